@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgent(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker-agent-test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	socket := path.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", socket)
+	assert.NoError(err)
+	defer l.Close()
+
+	served := make(chan error)
+	go func() {
+		served <- Serve(l, dir)
+	}()
+
+	c, err := Dial(socket)
+	assert.NoError(err)
+
+	stdout := bytes.Buffer{}
+	stderr := bytes.Buffer{}
+	result, err := c.Run(Step{Name: "first", Script: "#!/bin/sh\necho out\necho err >&2\nexit 3\n"}, &stdout, &stderr)
+	assert.NoError(err)
+	assert.Equal(3, result.ExitCode)
+	assert.Equal("out\n", stdout.String())
+	assert.Equal("err\n", stderr.String())
+
+	stdout.Reset()
+	result, err = c.Run(Step{Name: "second", Script: "#!/bin/sh\npwd\n", Dir: path.Join(dir, "work")}, &stdout, &stderr)
+	assert.NoError(err)
+	assert.Equal(0, result.ExitCode)
+	assert.Equal(path.Join(dir, "work")+"\n", stdout.String())
+
+	content := bytes.Repeat([]byte("stacker"), 10000)
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "file"), content, 0640))
+
+	read := bytes.Buffer{}
+	mode, err := c.ReadFile(path.Join(dir, "file"), &read)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0640), mode)
+	assert.Equal(content, read.Bytes())
+
+	// errors don't end the connection
+	_, err = c.ReadFile(path.Join(dir, "missing"), &read)
+	assert.Error(err)
+
+	assert.NoError(c.Shutdown())
+	assert.NoError(<-served)
+
+	// the scripts are cleaned up
+	ents, err := ioutil.ReadDir(dir)
+	assert.NoError(err)
+	assert.Len(ents, 3)
+}
+
+func TestLookupUser(t *testing.T) {
+	assert := assert.New(t)
+
+	uid, gid, err := lookupUser("root")
+	assert.NoError(err)
+	assert.Equal(uint32(0), uid)
+	assert.Equal(uint32(0), gid)
+
+	uid, gid, err = lookupUser("1234:5678")
+	assert.NoError(err)
+	assert.Equal(uint32(1234), uid)
+	assert.Equal(uint32(5678), gid)
+
+	_, _, err = lookupUser("stacker-no-such-user")
+	assert.Error(err)
+}
@@ -0,0 +1,117 @@
+package agent
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Client is a connection to an agent.
+type Client struct {
+	conn net.Conn
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+// Dial connects to the agent listening on socket.
+func Dial(socket string) (*Client, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't connect to agent")
+	}
+
+	return &Client{conn: conn, enc: json.NewEncoder(conn), dec: json.NewDecoder(conn)}, nil
+}
+
+func (c *Client) request(req Request) error {
+	return errors.Wrapf(c.enc.Encode(req), "couldn't send %s request", req.Type)
+}
+
+func (c *Client) event() (Event, error) {
+	ev := Event{}
+	if err := c.dec.Decode(&ev); err != nil {
+		return ev, errors.Wrapf(err, "couldn't read from agent")
+	}
+
+	if ev.Type == EventError {
+		return ev, errors.Errorf("agent: %s", ev.Error)
+	}
+
+	return ev, nil
+}
+
+// Run runs step's script (which should start with a shebang), writing its
+// output to stdout and stderr.
+func (c *Client) Run(step Step, stdout io.Writer, stderr io.Writer) (StepResult, error) {
+	req := Request{Type: RequestRun, Step: step.Name, Script: step.Script, User: step.User, Dir: step.Dir, Umask: step.Umask}
+	if err := c.request(req); err != nil {
+		return StepResult{}, err
+	}
+
+	for {
+		ev, err := c.event()
+		if err != nil {
+			return StepResult{}, err
+		}
+
+		switch ev.Type {
+		case EventOutput:
+			w := stdout
+			if ev.Stream == Stderr {
+				w = stderr
+			}
+			if _, err := w.Write(ev.Data); err != nil {
+				return StepResult{}, errors.WithStack(err)
+			}
+		case EventExit:
+			return StepResult{ExitCode: ev.ExitCode, Duration: ev.Duration}, nil
+		default:
+			return StepResult{}, errors.Errorf("unexpected %s event from agent", ev.Type)
+		}
+	}
+}
+
+// ReadFile writes the contents of the file p in the container to w,
+// returning its mode.
+func (c *Client) ReadFile(p string, w io.Writer) (os.FileMode, error) {
+	if err := c.request(Request{Type: RequestReadFile, Path: p}); err != nil {
+		return 0, err
+	}
+
+	for {
+		ev, err := c.event()
+		if err != nil {
+			return 0, err
+		}
+
+		switch ev.Type {
+		case EventData:
+			if _, err := w.Write(ev.Data); err != nil {
+				return 0, errors.WithStack(err)
+			}
+		case EventDone:
+			return ev.Mode, nil
+		default:
+			return 0, errors.Errorf("unexpected %s event from agent", ev.Type)
+		}
+	}
+}
+
+// Shutdown makes the agent exit, and closes the connection.
+func (c *Client) Shutdown() error {
+	defer c.Close()
+
+	if err := c.request(Request{Type: RequestShutdown}); err != nil {
+		return err
+	}
+
+	_, err := c.event()
+	return err
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
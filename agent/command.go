@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Command returns a command that runs script as usr, a docker style
+// user[:group] whose names are looked up in this system's /etc/passwd and
+// /etc/group, in dir, which is created if it doesn't exist, with the octal
+// umask. Empty usr, dir or umask leave those as they are. Since umasks are
+// per process, setting one sets this process's too.
+func Command(script string, usr string, dir string, umask string) (*exec.Cmd, error) {
+	cmd := exec.Command(script)
+
+	if umask != "" {
+		mask, err := strconv.ParseUint(umask, 8, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad umask %s", umask)
+		}
+		syscall.Umask(int(mask))
+	}
+
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, errors.Wrapf(err, "couldn't create working dir %s", dir)
+		}
+		cmd.Dir = dir
+	}
+
+	if usr != "" {
+		uid, gid, err := lookupUser(usr)
+		if err != nil {
+			return nil, err
+		}
+
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uid, Gid: gid},
+		}
+	}
+
+	return cmd, nil
+}
+
+func lookupUser(spec string) (uint32, uint32, error) {
+	name, group := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, group = spec[:i], spec[i+1:]
+	}
+
+	uid, err := strconv.ParseUint(name, 10, 32)
+	gid := uint64(0)
+	if err != nil {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "couldn't find user %s", name)
+		}
+
+		uid, _ = strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ = strconv.ParseUint(u.Gid, 10, 32)
+	} else if u, err := user.LookupId(name); err == nil {
+		// like docker, a numeric user gets its primary group if it
+		// has one
+		gid, _ = strconv.ParseUint(u.Gid, 10, 32)
+	}
+
+	if group != "" {
+		gid, err = strconv.ParseUint(group, 10, 32)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return 0, 0, errors.Wrapf(err, "couldn't find group %s", group)
+			}
+
+			gid, _ = strconv.ParseUint(g.Gid, 10, 32)
+		}
+	}
+
+	return uint32(uid), uint32(gid), nil
+}
@@ -0,0 +1,87 @@
+// Package agent is the stacker agent, which runs in build containers and
+// runs steps and does file operations on stacker's behalf, and the client
+// stacker talks to it with.
+//
+// The protocol is newline delimited JSON over a unix socket: stacker sends a
+// Request, and the agent answers with a stream of Events, the last of which
+// is either EventExit, EventDone or EventError.
+package agent
+
+import (
+	"os"
+	"time"
+)
+
+// Request types
+const (
+	// RequestRun runs Script as the step Step, as User in Dir with Umask
+	// (see Command()).
+	RequestRun = "run"
+	// RequestReadFile sends the contents of the file Path.
+	RequestReadFile = "read_file"
+	// RequestShutdown makes the agent exit.
+	RequestShutdown = "shutdown"
+)
+
+// Event types
+const (
+	// EventOutput is some of a step's output on Stream.
+	EventOutput = "output"
+	// EventExit is the end of a step.
+	EventExit = "exit"
+	// EventData is some of the contents of a file.
+	EventData = "data"
+	// EventDone is the successful end of a request that isn't a step.
+	EventDone = "done"
+	// EventError is a request that couldn't be done.
+	EventError = "error"
+)
+
+// Output streams
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+)
+
+type Request struct {
+	Type   string `json:"type"`
+	Step   string `json:"step,omitempty"`
+	Script string `json:"script,omitempty"`
+	Path   string `json:"path,omitempty"`
+	User   string `json:"user,omitempty"`
+	Dir    string `json:"dir,omitempty"`
+	Umask  string `json:"umask,omitempty"`
+}
+
+type Event struct {
+	Type   string `json:"type"`
+	Step   string `json:"step,omitempty"`
+	Stream string `json:"stream,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+
+	// for EventExit
+	ExitCode int           `json:"exit_code"`
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// for EventDone of RequestReadFile
+	Mode os.FileMode `json:"mode,omitempty"`
+
+	// for EventError
+	Error string `json:"error,omitempty"`
+}
+
+// Step is a script for the agent to run.
+type Step struct {
+	Name   string
+	Script string
+	// User, Dir and Umask are as for Command()
+	User  string
+	Dir   string
+	Umask string
+}
+
+// StepResult is how a step went.
+type StepResult struct {
+	ExitCode int
+	Duration time.Duration
+}
@@ -0,0 +1,171 @@
+package agent
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/pkg/errors"
+)
+
+// Serve answers the requests of the connections to l, one at a time, until
+// one of them asks it to shut down. Scripts are written to scriptDir to be
+// run, so that they don't end up in the rootfs.
+func Serve(l net.Listener, scriptDir string) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return errors.Wrapf(err, "couldn't accept connection")
+		}
+
+		shutdown, err := serveConn(conn, scriptDir)
+		conn.Close()
+		if err != nil {
+			log.Infof("agent connection failed: %v", err)
+		}
+
+		if shutdown {
+			return nil
+		}
+	}
+}
+
+// eventWriter sends Events on a connection; steps' stdout and stderr write
+// to it concurrently.
+type eventWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (ew *eventWriter) send(ev Event) error {
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	return errors.WithStack(ew.enc.Encode(ev))
+}
+
+// outputWriter is an io.Writer for one of a step's output streams.
+type outputWriter struct {
+	ew     *eventWriter
+	step   string
+	stream string
+}
+
+func (ow outputWriter) Write(p []byte) (int, error) {
+	// the encoder is done with p by the time Write returns
+	if err := ow.ew.send(Event{Type: EventOutput, Step: ow.step, Stream: ow.stream, Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func serveConn(conn net.Conn, scriptDir string) (bool, error) {
+	dec := json.NewDecoder(conn)
+	ew := &eventWriter{enc: json.NewEncoder(conn)}
+
+	for {
+		req := Request{}
+		if err := dec.Decode(&req); err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, errors.Wrapf(err, "couldn't decode request")
+		}
+
+		var err error
+		switch req.Type {
+		case RequestRun:
+			err = runStep(ew, req, scriptDir)
+		case RequestReadFile:
+			err = readFile(ew, req.Path)
+		case RequestShutdown:
+			return true, ew.send(Event{Type: EventDone})
+		default:
+			err = errors.Errorf("unknown request type %s", req.Type)
+		}
+
+		if err != nil {
+			if err := ew.send(Event{Type: EventError, Step: req.Step, Error: err.Error()}); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+func runStep(ew *eventWriter, req Request, scriptDir string) error {
+	f, err := ioutil.TempFile(scriptDir, "step-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(req.Script)
+	f.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := os.Chmod(f.Name(), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	cmd, err := Command(f.Name(), req.User, req.Dir, req.Umask)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = outputWriter{ew, req.Step, Stdout}
+	cmd.Stderr = outputWriter{ew, req.Step, Stderr}
+
+	start := time.Now()
+	err = cmd.Run()
+	exitCode := 0
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return errors.Wrapf(err, "couldn't run step %s", req.Step)
+		}
+		exitCode = exitErr.ExitCode()
+	}
+
+	return ew.send(Event{Type: EventExit, Step: req.Step, ExitCode: exitCode, Duration: time.Since(start)})
+}
+
+func readFile(ew *eventWriter, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !fi.Mode().IsRegular() {
+		return errors.Errorf("%s isn't a regular file", p)
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := ew.send(Event{Type: EventData, Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "couldn't read %s", p)
+		}
+	}
+
+	return ew.send(Event{Type: EventDone, Mode: fi.Mode()})
+}
@@ -3,4 +3,9 @@ package stacker
 const (
 	GitVersionAnnotation      = "com.cisco.stacker.git_version"
 	StackerContentsAnnotation = "com.cisco.stacker.stacker_yaml"
+	GitCommitAnnotation       = "org.opencontainers.image.revision"
+	GitSourceAnnotation       = "org.opencontainers.image.source"
+	GitDirtyAnnotation        = "com.cisco.stacker.git_dirty"
+	GitBranchAnnotation       = "com.cisco.stacker.git_branch"
+	VerityChainAnnotation     = "com.cisco.stacker.squashfs_verity_chain"
 )
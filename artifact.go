@@ -0,0 +1,222 @@
+package stacker
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/storage"
+	"github.com/anuvu/stacker/types"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultArtifactType is the config media type of artifacts that
+	// don't say what kind of artifact they are, as oras uses.
+	DefaultArtifactType = "application/vnd.unknown.config.v1+json"
+
+	// DefaultArtifactFileMediaType and DefaultArtifactDirMediaType are
+	// the media types of artifacts' blobs, if they don't set one.
+	DefaultArtifactFileMediaType = "application/octet-stream"
+	DefaultArtifactDirMediaType  = ispec.MediaTypeImageLayer
+)
+
+// artifactSpec is how to package a file from a layer's filesystem as an OCI
+// artifact.
+type artifactSpec struct {
+	// Path is the file (or directory, if DirMediaType isn't empty) in
+	// the layer's filesystem.
+	Path string
+
+	// FileMediaType and DirMediaType are the media type of the
+	// artifact's blob if Path is a file or a directory.
+	FileMediaType string
+	DirMediaType  string
+
+	// Validate, if it isn't nil, checks that the file at Path is what it
+	// should be.
+	Validate func(file string) error
+
+	// ConfigMediaType is the media type of the artifact's config, and
+	// Config its content, given the descriptor of the blob.
+	ConfigMediaType string
+	Config          func(blob ispec.Descriptor) (interface{}, error)
+}
+
+// generateArtifact replaces the images built for layer name (which l says
+// is an artifact) in the OCI output with the artifact, returning its
+// manifest's descriptor for each layer type.
+func generateArtifact(config types.StackerConfig, s types.Storage, oci casext.Engine, name string, l *types.Layer, layerTypes []types.LayerType) (map[types.LayerType]ispec.Descriptor, error) {
+	if l.Output != nil {
+		return outputArtifact(config, s, oci, name, l, layerTypes)
+	}
+
+	var spec artifactSpec
+	var err error
+	if l.Wasm != nil {
+		spec, err = wasmArtifact(config, l)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		spec = artifactSpec{
+			Path:            l.Artifact.Path,
+			FileMediaType:   l.Artifact.MediaType,
+			DirMediaType:    l.Artifact.MediaType,
+			ConfigMediaType: l.Artifact.ArtifactType,
+			Config: func(ispec.Descriptor) (interface{}, error) {
+				return struct{}{}, nil
+			},
+		}
+
+		if spec.FileMediaType == "" {
+			spec.FileMediaType = DefaultArtifactFileMediaType
+			spec.DirMediaType = DefaultArtifactDirMediaType
+		}
+
+		if spec.ConfigMediaType == "" {
+			spec.ConfigMediaType = DefaultArtifactType
+		}
+	}
+
+	return packageArtifact(config, s, oci, name, layerTypes, spec)
+}
+
+// packageArtifact replaces the images built for layer name in the OCI output
+// with the artifact spec describes. The artifact keeps the images'
+// annotations.
+func packageArtifact(config types.StackerConfig, s types.Storage, oci casext.Engine, name string, layerTypes []types.LayerType, spec artifactSpec) (map[types.LayerType]ispec.Descriptor, error) {
+	writable, cleanup, err := s.TemporaryWritableSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	// the layer's filesystem is whatever its run made it, so symlinks in
+	// the path are followed inside it, not on the host
+	source, err := securejoin.SecureJoin(path.Join(config.RootFSDir, writable, "rootfs"), spec.Path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "bad artifact path %s", spec.Path)
+	}
+	return putArtifact(config, oci, name, layerTypes, spec, source)
+}
+
+// putArtifact is packageArtifact for the artifact's file at source on the
+// host, rather than in the layer's filesystem.
+func putArtifact(config types.StackerConfig, oci casext.Engine, name string, layerTypes []types.LayerType, spec artifactSpec, source string) (map[types.LayerType]ispec.Descriptor, error) {
+	fi, err := os.Stat(source)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't find artifact %s", spec.Path)
+	}
+
+	if spec.Validate != nil {
+		if err := spec.Validate(source); err != nil {
+			return nil, errors.Wrapf(err, "bad artifact %s", spec.Path)
+		}
+	}
+
+	mediaType := spec.FileMediaType
+	var blob io.ReadCloser
+	if fi.IsDir() {
+		if spec.DirMediaType == "" {
+			return nil, errors.Errorf("artifact %s is a directory", spec.Path)
+		}
+		mediaType = spec.DirMediaType
+
+		mapOptions, err := storage.RepackMapOptions(config)
+		if err != nil {
+			return nil, err
+		}
+
+		blob = layer.GenerateInsertLayer(source, "/", false, &layer.RepackOptions{MapOptions: mapOptions})
+	} else {
+		blob, err = os.Open(source)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	defer blob.Close()
+
+	blobDigest, blobSize, err := oci.PutBlob(context.Background(), blob)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't add artifact %s", spec.Path)
+	}
+
+	blobDesc := ispec.Descriptor{
+		MediaType:   mediaType,
+		Digest:      blobDigest,
+		Size:        blobSize,
+		Annotations: map[string]string{ispec.AnnotationTitle: path.Base(spec.Path)},
+	}
+
+	artifactConfig, err := spec.Config(blobDesc)
+	if err != nil {
+		return nil, err
+	}
+
+	configDigest, configSize, err := oci.PutBlobJSON(context.Background(), artifactConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := map[types.LayerType]ispec.Descriptor{}
+	for _, layerType := range layerTypes {
+		layerName := layerType.LayerName(name)
+		imageManifest, err := stackeroci.LookupManifest(oci, layerName)
+		if err != nil {
+			return nil, err
+		}
+
+		// the config saying when the image was created is replaced,
+		// so prune finds it in the annotations instead
+		created, err := stackeroci.LookupCreated(oci, imageManifest)
+		if err != nil {
+			return nil, err
+		}
+
+		annotations := map[string]string{}
+		for k, v := range imageManifest.Annotations {
+			annotations[k] = v
+		}
+		if _, ok := annotations[ispec.AnnotationCreated]; !ok && !created.IsZero() {
+			annotations[ispec.AnnotationCreated] = created.UTC().Format(time.RFC3339)
+		}
+
+		manifest := ispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Config: ispec.Descriptor{
+				MediaType: spec.ConfigMediaType,
+				Digest:    configDigest,
+				Size:      configSize,
+			},
+			Layers:      []ispec.Descriptor{blobDesc},
+			Annotations: annotations,
+		}
+
+		manifestDigest, manifestSize, err := oci.PutBlobJSON(context.Background(), manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		desc := ispec.Descriptor{
+			MediaType: ispec.MediaTypeImageManifest,
+			Digest:    manifestDigest,
+			Size:      manifestSize,
+		}
+		if err := oci.UpdateReference(context.Background(), layerName, desc); err != nil {
+			return nil, err
+		}
+
+		manifests[layerType] = desc
+	}
+
+	return manifests, nil
+}
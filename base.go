@@ -1,16 +1,22 @@
 package stacker
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
+	"strings"
 
 	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/limits"
 	"github.com/anuvu/stacker/log"
+	stackeroci "github.com/anuvu/stacker/oci"
 	"github.com/anuvu/stacker/types"
 	"github.com/klauspost/pgzip"
-	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/opencontainers/umoci/oci/layer"
 	"github.com/pkg/errors"
@@ -38,8 +44,16 @@ func GetBase(o BaseLayerOpts) error {
 			return err
 		}
 
-		_, err := acquireUrl(o.Config, o.Storage, o.Layer.From.Url, cacheDir, o.Progress, "")
-		return err
+		if err := validateHash(o.Layer.From.Hash); err != nil {
+			return err
+		}
+
+		tar, err := acquireUrl(o.Config, o.Storage, o.Layer.From.Url, cacheDir, o.Progress, "", o.Cache.files)
+		if err != nil {
+			return err
+		}
+
+		return verifyTarBaseHash(o, tar)
 	/* now we can do all the containers/image types */
 	case types.OCILayer:
 		fallthrough
@@ -67,6 +81,10 @@ func SetupRootfs(o BaseLayerOpts) error {
 		return o.Storage.Restore(o.Layer.From.Tag, o.Name)
 	}
 
+	if o.Layer.From.Type == types.TarLayer {
+		return setupTarRootfs(o)
+	}
+
 	// For everything else, we create a new snapshot and extract whatever
 	// we can on top of it.
 	if err := o.Storage.Create(o.Name); err != nil {
@@ -74,12 +92,6 @@ func SetupRootfs(o BaseLayerOpts) error {
 	}
 
 	switch o.Layer.From.Type {
-	case types.TarLayer:
-		err := o.Storage.SetupEmptyRootfs(o.Name)
-		if err != nil {
-			return err
-		}
-		return setupTarRootfs(o)
 	case types.OCILayer:
 		fallthrough
 	case types.DockerLayer:
@@ -102,13 +114,13 @@ func importContainersImage(is *types.ImageSource, config types.StackerConfig, pr
 
 	// Note that we can do this over the top of the cache every time, since
 	// skopeo should be smart enough to only copy layers that have changed.
-	cacheDir := path.Join(config.StackerDir, "layer-bases", "oci")
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+	cacheDir, err := layerBasesLayout(config)
+	if err != nil {
 		return err
 	}
 
 	defer func() {
-		oci, err := umoci.OpenLayout(cacheDir)
+		oci, err := stackeroci.OpenLayout(cacheDir)
 		if err != nil {
 			// Some error might have occurred, in which case we
 			// don't have a valid OCI layout, which is fine.
@@ -122,15 +134,29 @@ func importContainersImage(is *types.ImageSource, config types.StackerConfig, pr
 		progressWriter = os.Stderr
 	}
 
+	if is.Type == types.DockerLayer {
+		release, err := limits.Acquire(config, limits.Network)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
 	log.Infof("loading %s", toImport)
 	err = lib.ImageCopy(lib.ImageCopyOpts{
-		Src:        toImport,
-		Dest:       fmt.Sprintf("oci:%s:%s", cacheDir, tag),
-		SrcSkipTLS: is.Insecure,
-		Progress:   progressWriter,
+		Src:                  toImport,
+		Dest:                 fmt.Sprintf("oci:%s:%s", cacheDir, tag),
+		SrcSkipTLS:           is.Insecure,
+		TmpDir:               config.TmpDir,
+		MaxParallelDownloads: config.MaxParallelDownloads,
+		Progress:             progressWriter,
 	})
 	if err != nil {
-		return errors.Wrapf(err, "couldn't import base layer %s", tag)
+		err = errors.Wrapf(err, "couldn't import base layer %s", tag)
+		if is.Type == types.DockerLayer {
+			err = types.WithKind(types.NetworkError, err)
+		}
+		return err
 	}
 
 	return err
@@ -148,13 +174,128 @@ func setupContainersImageRootfs(o BaseLayerOpts) error {
 	return o.Storage.Unpack(cacheTag, o.Name)
 }
 
+// verifyTarBaseHash checks that the tarball of a tar base is the one its
+// hash (if it has one) says.
+func verifyTarBaseHash(o BaseLayerOpts, tar string) error {
+	if o.Layer.From.Hash == "" {
+		return nil
+	}
+
+	actualHash, err := o.Cache.files.HashFile(tar, false)
+	if err != nil {
+		return err
+	}
+
+	actualHash = strings.TrimPrefix(actualHash, "sha256:")
+	if actualHash != strings.ToLower(o.Layer.From.Hash) {
+		return errors.Errorf("The requested hash of %s base is different than the actual hash: %s != %s",
+			o.Layer.From.Url, o.Layer.From.Hash, actualHash)
+	}
+
+	return nil
+}
+
+// tarExtraction is the storage tag the tarball of a tar base is extracted
+// to, which is named after the tarball's hash, so that layers built from the
+// same tarball share one extraction.
+func tarExtraction(o BaseLayerOpts, tar string) (string, error) {
+	hash, err := o.Cache.files.HashFile(tar, false)
+	if err != nil {
+		return "", err
+	}
+
+	return "tar-base-" + strings.TrimPrefix(hash, "sha256:"), nil
+}
+
 func setupTarRootfs(o BaseLayerOpts) error {
-	// initialize an empty image, then extract it
 	cacheDir := path.Join(o.Config.StackerDir, "layer-bases")
 	tar := path.Join(cacheDir, path.Base(o.Layer.From.Url))
 
-	layerPath := o.Storage.TarExtractLocation(o.Name)
-	return unpackTar(layerPath, tar)
+	extracted, err := tarExtraction(o, tar)
+	if err != nil {
+		return err
+	}
+
+	if o.Storage.Exists(extracted) {
+		log.Infof("using cached extraction of %s", o.Layer.From.Url)
+		return o.Storage.Restore(extracted, o.Name)
+	}
+
+	// initialize an empty image, then extract it; if anything goes
+	// wrong, don't leave a half extracted tarball around to be reused
+	if err := o.Storage.Create(extracted); err != nil {
+		return err
+	}
+
+	err = o.Storage.SetupEmptyRootfs(extracted)
+	if err == nil {
+		err = unpackTar(o.Storage.TarExtractLocation(extracted), tar)
+	}
+	if err == nil {
+		err = o.Storage.Finalize(extracted)
+	}
+	if err != nil {
+		o.Storage.Delete(extracted)
+		return err
+	}
+
+	return o.Storage.Restore(extracted, o.Name)
+}
+
+// The magic numbers tarballs may be compressed with.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompressTar returns the uncompressed stream of the tarball tar, which
+// may be compressed with gzip, xz or zstd.
+func decompressTar(tar string, tarReader io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(tarReader)
+	magic, err := buffered.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "couldn't read %s", tar)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		r, err := pgzip.NewReader(buffered)
+		return r, errors.Wrapf(err, "couldn't read gzip tarball %s", tar)
+	case bytes.HasPrefix(magic, xzMagic):
+		// there's no xz library around, so use the tool
+		cmd := exec.Command("xz", "-dc")
+		cmd.Stdin = buffered
+		cmd.Stderr = os.Stderr
+		r, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, errors.Wrapf(err, "couldn't decompress xz tarball %s", tar)
+		}
+		return &cmdReader{r, cmd}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		r, err := stackeroci.NewZstdReader(buffered)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't read zstd tarball %s", tar)
+		}
+		return r.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(buffered), nil
+	}
+}
+
+// cmdReader reads a command's output, and waits for the command once it's
+// closed.
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (cr *cmdReader) Close() error {
+	cr.ReadCloser.Close()
+	return errors.Wrapf(cr.cmd.Wait(), "%s failed", cr.cmd.Path)
 }
 
 func unpackTar(destDir string, tar string) error {
@@ -163,17 +304,15 @@ func unpackTar(destDir string, tar string) error {
 		return errors.Wrapf(err, "couldn't open %s", tar)
 	}
 	defer tarReader.Close()
-	var uncompressed io.ReadCloser
-	uncompressed, err = pgzip.NewReader(tarReader)
+
+	uncompressed, err := decompressTar(tar, tarReader)
 	if err != nil {
-		_, err = tarReader.Seek(0, os.SEEK_SET)
-		if err != nil {
-			return errors.Wrapf(err, "failed to 0 seek %s", tar)
-		}
-		uncompressed = tarReader
-	} else {
-		defer uncompressed.Close()
+		return err
 	}
 
-	return layer.UnpackLayer(destDir, uncompressed, &layer.UnpackOptions{KeepDirlinks: true})
+	err = layer.UnpackLayer(destDir, uncompressed, &layer.UnpackOptions{KeepDirlinks: true})
+	if closeErr := uncompressed.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
@@ -0,0 +1,167 @@
+package stacker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/types"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// sameFilesystem returns whether a and b are on the same filesystem, i.e.
+// whether files can be renamed from one to the other.
+func sameFilesystem(a, b string) (bool, error) {
+	var sa, sb syscall.Stat_t
+	if err := syscall.Stat(a, &sa); err != nil {
+		return false, errors.Wrapf(err, "couldn't stat %s", a)
+	}
+	if err := syscall.Stat(b, &sb); err != nil {
+		return false, errors.Wrapf(err, "couldn't stat %s", b)
+	}
+
+	return sa.Dev == sb.Dev, nil
+}
+
+// moveBlobs moves the blobs in the blobs dir from into the one to, and
+// removes from. Blobs that are already in to are the same (blobs are named
+// after their digest), so those are just deleted.
+func moveBlobs(from, to string) error {
+	algorithms, err := ioutil.ReadDir(from)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, alg := range algorithms {
+		if err := os.MkdirAll(path.Join(to, alg.Name()), 0755); err != nil {
+			return errors.WithStack(err)
+		}
+
+		blobs, err := ioutil.ReadDir(path.Join(from, alg.Name()))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		for _, blob := range blobs {
+			source := path.Join(from, alg.Name(), blob.Name())
+			dest := path.Join(to, alg.Name(), blob.Name())
+			if _, err := os.Stat(dest); err == nil {
+				continue
+			}
+
+			if err := os.Rename(source, dest); err != nil {
+				return errors.Wrapf(err, "couldn't move %s to the base image cache", source)
+			}
+		}
+	}
+
+	return errors.WithStack(os.RemoveAll(from))
+}
+
+// layerBasesLayout returns the layout docker and oci bases are copied into,
+// creating it if it doesn't exist. If there is a base image cache, the
+// layout's blobs dir is a link to the cache's, so that blobs another stacker
+// dir has already downloaded are reused instead of being downloaded and
+// stored again; each stacker dir still has its own index of the bases it
+// uses.
+func layerBasesLayout(config types.StackerConfig) (string, error) {
+	dir := path.Join(config.StackerDir, "layer-bases", "oci")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	if config.BaseImageCache == "" {
+		return dir, nil
+	}
+
+	shared := path.Join(config.BaseImageCache, "blobs")
+	if err := os.MkdirAll(path.Join(shared, "sha256"), 0755); err != nil {
+		return "", errors.Wrapf(err, "couldn't create base image cache")
+	}
+
+	blobs := path.Join(dir, "blobs")
+	fi, err := os.Lstat(blobs)
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.WithStack(err)
+	}
+	if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if target, err := os.Readlink(blobs); err == nil && target == shared {
+			return dir, nil
+		}
+	}
+
+	// the blobs are renamed into place by whatever copies them, which
+	// doesn't work across filesystems
+	same, err := sameFilesystem(dir, shared)
+	if err != nil {
+		return "", err
+	}
+	if !same {
+		log.Infof("WARNING: base_image_cache %s isn't on the same filesystem as %s, not using it", config.BaseImageCache, config.StackerDir)
+		return dir, nil
+	}
+
+	if fi != nil && fi.IsDir() {
+		log.Debugf("moving the blobs in %s to %s", blobs, shared)
+		if err := moveBlobs(blobs, shared); err != nil {
+			return "", err
+		}
+	} else if fi != nil {
+		if err := os.Remove(blobs); err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+
+	return dir, errors.Wrapf(os.Symlink(shared, blobs), "couldn't link %s to the base image cache", blobs)
+}
+
+// copyLayoutBlobs copies the blobs of the tags in the layout at ociDir into
+// the blobs dir dest, instead of copying all the blobs in a shared blobs dir.
+func copyLayoutBlobs(ociDir string, dest string) error {
+	oci, err := stackeroci.OpenLayout(ociDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	index, err := oci.GetIndex(context.Background())
+	if err != nil {
+		return err
+	}
+
+	for _, desc := range index.Manifests {
+		err := oci.Walk(context.Background(), desc, func(dp casext.DescriptorPath) error {
+			d := dp.Descriptor().Digest
+			if err := os.MkdirAll(path.Join(dest, d.Algorithm().String()), 0755); err != nil {
+				return errors.WithStack(err)
+			}
+
+			blob := path.Join(d.Algorithm().String(), d.Encoded())
+			if _, err := os.Stat(path.Join(dest, blob)); os.IsNotExist(err) {
+				if err := lib.FileCopy(path.Join(dest, blob), path.Join(ociDir, "blobs", blob)); err != nil {
+					return err
+				}
+			}
+
+			// only manifests and indexes refer to other blobs
+			switch dp.Descriptor().MediaType {
+			case ispec.MediaTypeImageManifest, ispec.MediaTypeImageIndex:
+				return nil
+			default:
+				return casext.ErrSkipDescriptor
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package stacker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayerBasesLayout(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_base_cache_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	cache := path.Join(dir, "cache")
+	one := types.StackerConfig{StackerDir: path.Join(dir, "one"), BaseImageCache: cache}
+	two := types.StackerConfig{StackerDir: path.Join(dir, "two"), BaseImageCache: cache}
+
+	// a stacker dir from before there was a cache keeps its blobs
+	oci, err := umoci.CreateLayout(path.Join(one.StackerDir, "layer-bases", "oci"))
+	assert.NoError(err)
+	assert.NoError(umoci.NewImage(oci, "base"))
+	oci.Close()
+
+	layout, err := layerBasesLayout(one)
+	assert.NoError(err)
+	assert.Equal(path.Join(one.StackerDir, "layer-bases", "oci"), layout)
+
+	target, err := os.Readlink(path.Join(layout, "blobs"))
+	assert.NoError(err)
+	assert.Equal(path.Join(cache, "blobs"), target)
+
+	oci, err = umoci.OpenLayout(layout)
+	assert.NoError(err)
+	descs, err := oci.ResolveReference(context.Background(), "base")
+	assert.NoError(err)
+	oci.Close()
+	manifest := descs[0].Descriptor().Digest.Encoded()
+	_, err = os.Stat(path.Join(cache, "blobs", "sha256", manifest))
+	assert.NoError(err)
+
+	// it's only set up once, and other stacker dirs share it
+	_, err = layerBasesLayout(one)
+	assert.NoError(err)
+	other, err := layerBasesLayout(two)
+	assert.NoError(err)
+	_, err = os.Stat(path.Join(other, "blobs", "sha256", manifest))
+	assert.NoError(err)
+
+	// exports get a copy of just the blobs the stacker dir uses
+	exported := path.Join(dir, "exported")
+	assert.NoError(copyLayoutBlobs(layout, exported))
+	_, err = os.Stat(path.Join(exported, "sha256", manifest))
+	assert.NoError(err)
+
+	// without a cache, the layout keeps its own blobs
+	three := types.StackerConfig{StackerDir: path.Join(dir, "three")}
+	layout, err = layerBasesLayout(three)
+	assert.NoError(err)
+	_, err = os.Lstat(path.Join(layout, "blobs"))
+	assert.True(os.IsNotExist(err))
+}
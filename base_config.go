@@ -0,0 +1,175 @@
+package stacker
+
+import (
+	"path"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/storage"
+	"github.com/anuvu/stacker/types"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// withBaseImage calls f with the layout and manifest of the image name is
+// built on: the first of its bases that is in the output, or the containers
+// image the chain of build only layers it is built on started from. It
+// returns false without calling f if there is no such image, e.g. for tar
+// bases.
+func withBaseImage(config types.StackerConfig, oci casext.Engine, name string, sfm types.StackerFiles, f func(layout casext.Engine, manifest ispec.Manifest) error) (bool, error) {
+	baseTag, base, err := storage.FindFirstBaseInOutput(name, sfm)
+	if err != nil {
+		return false, err
+	}
+
+	if base == nil {
+		return false, nil
+	}
+
+	layout := oci
+	tag := baseTag
+	if baseTag == name || base.BuildOnly {
+		tag, err = base.From.ParseTag()
+		if err != nil {
+			return false, err
+		}
+
+		layout, err = stackeroci.OpenLayout(path.Join(config.StackerDir, "layer-bases", "oci"))
+		if err != nil {
+			return false, err
+		}
+		defer layout.Close()
+	}
+
+	manifest, err := stackeroci.LookupManifest(layout, tag)
+	if err != nil {
+		return false, errors.Wrapf(err, "couldn't find base image %s", tag)
+	}
+
+	return true, f(layout, manifest)
+}
+
+// baseImageConfig returns the config of the image name is built on (see
+// withBaseImage). ok is false if there is no such image.
+func baseImageConfig(config types.StackerConfig, oci casext.Engine, name string, sfm types.StackerFiles) (ispec.ImageConfig, bool, error) {
+	var imageConfig ispec.ImageConfig
+	ok, err := withBaseImage(config, oci, name, sfm, func(layout casext.Engine, manifest ispec.Manifest) error {
+		image, err := stackeroci.LookupConfig(layout, manifest.Config)
+		if err != nil {
+			return err
+		}
+
+		imageConfig = image.Config
+		return nil
+	})
+	return imageConfig, ok, err
+}
+
+// inheritedConfig is the environment, user and working dir the steps of a
+// layer with inherit_config run with: its base image's, like a Dockerfile's
+// RUN, with the layer's build_env, runtime_user and working_dir overriding
+// them.
+type inheritedConfig struct {
+	Env        []string
+	User       string
+	WorkingDir string
+}
+
+func inheritConfig(config types.StackerConfig, oci casext.Engine, name string, l *types.Layer, sfm types.StackerFiles) (inheritedConfig, error) {
+	inherited := inheritedConfig{}
+	if !l.InheritConfig {
+		return inherited, nil
+	}
+
+	baseConfig, ok, err := baseImageConfig(config, oci, name, sfm)
+	if err != nil {
+		return inherited, err
+	}
+
+	if ok {
+		inherited.Env = baseConfig.Env
+		inherited.User = baseConfig.User
+		inherited.WorkingDir = baseConfig.WorkingDir
+	}
+
+	if l.RuntimeUser != "" {
+		inherited.User = l.RuntimeUser
+	}
+
+	if l.WorkingDir != "" {
+		inherited.WorkingDir = l.WorkingDir
+	}
+
+	return inherited, nil
+}
+
+// baseLayers returns the layers of the layerType image name is built on: its
+// first base in the output (see withBaseImage), as that layer type. ok is
+// false if there is no such image, or it doesn't have layers of that type,
+// since those are converted into new ones.
+func baseLayers(config types.StackerConfig, oci casext.Engine, name string, layerType types.LayerType, sfm types.StackerFiles) ([]ispec.Descriptor, bool, error) {
+	baseTag, base, err := storage.FindFirstBaseInOutput(name, sfm)
+	if err != nil || base == nil {
+		return nil, false, err
+	}
+
+	layout := oci
+	tag := layerType.LayerName(baseTag)
+	if baseTag == name || base.BuildOnly {
+		tag, err = base.From.ParseTag()
+		if err != nil {
+			return nil, false, err
+		}
+
+		layout, err = stackeroci.OpenLayout(path.Join(config.StackerDir, "layer-bases", "oci"))
+		if err != nil {
+			return nil, false, err
+		}
+		defer layout.Close()
+	}
+
+	manifest, err := stackeroci.LookupManifest(layout, tag)
+	if err != nil {
+		// built with other layer types only
+		return nil, false, nil
+	}
+
+	if len(manifest.Layers) > 0 {
+		if lt, err := types.NewLayerTypeManifest(manifest); err != nil || lt != layerType {
+			return nil, false, nil
+		}
+	}
+
+	return manifest.Layers, true, nil
+}
+
+// producedNoChanges returns true if the layerType image name was built as
+// has exactly the layers of the image it is built on (see baseLayers), i.e.
+// its build didn't change the filesystem.
+func producedNoChanges(config types.StackerConfig, oci casext.Engine, name string, layerType types.LayerType, sfm types.StackerFiles) (bool, error) {
+	manifest, err := stackeroci.LookupManifest(oci, layerType.LayerName(name))
+	if err != nil {
+		return false, err
+	}
+
+	base, ok, err := baseLayers(config, oci, name, layerType, sfm)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return sameLayers(base, manifest.Layers), nil
+}
+
+func sameLayers(a []ispec.Descriptor, b []ispec.Descriptor) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i, desc := range a {
+		if desc.Digest != b[i].Digest {
+			return false
+		}
+	}
+
+	return true
+}
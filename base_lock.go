@@ -0,0 +1,189 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// LockedBase is the tag (and the digest of its manifest) a docker base with
+// a constraint was resolved to.
+type LockedBase struct {
+	Url        string `yaml:"url"`
+	Constraint string `yaml:"constraint"`
+	Tag        string `yaml:"tag"`
+	Digest     string `yaml:"digest"`
+}
+
+// BaseLock is a stacker file's lock file: the bases its layers' constraints
+// were resolved to, by layer name.
+type BaseLock struct {
+	Bases map[string]LockedBase `yaml:"bases"`
+}
+
+// baseLockFile returns the lock file of the stacker file at file: the same
+// name, with .lock instead of its extension.
+func baseLockFile(file string) string {
+	return strings.TrimSuffix(file, path.Ext(file)) + ".lock"
+}
+
+func readBaseLock(p string) (*BaseLock, error) {
+	lock := &BaseLock{}
+	content, err := ioutil.ReadFile(p)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+
+	if err := yaml.Unmarshal(content, lock); err != nil {
+		return nil, errors.Wrapf(err, "bad lock file %s", p)
+	}
+
+	if lock.Bases == nil {
+		lock.Bases = map[string]LockedBase{}
+	}
+
+	return lock, nil
+}
+
+func (bl *BaseLock) write(p string) error {
+	content, err := yaml.Marshal(bl)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(os.Rename(tmp, p))
+}
+
+// baseLockMode is what resolveBases does about bases that aren't locked.
+type baseLockMode int
+
+const (
+	// lockNew resolves and locks the bases that aren't locked yet.
+	lockNew baseLockMode = iota
+	// lockUpdate resolves and locks all of them again.
+	lockUpdate
+	// lockReadOnly neither talks to the registry nor writes the lock
+	// file: bases that aren't locked are an error, since nothing can have
+	// been built from them.
+	lockReadOnly
+)
+
+// resolveStackerFilesBases does resolveBases for each of the stacker files in
+// sfm. Builds lock the bases they use; publish, verify, graph and so on use
+// lockReadOnly, so that their cache lookups see the bases the layers were
+// built from.
+func resolveStackerFilesBases(sfm types.StackerFiles, mode baseLockMode) error {
+	for file, sf := range sfm {
+		if err := resolveBases(file, sf, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveBases points the docker bases with a constraint in the stacker file
+// sf (at file) at the digest their lock file says, so that the build keeps
+// using the same image even if the tag it was resolved to moves. Bases that
+// aren't locked yet (or whose url or constraint changed, or all of them with
+// lockUpdate) are resolved to the newest tag in their constraint's range,
+// and added to the lock file.
+func resolveBases(file string, sf *types.Stackerfile, mode baseLockMode) error {
+	lockFile := baseLockFile(file)
+	lock, err := readBaseLock(lockFile)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	constrained := map[string]bool{}
+	for _, name := range sf.FileOrder {
+		l, _ := sf.Get(name)
+		if l.From == nil || l.From.Type != types.DockerLayer || l.From.Constraint == "" {
+			continue
+		}
+		constrained[name] = true
+
+		// already resolved; a constrained url can't have a digest of
+		// its own
+		if strings.Contains(l.From.Url[strings.LastIndex(l.From.Url, "/")+1:], "@") {
+			continue
+		}
+
+		locked, ok := lock.Bases[name]
+		if ok && mode != lockUpdate && locked.Url == l.From.Url && locked.Constraint == l.From.Constraint {
+			l.From.Url = l.From.Url + "@" + locked.Digest
+			continue
+		}
+
+		if mode == lockReadOnly {
+			return errors.Errorf("%s: %s %s isn't locked in %s, it needs to be built first", name, l.From.Url, l.From.Constraint, lockFile)
+		}
+
+		resolved, err := resolveBase(name, l.From)
+		if err != nil {
+			return err
+		}
+
+		lock.Bases[name] = resolved
+		changed = true
+		l.From.Url = l.From.Url + "@" + resolved.Digest
+	}
+
+	for name := range lock.Bases {
+		if !constrained[name] {
+			delete(lock.Bases, name)
+			changed = true
+		}
+	}
+
+	if !changed || mode == lockReadOnly {
+		return nil
+	}
+
+	if len(lock.Bases) == 0 {
+		return errors.WithStack(os.Remove(lockFile))
+	}
+
+	return lock.write(lockFile)
+}
+
+// resolveBase returns the newest tag of the repository of the base is that
+// is in its constraint's range.
+func resolveBase(name string, is *types.ImageSource) (LockedBase, error) {
+	constraint, err := types.ParseVersionConstraint(is.Constraint)
+	if err != nil {
+		return LockedBase{}, err
+	}
+
+	tags, err := lib.RepositoryTags(is.Url, "", "", is.Insecure)
+	if err != nil {
+		return LockedBase{}, types.WithKind(types.NetworkError, err)
+	}
+
+	tag, ok := constraint.Latest(tags)
+	if !ok {
+		return LockedBase{}, errors.Errorf("%s: no tag of %s is in %s", name, is.Url, is.Constraint)
+	}
+
+	ref := is.Url + ":" + tag
+	d, err := lib.ManifestDigest(ref, "", "", is.Insecure)
+	if err != nil {
+		return LockedBase{}, types.WithKind(types.NetworkError, err)
+	}
+
+	log.Infof("%s: resolved %s %s to %s (%s)", name, is.Url, is.Constraint, tag, d)
+	return LockedBase{Url: is.Url, Constraint: is.Constraint, Tag: tag, Digest: d.String()}, nil
+}
@@ -0,0 +1,154 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/anuvu/stacker/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBaseLockFile(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("/build/stacker.lock", baseLockFile("/build/stacker.yaml"))
+	assert.Equal("/build/os.lock", baseLockFile("/build/os.yml"))
+	assert.Equal("/build/stackerfile.lock", baseLockFile("/build/stackerfile"))
+}
+
+func TestBaseLockRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker-base-lock-")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	p := path.Join(dir, "stacker.lock")
+	lock, err := readBaseLock(p)
+	assert.NoError(err)
+	assert.Empty(lock.Bases)
+
+	lock.Bases["base"] = LockedBase{
+		Url:        "docker://example.com/myorg/base",
+		Constraint: "^2.3",
+		Tag:        "2.4.1",
+		Digest:     "sha256:1234",
+	}
+	assert.NoError(lock.write(p))
+
+	read, err := readBaseLock(p)
+	assert.NoError(err)
+	assert.Equal(lock, read)
+}
+
+func TestResolveBasesDropsStaleLocks(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker-base-lock-")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "stacker.yaml")
+	content := `base:
+    from:
+        type: docker
+        url: docker://example.com/myorg/base:2.4.1
+`
+	assert.NoError(ioutil.WriteFile(file, []byte(content), 0644))
+
+	// the layer doesn't have a constraint anymore
+	lock := &BaseLock{Bases: map[string]LockedBase{"base": {Url: "docker://example.com/myorg/base", Constraint: "^2.3", Tag: "2.4.1"}}}
+	assert.NoError(lock.write(baseLockFile(file)))
+
+	sf, err := types.NewStackerfile(file, nil)
+	assert.NoError(err)
+	assert.NoError(resolveBases(file, sf, lockNew))
+
+	_, err = os.Stat(baseLockFile(file))
+	assert.True(os.IsNotExist(err))
+
+	l, _ := sf.Get("base")
+	assert.Equal("docker://example.com/myorg/base:2.4.1", l.From.Url)
+}
+
+func TestResolveBasesUsesLockedDigest(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker-base-lock-")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "stacker.yaml")
+	content := `base:
+    from:
+        type: docker
+        url: docker://example.com/myorg/base
+        constraint: ^2.3
+`
+	assert.NoError(ioutil.WriteFile(file, []byte(content), 0644))
+
+	digest := "sha256:" + strings.Repeat("a", 64)
+	lock := &BaseLock{Bases: map[string]LockedBase{"base": {Url: "docker://example.com/myorg/base", Constraint: "^2.3", Tag: "2.4.1", Digest: digest}}}
+	assert.NoError(lock.write(baseLockFile(file)))
+
+	sfm, err := types.NewStackerFiles([]string{file}, nil)
+	assert.NoError(err)
+
+	// without talking to the registry, and only once
+	assert.NoError(resolveStackerFilesBases(sfm, lockReadOnly))
+	assert.NoError(resolveStackerFilesBases(sfm, lockNew))
+
+	l, ok := sfm.LookupLayerDefinition("base")
+	assert.True(ok)
+	assert.Equal("docker://example.com/myorg/base@"+digest, l.From.Url)
+
+	tag, err := l.From.ParseTag()
+	assert.NoError(err)
+	assert.Equal("base", tag)
+}
+
+func TestResolveBasesReadOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker-base-lock-")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "stacker.yaml")
+	content := `base:
+    from:
+        type: docker
+        url: docker://example.com/myorg/base
+        constraint: ^2.3
+`
+	assert.NoError(ioutil.WriteFile(file, []byte(content), 0644))
+
+	// an unlocked base isn't resolved (which would need the registry),
+	// and no lock file is written
+	sf, err := types.NewStackerfile(file, nil)
+	assert.NoError(err)
+	err = resolveBases(file, sf, lockReadOnly)
+	assert.Error(err)
+	assert.Contains(err.Error(), "isn't locked")
+
+	_, err = os.Stat(baseLockFile(file))
+	assert.True(os.IsNotExist(err))
+
+	// nor are stale entries dropped
+	lock := &BaseLock{Bases: map[string]LockedBase{
+		"base": {Url: "docker://example.com/myorg/base", Constraint: "^2.3", Tag: "2.4.1", Digest: "sha256:" + strings.Repeat("a", 64)},
+		"gone": {Url: "docker://example.com/myorg/gone", Constraint: "^1", Tag: "1.0", Digest: "sha256:" + strings.Repeat("b", 64)},
+	}}
+	assert.NoError(lock.write(baseLockFile(file)))
+
+	sf, err = types.NewStackerfile(file, nil)
+	assert.NoError(err)
+	assert.NoError(resolveBases(file, sf, lockReadOnly))
+
+	read, err := readBaseLock(baseLockFile(file))
+	assert.NoError(err)
+	assert.Equal(lock, read)
+}
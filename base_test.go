@@ -0,0 +1,77 @@
+package stacker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecompressTar(t *testing.T) {
+	assert := assert.New(t)
+
+	content := []byte("not really a tarball")
+
+	compressed := map[string]func(io.Writer) (io.WriteCloser, error){
+		"plain": func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		"gzip": func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		"zstd": func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+	}
+
+	if _, err := exec.LookPath("xz"); err == nil {
+		compressed["xz"] = func(w io.Writer) (io.WriteCloser, error) {
+			cmd := exec.Command("xz", "-c")
+			cmd.Stdout = w
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				return nil, err
+			}
+			return &cmdWriter{stdin, cmd}, cmd.Start()
+		}
+	}
+
+	for name, newWriter := range compressed {
+		var tarball bytes.Buffer
+		w, err := newWriter(&tarball)
+		assert.NoError(err)
+		_, err = w.Write(content)
+		assert.NoError(err)
+		assert.NoError(w.Close())
+
+		r, err := decompressTar(name, &tarball)
+		assert.NoError(err, name)
+		uncompressed, err := ioutil.ReadAll(r)
+		assert.NoError(err, name)
+		assert.NoError(r.Close(), name)
+		assert.Equal(content, uncompressed, name)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type cmdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (cw *cmdWriter) Close() error {
+	cw.WriteCloser.Close()
+	return cw.cmd.Wait()
+}
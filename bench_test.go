@@ -0,0 +1,147 @@
+package stacker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+
+	"github.com/anuvu/stacker/squashfs"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
+	"github.com/vbatts/go-mtree"
+)
+
+// benchFixture is a directory tree benchmarks generate layers from; "make
+// bench" runs all of them against each of these.
+type benchFixture struct {
+	name     string
+	generate func(dir string) error
+}
+
+func writeRandomFile(p string, size int64, r *rand.Rand) error {
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// random contents, so that compression doesn't make it cheap
+	_, err = io.CopyN(f, r, size)
+	return err
+}
+
+var benchFixtures = []benchFixture{
+	{"many-small-files", func(dir string) error {
+		r := rand.New(rand.NewSource(0))
+		for i := 0; i < 100; i++ {
+			sub := path.Join(dir, fmt.Sprintf("dir%d", i))
+			if err := os.Mkdir(sub, 0755); err != nil {
+				return err
+			}
+
+			for j := 0; j < 100; j++ {
+				if err := writeRandomFile(path.Join(sub, fmt.Sprintf("file%d", j)), 1024, r); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}},
+	{"few-huge-files", func(dir string) error {
+		r := rand.New(rand.NewSource(0))
+		for i := 0; i < 4; i++ {
+			if err := writeRandomFile(path.Join(dir, fmt.Sprintf("file%d", i)), 64<<20, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	{"deep-tree", func(dir string) error {
+		r := rand.New(rand.NewSource(0))
+		for i := 0; i < 200; i++ {
+			dir = path.Join(dir, fmt.Sprintf("d%d", i))
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return err
+			}
+
+			if err := writeRandomFile(path.Join(dir, "file"), 4096, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+}
+
+// runBenchFixtures runs f as a sub-benchmark for each of the fixtures.
+func runBenchFixtures(b *testing.B, f func(b *testing.B, dir string)) {
+	for _, fixture := range benchFixtures {
+		fixture := fixture
+		b.Run(fixture.name, func(b *testing.B) {
+			dir := b.TempDir()
+			if err := fixture.generate(dir); err != nil {
+				b.Fatalf("couldn't generate fixture: %v", err)
+			}
+
+			b.ResetTimer()
+			f(b, dir)
+		})
+	}
+}
+
+func BenchmarkMtreeWalk(b *testing.B) {
+	runBenchFixtures(b, func(b *testing.B, dir string) {
+		for i := 0; i < b.N; i++ {
+			if _, err := mtree.Walk(dir, nil, umoci.MtreeKeywords, fseval.Rootless); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkImportHash(b *testing.B) {
+	runBenchFixtures(b, func(b *testing.B, dir string) {
+		for i := 0; i < b.N; i++ {
+			// a new cache each time, so that nothing is cached
+			if _, err := walkImport(dir, &fileHashCache{Hashes: map[string]fileHash{}}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkTarPack(b *testing.B) {
+	runBenchFixtures(b, func(b *testing.B, dir string) {
+		for i := 0; i < b.N; i++ {
+			blob := layer.GenerateInsertLayer(dir, "/", false, &layer.RepackOptions{})
+			n, err := io.Copy(ioutil.Discard, blob)
+			blob.Close()
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(n)
+		}
+	})
+}
+
+func BenchmarkSquashfs(b *testing.B) {
+	if _, err := exec.LookPath("mksquashfs"); err != nil {
+		b.Skip("mksquashfs not found")
+	}
+
+	runBenchFixtures(b, func(b *testing.B, dir string) {
+		tempdir := b.TempDir()
+		for i := 0; i < b.N; i++ {
+			image, err := squashfs.MakeSquashfsFile(tempdir, dir, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			os.Remove(image)
+		}
+	})
+}
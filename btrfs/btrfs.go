@@ -3,7 +3,6 @@ package btrfs
 import (
 	"fmt"
 	"io/ioutil"
-	"math/rand"
 	"os"
 	"os/exec"
 	"os/user"
@@ -13,12 +12,12 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
-	"time"
 
+	"github.com/anuvu/stacker/lib"
 	"github.com/anuvu/stacker/log"
 	"github.com/anuvu/stacker/mount"
 	"github.com/anuvu/stacker/types"
-	"github.com/freddierice/go-losetup"
+	securejoin "github.com/cyphar/filepath-securejoin"
 	"github.com/lxc/lxd/shared"
 	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/oci/casext"
@@ -48,8 +47,7 @@ func NewLoopback(c types.StackerConfig) (types.Storage, error) {
 		return nil, err
 	}
 
-	loopback := path.Join(c.StackerDir, "btrfs.loop")
-	size := 100 * 1024 * 1024 * 1024
+	loopback := loopbackPath(c)
 	uid, err := strconv.Atoi(currentUser.Uid)
 	if err != nil {
 		return nil, err
@@ -60,7 +58,7 @@ func NewLoopback(c types.StackerConfig) (types.Storage, error) {
 		return nil, err
 	}
 
-	err = MakeLoopbackBtrfs(loopback, int64(size), uid, gid, c.RootFSDir)
+	err = MakeLoopbackBtrfs(loopback, defaultLoopbackSize, uid, gid, c.RootFSDir)
 	if err != nil {
 		return nil, err
 	}
@@ -91,6 +89,10 @@ func (b *btrfs) sync(subvol string) error {
 }
 
 func (b *btrfs) Create(source string) error {
+	if err := b.maybeGrow(); err != nil {
+		return err
+	}
+
 	output, err := exec.Command(
 		"btrfs",
 		"subvolume",
@@ -127,6 +129,10 @@ func (b *btrfs) Snapshot(source string, target string) error {
 }
 
 func (b *btrfs) Restore(source string, target string) error {
+	if err := b.maybeGrow(); err != nil {
+		return err
+	}
+
 	output, err := exec.Command(
 		"btrfs",
 		"subvolume",
@@ -320,6 +326,7 @@ func (b *btrfs) Delete(source string) error {
 
 func (b *btrfs) Detach() error {
 	if b.needsUmount {
+		log.SubsystemDebugf(log.Storage, "umount %s", b.c.RootFSDir)
 		err := syscall.Unmount(b.c.RootFSDir, 0)
 		err2 := os.RemoveAll(b.c.RootFSDir)
 		if err != nil {
@@ -340,7 +347,11 @@ func (b *btrfs) Exists(thing string) bool {
 }
 
 func (b *btrfs) TemporaryWritableSnapshot(source string) (string, func(), error) {
-	dir, err := ioutil.TempDir(b.c.RootFSDir, fmt.Sprintf("temp-snapshot-%s-", source))
+	if err := b.maybeGrow(); err != nil {
+		return "", nil, err
+	}
+
+	dir, err := ioutil.TempDir(b.c.RootFSDir, fmt.Sprintf("%s%s-", types.TemporarySnapshotPrefix, source))
 	if err != nil {
 		return "", nil, errors.Wrapf(err, "couldn't create temporary snapshot dir for %s", source)
 	}
@@ -379,7 +390,7 @@ func (b *btrfs) TemporaryWritableSnapshot(source string) (string, func(), error)
 
 func (b *btrfs) Clean() error {
 	subvolErr := btrfsSubVolumesDelete(b.c.RootFSDir)
-	loopback := path.Join(b.c.StackerDir, "btrfs.loop")
+	loopback := loopbackPath(b.c)
 
 	var umountErr error
 	_, err := os.Stat(loopback)
@@ -391,6 +402,7 @@ func (b *btrfs) Clean() error {
 			return errors.Errorf("can't fully clean btrfs from userns (try stacker clean ... as root)")
 		}
 
+		log.SubsystemDebugf(log.Storage, "umount %s", b.c.RootFSDir)
 		umountErr = errors.Wrapf(syscall.Unmount(b.c.RootFSDir, 0), "unable to umount rootfs")
 		if err = os.RemoveAll(loopback); err != nil {
 			log.Infof("failed removing btrfs loopback file: %v", err)
@@ -414,6 +426,29 @@ func (b *btrfs) GetLXCRootfsConfig(name string) (string, error) {
 	return fmt.Sprintf("dir:%s", path.Join(b.c.RootFSDir, name, "rootfs")), nil
 }
 
+func (b *btrfs) GetLXCWritableMount(name string, dir string) (string, error) {
+	// the rootfs is a plain directory, so bind mounting a part of it
+	// again gets a mount that isn't read only. It's whatever the image
+	// made it, so a symlink in dir could point anywhere on the host;
+	// like the overlay backend, those are refused.
+	dir = path.Clean("/" + dir)
+	rootfs := path.Join(b.c.RootFSDir, name, "rootfs")
+	source, err := securejoin.SecureJoin(rootfs, dir)
+	if err != nil {
+		return "", errors.Wrapf(err, "bad writable path %s", dir)
+	}
+
+	if source != path.Join(rootfs, dir) {
+		return "", errors.Errorf("writable path %s goes through a symlink in %s's filesystem", dir, name)
+	}
+
+	if err := os.MkdirAll(source, 0755); err != nil {
+		return "", errors.Wrapf(err, "couldn't create writable path %s", dir)
+	}
+
+	return fmt.Sprintf("%s %s none rbind 0 0", source, strings.TrimPrefix(dir, "/")), nil
+}
+
 func (b *btrfs) TarExtractLocation(name string) string {
 	return path.Join(b.c.RootFSDir, name, "rootfs")
 }
@@ -438,12 +473,13 @@ func MakeLoopbackBtrfs(loopback string, size int64, uid int, gid int, dest strin
 	/* Now we know that file is a valid btrfs "file" and that it's
 	 * not mounted, so let's mount it.
 	 */
-	dev, err := attachToLoop(loopback)
+	dev, err := lib.AttachToLoop(loopback, false)
 	if err != nil {
 		return errors.Errorf("Failed to attach loop device: %v", err)
 	}
 	defer dev.Detach()
 
+	log.SubsystemDebugf(log.Storage, "mount -t btrfs -o user_subvol_rm_allowed %s %s", dev.Path(), dest)
 	err = syscall.Mount(dev.Path(), dest, "btrfs", 0, "user_subvol_rm_allowed")
 	if err != nil {
 		return errors.Errorf("Failed mount fs: %v", err)
@@ -456,28 +492,6 @@ func MakeLoopbackBtrfs(loopback string, size int64, uid int, gid int, dest strin
 	return nil
 }
 
-// attachToLoop attaches the path to a loop device, retrying for a while if it
-// gets -EBUSY.
-func attachToLoop(path string) (dev losetup.Device, err error) {
-	// We can race between when we ask the kernel which loop device
-	// is free and when we actually attach to it. This window is
-	// pretty small, but still happens e.g. when we run the stacker
-	// test suite. So let's sleep for a random number of ms and
-	// retry the whole process again.
-	for i := 0; i < 10; i++ {
-		dev, err = losetup.Attach(path, 0, false)
-		if err == nil {
-			return dev, nil
-		}
-
-		// time.Durations are nanoseconds
-		ms := rand.Int63n(100 * 1000 * 1000)
-		time.Sleep(time.Duration(ms))
-	}
-
-	return dev, errors.Wrapf(err, "couldn't attach btrfs loop, too many retries")
-}
-
 func setupLoopback(path string, uid int, gid int, size int64) error {
 	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
@@ -0,0 +1,81 @@
+package btrfs
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
+	"github.com/pkg/errors"
+)
+
+func setReadOnly(p string, ro bool) error {
+	value := "false"
+	if ro {
+		value = "true"
+	}
+
+	output, err := exec.Command("btrfs", "property", "set", "-ts", p, "ro", value).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("btrfs set ro=%s %s: %s: %s", value, p, err, output)
+	}
+
+	return nil
+}
+
+func (b *btrfs) Dedup() (int, int64, error) {
+	ents, err := ioutil.ReadDir(b.c.RootFSDir)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "couldn't read roots dir")
+	}
+
+	// btrfs won't dedupe into readonly subvolumes, so temporarily make
+	// the finalized ones writable. The contents don't change, so this is
+	// safe for anything that uses them later.
+	readOnly := []string{}
+	defer func() {
+		for _, p := range readOnly {
+			if err := setReadOnly(p, true); err != nil {
+				log.Infof("couldn't mark %s readonly again: %v", p, err)
+			}
+		}
+	}()
+
+	for _, ent := range ents {
+		if !ent.IsDir() {
+			continue
+		}
+
+		p := path.Join(b.c.RootFSDir, ent.Name())
+		isSubvol, err := isBtrfsSubVolume(p)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if !isSubvol {
+			continue
+		}
+
+		ro, err := isReadOnlySubvolume(p)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if !ro {
+			continue
+		}
+
+		if err := setReadOnly(p, false); err != nil {
+			return 0, 0, err
+		}
+		readOnly = append(readOnly, p)
+	}
+
+	stats, err := lib.DedupeFiles(b.c.RootFSDir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return stats.Files, stats.Bytes, b.reportUsage()
+}
@@ -0,0 +1,189 @@
+package btrfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/pkg/errors"
+)
+
+// cacheExportFile is the name of the btrfs send stream in a cache export.
+const cacheExportFile = "roots.btrfs"
+
+type exportedSubvolume struct {
+	name       string
+	generation uint64
+}
+
+func isReadOnlySubvolume(p string) (bool, error) {
+	output, err := exec.Command("btrfs", "property", "get", "-ts", p, "ro").CombinedOutput()
+	if err != nil {
+		return false, errors.Errorf("btrfs property get %s: %s: %s", p, err, output)
+	}
+
+	return strings.TrimSpace(string(output)) == "ro=true", nil
+}
+
+// creationGeneration returns the btrfs generation a subvolume was created at;
+// a snapshot is always created after its source, so sending subvolumes in
+// this order lets btrfs send share extents with the ones already sent.
+func creationGeneration(p string) (uint64, error) {
+	output, err := exec.Command("btrfs", "subvolume", "show", p).CombinedOutput()
+	if err != nil {
+		return 0, errors.Errorf("btrfs subvolume show %s: %s: %s", p, err, output)
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(parts) != 2 || parts[0] != "Gen at creation" {
+			continue
+		}
+
+		return strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64)
+	}
+
+	return 0, errors.Errorf("couldn't find creation generation of %s", p)
+}
+
+func (b *btrfs) ExportCache(dir string) error {
+	ents, err := ioutil.ReadDir(b.c.RootFSDir)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read roots dir")
+	}
+
+	subvols := []exportedSubvolume{}
+	for _, ent := range ents {
+		if !ent.IsDir() {
+			continue
+		}
+
+		p := path.Join(b.c.RootFSDir, ent.Name())
+		isSubvol, err := isBtrfsSubVolume(p)
+		if err != nil {
+			return err
+		}
+
+		if !isSubvol {
+			continue
+		}
+
+		// btrfs can only send readonly subvolumes, and anything that
+		// isn't readonly is a work in progress anyway.
+		ro, err := isReadOnlySubvolume(p)
+		if err != nil {
+			return err
+		}
+
+		if !ro {
+			log.Debugf("not exporting writable subvolume %s", ent.Name())
+			continue
+		}
+
+		gen, err := creationGeneration(p)
+		if err != nil {
+			return err
+		}
+
+		subvols = append(subvols, exportedSubvolume{name: ent.Name(), generation: gen})
+	}
+
+	sort.Slice(subvols, func(i, j int) bool {
+		return subvols[i].generation < subvols[j].generation
+	})
+
+	f, err := os.Create(path.Join(dir, cacheExportFile))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create btrfs send stream")
+	}
+	defer f.Close()
+
+	// btrfs receive handles several concatenated streams, so send each
+	// subvolume separately, using all of the previous ones as clone
+	// sources; they will already have been received by the time this
+	// one is.
+	cloneSources := []string{}
+	for _, sv := range subvols {
+		p := path.Join(b.c.RootFSDir, sv.name)
+
+		args := []string{"send"}
+		for _, c := range cloneSources {
+			args = append(args, "-c", c)
+		}
+		args = append(args, p)
+
+		stderr := bytes.NewBuffer(nil)
+		cmd := exec.Command("btrfs", args...)
+		cmd.Stdout = f
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			return errors.Errorf("btrfs send %s: %s: %s", sv.name, err, stderr.String())
+		}
+
+		log.Debugf("exported subvolume %s", sv.name)
+		cloneSources = append(cloneSources, p)
+	}
+
+	return nil
+}
+
+func (b *btrfs) ImportCache(dir string) error {
+	// receive into a staging dir, and then snapshot from there. received
+	// subvolumes remember that they were received, which means btrfs
+	// won't let us mark them writable again when it's time to delete
+	// them; snapshots of them are regular subvolumes.
+	staging, err := ioutil.TempDir(b.c.RootFSDir, "cache-import-")
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create staging dir")
+	}
+	defer func() {
+		ents, err := ioutil.ReadDir(staging)
+		if err == nil {
+			for _, ent := range ents {
+				output, err := exec.Command("btrfs", "subvolume", "delete", path.Join(staging, ent.Name())).CombinedOutput()
+				if err != nil {
+					log.Infof("couldn't delete staged subvolume %s: %s: %s", ent.Name(), err, output)
+				}
+			}
+		}
+		os.RemoveAll(staging)
+	}()
+
+	output, err := exec.Command("btrfs", "receive", "-f", path.Join(dir, cacheExportFile), staging).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("btrfs receive: %s: %s", err, output)
+	}
+
+	ents, err := ioutil.ReadDir(staging)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read staging dir")
+	}
+
+	for _, ent := range ents {
+		if b.Exists(ent.Name()) {
+			log.Infof("%s already exists, not importing it", ent.Name())
+			continue
+		}
+
+		output, err := exec.Command(
+			"btrfs",
+			"subvolume",
+			"snapshot",
+			"-r",
+			path.Join(staging, ent.Name()),
+			path.Join(b.c.RootFSDir, ent.Name())).CombinedOutput()
+		if err != nil {
+			return errors.Errorf("btrfs snapshot %s: %s: %s", ent.Name(), err, output)
+		}
+
+		log.Debugf("imported subvolume %s", ent.Name())
+	}
+
+	return nil
+}
@@ -3,24 +3,40 @@ package btrfs
 import (
 	"context"
 	"io/ioutil"
+	"os"
 	"path"
 
+	"github.com/anuvu/stacker/lib"
 	stackeroci "github.com/anuvu/stacker/oci"
-	"github.com/opencontainers/umoci"
 )
 
 func gcForOCILayout(s *btrfs, layout string, thingsToKeep map[string]bool) error {
-	oci, err := umoci.OpenLayout(layout)
+	unlock, err := lib.Lock(layout, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	oci, err := stackeroci.OpenLayout(layout)
 	if err != nil {
 		return err
 	}
 	defer oci.Close()
 
-	err = oci.GC(context.Background())
+	// a blobs dir shared with other stacker dirs (the base_image_cache)
+	// has blobs that only their indexes refer to
+	fi, err := os.Lstat(path.Join(layout, "blobs"))
 	if err != nil {
 		return err
 	}
 
+	if fi.Mode()&os.ModeSymlink == 0 {
+		err = oci.GC(context.Background())
+		if err != nil {
+			return err
+		}
+	}
+
 	tags, err := oci.ListReferences(context.Background())
 	if err != nil {
 		return err
@@ -78,5 +94,5 @@ func (b *btrfs) GC() error {
 		}
 	}
 
-	return nil
+	return b.reportUsage()
 }
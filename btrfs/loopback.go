@@ -0,0 +1,182 @@
+package btrfs
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/mount"
+	"github.com/anuvu/stacker/types"
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// defaultLoopbackSize is the size of a newly created loopback file. It is
+// sparse, so this is just the most it can hold until it is grown.
+const defaultLoopbackSize = 100 * 1024 * 1024 * 1024
+
+func loopbackPath(c types.StackerConfig) string {
+	return path.Join(c.StackerDir, "btrfs.loop")
+}
+
+// HasLoopback returns true if the roots dir is stacker's btrfs loopback,
+// i.e. just where the loopback file in the stacker dir is mounted.
+func HasLoopback(c types.StackerConfig) bool {
+	_, err := os.Stat(loopbackPath(c))
+	return err == nil
+}
+
+// maxLoopbackSize returns the size the loopback file may be grown to, or 0 if
+// it shouldn't be grown.
+func maxLoopbackSize(c types.StackerConfig) (int64, error) {
+	if c.BtrfsLoopbackMaxSize == "" {
+		return 0, nil
+	}
+
+	max, err := humanize.ParseBytes(c.BtrfsLoopbackMaxSize)
+	if err != nil {
+		return 0, errors.Wrapf(err, "bad btrfs_loopback_max_size %s", c.BtrfsLoopbackMaxSize)
+	}
+
+	return int64(max), nil
+}
+
+type loopbackUsage struct {
+	used  uint64
+	total uint64
+	file  int64
+	max   int64
+}
+
+// usage returns how full the loopback filesystem is, or false if the roots
+// dir isn't a loopback.
+func (b *btrfs) usage() (loopbackUsage, bool, error) {
+	st, err := os.Stat(loopbackPath(b.c))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return loopbackUsage{}, false, nil
+		}
+		return loopbackUsage{}, false, errors.Wrapf(err, "couldn't stat loopback")
+	}
+
+	max, err := maxLoopbackSize(b.c)
+	if err != nil {
+		return loopbackUsage{}, false, err
+	}
+
+	fs := syscall.Statfs_t{}
+	if err := syscall.Statfs(b.c.RootFSDir, &fs); err != nil {
+		return loopbackUsage{}, false, errors.Wrapf(err, "couldn't statfs %s", b.c.RootFSDir)
+	}
+
+	total := fs.Blocks * uint64(fs.Bsize)
+	return loopbackUsage{
+		used:  total - fs.Bavail*uint64(fs.Bsize),
+		total: total,
+		file:  st.Size(),
+		max:   max,
+	}, true, nil
+}
+
+func (b *btrfs) reportUsage() error {
+	u, ok, err := b.usage()
+	if err != nil || !ok {
+		return err
+	}
+
+	max := "not configured"
+	if u.max > 0 {
+		max = humanize.IBytes(uint64(u.max))
+	}
+
+	log.Infof("btrfs loopback %s: %s used of %s (maximum size %s)", loopbackPath(b.c),
+		humanize.IBytes(u.used), humanize.IBytes(u.total), max)
+	return nil
+}
+
+// maybeGrow grows the loopback file and its filesystem when it is nearly
+// full, up to the configured btrfs_loopback_max_size. This is called before
+// operations that might write a lot, so that builds don't die with ENOSPC.
+func (b *btrfs) maybeGrow() error {
+	u, ok, err := b.usage()
+	if err != nil || !ok || u.max == 0 {
+		return err
+	}
+
+	// grow when there's less than 10% free
+	if u.total-u.used > u.total/10 {
+		return nil
+	}
+
+	if u.file >= u.max {
+		log.Infof("btrfs loopback has %s used and is already at its maximum size %s",
+			humanize.IBytes(u.used), humanize.IBytes(uint64(u.max)))
+		return nil
+	}
+
+	newSize := u.file * 2
+	if newSize > u.max {
+		newSize = u.max
+	}
+
+	m, mounted, err := mount.FindMount(b.c.RootFSDir)
+	if err != nil {
+		return err
+	}
+
+	if !mounted || !strings.HasPrefix(m.Source, "/dev/loop") {
+		return nil
+	}
+
+	log.Infof("growing btrfs loopback from %s to %s", humanize.IBytes(uint64(u.file)), humanize.IBytes(uint64(newSize)))
+
+	// growing the loop device and filesystem needs privilege, which we
+	// don't have if e.g. the loopback was set up by unpriv-setup; in
+	// that case, we just keep going and hope for the best.
+	if err := growLoopback(loopbackPath(b.c), m.Source, u.file, newSize, b.c.RootFSDir); err != nil {
+		log.Infof("couldn't grow btrfs loopback (try running stacker as root once): %v", err)
+	}
+
+	return nil
+}
+
+func growLoopback(loopback string, dev string, oldSize int64, size int64, mountpoint string) error {
+	if err := os.Truncate(loopback, size); err != nil {
+		return errors.Wrapf(err, "couldn't grow %s", loopback)
+	}
+
+	// if something goes wrong, the filesystem doesn't know about the new
+	// space yet, so it's safe to shrink the file back; otherwise we'd
+	// keep growing the file every time we were called.
+	rollback := func() {
+		os.Truncate(loopback, oldSize)
+		setLoopCapacity(dev)
+	}
+
+	if err := setLoopCapacity(dev); err != nil {
+		rollback()
+		return err
+	}
+
+	output, err := exec.Command("btrfs", "filesystem", "resize", "max", mountpoint).CombinedOutput()
+	if err != nil {
+		rollback()
+		return errors.Errorf("btrfs resize: %s: %s", err, output)
+	}
+
+	return nil
+}
+
+func setLoopCapacity(dev string) error {
+	fd, err := unix.Open(dev, unix.O_RDONLY, 0)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open %s", dev)
+	}
+	defer unix.Close(fd)
+
+	return errors.Wrapf(unix.IoctlSetInt(fd, unix.LOOP_SET_CAPACITY, 0), "couldn't update capacity of %s", dev)
+}
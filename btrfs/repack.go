@@ -6,34 +6,44 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/limits"
+	"github.com/anuvu/stacker/log"
 	stackermtree "github.com/anuvu/stacker/mtree"
 	stackeroci "github.com/anuvu/stacker/oci"
 	"github.com/anuvu/stacker/squashfs"
 	"github.com/anuvu/stacker/storage"
 	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/mutate"
 	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/fseval"
 	"github.com/opencontainers/umoci/pkg/mtreefilter"
 	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
 )
 
-func (b *btrfs) initEmptyLayer(name string, layerType types.LayerType) error {
+// initEmptyLayer creates an image with no layers in the output for name, and
+// points bundlePath's umoci metadata at it, so that the whole rootfs is
+// generated as the image's first layer. If imageConfig is not nil, the image
+// gets its configuration (minus the layers).
+func (b *btrfs) initEmptyLayer(name string, bundlePath string, layerType types.LayerType, imageConfig *ispec.Image) error {
 	var oci casext.Engine
 	var err error
 
 	tag := layerType.LayerName(name)
 	ociDir := b.c.OCIDir
-	bundlePath := path.Join(b.c.RootFSDir, name)
 
 	if _, statErr := os.Stat(ociDir); statErr != nil {
-		oci, err = umoci.CreateLayout(ociDir)
+		oci, err = stackeroci.CreateLayout(ociDir)
 	} else {
-		oci, err = umoci.OpenLayout(ociDir)
+		oci, err = stackeroci.OpenLayout(ociDir)
 	}
 	if err != nil {
 		return errors.Wrapf(err, "Failed creating layout for %s", ociDir)
@@ -44,6 +54,21 @@ func (b *btrfs) initEmptyLayer(name string, layerType types.LayerType) error {
 		return err
 	}
 
+	if imageConfig != nil {
+		manifest, err := stackeroci.LookupManifest(oci, tag)
+		if err != nil {
+			return err
+		}
+
+		newConfig := *imageConfig
+		newConfig.RootFS.DiffIDs = []digest.Digest{}
+		newConfig.History = nil
+		_, err = stackeroci.UpdateImageConfig(oci, tag, newConfig, manifest)
+		if err != nil {
+			return err
+		}
+	}
+
 	// kind of a hack, but the API won't let us init an empty image in a
 	// bundle with data already in it, which is probably reasonable. so
 	// what we do instead is: unpack the empty image above into a temp
@@ -79,19 +104,24 @@ func (b *btrfs) initEmptyLayer(name string, layerType types.LayerType) error {
 	return nil
 }
 
-func determineLayerType(ociDir, tag string) (types.LayerType, error) {
-	oci, err := umoci.OpenLayout(ociDir)
+func lookupImage(ociDir, tag string) (ispec.Manifest, ispec.Image, error) {
+	oci, err := stackeroci.OpenLayout(ociDir)
 	if err != nil {
-		return types.LayerType(""), err
+		return ispec.Manifest{}, ispec.Image{}, err
 	}
 	defer oci.Close()
 
 	manifest, err := stackeroci.LookupManifest(oci, tag)
 	if err != nil {
-		return types.LayerType(""), err
+		return ispec.Manifest{}, ispec.Image{}, err
 	}
 
-	return types.NewLayerTypeManifest(manifest)
+	imageConfig, err := stackeroci.LookupConfig(oci, manifest.Config)
+	if err != nil {
+		return ispec.Manifest{}, ispec.Image{}, err
+	}
+
+	return manifest, imageConfig, nil
 }
 
 func (b *btrfs) Repack(name string, layerTypes []types.LayerType, sfm types.StackerFiles) error {
@@ -110,6 +140,7 @@ func (b *btrfs) Repack(name string, layerTypes []types.LayerType, sfm types.Stac
 	}
 
 	initialized := false
+	var baseConfig *ispec.Image
 	if baseLayer != nil {
 		cacheDir := path.Join(b.c.StackerDir, "layer-bases", "oci")
 		// if it's from a containers image import and the layer types match, just copy it to the output
@@ -119,11 +150,22 @@ func (b *btrfs) Repack(name string, layerTypes []types.LayerType, sfm types.Stac
 				return err
 			}
 
-			sourceLayerType, err := determineLayerType(cacheDir, cacheTag)
+			manifest, imageConfig, err := lookupImage(cacheDir, cacheTag)
+			if err != nil {
+				return err
+			}
+
+			sourceLayerType, err := types.NewLayerTypeManifest(manifest)
 			if err != nil {
 				return err
 			}
-			if layerType == sourceLayerType {
+
+			// if they don't, we only have the base's final
+			// filesystem, so it is flattened into this layer.
+			if layerType != sourceLayerType {
+				log.Infof("converting %s base %s to %s; its layers will be flattened into %s", sourceLayerType, cacheTag, layerType, name)
+				baseConfig = &imageConfig
+			} else {
 				err = lib.ImageCopy(lib.ImageCopyOpts{
 					Src:  fmt.Sprintf("oci:%s:%s", cacheDir, cacheTag),
 					Dest: fmt.Sprintf("oci:%s:%s", b.c.OCIDir, layerType.LayerName(name)),
@@ -148,32 +190,68 @@ func (b *btrfs) Repack(name string, layerTypes []types.LayerType, sfm types.Stac
 	}
 
 	if !initialized {
-		if err = b.initEmptyLayer(name, layerType); err != nil {
+		if err = b.initEmptyLayer(name, path.Join(b.c.RootFSDir, name), layerType, baseConfig); err != nil {
 			return err
 		}
 	}
 
-	return doRepack(name, b.c.OCIDir, path.Join(b.c.RootFSDir, name), layerType)
+	author, err := storage.LayerAuthor(b.c, name, sfm)
+	if err != nil {
+		return err
+	}
+
+	return doRepack(b.c, name, path.Join(b.c.RootFSDir, name), layerType, author)
 }
 
-func doRepack(tag string, ociDir string, bundlePath string, layerType types.LayerType) error {
-	oci, err := umoci.OpenLayout(ociDir)
+// ConvertOutput for btrfs only has name's final filesystem to work with, so
+// the converted image has all of its layers flattened into one.
+func (b *btrfs) ConvertOutput(name string, layerType types.LayerType) error {
+	sourceType, err := storage.FindOutputLayerType(b.c.OCIDir, name, layerType)
 	if err != nil {
 		return err
 	}
-	defer oci.Close()
 
-	meta, err := umoci.ReadBundleMeta(bundlePath)
+	_, imageConfig, err := lookupImage(b.c.OCIDir, sourceType.LayerName(name))
 	if err != nil {
 		return err
 	}
 
-	mutator, err := mutate.New(oci, meta.From)
+	log.Infof("converting %s to %s; its layers will be flattened into one", sourceType.LayerName(name), layerType)
+
+	// the umoci metadata in the snapshot has to be replaced for the
+	// converted image, so do it in a throwaway copy.
+	tmp, cleanup, err := b.TemporaryWritableSnapshot(name)
 	if err != nil {
 		return err
 	}
+	defer cleanup()
+
+	bundlePath := path.Join(b.c.RootFSDir, tmp)
+	if err := cleanUmociMetadata(bundlePath); err != nil {
+		return err
+	}
 
-	imageMeta, err := mutator.Meta(context.Background())
+	if err := b.initEmptyLayer(name, bundlePath, layerType, &imageConfig); err != nil {
+		return err
+	}
+
+	return doRepack(b.c, name, bundlePath, layerType, imageConfig.Author)
+}
+
+func doRepack(config types.StackerConfig, tag string, bundlePath string, layerType types.LayerType, author string) error {
+	ociDir := config.OCIDir
+	oci, err := stackeroci.OpenLayout(ociDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	meta, err := umoci.ReadBundleMeta(bundlePath)
+	if err != nil {
+		return err
+	}
+
+	mutator, err := mutate.New(oci, meta.From)
 	if err != nil {
 		return err
 	}
@@ -183,17 +261,128 @@ func doRepack(tag string, ociDir string, bundlePath string, layerType types.Laye
 	case "tar":
 		now := time.Now()
 		history := &ispec.History{
-			Author:     imageMeta.Author,
+			Author:     author,
 			Created:    &now,
 			CreatedBy:  "stacker umoci repack",
 			EmptyLayer: false,
 		}
 
-		filters := []mtreefilter.FilterFunc{stackermtree.LayerGenerationIgnoreRoot}
-		return umoci.Repack(oci, layerName, bundlePath, meta, history, filters, true, mutator)
+		return repackTar(config, oci, layerName, bundlePath, meta, history, mutator)
 	case "squashfs":
-		return squashfs.GenerateSquashfsLayer(layerName, imageMeta.Author, bundlePath, ociDir, oci)
+		release, err := limits.Acquire(config, limits.Squashfs)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		keywords, err := stackermtree.Keywords(config.MtreeKeywords)
+		if err != nil {
+			return err
+		}
+		return squashfs.GenerateSquashfsLayer(layerName, author, bundlePath, ociDir, oci, config.SquashfsVerity, keywords)
 	default:
 		return errors.Errorf("unknown layer type %s", layerType)
 	}
 }
+
+// repackTar is umoci.Repack, except that it generates the layer with the
+// compression and id mappings in the stacker config, where umoci always uses
+// gzip and the mappings from the bundle's metadata.
+func repackTar(config types.StackerConfig, oci casext.Engine, tag string, bundlePath string, meta umoci.Meta, history *ispec.History, mutator *mutate.Mutator) error {
+	compressor, err := storage.TarCompressor(config)
+	if err != nil {
+		return err
+	}
+
+	mapOptions, err := storage.RepackMapOptions(config)
+	if err != nil {
+		return err
+	}
+
+	mtreeName := strings.Replace(meta.From.Descriptor().Digest.String(), ":", "_", 1)
+	mtreePath := path.Join(bundlePath, mtreeName+".mtree")
+	rootfs := path.Join(bundlePath, layer.RootfsName)
+
+	mfh, err := os.Open(mtreePath)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open mtree")
+	}
+	defer mfh.Close()
+
+	spec, err := mtree.ParseSpec(mfh)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't parse mtree")
+	}
+
+	keywords, err := stackermtree.Keywords(config.MtreeKeywords)
+	if err != nil {
+		return err
+	}
+
+	diffs, err := mtree.Check(rootfs, spec, keywords, fseval.Default)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't check mtree")
+	}
+
+	filters := []mtreefilter.FilterFunc{stackermtree.LayerGenerationIgnoreRoot, mtreefilter.SimplifyFilter(diffs)}
+	diffs = mtreefilter.FilterDeltas(diffs, filters...)
+
+	if len(diffs) == 0 {
+		imageConfig, err := mutator.Config(context.Background())
+		if err != nil {
+			return err
+		}
+
+		imageMeta, err := mutator.Meta(context.Background())
+		if err != nil {
+			return err
+		}
+
+		annotations, err := mutator.Annotations(context.Background())
+		if err != nil {
+			return err
+		}
+
+		// there's no layer to have history; the build records that
+		// it didn't change anything
+		err = mutator.Set(context.Background(), imageConfig, imageMeta, annotations, nil)
+		if err != nil {
+			return err
+		}
+	} else {
+		packOptions := layer.RepackOptions{MapOptions: mapOptions}
+		reader, err := layer.GenerateLayer(rootfs, diffs, &packOptions)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't generate diff layer")
+		}
+		defer reader.Close()
+
+		_, err = mutator.Add(context.Background(), ispec.MediaTypeImageLayer, reader, history, compressor)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't add diff layer")
+		}
+	}
+
+	newDescriptorPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return errors.Wrapf(err, "couldn't commit mutated image")
+	}
+
+	err = oci.UpdateReference(context.Background(), tag, newDescriptorPath.Root())
+	if err != nil {
+		return errors.Wrapf(err, "couldn't add tag %s", tag)
+	}
+
+	newMtreeName := strings.Replace(newDescriptorPath.Descriptor().Digest.String(), ":", "_", 1)
+	err = umoci.GenerateBundleManifest(newMtreeName, bundlePath, fseval.Default)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't write mtree metadata")
+	}
+
+	if err := os.Remove(mtreePath); err != nil {
+		return errors.Wrapf(err, "couldn't remove old mtree metadata")
+	}
+
+	meta.From = newDescriptorPath
+	return umoci.WriteBundleMeta(bundlePath, meta)
+}
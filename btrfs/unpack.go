@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/limits"
 	"github.com/anuvu/stacker/log"
 	stackeroci "github.com/anuvu/stacker/oci"
 	"github.com/anuvu/stacker/squashfs"
@@ -21,14 +22,18 @@ import (
 )
 
 func (b *btrfs) Unpack(tag, name string) error {
-	oci, err := umoci.OpenLayout(b.c.OCIDir)
+	if err := b.maybeGrow(); err != nil {
+		return err
+	}
+
+	oci, err := stackeroci.OpenLayout(b.c.OCIDir)
 	if err != nil {
 		return err
 	}
 	defer oci.Close()
 
 	cacheDir := path.Join(b.c.StackerDir, "layer-bases", "oci")
-	cacheOCI, err := umoci.OpenLayout(cacheDir)
+	cacheOCI, err := stackeroci.OpenLayout(cacheDir)
 	if err != nil {
 		return err
 	}
@@ -83,8 +88,13 @@ func (b *btrfs) Unpack(tag, name string) error {
 			return err
 		}
 
-		err = doUnpack(b.c, tag, cacheDir, bundlePath, startFrom.Digest.String())
+		release, err := limits.Acquire(b.c, limits.Extract)
+		if err != nil {
+			return err
+		}
 
+		err = doUnpack(b.c, tag, cacheDir, bundlePath, startFrom.Digest.String())
+		release()
 		if err != nil {
 			return err
 		}
@@ -132,7 +142,7 @@ func (b *btrfs) findPreviousExtraction(oci casext.Engine, manifest ispec.Manifes
 }
 
 func doUnpack(config types.StackerConfig, tag, ociDir, bundlePath, startFromDigest string) error {
-	oci, err := umoci.OpenLayout(ociDir)
+	oci, err := stackeroci.OpenLayout(ociDir)
 	if err != nil {
 		return err
 	}
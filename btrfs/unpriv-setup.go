@@ -1,12 +1,9 @@
 package btrfs
 
 import (
-	"path"
-
 	"github.com/anuvu/stacker/types"
 )
 
 func UnprivSetup(config types.StackerConfig, uid, gid int) error {
-	size := int64(100 * 1024 * 1024 * 1024)
-	return MakeLoopbackBtrfs(path.Join(config.StackerDir, "btrfs.loop"), size, uid, gid, config.RootFSDir)
+	return MakeLoopbackBtrfs(loopbackPath(config), defaultLoopbackSize, uid, gid, config.RootFSDir)
 }
@@ -5,37 +5,96 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/user"
 	"path"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/anuvu/stacker/agent"
 	"github.com/anuvu/stacker/log"
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/storage"
 	"github.com/anuvu/stacker/types"
+	"github.com/dustin/go-humanize"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
-	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/mutate"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
 )
 
 type BuildArgs struct {
-	Config       types.StackerConfig
-	LeaveUnladen bool
-	NoCache      bool
-	Substitute   []string
-	OnRunFailure string
-	LayerTypes   []types.LayerType
-	OrderOnly    bool
-	SetupOnly    bool
-	Progress     bool
+	Config        types.StackerConfig
+	LeaveUnladen  bool
+	NoCache       bool
+	Substitute    []string
+	OnRunFailure  string
+	LayerTypes    []types.LayerType
+	OrderOnly     bool
+	SetupOnly     bool
+	Progress      bool
+	VerifyImports bool
+	Jobs          int
+	Interactive   bool
+	KeepGoing     bool
+	UpdateLock    bool
+	FailOnEmpty   bool
+	Invalidate    []string
 }
 
 // Builder is responsible for building the layers based on stackerfiles
 type Builder struct {
 	builtStackerfiles types.StackerFiles // Keep track of all the Stackerfiles which were built
 	opts              *BuildArgs         // Build options
+	report            Report             // Summary of what was built
+	steps             []StepReport       // The steps run for the layer being built
+	webhook           *webhook           // Where build events are sent, if anywhere
+	provisioning      string             // The last layer whose rootfs was set up
+	failed            map[string]bool    // The layers that failed or were skipped, with KeepGoing
+	failures          []error            // Why the layers that failed did, with KeepGoing
+	basesLocked       bool               // Whether the lock files were already updated, with UpdateLock
+	checked           bool               // Whether the stacker files' hosts and policy were already checked
+
+	mu        sync.Mutex
+	cancelled bool       // Whether Cancel() was called
+	running   *Container // The container running a step, if any
+}
+
+// ErrBuildCancelled is errors.Cause() of the error builds that were
+// cancelled fail with.
+var ErrBuildCancelled = errors.New("build cancelled")
+
+func cancelledError() error {
+	return types.WithKind(types.CancelledError, ErrBuildCancelled)
+}
+
+// Cancel cancels the build: the step that is running is killed, and the
+// build fails as soon as it can, rolling back the rootfs of the layer it
+// was building, so that what was left of it is never used.
+func (b *Builder) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cancelled = true
+	if b.running != nil {
+		if err := b.running.Kill(); err != nil {
+			log.Infof("couldn't stop the running step: %v", err)
+		}
+	}
+}
+
+// Cancelled returns whether the build was cancelled.
+func (b *Builder) Cancelled() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cancelled
+}
+
+func (b *Builder) setRunning(c *Container) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.running = c
 }
 
 // NewBuilder initializes a new Builder struct
@@ -43,10 +102,85 @@ func NewBuilder(opts *BuildArgs) *Builder {
 	return &Builder{
 		builtStackerfiles: make(map[string]*types.Stackerfile, 1),
 		opts:              opts,
+		failed:            map[string]bool{},
+		webhook:           newWebhook(opts.Config, "build"),
+	}
+}
+
+// setEnv sets the variable k to v in env, a list of KEY=value strings,
+// replacing the one it inherited from the base image if there is one, so
+// configs don't end up with the same variable twice.
+func setEnv(env []string, k string, v string) []string {
+	for i, kv := range env {
+		if strings.HasPrefix(kv, k+"=") {
+			env[i] = fmt.Sprintf("%s=%s", k, v)
+			return env
+		}
+	}
+
+	return append(env, fmt.Sprintf("%s=%s", k, v))
+}
+
+// mergeCommand sets the cmd and entrypoint of imageConfig, the base image's
+// config, to the ones of layer l, merged with the base image's according to
+// the layer's command_merge.
+func mergeCommand(name string, l *types.Layer, imageConfig *ispec.ImageConfig) error {
+	merge, err := l.ParseCommandMerge()
+	if err != nil {
+		return err
+	}
+
+	if l.FullCommand != nil {
+		if l.CommandMerge != "" {
+			log.Infof("WARNING: %s: full_command replaces the cmd and entrypoint, so command_merge: %s does nothing", name, merge)
+		}
+
+		imageConfig.Cmd = nil
+		imageConfig.Entrypoint, err = l.ParseFullCommand()
+		return err
+	}
+
+	cmd, err := l.ParseCmd()
+	if err != nil {
+		return err
+	}
+
+	entrypoint, err := l.ParseEntrypoint()
+	if err != nil {
+		return err
+	}
+
+	switch merge {
+	case types.CommandMergeInherit:
+		// a base image's cmd is usually arguments for its own
+		// entrypoint, not the new one
+		if l.Entrypoint != nil && l.Cmd == nil && len(imageConfig.Cmd) > 0 {
+			log.Infof("WARNING: %s: entrypoint is set, but cmd %q is inherited from the base image; set cmd, or command_merge: replace to clear it", name, imageConfig.Cmd)
+		}
+
+		if l.Cmd != nil {
+			imageConfig.Cmd = cmd
+		}
+
+		if l.Entrypoint != nil {
+			imageConfig.Entrypoint = entrypoint
+		}
+	case types.CommandMergeReplace:
+		imageConfig.Cmd = cmd
+		imageConfig.Entrypoint = entrypoint
+	case types.CommandMergeAppend:
+		if l.Cmd == nil && l.Entrypoint == nil {
+			log.Infof("WARNING: %s: command_merge is append, but neither cmd nor entrypoint is set", name)
+		}
+
+		imageConfig.Cmd = append(imageConfig.Cmd, cmd...)
+		imageConfig.Entrypoint = append(imageConfig.Entrypoint, entrypoint...)
 	}
+
+	return nil
 }
 
-func (b *Builder) updateOCIConfigForOutput(sf *types.Stackerfile, s types.Storage, oci casext.Engine, layerType types.LayerType, l *types.Layer, name string) error {
+func (b *Builder) updateOCIConfigForOutput(sf *types.Stackerfile, s types.Storage, oci casext.Engine, layerType types.LayerType, l *types.Layer, name string, noChanges bool) error {
 	opts := b.opts
 
 	layerName := layerType.LayerName(name)
@@ -130,11 +264,11 @@ func (b *Builder) updateOCIConfigForOutput(sf *types.Stackerfile, s types.Storag
 	}
 
 	pathSet := false
-	for k, v := range l.Environment {
+	for _, k := range types.SortedEnvKeys(l.Environment) {
 		if k == "PATH" {
 			pathSet = true
 		}
-		imageConfig.Env = append(imageConfig.Env, fmt.Sprintf("%s=%s", k, v))
+		imageConfig.Env = setEnv(imageConfig.Env, k, l.Environment[k])
 	}
 
 	if !pathSet {
@@ -151,26 +285,8 @@ func (b *Builder) updateOCIConfigForOutput(sf *types.Stackerfile, s types.Storag
 		imageConfig.Env = append(imageConfig.Env, fmt.Sprintf("PATH=%s", ReasonableDefaultPath))
 	}
 
-	if l.Cmd != nil {
-		imageConfig.Cmd, err = l.ParseCmd()
-		if err != nil {
-			return err
-		}
-	}
-
-	if l.Entrypoint != nil {
-		imageConfig.Entrypoint, err = l.ParseEntrypoint()
-		if err != nil {
-			return err
-		}
-	}
-
-	if l.FullCommand != nil {
-		imageConfig.Cmd = nil
-		imageConfig.Entrypoint, err = l.ParseFullCommand()
-		if err != nil {
-			return err
-		}
+	if err := mergeCommand(name, l, &imageConfig); err != nil {
+		return err
 	}
 
 	if imageConfig.Volumes == nil {
@@ -198,24 +314,11 @@ func (b *Builder) updateOCIConfigForOutput(sf *types.Stackerfile, s types.Storag
 		return err
 	}
 
-	username := os.Getenv("SUDO_USER")
-
-	if username == "" {
-		user, err := user.Current()
-		if err != nil {
-			return err
-		}
-
-		username = user.Username
-	}
-
-	host, err := os.Hostname()
+	author, explicitAuthor, err := l.ParseAuthor(opts.Config)
 	if err != nil {
 		return err
 	}
 
-	author := fmt.Sprintf("%s@%s", username, host)
-
 	meta.Created = time.Now()
 	meta.Architecture = runtime.GOARCH
 	meta.OS = runtime.GOOS
@@ -230,14 +333,35 @@ func (b *Builder) updateOCIConfigForOutput(sf *types.Stackerfile, s types.Storag
 	// in. we don't care if it's not a git directory, because in that case
 	// we'll fall back to putting the whole stacker file contents in the
 	// metadata.
-	gitVersion, _ := GitVersion(sf.ReferenceDirectory)
+	if !opts.Config.NoGitAnnotations {
+		gitVersion, _ := GitVersion(sf.ReferenceDirectory)
+
+		if gitVersion != "" {
+			log.Debugf("setting git version annotation to %s", gitVersion)
+			annotations[GitVersionAnnotation] = gitVersion
+		}
+
+		gitAnnotations, err := GitAnnotations(sf.ReferenceDirectory)
+		if err != nil {
+			log.Debugf("not adding git annotations: %v", err)
+		}
 
-	if gitVersion != "" {
-		log.Debugf("setting git version annotation to %s", gitVersion)
-		annotations[GitVersionAnnotation] = gitVersion
+		for k, v := range gitAnnotations {
+			annotations[k] = v
+		}
+	}
+
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		return err
 	}
 
+	setVerityChain(opts.Config, name, layerType, manifest.Layers, annotations)
+
 	annotations[StackerContentsAnnotation] = sf.AfterSubstitutions
+	if explicitAuthor {
+		annotations[ispec.AnnotationAuthors] = author
+	}
 
 	history := ispec.History{
 		EmptyLayer: true, // this is only the history for imageConfig edit
@@ -245,6 +369,11 @@ func (b *Builder) updateOCIConfigForOutput(sf *types.Stackerfile, s types.Storag
 		CreatedBy:  "stacker build",
 		Author:     author,
 	}
+	if noChanges {
+		// there's no layer for the build, so say that it ran, and
+		// didn't change anything
+		history.Comment = "no filesystem changes"
+	}
 
 	err = mutator.Set(context.Background(), imageConfig, meta, annotations, &history)
 	if err != nil {
@@ -269,6 +398,83 @@ func (b *Builder) updateOCIConfigForOutput(sf *types.Stackerfile, s types.Storag
 	return nil
 }
 
+// Report returns a summary of the layers built so far
+func (b *Builder) Report() *Report {
+	return &b.report
+}
+
+func (b *Builder) recordLayer(oci casext.Engine, file string, name string, l *types.Layer, cacheHit bool, layerTypes []types.LayerType, start time.Time) error {
+	lr := LayerReport{
+		Stackerfile: file,
+		Name:        name,
+		CacheHit:    cacheHit,
+		BuildOnly:   l.BuildOnly,
+		Outputs:     []ManifestReport{},
+	}
+
+	for _, layerType := range layerTypes {
+		mr, err := newManifestReport(oci, layerType, name)
+		if err != nil {
+			return err
+		}
+		lr.Outputs = append(lr.Outputs, mr)
+	}
+
+	lr.Steps = b.steps
+	b.steps = nil
+
+	lr.DurationSeconds = time.Since(start).Seconds()
+	b.report.Layers = append(b.report.Layers, lr)
+	b.webhook.send(WebhookEvent{Event: EventLayerBuilt, Stackerfiles: []string{file}, Layer: &lr})
+	return nil
+}
+
+// ensureBaseLayerTypes makes sure that if name is built on top of another
+// layer in the output, that layer is in the output in all of the layer types
+// name wants, since name's layers will be added on top of those, converting
+// it if necessary.
+func ensureBaseLayerTypes(s types.Storage, oci casext.Engine, name string, layerTypes []types.LayerType, sfm types.StackerFiles) error {
+	baseTag, baseLayer, err := storage.FindFirstBaseInOutput(name, sfm)
+	if err != nil {
+		return err
+	}
+
+	if baseLayer == nil || baseLayer.BuildOnly || baseTag == name {
+		return nil
+	}
+
+	for _, layerType := range layerTypes {
+		descPaths, err := oci.ResolveReference(context.Background(), layerType.LayerName(baseTag))
+		if err != nil {
+			return err
+		}
+
+		if len(descPaths) == 0 {
+			log.Infof("%s wants %s output, converting its base %s", name, layerType, baseTag)
+			if err := s.ConvertOutput(baseTag, layerType); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkStackerfile checks that the stacker file sf (at path) only uses the
+// hosts the config allows, that its outputs can be made with the config, and
+// that it passes its policy.
+func checkStackerfile(config types.StackerConfig, path string, sf *types.Stackerfile) error {
+	if err := checkAllowedHosts(config, path, sf); err != nil {
+		return err
+	}
+
+	if err := checkOutputsMapping(config, sf); err != nil {
+		return err
+	}
+
+	return checkStackerfilePolicy(config, path, sf)
+}
+
 // Build builds a single stackerfile
 func (b *Builder) Build(s types.Storage, file string) error {
 	opts := b.opts
@@ -282,6 +488,20 @@ func (b *Builder) Build(s types.Storage, file string) error {
 		return err
 	}
 
+	if !b.checked {
+		if err := checkStackerfile(opts.Config, file, sf); err != nil {
+			return err
+		}
+	}
+
+	mode := lockNew
+	if opts.UpdateLock && !b.basesLocked {
+		mode = lockUpdate
+	}
+	if err := resolveBases(file, sf, mode); err != nil {
+		return err
+	}
+
 	order, err := sf.DependencyOrder(b.builtStackerfiles)
 	if err != nil {
 		return err
@@ -291,9 +511,9 @@ func (b *Builder) Build(s types.Storage, file string) error {
 
 	var oci casext.Engine
 	if _, statErr := os.Stat(opts.Config.OCIDir); statErr != nil {
-		oci, err = umoci.CreateLayout(opts.Config.OCIDir)
+		oci, err = stackeroci.CreateLayout(opts.Config.OCIDir)
 	} else {
-		oci, err = umoci.OpenLayout(opts.Config.OCIDir)
+		oci, err = stackeroci.OpenLayout(opts.Config.OCIDir)
 	}
 	if err != nil {
 		return err
@@ -306,229 +526,723 @@ func (b *Builder) Build(s types.Storage, file string) error {
 	if err != nil {
 		return err
 	}
+	buildCache.SetVerifyImports(opts.VerifyImports)
+
+	// the container is closed (by buildLayer) before this
+	defer func() {
+		if b.Cancelled() && buildCache.Provisioning[b.provisioning] {
+			log.Infof("build cancelled, rolling back %s", b.provisioning)
+			if err := s.Delete(b.provisioning); err != nil {
+				log.Infof("couldn't roll back %s: %v", b.provisioning, err)
+			}
+		}
+	}()
 
 	for _, name := range order {
-		l, ok := sf.Get(name)
-		if !ok {
-			return errors.Errorf("%s not present in stackerfile?", name)
+		if b.Cancelled() {
+			return cancelledError()
 		}
 
-		// if a container builds on another container in a stacker
-		// file, we can't correctly render the dependent container's
-		// filesystem, since we don't know what the output of the
-		// parent build will be. so let's refuse to run in setup-only
-		// mode in this case.
-		if opts.SetupOnly && l.From.Type == types.BuiltLayer {
-			return errors.Errorf("no built type layers (%s) allowed in setup mode", name)
+		if dep := b.failedDependency(sf, name); dep != "" {
+			b.layerSkipped(file, sf, name, dep)
+			continue
 		}
 
-		log.Infof("preparing image %s...", name)
+		if err := b.buildLayer(s, oci, buildCache, sf, file, name); err != nil {
+			if !opts.KeepGoing || b.Cancelled() {
+				return err
+			}
 
-		// We need to run the imports first since we now compare
-		// against imports for caching layers. Since we don't do
-		// network copies if the files are present and we use rsync to
-		// copy things across, hopefully this isn't too expensive.
-		imports, err := l.ParseImport()
-		if err != nil {
-			return err
+			b.layerFailed(file, sf, name, err)
 		}
+	}
+	b.report.FailedLayer = nil
 
-		err = CleanImportsDir(opts.Config, name, imports, buildCache)
-		if err != nil {
-			return err
-		}
+	// even if everything was cached, we may have hashed some new files
+	err = buildCache.persist()
+	if err != nil {
+		return err
+	}
 
-		if err := Import(opts.Config, s, name, imports, opts.Progress); err != nil {
-			return err
-		}
+	// the commands reading images in the OCI output hold shared locks
+	unlock, err := LockOCILayout(opts.Config.OCIDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-		// Need to check if the image has bind mounts, if the image has bind mounts,
-		// it needs to be rebuilt regardless of the build cache
-		// The reason is that tracking build cache for bind mounted folders
-		// is too expensive, so we don't do it
-		binds, err := l.ParseBinds()
-		if err != nil {
-			return err
-		}
+	return oci.GC(context.Background())
+}
 
-		baseOpts := BaseLayerOpts{
-			Config:     opts.Config,
-			Name:       name,
-			Layer:      l,
-			Cache:      buildCache,
-			OCI:        oci,
-			LayerTypes: opts.LayerTypes,
-			Storage:    s,
-			Progress:   opts.Progress,
-		}
+// buildLayer builds the layer name of the stackerfile sf.
+func (b *Builder) buildLayer(s types.Storage, oci casext.Engine, buildCache *BuildCache, sf *types.Stackerfile, file string, name string) error {
+	opts := b.opts
+
+	l, ok := sf.Get(name)
+	if !ok {
+		return errors.Errorf("%s not present in stackerfile?", name)
+	}
+
+	// if a container builds on another container in a stacker
+	// file, we can't correctly render the dependent container's
+	// filesystem, since we don't know what the output of the
+	// parent build will be. so let's refuse to run in setup-only
+	// mode in this case.
+	if opts.SetupOnly && l.From.Type == types.BuiltLayer {
+		return errors.Errorf("no built type layers (%s) allowed in setup mode", name)
+	}
+
+	log.Infof("preparing image %s...", name)
+	start := time.Now()
+
+	// if anything below fails, this is the layer to blame
+	b.report.FailedLayer = &LayerFailure{Stackerfile: file, Name: name, Line: sf.LayerLine(name)}
+
+	layerTypes, err := l.ParseLayerType()
+	if err != nil {
+		return err
+	}
+	if layerTypes == nil {
+		layerTypes = opts.LayerTypes
+	}
+
+	// We need to run the imports first since we now compare
+	// against imports for caching layers. Since we don't do
+	// network copies if the files are present and we use rsync to
+	// copy things across, hopefully this isn't too expensive.
+	imports, err := l.ParseImport()
+	if err != nil {
+		return err
+	}
+
+	err = CleanImportsDir(opts.Config, name, imports, buildCache)
+	if err != nil {
+		return err
+	}
+
+	if err := Import(opts.Config, s, name, imports, buildCache, opts.Progress); err != nil {
+		return err
+	}
+
+	// Need to check if the image has bind mounts, if the image has
+	// bind mounts with no bind_cache, it needs to be rebuilt
+	// regardless of the build cache, since we have no idea
+	// whether their contents changed.
+	binds, err := l.ParseBinds()
+	if err != nil {
+		return err
+	}
+
+	baseOpts := BaseLayerOpts{
+		Config:     opts.Config,
+		Name:       name,
+		Layer:      l,
+		Cache:      buildCache,
+		OCI:        oci,
+		LayerTypes: layerTypes,
+		Storage:    s,
+		Progress:   opts.Progress,
+	}
 
-		if err := GetBase(baseOpts); err != nil {
+	if err := GetBase(baseOpts); err != nil {
+		return err
+	}
+
+	if contains(opts.Invalidate, name) {
+		if err := buildCache.Invalidate(name); err != nil {
 			return err
 		}
+	}
 
-		cacheEntry, cacheHit, err := buildCache.Lookup(name)
+	cacheEntry, cacheHit, err := buildCache.Lookup(name)
+	if err != nil {
+		return err
+	}
+	if cacheHit {
+		expired, err := buildCache.Expired(name, cacheEntry)
 		if err != nil {
 			return err
 		}
-		if cacheHit && (len(binds) == 0) {
-			if l.BuildOnly {
-				if cacheEntry.Name != name {
-					err = s.Snapshot(cacheEntry.Name, name)
+		if expired {
+			log.Infof("cache miss because %s was built more than its cache_ttl of %s ago", name, l.CacheTTL)
+			cacheHit = false
+		}
+	}
+	if cacheHit && !binds.AlwaysRebuild() {
+		if l.BuildOnly {
+			if cacheEntry.Name != name {
+				err = s.Snapshot(cacheEntry.Name, name)
+				if err != nil {
+					return err
+				}
+			}
+			if err := generateOutput(opts.Config, s, name, l, true); err != nil {
+				return err
+			}
+			if err := generateLayerOutputs(opts.Config, s, name, l, true); err != nil {
+				return err
+			}
+			if err := b.recordLayer(oci, file, name, l, true, nil, start); err != nil {
+				return err
+			}
+			return nil
+		} else {
+			foundCount := 0
+			for _, layerType := range layerTypes {
+				blob, ok := cacheEntry.Manifests[layerType]
+				if ok {
+					foundCount += 1
+					layerName := layerType.LayerName(name)
+					err = oci.UpdateReference(context.Background(), layerName, blob)
 					if err != nil {
 						return err
 					}
+					log.Infof("found cached layer %s", layerName)
 				}
-				continue
-			} else {
-				foundCount := 0
-				for _, layerType := range opts.LayerTypes {
-					blob, ok := cacheEntry.Manifests[layerType]
-					if ok {
-						foundCount += 1
-						layerName := layerType.LayerName(name)
-						err = oci.UpdateReference(context.Background(), layerName, blob)
-						if err != nil {
-							return err
-						}
-						log.Infof("found cached layer %s", layerName)
-					}
-				}
+			}
 
-				if foundCount == len(opts.LayerTypes) {
-					continue
+			if foundCount == len(layerTypes) {
+				// the policy may have changed since the
+				// layer was built
+				if err := checkImagePolicy(opts.Config, oci, name, layerTypes); err != nil {
+					return err
 				}
-
-				log.Infof("missing some cached layer output types, building anyway")
+				if err := generateOutput(opts.Config, s, name, l, true); err != nil {
+					return err
+				}
+				if err := generateLayerOutputs(opts.Config, s, name, l, true); err != nil {
+					return err
+				}
+				if err := b.recordLayer(oci, file, name, l, true, layerTypes, start); err != nil {
+					return err
+				}
+				return nil
 			}
-		} else if cacheHit && (len(binds) > 0) {
-			log.Infof("rebuilding cached layer due to use of binds in stacker file")
+
+			log.Infof("missing some cached layer output types, building anyway")
 		}
+	} else if cacheHit && binds.AlwaysRebuild() {
+		log.Infof("rebuilding cached layer due to use of binds in stacker file")
+	}
 
-		err = SetupRootfs(baseOpts)
+	if !l.BuildOnly {
+		err = ensureBaseLayerTypes(s, oci, name, layerTypes, b.builtStackerfiles)
 		if err != nil {
 			return err
 		}
+	}
+
+	runSteps, err := l.ParseRunSteps()
+	if err != nil {
+		return err
+	}
 
-		overlayDirs, err := l.ParseOverlayDirs()
+	// until the layer is built, what's in its rootfs can't be used
+	if err := buildCache.StartProvisioning(name); err != nil {
+		return err
+	}
+	b.provisioning = name
+
+	// the results of run steps that haven't changed since the
+	// last build can be reused, even though the layer has
+	stepKeys := []string{}
+	stepsDone := 0
+	if len(runSteps) != 0 && !opts.SetupOnly && canCacheRunSteps(s, l, binds) {
+		stepKeys, err = buildCache.RunStepKeys(name, runSteps)
 		if err != nil {
 			return err
 		}
 
-		err = s.SetOverlayDirs(name, overlayDirs, opts.LayerTypes)
+		stepsDone, err = restoreRunSteps(s, name, runSteps, stepKeys)
 		if err != nil {
 			return err
 		}
+	}
 
-		c, err := NewContainer(opts.Config, s, name)
+	if stepsDone == 0 {
+		err = SetupRootfs(baseOpts)
 		if err != nil {
 			return err
 		}
-		defer c.Close()
+	}
+
+	overlayDirs, err := l.ParseOverlayDirs()
+	if err != nil {
+		return err
+	}
+
+	err = s.SetOverlayDirs(name, overlayDirs, layerTypes)
+	if err != nil {
+		return err
+	}
+
+	c, err := NewContainer(opts.Config, s, name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	inherited, err := inheritConfig(opts.Config, oci, name, l, b.builtStackerfiles)
+	if err != nil {
+		return err
+	}
+
+	err = c.SetupBaseEnv(inherited.Env)
+	if err != nil {
+		return err
+	}
+
+	err = c.SetupLayerConfig(l, name)
+	if err != nil {
+		return err
+	}
 
-		err = c.SetupLayerConfig(l, name)
+	if opts.SetupOnly {
+		err = c.c.SaveConfigFile(path.Join(opts.Config.RootFSDir, name, "lxc.conf"))
 		if err != nil {
+			return errors.Wrapf(err, "error saving config file for %s", name)
+		}
+
+		if err := s.Finalize(name); err != nil {
 			return err
 		}
+		log.Infof("setup for %s complete", name)
+		return nil
+	}
 
-		if opts.SetupOnly {
-			err = c.c.SaveConfigFile(path.Join(opts.Config.RootFSDir, name, "lxc.conf"))
-			if err != nil {
-				return errors.Wrapf(err, "error saving config file for %s", name)
+	run, err := l.ParseRun()
+	if err != nil {
+		return err
+	}
+
+	err = c.CaptureSyslog()
+	if err != nil {
+		return err
+	}
+
+	umask, err := l.ParseUmask()
+	if err != nil {
+		return err
+	}
+
+	if err := checkRetries(s, l, runSteps); err != nil {
+		return err
+	}
+
+	runner := &stepRunner{b: b, c: c, s: s, name: name, user: inherited.User, dir: inherited.WorkingDir, umask: umask}
+	defer runner.stop()
+
+	// before the packages, so that their users don't get the uids these
+	// are meant to have; if run steps were restored, they have them
+	users, err := l.ParseUsers()
+	if err != nil {
+		return err
+	}
+	if len(users) != 0 && stepsDone == 0 {
+		log.Infof("adding %d users", len(users))
+		if err := c.AddUsers(users); err != nil {
+			return errors.Wrapf(err, "couldn't add users")
+		}
+	}
+
+	// with run_steps, installing the packages is the first step
+	packages, err := l.ParsePackages()
+	if err != nil {
+		return err
+	}
+	if packages != "" && len(runSteps) == 0 {
+		log.Infof("installing %s packages", l.Packages.Manager)
+		if err := runner.run("packages", []string{packages}, false, l.Retries); err != nil {
+			return err
+		}
+	}
+
+	if len(run) != 0 {
+		if err := runner.run("run", run, l.Interactive, l.Retries); err != nil {
+			return err
+		}
+	}
+
+	for i := stepsDone; i < len(runSteps); i++ {
+		log.Infof("running step %s", runSteps[i].Name)
+		if err := runner.run(runSteps[i].Name, runSteps[i].Run.([]string), runSteps[i].Interactive, runSteps[i].Retries); err != nil {
+			return errors.Wrapf(err, "run step %s failed", runSteps[i].Name)
+		}
+
+		if len(stepKeys) != 0 {
+			// the agent's mountpoints shouldn't end up in
+			// the snapshot
+			if err := runner.stop(); err != nil {
+				return err
 			}
 
-			if err := s.Finalize(name); err != nil {
+			if err := snapshotRunStep(s, name, stepKeys[i]); err != nil {
 				return err
 			}
-			log.Infof("setup for %s complete", name)
-			continue
 		}
+	}
 
-		run, err := l.ParseRun()
+	if err := runner.stop(); err != nil {
+		return err
+	}
+	b.steps = runner.steps
+
+	harden, err := l.ParseHarden()
+	if err != nil {
+		return err
+	}
+	if harden != nil {
+		writable, err := l.ParseWritablePaths()
 		if err != nil {
 			return err
 		}
 
-		if len(run) != 0 {
-			rootfs := path.Join(opts.Config.RootFSDir, name, "rootfs")
-			shellScript := path.Join(opts.Config.StackerDir, "imports", name, ".stacker-run.sh")
-			err = GenerateShellForRunning(rootfs, run, shellScript)
-			if err != nil {
-				return err
-			}
+		log.Infof("hardening %s", name)
+		if err := c.Harden(harden, writable); err != nil {
+			return errors.Wrapf(err, "couldn't harden %s", name)
+		}
+	}
 
-			// These should all be non-interactive; let's ensure that.
-			err = c.Execute("/stacker/.stacker-run.sh", nil)
-			if err != nil {
-				if opts.OnRunFailure != "" {
-					err2 := c.Execute(opts.OnRunFailure, os.Stdin)
-					if err2 != nil {
-						log.Infof("failed executing %s: %s\n", opts.OnRunFailure, err2)
-					}
-				}
-				return errors.Errorf("run commands failed: %s", err)
-			}
+	if len(stepKeys) != 0 {
+		if err := pruneRunSteps(opts.Config, s, name, stepKeys); err != nil {
+			return err
 		}
+	}
 
-		// This is a build only layer, meaning we don't need to include
-		// it in the final image, as outputs from it are going to be
-		// imported into future images. Let's just snapshot it and add
-		// a bogus entry to our cache.
-		if l.BuildOnly {
-			if err := s.Finalize(name); err != nil {
-				return err
-			}
+	// This is a build only layer, meaning we don't need to include
+	// it in the final image, as outputs from it are going to be
+	// imported into future images. Let's just snapshot it and add
+	// a bogus entry to our cache.
+	if l.BuildOnly {
+		if err := s.Finalize(name); err != nil {
+			return err
+		}
 
-			log.Debugf("build only layer, skipping OCI diff generation")
+		log.Debugf("build only layer, skipping OCI diff generation")
 
-			// A small hack: for build only layers, we keep track
-			// of the name, so we can make sure it exists when
-			// there is a cache hit. We should probably make this
-			// into some sort of proper Either type.
-			manifests := map[types.LayerType]ispec.Descriptor{opts.LayerTypes[0]: ispec.Descriptor{}}
-			if err := buildCache.Put(name, manifests); err != nil {
+		// A small hack: for build only layers, we keep track
+		// of the name, so we can make sure it exists when
+		// there is a cache hit. We should probably make this
+		// into some sort of proper Either type.
+		manifests := map[types.LayerType]ispec.Descriptor{layerTypes[0]: ispec.Descriptor{}}
+		if err := generateOutput(opts.Config, s, name, l, false); err != nil {
+			return err
+		}
+		if err := generateLayerOutputs(opts.Config, s, name, l, false); err != nil {
+			return err
+		}
+		if err := buildCache.Put(name, manifests); err != nil {
+			return err
+		}
+		if err := b.recordLayer(oci, file, name, l, false, nil, start); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	err = s.Repack(name, layerTypes, b.builtStackerfiles)
+	if err != nil {
+		return err
+	}
+
+	manifests := map[types.LayerType]ispec.Descriptor{}
+	for _, layerType := range layerTypes {
+		noChanges, err := producedNoChanges(opts.Config, oci, name, layerType, b.builtStackerfiles)
+		if err != nil {
+			return err
+		}
+
+		if l.MergeWithParent && !noChanges {
+			if err := mergeWithParent(opts.Config, oci, name, layerType, b.builtStackerfiles); err != nil {
 				return err
 			}
-			continue
 		}
 
-		err = s.Repack(name, opts.LayerTypes, b.builtStackerfiles)
+		if noChanges {
+			if opts.FailOnEmpty && expectsChanges(l) {
+				return errors.Errorf("%s: its run didn't change the filesystem", name)
+			}
+			log.Infof("%s didn't change the filesystem, it has no %s layer", name, layerType)
+		}
+
+		err = b.updateOCIConfigForOutput(sf, s, oci, layerType, l, name, noChanges)
 		if err != nil {
 			return err
 		}
 
-		manifests := map[types.LayerType]ispec.Descriptor{}
-		for _, layerType := range opts.LayerTypes {
-			err = b.updateOCIConfigForOutput(sf, s, oci, layerType, l, name)
-			if err != nil {
-				return err
+		descPaths, err := oci.ResolveReference(context.Background(), layerType.LayerName(name))
+		if err != nil {
+			return err
+		}
+
+		manifests[layerType] = descPaths[0].Descriptor()
+
+	}
+
+	err = checkLayerHygiene(opts.Config, oci, name, layerTypes, b.builtStackerfiles)
+	if err != nil {
+		return err
+	}
+
+	if l.IsArtifact() {
+		manifests, err = generateArtifact(opts.Config, s, oci, name, l, layerTypes)
+		if err != nil {
+			return err
+		}
+		log.Infof("packaged %s as an artifact", name)
+	}
+
+	// what's output, i.e. the artifact rather than the image it's from
+	err = checkImagePolicy(opts.Config, oci, name, layerTypes)
+	if err != nil {
+		return err
+	}
+
+	if err := generateOutput(opts.Config, s, name, l, false); err != nil {
+		return err
+	}
+	if err := generateLayerOutputs(opts.Config, s, name, l, false); err != nil {
+		return err
+	}
+
+	if err := buildCache.Put(name, manifests); err != nil {
+		return err
+	}
+
+	if err := s.Finalize(name); err != nil {
+		return err
+	}
+
+	if err := b.recordLayer(oci, file, name, l, false, layerTypes, start); err != nil {
+		return err
+	}
+
+	log.Infof("filesystem %s built successfully", name)
+	return nil
+}
+
+// expectsChanges returns true if l runs something (or installs packages), so
+// that its build not changing the filesystem is unexpected; layers that only
+// change the image config never do.
+func expectsChanges(l *types.Layer) bool {
+	run, _ := l.ParseRun()
+	steps, _ := l.ParseRunSteps()
+	return len(run) > 0 || len(steps) > 0
+}
+
+// stepRunner runs the commands from a layer's run and run_steps directives
+// in its container c, through a stacker agent if the config asks for one.
+type stepRunner struct {
+	b     *Builder
+	c     *Container
+	s     types.Storage
+	name  string
+	agent *Agent
+	steps []StepReport
+
+	// the user, working dir and umask to run the steps with, if they
+	// aren't the defaults
+	user  string
+	dir   string
+	umask string
+}
+
+// run runs step, attempting it again as retries says if it fails.
+func (r *stepRunner) run(step string, run []string, interactive bool, retries *types.Retries) error {
+	opts := r.b.opts
+	start := time.Now()
+	interactive = interactive || opts.Interactive
+
+	attempts, delay, err := retries.Parse()
+	if err != nil {
+		return err
+	}
+
+	// what the rootfs was before the step, so that the changes of failed
+	// attempts can be thrown away
+	snapshot := fmt.Sprintf("%s%s-retry", types.TemporarySnapshotPrefix, r.name)
+	if attempts > 1 {
+		// the agent's mountpoints shouldn't end up in the snapshot
+		if err := r.stop(); err != nil {
+			return err
+		}
+		if err := r.s.Snapshot(r.name, snapshot); err != nil {
+			return err
+		}
+		defer r.s.Delete(snapshot)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = r.attempt(step, run, interactive)
+		if err == nil || attempt >= attempts || r.b.Cancelled() {
+			break
+		}
+
+		log.Infof("%s failed (attempt %d of %d), retrying in %s: %s", step, attempt, attempts, delay, err)
+		if err := r.stop(); err != nil {
+			return err
+		}
+		if err := r.s.Delete(r.name); err != nil {
+			return err
+		}
+		if err := r.s.Restore(snapshot, r.name); err != nil {
+			return err
+		}
+		time.Sleep(delay)
+	}
+	if err != nil {
+		if r.b.Cancelled() {
+			return cancelledError()
+		}
+
+		if opts.OnRunFailure != "" {
+			// the agent's container has to exit before another
+			// one can be run
+			if err2 := r.stop(); err2 != nil {
+				log.Debugf("failed stopping agent: %s", err2)
 			}
 
-			descPaths, err := oci.ResolveReference(context.Background(), layerType.LayerName(name))
-			if err != nil {
-				return err
+			err2 := r.c.Execute(opts.OnRunFailure, os.Stdin)
+			if err2 != nil {
+				log.Infof("failed executing %s: %s\n", opts.OnRunFailure, err2)
 			}
+		}
+		return errors.Errorf("run commands failed: %s", err)
+	}
 
-			manifests[layerType] = descPaths[0].Descriptor()
+	r.steps = append(r.steps, StepReport{Name: step, DurationSeconds: time.Since(start).Seconds()})
+	return nil
+}
+
+// checkRetries checks that the layer's and its run steps' retries are valid,
+// and that the storage can do them: a retry starts from a snapshot of the
+// rootfs from before the step, and overlay's snapshots aren't copies, they
+// share the layer's upperdir.
+func checkRetries(s types.Storage, l *types.Layer, runSteps []types.RunStep) error {
+	retries := []*types.Retries{l.Retries}
+	for _, step := range runSteps {
+		retries = append(retries, step.Retries)
+	}
 
+	for _, r := range retries {
+		attempts, _, err := r.Parse()
+		if err != nil {
+			return err
 		}
 
-		if err := buildCache.Put(name, manifests); err != nil {
+		if attempts > 1 && s.Name() != "btrfs" {
+			return errors.Errorf("retries only work with btrfs storage, not %s", s.Name())
+		}
+	}
+
+	return nil
+}
+
+// attempt runs step once.
+func (r *stepRunner) attempt(step string, run []string, interactive bool) error {
+	opts := r.b.opts
+
+	if r.b.Cancelled() {
+		return cancelledError()
+	}
+	r.b.setRunning(r.c)
+	defer r.b.setRunning(nil)
+
+	var err error
+	if opts.Config.RunAgent && !interactive {
+		err = r.runInAgent(step, run)
+	} else {
+		// the agent doesn't do stdin, so interactive steps are run
+		// in a container of their own
+		if err := r.stop(); err != nil {
 			return err
 		}
 
-		if err := s.Finalize(name); err != nil {
+		rootfs := path.Join(opts.Config.RootFSDir, r.name, "rootfs")
+		shellScript := path.Join(opts.Config.StackerDir, "imports", r.name, ".stacker-run.sh")
+		err = GenerateShellForRunning(rootfs, run, shellScript)
+		if err != nil {
 			return err
 		}
 
-		log.Infof("filesystem %s built successfully", name)
+		args := "/stacker/.stacker-run.sh"
+		if r.user != "" || r.dir != "" || r.umask != "" {
+			if err := r.c.bindStacker(); err != nil {
+				return err
+			}
+			args = execAsCommand(r.user, r.dir, r.umask, args)
+		}
 
+		if interactive {
+			err = r.c.ExecuteInteractive(args)
+		} else {
+			// These should all be non-interactive; let's ensure that.
+			err = r.c.Execute(args, nil)
+		}
 	}
 
-	return oci.GC(context.Background())
+	return err
+}
+
+func (r *stepRunner) runInAgent(step string, run []string) error {
+	if r.agent == nil {
+		a, err := r.c.StartAgent()
+		if err != nil {
+			return err
+		}
+		r.agent = a
+	}
+
+	result, err := r.agent.Run(agent.Step{Name: step, Script: runScript(run), User: r.user, Dir: r.dir, Umask: r.umask}, os.Stdout, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("%s exited with status %d after %s", step, result.ExitCode, result.Duration)
+	if result.ExitCode != 0 {
+		return errors.Errorf("exit status %d", result.ExitCode)
+	}
+
+	return nil
+}
+
+// execAsCommand returns the command that runs script as user in dir with
+// umask in the container.
+func execAsCommand(user string, dir string, umask string, script string) string {
+	args := "/static-stacker internal-go exec-as"
+	if user != "" {
+		args += " --user " + user
+	}
+	if dir != "" {
+		args += " --dir " + dir
+	}
+	if umask != "" {
+		args += " --umask " + umask
+	}
+	return args + " " + script
+}
+
+// stop stops the agent, if there is one. The next step will start another.
+func (r *stepRunner) stop() error {
+	if r.agent == nil {
+		return nil
+	}
+
+	err := r.agent.Stop()
+	r.agent = nil
+	return err
 }
 
 // BuildMultiple builds a list of stackerfiles
 func (b *Builder) BuildMultiple(paths []string) error {
+	start := time.Now()
+	b.webhook.send(WebhookEvent{Event: EventStarted, Stackerfiles: paths})
+	err := b.buildMultiple(paths)
+	b.webhook.finish(&b.report, start, err)
+	return err
+}
+
+func (b *Builder) buildMultiple(paths []string) error {
 	opts := b.opts
 
 	s, err := NewStorage(opts.Config)
@@ -539,12 +1253,46 @@ func (b *Builder) BuildMultiple(paths []string) error {
 		defer s.Detach()
 	}
 
+	// clean up after any stacker that died while writing the output
+	if err := stackeroci.Recover(opts.Config.OCIDir); err != nil {
+		return err
+	}
+
 	// Read all the stacker recipes
 	stackerFiles, err := types.NewStackerFiles(paths, append(opts.Substitute, b.opts.Config.Substitutions()...))
 	if err != nil {
 		return err
 	}
 
+	// before anything is fetched from the hosts they might not allow
+	files := []string{}
+	for p := range stackerFiles {
+		files = append(files, p)
+	}
+	sort.Strings(files)
+	for _, p := range files {
+		if err := checkStackerfile(opts.Config, p, stackerFiles[p]); err != nil {
+			return err
+		}
+	}
+	b.checked = true
+
+	// before the bases are prefetched; Build() finds them locked
+	mode := lockNew
+	if opts.UpdateLock {
+		mode = lockUpdate
+	}
+	if err := resolveStackerFilesBases(stackerFiles, mode); err != nil {
+		return err
+	}
+	b.basesLocked = true
+
+	for _, name := range opts.Invalidate {
+		if _, ok := stackerFiles.LookupLayerDefinition(name); !ok {
+			return errors.Errorf("can't invalidate %s, there's no such layer", name)
+		}
+	}
+
 	// Initialize the DAG
 	dag, err := NewStackerFilesDAG(stackerFiles)
 	if err != nil {
@@ -568,6 +1316,11 @@ func (b *Builder) BuildMultiple(paths []string) error {
 		return nil
 	}
 
+	// --no-cache throws away anything downloaded before each build
+	if opts.Jobs > 1 && !opts.NoCache {
+		prefetchBases(opts.Config, prefetchList(dag, stackerFiles), opts.Jobs)
+	}
+
 	// Build all Stackerfiles
 	for i, p := range sortedPaths {
 		log.Debugf("building: %d %s", i, p)
@@ -578,5 +1331,19 @@ func (b *Builder) BuildMultiple(paths []string) error {
 		}
 	}
 
+	if err := b.keepGoingError(); err != nil {
+		return err
+	}
+
+	// each Build() already collected the OCI output
+	if opts.Config.GCAfterBuild {
+		reclaimed, err := gcLayerBases(opts.Config)
+		if err != nil {
+			return err
+		}
+		b.report.ReclaimedBytes = reclaimed
+		log.Infof("gc of the base images in %s reclaimed %s", opts.Config.StackerDir, humanize.IBytes(uint64(reclaimed)))
+	}
+
 	return nil
 }
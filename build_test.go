@@ -0,0 +1,51 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/anuvu/stacker/types"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	base := func() ispec.ImageConfig {
+		return ispec.ImageConfig{Entrypoint: []string{"/bin/sh", "-c"}, Cmd: []string{"echo base"}}
+	}
+
+	for _, tc := range []struct {
+		layer      types.Layer
+		entrypoint []string
+		cmd        []string
+	}{
+		// nothing set, everything is inherited
+		{types.Layer{}, []string{"/bin/sh", "-c"}, []string{"echo base"}},
+		{types.Layer{Entrypoint: "/app"}, []string{"/app"}, []string{"echo base"}},
+		{types.Layer{Cmd: "--help"}, []string{"/bin/sh", "-c"}, []string{"--help"}},
+		{types.Layer{Entrypoint: "/app", CommandMerge: "replace"}, []string{"/app"}, []string{}},
+		{types.Layer{CommandMerge: "replace"}, []string{}, []string{}},
+		{types.Layer{Cmd: "--verbose", CommandMerge: "append"}, []string{"/bin/sh", "-c"}, []string{"echo base", "--verbose"}},
+		{types.Layer{FullCommand: "/app --help", CommandMerge: "append"}, []string{"/app", "--help"}, nil},
+	} {
+		imageConfig := base()
+		l := tc.layer
+		assert.NoError(mergeCommand("test", &l, &imageConfig))
+		assert.Equal(tc.entrypoint, imageConfig.Entrypoint, "%+v", tc.layer)
+		assert.Equal(tc.cmd, imageConfig.Cmd, "%+v", tc.layer)
+	}
+
+	imageConfig := base()
+	assert.Error(mergeCommand("test", &types.Layer{CommandMerge: "prepend"}, &imageConfig))
+}
+
+func TestSetEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	env := []string{"PATH=/bin", "HOME=/root"}
+	env = setEnv(env, "PATH", "/usr/bin:/bin")
+	env = setEnv(env, "FOO", "bar=baz")
+	env = setEnv(env, "PATHS", "no")
+	assert.Equal([]string{"PATH=/usr/bin:/bin", "HOME=/root", "FOO=bar=baz", "PATHS=no"}, env)
+}
@@ -3,25 +3,31 @@ package stacker
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/anuvu/stacker/lib"
 	"github.com/anuvu/stacker/log"
+	stackeroci "github.com/anuvu/stacker/oci"
 	"github.com/anuvu/stacker/types"
 	"github.com/mitchellh/hashstructure"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
-	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
 	"github.com/vbatts/go-mtree"
 )
 
-const currentCacheVersion = 10
+const currentCacheVersion = 13
 
 type ImportType int
 
@@ -46,17 +52,30 @@ type OverlayDirHash struct {
 	Hash string
 }
 
+type BindHash struct {
+	// The bind_cache mode the hash was computed with.
+	Mode string
+	Hash string
+}
+
 type CacheEntry struct {
 	// A map of LayerType:Manifest this build corresponds to.
 	Manifests map[types.LayerType]ispec.Descriptor
 
 	// A map of the import url to the base64 encoded result of mtree walk
-	// or sha256 sum of a file, depending on what Type is.
+	// or sha256 sum of a file, depending on what Type is. Like all the
+	// paths in the CacheEntry, the url is normalized by
+	// BuildCache.normalizer(), so the cache doesn't depend on where
+	// things are on disk.
 	Imports map[string]ImportHash
 
 	// A map of the overlay_dir url to the base64 encoded result of mtree walk
 	OverlayDirs map[string]OverlayDirHash
 
+	// A map of bind sources to hashes of their contents, for binds
+	// which have a bind_cache of mtime or content.
+	Binds map[string]BindHash
+
 	// The name of this layer as it was built. Useful for the BuildOnly
 	// case to make sure it still exists, and for printing error messages.
 	Name string
@@ -69,6 +88,16 @@ type CacheEntry struct {
 	// mismatch with the current base layer's CacheEntry, the layer should
 	// be rebuilt.
 	Base string
+
+	// When the layer was built, for layers with a cache_ttl. It isn't an
+	// input of the build, so it isn't part of the entry's hash, but it is
+	// part of the Base of the layers built on build only layers.
+	Created time.Time `hash:"ignore"`
+
+	// The layer's epoch in the BuildCache when it was built; invalidating
+	// the layer bumps that, so this entry no longer matches. Like Created,
+	// it's part of the Base of the layers built on it instead of its hash.
+	Epoch int `hash:"ignore"`
 }
 
 type BuildCache struct {
@@ -76,6 +105,15 @@ type BuildCache struct {
 	Cache   map[string]CacheEntry `json:"cache"`
 	Version int                   `json:"version"`
 	config  types.StackerConfig
+	files   *fileHashCache
+
+	// Provisioning are the layers whose rootfs is being (or was, by a
+	// build that didn't finish) set up, so what's in it can't be used.
+	Provisioning map[string]bool `json:"provisioning,omitempty"`
+
+	// Epochs are how many times each layer was invalidated, so that they
+	// are rebuilt until their cache entries record the current epoch.
+	Epochs map[string]int `json:"epochs,omitempty"`
 }
 
 type versionCheck struct {
@@ -96,6 +134,7 @@ func OpenCache(config types.StackerConfig, oci casext.Engine, sfm types.StackerF
 	cache := &BuildCache{
 		sfm:    sfm,
 		config: config,
+		files:  openFileHashCache(config),
 	}
 
 	if err != nil {
@@ -117,19 +156,26 @@ func OpenCache(config types.StackerConfig, oci casext.Engine, sfm types.StackerF
 		return nil, err
 	}
 
+	dirty := false
 	if !cacheOk {
-		log.Infof("old cache version found, clearing cache and rebuilding from scratch...")
-		os.Remove(config.CacheFile())
-		cache.Cache = map[string]CacheEntry{}
-		cache.Version = currentCacheVersion
-		return cache, nil
+		content, err = migrateCache(cache, content)
+		if err != nil {
+			log.Infof("couldn't migrate old cache (%v), clearing cache and rebuilding from scratch...", err)
+			os.Remove(config.CacheFile())
+			cache.Cache = map[string]CacheEntry{}
+			cache.Version = currentCacheVersion
+			return cache, nil
+		}
+
+		log.Infof("migrated cache to version %d", currentCacheVersion)
+		// make sure we don't have to do it again next time
+		dirty = true
 	}
 
 	if err := json.Unmarshal(content, cache); err != nil {
 		return nil, errors.Wrapf(err, "error parsing cache")
 	}
 
-	pruned := false
 	for hash, ent := range cache.Cache {
 		if ent.Layer.BuildOnly {
 			// If this is a build only layer, we just rely on the
@@ -151,11 +197,11 @@ func OpenCache(config types.StackerConfig, oci casext.Engine, sfm types.StackerF
 			log.Infof("couldn't find %s, pruning it from the cache", ent.Name)
 			log.Debugf("original error %s", err)
 			delete(cache.Cache, hash)
-			pruned = true
+			dirty = true
 		}
 	}
 
-	if pruned {
+	if dirty {
 		err := cache.persist()
 		if err != nil {
 			return nil, err
@@ -168,8 +214,14 @@ func OpenCache(config types.StackerConfig, oci casext.Engine, sfm types.StackerF
 /* Explicitly don't use mtime */
 var mtreeKeywords = []mtree.Keyword{"type", "link", "uid", "gid", "xattr", "mode", "sha256digest"}
 
-func walkImport(path string) (*mtree.DirectoryHierarchy, error) {
-	return mtree.Walk(path, nil, mtreeKeywords, nil)
+func walkImport(path string, files *fileHashCache) (*mtree.DirectoryHierarchy, error) {
+	return mtree.Walk(path, nil, mtreeKeywords, files.fsEval())
+}
+
+// SetVerifyImports makes the cache fully re-hash all imports, instead of
+// trusting the hashes of files whose size and mtime haven't changed.
+func (c *BuildCache) SetVerifyImports(verify bool) {
+	c.files.verify = verify
 }
 
 func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
@@ -188,12 +240,28 @@ func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
 		return nil, false, nil
 	}
 
+	if c.Provisioning[name] {
+		log.Infof("cache miss because the last build of %s didn't finish", name)
+		return nil, false, nil
+	}
+
+	if result.Epoch != c.Epochs[name] {
+		log.Infof("cache miss because %s was invalidated", name)
+		return nil, false, nil
+	}
+
+	normalizer := c.normalizer(l.ReferenceDirectory())
+	normalized, err := normalizeLayer(normalizer, l)
+	if err != nil {
+		return nil, false, err
+	}
+
 	h1, err := hashstructure.Hash(result.Layer, nil)
 	if err != nil {
 		return nil, false, err
 	}
 
-	h2, err := hashstructure.Hash(l, nil)
+	h2, err := hashstructure.Hash(normalized, nil)
 	if err != nil {
 		return nil, false, err
 	}
@@ -219,7 +287,7 @@ func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
 	}
 
 	for _, imp := range imports {
-		cachedImport, ok := result.Imports[imp.Path]
+		cachedImport, ok := result.Imports[normalizer.Replace(imp.Path)]
 		if !ok {
 			log.Infof("cache miss because of new import: %s", imp.Path)
 			return nil, false, nil
@@ -243,7 +311,7 @@ func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
 		}
 
 		if st.IsDir() {
-			dirChanged, err := isCachedDirChanged(diskPath, cachedImport.Hash)
+			dirChanged, err := isCachedDirChanged(diskPath, cachedImport.Hash, c.files)
 			if err != nil {
 				return nil, false, err
 			}
@@ -252,7 +320,7 @@ func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
 				return nil, false, nil
 			}
 		} else {
-			h, err := lib.HashFile(diskPath, true)
+			h, err := c.files.HashFile(diskPath, true)
 			if err != nil {
 				return nil, false, err
 			}
@@ -270,7 +338,7 @@ func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
 	}
 
 	for _, overlayDir := range overlayDirs {
-		cachedOverlayDir, ok := result.OverlayDirs[overlayDir.Source]
+		cachedOverlayDir, ok := result.OverlayDirs[normalizer.Replace(overlayDir.Source)]
 		if !ok {
 			log.Infof("cache miss because of new overlay_dir: %s", overlayDir.Source)
 			return nil, false, nil
@@ -284,7 +352,7 @@ func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
 			}
 			return nil, false, err
 		}
-		dirChanged, err := isCachedDirChanged(overlayDir.Source, cachedOverlayDir.Hash)
+		dirChanged, err := isCachedDirChanged(overlayDir.Source, cachedOverlayDir.Hash, c.files)
 		if err != nil {
 			return nil, false, err
 		}
@@ -294,10 +362,55 @@ func (c *BuildCache) Lookup(name string) (*CacheEntry, bool, error) {
 		}
 	}
 
+	binds, err := l.ParseBinds()
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, bind := range binds {
+		if bind.BindCache != types.BindCacheMtime && bind.BindCache != types.BindCacheContent {
+			continue
+		}
+
+		cachedBind, ok := result.Binds[normalizer.Replace(bind.Source)]
+		if !ok || cachedBind.Mode != bind.BindCache {
+			log.Infof("cache miss because of new bind: %s", bind.Source)
+			return nil, false, nil
+		}
+
+		h, err := hashBind(bind.Source, bind.BindCache)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if h != cachedBind.Hash {
+			log.Infof("cache miss because bind content changed: %s", bind.Source)
+			return nil, false, nil
+		}
+	}
+
 	return &result, true, nil
 }
 
-func isCachedDirChanged(dirPath string, cachedDirHash string) (bool, error) {
+// Expired returns whether entry, the layer name's cache entry that Lookup
+// found, was built more than the layer's cache_ttl ago. Only the decision to
+// rebuild the layer looks at it: publish and the like go on using the last
+// build, however old, as do the hashes of the layers built on it.
+func (c *BuildCache) Expired(name string, entry *CacheEntry) (bool, error) {
+	l, ok := c.sfm.LookupLayerDefinition(name)
+	if !ok {
+		return false, nil
+	}
+
+	ttl, err := l.ParseCacheTTL()
+	if err != nil {
+		return false, err
+	}
+
+	return ttl > 0 && time.Since(entry.Created) > ttl, nil
+}
+
+func isCachedDirChanged(dirPath string, cachedDirHash string, files *fileHashCache) (bool, error) {
 	rawCachedImport, err := base64.StdEncoding.DecodeString(cachedDirHash)
 	if err != nil {
 		return true, err
@@ -308,7 +421,7 @@ func isCachedDirChanged(dirPath string, cachedDirHash string) (bool, error) {
 		return true, err
 	}
 
-	dh, err := walkImport(dirPath)
+	dh, err := walkImport(dirPath, files)
 	if err != nil {
 		return true, err
 	}
@@ -325,8 +438,8 @@ func isCachedDirChanged(dirPath string, cachedDirHash string) (bool, error) {
 	return false, nil
 }
 
-func getEncodedMtree(path string) (string, error) {
-	dh, err := walkImport(path)
+func getEncodedMtree(path string, files *fileHashCache) (string, error) {
+	dh, err := walkImport(path, files)
 	if err != nil {
 		return "", err
 	}
@@ -340,8 +453,185 @@ func getEncodedMtree(path string) (string, error) {
 	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
 }
 
+// hashBind computes a hash of the contents of a bind mount's source,
+// according to its bind_cache mode.
+func hashBind(source string, mode string) (string, error) {
+	if mode == types.BindCacheContent {
+		h, err := hashGitWorkTree(source)
+		if err == nil {
+			return h, nil
+		}
+		log.Debugf("couldn't use git to hash %s, walking it instead: %v", source, err)
+	}
+
+	h := sha256.New()
+	err := filepath.Walk(source, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, p)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(h, "%s %v", rel, info.Mode())
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't readlink %s", p)
+			}
+			fmt.Fprintf(h, " %s", target)
+		case !info.Mode().IsRegular():
+		case mode == types.BindCacheMtime:
+			fmt.Fprintf(h, " %d %d", info.Size(), info.ModTime().UnixNano())
+		default:
+			fileHash, err := lib.HashFile(p, false)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, " %s", fileHash)
+		}
+
+		fmt.Fprintf(h, "\n")
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't hash bind %s", source)
+	}
+
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
+
+// hashGitWorkTree hashes the contents of a directory in a git work tree. It
+// uses the blob hashes in git's index instead of reading every file, and only
+// reads the contents of files which git thinks are modified or untracked.
+// Files that git ignores are not included in the hash.
+func hashGitWorkTree(dir string) (string, error) {
+	st, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+
+	if !st.IsDir() {
+		return "", errors.Errorf("%s is not a directory", dir)
+	}
+
+	// like git status, so that files whose stat info changed but whose
+	// contents didn't (e.g. touched ones) aren't --modified; the index
+	// may not be writable, which just means they're hashed below
+	exec.Command("git", "-C", dir, "update-index", "-q", "--refresh").Run()
+
+	staged, err := exec.Command("git", "-C", dir, "ls-files", "--stage", "-z", ".").Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "git ls-files --stage failed")
+	}
+
+	changed, err := exec.Command("git", "-C", dir, "ls-files", "-z", "--modified", "--others", "--exclude-standard", ".").Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "git ls-files --modified failed")
+	}
+
+	h := sha256.New()
+	h.Write(staged)
+
+	for _, f := range strings.Split(string(changed), "\x00") {
+		if f == "" {
+			continue
+		}
+
+		fileHash, err := lib.HashFile(filepath.Join(dir, f), true)
+		if err != nil {
+			if !os.IsNotExist(errors.Cause(err)) {
+				return "", err
+			}
+
+			fileHash = "deleted"
+		}
+
+		fmt.Fprintf(h, "%s %s\n", f, fileHash)
+	}
+
+	return fmt.Sprintf("git:%x", h.Sum(nil)), nil
+}
+
+// normalizer returns a replacer that rewrites the machine specific absolute
+// paths in a layer (refDir, the directory its stacker file is in, and
+// stacker's own working directories) into placeholders, so that a cache built
+// in one workspace can be used in another.
+func (c *BuildCache) normalizer(refDir string) *strings.Replacer {
+	dirs := map[string]string{
+		refDir:              "${{REFERENCE_DIR}}",
+		c.config.StackerDir: "${{STACKER_STACKER_DIR}}",
+		c.config.RootFSDir:  "${{STACKER_ROOTFS_DIR}}",
+		c.config.OCIDir:     "${{STACKER_OCI_DIR}}",
+	}
+
+	// strings.Replacer tries the replacements in order, so make sure e.g.
+	// a stacker dir inside the reference dir is replaced first.
+	sorted := []string{}
+	for dir := range dirs {
+		if dir == "" || dir == "/" {
+			continue
+		}
+		sorted = append(sorted, dir)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return len(sorted[i]) > len(sorted[j])
+	})
+
+	replacements := []string{}
+	for _, dir := range sorted {
+		replacements = append(replacements, dir, dirs[dir])
+	}
+
+	return strings.NewReplacer(replacements...)
+}
+
+// normalizeLayer returns a copy of l with all of its paths normalized.
+func normalizeLayer(normalizer *strings.Replacer, l *types.Layer) (*types.Layer, error) {
+	content, err := json.Marshal(l)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't marshal layer")
+	}
+
+	normalized := &types.Layer{}
+	err = json.Unmarshal([]byte(normalizer.Replace(string(content))), normalized)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't unmarshal normalized layer")
+	}
+
+	return normalized, nil
+}
+
 // getBaseHash returns some kind of "hash" for the base layer, whatever type it
 // may be.
+// entryBaseHash returns what the layers built on the layer whose cache entry
+// is ent record as their Base: the entry's hash, its epoch and, since build
+// only layers have no manifests that a rebuild (e.g. once their cache_ttl is
+// up) would change, when they were built.
+func entryBaseHash(ent CacheEntry) (string, error) {
+	h, err := hashstructure.Hash(&ent, nil)
+	if err != nil {
+		return "", err
+	}
+
+	base := fmt.Sprintf("%d", h)
+	if len(ent.Manifests) == 0 {
+		base = fmt.Sprintf("%s-%s", base, ent.Created.UTC().Format(time.RFC3339Nano))
+	}
+
+	// nor would a rebuild that came out the same as before, but
+	// invalidating a layer rebuilds everything built on it too
+	if ent.Epoch != 0 {
+		base = fmt.Sprintf("%s-epoch%d", base, ent.Epoch)
+	}
+
+	return base, nil
+}
+
 func (c *BuildCache) getBaseHash(name string) (string, error) {
 	l, ok := c.sfm.LookupLayerDefinition(name)
 	if !ok {
@@ -359,17 +649,12 @@ func (c *BuildCache) getBaseHash(name string) (string, error) {
 			return "", errors.Errorf("couldn't find a cache of base layer for %s: %s", name, l.From.Tag)
 		}
 
-		baseHash, err := hashstructure.Hash(baseEnt, nil)
-		if err != nil {
-			return "", err
-		}
-
-		return fmt.Sprintf("%d", baseHash), nil
+		return entryBaseHash(*baseEnt)
 	case types.TarLayer:
 		// use the hash of the input tarball
 		cacheDir := path.Join(c.config.StackerDir, "layer-bases")
 		tar := path.Join(cacheDir, path.Base(l.From.Url))
-		return lib.HashFile(tar, true)
+		return c.files.HashFile(tar, true)
 	case types.OCILayer:
 		fallthrough
 	case types.DockerLayer:
@@ -379,7 +664,7 @@ func (c *BuildCache) getBaseHash(name string) (string, error) {
 		}
 
 		// use the manifest hash of the thing in the cache
-		oci, err := umoci.OpenLayout(path.Join(c.config.StackerDir, "layer-bases", "oci"))
+		oci, err := stackeroci.OpenLayout(path.Join(c.config.StackerDir, "layer-bases", "oci"))
 		if err != nil {
 			return "", err
 		}
@@ -401,28 +686,231 @@ func (c *BuildCache) getBaseHash(name string) (string, error) {
 }
 
 func (c *BuildCache) Put(name string, manifests map[types.LayerType]ispec.Descriptor) error {
+	ent, err := c.newEntry(name, manifests)
+	if err != nil {
+		return err
+	}
+
+	ent.Created = time.Now()
+	c.Cache[name] = ent
+	delete(c.Provisioning, name)
+	return c.persist()
+}
+
+// StartProvisioning records that name's rootfs is about to be set up, until
+// Put() records the result, so that if the build doesn't get that far (e.g.
+// because stacker was killed), later builds don't use what's left of it.
+func (c *BuildCache) StartProvisioning(name string) error {
+	if c.Provisioning == nil {
+		c.Provisioning = map[string]bool{}
+	}
+
+	c.Provisioning[name] = true
+	return c.persist()
+}
+
+// Invalidate bumps name's epoch, so that its cache entry (and its run steps'
+// snapshots) aren't used any more, and it's rebuilt the next time it's
+// built; along with everything built on it, since its rebuild changes their
+// base.
+func (c *BuildCache) Invalidate(name string) error {
+	if c.Epochs == nil {
+		c.Epochs = map[string]int{}
+	}
+
+	c.Epochs[name]++
+	log.Infof("invalidated the cache of %s", name)
+	return c.persist()
+}
+
+// RunStepKeys returns a key for the state of name's rootfs after each of
+// steps. The first step's key covers its inputs and everything the rootfs
+// depended on before it ran (the base, imports, binds, etc.), and each later
+// step's key covers the previous step's and its own inputs, so a step's key
+// only changes if it or something before it did. Things that only go in the
+// image's config (cmd, labels, etc.) are left out, so that changing them
+// doesn't rerun any steps.
+func (c *BuildCache) RunStepKeys(name string, steps []types.RunStep) ([]string, error) {
+	ent, err := c.newEntry(name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	l := ent.Layer
+	l.RunSteps = nil
+	l.Cmd = nil
+	l.Entrypoint = nil
+	l.FullCommand = nil
+	l.Environment = nil
+	l.Volumes = nil
+	l.Labels = nil
+	l.GenerateLabels = nil
+	l.RuntimeUser = ""
+	l.LayerType = nil
+	l.BuildOnly = false
+
+	h, err := hashstructure.Hash(ent, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("%d", h)
+	if epoch := c.Epochs[name]; epoch != 0 {
+		// so that invalidating the layer reruns all of its steps
+		key = fmt.Sprintf("%s-%d", key, epoch)
+	}
+	keys := []string{}
+	for _, step := range steps {
+		content, err := json.Marshal(step)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't marshal run step %s", step.Name)
+		}
+
+		key = fmt.Sprintf("%x", sha256.Sum256([]byte(key+string(content))))
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// CacheKeyInput is one of the things a layer's cache key is computed from,
+// and its hash.
+type CacheKeyInput struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+}
+
+// CacheKey is a layer's cache key, and the inputs it was computed from.
+type CacheKey struct {
+	Key    string          `json:"key"`
+	Inputs []CacheKeyInput `json:"inputs"`
+}
+
+// Key returns the cache key of name's current inputs, i.e. a hash of the
+// cache entry building it now would store (minus the manifests it outputs),
+// along with the hashes of each of those inputs: its definition, its base,
+// and its imports, overlay_dirs and cached binds. The layer is a cache hit
+// if its key is the same as when it was last built, so comparing the inputs
+// says why it was rebuilt.
+//
+// Like the cache entries themselves, the inputs are the ones stacker has
+// already fetched: the imports as they were last copied in, and the base as
+// it was last pulled (or, for built bases, as the cache has it).
+func (c *BuildCache) Key(name string) (CacheKey, error) {
+	ent, err := c.newEntry(name, nil)
+	if err != nil {
+		return CacheKey{}, errors.Wrapf(err, "couldn't compute the cache entry of %s", name)
+	}
+
+	return entryKey(ent)
+}
+
+// CachedKey returns the cache key name had when it was last built, if it's
+// in the cache.
+func (c *BuildCache) CachedKey(name string) (CacheKey, bool, error) {
+	ent, ok := c.Cache[name]
+	if !ok {
+		return CacheKey{}, false, nil
+	}
+
+	ent.Manifests = nil
+	key, err := entryKey(ent)
+	return key, true, err
+}
+
+// entryKey returns the cache key of the cache entry ent, which has no
+// manifests.
+func entryKey(ent CacheEntry) (CacheKey, error) {
+	key := CacheKey{}
+	h, err := hashstructure.Hash(ent, nil)
+	if err != nil {
+		return CacheKey{}, errors.WithStack(err)
+	}
+	key.Key = fmt.Sprintf("%d", h)
+
+	h, err = hashstructure.Hash(ent.Layer, nil)
+	if err != nil {
+		return CacheKey{}, errors.WithStack(err)
+	}
+	key.Inputs = append(key.Inputs, CacheKeyInput{"layer", fmt.Sprintf("%d", h)})
+	key.Inputs = append(key.Inputs, CacheKeyInput{fmt.Sprintf("base %s", ent.Layer.From.Type), ent.Base})
+
+	// directories are hashed as their whole (encoded) mtree, which is
+	// too big to print
+	inputHash := func(hash string, dir bool) string {
+		if !dir {
+			return hash
+		}
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(hash)))
+	}
+
+	imports := []string{}
+	for imp := range ent.Imports {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	for _, imp := range imports {
+		ih := ent.Imports[imp]
+		key.Inputs = append(key.Inputs, CacheKeyInput{"import " + imp, inputHash(ih.Hash, ih.Type.IsDir())})
+	}
+
+	overlayDirs := []string{}
+	for dir := range ent.OverlayDirs {
+		overlayDirs = append(overlayDirs, dir)
+	}
+	sort.Strings(overlayDirs)
+	for _, dir := range overlayDirs {
+		key.Inputs = append(key.Inputs, CacheKeyInput{"overlay_dir " + dir, inputHash(ent.OverlayDirs[dir].Hash, true)})
+	}
+
+	binds := []string{}
+	for bind := range ent.Binds {
+		binds = append(binds, bind)
+	}
+	sort.Strings(binds)
+	for _, bind := range binds {
+		bh := ent.Binds[bind]
+		key.Inputs = append(key.Inputs, CacheKeyInput{fmt.Sprintf("bind %s (%s)", bind, bh.Mode), bh.Hash})
+	}
+
+	if ent.Epoch != 0 {
+		key.Inputs = append(key.Inputs, CacheKeyInput{"epoch", fmt.Sprintf("%d", ent.Epoch)})
+	}
+
+	return key, nil
+}
+
+// newEntry computes the cache entry for name's current inputs.
+func (c *BuildCache) newEntry(name string, manifests map[types.LayerType]ispec.Descriptor) (CacheEntry, error) {
 	l, ok := c.sfm.LookupLayerDefinition(name)
 	if !ok {
-		return errors.Errorf("%s missing from stackerfile?", name)
+		return CacheEntry{}, errors.Errorf("%s missing from stackerfile?", name)
 	}
 
 	baseHash, err := c.getBaseHash(name)
 	if err != nil {
-		return err
+		return CacheEntry{}, err
+	}
+
+	normalizer := c.normalizer(l.ReferenceDirectory())
+	normalized, err := normalizeLayer(normalizer, l)
+	if err != nil {
+		return CacheEntry{}, err
 	}
 
 	ent := CacheEntry{
 		Manifests:   manifests,
 		Imports:     map[string]ImportHash{},
 		OverlayDirs: map[string]OverlayDirHash{},
+		Binds:       map[string]BindHash{},
 		Name:        name,
-		Layer:       l,
+		Layer:       normalized,
 		Base:        baseHash,
 	}
 
 	imports, err := l.ParseImport()
 	if err != nil {
-		return err
+		return CacheEntry{}, err
 	}
 
 	for _, imp := range imports {
@@ -431,43 +919,61 @@ func (c *BuildCache) Put(name string, manifests map[types.LayerType]ispec.Descri
 		diskPath := path.Join(importsDir, name, fname)
 		st, err := os.Stat(diskPath)
 		if err != nil {
-			return err
+			return CacheEntry{}, err
 		}
 
 		ih := ImportHash{}
 		if st.IsDir() {
 			ih.Type = ImportDir
-			ih.Hash, err = getEncodedMtree(diskPath)
+			ih.Hash, err = getEncodedMtree(diskPath, c.files)
 			if err != nil {
-				return err
+				return CacheEntry{}, err
 			}
 		} else {
 			ih.Type = ImportFile
-			ih.Hash, err = lib.HashFile(diskPath, true)
+			ih.Hash, err = c.files.HashFile(diskPath, true)
 			if err != nil {
-				return err
+				return CacheEntry{}, err
 			}
 		}
 
-		ent.Imports[imp.Path] = ih
+		ent.Imports[normalizer.Replace(imp.Path)] = ih
 	}
 
 	overlayDirs, err := l.ParseOverlayDirs()
 	if err != nil {
-		return err
+		return CacheEntry{}, err
 	}
 
 	for _, overlayDir := range overlayDirs {
 		odh := OverlayDirHash{}
-		odh.Hash, err = getEncodedMtree(overlayDir.Source)
+		odh.Hash, err = getEncodedMtree(overlayDir.Source, c.files)
 		if err != nil {
-			return err
+			return CacheEntry{}, err
 		}
-		ent.OverlayDirs[overlayDir.Source] = odh
+		ent.OverlayDirs[normalizer.Replace(overlayDir.Source)] = odh
 	}
 
-	c.Cache[name] = ent
-	return c.persist()
+	binds, err := l.ParseBinds()
+	if err != nil {
+		return CacheEntry{}, err
+	}
+
+	for _, bind := range binds {
+		if bind.BindCache != types.BindCacheMtime && bind.BindCache != types.BindCacheContent {
+			continue
+		}
+
+		bh := BindHash{Mode: bind.BindCache}
+		bh.Hash, err = hashBind(bind.Source, bind.BindCache)
+		if err != nil {
+			return CacheEntry{}, err
+		}
+		ent.Binds[normalizer.Replace(bind.Source)] = bh
+	}
+
+	ent.Epoch = c.Epochs[name]
+	return ent, nil
 }
 
 func (c *BuildCache) persist() error {
@@ -476,5 +982,10 @@ func (c *BuildCache) persist() error {
 		return err
 	}
 
-	return ioutil.WriteFile(c.config.CacheFile(), content, 0600)
+	err = ioutil.WriteFile(c.config.CacheFile(), content, 0600)
+	if err != nil {
+		return err
+	}
+
+	return c.files.persist()
 }
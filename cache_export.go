@@ -0,0 +1,147 @@
+package stacker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/pkg/errors"
+)
+
+const currentCacheExportVersion = 1
+
+// cacheExportMetadata describes a cache export, so that we don't try to
+// import it into something that can't use it.
+type cacheExportMetadata struct {
+	Version     int    `json:"version"`
+	StorageType string `json:"storage_type"`
+}
+
+// cacheExportDirs are the directories (besides the storage itself) that the
+// build cache refers to: the destination of imports, the base layers for
+// each layer, and the output OCI layout.
+func cacheExportDirs(config types.StackerConfig) map[string]string {
+	return map[string]string{
+		"imports":     path.Join(config.StackerDir, "imports"),
+		"layer-bases": path.Join(config.StackerDir, "layer-bases"),
+		"oci":         config.OCIDir,
+	}
+}
+
+// ExportCache writes everything needed for another machine to get cache hits
+// on the layers built here into dir, which must not exist.
+func ExportCache(config types.StackerConfig, dir string) error {
+	if _, err := os.Stat(config.CacheFile()); err != nil {
+		return errors.Wrapf(err, "no build cache to export")
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return errors.Wrapf(err, "couldn't create export dir")
+	}
+
+	s, err := NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer s.Detach()
+
+	content, err := json.Marshal(cacheExportMetadata{
+		Version:     currentCacheExportVersion,
+		StorageType: s.Name(),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(path.Join(dir, "metadata.json"), content, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't write export metadata")
+	}
+
+	for name, source := range cacheExportDirs(config) {
+		if _, err := os.Stat(source); os.IsNotExist(err) {
+			continue
+		}
+
+		log.Debugf("exporting %s", source)
+		if err := lib.DirCopy(path.Join(dir, name), source); err != nil {
+			return err
+		}
+	}
+
+	// rather than a link to the base image cache, which isn't exported,
+	// copy the bases' blobs out of it
+	blobs := path.Join(dir, "layer-bases", "oci", "blobs")
+	if fi, err := os.Lstat(blobs); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(blobs); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := copyLayoutBlobs(path.Join(config.StackerDir, "layer-bases", "oci"), blobs); err != nil {
+			return err
+		}
+	}
+
+	if err := s.ExportCache(dir); err != nil {
+		return err
+	}
+
+	return lib.FileCopy(path.Join(dir, path.Base(config.CacheFile())), config.CacheFile())
+}
+
+// ImportCache restores a cache exported by ExportCache into this
+// configuration's directories. Since the build cache can't be merged, this
+// refuses to overwrite an existing one.
+func ImportCache(config types.StackerConfig, dir string) error {
+	content, err := ioutil.ReadFile(path.Join(dir, "metadata.json"))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read export metadata")
+	}
+
+	metadata := cacheExportMetadata{}
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return errors.Wrapf(err, "couldn't parse export metadata")
+	}
+
+	if metadata.Version != currentCacheExportVersion {
+		return errors.Errorf("unknown cache export version %d", metadata.Version)
+	}
+
+	if metadata.StorageType != config.StorageType {
+		return errors.Errorf("cache was exported from %s storage, can't import it into %s", metadata.StorageType, config.StorageType)
+	}
+
+	if _, err := os.Stat(config.CacheFile()); err == nil {
+		return errors.Errorf("refusing to overwrite existing build cache %s; run stacker clean first", config.CacheFile())
+	}
+
+	s, err := NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer s.Detach()
+
+	if err := s.ImportCache(dir); err != nil {
+		return err
+	}
+
+	for name, dest := range cacheExportDirs(config) {
+		source := path.Join(dir, name)
+		if _, err := os.Stat(source); os.IsNotExist(err) {
+			continue
+		}
+
+		log.Debugf("importing %s", dest)
+		if err := lib.DirCopy(dest, source); err != nil {
+			return err
+		}
+	}
+
+	// do this last, so a failed import doesn't leave behind a cache that
+	// refers to things which aren't there.
+	return lib.FileCopy(config.CacheFile(), path.Join(dir, path.Base(config.CacheFile())))
+}
@@ -0,0 +1,303 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/mitchellh/hashstructure"
+	"github.com/pkg/errors"
+)
+
+// cacheMigration upgrades the cache entries (the "cache" member of the
+// serialized BuildCache) from one version to the next. The entries are passed
+// as generic json, since the old versions don't necessarily match the
+// current types.
+type cacheMigration func(c *BuildCache, entries map[string]interface{}) error
+
+// cacheMigrations is indexed by the version each migration upgrades from.
+// Caches older than the oldest migration here are thrown away.
+var cacheMigrations = map[int]cacheMigration{
+	10: migrateCacheBinds,
+	11: migrateCachePaths,
+	12: migrateCacheBases,
+}
+
+// migrateCache upgrades the serialized cache content to currentCacheVersion.
+func migrateCache(c *BuildCache, content []byte) ([]byte, error) {
+	raw := struct {
+		Cache   map[string]interface{} `json:"cache"`
+		Version int                    `json:"version"`
+	}{}
+	if err := json.Unmarshal(content, &raw); err != nil {
+		return nil, errors.Wrapf(err, "error parsing cache")
+	}
+
+	if raw.Version > currentCacheVersion {
+		return nil, errors.Errorf("cache version %d is newer than this stacker (%d)", raw.Version, currentCacheVersion)
+	}
+
+	if raw.Cache == nil {
+		raw.Cache = map[string]interface{}{}
+	}
+
+	for raw.Version < currentCacheVersion {
+		migration, ok := cacheMigrations[raw.Version]
+		if !ok {
+			return nil, errors.Errorf("don't know how to migrate cache version %d", raw.Version)
+		}
+
+		log.Debugf("migrating cache from version %d to %d", raw.Version, raw.Version+1)
+		if err := migration(c, raw.Cache); err != nil {
+			return nil, errors.Wrapf(err, "couldn't migrate cache version %d", raw.Version)
+		}
+		raw.Version++
+	}
+
+	return json.Marshal(raw)
+}
+
+// migrateCacheBinds converts version 10 to 11: the cache entries gained a map
+// of bind hashes, and layers' binds went from a string or list of strings to
+// a list of structured binds.
+func migrateCacheBinds(c *BuildCache, entries map[string]interface{}) error {
+	for name, v := range entries {
+		ent, ok := v.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("bad cache entry for %s", name)
+		}
+
+		ent["Binds"] = map[string]interface{}{}
+
+		layer, ok := ent["Layer"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		var old []interface{}
+		switch b := layer["Binds"].(type) {
+		case nil:
+		case string:
+			old = []interface{}{b}
+		case []interface{}:
+			old = b
+		default:
+			return errors.Errorf("bad binds for %s: %v", name, b)
+		}
+
+		if len(old) == 0 {
+			layer["Binds"] = nil
+			continue
+		}
+
+		binds := []interface{}{}
+		for _, o := range old {
+			s, ok := o.(string)
+			if !ok {
+				return errors.Errorf("bad bind for %s: %v", name, o)
+			}
+
+			parts := strings.SplitN(s, "->", 2)
+			bind := map[string]interface{}{
+				"Source":    strings.TrimSpace(parts[0]),
+				"Dest":      "",
+				"BindCache": "",
+			}
+			if len(parts) == 2 {
+				bind["Dest"] = strings.TrimSpace(parts[1])
+			}
+			binds = append(binds, bind)
+		}
+		layer["Binds"] = binds
+	}
+
+	return nil
+}
+
+// migrateCachePaths converts version 11 to 12: the paths in the cache entries
+// are normalized (see BuildCache.normalizer()). Versions 11 and 12 have the
+// same schema, so this works on CacheEntrys directly.
+//
+// Normalizing a layer's entry changes its hash, which layers built on top of
+// it record as their Base, so those are updated too, but only if they were up
+// to date with their base in the first place.
+func migrateCachePaths(c *BuildCache, entries map[string]interface{}) error {
+	old, err := decodeCacheEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	migrated := map[string]CacheEntry{}
+	for name, ent := range old {
+		refDir := ""
+		if l, ok := c.sfm.LookupLayerDefinition(name); ok {
+			refDir = l.ReferenceDirectory()
+		} else {
+			log.Infof("%s isn't in the current stacker files, its imports may not be cached", name)
+		}
+		normalizer := c.normalizer(refDir)
+
+		imports := map[string]ImportHash{}
+		for k, v := range ent.Imports {
+			imports[normalizer.Replace(k)] = v
+		}
+		ent.Imports = imports
+
+		overlayDirs := map[string]OverlayDirHash{}
+		for k, v := range ent.OverlayDirs {
+			overlayDirs[normalizer.Replace(k)] = v
+		}
+		ent.OverlayDirs = overlayDirs
+
+		binds := map[string]BindHash{}
+		for k, v := range ent.Binds {
+			binds[normalizer.Replace(k)] = v
+		}
+		ent.Binds = binds
+
+		if ent.Layer != nil {
+			ent.Layer, err = normalizeLayer(normalizer, ent.Layer)
+			if err != nil {
+				return err
+			}
+		}
+
+		migrated[name] = ent
+	}
+
+	if err := rebaseCacheEntries(old, migrated, plainBaseHash, plainBaseHash); err != nil {
+		return err
+	}
+
+	return encodeCacheEntries(migrated, entries)
+}
+
+// migrateCacheBases converts version 12 to 13: the Base of layers built on
+// other layers covers their epoch, and for build only ones when they were
+// built (see entryBaseHash()). The schema is the same.
+func migrateCacheBases(c *BuildCache, entries map[string]interface{}) error {
+	old, err := decodeCacheEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	migrated := map[string]CacheEntry{}
+	for name, ent := range old {
+		migrated[name] = ent
+	}
+
+	if err := rebaseCacheEntries(old, migrated, plainBaseHash, entryBaseHash); err != nil {
+		return err
+	}
+
+	return encodeCacheEntries(migrated, entries)
+}
+
+// plainBaseHash is what versions 11 and 12 recorded as the Base of the layers
+// built on the layer whose cache entry is ent: just the entry's hash.
+func plainBaseHash(ent CacheEntry) (string, error) {
+	h, err := hashstructure.Hash(&ent, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d", h), nil
+}
+
+// rebaseCacheEntries updates the Base of the built layers in migrated to
+// newBase of their base's migrated entry, but only if they were up to date
+// with their base in old (by oldBase) in the first place. A layer's Base
+// depends on its base's Base, so they're fixed up from the bottom of the
+// stack.
+func rebaseCacheEntries(old map[string]CacheEntry, migrated map[string]CacheEntry, oldBase func(CacheEntry) (string, error), newBase func(CacheEntry) (string, error)) error {
+	// the Base of the layer name, if it's built on one in ents
+	baseOf := func(ents map[string]CacheEntry, name string, hash func(CacheEntry) (string, error)) (string, bool, error) {
+		ent, ok := ents[name]
+		if !ok || ent.Layer == nil || ent.Layer.From == nil || ent.Layer.From.Type != types.BuiltLayer {
+			return "", false, nil
+		}
+
+		base, ok := ents[ent.Layer.From.Tag]
+		if !ok {
+			return "", false, nil
+		}
+
+		h, err := hash(base)
+		return h, err == nil, err
+	}
+
+	upToDate := map[string]bool{}
+	for name, ent := range old {
+		h, ok, err := baseOf(old, name, oldBase)
+		if err != nil {
+			return err
+		}
+		upToDate[name] = ok && h == ent.Base
+	}
+
+	done := map[string]bool{}
+	var rebase func(name string) error
+	rebase = func(name string) error {
+		if done[name] {
+			return nil
+		}
+		done[name] = true
+
+		if !upToDate[name] {
+			return nil
+		}
+
+		ent := migrated[name]
+		if err := rebase(ent.Layer.From.Tag); err != nil {
+			return err
+		}
+
+		h, _, err := baseOf(migrated, name, newBase)
+		if err != nil {
+			return err
+		}
+
+		ent.Base = h
+		migrated[name] = ent
+		return nil
+	}
+
+	for name := range migrated {
+		if err := rebase(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeCacheEntries and encodeCacheEntries convert between the generic json
+// migrations get and CacheEntrys, for versions with the current schema.
+func decodeCacheEntries(entries map[string]interface{}) (map[string]CacheEntry, error) {
+	content, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	ents := map[string]CacheEntry{}
+	if err := json.Unmarshal(content, &ents); err != nil {
+		return nil, errors.Wrapf(err, "error parsing cache entries")
+	}
+
+	return ents, nil
+}
+
+func encodeCacheEntries(ents map[string]CacheEntry, entries map[string]interface{}) error {
+	content, err := json.Marshal(ents)
+	if err != nil {
+		return err
+	}
+
+	for name := range entries {
+		delete(entries, name)
+	}
+
+	return json.Unmarshal(content, &entries)
+}
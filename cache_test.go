@@ -1,13 +1,19 @@
 package stacker
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/anuvu/stacker/types"
 	"github.com/mitchellh/hashstructure"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/oci/casext"
@@ -100,6 +106,322 @@ foo:
 	}
 }
 
+func TestCacheProvisioning(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_cache_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := types.StackerConfig{
+		StackerDir: dir,
+		RootFSDir:  dir,
+	}
+
+	oci, err := umoci.CreateLayout(path.Join(config.StackerDir, "layer-bases", "oci"))
+	assert.NoError(err)
+	defer oci.Close()
+	assert.NoError(umoci.NewImage(oci, "centos"))
+
+	stackerYaml := path.Join(dir, "stacker.yaml")
+	err = ioutil.WriteFile(stackerYaml, []byte(`
+foo:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: zomg
+    build_only: true
+`), 0644)
+	assert.NoError(err)
+
+	sf, err := types.NewStackerfile(stackerYaml, nil)
+	assert.NoError(err)
+
+	cache, err := OpenCache(config, casext.Engine{}, types.StackerFiles{"dummy": sf})
+	assert.NoError(err)
+
+	assert.NoError(os.MkdirAll(path.Join(dir, "foo"), 0755))
+	assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{}))
+	_, ok, err := cache.Lookup("foo")
+	assert.NoError(err)
+	assert.True(ok)
+
+	// a build that starts setting up foo's rootfs and never finishes
+	// means it can't be used, even by later stackers
+	assert.NoError(cache.StartProvisioning("foo"))
+	cache, err = OpenCache(config, casext.Engine{}, types.StackerFiles{"dummy": sf})
+	assert.NoError(err)
+	_, ok, err = cache.Lookup("foo")
+	assert.NoError(err)
+	assert.False(ok)
+
+	assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{}))
+	_, ok, err = cache.Lookup("foo")
+	assert.NoError(err)
+	assert.True(ok)
+}
+
+func TestCacheTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_cache_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := types.StackerConfig{
+		StackerDir: dir,
+		RootFSDir:  dir,
+	}
+
+	oci, err := umoci.CreateLayout(path.Join(config.StackerDir, "layer-bases", "oci"))
+	assert.NoError(err)
+	defer oci.Close()
+	assert.NoError(umoci.NewImage(oci, "centos"))
+
+	stackerYaml := path.Join(dir, "stacker.yaml")
+	err = ioutil.WriteFile(stackerYaml, []byte(`
+foo:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: apt-get update
+    cache_ttl: 24h
+    build_only: true
+`), 0644)
+	assert.NoError(err)
+
+	sf, err := types.NewStackerfile(stackerYaml, nil)
+	assert.NoError(err)
+
+	cache, err := OpenCache(config, casext.Engine{}, types.StackerFiles{"dummy": sf})
+	assert.NoError(err)
+
+	assert.NoError(os.MkdirAll(path.Join(dir, "foo"), 0755))
+	assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{}))
+	_, ok, err := cache.Lookup("foo")
+	assert.NoError(err)
+	assert.True(ok)
+
+	// the build time isn't part of the key
+	key, err := cache.Key("foo")
+	assert.NoError(err)
+	cached, _, err := cache.CachedKey("foo")
+	assert.NoError(err)
+	assert.Equal(key.Key, cached.Key)
+
+	ent := cache.Cache["foo"]
+	ent.Created = ent.Created.Add(-25 * time.Hour)
+	cache.Cache["foo"] = ent
+
+	// the old build is still what publish and the like find, but it's
+	// rebuilt
+	entry, ok, err := cache.Lookup("foo")
+	assert.NoError(err)
+	assert.True(ok)
+	expired, err := cache.Expired("foo", entry)
+	assert.NoError(err)
+	assert.True(expired)
+
+	// nor is the ttl itself
+	l, _ := sf.Get("foo")
+	l.CacheTTL = "48h"
+	entry, ok, err = cache.Lookup("foo")
+	assert.NoError(err)
+	assert.True(ok)
+	expired, err = cache.Expired("foo", entry)
+	assert.NoError(err)
+	assert.False(expired)
+}
+
+func TestCacheTTLRebuildsChildren(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_cache_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := types.StackerConfig{
+		StackerDir: dir,
+		RootFSDir:  dir,
+	}
+
+	oci, err := umoci.CreateLayout(path.Join(config.StackerDir, "layer-bases", "oci"))
+	assert.NoError(err)
+	defer oci.Close()
+	assert.NoError(umoci.NewImage(oci, "centos"))
+
+	stackerYaml := path.Join(dir, "stacker.yaml")
+	err = ioutil.WriteFile(stackerYaml, []byte(`
+foo:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: apt-get update
+    cache_ttl: 24h
+    build_only: true
+bar:
+    from:
+        type: built
+        tag: foo
+    run: apt-get install -y thing
+`), 0644)
+	assert.NoError(err)
+
+	sf, err := types.NewStackerfile(stackerYaml, nil)
+	assert.NoError(err)
+
+	cache, err := OpenCache(config, casext.Engine{}, types.StackerFiles{"dummy": sf})
+	assert.NoError(err)
+
+	assert.NoError(os.MkdirAll(path.Join(dir, "foo"), 0755))
+	assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{}))
+	assert.NoError(cache.Put("bar", map[types.LayerType]ispec.Descriptor{}))
+	_, ok, err := cache.Lookup("bar")
+	assert.NoError(err)
+	assert.True(ok)
+
+	// it survives a reload
+	cache, err = OpenCache(config, casext.Engine{}, types.StackerFiles{"dummy": sf})
+	assert.NoError(err)
+	_, ok, err = cache.Lookup("bar")
+	assert.NoError(err)
+	assert.True(ok)
+
+	// foo is rebuilt once its ttl is up, to the same (empty) manifests,
+	// but bar has to see its fresh rootfs
+	ent := cache.Cache["foo"]
+	ent.Created = ent.Created.Add(-25 * time.Hour)
+	cache.Cache["foo"] = ent
+	assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{}))
+	_, ok, err = cache.Lookup("bar")
+	assert.NoError(err)
+	assert.False(ok)
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_cache_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := types.StackerConfig{
+		StackerDir: dir,
+		RootFSDir:  dir,
+	}
+
+	oci, err := umoci.CreateLayout(path.Join(config.StackerDir, "layer-bases", "oci"))
+	assert.NoError(err)
+	defer oci.Close()
+	assert.NoError(umoci.NewImage(oci, "centos"))
+
+	stackerYaml := path.Join(dir, "stacker.yaml")
+	err = ioutil.WriteFile(stackerYaml, []byte(`
+foo:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run_steps:
+        - name: one
+          run: zomg
+    build_only: true
+`), 0644)
+	assert.NoError(err)
+
+	sf, err := types.NewStackerfile(stackerYaml, nil)
+	assert.NoError(err)
+
+	cache, err := OpenCache(config, casext.Engine{}, types.StackerFiles{"dummy": sf})
+	assert.NoError(err)
+
+	l, _ := sf.Get("foo")
+	steps, err := l.ParseRunSteps()
+	assert.NoError(err)
+	keys, err := cache.RunStepKeys("foo", steps)
+	assert.NoError(err)
+
+	assert.NoError(os.MkdirAll(path.Join(dir, "foo"), 0755))
+	assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{}))
+
+	// invalidating it is remembered until its next build
+	assert.NoError(cache.Invalidate("foo"))
+	cache, err = OpenCache(config, casext.Engine{}, types.StackerFiles{"dummy": sf})
+	assert.NoError(err)
+	_, ok, err := cache.Lookup("foo")
+	assert.NoError(err)
+	assert.False(ok)
+
+	invalidated, err := cache.RunStepKeys("foo", steps)
+	assert.NoError(err)
+	assert.NotEqual(keys, invalidated)
+
+	assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{}))
+	_, ok, err = cache.Lookup("foo")
+	assert.NoError(err)
+	assert.True(ok)
+}
+
+func TestCacheInvalidateRebuildsChildren(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_cache_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := types.StackerConfig{
+		StackerDir: dir,
+		RootFSDir:  dir,
+	}
+
+	oci, err := umoci.CreateLayout(path.Join(config.StackerDir, "layer-bases", "oci"))
+	assert.NoError(err)
+	defer oci.Close()
+	assert.NoError(umoci.NewImage(oci, "centos"))
+
+	stackerYaml := path.Join(dir, "stacker.yaml")
+	err = ioutil.WriteFile(stackerYaml, []byte(`
+foo:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: echo foo > /foo
+bar:
+    from:
+        type: built
+        tag: foo
+    run: echo bar > /bar
+`), 0644)
+	assert.NoError(err)
+
+	sf, err := types.NewStackerfile(stackerYaml, nil)
+	assert.NoError(err)
+
+	cache, err := OpenCache(config, casext.Engine{}, types.StackerFiles{"dummy": sf})
+	assert.NoError(err)
+
+	// foo's rebuild comes out byte for byte the same
+	tar, err := types.NewLayerType("tar")
+	assert.NoError(err)
+	manifests := map[types.LayerType]ispec.Descriptor{tar: {MediaType: ispec.MediaTypeImageManifest, Digest: digest.FromString("foo")}}
+	assert.NoError(cache.Put("foo", manifests))
+	assert.NoError(cache.Put("bar", manifests))
+
+	assert.NoError(cache.Invalidate("foo"))
+	assert.NoError(cache.Put("foo", manifests))
+	_, ok, err := cache.Lookup("foo")
+	assert.NoError(err)
+	assert.True(ok)
+
+	_, ok, err = cache.Lookup("bar")
+	assert.NoError(err)
+	assert.False(ok)
+
+	assert.NoError(cache.Put("bar", manifests))
+	_, ok, err = cache.Lookup("bar")
+	assert.NoError(err)
+	assert.True(ok)
+}
+
 func TestCacheEntryChanged(t *testing.T) {
 	assert := assert.New(t)
 
@@ -114,5 +436,363 @@ func TestCacheEntryChanged(t *testing.T) {
 	// This test works because the type information is included in the
 	// hashstructure hash above, so using a zero valued CacheEntry is
 	// enough to capture changes in types.
-	assert.Equal(uint64(0x22f75070ead4ce2e), h)
+	assert.Equal(uint64(0xa90c3356288d386a), h)
+}
+
+func TestCacheKey(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_cache_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := types.StackerConfig{
+		StackerDir: dir,
+		RootFSDir:  dir,
+	}
+
+	layerBases := path.Join(config.StackerDir, "layer-bases")
+	assert.NoError(os.MkdirAll(layerBases, 0755))
+
+	oci, err := umoci.CreateLayout(path.Join(layerBases, "oci"))
+	assert.NoError(err)
+	defer oci.Close()
+	assert.NoError(umoci.NewImage(oci, "centos"))
+
+	// the imports as they were last copied in
+	importsDir := path.Join(dir, "imports", "foo")
+	assert.NoError(os.MkdirAll(importsDir, 0755))
+	assert.NoError(ioutil.WriteFile(path.Join(importsDir, "setup.sh"), []byte("echo hi"), 0644))
+
+	stackerYaml := path.Join(dir, "stacker.yaml")
+	assert.NoError(ioutil.WriteFile(stackerYaml, []byte(`
+foo:
+    from:
+        type: docker
+        url: docker://centos:latest
+    import: setup.sh
+    run: sh /stacker/setup.sh
+`), 0644))
+
+	sf, err := types.NewStackerfile(stackerYaml, nil)
+	assert.NoError(err)
+
+	cache, err := OpenCache(config, casext.Engine{}, types.StackerFiles{"dummy": sf})
+	assert.NoError(err)
+
+	key, err := cache.Key("foo")
+	assert.NoError(err)
+
+	names := []string{}
+	for _, input := range key.Inputs {
+		names = append(names, input.Name)
+		assert.NotEmpty(input.Hash, input.Name)
+	}
+	// paths are normalized like they are in the cache
+	assert.Len(names, 3)
+	assert.Equal([]string{"layer", "base docker"}, names[:2])
+	assert.True(strings.HasPrefix(names[2], "import ${{"), names[2])
+	assert.True(strings.HasSuffix(names[2], "}}/setup.sh"), names[2])
+
+	_, ok, err := cache.CachedKey("foo")
+	assert.NoError(err)
+	assert.False(ok)
+
+	// the key is the same once it's built, whatever it outputs
+	assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{"tar": {MediaType: ispec.MediaTypeImageManifest}}))
+	cached, ok, err := cache.CachedKey("foo")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(key, cached)
+
+	// and changes with its inputs
+	assert.NoError(ioutil.WriteFile(path.Join(importsDir, "setup.sh"), []byte("echo bye"), 0644))
+	changed, err := cache.Key("foo")
+	assert.NoError(err)
+	assert.NotEqual(key.Key, changed.Key)
+	assert.Equal(key.Inputs[0], changed.Inputs[0])
+	assert.NotEqual(key.Inputs[2], changed.Inputs[2])
+}
+
+func TestFileHashCache(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_cache_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := types.StackerConfig{StackerDir: dir}
+	files := openFileHashCache(config)
+
+	p := path.Join(dir, "foo")
+	assert.NoError(ioutil.WriteFile(p, []byte("foo"), 0644))
+
+	h, err := files.HashFile(p, false)
+	assert.NoError(err)
+	assert.NoError(files.persist())
+
+	// if the file's metadata hasn't changed, we should trust the cache
+	files = openFileHashCache(config)
+	for key, ent := range files.Hashes {
+		ent.Hash = "bogus"
+		files.Hashes[key] = ent
+	}
+
+	cached, err := files.HashFile(p, false)
+	assert.NoError(err)
+	assert.Equal("bogus", cached)
+
+	// ...unless we're verifying
+	files.verify = true
+	verified, err := files.HashFile(p, false)
+	assert.NoError(err)
+	assert.Equal(h, verified)
+
+	// and changing the file invalidates it
+	files.verify = false
+	assert.NoError(ioutil.WriteFile(p, []byte("bar"), 0644))
+	changed, err := files.HashFile(p, false)
+	assert.NoError(err)
+	assert.NotEqual(h, changed)
+}
+
+func TestCacheIsRelocatable(t *testing.T) {
+	assert := assert.New(t)
+
+	setup := func(dir string) (types.StackerConfig, types.StackerFiles) {
+		config := types.StackerConfig{
+			StackerDir: path.Join(dir, ".stacker"),
+			RootFSDir:  path.Join(dir, "roots"),
+			OCIDir:     path.Join(dir, "oci"),
+		}
+
+		layerBases := path.Join(config.StackerDir, "layer-bases")
+		assert.NoError(os.MkdirAll(layerBases, 0755))
+		assert.NoError(ioutil.WriteFile(path.Join(layerBases, "base.tar"), []byte("base"), 0644))
+
+		assert.NoError(os.MkdirAll(path.Join(config.StackerDir, "imports", "foo"), 0755))
+		assert.NoError(ioutil.WriteFile(path.Join(config.StackerDir, "imports", "foo", "bar"), []byte("bar"), 0644))
+		assert.NoError(ioutil.WriteFile(path.Join(dir, "bar"), []byte("bar"), 0644))
+		assert.NoError(os.MkdirAll(path.Join(config.RootFSDir, "foo"), 0755))
+
+		stackerYaml := path.Join(dir, "stacker.yaml")
+		assert.NoError(ioutil.WriteFile(stackerYaml, []byte(`
+foo:
+    from:
+        type: tar
+        url: base.tar
+    import: bar
+    run: ls ${{STACKER_ROOTFS_DIR}}
+    build_only: true
+`), 0644))
+
+		sf, err := types.NewStackerfile(stackerYaml, config.Substitutions())
+		assert.NoError(err)
+
+		return config, types.StackerFiles{stackerYaml: sf}
+	}
+
+	dir1, err := ioutil.TempDir("", "stacker_cache_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir1)
+
+	dir2, err := ioutil.TempDir("", "stacker_cache_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir2)
+
+	config1, sfm1 := setup(dir1)
+	cache, err := OpenCache(config1, casext.Engine{}, sfm1)
+	assert.NoError(err)
+	assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{}))
+
+	config2, sfm2 := setup(dir2)
+	content, err := ioutil.ReadFile(config1.CacheFile())
+	assert.NoError(err)
+	assert.NoError(ioutil.WriteFile(config2.CacheFile(), content, 0600))
+
+	cache, err = OpenCache(config2, casext.Engine{}, sfm2)
+	assert.NoError(err)
+
+	_, ok, err := cache.Lookup("foo")
+	assert.NoError(err)
+	assert.True(ok)
+}
+
+func TestCacheMigration(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_cache_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := types.StackerConfig{
+		StackerDir: path.Join(dir, ".stacker"),
+		RootFSDir:  path.Join(dir, "roots"),
+		OCIDir:     path.Join(dir, "oci"),
+	}
+
+	layerBases := path.Join(config.StackerDir, "layer-bases")
+	assert.NoError(os.MkdirAll(layerBases, 0755))
+	assert.NoError(ioutil.WriteFile(path.Join(layerBases, "base.tar"), []byte("base"), 0644))
+
+	assert.NoError(os.MkdirAll(path.Join(config.StackerDir, "imports", "foo"), 0755))
+	assert.NoError(ioutil.WriteFile(path.Join(config.StackerDir, "imports", "foo", "bar"), []byte("bar"), 0644))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "bar"), []byte("bar"), 0644))
+	assert.NoError(os.MkdirAll(path.Join(config.RootFSDir, "foo"), 0755))
+	assert.NoError(os.MkdirAll(path.Join(config.RootFSDir, "baz"), 0755))
+
+	stackerYaml := path.Join(dir, "stacker.yaml")
+	assert.NoError(ioutil.WriteFile(stackerYaml, []byte(`
+foo:
+    from:
+        type: tar
+        url: base.tar
+    import: bar
+    binds: /dev
+    run: ls ${{STACKER_ROOTFS_DIR}}
+    build_only: true
+baz:
+    from:
+        type: built
+        tag: foo
+    build_only: true
+`), 0644))
+
+	sf, err := types.NewStackerfile(stackerYaml, config.Substitutions())
+	assert.NoError(err)
+	sfm := types.StackerFiles{stackerYaml: sf}
+
+	cache, err := OpenCache(config, casext.Engine{}, sfm)
+	assert.NoError(err)
+	assert.NoError(cache.Put("foo", map[types.LayerType]ispec.Descriptor{}))
+	assert.NoError(cache.Put("baz", map[types.LayerType]ispec.Descriptor{}))
+
+	pristine, err := ioutil.ReadFile(config.CacheFile())
+	assert.NoError(err)
+
+	// downgrade turns the cache into what an older stacker would have
+	// written: before version 12, absolute paths, and for version 10,
+	// string binds and no bind hashes.
+	downgrade := func(version int) {
+		raw := struct {
+			Cache   map[string]map[string]interface{} `json:"cache"`
+			Version int                               `json:"version"`
+		}{}
+		content := string(pristine)
+		if version < 12 {
+			content = strings.NewReplacer(
+				"${{REFERENCE_DIR}}", dir,
+				"${{STACKER_ROOTFS_DIR}}", config.RootFSDir,
+			).Replace(content)
+		}
+		assert.NoError(json.Unmarshal([]byte(content), &raw))
+
+		raw.Version = version
+		if version == 10 {
+			for _, ent := range raw.Cache {
+				delete(ent, "Binds")
+			}
+			raw.Cache["foo"]["Layer"].(map[string]interface{})["Binds"] = "/dev"
+			// the hash of the version 10 entry for foo, which we
+			// can't compute with the current types
+			raw.Cache["baz"]["Base"] = "12345"
+		}
+
+		if version == 11 || version == 12 {
+			// baz was up to date with the old (un-normalized, for
+			// 11) foo, whose build time wasn't part of its Base
+			foo := CacheEntry{}
+			fooJSON, err := json.Marshal(raw.Cache["foo"])
+			assert.NoError(err)
+			assert.NoError(json.Unmarshal(fooJSON, &foo))
+			h, err := hashstructure.Hash(&foo, nil)
+			assert.NoError(err)
+			raw.Cache["baz"]["Base"] = fmt.Sprintf("%d", h)
+		}
+
+		result, err := json.Marshal(raw)
+		assert.NoError(err)
+		assert.NoError(ioutil.WriteFile(config.CacheFile(), result, 0600))
+	}
+
+	downgrade(11)
+	cache, err = OpenCache(config, casext.Engine{}, sfm)
+	assert.NoError(err)
+	assert.Equal(currentCacheVersion, cache.Version)
+
+	_, ok, err := cache.Lookup("foo")
+	assert.NoError(err)
+	assert.True(ok)
+
+	_, ok, err = cache.Lookup("baz")
+	assert.NoError(err)
+	assert.True(ok)
+
+	downgrade(12)
+	cache, err = OpenCache(config, casext.Engine{}, sfm)
+	assert.NoError(err)
+	assert.Equal(currentCacheVersion, cache.Version)
+
+	_, ok, err = cache.Lookup("baz")
+	assert.NoError(err)
+	assert.True(ok)
+
+	// version 10 entries hashed differently, so we can't tell whether baz
+	// was up to date with foo; it is rebuilt to be safe.
+	downgrade(10)
+	cache, err = OpenCache(config, casext.Engine{}, sfm)
+	assert.NoError(err)
+
+	_, ok, err = cache.Lookup("foo")
+	assert.NoError(err)
+	assert.True(ok)
+
+	_, ok, err = cache.Lookup("baz")
+	assert.NoError(err)
+	assert.False(ok)
+
+	// and the migrated cache was saved
+	content, err := ioutil.ReadFile(config.CacheFile())
+	assert.NoError(err)
+	ok, err = versionMatches(content)
+	assert.NoError(err)
+	assert.True(ok)
+}
+
+func TestHashGitWorkTreeIgnoresTouchedFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+
+	dir, err := ioutil.TempDir("", "stacker_cache_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		output, err := cmd.CombinedOutput()
+		assert.NoError(err, string(output))
+	}
+
+	file := path.Join(dir, "foo")
+	git("init", "-q")
+	assert.NoError(ioutil.WriteFile(file, []byte("foo"), 0644))
+	git("add", "foo")
+	git("commit", "-q", "-m", "foo")
+
+	before, err := hashGitWorkTree(dir)
+	assert.NoError(err)
+
+	then := time.Now().Add(-time.Hour)
+	assert.NoError(os.Chtimes(file, then, then))
+	touched, err := hashGitWorkTree(dir)
+	assert.NoError(err)
+	assert.Equal(before, touched)
+
+	assert.NoError(ioutil.WriteFile(file, []byte("bar"), 0644))
+	modified, err := hashGitWorkTree(dir)
+	assert.NoError(err)
+	assert.NotEqual(before, modified)
 }
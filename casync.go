@@ -0,0 +1,46 @@
+package stacker
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/anuvu/stacker/types"
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+// CaidxMediaType is the media type of casync outputs' blobs when they're
+// artifacts.
+const CaidxMediaType = "application/x-caidx"
+
+// casyncStore returns the chunk store the casync output o of layer name
+// adds its chunks to.
+func casyncStore(config types.StackerConfig, name string, o *types.Output) string {
+	if o.Store != "" {
+		return o.Store
+	}
+
+	return path.Join(path.Dir(config.OCIDir), name+".castr")
+}
+
+// generateCasync writes a casync index of rootfs to dest, adding the chunks
+// of the archive it indexes to the output's chunk store, with desync (which
+// also writes to remote stores, unlike casync itself; the indexes and stores
+// are the same).
+func generateCasync(config types.StackerConfig, name string, rootfs string, o *types.Output, dest string) error {
+	store := casyncStore(config, name, o)
+	args := []string{"tar", "--index", "--store", store}
+	if o.ChunkSize != "" {
+		size, err := humanize.ParseBytes(o.ChunkSize)
+		if err != nil {
+			return errors.Wrapf(err, "bad chunk size %s", o.ChunkSize)
+		}
+
+		// the same proportions as casync's default 16:64:256
+		avg := size / 1024
+		args = append(args, "--chunk-size", fmt.Sprintf("%d:%d:%d", avg/4, avg, avg*4))
+	}
+	args = append(args, dest, rootfs)
+
+	return runDiskTool("desync", "", args...)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/types"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var bomCmd = cli.Command{
+	Name:  "bom",
+	Usage: "audit published images",
+	Subcommands: []cli.Command{
+		{
+			Name:   "verify",
+			Usage:  "checks that published images are what the build cache says the stacker yaml files build",
+			Action: doBOMVerify,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "stacker-file, f",
+					Usage: "the input stackerfile",
+					Value: "stacker.yaml",
+				},
+				cli.StringFlag{
+					Name:  "stacker-file-pattern, p",
+					Usage: "regex pattern to use when searching for stackerfile paths",
+					Value: stackerFilePathRegex,
+				},
+				cli.StringFlag{
+					Name:  "search-dir, d",
+					Usage: "directory under which to search for stackerfiles",
+				},
+				cli.StringFlag{
+					Name:  "url",
+					Usage: "url the OCI images were published to",
+				},
+				cli.StringFlag{
+					Name:  "tag",
+					Usage: "tag the OCI images were published as",
+				},
+				cli.StringFlag{
+					Name:  "username",
+					Usage: "username for the registry",
+				},
+				cli.StringFlag{
+					Name:  "password",
+					Usage: "password for the registry",
+				},
+				cli.StringSliceFlag{
+					Name:  "substitute",
+					Usage: "variable substitution in stackerfiles, FOO=bar format",
+				},
+				cli.StringSliceFlag{
+					Name:  "substitute-file",
+					Usage: "yaml file of substitutions (FOO: bar); --substitute and STACKER_SUBST_FOO take precedence",
+				},
+				cli.StringSliceFlag{
+					Name:  "layer-type",
+					Usage: "set the published layer type (supported values: tar, squashfs); can be supplied multiple times",
+					Value: &cli.StringSlice{"tar"},
+				},
+			},
+			Before: beforeBOMVerify,
+		},
+	},
+}
+
+func beforeBOMVerify(ctx *cli.Context) error {
+	if len(ctx.String("search-dir")) != 0 {
+		err := validateFileSearchFlags(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if (ctx.String("username") == "") != (ctx.String("password") == "") {
+		return errors.Errorf("supply both username and password, or none of them")
+	}
+
+	if len(ctx.String("url")) == 0 {
+		return errors.Errorf("--url is a mandatory argument for verifying")
+	}
+
+	if len(ctx.String("tag")) == 0 {
+		return errors.Errorf("--tag is a mandatory argument for verifying")
+	}
+
+	return nil
+}
+
+func doBOMVerify(ctx *cli.Context) error {
+	layerTypes, err := types.NewLayerTypes(ctx.StringSlice("layer-type"))
+	if err != nil {
+		return err
+	}
+
+	substitute, err := substitutions(ctx)
+	if err != nil {
+		return err
+	}
+
+	args := stacker.VerifyArgs{
+		Config:     config,
+		Substitute: substitute,
+		Url:        ctx.String("url"),
+		Tag:        ctx.String("tag"),
+		Username:   ctx.String("username"),
+		Password:   ctx.String("password"),
+		LayerTypes: layerTypes,
+	}
+
+	var stackerFiles []string
+	if len(ctx.String("search-dir")) > 0 {
+		stackerFiles, err = lib.FindFiles(ctx.String("search-dir"), ctx.String("stacker-file-pattern"))
+		if err != nil {
+			return err
+		}
+	} else {
+		stackerFiles = []string{ctx.String("stacker-file")}
+	}
+
+	results, err := stacker.Verify(&args, stackerFiles)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Problem == "" {
+			fmt.Printf("[ OK ] %s: %s\n", r.Destination, r.Published)
+			continue
+		}
+
+		failed++
+		fmt.Printf("[FAIL] %s: %s\n", r.Destination, r.Problem)
+		if r.Expected != "" && r.Published != "" {
+			fmt.Printf("       expected %s, published %s\n", r.Expected, r.Published)
+		}
+	}
+
+	if failed != 0 {
+		return errors.Errorf("%d of %d images don't match their stacker files", failed, len(results))
+	}
+
+	return nil
+}
@@ -1,7 +1,14 @@
 package main
 
 import (
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
 	"github.com/anuvu/stacker"
+	"github.com/anuvu/stacker/log"
 	"github.com/anuvu/stacker/types"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -39,6 +46,10 @@ func initCommonBuildFlags() []cli.Flag {
 			Name:  "substitute",
 			Usage: "variable substitution in stackerfiles, FOO=bar format",
 		},
+		cli.StringSliceFlag{
+			Name:  "substitute-file",
+			Usage: "yaml file of substitutions (FOO: bar); --substitute and STACKER_SUBST_FOO take precedence",
+		},
 		cli.StringFlag{
 			Name:  "on-run-failure",
 			Usage: "command to run inside container if run fails (useful for inspection)",
@@ -52,10 +63,44 @@ func initCommonBuildFlags() []cli.Flag {
 			Usage: "set the output layer type (supported values: tar, squashfs); can be supplied multiple times",
 			Value: &cli.StringSlice{"tar"},
 		},
+		cli.BoolFlag{
+			Name:  "interactive",
+			Usage: "run all the run steps with stacker's stdin and a terminal, as if they had interactive: true",
+		},
 		cli.BoolFlag{
 			Name:  "order-only",
 			Usage: "show the build order without running the actual build",
 		},
+		cli.BoolFlag{
+			Name:  "verify-imports",
+			Usage: "fully re-hash imports instead of trusting the size and mtime of files that were hashed before",
+		},
+		cli.StringFlag{
+			Name:  "output-json",
+			Usage: "write a json summary of the build (tags, digests, cache hits, durations) to this file",
+		},
+		cli.BoolFlag{
+			Name:  "keep-going",
+			Usage: "keep building the layers that don't depend on a layer that failed, and summarize which did at the end",
+		},
+		cli.BoolFlag{
+			Name:  "update-lock",
+			Usage: "resolve the constraints of docker bases again, instead of using the tags in the stacker files' lock files",
+		},
+		cli.StringSliceFlag{
+			Name:  "invalidate",
+			Usage: "rebuild these layers (and the ones built on them) even if they're cached; a comma separated list, can be supplied multiple times",
+		},
+		cli.BoolFlag{
+			Name:  "fail-on-empty-layer",
+			Usage: "fail the build of layers whose run doesn't change their filesystem",
+		},
+		cli.IntFlag{
+			Name:  "jobs",
+			Usage: "number of base images to pull in parallel before building; 1 pulls each base when its layer is built",
+			Value: 4,
+		},
+		ciAnnotationsFlag,
 	}
 }
 
@@ -75,20 +120,46 @@ func beforeBuild(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	return nil
+
+	return validateCIAnnotationsFlag(ctx)
+}
+
+// invalidateLayers returns the layers in --invalidate, which are a comma
+// separated list.
+func invalidateLayers(ctx *cli.Context) []string {
+	layers := []string{}
+	for _, list := range ctx.StringSlice("invalidate") {
+		for _, name := range strings.Split(list, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				layers = append(layers, name)
+			}
+		}
+	}
+	return layers
 }
 
 func newBuildArgs(ctx *cli.Context) (stacker.BuildArgs, error) {
+	substitute, err := substitutions(ctx)
+	if err != nil {
+		return stacker.BuildArgs{}, err
+	}
+
 	args := stacker.BuildArgs{
-		Config:       config,
-		LeaveUnladen: ctx.Bool("leave-unladen"),
-		NoCache:      ctx.Bool("no-cache"),
-		Substitute:   ctx.StringSlice("substitute"),
-		OnRunFailure: ctx.String("on-run-failure"),
-		OrderOnly:    ctx.Bool("order-only"),
-		Progress:     shouldShowProgress(ctx),
+		Config:        config,
+		LeaveUnladen:  ctx.Bool("leave-unladen"),
+		NoCache:       ctx.Bool("no-cache"),
+		Substitute:    substitute,
+		OnRunFailure:  ctx.String("on-run-failure"),
+		OrderOnly:     ctx.Bool("order-only"),
+		Progress:      shouldShowProgress(ctx),
+		VerifyImports: ctx.Bool("verify-imports"),
+		Jobs:          ctx.Int("jobs"),
+		Interactive:   ctx.Bool("interactive"),
+		KeepGoing:     ctx.Bool("keep-going"),
+		UpdateLock:    ctx.Bool("update-lock"),
+		FailOnEmpty:   ctx.Bool("fail-on-empty-layer"),
+		Invalidate:    invalidateLayers(ctx),
 	}
-	var err error
 	args.LayerTypes, err = types.NewLayerTypes(ctx.StringSlice("layer-type"))
 	return args, err
 }
@@ -100,5 +171,54 @@ func doBuild(ctx *cli.Context) error {
 	}
 
 	builder := stacker.NewBuilder(&args)
-	return builder.BuildMultiple([]string{ctx.String("stacker-file")})
+	defer cancelOnSignal(builder)()
+	start := time.Now()
+	err = builder.BuildMultiple([]string{ctx.String("stacker-file")})
+	return writeReport(ctx, builder.Report(), start, err)
+}
+
+// cancelOnSignal cancels the build when stacker gets SIGINT or SIGTERM, so
+// that it rolls back the layer it was building before it exits. A second
+// signal makes it exit right away. The returned function stops this.
+func cancelOnSignal(builder *stacker.Builder) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		for sg := range signals {
+			if builder.Cancelled() {
+				log.Infof("got %v again, exiting without rolling back", sg)
+				os.Exit(types.CancelledError.ExitCode())
+			}
+
+			log.Infof("got %v, cancelling the build", sg)
+			builder.Cancel()
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+	}
+}
+
+// writeReport writes the report to --output-json and emits --ci-annotations
+// if they were specified, and returns the original error from the operation.
+func writeReport(ctx *cli.Context, report *stacker.Report, start time.Time, err error) error {
+	report.Finish(start, err)
+	logCIAnnotations(ctx, report)
+
+	if ctx.String("output-json") == "" {
+		return err
+	}
+
+	if err2 := report.Write(ctx.String("output-json")); err2 != nil {
+		if err != nil {
+			log.Infof("couldn't write report: %v", err2)
+			return err
+		}
+		return err2
+	}
+
+	return err
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/anuvu/stacker"
+	"github.com/anuvu/stacker/log"
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/types"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var cacheCmd = cli.Command{
+	Name:  "cache",
+	Usage: "manage stacker's build cache",
+	Subcommands: []cli.Command{
+		{
+			Name:   "migrate",
+			Usage:  "upgrade the build cache from an older version of stacker",
+			Action: doCacheMigrate,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "stacker-file, f",
+					Usage: "the stacker file(s) whose layers are in the cache (default: stacker.yaml)",
+				},
+				cli.StringSliceFlag{
+					Name:  "substitute",
+					Usage: "variable substitution in stackerfiles, FOO=bar format",
+				},
+				cli.StringSliceFlag{
+					Name:  "substitute-file",
+					Usage: "yaml file of substitutions (FOO: bar); --substitute and STACKER_SUBST_FOO take precedence",
+				},
+			},
+		},
+		{
+			Name:      "key",
+			Usage:     "print a layer's cache key, and the hashes of the inputs it's computed from",
+			ArgsUsage: "<layer>",
+			Action:    doCacheKey,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "stacker-file, f",
+					Usage: "the stacker file(s) the layer and its bases are in (default: stacker.yaml)",
+				},
+				cli.StringSliceFlag{
+					Name:  "substitute",
+					Usage: "variable substitution in stackerfiles, FOO=bar format",
+				},
+				cli.StringSliceFlag{
+					Name:  "substitute-file",
+					Usage: "yaml file of substitutions (FOO: bar); --substitute and STACKER_SUBST_FOO take precedence",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the key and its inputs as json",
+				},
+			},
+		},
+		{
+			Name:      "export",
+			Usage:     "export the build cache and built layers so another machine can use them",
+			ArgsUsage: "<dir>",
+			Action:    doCacheExport,
+		},
+		{
+			Name:      "import",
+			Usage:     "import a build cache previously exported with stacker cache export",
+			ArgsUsage: "<dir>",
+			Action:    doCacheImport,
+		},
+	},
+}
+
+// cacheStackerFiles reads the --stacker-file(s) whose layers are in the
+// cache.
+func cacheStackerFiles(ctx *cli.Context) (types.StackerFiles, error) {
+	substitute, err := substitutions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	files := ctx.StringSlice("stacker-file")
+	if len(files) == 0 {
+		files = []string{"stacker.yaml"}
+	}
+
+	// Paths in the cache are relative to the stacker file that defined
+	// them, so we need the stacker files to migrate it.
+	sfm := types.StackerFiles{}
+	for _, f := range files {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return nil, err
+		}
+
+		sf, err := types.NewStackerfile(f, append(substitute, config.Substitutions()...))
+		if err != nil {
+			return nil, err
+		}
+		sfm[abs] = sf
+	}
+
+	return sfm, nil
+}
+
+func doCacheMigrate(ctx *cli.Context) error {
+	sfm, err := cacheStackerFiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(config.CacheFile()); err != nil {
+		if os.IsNotExist(err) {
+			log.Infof("no build cache found, nothing to migrate")
+			return nil
+		}
+		return errors.Wrapf(err, "couldn't stat cache")
+	}
+
+	oci, err := stackeroci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	cache, err := stacker.OpenCache(config, oci, sfm)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("cache is at version %d with %d entries", cache.Version, len(cache.Cache))
+	return nil
+}
+
+func doCacheKey(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.Errorf("wrong number of args for cache key")
+	}
+	name := ctx.Args().First()
+
+	sfm, err := cacheStackerFiles(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := sfm.LookupLayerDefinition(name); !ok {
+		return errors.Errorf("no layer %s in the stacker files", name)
+	}
+
+	oci, err := stackeroci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	cache, err := stacker.OpenCache(config, oci, sfm)
+	if err != nil {
+		return err
+	}
+
+	key, err := cache.Key(name)
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		content, err := json.MarshalIndent(key, "", "  ")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		fmt.Println(string(content))
+		return nil
+	}
+
+	cached, ok, err := cache.CachedKey(name)
+	if err != nil {
+		return err
+	}
+
+	// say what changed since the last build, if there was one
+	was := func(current string, previous string) string {
+		if !ok || current == previous {
+			return ""
+		}
+		if previous == "" {
+			return " (new)"
+		}
+		return fmt.Sprintf(" (was %s)", previous)
+	}
+
+	previous := map[string]string{}
+	for _, input := range cached.Inputs {
+		previous[input.Name] = input.Hash
+	}
+
+	fmt.Printf("key: %s%s\n", key.Key, was(key.Key, cached.Key))
+	for _, input := range key.Inputs {
+		fmt.Printf("%s: %s%s\n", input.Name, input.Hash, was(input.Hash, previous[input.Name]))
+		delete(previous, input.Name)
+	}
+
+	for _, input := range cached.Inputs {
+		if _, removed := previous[input.Name]; removed {
+			fmt.Printf("%s: (removed, was %s)\n", input.Name, input.Hash)
+		}
+	}
+
+	return nil
+}
+
+func doCacheExport(ctx *cli.Context) error {
+	if !ctx.Args().Present() {
+		return errors.Errorf("need a directory to export to")
+	}
+
+	return stacker.ExportCache(config, ctx.Args().First())
+}
+
+func doCacheImport(ctx *cli.Context) error {
+	if !ctx.Args().Present() {
+		return errors.Errorf("need a directory to import from")
+	}
+
+	return stacker.ImportCache(config, ctx.Args().First())
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/anuvu/stacker"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var catCmd = cli.Command{
+	Name:         "cat",
+	Usage:        "prints a file from an image without extracting it",
+	Action:       doCat,
+	BashComplete: completeOCITagPaths,
+	ArgsUsage: `<tag>:<path>
+
+<tag> is the tag of an image in the OCI output.
+
+<path> is the path of a regular file (relative to /) in the image's rootfs.`,
+}
+
+// splitImagePath splits a <tag>:<path> argument.
+func splitImagePath(arg string) (string, string, error) {
+	parts := strings.SplitN(arg, ":", 2)
+	if len(parts) < 2 {
+		return "", "", errors.Errorf("invalid argument %s, it should be <tag>:<path>", arg)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+func doCat(ctx *cli.Context) error {
+	tag, file, err := splitImagePath(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+
+	return stacker.CatImageFile(config, tag, file, os.Stdout)
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"flag"
+	"io/ioutil"
 	"os"
 
 	"github.com/anuvu/stacker"
@@ -11,10 +13,11 @@ import (
 )
 
 var chrootCmd = cli.Command{
-	Name:    "chroot",
-	Usage:   "run a command in a chroot",
-	Aliases: []string{"exec"},
-	Action:  doChroot,
+	Name:         "chroot",
+	Usage:        "run a command in a chroot",
+	Aliases:      []string{"exec"},
+	Action:       doChroot,
+	BashComplete: completeLayerNames,
 	Flags: []cli.Flag{
 		cli.StringFlag{
 			Name:  "stacker-file, f",
@@ -25,6 +28,10 @@ var chrootCmd = cli.Command{
 			Name:  "substitute",
 			Usage: "variable substitution in stackerfiles, FOO=bar format",
 		},
+		cli.StringSliceFlag{
+			Name:  "substitute-file",
+			Usage: "yaml file of substitutions (FOO: bar); --substitute and STACKER_SUBST_FOO take precedence",
+		},
 	},
 	ArgsUsage: `[tag] [cmd]
 
@@ -32,10 +39,58 @@ var chrootCmd = cli.Command{
 none is specified.
 
 <cmd> is the command to run, or /bin/sh if none is specified. To specify cmd,
-you must specify a tag.`,
+you must specify a tag.
+
+If <tag> is being built, <cmd> (which may have arguments, after a --) is run
+in its build container alongside the step in progress, e.g.:
+
+    stacker exec <tag> -- ps aux`,
+}
+
+// chrootTag returns the tag argument of a chroot command line, if there is
+// one, before the command's flags have been parsed by cli.
+func chrootTag(ctx *cli.Context) string {
+	set := flag.NewFlagSet(chrootCmd.Name, flag.ContinueOnError)
+	set.SetOutput(ioutil.Discard)
+	for _, f := range chrootCmd.Flags {
+		f.Apply(set)
+	}
+
+	if err := set.Parse(ctx.Args().Tail()); err != nil {
+		return ""
+	}
+
+	return set.Arg(0)
+}
+
+// chrootArgs returns the command (and its args) after the tag on a chroot
+// command line. cli keeps the -- that separates them, so it's dropped here.
+func chrootArgs(ctx *cli.Context) []string {
+	args := ctx.Args().Tail()
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	return args
 }
 
 func doChroot(ctx *cli.Context) error {
+	if len(ctx.Args()) > 0 && stacker.BuildRunning(config, ctx.Args()[0]) {
+		args := chrootArgs(ctx)
+		if len(args) == 0 {
+			args = []string{"/bin/sh"}
+		}
+
+		log.Infof("%s is being built, attaching to its build container", ctx.Args()[0])
+		status, err := stacker.AttachToBuild(config, ctx.Args()[0], args)
+		if err != nil {
+			return err
+		}
+		if status != 0 {
+			os.Exit(status)
+		}
+		return nil
+	}
+
 	s, err := stacker.NewStorage(config)
 	if err != nil {
 		return err
@@ -49,8 +104,8 @@ func doChroot(ctx *cli.Context) error {
 
 	cmd := "/bin/sh"
 
-	if len(ctx.Args()) > 1 {
-		cmd = ctx.Args()[1]
+	if args := chrootArgs(ctx); len(args) > 0 {
+		cmd = args[0]
 	}
 
 	file := ctx.String("f")
@@ -68,7 +123,12 @@ func doChroot(ctx *cli.Context) error {
 		defer c.Close()
 		return c.Execute(cmd, os.Stdin)
 	}
-	sf, err := types.NewStackerfile(file, ctx.StringSlice("substitute"))
+	substitute, err := substitutions(ctx)
+	if err != nil {
+		return err
+	}
+
+	sf, err := types.NewStackerfile(file, substitute)
 	if err != nil {
 		return err
 	}
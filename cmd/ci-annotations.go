@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/anuvu/stacker"
+	"github.com/anuvu/stacker/log"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var ciAnnotationsFlag = cli.StringFlag{
+	Name:  "ci-annotations",
+	Usage: "emit annotations for failures, cache hits and digests for a CI system (supported values: github, buildkite)",
+}
+
+func validateCIAnnotationsFlag(ctx *cli.Context) error {
+	switch ctx.String("ci-annotations") {
+	case "", "github", "buildkite":
+		return nil
+	default:
+		return errors.Errorf("unknown --ci-annotations %s", ctx.String("ci-annotations"))
+	}
+}
+
+// ciAnnotation is a CI system independent annotation; level is one of
+// "error" or "notice".
+type ciAnnotation struct {
+	level   string
+	title   string
+	message string
+	file    string
+	line    int
+}
+
+func reportAnnotations(report *stacker.Report) []ciAnnotation {
+	annotations := []ciAnnotation{}
+
+	for _, f := range report.FailedLayers {
+		a := ciAnnotation{level: "error", title: fmt.Sprintf("stacker build of %s failed", f.Name), message: f.Error, file: f.Stackerfile, line: f.Line}
+		if f.SkippedFor != "" {
+			a.title = fmt.Sprintf("stacker build of %s skipped", f.Name)
+			a.message = fmt.Sprintf("%s depends on %s, which failed", f.Name, f.SkippedFor)
+		}
+		annotations = append(annotations, a)
+	}
+
+	if report.Error != "" {
+		a := ciAnnotation{level: "error", title: "stacker failed", message: report.Error}
+		if report.FailedLayer != nil {
+			a.title = fmt.Sprintf("stacker build of %s failed", report.FailedLayer.Name)
+			a.file = report.FailedLayer.Stackerfile
+			a.line = report.FailedLayer.Line
+		}
+		annotations = append(annotations, a)
+	}
+
+	if len(report.Layers) != 0 {
+		hits := 0
+		for _, l := range report.Layers {
+			if l.CacheHit {
+				hits++
+			}
+		}
+		annotations = append(annotations, ciAnnotation{
+			level:   "notice",
+			title:   "stacker cache",
+			message: fmt.Sprintf("%d of %d layers came from the cache", hits, len(report.Layers)),
+		})
+	}
+
+	for _, l := range report.Layers {
+		for _, o := range l.Outputs {
+			annotations = append(annotations, ciAnnotation{
+				level:   "notice",
+				title:   fmt.Sprintf("built %s", o.Tag),
+				message: fmt.Sprintf("%s %s", o.Tag, o.ManifestDigest),
+			})
+		}
+	}
+
+	for _, p := range report.Published {
+		title := fmt.Sprintf("published %s", p.Tag)
+		if p.Skipped {
+			title = fmt.Sprintf("%s already published", p.Tag)
+		}
+		annotations = append(annotations, ciAnnotation{
+			level:   "notice",
+			title:   title,
+			message: fmt.Sprintf("%s %s", p.Destination, p.ManifestDigest),
+		})
+	}
+
+	return annotations
+}
+
+// escapeGithub escapes s for use in a github workflow command; properties
+// (e.g. the title) need some extra characters escaped.
+func escapeGithub(s string, property bool) string {
+	s = strings.Replace(s, "%", "%25", -1)
+	s = strings.Replace(s, "\r", "%0D", -1)
+	s = strings.Replace(s, "\n", "%0A", -1)
+	if property {
+		s = strings.Replace(s, ":", "%3A", -1)
+		s = strings.Replace(s, ",", "%2C", -1)
+	}
+	return s
+}
+
+func githubAnnotation(a ciAnnotation) string {
+	properties := []string{}
+	if a.file != "" {
+		properties = append(properties, fmt.Sprintf("file=%s", escapeGithub(a.file, true)))
+		if a.line != 0 {
+			properties = append(properties, fmt.Sprintf("line=%d", a.line))
+		}
+	}
+	properties = append(properties, fmt.Sprintf("title=%s", escapeGithub(a.title, true)))
+
+	return fmt.Sprintf("::%s %s::%s", a.level, strings.Join(properties, ","), escapeGithub(a.message, false))
+}
+
+// buildkiteAnnotation returns the markdown for a buildkite annotation, and its
+// style.
+func buildkiteAnnotation(a ciAnnotation) (string, string) {
+	body := fmt.Sprintf("**%s**", a.title)
+	if a.file != "" {
+		location := a.file
+		if a.line != 0 {
+			location = fmt.Sprintf("%s:%d", a.file, a.line)
+		}
+		body += fmt.Sprintf(" (`%s`)", location)
+	}
+	body += fmt.Sprintf("\n\n```\n%s\n```\n", a.message)
+
+	style := "info"
+	if a.level == "error" {
+		style = "error"
+	}
+
+	return body, style
+}
+
+func emitCIAnnotations(kind string, report *stacker.Report) error {
+	for _, a := range reportAnnotations(report) {
+		switch kind {
+		case "github":
+			fmt.Println(githubAnnotation(a))
+		case "buildkite":
+			body, style := buildkiteAnnotation(a)
+			// annotations of the same style are appended into one
+			cmd := exec.Command("buildkite-agent", "annotate", "--style", style, "--context", "stacker-"+style, "--append")
+			cmd.Stdin = strings.NewReader(body)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				return errors.Wrapf(err, "couldn't run buildkite-agent annotate")
+			}
+		}
+	}
+
+	return nil
+}
+
+// logCIAnnotations emits the report's annotations if --ci-annotations was
+// specified. Failing to annotate doesn't fail the build, so errors are only
+// logged.
+func logCIAnnotations(ctx *cli.Context, report *stacker.Report) {
+	kind := ctx.String("ci-annotations")
+	if kind == "" {
+		return
+	}
+
+	if err := emitCIAnnotations(kind, report); err != nil {
+		log.Infof("couldn't emit %s annotations: %v", kind, err)
+	}
+}
@@ -37,6 +37,12 @@ func doClean(ctx *cli.Context) error {
 		}
 	}
 
+	unlock, err := stacker.LockOCILayout(config.OCIDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	if err := os.RemoveAll(config.OCIDir); err != nil {
 		log.Infof("problem cleaning oci dir %v", err)
 		fail = true
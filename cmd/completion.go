@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/types"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// completionFlag is the flag urfave/cli appends to the command line when it is
+// asked to generate completions.
+const completionFlag = "--generate-bash-completion"
+
+const bashCompletion = `# bash completion for stacker; source this file or put it in
+# /etc/bash_completion.d/
+_stacker_complete() {
+	local cur opts
+	COMPREPLY=()
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	if [[ "$cur" == "-"* ]]; then
+		opts=$( ${COMP_WORDS[@]:0:$COMP_CWORD} ${cur} --generate-bash-completion 2>/dev/null )
+	else
+		opts=$( ${COMP_WORDS[@]:0:$COMP_CWORD} --generate-bash-completion 2>/dev/null )
+	fi
+	COMPREPLY=( $(compgen -W "${opts}" -- ${cur}) )
+	return 0
+}
+
+complete -o bashdefault -o default -o nospace -F _stacker_complete stacker
+`
+
+const zshCompletion = `#compdef stacker
+
+_stacker_complete() {
+	local -a opts
+	local cur
+	cur=${words[-1]}
+	if [[ "$cur" == "-"* ]]; then
+		opts=("${(@f)$(${words[@]:0:#words[@]-1} ${cur} --generate-bash-completion 2>/dev/null)}")
+	else
+		opts=("${(@f)$(${words[@]:0:#words[@]-1} --generate-bash-completion 2>/dev/null)}")
+	fi
+
+	if [[ "${opts[1]}" != "" ]]; then
+		_describe 'values' opts
+	else
+		_files
+	fi
+}
+
+compdef _stacker_complete stacker
+`
+
+const fishCompletion = `# fish completion for stacker
+function __stacker_complete
+	set -l args (commandline -opc)
+	set -e args[1]
+	set -l cur (commandline -ct)
+	if string match -q -- '-*' $cur
+		stacker $args $cur --generate-bash-completion 2>/dev/null
+	else
+		stacker $args --generate-bash-completion 2>/dev/null
+	end
+end
+
+complete -c stacker -f -a '(__stacker_complete)'
+`
+
+var completionCmd = cli.Command{
+	Name:   "completion",
+	Usage:  "generates a shell completion script for stacker",
+	Action: doCompletion,
+	ArgsUsage: `<shell>
+
+<shell> is one of bash, zsh, or fish. The script is printed to stdout, e.g.
+
+    source <(stacker completion bash)`,
+	BashComplete: func(ctx *cli.Context) {
+		for _, shell := range []string{"bash", "zsh", "fish"} {
+			fmt.Println(shell)
+		}
+	},
+}
+
+func doCompletion(ctx *cli.Context) error {
+	switch ctx.Args().First() {
+	case "bash":
+		fmt.Print(bashCompletion)
+	case "zsh":
+		fmt.Print(zshCompletion)
+	case "fish":
+		fmt.Print(fishCompletion)
+	case "":
+		return errors.Errorf("please specify a shell (bash, zsh, or fish)")
+	default:
+		return errors.Errorf("unknown shell %s (supported: bash, zsh, fish)", ctx.Args().First())
+	}
+
+	return nil
+}
+
+// isCompleting returns true if stacker was invoked by a shell completion
+// script.
+func isCompleting() bool {
+	return len(os.Args) > 0 && os.Args[len(os.Args)-1] == completionFlag
+}
+
+// completeLayerNames prints the layer names in the stackerfile specified by
+// the command's --stacker-file flag. Errors are silently ignored, there's not
+// much useful we can do about them in the middle of a completion.
+func completeLayerNames(ctx *cli.Context) {
+	substitute, err := substitutions(ctx)
+	if err != nil {
+		return
+	}
+
+	sf, err := types.NewStackerfile(ctx.String("stacker-file"), append(substitute, config.Substitutions()...))
+	if err != nil {
+		return
+	}
+
+	for _, name := range sf.FileOrder {
+		fmt.Println(name)
+	}
+}
+
+// completeOCITags prints the tags present in the output OCI layout.
+func completeOCITags(ctx *cli.Context) {
+	oci, err := stackeroci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return
+	}
+	defer oci.Close()
+
+	tags, err := oci.ListReferences(context.Background())
+	if err != nil {
+		return
+	}
+
+	sort.Strings(tags)
+	for _, t := range tags {
+		fmt.Println(t)
+	}
+}
+
+// completeOCITagPaths prints the tags in the OCI output in <tag>: form, for
+// commands that take <tag>:<path>.
+func completeOCITagPaths(ctx *cli.Context) {
+	if strings.Contains(ctx.Args().First(), ":") {
+		return
+	}
+
+	oci, err := stackeroci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return
+	}
+	defer oci.Close()
+
+	tags, err := oci.ListReferences(context.Background())
+	if err != nil {
+		return
+	}
+
+	sort.Strings(tags)
+	for _, t := range tags {
+		fmt.Printf("%s:\n", t)
+	}
+}
+
+// completeGrabTargets prints the layer names from stacker.yaml (if present)
+// in <tag>: form, since grab takes <tag>:<path>.
+func completeGrabTargets(ctx *cli.Context) {
+	if strings.Contains(ctx.Args().First(), ":") {
+		return
+	}
+
+	sf, err := types.NewStackerfile("stacker.yaml", config.Substitutions())
+	if err != nil {
+		return
+	}
+
+	for _, name := range sf.FileOrder {
+		fmt.Printf("%s:\n", name)
+	}
+}
+
+// levenshtein computes the edit distance between two strings.
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			cur[j] = prev[j] + 1
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+// suggestCommands returns the visible commands (or aliases) that look like
+// typos of name.
+func suggestCommands(app *cli.App, name string) []string {
+	suggestions := []string{}
+	for _, c := range app.Commands {
+		if c.Hidden {
+			continue
+		}
+
+		for _, candidate := range c.Names() {
+			if levenshtein(name, candidate) <= 2 || strings.HasPrefix(candidate, name) {
+				suggestions = append(suggestions, c.Name)
+				break
+			}
+		}
+	}
+
+	return suggestions
+}
+
+// doUnknownCommand is the app's default action; it is only reached when the
+// user supplied a command that doesn't exist (or no command at all).
+func doUnknownCommand(ctx *cli.Context) error {
+	if !ctx.Args().Present() {
+		return cli.ShowAppHelp(ctx)
+	}
+
+	name := ctx.Args().First()
+	suggestions := suggestCommands(ctx.App, name)
+	if len(suggestions) == 0 {
+		return errors.Errorf("unknown command %s, see stacker --help", name)
+	}
+
+	return errors.Errorf("unknown command %s, did you mean: %s?", name, strings.Join(suggestions, ", "))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/stacker/types"
+	"github.com/urfave/cli"
+)
+
+var configCmd = cli.Command{
+	Name:  "config",
+	Usage: "inspect stacker's configuration",
+	Subcommands: []cli.Command{
+		cli.Command{
+			Name:   "show",
+			Usage:  "shows the effective configuration",
+			Action: doConfigShow,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "origin",
+					Usage: "say which config file, flag or profile each setting came from",
+				},
+			},
+		},
+	},
+}
+
+func doConfigShow(ctx *cli.Context) error {
+	var origins types.ConfigOrigins
+	if ctx.Bool("origin") {
+		origins = configOrigins
+	}
+
+	content, err := config.Show(origins)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(content)
+	return nil
+}
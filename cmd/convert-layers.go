@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/anuvu/stacker"
+	"github.com/anuvu/stacker/log"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var convertLayersCmd = cli.Command{
+	Name:   "convert-layers",
+	Usage:  "converts the layers of a built image to another format",
+	Action: doConvertLayers,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "to",
+			Usage: "the layer format to convert to: squashfs, tar+gzip or tar+zstd",
+		},
+		cli.StringFlag{
+			Name:  "tag",
+			Usage: "the tag for the converted image (default: <tag>-<format>)",
+		},
+	},
+	ArgsUsage: `<tag>
+
+<tag> is the tag of the image in the output OCI layout to convert.`,
+}
+
+func doConvertLayers(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.Errorf("wrong number of args for convert-layers")
+	}
+	tag := ctx.Args().First()
+
+	format := ctx.String("to")
+	if format == "" {
+		return errors.Errorf("--to is required")
+	}
+
+	newTag := ctx.String("tag")
+	if newTag == "" {
+		newTag = fmt.Sprintf("%s-%s", tag, strings.Replace(format, "+", "-", -1))
+	}
+
+	if err := stacker.ConvertLayers(config, tag, newTag, format); err != nil {
+		return err
+	}
+
+	log.Infof("converted %s to %s", tag, newTag)
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/anuvu/stacker"
+	"github.com/anuvu/stacker/log"
+	"github.com/dustin/go-humanize"
+	"github.com/urfave/cli"
+)
+
+var dedupCmd = cli.Command{
+	Name:   "dedup",
+	Usage:  "share the disk space of identical files across all the built layers",
+	Action: doDedup,
+}
+
+func doDedup(ctx *cli.Context) error {
+	s, err := stacker.NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer s.Detach()
+
+	files, bytes, err := s.Dedup()
+	if err != nil {
+		return err
+	}
+
+	log.Infof("deduplicated %d files (%s)", files, humanize.IBytes(uint64(bytes)))
+	return nil
+}
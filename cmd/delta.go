@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/anuvu/stacker/log"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var deltaCmd = cli.Command{
+	Name:   "delta",
+	Usage:  "adds xdelta3 deltas between the squashfs layers of two images as an OCI artifact",
+	Action: doDelta,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "tag",
+			Usage: "the tag for the delta artifact (default: <to>-from-<from>)",
+		},
+	},
+	ArgsUsage: `<from> <to>
+
+<from> and <to> are the tags of the images in the output OCI layout to make
+deltas from and to, e.g. the last published and the new version of a layer.`,
+}
+
+func doDelta(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return errors.Errorf("wrong number of args for delta")
+	}
+	from := ctx.Args().Get(0)
+	to := ctx.Args().Get(1)
+
+	tag := ctx.String("tag")
+	if tag == "" {
+		tag = fmt.Sprintf("%s-from-%s", to, from)
+	}
+
+	artifact, err := stacker.GenerateDeltas(config, from, to, tag)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("added %d deltas from %s to %s as %s", len(artifact.Layers), from, to, tag)
+	return nil
+}
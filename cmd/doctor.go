@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/anuvu/stacker/btrfs"
+	"github.com/anuvu/stacker/container"
+	"github.com/anuvu/stacker/squashfs"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"golang.org/x/sys/unix"
+)
+
+var doctorCmd = cli.Command{
+	Name:   "doctor",
+	Usage:  "checks that the tools and kernel features stacker needs are available",
+	Action: doDoctor,
+}
+
+// doctorCheck is one thing stacker doctor checks. check returns some details
+// to print on success; hint is printed if it fails.
+type doctorCheck struct {
+	name  string
+	check func() (string, error)
+	hint  string
+
+	// optional checks are for features stacker can do without, so they
+	// only warn when they fail.
+	optional bool
+}
+
+func doDoctor(ctx *cli.Context) error {
+	checks := []doctorCheck{
+		{
+			name:  "mksquashfs",
+			check: func() (string, error) { return squashfsToolDetails("mksquashfs") },
+			hint:  "install squashfs-tools",
+		},
+		{
+			name:  "unsquashfs",
+			check: func() (string, error) { return squashfsToolDetails("unsquashfs") },
+			hint:  "install squashfs-tools",
+		},
+	}
+
+	if config.SquashfsVerity {
+		checks = append(checks, doctorCheck{
+			name:  "veritysetup",
+			check: func() (string, error) { return lookPath("veritysetup") },
+			hint:  "squashfs_verity needs veritysetup; install cryptsetup",
+		})
+	}
+
+	if os.Geteuid() != 0 {
+		checks = append(checks, unprivChecks()...)
+	}
+
+	switch config.StorageType {
+	case "overlay":
+		checks = append(checks, overlayChecks()...)
+	case "btrfs":
+		checks = append(checks, btrfsChecks()...)
+	}
+
+	checks = append(checks, doctorCheck{
+		name:     "idmapped mounts",
+		check:    func() (string, error) { return "", kernelAtLeast(5, 12) },
+		hint:     "idmapped mounts need kernel >= 5.12",
+		optional: true,
+	})
+
+	failed := 0
+	for _, c := range checks {
+		details, err := c.check()
+		if err == nil {
+			fmt.Printf("[ OK ] %s", c.name)
+			if details != "" {
+				fmt.Printf(" (%s)", details)
+			}
+			fmt.Printf("\n")
+			continue
+		}
+
+		status := "FAIL"
+		if c.optional {
+			status = "WARN"
+		} else {
+			failed++
+		}
+
+		fmt.Printf("[%s] %s: %v\n", status, c.name, err)
+		fmt.Printf("       %s\n", c.hint)
+	}
+
+	if failed != 0 {
+		return errors.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+
+	return nil
+}
+
+func squashfsToolDetails(tool string) (string, error) {
+	version, err := squashfs.ToolVersion(tool)
+	if err != nil {
+		return "", err
+	}
+
+	compressors, err := squashfs.ToolCompressors(tool)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s; compressors: %s", version, strings.Join(compressors, " ")), nil
+}
+
+func lookPath(binary string) (string, error) {
+	p, err := exec.LookPath(binary)
+	if err != nil {
+		return "", errors.Errorf("%s not found in $PATH", binary)
+	}
+
+	return p, nil
+}
+
+func unprivChecks() []doctorCheck {
+	checks := []doctorCheck{
+		{
+			name: "subuid and subgid ranges",
+			check: func() (string, error) {
+				idmapSet, err := container.ResolveCurrentIdmapSet()
+				if err != nil {
+					return "", err
+				}
+
+				if idmapSet == nil {
+					return "", errors.Errorf("no /etc/subuid or /etc/subgid entries for the current user")
+				}
+
+				return strings.Join(idmapSet.ToLxcString(), ", "), nil
+			},
+			hint: "run sudo stacker unpriv-setup",
+		},
+	}
+
+	for _, binary := range []string{"newuidmap", "newgidmap", "lxc-usernsexec"} {
+		binary := binary
+		checks = append(checks, doctorCheck{
+			name:  binary,
+			check: func() (string, error) { return lookPath(binary) },
+			hint:  "unprivileged builds need newuidmap and newgidmap (shadow/uidmap) and lxc-usernsexec (lxc)",
+		})
+	}
+
+	return checks
+}
+
+func overlayChecks() []doctorCheck {
+	return []doctorCheck{
+		{
+			name: "overlay storage",
+			check: func() (string, error) {
+				return "", checkOverlayInUserns()
+			},
+			hint: "overlay needs to be mountable (kernel >= 5.11 when unprivileged), and creating whiteouts needs kernel >= 5.8; or use --storage-type=btrfs",
+		},
+		{
+			name: "overlay userxattr",
+			check: func() (string, error) {
+				return "", checkOverlayInUserns("--userxattr")
+			},
+			hint:     "unprivileged squashfs layers with whiteouts need kernel >= 5.11 (and >= 6.7 to mount them)",
+			optional: true,
+		},
+	}
+}
+
+// checkOverlayInUserns runs internal-go check-overlay in the user namespace
+// builds run in, since that's where overlay has to work.
+func checkOverlayInUserns(args ...string) error {
+	binary, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return err
+	}
+
+	cmd := []string{
+		binary,
+		"--roots-dir", config.RootFSDir,
+		"--stacker-dir", config.StackerDir,
+		"--internal-userns",
+		"internal-go", "check-overlay",
+	}
+	cmd = append(cmd, args...)
+	return container.MaybeRunInUserns(cmd, "")
+}
+
+func btrfsChecks() []doctorCheck {
+	checks := []doctorCheck{}
+	for _, binary := range []string{"btrfs", "mkfs.btrfs"} {
+		binary := binary
+		checks = append(checks, doctorCheck{
+			name:  binary,
+			check: func() (string, error) { return lookPath(binary) },
+			hint:  "install btrfs-progs",
+		})
+	}
+
+	checks = append(checks, doctorCheck{
+		name:  "squashtool",
+		check: func() (string, error) { return lookPath("squashtool") },
+		hint:  "extracting squashfs layers with btrfs storage needs squashtool (https://github.com/anuvu/squashfs)",
+		// only needed for squashfs images
+		optional: true,
+	})
+
+	checks = append(checks, doctorCheck{
+		name: "btrfs roots dir",
+		check: func() (string, error) {
+			if _, err := os.Stat(config.RootFSDir); err == nil {
+				isBtrfs, err := btrfs.DetectBtrfs(config.RootFSDir)
+				if err != nil {
+					return "", err
+				}
+
+				if isBtrfs {
+					return fmt.Sprintf("%s is btrfs", config.RootFSDir), nil
+				}
+			}
+
+			loopback := path.Join(config.StackerDir, "btrfs.loop")
+			if _, err := os.Stat(loopback); err == nil {
+				return fmt.Sprintf("%s will be mounted", loopback), nil
+			}
+
+			if os.Geteuid() != 0 {
+				return "", errors.Errorf("%s isn't btrfs, and creating a loopback needs root", config.RootFSDir)
+			}
+
+			return fmt.Sprintf("%s will be created", loopback), nil
+		},
+		hint: "run sudo stacker unpriv-setup",
+	})
+
+	return checks
+}
+
+// kernelAtLeast returns an error if the running kernel is older than
+// major.minor.
+func kernelAtLeast(major, minor int) error {
+	uts := unix.Utsname{}
+	if err := unix.Uname(&uts); err != nil {
+		return errors.Wrapf(err, "couldn't get kernel version")
+	}
+
+	release := unix.ByteSliceToString(uts.Release[:])
+
+	var kMajor, kMinor int
+	if _, err := fmt.Sscanf(release, "%d.%d", &kMajor, &kMinor); err != nil {
+		return errors.Wrapf(err, "couldn't parse kernel version %s", release)
+	}
+
+	if kMajor < major || (kMajor == major && kMinor < minor) {
+		return errors.Errorf("kernel %s is older than %d.%d", release, major, minor)
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/anuvu/stacker"
+	"github.com/anuvu/stacker/log"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var exportLXDCmd = cli.Command{
+	Name:         "export-lxd",
+	Usage:        "exports a layer's filesystem as an LXD (or Incus) image",
+	Action:       doExportLXD,
+	BashComplete: completeLayerNames,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "the directory to write the image to, by default <tag>-lxd",
+		},
+		cli.StringFlag{
+			Name:  "import",
+			Usage: "import the image into the local daemon with this alias",
+		},
+		cli.StringFlag{
+			Name:  "client",
+			Usage: "the client to import the image with, lxc or incus",
+			Value: "lxc",
+		},
+	},
+	ArgsUsage: `<tag>
+
+<tag> is the built tag whose filesystem is exported, as a split image: a
+metadata tarball and the filesystem as a squashfs.`,
+}
+
+func doExportLXD(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.Errorf("wrong number of args for export-lxd")
+	}
+	tag := ctx.Args().First()
+
+	dir := ctx.String("output")
+	if dir == "" {
+		dir = tag + "-lxd"
+	}
+
+	s, err := stacker.NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer s.Detach()
+
+	if err := stacker.ExportLXDImage(config, s, tag, dir); err != nil {
+		return err
+	}
+	log.Infof("exported %s to %s", tag, dir)
+
+	if alias := ctx.String("import"); alias != "" {
+		return stacker.ImportLXDImage(ctx.String("client"), dir, alias)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path"
+
+	"github.com/anuvu/stacker"
+	"github.com/anuvu/stacker/log"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var exportRootfsCmd = cli.Command{
+	Name:         "export-rootfs",
+	Usage:        "exports a layer's filesystem as a single tarball",
+	Action:       doExportRootfs,
+	BashComplete: completeLayerNames,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "the tarball to write, or - for stdout",
+		},
+		cli.StringFlag{
+			Name:  "compression",
+			Usage: "none, gzip or zstd; by default from the output's extension (.gz, .tgz, .zst or .tzst)",
+		},
+	},
+	ArgsUsage: `<tag>
+
+<tag> is the built tag whose filesystem is exported, flattened into one
+tarball with no OCI image around it, e.g. for chroots, LXD or systemd-nspawn.`,
+}
+
+func doExportRootfs(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.Errorf("wrong number of args for export-rootfs")
+	}
+	tag := ctx.Args().First()
+
+	output := ctx.String("output")
+	if output == "" {
+		return errors.Errorf("no --output to export %s to", tag)
+	}
+
+	compression := ctx.String("compression")
+	if compression == "" {
+		compression = stacker.RootfsCompression(output)
+	}
+
+	s, err := stacker.NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer s.Detach()
+
+	if output == "-" {
+		return stacker.ExportRootfs(config, s, tag, compression, os.Stdout)
+	}
+
+	// written next to output, and renamed into place once it's complete
+	tmp := path.Join(path.Dir(output), "."+path.Base(output)+".tmp")
+	defer os.Remove(tmp)
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = stacker.ExportRootfs(config, s, tag, compression, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := os.Rename(tmp, output); err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.Infof("exported %s to %s", tag, output)
+	return nil
+}
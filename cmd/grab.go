@@ -5,14 +5,16 @@ import (
 	"strings"
 
 	"github.com/anuvu/stacker"
+	"github.com/anuvu/stacker/log"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
 
 var grabCmd = cli.Command{
-	Name:   "grab",
-	Usage:  "grabs a file from the layer's filesystem",
-	Action: doGrab,
+	Name:         "grab",
+	Usage:        "grabs a file from the layer's filesystem",
+	Action:       doGrab,
+	BashComplete: completeGrabTargets,
 	ArgsUsage: `<tag>:<path>
 
 <tag> is the tag in a built stacker image to extract the file from.
@@ -21,27 +23,33 @@ var grabCmd = cli.Command{
 }
 
 func doGrab(ctx *cli.Context) error {
-	s, err := stacker.NewStorage(config)
+	parts := strings.SplitN(ctx.Args().First(), ":", 2)
+	if len(parts) < 2 {
+		return errors.Errorf("invalid grab argument: %s", ctx.Args().First())
+	}
+
+	cwd, err := os.Getwd()
 	if err != nil {
 		return err
 	}
-	defer s.Detach()
 
-	parts := strings.SplitN(ctx.Args().First(), ":", 2)
-	if len(parts) < 2 {
-		return errors.Errorf("invalid grab argument: %s", ctx.Args().First())
+	err = stacker.GrabFromImage(config, parts[0], parts[1], cwd)
+	if errors.Cause(err) != stacker.ErrCantGrabFromImage {
+		return err
 	}
+	log.Debugf("%v, grabbing from the roots dir", err)
 
-	name, cleanup, err := s.TemporaryWritableSnapshot(parts[0])
+	s, err := stacker.NewStorage(config)
 	if err != nil {
 		return err
 	}
-	defer cleanup()
+	defer s.Detach()
 
-	cwd, err := os.Getwd()
+	name, cleanup, err := s.TemporaryWritableSnapshot(parts[0])
 	if err != nil {
 		return err
 	}
+	defer cleanup()
 
 	return stacker.Grab(config, s, name, parts[1], cwd)
 }
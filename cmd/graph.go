@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var graphCmd = cli.Command{
+	Name:   "graph",
+	Usage:  "prints the graph of the layers in stacker files, colored by whether the next build will rebuild them",
+	Action: doGraph,
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "stacker-file, f",
+			Usage: "the stacker file(s) to graph (default: stacker.yaml)",
+		},
+		cli.StringSliceFlag{
+			Name:  "substitute",
+			Usage: "variable substitution in stackerfiles, FOO=bar format",
+		},
+		cli.StringSliceFlag{
+			Name:  "substitute-file",
+			Usage: "yaml file of substitutions (FOO: bar); --substitute and STACKER_SUBST_FOO take precedence",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "the graph's format (supported values: dot, mermaid)",
+			Value: "dot",
+		},
+		cli.BoolFlag{
+			Name:  "no-cache-status",
+			Usage: "don't look the layers up in the build cache",
+		},
+	},
+}
+
+func doGraph(ctx *cli.Context) error {
+	format := ctx.String("format")
+	if format != "dot" && format != "mermaid" {
+		return errors.Errorf("unknown --format %s", format)
+	}
+
+	substitute, err := substitutions(ctx)
+	if err != nil {
+		return err
+	}
+
+	files := ctx.StringSlice("stacker-file")
+	if len(files) == 0 {
+		files = []string{"stacker.yaml"}
+	}
+
+	g, err := stacker.NewLayerGraph(config, files, substitute, !ctx.Bool("no-cache-status"))
+	if err != nil {
+		return err
+	}
+
+	if format == "mermaid" {
+		fmt.Print(g.Mermaid())
+	} else {
+		fmt.Print(g.DOT())
+	}
+	return nil
+}
@@ -5,20 +5,21 @@ import (
 	"encoding/json"
 	"fmt"
 
+	"github.com/anuvu/stacker"
 	stackeroci "github.com/anuvu/stacker/oci"
 	"github.com/dustin/go-humanize"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
-	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 )
 
 var inspectCmd = cli.Command{
-	Name:   "inspect",
-	Usage:  "print the json representation of an OCI image",
-	Action: doInspect,
-	Flags:  []cli.Flag{},
+	Name:         "inspect",
+	Usage:        "print the json representation of an OCI image",
+	Action:       doInspect,
+	Flags:        []cli.Flag{},
+	BashComplete: completeOCITags,
 	ArgsUsage: `[tag]
 
 <tag> is the tag in the stackerfile to inspect. If none is supplied, inspect
@@ -26,7 +27,13 @@ prints the information on all tags.`,
 }
 
 func doInspect(ctx *cli.Context) error {
-	oci, err := umoci.OpenLayout(config.OCIDir)
+	unlock, err := stacker.LockOCILayout(config.OCIDir, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	oci, err := stackeroci.OpenLayout(config.OCIDir)
 	if err != nil {
 		return err
 	}
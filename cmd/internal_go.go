@@ -3,9 +3,13 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"os/exec"
+	"path"
 	"strings"
 
+	"github.com/anuvu/stacker/agent"
 	"github.com/anuvu/stacker/lib"
 	"github.com/anuvu/stacker/log"
 	"github.com/anuvu/stacker/overlay"
@@ -21,10 +25,60 @@ var internalGoCmd = cli.Command{
 			Name:   "cp",
 			Action: doCP,
 		},
+		cli.Command{
+			Name:   "agent",
+			Action: doAgent,
+		},
+		cli.Command{
+			Name:   "exec-as",
+			Action: doExecAs,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name: "user",
+				},
+				cli.StringFlag{
+					Name: "dir",
+				},
+				cli.StringFlag{
+					Name: "umask",
+				},
+			},
+		},
+		cli.Command{
+			Name:   "harden",
+			Action: doHarden,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name: "strip-setuid",
+				},
+				cli.StringSliceFlag{
+					Name: "keep-setuid",
+				},
+				cli.BoolFlag{
+					Name: "root-owned",
+				},
+				cli.StringSliceFlag{
+					Name: "skip",
+				},
+			},
+		},
+		cli.Command{
+			Name:   "add-users",
+			Action: doAddUsers,
+		},
 		cli.Command{
 			Name:   "check-aa-profile",
 			Action: doCheckAAProfile,
 		},
+		cli.Command{
+			Name:   "check-overlay",
+			Action: doCheckOverlay,
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name: "userxattr",
+				},
+			},
+		},
 		/*
 		 * these are not actually used by stacker, but are entrypoints
 		 * to the code for use in the test suite.
@@ -70,6 +124,24 @@ func doTestsuiteCheckOverlay(ctx *cli.Context) error {
 	return nil
 }
 
+// doCheckOverlay is how stacker doctor checks that overlay works in the user
+// namespace stacker builds in.
+func doCheckOverlay(ctx *cli.Context) error {
+	if ctx.Bool("userxattr") {
+		if !overlay.SupportsUserxattr() {
+			return errors.Errorf("can't mount overlay with userxattr")
+		}
+		return nil
+	}
+
+	err := os.MkdirAll(config.RootFSDir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't make rootfs dir")
+	}
+
+	return overlay.CanDoOverlay(config)
+}
+
 func doImageCopy(ctx *cli.Context) error {
 	if len(ctx.Args()) != 2 {
 		return errors.Errorf("wrong number of args")
@@ -82,6 +154,44 @@ func doImageCopy(ctx *cli.Context) error {
 	})
 }
 
+// doHarden is run in a build's container once it's done, to harden the
+// directories in its args.
+func doHarden(ctx *cli.Context) error {
+	if len(ctx.Args()) == 0 {
+		return errors.Errorf("nothing to harden")
+	}
+
+	opts := lib.HardenOpts{
+		StripSetuid: ctx.Bool("strip-setuid"),
+		KeepSetuid:  ctx.StringSlice("keep-setuid"),
+		RootOwned:   ctx.Bool("root-owned"),
+		Skip:        ctx.StringSlice("skip"),
+	}
+
+	stats, err := lib.HardenRootfs("/", ctx.Args(), opts)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("hardened the rootfs: stripped setuid from %d files, chowned %d", stats.Stripped, stats.Chowned)
+	return nil
+}
+
+// doAddUsers is run in a build's container to add the users in its args (as
+// lib.User's String() has them) to its rootfs.
+func doAddUsers(ctx *cli.Context) error {
+	users := []lib.User{}
+	for _, arg := range ctx.Args() {
+		u, err := lib.ParseUser(arg)
+		if err != nil {
+			return err
+		}
+		users = append(users, u)
+	}
+
+	return lib.AddUsers("/", users)
+}
+
 func doCP(ctx *cli.Context) error {
 	if len(ctx.Args()) != 2 {
 		return errors.Errorf("wrong number of args")
@@ -93,6 +203,46 @@ func doCP(ctx *cli.Context) error {
 	)
 }
 
+// doAgent is the stacker agent, run in the build container by
+// Container.StartAgent(). Its scripts are written next to its socket.
+func doAgent(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.Errorf("wrong number of args")
+	}
+
+	socket := ctx.Args()[0]
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't listen on %s", socket)
+	}
+	defer os.Remove(socket)
+	defer l.Close()
+
+	return agent.Serve(l, path.Dir(socket))
+}
+
+// doExecAs runs a step's script in the build container as the user, in the
+// working dir and with the umask its layer asks for.
+func doExecAs(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.Errorf("wrong number of args")
+	}
+
+	cmd, err := agent.Command(ctx.Args()[0], ctx.String("user"), ctx.String("dir"), ctx.String("umask"))
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		os.Exit(exitErr.ExitCode())
+	}
+	return errors.WithStack(err)
+}
+
 const aaControlFile = "/proc/self/attr/current"
 
 func doCheckAAProfile(ctx *cli.Context) error {
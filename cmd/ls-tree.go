@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var lsTreeCmd = cli.Command{
+	Name:         "ls-tree",
+	Usage:        "lists the files in an image, and the layers they came from",
+	Action:       doLsTree,
+	BashComplete: completeOCITags,
+	ArgsUsage: `<tag> [path]
+
+<tag> is the tag of an image in the OCI output.
+
+[path] is the file or directory (relative to /) in the image's rootfs to list,
+by default the whole rootfs.`,
+}
+
+func doLsTree(ctx *cli.Context) error {
+	if ctx.NArg() < 1 || ctx.NArg() > 2 {
+		return errors.Errorf("wrong number of args for ls-tree")
+	}
+
+	files, err := stacker.ListImageFiles(config, ctx.Args().Get(0), ctx.Args().Get(1))
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		name := "/" + f.Path
+		if f.Linkname != "" {
+			name = fmt.Sprintf("%s -> %s", name, f.Linkname)
+		}
+
+		fmt.Printf("%s %d/%d %10d %.12s %s\n", f.Mode, f.Uid, f.Gid, f.Size, f.Layer.Encoded(), name)
+	}
+
+	return nil
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/user"
@@ -10,6 +9,7 @@ import (
 	"path/filepath"
 	"syscall"
 
+	"github.com/anuvu/stacker"
 	"github.com/anuvu/stacker/container"
 	stackerlog "github.com/anuvu/stacker/log"
 	"github.com/anuvu/stacker/types"
@@ -17,13 +17,17 @@ import (
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"golang.org/x/term"
-	"gopkg.in/yaml.v2"
 )
 
 var (
 	config      types.StackerConfig
 	version     = ""
 	lxc_version = ""
+
+	// configOrigins is where each of config's settings came from
+	configOrigins types.ConfigOrigins
+
+	debugFlag stackerlog.DebugFlag
 )
 
 func shouldShowProgress(ctx *cli.Context) bool {
@@ -39,7 +43,16 @@ func shouldShowProgress(ctx *cli.Context) bool {
 	return term.IsTerminal(int(os.Stdout.Fd()))
 }
 
+// substitutions returns the substitutions from --substitute, the
+// STACKER_SUBST_* environment variables and --substitute-file, in that order
+// of precedence.
+func substitutions(ctx *cli.Context) ([]string, error) {
+	return types.CombineSubstitutions(ctx.StringSlice("substitute"), os.Environ(), ctx.StringSlice("substitute-file"))
+}
+
 func stackerResult(err error) {
+	stopProfiling()
+
 	if err != nil {
 		format := "error: %v\n"
 		if config.Debug {
@@ -48,6 +61,12 @@ func stackerResult(err error) {
 
 		fmt.Fprintf(os.Stderr, format, err)
 
+		// errors we know the kind of get their own exit code, so that
+		// e.g. CI can tell bad stacker files from registry outages
+		if kind := types.KindOf(err); kind != types.OtherError {
+			os.Exit(kind.ExitCode())
+		}
+
 		// propagate the wrapped execution's error code if we're in the
 		// userns wrapper
 		exitErr, ok := errors.Cause(err).(*exec.ExitError)
@@ -60,6 +79,51 @@ func stackerResult(err error) {
 	}
 }
 
+// needsTools returns true if the command may run tools, which come from
+// the tools image if the config has one.
+func needsTools(ctx *cli.Context) bool {
+	if len(ctx.Args()) < 1 || isCompleting() {
+		return false
+	}
+
+	// the config should be shown even if the tools image can't be pulled
+	name := ctx.Args()[0]
+	return name != completionCmd.Name && name != configCmd.Name && ctx.App.Command(name) != nil
+}
+
+// shouldRunInUserns decides whether or not we need to re-exec ourselves in a
+// user namespace before running the command.
+func shouldRunInUserns(ctx *cli.Context) bool {
+	if ctx.Bool("internal-userns") || len(ctx.Args()) < 1 {
+		return false
+	}
+
+	// shell completion and typos don't need any privilege
+	if isCompleting() {
+		return false
+	}
+
+	name := ctx.Args()[0]
+	// doctor checks the userns setup itself
+	if name == "unpriv-stacker" || name == completionCmd.Name || name == doctorCmd.Name || name == configCmd.Name || ctx.App.Command(name) == nil {
+		return false
+	}
+
+	// images are mounted in the host's mount namespace, so that they're
+	// still mounted after stacker exits
+	if name == mountCmd.Name || name == umountCmd.Name {
+		return false
+	}
+
+	// a build in progress can only be attached to from outside of the
+	// user namespace (the build's is a different one)
+	if ctx.App.Command(name) == ctx.App.Command(chrootCmd.Name) && stacker.BuildRunning(config, chrootTag(ctx)) {
+		return false
+	}
+
+	return true
+}
+
 func main() {
 
 	app := cli.NewApp()
@@ -81,16 +145,39 @@ func main() {
 	app.Commands = []cli.Command{
 		buildCmd,
 		recursiveBuildCmd,
+		graphCmd,
 		publishCmd,
+		pruneRemoteCmd,
+		pruneCmd,
+		bomCmd,
 		chrootCmd,
 		cleanCmd,
 		inspectCmd,
 		grabCmd,
+		catCmd,
+		statCmd,
+		lsTreeCmd,
+		exportRootfsCmd,
+		exportLXDCmd,
 		internalGoCmd,
 		unprivSetupCmd,
 		gcCmd,
+		configCmd,
+		storageCmd,
+		completionCmd,
+		cacheCmd,
+		dedupCmd,
+		convertLayersCmd,
+		deltaCmd,
+		doctorCmd,
+		verityInfoCmd,
+		mountCmd,
+		umountCmd,
 	}
 
+	app.EnableBashCompletion = true
+	app.Action = doUnknownCommand
+
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:  "stacker-dir",
@@ -112,9 +199,14 @@ func main() {
 			Usage: "stacker config file with defaults",
 			Value: path.Join(configDir, "conf.yaml"),
 		},
-		cli.BoolFlag{
+		cli.StringFlag{
+			Name:  "profile",
+			Usage: "use the directories of this profile from the stacker config",
+		},
+		cli.GenericFlag{
 			Name:  "debug",
-			Usage: "enable stacker debug mode",
+			Usage: "enable stacker debug mode, or with e.g. --debug=storage,oci,container just those subsystems' debug logs",
+			Value: &debugFlag,
 		},
 		cli.BoolFlag{
 			Name:  "q, quiet",
@@ -136,6 +228,7 @@ func main() {
 			Hidden: true,
 		},
 	}
+	app.Flags = append(app.Flags, profileFlags...)
 
 	/*
 	 * Here's a barrel of suck: urfave/cli v1 doesn't allow for default
@@ -172,33 +265,56 @@ func main() {
 	}()
 	app.Before = func(ctx *cli.Context) error {
 		logLevel := log.InfoLevel
-		if ctx.Bool("debug") {
+		if ctx.IsSet("debug") && ctx.Bool("quiet") {
+			return errors.Errorf("debug and quiet don't make sense together")
+		}
+
+		if debugFlag.All {
 			config.Debug = true
 			logLevel = log.DebugLevel
-			if ctx.Bool("quiet") {
-				return errors.Errorf("debug and quiet don't make sense together")
-			}
 		} else if ctx.Bool("quiet") {
 			logLevel = log.FatalLevel
 		}
 
+		// the system config, then the user's, then the project's, and
+		// then an explicitly given --config (which used to replace the
+		// user's, so it still does)
+		configFiles := []string{types.SystemConfigFile}
+		if !ctx.IsSet("config") {
+			configFiles = append(configFiles, ctx.String("config"))
+		}
+		configFiles = append(configFiles, types.ProjectConfigFile)
+		if ctx.IsSet("config") {
+			configFiles = append(configFiles, ctx.String("config"))
+		}
+
 		var err error
-		content, err := ioutil.ReadFile(ctx.String("config"))
-		if err == nil {
-			err = yaml.Unmarshal(content, &config)
-			if err != nil {
+		configOrigins, err = config.LoadFiles(configFiles)
+		if err != nil {
+			return err
+		}
+
+		if ctx.String("profile") != "" {
+			if err := config.ApplyProfile(ctx.String("profile"), configOrigins); err != nil {
 				return err
 			}
 		}
 
-		if config.StackerDir == "" || ctx.IsSet("stacker-dir") {
-			config.StackerDir = ctx.String("stacker-dir")
-		}
-		if config.OCIDir == "" || ctx.IsSet("oci-dir") {
-			config.OCIDir = ctx.String("oci-dir")
-		}
-		if config.RootFSDir == "" || ctx.IsSet("roots-dir") {
-			config.RootFSDir = ctx.String("roots-dir")
+		for _, dir := range []struct {
+			flag   string
+			key    string
+			config *string
+		}{
+			{"stacker-dir", "stacker_dir", &config.StackerDir},
+			{"oci-dir", "oci_dir", &config.OCIDir},
+			{"roots-dir", "rootfs_dir", &config.RootFSDir},
+		} {
+			if ctx.IsSet(dir.flag) {
+				configOrigins[dir.key] = "--" + dir.flag
+			}
+			if *dir.config == "" || ctx.IsSet(dir.flag) {
+				*dir.config = ctx.String(dir.flag)
+			}
 		}
 
 		config.StackerDir, err = filepath.Abs(config.StackerDir)
@@ -215,6 +331,38 @@ func main() {
 			return err
 		}
 
+		if config.BaseImageCache != "" {
+			config.BaseImageCache, err = filepath.Abs(config.BaseImageCache)
+			if err != nil {
+				return err
+			}
+
+			if config.OverlayLayerPool == "" {
+				config.OverlayLayerPool = path.Join(config.BaseImageCache, "overlay-layers")
+			}
+		}
+
+		if config.OverlayLayerPool != "" {
+			config.OverlayLayerPool, err = filepath.Abs(config.OverlayLayerPool)
+			if err != nil {
+				return err
+			}
+		}
+
+		if config.TmpDir != "" {
+			config.TmpDir, err = filepath.Abs(config.TmpDir)
+			if err != nil {
+				return err
+			}
+
+			if err := os.MkdirAll(config.TmpDir, 0755); err != nil {
+				return errors.Wrapf(err, "couldn't make tmp dir")
+			}
+
+			// so that everything stacker runs uses it too
+			os.Setenv("TMPDIR", config.TmpDir)
+		}
+
 		config.StorageType = ctx.String("storage-type")
 
 		fi, err := os.Stat(config.CacheFile())
@@ -246,7 +394,15 @@ func main() {
 		stackerlog.FilterNonStackerLogs(handler, logLevel)
 		stackerlog.Debugf("stacker version %s", version)
 
-		if !ctx.Bool("internal-userns") && len(ctx.Args()) >= 1 && ctx.Args()[0] != "unpriv-stacker" {
+		// the stacker that started this one waits for it, and passes on
+		// SIGTERM to it, but may be killed itself
+		if ctx.Bool("internal-userns") {
+			if err := container.SetParentDeathSignal(); err != nil {
+				return err
+			}
+		}
+
+		if shouldRunInUserns(ctx) {
 			binary, err := os.Readlink("/proc/self/exe")
 			if err != nil {
 				return err
@@ -259,7 +415,18 @@ func main() {
 
 			stackerResult(container.MaybeRunInUserns(cmd, ""))
 		}
-		return nil
+
+		// the tools image's tools are found before the host's by
+		// everything stacker runs
+		if needsTools(ctx) {
+			if err := stacker.SetupTools(config); err != nil {
+				return err
+			}
+		}
+
+		// only profile the process that does the work, not the one that
+		// just waits for it in the userns wrapper
+		return startProfiling(ctx)
 	}
 
 	stackerResult(app.Run(os.Args))
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+
+	"github.com/anuvu/stacker"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var mountCmd = cli.Command{
+	Name:         "mount",
+	Usage:        "mounts a squashfs image from the OCI output read only on the host",
+	Action:       doMount,
+	BashComplete: completeOCITags,
+	ArgsUsage: `<tag> <dir>
+
+<tag> is the tag of an image in the OCI output whose layers are all squashfs.
+
+<dir> is where to mount it; it is created if it doesn't exist.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "writable",
+			Usage: "put a tmpfs on top of the image, so it can be written to (the changes are lost when it's unmounted)",
+		},
+	},
+}
+
+var umountCmd = cli.Command{
+	Name:      "umount",
+	Usage:     "unmounts an image stacker mount mounted",
+	Action:    doUmount,
+	ArgsUsage: `<dir>`,
+}
+
+func doMount(ctx *cli.Context) error {
+	if len(ctx.Args()) != 2 {
+		return errors.Errorf("usage: stacker mount <tag> <dir>")
+	}
+
+	// the mounts have to outlive stacker, in the host's mount namespace
+	if os.Geteuid() != 0 {
+		return errors.Errorf("stacker mount needs to be run as root")
+	}
+
+	return stacker.MountImage(config, ctx.Args()[0], ctx.Args()[1], ctx.Bool("writable"))
+}
+
+func doUmount(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.Errorf("usage: stacker umount <dir>")
+	}
+
+	if os.Geteuid() != 0 {
+		return errors.Errorf("stacker umount needs to be run as root")
+	}
+
+	return stacker.UnmountImage(config, ctx.Args()[0])
+}
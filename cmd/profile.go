@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var profileFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "cpuprofile",
+		Usage: "write a pprof CPU profile of the run to this file",
+	},
+	cli.StringFlag{
+		Name:  "memprofile",
+		Usage: "write a pprof heap profile to this file when the run finishes",
+	},
+	cli.StringFlag{
+		Name:  "trace",
+		Usage: "write a runtime execution trace of the run to this file",
+	},
+}
+
+var (
+	cpuProfile *os.File
+	traceFile  *os.File
+	memProfile string
+)
+
+// startProfiling starts whatever profiling the flags asked for;
+// stopProfiling() finishes it.
+func startProfiling(ctx *cli.Context) error {
+	var err error
+	if ctx.String("cpuprofile") != "" {
+		cpuProfile, err = os.Create(ctx.String("cpuprofile"))
+		if err != nil {
+			return errors.Wrapf(err, "couldn't create cpu profile")
+		}
+
+		if err := pprof.StartCPUProfile(cpuProfile); err != nil {
+			return errors.Wrapf(err, "couldn't start cpu profile")
+		}
+	}
+
+	if ctx.String("trace") != "" {
+		traceFile, err = os.Create(ctx.String("trace"))
+		if err != nil {
+			return errors.Wrapf(err, "couldn't create trace")
+		}
+
+		if err := trace.Start(traceFile); err != nil {
+			return errors.Wrapf(err, "couldn't start trace")
+		}
+	}
+
+	memProfile = ctx.String("memprofile")
+	return nil
+}
+
+// stopProfiling writes out the profiles; since it is called on the way out,
+// errors are only logged.
+func stopProfiling() {
+	if cpuProfile != nil {
+		pprof.StopCPUProfile()
+		cpuProfile.Close()
+		cpuProfile = nil
+	}
+
+	if traceFile != nil {
+		trace.Stop()
+		traceFile.Close()
+		traceFile = nil
+	}
+
+	if memProfile != "" {
+		f, err := os.Create(memProfile)
+		if err != nil {
+			log.Infof("couldn't create memory profile: %v", err)
+			return
+		}
+		defer f.Close()
+
+		// get up to date statistics
+		runtime.GC()
+		if err := pprof.WriteHeapProfile(f); err != nil {
+			log.Infof("couldn't write memory profile: %v", err)
+		}
+		memProfile = ""
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"time"
+
+	"github.com/anuvu/stacker"
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/types"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var pruneRemoteCmd = cli.Command{
+	Name:   "prune-remote",
+	Usage:  "deletes old tags of the layers in one or more stacker yaml files from a publish destination",
+	Action: doPruneRemote,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "stacker-file, f",
+			Usage: "the input stackerfile",
+			Value: "stacker.yaml",
+		},
+		cli.StringFlag{
+			Name:  "stacker-file-pattern, p",
+			Usage: "regex pattern to use when searching for stackerfile paths",
+			Value: stackerFilePathRegex,
+		},
+		cli.StringFlag{
+			Name:  "search-dir, d",
+			Usage: "directory under which to search for stackerfiles",
+		},
+		cli.StringFlag{
+			Name:  "url",
+			Usage: "url of the publish destination to prune",
+		},
+		cli.StringFlag{
+			Name:  "username",
+			Usage: "username for the registry",
+		},
+		cli.StringFlag{
+			Name:  "password",
+			Usage: "password for the registry",
+		},
+		cli.StringSliceFlag{
+			Name:  "substitute",
+			Usage: "variable substitution in stackerfiles, FOO=bar format",
+		},
+		cli.StringSliceFlag{
+			Name:  "substitute-file",
+			Usage: "yaml file of substitutions (FOO: bar); --substitute and STACKER_SUBST_FOO take precedence",
+		},
+		cli.IntFlag{
+			Name:  "keep-last",
+			Usage: "number of most recently created tags to keep for each layer",
+			Value: 10,
+		},
+		cli.BoolFlag{
+			Name:  "keep-semver",
+			Usage: "keep all tags that are semantic versions (e.g. 1.2.3 or v1.2.3-squashfs)",
+		},
+		cli.IntFlag{
+			Name:  "untagged-older-than",
+			Usage: "also remove untagged blobs older than this many days (oci layouts only)",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "show what would be deleted without deleting it",
+		},
+	},
+	Before: beforePruneRemote,
+}
+
+func beforePruneRemote(ctx *cli.Context) error {
+	if len(ctx.String("search-dir")) != 0 {
+		err := validateFileSearchFlags(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	username := ctx.String("username")
+	password := ctx.String("password")
+	if (username == "") != (password == "") {
+		return errors.Errorf("supply both username and password, or none of them")
+	}
+
+	if len(ctx.String("url")) == 0 {
+		return errors.Errorf("--url is a mandatory argument for pruning")
+	}
+
+	if ctx.Int("keep-last") < 1 {
+		return errors.Errorf("--keep-last must be at least 1")
+	}
+
+	if ctx.Int("untagged-older-than") < 0 {
+		return errors.Errorf("--untagged-older-than can't be negative")
+	}
+
+	is, err := types.NewImageSource(ctx.String("url"))
+	if err != nil {
+		return err
+	}
+
+	if ctx.Int("untagged-older-than") != 0 && is.Type != types.OCILayer {
+		return errors.Errorf("--untagged-older-than is only supported for oci: destinations; registries don't list untagged manifests")
+	}
+
+	return nil
+}
+
+func doPruneRemote(ctx *cli.Context) error {
+	substitute, err := substitutions(ctx)
+	if err != nil {
+		return err
+	}
+
+	args := stacker.PruneRemoteArgs{
+		Config:     config,
+		Substitute: substitute,
+		Url:        ctx.String("url"),
+		Username:   ctx.String("username"),
+		Password:   ctx.String("password"),
+		Policy: stacker.RetentionPolicy{
+			KeepLast:   ctx.Int("keep-last"),
+			KeepSemver: ctx.Bool("keep-semver"),
+		},
+		UntaggedOlderThan: time.Duration(ctx.Int("untagged-older-than")) * 24 * time.Hour,
+		DryRun:            ctx.Bool("dry-run"),
+	}
+
+	var stackerFiles []string
+	if len(ctx.String("search-dir")) > 0 {
+		stackerFiles, err = lib.FindFiles(ctx.String("search-dir"), ctx.String("stacker-file-pattern"))
+		if err != nil {
+			return err
+		}
+	} else {
+		stackerFiles = []string{ctx.String("stacker-file")}
+	}
+
+	return stacker.PruneRemote(&args, stackerFiles)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/anuvu/stacker"
+	"github.com/anuvu/stacker/log"
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var pruneCmd = cli.Command{
+	Name:   "prune",
+	Usage:  "deletes old images from the OCI output, and the roots dir snapshots they were built from",
+	Action: doPrune,
+	Flags: []cli.Flag{
+		cli.DurationFlag{
+			Name:  "older-than",
+			Usage: "only delete images created longer ago than this (e.g. 720h)",
+		},
+		cli.StringFlag{
+			Name:  "match",
+			Usage: "only delete images whose tags match this glob pattern (e.g. 'nightly-*')",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "show what would be deleted without deleting it",
+		},
+	},
+	Before: beforePrune,
+}
+
+func beforePrune(ctx *cli.Context) error {
+	if ctx.Duration("older-than") <= 0 && ctx.String("match") == "" {
+		return errors.Errorf("refusing to prune everything, supply --older-than and/or --match")
+	}
+
+	if ctx.Duration("older-than") < 0 {
+		return errors.Errorf("--older-than can't be negative")
+	}
+
+	return nil
+}
+
+func doPrune(ctx *cli.Context) error {
+	s, err := stacker.NewStorage(config)
+	if err != nil {
+		return err
+	}
+	defer s.Detach()
+
+	args := stacker.PruneLocalArgs{
+		OlderThan: ctx.Duration("older-than"),
+		Match:     ctx.String("match"),
+		DryRun:    ctx.Bool("dry-run"),
+	}
+
+	reclaimed, err := stacker.PruneLocal(config, s, &args)
+	if err != nil {
+		return err
+	}
+
+	if !args.DryRun {
+		log.Infof("reclaimed %s", humanize.IBytes(uint64(reclaimed)))
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/anuvu/stacker"
 	"github.com/anuvu/stacker/lib"
 	"github.com/anuvu/stacker/types"
@@ -47,19 +49,36 @@ var publishCmd = cli.Command{
 			Name:  "substitute",
 			Usage: "variable substitution in stackerfiles, FOO=bar format",
 		},
+		cli.StringSliceFlag{
+			Name:  "substitute-file",
+			Usage: "yaml file of substitutions (FOO: bar); --substitute and STACKER_SUBST_FOO take precedence",
+		},
 		cli.BoolFlag{
 			Name:  "show-only",
 			Usage: "show the images to be published without actually publishing them",
 		},
 		cli.BoolFlag{
 			Name:  "force",
-			Usage: "force publishing the images present in the OCI layout even if they should be rebuilt",
+			Usage: "force publishing the images present in the OCI layout even if they should be rebuilt, or overwrite existing tags with --no-overwrite",
+		},
+		cli.BoolFlag{
+			Name:  "always-push",
+			Usage: "push tags even if the destination already has the same manifest",
+		},
+		cli.BoolFlag{
+			Name:  "no-overwrite",
+			Usage: "fail if a destination tag already exists with a different manifest",
 		},
 		cli.StringSliceFlag{
 			Name:  "layer-type",
 			Usage: "set the output layer type (supported values: tar, squashfs); can be supplied multiple times",
 			Value: &cli.StringSlice{"tar"},
 		},
+		cli.StringFlag{
+			Name:  "output-json",
+			Usage: "write a json summary of the published images (destinations, digests, durations) to this file",
+		},
+		ciAnnotationsFlag,
 	},
 	Before: beforePublish,
 }
@@ -88,7 +107,7 @@ func beforePublish(ctx *cli.Context) error {
 		return errors.Errorf("--url is a mandatory argument for publishing")
 	}
 
-	return nil
+	return validateCIAnnotationsFlag(ctx)
 }
 
 func doPublish(ctx *cli.Context) error {
@@ -97,17 +116,24 @@ func doPublish(ctx *cli.Context) error {
 		return err
 	}
 
+	substitute, err := substitutions(ctx)
+	if err != nil {
+		return err
+	}
+
 	args := stacker.PublishArgs{
-		Config:     config,
-		ShowOnly:   ctx.Bool("show-only"),
-		Substitute: ctx.StringSlice("substitute"),
-		Tags:       ctx.StringSlice("tag"),
-		Url:        ctx.String("url"),
-		Username:   ctx.String("username"),
-		Password:   ctx.String("password"),
-		Force:      ctx.Bool("force"),
-		Progress:   shouldShowProgress(ctx),
-		LayerTypes: layerTypes,
+		Config:      config,
+		ShowOnly:    ctx.Bool("show-only"),
+		Substitute:  substitute,
+		Tags:        ctx.StringSlice("tag"),
+		Url:         ctx.String("url"),
+		Username:    ctx.String("username"),
+		Password:    ctx.String("password"),
+		Force:       ctx.Bool("force"),
+		Progress:    shouldShowProgress(ctx),
+		LayerTypes:  layerTypes,
+		AlwaysPush:  ctx.Bool("always-push"),
+		NoOverwrite: ctx.Bool("no-overwrite"),
 	}
 
 	var stackerFiles []string
@@ -123,5 +149,7 @@ func doPublish(ctx *cli.Context) error {
 	}
 
 	publisher := stacker.NewPublisher(&args)
-	return publisher.PublishMultiple(stackerFiles)
+	start := time.Now()
+	err = publisher.PublishMultiple(stackerFiles)
+	return writeReport(ctx, publisher.Report(), start, err)
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/anuvu/stacker"
 	"github.com/anuvu/stacker/lib"
 	"github.com/urfave/cli"
@@ -51,7 +53,7 @@ func beforeRecursiveBuild(ctx *cli.Context) error {
 		return err
 	}
 
-	return nil
+	return validateCIAnnotationsFlag(ctx)
 }
 
 func doRecursiveBuild(ctx *cli.Context) error {
@@ -66,5 +68,8 @@ func doRecursiveBuild(ctx *cli.Context) error {
 	}
 
 	builder := stacker.NewBuilder(&args)
-	return builder.BuildMultiple(stackerFiles)
+	defer cancelOnSignal(builder)()
+	start := time.Now()
+	err = builder.BuildMultiple(stackerFiles)
+	return writeReport(ctx, builder.Report(), start, err)
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/anuvu/stacker"
+	"github.com/urfave/cli"
+)
+
+var statCmd = cli.Command{
+	Name:         "stat",
+	Usage:        "prints the metadata of a file in an image without extracting it",
+	Action:       doStat,
+	BashComplete: completeOCITagPaths,
+	ArgsUsage: `<tag>:<path>
+
+<tag> is the tag of an image in the OCI output.
+
+<path> is the path (relative to /) in the image's rootfs.`,
+}
+
+func doStat(ctx *cli.Context) error {
+	tag, file, err := splitImagePath(ctx.Args().First())
+	if err != nil {
+		return err
+	}
+
+	info, err := stacker.StatImageFile(config, tag, file)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("path: /%s\n", info.Path)
+	fmt.Printf("mode: %s (%04o)\n", info.Mode, info.Mode.Perm())
+	fmt.Printf("owner: %d:%d\n", info.Uid, info.Gid)
+	fmt.Printf("size: %d\n", info.Size)
+	if info.Linkname != "" {
+		fmt.Printf("link: %s\n", info.Linkname)
+	}
+	fmt.Printf("layer: %s\n", info.Layer)
+
+	names := []string{}
+	for name := range info.Xattrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("xattr: %s=%s\n", name, info.Xattrs[name])
+	}
+
+	return nil
+}
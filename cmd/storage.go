@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/anuvu/stacker"
+	"github.com/anuvu/stacker/log"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var storageCmd = cli.Command{
+	Name:  "storage",
+	Usage: "manage stacker's storage",
+	Subcommands: []cli.Command{
+		cli.Command{
+			Name:      "move",
+			Usage:     "moves the roots dir somewhere else",
+			ArgsUsage: "<new roots dir>",
+			Action:    doStorageMove,
+		},
+	},
+}
+
+func doStorageMove(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.Errorf("wrong number of args for move")
+	}
+
+	if err := stacker.MoveRootsDir(config, ctx.Args()[0]); err != nil {
+		return err
+	}
+
+	log.Infof("moved %s to %s; point rootfs_dir (or --roots-dir) at it to use it", config.RootFSDir, ctx.Args()[0])
+	return nil
+}
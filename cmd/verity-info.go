@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/anuvu/stacker"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+var verityInfoCmd = cli.Command{
+	Name:         "verity-info",
+	Usage:        "prints the dm-verity root hashes of a squashfs image's layers, and their chain",
+	Action:       doVerityInfo,
+	BashComplete: completeOCITags,
+	ArgsUsage: `<tag>
+
+<tag> is the tag of an image in the OCI output, built with squashfs_verity.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the hashes as json, instead of shell variable assignments",
+		},
+	},
+}
+
+func doVerityInfo(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return errors.Errorf("usage: stacker verity-info <tag>")
+	}
+
+	info, err := stacker.ImageVerityInfo(config, ctx.Args().First())
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("json") {
+		content, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		fmt.Println(string(content))
+		return nil
+	}
+
+	fmt.Print(info.Env())
+	return nil
+}
@@ -8,15 +8,23 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"sort"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/anuvu/stacker/agent"
 	"github.com/anuvu/stacker/container"
 	"github.com/anuvu/stacker/embed-exec"
+	"github.com/anuvu/stacker/lib"
 	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/mount"
+	"github.com/anuvu/stacker/overlay"
 	"github.com/anuvu/stacker/types"
 	"github.com/lxc/go-lxc"
+	"github.com/lxc/lxd/shared"
 	"github.com/pkg/errors"
+	"golang.org/x/term"
 )
 
 const (
@@ -27,8 +35,37 @@ const (
 type Container struct {
 	sc types.StackerConfig
 	c  *lxc.Container
+
+	// stackerMounted is whether bindStacker() has been called
+	stackerMounted bool
+
+	// syslog receives what the build's processes log to /dev/log
+	syslog *syslogSink
+
+	// hostFilesDir has the copies of the hostFiles that are mounted in
+	// the container
+	hostFilesDir string
+
+	storage types.Storage
+	// rootfsOptions are the lxc.rootfs.options the rootfs is mounted with
+	rootfsOptions []string
+	// readOnly is whether the rootfs is mounted read only, see
+	// SetupWritablePaths()
+	readOnly bool
+	// mountpoints are where bindMount() mounted things
+	mountpoints []string
+
+	// agentDir is mounted at /stacker-agent, for the agents' sockets
+	agentDir string
 }
 
+// hostFiles are the host's files that are injected into containers, so
+// that their network works like the host's. They are bind mounted from
+// copies, so that builds can't change the host's, and the empty files lxc
+// creates to mount them on are removed after each run, so the host's network
+// config doesn't leak into images that don't have these files.
+var hostFiles = []string{"/etc/resolv.conf", "/etc/hosts"}
+
 func NewContainer(sc types.StackerConfig, storage types.Storage, name string) (*Container, error) {
 	if !lxc.VersionAtLeast(2, 1, 0) {
 		return nil, errors.Errorf("stacker requires liblxc >= 2.1.0")
@@ -38,7 +75,7 @@ func NewContainer(sc types.StackerConfig, storage types.Storage, name string) (*
 	if err != nil {
 		return nil, err
 	}
-	c := &Container{sc: sc, c: lxcC}
+	c := &Container{sc: sc, c: lxcC, storage: storage}
 
 	if err := c.c.SetLogLevel(lxc.TRACE); err != nil {
 		return nil, err
@@ -108,12 +145,26 @@ func NewContainer(sc types.StackerConfig, storage types.Storage, name string) (*
 		return nil, err
 	}
 
-	err = c.bindMount("/sys", "/sys", "")
+	sysOpts := ""
+	if sc.HardenedBuilds {
+		if err := c.harden(); err != nil {
+			return nil, err
+		}
+		sysOpts = "ro"
+	}
+
+	err = c.bindMount("/sys", "/sys", sysOpts)
 	if err != nil {
 		return nil, err
 	}
 
-	err = c.bindMount("/etc/resolv.conf", "/etc/resolv.conf", "")
+	if sc.HardenedBuilds {
+		if err := c.readOnlySysMounts(); err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.injectHostFiles()
 	if err != nil {
 		return nil, err
 	}
@@ -128,6 +179,16 @@ func NewContainer(sc types.StackerConfig, storage types.Storage, name string) (*
 		return nil, err
 	}
 
+	// unprivileged builds can't use the trusted. xattrs overlay normally
+	// keeps its metadata in, so have it use (and honor the whiteouts in)
+	// the user. ones instead.
+	if shared.RunningInUserNS() && storage.Name() == "overlay" && overlay.SupportsUserxattr() {
+		err = c.setRootfsOption("userxattr")
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// liblxc inserts an apparmor profile if we don't set one by default.
 	// however, since we may be statically linked with no packaging
 	// support, the host may not have this default profile. let's check for
@@ -151,6 +212,86 @@ func NewContainer(sc types.StackerConfig, storage types.Storage, name string) (*
 	return c, nil
 }
 
+// hardenedCaps are the capabilities builds keep in hardened mode: what
+// package managers and the like need to install files with the right owners
+// and modes, and nothing that reaches outside of the container.
+var hardenedCaps = []string{
+	"audit_write", "chown", "dac_override", "fowner", "fsetid", "kill",
+	"mknod", "net_bind_service", "setfcap", "setgid", "setpcap", "setuid",
+	"sys_chroot",
+}
+
+// maskedProcFiles and maskedProcDirs are the parts of /proc that leak
+// information about (or allow poking at) the host, which hardened builds
+// don't see.
+var (
+	maskedProcFiles = []string{"kcore", "keys", "latency_stats", "sched_debug", "timer_list", "timer_stats"}
+	maskedProcDirs  = []string{"acpi", "scsi"}
+)
+
+// harden sets up the container for running semi-trusted stacker files:
+// setuid binaries don't work, only the capabilities in hardenedCaps are
+// kept and the information leaking parts of /proc are masked. (/sys is
+// mounted read only by the caller, see readOnlySysMounts.)
+func (c *Container) harden() error {
+	configs := map[string]string{
+		"lxc.no_new_privs": "1",
+		"lxc.cap.keep":     strings.Join(hardenedCaps, " "),
+	}
+	if err := c.setConfigs(configs); err != nil {
+		return err
+	}
+
+	for _, f := range maskedProcFiles {
+		if err := c.setConfig("lxc.mount.entry", fmt.Sprintf("/dev/null proc/%s none bind,optional 0 0", f)); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range maskedProcDirs {
+		if err := c.setConfig("lxc.mount.entry", fmt.Sprintf("tmpfs proc/%s tmpfs ro,optional 0 0", d)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readOnlySysMounts makes the mounts under the host's /sys (cgroups,
+// securityfs, ...) read only too: the ro of the /sys rbind only applies to
+// /sys itself, not to the submounts it brings along.
+func (c *Container) readOnlySysMounts() error {
+	mounts, err := mount.ParseMounts("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+
+	targets := map[string]bool{}
+	for _, m := range mounts {
+		// mountinfo escapes whitespace in paths, which lxc.mount.entry
+		// can't express either; nothing standard under /sys has any
+		if strings.HasPrefix(m.Target, "/sys/") && !strings.Contains(m.Target, `\`) {
+			targets[m.Target] = true
+		}
+	}
+
+	// sorted, so parents are remounted before their children
+	sorted := make([]string, 0, len(targets))
+	for t := range targets {
+		sorted = append(sorted, t)
+	}
+	sort.Strings(sorted)
+
+	for _, t := range sorted {
+		val := fmt.Sprintf("%s %s none bind,ro,optional 0 0", t, strings.TrimPrefix(t, "/"))
+		if err := c.setConfig("lxc.mount.entry", val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (c *Container) bindMount(source string, dest string, extraOpts string) error {
 	createOpt := "create=dir"
 	stat, err := os.Stat(source)
@@ -159,7 +300,152 @@ func (c *Container) bindMount(source string, dest string, extraOpts string) erro
 	}
 
 	val := fmt.Sprintf("%s %s none rbind,%s,%s 0 0", source, strings.TrimPrefix(dest, "/"), createOpt, extraOpts)
-	return c.setConfig("lxc.mount.entry", val)
+	if err := c.setConfig("lxc.mount.entry", val); err != nil {
+		return err
+	}
+
+	c.mountpoints = append(c.mountpoints, path.Clean(dest))
+	return nil
+}
+
+// injectHostFiles bind mounts copies of the hostFiles the host has into the
+// container.
+func (c *Container) injectHostFiles() error {
+	dir, err := ioutil.TempDir(c.sc.StackerDir, "host-files-")
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create host files dir")
+	}
+	c.hostFilesDir = dir
+
+	for _, f := range hostFiles {
+		content, err := ioutil.ReadFile(f)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "couldn't read %s", f)
+		}
+
+		copied := path.Join(dir, path.Base(f))
+		if err := ioutil.WriteFile(copied, content, 0644); err != nil {
+			return errors.Wrapf(err, "couldn't copy %s", f)
+		}
+
+		if err := c.bindMount(copied, f, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// missingMountpoints returns the places the hostFiles would be in the
+// filesystem of the container name in roots, if they aren't there (yet).
+// Like the /stacker mountpoint, these are in "rootfs" for btrfs and
+// "overlay" for the overlay backend.
+func missingMountpoints(roots string, name string) []string {
+	missing := []string{}
+	for _, dir := range []string{"rootfs", "overlay"} {
+		for _, f := range hostFiles {
+			p := path.Join(roots, name, dir, f)
+			if _, err := os.Lstat(p); os.IsNotExist(err) {
+				missing = append(missing, p)
+			}
+		}
+	}
+
+	return missing
+}
+
+// removeMountpoints removes the empty files lxc created at the missing
+// mountpoints.
+func removeMountpoints(missing []string) {
+	for _, p := range missing {
+		fi, err := os.Lstat(p)
+		if err != nil || !fi.Mode().IsRegular() || fi.Size() != 0 {
+			continue
+		}
+
+		log.Debugf("removing mountpoint %s", p)
+		if err := os.Remove(p); err != nil {
+			log.Infof("WARNING: couldn't remove mountpoint %s: %v", p, err)
+		}
+	}
+}
+
+// bindStacker bind mounts this stacker binary at /static-stacker, for running
+// internal-go subcommands in the container.
+func (c *Container) bindStacker() error {
+	if c.stackerMounted {
+		return nil
+	}
+
+	binary, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return errors.Wrapf(err, "couldn't find executable for bind mount")
+	}
+
+	if err := c.bindMount(binary, "/static-stacker", ""); err != nil {
+		return err
+	}
+
+	c.stackerMounted = true
+	return nil
+}
+
+func (c *Container) setRootfsOption(option string) error {
+	c.rootfsOptions = append(c.rootfsOptions, option)
+	return c.setConfig("lxc.rootfs.options", strings.Join(c.rootfsOptions, ","))
+}
+
+// stackerMountpoints are where stacker mounts its own things in containers,
+// and whether they are directories.
+var stackerMountpoints = map[string]bool{
+	"/stacker":        true,
+	"/stacker-agent":  true,
+	"/static-stacker": false,
+}
+
+// createMountpoints creates the stackerMountpoints and hostFiles the rootfs
+// doesn't have, where what's written to it ends up, and returns the ones it
+// created. lxc creates them itself, except in a read only rootfs.
+func (c *Container) createMountpoints() ([]string, error) {
+	mountpoints := map[string]bool{}
+	for mountpoint, dir := range stackerMountpoints {
+		mountpoints[mountpoint] = dir
+	}
+	for _, f := range hostFiles {
+		mountpoints[f] = false
+	}
+
+	created := []string{}
+	rootfs := c.storage.TarExtractLocation(c.c.Name())
+	for mountpoint, dir := range mountpoints {
+		p := path.Join(rootfs, mountpoint)
+		if _, err := os.Lstat(p); err == nil {
+			continue
+		}
+
+		if dir {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				return created, errors.Wrapf(err, "couldn't create mountpoint %s", mountpoint)
+			}
+			created = append(created, p)
+			continue
+		}
+
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			return created, errors.Wrapf(err, "couldn't create mountpoint %s", mountpoint)
+		}
+
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return created, errors.Wrapf(err, "couldn't create mountpoint %s", mountpoint)
+		}
+		f.Close()
+		created = append(created, p)
+	}
+
+	return created, nil
 }
 
 func (c *Container) setConfigs(config map[string]string) error {
@@ -208,6 +494,42 @@ func (c *Container) containerError(theErr error, msg string) error {
 }
 
 func (c *Container) Execute(args string, stdin io.Reader) error {
+	return c.execute(args, stdin, nil)
+}
+
+// ExecuteInteractive runs args in the container with stacker's stdin. If
+// that isn't a terminal (e.g. in CI), the container gets a pty of its own
+// that stdin is copied to, since some programs (installers, debuggers) refuse
+// to run without one.
+func (c *Container) ExecuteInteractive(args string) error {
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		return c.Execute(args, os.Stdin)
+	}
+
+	ptmx, tty, err := openPty()
+	if err != nil {
+		return err
+	}
+	defer ptmx.Close()
+
+	go io.Copy(ptmx, os.Stdin)
+
+	copied := make(chan struct{})
+	go func() {
+		// this ends with EIO once the container's side is closed
+		io.Copy(os.Stdout, ptmx)
+		close(copied)
+	}()
+
+	err = c.execute(args, nil, tty)
+	tty.Close()
+	<-copied
+	return err
+}
+
+// execute runs args in the container. If tty isn't nil, it is the
+// container's stdio and controlling terminal, and stdin is ignored.
+func (c *Container) execute(args string, stdin io.Reader, tty *os.File) error {
 	if err := c.setConfig("lxc.execute.cmd", args); err != nil {
 		return err
 	}
@@ -223,12 +545,32 @@ func (c *Container) Execute(args string, stdin io.Reader) error {
 		return err
 	}
 
+	if lxcConfig, err := ioutil.ReadFile(f.Name()); err == nil {
+		log.SubsystemDebugf(log.Container, "lxc config for %s:\n%s", c.c.Name(), string(lxcConfig))
+	}
+
 	// we want to be sure to remove the /stacker from the generated
 	// filesystem after execution. TODO: parameterize this by storage
 	// backend? it will always be "rootfs" for btrfs and "overlay" for the
 	// overlay backend. Maybe this shouldn't even live here.
 	defer os.Remove(path.Join(c.sc.RootFSDir, c.c.Name(), "rootfs", "stacker"))
 	defer os.Remove(path.Join(c.sc.RootFSDir, c.c.Name(), "overlay", "stacker"))
+	if c.stackerMounted {
+		defer os.Remove(path.Join(c.sc.RootFSDir, c.c.Name(), "rootfs", "static-stacker"))
+		defer os.Remove(path.Join(c.sc.RootFSDir, c.c.Name(), "overlay", "static-stacker"))
+	}
+	defer removeMountpoints(missingMountpoints(c.sc.RootFSDir, c.c.Name()))
+	if c.readOnly {
+		created, err := c.createMountpoints()
+		defer func() {
+			for _, p := range created {
+				os.Remove(p)
+			}
+		}()
+		if err != nil {
+			return err
+		}
+	}
 
 	cmd, cleanup, err := embed_exec.GetCommand(
 		embeddedFS,
@@ -248,7 +590,7 @@ func (c *Container) Execute(args string, stdin io.Reader) error {
 
 	// If this is non-interactive, we're going to setsid() later, so we
 	// need to make sure we capture the output somehow.
-	if stdin == nil {
+	if stdin == nil && tty == nil {
 		reader, writer := io.Pipe()
 		defer writer.Close()
 
@@ -265,6 +607,13 @@ func (c *Container) Execute(args string, stdin io.Reader) error {
 
 	}
 
+	if tty != nil {
+		cmd.Stdin = tty
+		cmd.Stdout = tty
+		cmd.Stderr = tty
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	}
+
 	signals := make(chan os.Signal)
 	signal.Notify(signals)
 	done := make(chan bool)
@@ -305,6 +654,145 @@ func (c *Container) Execute(args string, stdin io.Reader) error {
 	return c.containerError(cmdErr, "execute failed")
 }
 
+// Agent is a stacker agent running in a container; Stop() must be called when
+// done with it.
+type Agent struct {
+	*agent.Client
+	c    *Container
+	dir  string
+	done chan error
+}
+
+// setupAgentDir creates the dir the agents' sockets are in, and mounts it at
+// /stacker-agent. It's only done once per container, since every agent it
+// runs can use the same one. The dir is a short temporary one, since unix
+// socket paths are limited to 108 bytes and StackerDir can be anywhere.
+func (c *Container) setupAgentDir() (string, error) {
+	if c.agentDir != "" {
+		return c.agentDir, nil
+	}
+
+	dir, err := ioutil.TempDir("", "stacker-agent-")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	// the steps may not run as root
+	if err := os.Chmod(dir, 0755); err != nil {
+		os.RemoveAll(dir)
+		return "", errors.WithStack(err)
+	}
+
+	if err := c.bindMount(dir, "/stacker-agent", ""); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	c.agentDir = dir
+	return dir, nil
+}
+
+// StartAgent runs the stacker agent in the container, and connects to it.
+func (c *Container) StartAgent() (*Agent, error) {
+	dir, err := c.setupAgentDir()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.bindStacker(); err != nil {
+		return nil, err
+	}
+
+	// the socket is how it's known that the agent is listening, so a
+	// previous agent's mustn't be there
+	socket := path.Join(dir, "agent.sock")
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return nil, errors.WithStack(err)
+	}
+
+	a := &Agent{c: c, dir: dir, done: make(chan error, 1)}
+	go func() {
+		a.done <- c.Execute("/static-stacker internal-go agent /stacker-agent/agent.sock", nil)
+	}()
+
+	for start := time.Now(); ; time.Sleep(50 * time.Millisecond) {
+		select {
+		case err := <-a.done:
+			a.cleanup()
+			if err == nil {
+				err = errors.Errorf("exited before listening")
+			}
+			return nil, errors.Wrapf(err, "couldn't start agent")
+		default:
+		}
+
+		if _, err := os.Stat(socket); err == nil {
+			break
+		}
+
+		if time.Since(start) > 30*time.Second {
+			syscall.Kill(c.c.InitPid(), syscall.SIGKILL)
+			<-a.done
+			a.cleanup()
+			return nil, errors.Errorf("timed out waiting for agent to start")
+		}
+	}
+
+	a.Client, err = agent.Dial(socket)
+	if err != nil {
+		a.Client = nil
+		a.Stop()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *Agent) cleanup() {
+	// the dir is the container's, and removed when it's closed
+	os.Remove(path.Join(a.dir, "agent.sock"))
+	for _, dir := range []string{"rootfs", "overlay"} {
+		os.Remove(path.Join(a.c.sc.RootFSDir, a.c.c.Name(), dir, "stacker-agent"))
+	}
+}
+
+// Stop shuts the agent down, and waits for its container to exit. It is safe
+// to call more than once.
+func (a *Agent) Stop() error {
+	if a.done == nil {
+		return nil
+	}
+
+	var err error
+	if a.Client != nil {
+		err = a.Client.Shutdown()
+		if err != nil {
+			// it won't be listening any more, so make sure it
+			// doesn't hang around
+			syscall.Kill(a.c.c.InitPid(), syscall.SIGKILL)
+		}
+	}
+
+	if execErr := <-a.done; err == nil {
+		err = execErr
+	}
+	a.done = nil
+	a.cleanup()
+	return err
+}
+
+// SetupBaseEnv sets the environment of the container to env, the "K=V" Env
+// of the base image's config; SetupLayerConfig() can override it.
+func (c *Container) SetupBaseEnv(env []string) error {
+	for _, kv := range env {
+		if err := c.setConfig("lxc.environment", kv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (c *Container) SetupLayerConfig(l *types.Layer, name string) error {
 	env, err := l.BuildEnvironment(name)
 	if err != nil {
@@ -331,32 +819,252 @@ func (c *Container) SetupLayerConfig(l *types.Layer, name string) error {
 		}
 	}
 
+	writable, err := l.ParseWritablePaths()
+	if err != nil {
+		return err
+	}
+
+	// before the binds and caches, which may be in them
+	if err := c.SetupWritablePaths(name, writable); err != nil {
+		return err
+	}
+
 	binds, err := l.ParseBinds()
 	if err != nil {
 		return err
 	}
 
-	for source, target := range binds {
-		err = c.bindMount(source, target, "")
+	if len(binds) > 0 && c.sc.HardenedBuilds {
+		return types.KindErrorf(types.PolicyError, "hardened builds can't bind mount host paths, but %s has binds", c.c.Name())
+	}
+
+	for _, bind := range binds {
+		err = c.bindMount(bind.Source, bind.Dest, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	cacheDirs, err := l.ParseCacheDirs()
+	if err != nil {
+		return err
+	}
+
+	// since these are mounted over the rootfs, what's written to them
+	// isn't part of the layer
+	for _, dir := range cacheDirs {
+		source := c.sc.RunCacheDir(name, dir)
+		if err := os.MkdirAll(source, 0755); err != nil {
+			return errors.Wrapf(err, "couldn't create cache for %s", dir)
+		}
+
+		log.Debugf("mounting cache %s at %s", source, dir)
+		err = c.bindMount(source, dir, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetupWritablePaths mounts the rootfs read only, except for the directories
+// in writable, so that a build can only change what its layer says it does.
+// The rest of the rootfs has to have the mountpoints of the binds and caches
+// already, since they can't be created in it.
+func (c *Container) SetupWritablePaths(name string, writable []string) error {
+	if len(writable) == 0 {
+		return nil
+	}
+
+	if err := c.setRootfsOption("ro"); err != nil {
+		return err
+	}
+	c.readOnly = true
+
+	for _, dir := range writable {
+		entry, err := c.storage.GetLXCWritableMount(name, dir)
 		if err != nil {
 			return err
 		}
+
+		if err := c.setConfig("lxc.mount.entry", entry); err != nil {
+			return err
+		}
+	}
+
+	log.Infof("%s: only %s are writable", name, strings.Join(writable, ", "))
+	return nil
+}
+
+// Harden runs the internal-go harden command in the container, which does h
+// to its rootfs, or only to the writable paths if it's read only. What's
+// mounted in the container is left alone.
+func (c *Container) Harden(h *types.Harden, writable []string) error {
+	if err := c.bindStacker(); err != nil {
+		return err
+	}
+
+	args := "/static-stacker internal-go harden"
+	if h.StripSetuid {
+		args += " --strip-setuid"
+	}
+	for _, p := range h.KeepSetuid {
+		args += " --keep-setuid " + p
+	}
+	if h.RootOwned {
+		args += " --root-owned"
+	}
+
+	// lxc mounts these itself
+	for _, p := range append([]string{"/proc", "/dev"}, c.mountpoints...) {
+		args += " --skip " + p
+	}
+
+	if c.readOnly {
+		args += " " + strings.Join(writable, " ")
+	} else {
+		args += " /"
+	}
+
+	return c.Execute(args, nil)
+}
+
+// AddUsers runs the internal-go add-users command in the container, to add
+// users to its rootfs.
+func (c *Container) AddUsers(users []types.User) error {
+	if err := c.bindStacker(); err != nil {
+		return err
+	}
+
+	args := "/static-stacker internal-go add-users"
+	for _, u := range users {
+		user := lib.User{Name: u.Name, UID: *u.UID, Group: u.Group, GID: *u.GID, Home: u.Home, Shell: u.Shell, Groups: u.Groups}
+		args += " " + user.String()
+	}
+
+	return c.Execute(args, nil)
+}
+
+// CaptureSyslog makes what the container's processes send to /dev/log part of
+// stacker's log, until the container is closed.
+func (c *Container) CaptureSyslog() error {
+	if c.syslog != nil {
+		return nil
+	}
+
+	sink, err := newSyslogSink()
+	if err != nil {
+		return err
+	}
+
+	if err := c.bindMount(sink.socket, "/dev/log", ""); err != nil {
+		sink.Close()
+		return err
 	}
 
+	c.syslog = sink
 	return nil
 }
 
+// Kill kills whatever is running in the container, if anything is.
+func (c *Container) Kill() error {
+	pid := c.c.InitPid()
+	if pid <= 0 {
+		return nil
+	}
+
+	return errors.Wrapf(syscall.Kill(pid, syscall.SIGKILL), "couldn't kill %s", c.c.Name())
+}
+
 func (c *Container) Close() {
+	if c.syslog != nil {
+		c.syslog.Close()
+	}
+	if c.hostFilesDir != "" {
+		os.RemoveAll(c.hostFilesDir)
+	}
+	if c.agentDir != "" {
+		os.RemoveAll(c.agentDir)
+	}
 	c.c.Release()
 }
 
+// buildContainer returns the lxc container name's build runs in, without
+// configuring it: it is only for looking at (or into) a build in progress.
+func buildContainer(sc types.StackerConfig, name string) (*lxc.Container, error) {
+	if !lxc.VersionAtLeast(2, 1, 0) {
+		return nil, errors.Errorf("stacker requires liblxc >= 2.1.0")
+	}
+
+	return lxc.NewContainer(name, sc.RootFSDir)
+}
+
+// BuildRunning returns true if name is being built, i.e. its build container
+// is running.
+func BuildRunning(sc types.StackerConfig, name string) bool {
+	if name == "" {
+		return false
+	}
+
+	c, err := buildContainer(sc, name)
+	if err != nil {
+		return false
+	}
+	defer c.Release()
+
+	return c.Running()
+}
+
+// AttachToBuild runs args in the build container of name, with the same
+// environment the build's steps have, and returns their exit status. This has
+// to be called from outside of the user namespace stacker builds in, since
+// the build's namespaces can't be joined from another one.
+func AttachToBuild(sc types.StackerConfig, name string, args []string) (int, error) {
+	c, err := buildContainer(sc, name)
+	if err != nil {
+		return -1, err
+	}
+	defer c.Release()
+
+	if !c.Running() {
+		return -1, errors.Errorf("%s isn't being built", name)
+	}
+
+	opts := lxc.DefaultAttachOptions
+	opts.ClearEnv = true
+	opts.Env = []string{fmt.Sprintf("PATH=%s", ReasonableDefaultPath)}
+
+	environ, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/environ", c.InitPid()))
+	if err == nil {
+		opts.Env = strings.Split(strings.TrimRight(string(environ), "\x00"), "\x00")
+	} else {
+		log.Debugf("couldn't read the build's environment: %v", err)
+	}
+
+	if term := os.Getenv("TERM"); term != "" {
+		opts.Env = append(opts.Env, fmt.Sprintf("TERM=%s", term))
+	}
+
+	status, err := c.RunCommandStatus(args, opts)
+	if err != nil {
+		return -1, errors.Wrapf(err, "couldn't attach to %s", name)
+	}
+
+	return status, nil
+}
+
 // GenerateShellForRunning generates a shell script to run inside the
 // container, and writes it to the contianer. It checks that the script already
 // have a shebang? If so, it leaves it as is, otherwise it prepends a shebang.
 func GenerateShellForRunning(rootfs string, cmd []string, outFile string) error {
+	return ioutil.WriteFile(outFile, []byte(runScript(cmd)), 0755)
+}
+
+func runScript(cmd []string) string {
 	shebangLine := "#!/bin/sh -xe\n"
 	if strings.HasPrefix(cmd[0], "#!") {
 		shebangLine = ""
 	}
-	return ioutil.WriteFile(outFile, []byte(shebangLine+strings.Join(cmd, "\n")+"\n"), 0755)
+	return shebangLine + strings.Join(cmd, "\n") + "\n"
 }
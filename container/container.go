@@ -4,13 +4,16 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
 	"strconv"
+	"syscall"
 
 	"github.com/anuvu/stacker/log"
 	"github.com/anuvu/stacker/types"
 	"github.com/lxc/lxd/shared/idmap"
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
 func ResolveCurrentIdmapSet() (*idmap.IdmapSet, error) {
@@ -95,7 +98,7 @@ func RunInUserns(idmapSet *idmap.IdmapSet, userCmd []string, msg string) error {
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	err := cmd.Run()
+	err := runCancellable(cmd)
 	if err != nil {
 		if msg != "" {
 			return errors.Wrapf(err, msg)
@@ -106,6 +109,50 @@ func RunInUserns(idmapSet *idmap.IdmapSet, userCmd []string, msg string) error {
 	return nil
 }
 
+// runCancellable runs cmd, a stacker that does the actual work, so that it can
+// be cancelled. ^C sends SIGINT to everything in the foreground, cmd
+// included, so this ignores it rather than exiting before cmd has cleaned up;
+// SIGTERM is passed on to cmd. A stacker in a user namespace is under
+// lxc-usernsexec, which SIGTERM kills, so it gets SIGTERM when its parent
+// dies (see SetParentDeathSignal()).
+func runCancellable(cmd *exec.Cmd) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	go func() {
+		for sg := range signals {
+			if sg == syscall.SIGTERM {
+				cmd.Process.Signal(sg)
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	close(signals)
+	return err
+}
+
+// SetParentDeathSignal makes the kernel send this stacker SIGTERM when its
+// parent dies, so that a stacker in a user namespace is cancelled when the
+// stacker that started it is.
+func SetParentDeathSignal() error {
+	if err := unix.Prctl(unix.PR_SET_PDEATHSIG, uintptr(unix.SIGTERM), 0, 0, 0); err != nil {
+		return errors.Wrapf(err, "couldn't set parent death signal")
+	}
+
+	// the parent may have died before it was set
+	if os.Getppid() == 1 {
+		return errors.Errorf("the stacker that started this one exited")
+	}
+
+	return nil
+}
+
 // A wrapper which runs things in a userns if we're an unprivileged user with
 // an idmap, or runs things on the host if we're root and don't.
 func MaybeRunInUserns(userCmd []string, msg string) error {
@@ -117,7 +164,7 @@ func MaybeRunInUserns(userCmd []string, msg string) error {
 		cmd.Stdin = os.Stdin
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
-		return errors.Wrapf(cmd.Run(), msg)
+		return errors.Wrapf(runCancellable(cmd), msg)
 	}
 
 	idmapSet, err := ResolveCurrentIdmapSet()
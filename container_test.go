@@ -0,0 +1,36 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveMountpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	roots, err := ioutil.TempDir("", "stacker_mountpoints_test")
+	assert.NoError(err)
+	defer os.RemoveAll(roots)
+
+	// the image has its own /etc/hosts, but no /etc/resolv.conf
+	etc := path.Join(roots, "layer", "rootfs", "etc")
+	assert.NoError(os.MkdirAll(etc, 0755))
+	assert.NoError(ioutil.WriteFile(path.Join(etc, "hosts"), []byte("127.0.0.1 localhost\n"), 0644))
+
+	missing := missingMountpoints(roots, "layer")
+	assert.Contains(missing, path.Join(etc, "resolv.conf"))
+	assert.NotContains(missing, path.Join(etc, "hosts"))
+
+	// lxc creates an empty file to mount resolv.conf on
+	assert.NoError(ioutil.WriteFile(path.Join(etc, "resolv.conf"), nil, 0644))
+	removeMountpoints(missing)
+
+	_, err = os.Stat(path.Join(etc, "resolv.conf"))
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(path.Join(etc, "hosts"))
+	assert.NoError(err)
+}
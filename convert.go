@@ -0,0 +1,186 @@
+package stacker
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/anuvu/stacker/limits"
+	"github.com/anuvu/stacker/log"
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/squashfs"
+	"github.com/anuvu/stacker/storage"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+)
+
+// The formats ConvertLayers can convert an image's layers to.
+const (
+	LayerFormatSquashfs = "squashfs"
+	LayerFormatTarGzip  = "tar+gzip"
+	LayerFormatTarZstd  = "tar+zstd"
+)
+
+var layerFormatMediaTypes = map[string]string{
+	LayerFormatSquashfs: stackeroci.MediaTypeLayerSquashfs,
+	LayerFormatTarGzip:  ispec.MediaTypeImageLayerGzip,
+	LayerFormatTarZstd:  stackeroci.MediaTypeLayerZstd,
+}
+
+// ConvertLayers rewrites the image tag in the output into one with the same
+// config and annotations but whose layers are in format, and stores it as
+// newTag.
+func ConvertLayers(config types.StackerConfig, tag string, newTag string, format string) error {
+	mediaType, ok := layerFormatMediaTypes[format]
+	if !ok {
+		return errors.Errorf("unknown layer format %s", format)
+	}
+
+	oci, err := stackeroci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return err
+	}
+
+	imageConfig, err := stackeroci.LookupConfig(oci, manifest.Config)
+	if err != nil {
+		return err
+	}
+
+	newManifest := manifest
+	newManifest.Layers = []ispec.Descriptor{}
+	newConfig := imageConfig
+	newConfig.RootFS.DiffIDs = []digest.Digest{}
+
+	for i, desc := range manifest.Layers {
+		newDesc := desc
+		diffID := imageConfig.RootFS.DiffIDs[i]
+
+		if desc.MediaType != mediaType {
+			log.Infof("converting layer %s to %s", desc.Digest, format)
+			newDesc, diffID, err = convertLayer(config, oci, desc, mediaType)
+			if err != nil {
+				return errors.Wrapf(err, "couldn't convert layer %s", desc.Digest)
+			}
+			newDesc.Annotations = desc.Annotations
+		}
+
+		newManifest.Layers = append(newManifest.Layers, newDesc)
+		newConfig.RootFS.DiffIDs = append(newConfig.RootFS.DiffIDs, diffID)
+	}
+
+	_, err = stackeroci.UpdateImageConfig(oci, newTag, newConfig, newManifest)
+	return err
+}
+
+// convertLayer converts the layer desc to mediaType, returning the new
+// layer's descriptor and diff ID.
+func convertLayer(config types.StackerConfig, oci casext.Engine, desc ispec.Descriptor, mediaType string) (ispec.Descriptor, digest.Digest, error) {
+	// squashfs is a filesystem rather than a stream, so going to or from
+	// it needs the layer's contents on disk.
+	dir, err := ioutil.TempDir(config.StackerDir, "convert-layer-")
+	if err != nil {
+		return ispec.Descriptor{}, "", errors.Wrapf(err, "couldn't create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	contents := path.Join(dir, "contents")
+
+	var tarStream io.ReadCloser
+	switch desc.MediaType {
+	case stackeroci.MediaTypeLayerSquashfs, stackeroci.ImpoliteMediaTypeLayerSquashfs:
+		blob := path.Join(config.OCIDir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+		if err := squashfs.ExtractSingleSquash(blob, contents, "overlay"); err != nil {
+			return ispec.Descriptor{}, "", err
+		}
+
+		packOptions := layer.RepackOptions{TranslateOverlayWhiteouts: true}
+		tarStream = layer.GenerateInsertLayer(contents, "/", false, &packOptions)
+	default:
+		tarStream, err = stackeroci.OpenTarLayer(oci, desc)
+		if err != nil {
+			return ispec.Descriptor{}, "", err
+		}
+	}
+	defer tarStream.Close()
+
+	if mediaType != stackeroci.MediaTypeLayerSquashfs {
+		return putTarLayer(config, oci, tarStream, mediaType)
+	}
+
+	if err := os.MkdirAll(contents, 0755); err != nil {
+		return ispec.Descriptor{}, "", errors.Wrapf(err, "couldn't create layer dir")
+	}
+
+	// overlay style whiteouts are what squashfs consumers expect
+	unpackOptions := layer.UnpackOptions{WhiteoutMode: layer.OverlayFSWhiteout}
+	if err := layer.UnpackLayer(contents, tarStream, &unpackOptions); err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	release, err := limits.Acquire(config, limits.Squashfs)
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+	// make the image in the output, so it can be renamed into place
+	image, err := squashfs.MakeSquashfsFile(config.OCIDir, contents, nil)
+	release()
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	converted, err := squashfs.PutLayer(oci, config.OCIDir, image, config.SquashfsVerity)
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	// squashfs layers aren't compressed (from OCI's point of view), so
+	// the diff id is the digest
+	return converted, converted.Digest, nil
+}
+
+// putTarLayer compresses the tar stream according to mediaType and adds it
+// to oci. The layer_compression_level from the stacker config is used if
+// its layer_compression is the same as mediaType's.
+func putTarLayer(config types.StackerConfig, oci casext.Engine, tarStream io.Reader, mediaType string) (ispec.Descriptor, digest.Digest, error) {
+	compression := "gzip"
+	if mediaType == stackeroci.MediaTypeLayerZstd {
+		compression = "zstd"
+	}
+
+	compressionConfig := config
+	if compressionConfig.LayerCompression != compression {
+		compressionConfig.LayerCompression = compression
+		compressionConfig.LayerCompressionLevel = 0
+	}
+
+	compressor, err := storage.TarCompressor(compressionConfig)
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	diffID := digest.SHA256.Digester()
+	blob, err := compressor.Compress(io.TeeReader(tarStream, diffID.Hash()))
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+	defer blob.Close()
+
+	d, size, err := oci.PutBlob(context.Background(), blob)
+	if err != nil {
+		return ispec.Descriptor{}, "", err
+	}
+
+	return ispec.Descriptor{MediaType: mediaType, Digest: d, Size: size}, diffID.Digest(), nil
+}
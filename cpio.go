@@ -0,0 +1,133 @@
+package stacker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/idtools"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// cpioTrailer is the name of the entry that ends a cpio archive.
+const cpioTrailer = "TRAILER!!!"
+
+// cpioWriter writes cpio archives in the newc format, the one the kernel
+// unpacks initramfses from.
+type cpioWriter struct {
+	w   *bufio.Writer
+	ino uint64
+}
+
+func (cw *cpioWriter) pad(n int64) error {
+	if n%4 == 0 {
+		return nil
+	}
+	_, err := cw.w.Write(make([]byte, 4-n%4))
+	return err
+}
+
+// writeHeader writes the header of the entry name. st is its stat, with the
+// uid and gid already mapped, and size the size of its content.
+func (cw *cpioWriter) writeHeader(name string, st *syscall.Stat_t, size int64) error {
+	cw.ino++
+	header := fmt.Sprintf("070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		cw.ino,
+		st.Mode,
+		st.Uid,
+		st.Gid,
+		1,
+		st.Mtim.Sec,
+		size,
+		0,
+		0,
+		unix.Major(uint64(st.Rdev)),
+		unix.Minor(uint64(st.Rdev)),
+		len(name)+1,
+		0,
+	)
+	if _, err := cw.w.WriteString(header + name + "\x00"); err != nil {
+		return err
+	}
+
+	return cw.pad(int64(len(header) + len(name) + 1))
+}
+
+// writeCpio writes the files in rootfs to w as a cpio archive, with their
+// uids and gids mapped as mapOptions says. Hard links are written as copies
+// of the file, which is all an initramfs needs.
+func writeCpio(rootfs string, w io.Writer, mapOptions layer.MapOptions) error {
+	cw := &cpioWriter{w: bufio.NewWriter(w)}
+
+	err := filepath.Walk(rootfs, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if p == rootfs {
+			return nil
+		}
+
+		name, err := filepath.Rel(rootfs, p)
+		if err != nil {
+			return err
+		}
+
+		st := *info.Sys().(*syscall.Stat_t)
+		uid, err := idtools.ToContainer(int(st.Uid), mapOptions.UIDMappings)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't map uid of %s", name)
+		}
+		gid, err := idtools.ToContainer(int(st.Gid), mapOptions.GIDMappings)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't map gid of %s", name)
+		}
+		st.Uid = uint32(uid)
+		st.Gid = uint32(gid)
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if err := cw.writeHeader(name, &st, int64(len(target))); err != nil {
+				return err
+			}
+			if _, err := cw.w.WriteString(target); err != nil {
+				return err
+			}
+			return cw.pad(int64(len(target)))
+		case info.Mode().IsRegular():
+			if err := cw.writeHeader(name, &st, info.Size()); err != nil {
+				return err
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			n, err := io.CopyN(cw.w, f, info.Size())
+			if err != nil {
+				return errors.Wrapf(err, "couldn't read %s", name)
+			}
+			return cw.pad(n)
+		default:
+			return cw.writeHeader(name, &st, 0)
+		}
+	})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't archive %s", rootfs)
+	}
+
+	if err := cw.writeHeader(cpioTrailer, &syscall.Stat_t{}, 0); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(cw.w.Flush())
+}
@@ -0,0 +1,69 @@
+package stacker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/stretchr/testify/assert"
+)
+
+// readCpio returns the content of each entry in a newc cpio archive, or the
+// link target for symlinks.
+func readCpio(t *testing.T, archive []byte) map[string]string {
+	entries := map[string]string{}
+	align := func(n int) int { return (n + 3) &^ 3 }
+
+	for off := 0; ; {
+		header := archive[off : off+110]
+		if string(header[:6]) != "070701" {
+			t.Fatalf("bad cpio magic at %d: %q", off, header[:6])
+		}
+		field := func(i int) int {
+			v, err := strconv.ParseUint(string(header[6+8*i:14+8*i]), 16, 32)
+			if err != nil {
+				t.Fatalf("bad cpio header field %d: %s", i, err)
+			}
+			return int(v)
+		}
+		size := field(6)
+		nameSize := field(11)
+
+		name := string(archive[off+110 : off+110+nameSize-1])
+		off = align(off + 110 + nameSize)
+		if name == cpioTrailer {
+			return entries
+		}
+		entries[name] = string(archive[off : off+size])
+		off = align(off + size)
+	}
+}
+
+func TestWriteCpio(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_cpio_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.MkdirAll(path.Join(dir, "bin"), 0755))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "bin", "init"), []byte("#!/bin/sh\n"), 0755))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "empty"), nil, 0644))
+	assert.NoError(os.Symlink("bin/init", path.Join(dir, "init")))
+
+	var archive bytes.Buffer
+	assert.NoError(writeCpio(dir, &archive, layer.MapOptions{}))
+	assert.Equal(0, archive.Len()%4)
+
+	entries := readCpio(t, archive.Bytes())
+	assert.Equal(map[string]string{
+		"bin":      "",
+		"bin/init": "#!/bin/sh\n",
+		"empty":    "",
+		"init":     "bin/init",
+	}, entries)
+}
@@ -0,0 +1,209 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/anuvu/stacker/log"
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DeltaArtifactType is the config media type of the artifacts
+	// GenerateDeltas makes.
+	DeltaArtifactType = "application/vnd.stacker.delta.config.v1+json"
+
+	// MediaTypeLayerDelta is the media type of their blobs: xdelta3
+	// (VCDIFF, RFC 3284) deltas that turn one layer blob into another.
+	MediaTypeLayerDelta = "application/vnd.stacker.layer.delta.v1.vcdiff"
+
+	// DeltaSourceAnnotation and DeltaTargetAnnotation are the digests
+	// of the blob a delta applies to, and of the blob it makes.
+	DeltaSourceAnnotation = "com.cisco.stacker.delta_source"
+	DeltaTargetAnnotation = "com.cisco.stacker.delta_target"
+)
+
+// DeltaConfig is the config of a delta artifact: the manifests of the image
+// its deltas are from and of the one they make.
+type DeltaConfig struct {
+	Source digest.Digest `json:"source"`
+	Target digest.Digest `json:"target"`
+}
+
+// deltaPair is a layer of the image deltas are made to, and the layer of
+// the image they're made from in the same place.
+type deltaPair struct {
+	source ispec.Descriptor
+	target ispec.Descriptor
+}
+
+// deltaPairs returns the layers of target that there can be a delta for:
+// the squashfs ones that changed, since the layer they replace in source.
+// Deltas of compressed tar layers are as big as the layers, and layers past
+// the end of source have nothing to be a delta from.
+func deltaPairs(source []ispec.Descriptor, target []ispec.Descriptor) []deltaPair {
+	pairs := []deltaPair{}
+	for i, desc := range target {
+		if i >= len(source) {
+			break
+		}
+
+		if desc.Digest == source[i].Digest {
+			continue
+		}
+
+		if !isSquashfsLayer(desc) || !isSquashfsLayer(source[i]) {
+			log.Infof("not making a delta for %s, only squashfs layers have useful deltas", desc.Digest)
+			continue
+		}
+
+		pairs = append(pairs, deltaPair{source: source[i], target: desc})
+	}
+
+	return pairs
+}
+
+func isSquashfsLayer(desc ispec.Descriptor) bool {
+	return desc.MediaType == stackeroci.MediaTypeLayerSquashfs || desc.MediaType == stackeroci.ImpoliteMediaTypeLayerSquashfs
+}
+
+// GenerateDeltas adds an artifact tagged deltaTag to the OCI output, with
+// deltas from the layers of the image from to the ones of the image to that
+// replace them, so that something which has from can update to to by
+// downloading the deltas instead of the changed layers. Deltas that wouldn't
+// be smaller than their layer are left out.
+func GenerateDeltas(config types.StackerConfig, from string, to string, deltaTag string) (*ispec.Manifest, error) {
+	unlock, err := LockOCILayout(config.OCIDir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	oci, err := stackeroci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return nil, err
+	}
+	defer oci.Close()
+
+	descs := map[string]ispec.Descriptor{}
+	manifests := map[string]ispec.Manifest{}
+	for _, tag := range []string{from, to} {
+		descPaths, err := oci.ResolveReference(context.Background(), tag)
+		if err != nil {
+			return nil, err
+		}
+		if len(descPaths) != 1 {
+			return nil, errors.Errorf("no single image %s in the output", tag)
+		}
+		descs[tag] = descPaths[0].Descriptor()
+
+		manifests[tag], err = stackeroci.LookupManifest(oci, tag)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	artifact := ispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Layers:    []ispec.Descriptor{},
+	}
+
+	for _, pair := range deltaPairs(manifests[from].Layers, manifests[to].Layers) {
+		delta, err := makeDelta(config, pair)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't make a delta from %s to %s", pair.source.Digest, pair.target.Digest)
+		}
+
+		fi, err := os.Stat(delta)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+
+		if fi.Size() >= pair.target.Size {
+			log.Infof("the delta for %s isn't smaller than it, leaving it out", pair.target.Digest)
+			os.Remove(delta)
+			continue
+		}
+
+		d, size, err := stackeroci.PutBlobFile(oci, config.OCIDir, delta)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Infof("delta from %s to %s is %d bytes, instead of %d", pair.source.Digest, pair.target.Digest, size, pair.target.Size)
+		artifact.Layers = append(artifact.Layers, ispec.Descriptor{
+			MediaType: MediaTypeLayerDelta,
+			Digest:    d,
+			Size:      size,
+			Annotations: map[string]string{
+				DeltaSourceAnnotation: pair.source.Digest.String(),
+				DeltaTargetAnnotation: pair.target.Digest.String(),
+			},
+		})
+	}
+
+	deltaConfig := DeltaConfig{Source: descs[from].Digest, Target: descs[to].Digest}
+	configDigest, configSize, err := oci.PutBlobJSON(context.Background(), deltaConfig)
+	if err != nil {
+		return nil, err
+	}
+	artifact.Config = ispec.Descriptor{MediaType: DeltaArtifactType, Digest: configDigest, Size: configSize}
+
+	manifestDigest, manifestSize, err := oci.PutBlobJSON(context.Background(), artifact)
+	if err != nil {
+		return nil, err
+	}
+
+	desc := ispec.Descriptor{MediaType: ispec.MediaTypeImageManifest, Digest: manifestDigest, Size: manifestSize}
+	if err := oci.UpdateReference(context.Background(), deltaTag, desc); err != nil {
+		return nil, err
+	}
+
+	return &artifact, nil
+}
+
+// makeDelta makes the delta from pair's source blob to its target, in a
+// temporary file in the OCI output (so it can be renamed into its blobs),
+// and returns its path.
+func makeDelta(config types.StackerConfig, pair deltaPair) (string, error) {
+	blob := func(d digest.Digest) string {
+		return path.Join(config.OCIDir, "blobs", d.Algorithm().String(), d.Encoded())
+	}
+
+	f, err := ioutil.TempFile(config.OCIDir, ".delta-")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	f.Close()
+
+	// xdelta3 only finds matches within its source window, which is 64MiB
+	// by default; making it the size of the source (up to the 2GiB it
+	// allows) finds the ones anywhere in it
+	window := pair.source.Size
+	if window > 1<<31 {
+		window = 1 << 31
+	}
+	if window < 1<<20 {
+		window = 1 << 20
+	}
+
+	args := []string{"-e", "-f", "-9", "-B", fmt.Sprintf("%d", window), "-s", blob(pair.source.Digest), blob(pair.target.Digest), f.Name()}
+	log.Debugf("xdelta3 %s", strings.Join(args, " "))
+	output, err := exec.Command("xdelta3", args...).CombinedOutput()
+	if err != nil {
+		os.Remove(f.Name())
+		return "", errors.Wrapf(err, "xdelta3 failed: %s", strings.TrimSpace(string(output)))
+	}
+
+	return f.Name(), nil
+}
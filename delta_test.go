@@ -0,0 +1,37 @@
+package stacker
+
+import (
+	"testing"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeltaPairs(t *testing.T) {
+	assert := assert.New(t)
+
+	layer := func(mediaType string, content string) ispec.Descriptor {
+		return ispec.Descriptor{MediaType: mediaType, Digest: digest.FromString(content), Size: int64(len(content))}
+	}
+
+	base := layer(stackeroci.MediaTypeLayerSquashfs, "base")
+	oldApp := layer(stackeroci.MediaTypeLayerSquashfs, "app v1")
+	newApp := layer(stackeroci.MediaTypeLayerSquashfs, "app v2")
+	oldTar := layer(ispec.MediaTypeImageLayerGzip, "tar v1")
+	newTar := layer(ispec.MediaTypeImageLayerGzip, "tar v2")
+	extra := layer(stackeroci.MediaTypeLayerSquashfs, "extra")
+
+	// unchanged layers don't need deltas, and only the changed one gets one
+	pairs := deltaPairs([]ispec.Descriptor{base, oldApp}, []ispec.Descriptor{base, newApp})
+	assert.Equal([]deltaPair{{source: oldApp, target: newApp}}, pairs)
+
+	// tar layers and layers with nothing under them in the source are
+	// left out
+	pairs = deltaPairs([]ispec.Descriptor{oldTar, oldApp}, []ispec.Descriptor{newTar, newApp, extra})
+	assert.Equal([]deltaPair{{source: oldApp, target: newApp}}, pairs)
+
+	pairs = deltaPairs([]ispec.Descriptor{base}, []ispec.Descriptor{base})
+	assert.Empty(pairs)
+}
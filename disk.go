@@ -0,0 +1,131 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+const (
+	// diskPartitionOffset is where a disk image's partition starts,
+	// leaving room for the bootloader after the partition table.
+	diskPartitionOffset = 1024 * 1024
+
+	// diskSlack is how much bigger than its rootfs a disk image is, if
+	// its size isn't given.
+	diskSlack = 256 * 1024 * 1024
+)
+
+// rootfsSize returns the size of the files in rootfs.
+func rootfsSize(rootfs string) (uint64, error) {
+	size := uint64(0)
+	err := filepath.Walk(rootfs, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		size += uint64(info.Size())
+		return nil
+	})
+	return size, errors.Wrapf(err, "couldn't measure %s", rootfs)
+}
+
+// runDiskTool runs one of the tools outputs are made with, e.g. the ones
+// disk images are made with.
+func runDiskTool(name string, stdin string, args ...string) error {
+	log.Debugf("running %s %s", name, strings.Join(args, " "))
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "%s failed: %s", name, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// generateDiskImage writes a disk image of rootfs (the filesystem of layer
+// name) to dest as o says: a dos partition table with one bootable
+// partition, whose filesystem is made straight from rootfs with mkfs -d, so
+// nothing has to be mounted. The hooks are then run to install a
+// bootloader, before the image is converted to its format.
+func generateDiskImage(name string, rootfs string, o *types.Output, dest string) error {
+	var size uint64
+	var err error
+	if o.Size != "" {
+		size, err = humanize.ParseBytes(o.Size)
+		if err != nil {
+			return errors.Wrapf(err, "bad disk size %s", o.Size)
+		}
+	} else {
+		size, err = rootfsSize(rootfs)
+		if err != nil {
+			return err
+		}
+		size = size*3/2 + diskSlack
+	}
+
+	// partitions are aligned to MiBs
+	size = (size + diskPartitionOffset - 1) / diskPartitionOffset * diskPartitionOffset
+	if size <= diskPartitionOffset {
+		return errors.Errorf("disk size %s is too small", o.Size)
+	}
+	partitionSize := size - diskPartitionOffset
+
+	raw := dest
+	if o.Format != "raw" {
+		raw = dest + ".raw"
+		defer os.Remove(raw)
+	}
+
+	f, err := os.Create(raw)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = f.Truncate(int64(size))
+	f.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.Infof("making %s %s disk image of %s", humanize.IBytes(size), o.Filesystem, name)
+	err = runDiskTool("mkfs."+o.Filesystem, "", "-F", "-q", "-E", fmt.Sprintf("offset=%d", diskPartitionOffset), "-d", rootfs, raw, fmt.Sprintf("%dk", partitionSize/1024))
+	if err != nil {
+		return err
+	}
+
+	err = runDiskTool("sfdisk", fmt.Sprintf("label: dos\nstart=%d, type=83, bootable\n", diskPartitionOffset/512), "--quiet", raw)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range o.Hooks {
+		log.Infof("running disk image hook %s", hook)
+		cmd := exec.Command(hook)
+		cmd.Env = append(os.Environ(),
+			"STACKER_LAYER_NAME="+name,
+			"STACKER_DISK="+raw,
+			"STACKER_ROOTFS="+rootfs,
+			fmt.Sprintf("STACKER_PARTITION_OFFSET=%d", diskPartitionOffset),
+			fmt.Sprintf("STACKER_PARTITION_SIZE=%d", partitionSize),
+		)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return errors.Wrapf(err, "disk image hook %s failed", hook)
+		}
+	}
+
+	if o.Format == "qcow2" {
+		return runDiskTool("qemu-img", "", "convert", "-f", "raw", "-O", "qcow2", raw, dest)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package stacker
+
+import (
+	"io"
+	"path"
+	"strings"
+
+	"github.com/anuvu/stacker/storage"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+)
+
+// RootfsCompression returns the compression of a rootfs tarball from its
+// file name: gzip for .gz and .tgz, zstd for .zst and .tzst, and none
+// otherwise.
+func RootfsCompression(file string) string {
+	switch {
+	case strings.HasSuffix(file, ".gz"), strings.HasSuffix(file, ".tgz"):
+		return "gzip"
+	case strings.HasSuffix(file, ".zst"), strings.HasSuffix(file, ".tzst"):
+		return "zstd"
+	default:
+		return "none"
+	}
+}
+
+// ExportRootfs writes the filesystem of the built layer tag to w as a single
+// tarball, compressed with compression (none, gzip or zstd), with its uids
+// and gids mapped like its layers' are.
+func ExportRootfs(config types.StackerConfig, s types.Storage, tag string, compression string, w io.Writer) error {
+	compressor, err := storage.OutputCompressor(compression)
+	if err != nil {
+		return err
+	}
+
+	mapOptions, err := storage.RepackMapOptions(config)
+	if err != nil {
+		return err
+	}
+
+	name, cleanup, err := s.TemporaryWritableSnapshot(tag)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	rootfs := path.Join(config.RootFSDir, name, "rootfs")
+	tarball := layer.GenerateInsertLayer(rootfs, "/", false, &layer.RepackOptions{MapOptions: mapOptions})
+	defer tarball.Close()
+
+	compressed, err := compressor.Compress(tarball)
+	if err != nil {
+		return err
+	}
+	defer compressed.Close()
+
+	_, err = io.Copy(w, compressed)
+	return errors.Wrapf(err, "couldn't export %s", tag)
+}
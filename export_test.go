@@ -0,0 +1,17 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRootfsCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("none", RootfsCompression("rootfs.tar"))
+	assert.Equal("gzip", RootfsCompression("rootfs.tar.gz"))
+	assert.Equal("gzip", RootfsCompression("rootfs.tgz"))
+	assert.Equal("zstd", RootfsCompression("rootfs.tar.zst"))
+	assert.Equal("none", RootfsCompression("-"))
+}
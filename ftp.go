@@ -0,0 +1,289 @@
+package stacker
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/pkg/errors"
+)
+
+// ftpTimeout is how long connecting to an ftp server, or waiting for it to
+// respond or send more of a file, can take before the download fails.
+var ftpTimeout = 60 * time.Second
+
+// ftpConn is the control connection of a (passive mode, binary) ftp session,
+// which is all stacker needs to download imports.
+type ftpConn struct {
+	raw  net.Conn
+	conn *textproto.Conn
+	host string
+}
+
+// dialFTP connects and logs in to the server of the ftp url u, as the url's
+// user if it has one, or anonymously.
+func dialFTP(u *url.URL) (*ftpConn, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+
+	raw, err := net.DialTimeout("tcp", addr, ftpTimeout)
+	if err != nil {
+		return nil, types.WithKind(types.NetworkError, errors.WithStack(err))
+	}
+
+	conn := textproto.NewConn(raw)
+	fc := &ftpConn{raw: raw, conn: conn, host: u.Hostname()}
+	if _, _, err := fc.readResponse(220); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "bad ftp greeting from %s", addr)
+	}
+
+	user, password := "anonymous", "anonymous@"
+	if u.User != nil {
+		user = u.User.Username()
+		if p, ok := u.User.Password(); ok {
+			password = p
+		}
+	}
+
+	code, _, err := fc.cmd(0, "USER %s", user)
+	if err == nil && code == 331 {
+		_, _, err = fc.cmd(230, "PASS %s", password)
+	} else if err == nil && code != 230 {
+		err = errors.Errorf("unexpected response %d to USER", code)
+	}
+	if err == nil {
+		_, _, err = fc.cmd(200, "TYPE I")
+	}
+	if err != nil {
+		fc.Close()
+		return nil, errors.Wrapf(err, "couldn't log in to %s", addr)
+	}
+
+	return fc, nil
+}
+
+// cmd sends the command, and returns the server's response, which should
+// have the code expectCode (if it isn't 0).
+func (fc *ftpConn) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	fc.raw.SetDeadline(time.Now().Add(ftpTimeout))
+	if _, err := fc.conn.Cmd(format, args...); err != nil {
+		return 0, "", errors.WithStack(err)
+	}
+
+	return fc.readResponse(expectCode)
+}
+
+// readResponse reads the server's response, giving up if it doesn't come
+// within ftpTimeout.
+func (fc *ftpConn) readResponse(expectCode int) (int, string, error) {
+	fc.raw.SetDeadline(time.Now().Add(ftpTimeout))
+	code, msg, err := fc.conn.ReadResponse(expectCode)
+	if err != nil {
+		return code, msg, errors.WithStack(err)
+	}
+
+	return code, msg, nil
+}
+
+// size returns the size of the file p on the server.
+func (fc *ftpConn) size(p string) (int64, error) {
+	_, msg, err := fc.cmd(213, "SIZE %s", p)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+	return size, errors.Wrapf(err, "bad SIZE response %s", msg)
+}
+
+// mtime returns the modification time of the file p on the server, or the
+// zero time if the server doesn't support MDTM.
+func (fc *ftpConn) mtime(p string) time.Time {
+	_, msg, err := fc.cmd(213, "MDTM %s", p)
+	if err != nil {
+		return time.Time{}
+	}
+
+	// 213 YYYYMMDDHHMMSS[.sss], in UTC
+	mtime, err := time.Parse("20060102150405", strings.SplitN(strings.TrimSpace(msg), ".", 2)[0])
+	if err != nil {
+		return time.Time{}
+	}
+
+	return mtime
+}
+
+// dataConn opens a passive mode data connection, with EPSV if the server
+// supports it and PASV if it doesn't. The data connection always goes to the
+// host the control connection is to, since servers behind NAT often send
+// addresses that can't be reached in PASV responses.
+func (fc *ftpConn) dataConn() (net.Conn, error) {
+	port := ""
+	_, msg, err := fc.cmd(229, "EPSV")
+	if err == nil {
+		// 229 Entering Extended Passive Mode (|||6446|)
+		start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+		if start < 0 || end < start+4 {
+			return nil, errors.Errorf("bad EPSV response %s", msg)
+		}
+		port = msg[start+4 : end]
+	} else {
+		_, msg, err = fc.cmd(227, "PASV")
+		if err != nil {
+			return nil, err
+		}
+
+		// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+		if start < 0 || end < start {
+			return nil, errors.Errorf("bad PASV response %s", msg)
+		}
+		parts := strings.Split(msg[start+1:end], ",")
+		if len(parts) != 6 {
+			return nil, errors.Errorf("bad PASV response %s", msg)
+		}
+		p1, err1 := strconv.Atoi(parts[4])
+		p2, err2 := strconv.Atoi(parts[5])
+		if err1 != nil || err2 != nil {
+			return nil, errors.Errorf("bad PASV response %s", msg)
+		}
+		port = fmt.Sprintf("%d", p1*256+p2)
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(fc.host, port), ftpTimeout)
+	if err != nil {
+		return nil, types.WithKind(types.NetworkError, errors.WithStack(err))
+	}
+
+	return conn, nil
+}
+
+// ftpReader is the content of a file being retrieved. Sessions are only used
+// for one file, so closing it finishes the transfer and ends the session.
+type ftpReader struct {
+	net.Conn
+	fc *ftpConn
+}
+
+func (r *ftpReader) Read(p []byte) (int, error) {
+	r.Conn.SetReadDeadline(time.Now().Add(ftpTimeout))
+	return r.Conn.Read(p)
+}
+
+func (r *ftpReader) Close() error {
+	r.Conn.Close()
+	_, _, err := r.fc.readResponse(2)
+	r.fc.Close()
+	return errors.Wrapf(err, "ftp transfer failed")
+}
+
+// retr returns the content of the file p on the server.
+func (fc *ftpConn) retr(p string) (io.ReadCloser, error) {
+	conn, err := fc.dataConn()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err := fc.cmd(1, "RETR %s", p); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &ftpReader{conn, fc}, nil
+}
+
+func (fc *ftpConn) Close() error {
+	fc.cmd(221, "QUIT")
+	return fc.conn.Close()
+}
+
+// ftpGet returns the content of the file at the ftp url remoteURL, and its
+// size (or -1 if the server won't say).
+func ftpGet(remoteURL string) (io.ReadCloser, int64, error) {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+
+	fc, err := dialFTP(u)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size, err := fc.size(u.Path)
+	if err != nil {
+		size = -1
+	}
+
+	content, err := fc.retr(u.Path)
+	if err != nil {
+		fc.Close()
+		return nil, 0, types.WithKind(types.NetworkError, errors.Wrapf(err, "couldn't download %s", redactURL(remoteURL)))
+	}
+
+	return content, size, nil
+}
+
+// getFtpFileInfo returns the content size of a file on an ftp server, and
+// its mtime if the server says (or the zero time); ftp has no standard way to
+// get a file's hash.
+func getFtpFileInfo(remoteURL string) (string, time.Time, error) {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return "", time.Time{}, errors.WithStack(err)
+	}
+
+	fc, err := dialFTP(u)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer fc.Close()
+
+	size, err := fc.size(u.Path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return fmt.Sprintf("%d", size), fc.mtime(u.Path), nil
+}
+
+// ftpDownload is Download for ftp urls. Without a hash to check it against,
+// the cached copy is only used if it has the size and mtime (if the server
+// has one) of the remote file, which are what the server can tell.
+func ftpDownload(cacheDir string, remoteURL string, progress bool, hash string, remoteSize string, remoteMtime time.Time) (string, error) {
+	name := path.Join(cacheDir, path.Base(remoteURL))
+	if hash == "" && remoteSize != "" {
+		fi, err := os.Stat(name)
+		if err == nil && (strconv.FormatInt(fi.Size(), 10) != remoteSize || (!remoteMtime.IsZero() && !fi.ModTime().Equal(remoteMtime))) {
+			log.Infof("cached copy of %s is out of date", redactURL(remoteURL))
+			if err := os.RemoveAll(name); err != nil {
+				return "", errors.WithStack(err)
+			}
+		}
+	}
+
+	p, err := Download(cacheDir, remoteURL, progress, hash, remoteSize)
+	if err != nil {
+		return p, err
+	}
+
+	if !remoteMtime.IsZero() {
+		if err := os.Chtimes(p, remoteMtime, remoteMtime); err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+
+	return p, nil
+}
@@ -0,0 +1,219 @@
+package stacker
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeFTPServer serves files over just enough ftp for stacker's client, on
+// localhost. It only supports PASV if epsv is false, and returns its address
+// and the commands it was sent.
+func fakeFTPServer(t *testing.T, files map[string]string, epsv bool) (string, func() []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen %v", err)
+	}
+
+	lock := sync.Mutex{}
+	commands := []string{}
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var data net.Listener
+		r := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "220 hello\r\n")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			lock.Lock()
+			commands = append(commands, line)
+			lock.Unlock()
+
+			parts := strings.SplitN(line, " ", 2)
+			arg := ""
+			if len(parts) == 2 {
+				arg = parts[1]
+			}
+
+			switch parts[0] {
+			case "USER":
+				fmt.Fprintf(conn, "331 password please\r\n")
+			case "PASS":
+				fmt.Fprintf(conn, "230 welcome\r\n")
+			case "TYPE":
+				fmt.Fprintf(conn, "200 binary\r\n")
+			case "SIZE":
+				content, ok := files[arg]
+				if !ok {
+					fmt.Fprintf(conn, "550 no such file\r\n")
+					continue
+				}
+				fmt.Fprintf(conn, "213 %d\r\n", len(content))
+			case "MDTM":
+				if _, ok := files[arg]; !ok {
+					fmt.Fprintf(conn, "550 no such file\r\n")
+					continue
+				}
+				fmt.Fprintf(conn, "213 20200102030405\r\n")
+			case "EPSV", "PASV":
+				if parts[0] == "EPSV" && !epsv {
+					fmt.Fprintf(conn, "502 no\r\n")
+					continue
+				}
+
+				data, err = net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					return
+				}
+				port := data.Addr().(*net.TCPAddr).Port
+				if parts[0] == "EPSV" {
+					fmt.Fprintf(conn, "229 Entering Extended Passive Mode (|||%d|)\r\n", port)
+				} else {
+					// an unreachable address, like NATed servers send
+					fmt.Fprintf(conn, "227 Entering Passive Mode (10,1,2,3,%d,%d)\r\n", port/256, port%256)
+				}
+			case "RETR":
+				content, ok := files[arg]
+				if !ok {
+					data.Close()
+					fmt.Fprintf(conn, "550 no such file\r\n")
+					continue
+				}
+				fmt.Fprintf(conn, "150 here it comes\r\n")
+				dc, err := data.Accept()
+				data.Close()
+				if err != nil {
+					return
+				}
+				fmt.Fprint(dc, content)
+				dc.Close()
+				fmt.Fprintf(conn, "226 done\r\n")
+			case "QUIT":
+				fmt.Fprintf(conn, "221 bye\r\n")
+				return
+			default:
+				fmt.Fprintf(conn, "502 not implemented\r\n")
+			}
+		}
+	}()
+
+	return l.Addr().String(), func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, commands...)
+	}
+}
+
+func TestFTPGet(t *testing.T) {
+	assert := assert.New(t)
+
+	files := map[string]string{"/pub/firmware.bin": "some firmware"}
+	for _, epsv := range []bool{true, false} {
+		addr, commands := fakeFTPServer(t, files, epsv)
+
+		content, size, err := ftpGet(fmt.Sprintf("ftp://me:sekrit@%s/pub/firmware.bin", addr))
+		assert.NoError(err)
+		assert.Equal(int64(len(files["/pub/firmware.bin"])), size)
+
+		downloaded, err := ioutil.ReadAll(content)
+		assert.NoError(err)
+		assert.Equal(files["/pub/firmware.bin"], string(downloaded))
+		assert.NoError(content.Close())
+
+		assert.Contains(commands(), "USER me")
+		assert.Contains(commands(), "PASS sekrit")
+	}
+
+	addr, commands := fakeFTPServer(t, files, true)
+	_, _, err := ftpGet(fmt.Sprintf("ftp://%s/pub/missing.bin", addr))
+	assert.Error(err)
+	assert.Contains(commands(), "USER anonymous")
+}
+
+func TestGetFtpFileInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	addr, _ := fakeFTPServer(t, map[string]string{"/file": "12345"}, true)
+	size, mtime, err := getFtpFileInfo(fmt.Sprintf("ftp://%s/file", addr))
+	assert.NoError(err)
+	assert.Equal("5", size)
+	assert.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), mtime)
+}
+
+func TestFTPDownloadChecksCachedCopy(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker-ftp-test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	cached := path.Join(dir, "file")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	files := map[string]string{"/file": "new content"}
+
+	// same size and mtime: the cached copy is used
+	assert.NoError(ioutil.WriteFile(cached, []byte("old content"), 0644))
+	assert.NoError(os.Chtimes(cached, mtime, mtime))
+	p, err := ftpDownload(dir, fmt.Sprintf("ftp://%s/file", "127.0.0.1:1"), false, "", "11", mtime)
+	assert.NoError(err)
+	content, err := ioutil.ReadFile(p)
+	assert.NoError(err)
+	assert.Equal("old content", string(content))
+
+	// a different mtime or size: it's downloaded again
+	for _, size := range []string{"11", "12"} {
+		assert.NoError(ioutil.WriteFile(cached, []byte("old content"), 0644))
+		addr, _ := fakeFTPServer(t, files, true)
+		p, err = ftpDownload(dir, fmt.Sprintf("ftp://%s/file", addr), false, "", size, mtime.Add(time.Hour))
+		assert.NoError(err)
+		content, err = ioutil.ReadFile(p)
+		assert.NoError(err)
+		assert.Equal("new content", string(content))
+
+		fi, err := os.Stat(p)
+		assert.NoError(err)
+		assert.True(fi.ModTime().Equal(mtime.Add(time.Hour)))
+	}
+}
+
+func TestFTPTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(old time.Duration) { ftpTimeout = old }(ftpTimeout)
+	ftpTimeout = 100 * time.Millisecond
+
+	// a server that never says hello
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(5 * time.Second)
+	}()
+
+	_, _, err = ftpGet(fmt.Sprintf("ftp://%s/file", l.Addr().String()))
+	assert.Error(err)
+}
@@ -1,7 +1,10 @@
 package stacker
 
 import (
+	"fmt"
+	"net/url"
 	"os/exec"
+	"strconv"
 	"strings"
 
 	"github.com/apex/log"
@@ -81,3 +84,77 @@ func NewGitLayerTag(path string) (string, error) {
 	// Add commit id in tag
 	return "commit-" + hash, nil
 }
+
+// gitDirty returns true if the git repo at path has uncommitted changes to
+// tracked files.
+func gitDirty(path string) (bool, error) {
+	args := []string{"-C", path, "status", "--porcelain", "--untracked-files=no"}
+	output, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		return false, err
+	}
+
+	return len(output) != 0, nil
+}
+
+// gitOutput runs git in path, returning its trimmed output, or "" if it fails
+// (e.g. a config key that isn't set).
+func gitOutput(path string, args ...string) string {
+	output, err := exec.Command("git", append([]string{"-C", path}, args...)...).Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(output))
+}
+
+// stripURLCredentials removes any user:password@ from a remote url, so it
+// doesn't end up in published images.
+func stripURLCredentials(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil || u.Scheme == "" || u.User == nil {
+		// scp style git@host:path urls don't have credentials
+		return remote
+	}
+
+	u.User = nil
+	return u.String()
+}
+
+// GitAnnotations returns the annotations describing the git repo that path is
+// in: the commit, whether it was dirty, the branch and the url of the
+// branch's remote.
+func GitAnnotations(path string) (map[string]string, error) {
+	commit, err := gitHash(path, false)
+	if err != nil {
+		return nil, err
+	}
+
+	dirty, err := gitDirty(path)
+	if err != nil {
+		return nil, err
+	}
+
+	annotations := map[string]string{
+		GitCommitAnnotation: commit,
+		GitDirtyAnnotation:  strconv.FormatBool(dirty),
+	}
+
+	// HEAD if detached
+	branch := gitOutput(path, "rev-parse", "--abbrev-ref", "HEAD")
+	if branch != "" && branch != "HEAD" {
+		annotations[GitBranchAnnotation] = branch
+	}
+
+	remote := gitOutput(path, "config", fmt.Sprintf("branch.%s.remote", branch))
+	if remote == "" {
+		remote = "origin"
+	}
+
+	remoteURL := gitOutput(path, "config", fmt.Sprintf("remote.%s.url", remote))
+	if remoteURL != "" {
+		annotations[GitSourceAnnotation] = stripURLCredentials(remoteURL)
+	}
+
+	return annotations, nil
+}
@@ -1,14 +1,57 @@
 package stacker
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path"
 
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/squashfs"
 	"github.com/anuvu/stacker/types"
 	"github.com/pkg/errors"
 )
 
+// ErrCantGrabFromImage means that GrabFromImage can't read a file straight out
+// of an image's layers, so it has to be grabbed out of the roots dir with
+// Grab() instead.
+var ErrCantGrabFromImage = errors.New("can't grab it straight out of the image")
+
+// GrabFromImage copies the regular file source out of the image tag in the
+// OCI output into targetDir, reading only the layers (and for squashfs
+// layers, only the parts of them) it needs, which is much faster than
+// restoring the image's whole filesystem. If tag isn't in the output or
+// source isn't a regular file, errors.Cause() of the error is
+// ErrCantGrabFromImage.
+func GrabFromImage(sc types.StackerConfig, tag string, source string, targetDir string) error {
+	oci, err := stackeroci.OpenLayout(sc.OCIDir)
+	if err != nil {
+		return errors.Wrapf(ErrCantGrabFromImage, "%s: %v", tag, err)
+	}
+
+	tags, err := oci.ListReferences(context.Background())
+	oci.Close()
+	if err != nil {
+		return err
+	}
+
+	inOutput := false
+	for _, t := range tags {
+		inOutput = inOutput || t == tag
+	}
+	if !inOutput {
+		return errors.Wrapf(ErrCantGrabFromImage, "%s isn't in the output", tag)
+	}
+
+	target := cleanImagePath(source)
+	_, err = lookupInImage(sc.OCIDir, tag, target, path.Join(targetDir, path.Base(target)))
+	switch errors.Cause(err) {
+	case errNotRegularFile, squashfs.ErrToolNotFound:
+		return errors.Wrapf(ErrCantGrabFromImage, "%v", err)
+	}
+	return errors.Wrapf(err, "couldn't grab %s from %s", source, tag)
+}
+
 func Grab(sc types.StackerConfig, storage types.Storage, name string, source string, targetDir string) error {
 	c, err := NewContainer(sc, storage, name)
 	if err != nil {
@@ -16,21 +59,47 @@ func Grab(sc types.StackerConfig, storage types.Storage, name string, source str
 	}
 	defer c.Close()
 
+	if sc.RunAgent {
+		return grabWithAgent(c, source, targetDir)
+	}
+
 	err = c.bindMount(targetDir, "/stacker", "")
 	if err != nil {
 		return err
 	}
 	defer os.Remove(path.Join(sc.RootFSDir, name, "rootfs", "stacker"))
 
-	binary, err := os.Readlink("/proc/self/exe")
+	err = c.bindStacker()
 	if err != nil {
-		return errors.Wrapf(err, "couldn't find executable for bind mount")
+		return err
 	}
 
-	err = c.bindMount(binary, "/static-stacker", "")
+	return c.Execute(fmt.Sprintf("/static-stacker internal-go cp %s /stacker/%s", source, path.Base(source)), nil)
+}
+
+// grabWithAgent has an agent send source over its socket, so targetDir doesn't
+// need to be mounted in the container.
+func grabWithAgent(c *Container, source string, targetDir string) error {
+	a, err := c.StartAgent()
 	if err != nil {
 		return err
 	}
+	defer a.Stop()
 
-	return c.Execute(fmt.Sprintf("/static-stacker internal-go cp %s /stacker/%s", source, path.Base(source)), nil)
+	f, err := os.Create(path.Join(targetDir, path.Base(source)))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	mode, err := a.ReadFile(source, f)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't grab %s", source)
+	}
+
+	if err := f.Chmod(mode.Perm()); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return a.Stop()
 }
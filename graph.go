@@ -0,0 +1,270 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/anuvu/stacker/log"
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/types"
+)
+
+// GraphStatus is what the build cache says about a layer in a LayerGraph,
+// i.e. whether the next build will rebuild it.
+type GraphStatus string
+
+const (
+	// GraphCached layers are in the cache as they are now.
+	GraphCached GraphStatus = "cached"
+	// GraphChanged layers were built, but something about them (their
+	// definition, imports or base image) changed since.
+	GraphChanged GraphStatus = "changed"
+	// GraphAffected layers haven't changed themselves, but depend on a
+	// layer that will be rebuilt, so they will be too.
+	GraphAffected GraphStatus = "affected"
+	// GraphNew layers have never been built.
+	GraphNew GraphStatus = "new"
+	// GraphExternal nodes are base images (and stacker-oci:// images)
+	// that aren't layers of the stacker files.
+	GraphExternal GraphStatus = "external"
+)
+
+func (s GraphStatus) rebuilt() bool {
+	return s == GraphChanged || s == GraphAffected || s == GraphNew
+}
+
+// GraphNode is a layer (or external image) in a LayerGraph. Its Status is
+// empty if the graph was made without looking at the cache.
+type GraphNode struct {
+	Name        string
+	Stackerfile string
+	Status      GraphStatus
+}
+
+// GraphEdge says that To is built on (Kind "from") or imports from (Kind
+// "import") From.
+type GraphEdge struct {
+	From string
+	To   string
+	Kind string
+}
+
+// LayerGraph is the graph of the layers in some stacker files, and what
+// they're built on or import from.
+type LayerGraph struct {
+	Nodes []GraphNode
+	Edges []GraphEdge
+}
+
+// NewLayerGraph returns the graph of the layers in the stacker files at
+// paths (and their prerequisites). If cacheStatus is set, each layer's
+// status is looked up in the build cache.
+func NewLayerGraph(config types.StackerConfig, paths []string, substitute []string, cacheStatus bool) (*LayerGraph, error) {
+	sfm, err := types.NewStackerFiles(paths, append(substitute, config.Substitutions()...))
+	if err != nil {
+		return nil, err
+	}
+
+	dag, err := NewStackerFilesDAG(sfm)
+	if err != nil {
+		return nil, err
+	}
+
+	var buildCache *BuildCache
+	if _, statErr := os.Stat(config.OCIDir); cacheStatus && statErr == nil {
+		oci, err := stackeroci.OpenLayout(config.OCIDir)
+		if err != nil {
+			return nil, err
+		}
+		defer oci.Close()
+
+		// the cache knows the layers by the bases they were built from
+		if err := resolveStackerFilesBases(sfm, lockReadOnly); err != nil {
+			return nil, err
+		}
+
+		buildCache, err = OpenCache(config, oci, sfm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	g := &LayerGraph{}
+	statuses := map[string]GraphStatus{}
+	for _, p := range dag.Sort() {
+		sf := dag.GetStackerFile(p)
+		order, err := sf.DependencyOrder(sfm)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range order {
+			l, _ := sf.Get(name)
+			deps, err := l.Dependencies()
+			if err != nil {
+				return nil, err
+			}
+
+			from := ""
+			switch l.From.Type {
+			case types.BuiltLayer:
+				from = l.From.Tag
+			case types.TarLayer:
+				from = l.From.Url
+				if url, err := types.NewDockerishUrl(l.From.Url); err == nil && url.Scheme == "stacker" {
+					from = url.Host
+				}
+			default:
+				from = l.From.Url
+			}
+
+			if !contains(deps, from) {
+				g.Edges = append(g.Edges, GraphEdge{From: from, To: name, Kind: "from"})
+			}
+			for _, dep := range deps {
+				kind := "import"
+				if dep == from {
+					kind = "from"
+				}
+				g.Edges = append(g.Edges, GraphEdge{From: dep, To: name, Kind: kind})
+			}
+
+			node := GraphNode{Name: name, Stackerfile: p}
+			if cacheStatus {
+				node.Status = layerGraphStatus(buildCache, name, deps, statuses)
+				statuses[name] = node.Status
+			}
+			g.Nodes = append(g.Nodes, node)
+		}
+	}
+
+	// what the layers are built on that isn't a layer
+	layers := map[string]bool{}
+	for _, n := range g.Nodes {
+		layers[n.Name] = true
+	}
+	for _, e := range g.Edges {
+		if !layers[e.From] {
+			g.Nodes = append(g.Nodes, GraphNode{Name: e.From, Status: GraphExternal})
+			layers[e.From] = true
+		}
+	}
+
+	return g, nil
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// layerGraphStatus returns the status of name, whose dependencies have the
+// statuses in statuses, in c (which is nil if nothing was built yet).
+func layerGraphStatus(c *BuildCache, name string, deps []string, statuses map[string]GraphStatus) GraphStatus {
+	if c == nil {
+		return GraphNew
+	}
+
+	if _, ok := c.Cache[name]; !ok {
+		return GraphNew
+	}
+
+	for _, dep := range deps {
+		if statuses[dep].rebuilt() {
+			return GraphAffected
+		}
+	}
+
+	_, hit, err := c.Lookup(name)
+	if err != nil {
+		log.Debugf("couldn't look %s up in the cache: %v", name, err)
+	}
+	if err != nil || !hit {
+		return GraphChanged
+	}
+
+	return GraphCached
+}
+
+var graphColors = map[GraphStatus]string{
+	GraphCached:   "#b7e1a1",
+	GraphChanged:  "#f4a582",
+	GraphAffected: "#fddbc7",
+	GraphNew:      "#d9d9d9",
+}
+
+// DOT returns the graph in graphviz's dot language, with the layers colored
+// by their status.
+func (g *LayerGraph) DOT() string {
+	dot := "digraph stacker {\n"
+	dot += "\tnode [shape=box, style=filled, fillcolor=white];\n"
+	for _, n := range g.Nodes {
+		attrs := []string{}
+		if n.Status == GraphExternal {
+			attrs = append(attrs, "style=dashed")
+		} else if color, ok := graphColors[n.Status]; ok {
+			attrs = append(attrs, fmt.Sprintf("fillcolor=%q", color))
+		}
+		if n.Status != "" {
+			attrs = append(attrs, fmt.Sprintf("tooltip=%q", n.Status))
+		}
+		dot += fmt.Sprintf("\t%s [%s];\n", strconv.Quote(n.Name), strings.Join(attrs, ", "))
+	}
+	for _, e := range g.Edges {
+		style := ""
+		if e.Kind == "import" {
+			style = " [style=dashed, label=import]"
+		}
+		dot += fmt.Sprintf("\t%s -> %s%s;\n", strconv.Quote(e.From), strconv.Quote(e.To), style)
+	}
+	return dot + "}\n"
+}
+
+// Mermaid returns the graph as a mermaid flowchart, with the layers colored
+// by their status.
+func (g *LayerGraph) Mermaid() string {
+	// mermaid ids can't have most of the characters in image names
+	ids := map[string]string{}
+	for i, n := range g.Nodes {
+		ids[n.Name] = fmt.Sprintf("n%d", i)
+	}
+
+	mermaid := "graph TD\n"
+	for _, n := range g.Nodes {
+		mermaid += fmt.Sprintf("    %s[\"%s\"]\n", ids[n.Name], strings.ReplaceAll(n.Name, `"`, "#quot;"))
+	}
+	for _, e := range g.Edges {
+		arrow := "-->"
+		if e.Kind == "import" {
+			arrow = "-. import .->"
+		}
+		mermaid += fmt.Sprintf("    %s %s %s\n", ids[e.From], arrow, ids[e.To])
+	}
+
+	for _, status := range []GraphStatus{GraphCached, GraphChanged, GraphAffected, GraphNew, GraphExternal} {
+		nodes := []string{}
+		for _, n := range g.Nodes {
+			if n.Status == status {
+				nodes = append(nodes, ids[n.Name])
+			}
+		}
+		if len(nodes) == 0 {
+			continue
+		}
+
+		if status == GraphExternal {
+			mermaid += "    classDef external fill:#fff,stroke-dasharray: 5 5\n"
+		} else {
+			mermaid += fmt.Sprintf("    classDef %s fill:%s\n", status, graphColors[status])
+		}
+		mermaid += fmt.Sprintf("    class %s %s\n", strings.Join(nodes, ","), status)
+	}
+
+	return mermaid
+}
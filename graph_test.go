@@ -0,0 +1,75 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/anuvu/stacker/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLayerGraph(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_graph_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	stackerfile := path.Join(dir, "stacker.yaml")
+	assert.NoError(ioutil.WriteFile(stackerfile, []byte(`base:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: make
+child:
+    from:
+        type: built
+        tag: base
+tools:
+    from:
+        type: docker
+        url: docker://centos:latest
+    import:
+        - stacker://base/usr/bin/tool
+        - stacker-oci://released/foo
+`), 0644))
+
+	config := types.StackerConfig{StackerDir: path.Join(dir, ".stacker"), OCIDir: path.Join(dir, "oci")}
+	g, err := NewLayerGraph(config, []string{stackerfile}, nil, true)
+	assert.NoError(err)
+
+	statuses := map[string]GraphStatus{}
+	for _, n := range g.Nodes {
+		statuses[n.Name] = n.Status
+	}
+	assert.Equal(map[string]GraphStatus{
+		"base":                   GraphNew,
+		"child":                  GraphNew,
+		"tools":                  GraphNew,
+		"docker://centos:latest": GraphExternal,
+		"released":               GraphExternal,
+	}, statuses)
+
+	assert.Contains(g.Edges, GraphEdge{From: "base", To: "child", Kind: "from"})
+	assert.Contains(g.Edges, GraphEdge{From: "base", To: "tools", Kind: "import"})
+	assert.Contains(g.Edges, GraphEdge{From: "docker://centos:latest", To: "tools", Kind: "from"})
+	assert.Len(g.Edges, 5)
+
+	dot := g.DOT()
+	assert.True(strings.HasPrefix(dot, "digraph stacker {\n"))
+	assert.Contains(dot, "\t\"base\" -> \"tools\" [style=dashed, label=import];\n")
+	assert.Contains(dot, "\t\"docker://centos:latest\" [style=dashed, tooltip=\"external\"];\n")
+
+	mermaid := g.Mermaid()
+	assert.Contains(mermaid, "n0[\"base\"]")
+	assert.Contains(mermaid, "n0 -. import .-> n2")
+	assert.Contains(mermaid, "class n0,n1,n2 new")
+
+	// layers that depend on one that will be rebuilt will be too
+	cache := &BuildCache{Cache: map[string]CacheEntry{"child": {}}}
+	assert.Equal(GraphAffected, layerGraphStatus(cache, "child", []string{"base"}, map[string]GraphStatus{"base": GraphChanged}))
+	assert.Equal(GraphNew, layerGraphStatus(cache, "base", nil, nil))
+}
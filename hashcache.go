@@ -0,0 +1,199 @@
+package stacker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"syscall"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+// fileStat is the part of a file's metadata that we use to decide whether it
+// has changed since we last hashed it.
+type fileStat struct {
+	Dev   uint64
+	Ino   uint64
+	Size  int64
+	Mode  os.FileMode
+	Mtime int64
+	Ctime int64
+}
+
+func newFileStat(info os.FileInfo) (fileStat, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileStat{}, false
+	}
+
+	return fileStat{
+		Dev:   uint64(st.Dev),
+		Ino:   st.Ino,
+		Size:  st.Size,
+		Mode:  info.Mode(),
+		Mtime: st.Mtim.Nano(),
+		Ctime: st.Ctim.Nano(),
+	}, true
+}
+
+type fileHash struct {
+	Stat fileStat
+	Hash string
+}
+
+// fileHashCache remembers file hashes keyed by the file's device, inode, size,
+// mode, mtime and ctime, so that large imports which haven't changed don't
+// need to be re-read on every build. When verify is set, every file is hashed
+// anyway, and we complain about any file whose content changed without its
+// metadata changing.
+type fileHashCache struct {
+	path    string
+	verify  bool
+	Version int                 `json:"version"`
+	Hashes  map[string]fileHash `json:"hashes"`
+}
+
+const currentFileHashCacheVersion = 1
+
+func openFileHashCache(config types.StackerConfig) *fileHashCache {
+	fhc := &fileHashCache{
+		path:    path.Join(config.StackerDir, "file-hashes.json"),
+		Version: currentFileHashCacheVersion,
+		Hashes:  map[string]fileHash{},
+	}
+
+	content, err := ioutil.ReadFile(fhc.path)
+	if err != nil {
+		return fhc
+	}
+
+	// this is just an optimization, so if it's corrupt or old we can just
+	// start from scratch.
+	existing := fileHashCache{}
+	if err := json.Unmarshal(content, &existing); err != nil || existing.Version != currentFileHashCacheVersion {
+		log.Debugf("ignoring invalid file hash cache %s: %v", fhc.path, err)
+		return fhc
+	}
+
+	if existing.Hashes != nil {
+		fhc.Hashes = existing.Hashes
+	}
+	return fhc
+}
+
+// hash returns the hash of kind for p, calling compute if p has changed since
+// the last time it was hashed.
+func (fhc *fileHashCache) hash(kind string, p string, info os.FileInfo, compute func() (string, error)) (string, error) {
+	st, ok := newFileStat(info)
+	if !ok {
+		return compute()
+	}
+
+	key := fmt.Sprintf("%s:%s", kind, p)
+	cached, ok := fhc.Hashes[key]
+	if ok && cached.Stat == st && !fhc.verify {
+		return cached.Hash, nil
+	}
+
+	h, err := compute()
+	if err != nil {
+		return "", err
+	}
+
+	if ok && cached.Stat == st && cached.Hash != h {
+		log.Infof("%s changed without its size or mtime changing", p)
+	}
+
+	fhc.Hashes[key] = fileHash{Stat: st, Hash: h}
+	return h, nil
+}
+
+// HashFile is lib.HashFile, but uses the cached hash if p hasn't changed.
+func (fhc *fileHashCache) HashFile(p string, includeMode bool) (string, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't stat %s for hashing", p)
+	}
+
+	return fhc.hash(fmt.Sprintf("sha256-%v", includeMode), p, info, func() (string, error) {
+		return lib.HashFile(p, includeMode)
+	})
+}
+
+func (fhc *fileHashCache) persist() error {
+	// forget about files that don't exist any more, so this doesn't grow
+	// forever.
+	for key := range fhc.Hashes {
+		p := strings.SplitN(key, ":", 2)[1]
+		if _, err := os.Lstat(p); err != nil {
+			delete(fhc.Hashes, key)
+		}
+	}
+
+	content, err := json.Marshal(fhc)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fhc.path, content, 0600)
+}
+
+var sha256KeywordFunc = reflect.ValueOf(mtree.KeywordFuncs["sha256digest"]).Pointer()
+
+// cachingFsEval is an mtree.FsEval that looks up sha256digests in a
+// fileHashCache instead of reading the files.
+type cachingFsEval struct {
+	mtree.DefaultFsEval
+	files *fileHashCache
+}
+
+func (fs cachingFsEval) KeywordFunc(fn mtree.KeywordFunc) mtree.KeywordFunc {
+	// All the digest keywords share an implementation, so this will also
+	// match e.g. md5digest. mtreeKeywords doesn't include any other
+	// digests, and if someone adds one, the check below will make the walk
+	// fail loudly instead of silently caching the wrong thing.
+	if reflect.ValueOf(fn).Pointer() != sha256KeywordFunc {
+		return fn
+	}
+
+	return func(p string, info os.FileInfo, r io.Reader) ([]mtree.KeyVal, error) {
+		if !info.Mode().IsRegular() {
+			return fn(p, info, r)
+		}
+
+		h, err := fs.files.hash("mtree", p, info, func() (string, error) {
+			kvs, err := fn(p, info, r)
+			if err != nil {
+				return "", err
+			}
+
+			if len(kvs) != 1 || kvs[0].Keyword() != "sha256digest" {
+				return "", errors.Errorf("unexpected digest for %s: %v", p, kvs)
+			}
+
+			return kvs[0].Value(), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return []mtree.KeyVal{mtree.KeyVal(fmt.Sprintf("sha256digest=%s", h))}, nil
+	}
+}
+
+func (fhc *fileHashCache) fsEval() mtree.FsEval {
+	if fhc == nil {
+		return nil
+	}
+
+	return cachingFsEval{files: fhc}
+}
@@ -0,0 +1,150 @@
+package stacker
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/anuvu/stacker/types"
+)
+
+// defaultRegistry is where docker:// urls without a registry in them are
+// pulled from.
+const defaultRegistry = "docker.io"
+
+// remoteHost returns the host the url of a base image (of type docker if
+// docker is true) or import is pulled from, or "" if it isn't pulled over
+// the network.
+func remoteHost(url string, docker bool) (string, error) {
+	parsed, err := types.NewDockerishUrl(url)
+	if err != nil {
+		return "", err
+	}
+
+	switch parsed.Scheme {
+	case "http", "https", "ftp", "rsync":
+		return parsed.Host, nil
+	case "docker":
+		if !docker {
+			return "", nil
+		}
+
+		// like containers/image, the first part of the path is
+		// the registry if it looks like a host name; otherwise
+		// (e.g. docker://centos:latest) it is part of the image's
+		// name
+		if parsed.Path == "" || !(strings.ContainsAny(parsed.Host, ".:") || parsed.Host == "localhost") {
+			return defaultRegistry, nil
+		}
+
+		return parsed.Host, nil
+	default:
+		return "", nil
+	}
+}
+
+// normalizeHost returns the host name of host (from a url, so e.g.
+// user@Registry.Example.COM.:5000 or [::1]:5000) the way patterns are
+// matched against it: lower case, without a trailing dot, and without the
+// user, IPv6 brackets or port, which is returned separately if there is one.
+func normalizeHost(host string) (string, string) {
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		host = host[i+1:]
+	}
+	host = strings.ToLower(host)
+
+	port := ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	host = strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ".")
+	return host, port
+}
+
+// hostAllowed returns true if host is allowed by the allowed and denied
+// glob patterns, which may or may not include the port. Denied patterns win,
+// and if there are no allowed patterns, anything that isn't denied is
+// allowed.
+func hostAllowed(host string, allowed []string, denied []string) bool {
+	hostname, port := normalizeHost(host)
+	candidates := []string{hostname}
+	if port != "" {
+		candidates = append(candidates, net.JoinHostPort(hostname, port))
+	}
+
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			pattern = strings.ToLower(pattern)
+			for _, candidate := range candidates {
+				if ok, _ := path.Match(pattern, candidate); ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if matches(denied) {
+		return false
+	}
+
+	return len(allowed) == 0 || matches(allowed)
+}
+
+// checkAllowedHosts makes sure that the layers in the stacker file at
+// path only pull their base images, imports and imports' signatures from the
+// hosts the stacker config allows, returning one error with all the urls that it doesn't.
+func checkAllowedHosts(config types.StackerConfig, path string, sf *types.Stackerfile) error {
+	if len(config.AllowedHosts) == 0 && len(config.DeniedHosts) == 0 {
+		return nil
+	}
+
+	violations := []string{}
+	check := func(name string, url string, docker bool) error {
+		host, err := remoteHost(url, docker)
+		if err != nil {
+			return err
+		}
+
+		if host != "" && !hostAllowed(host, config.AllowedHosts, config.DeniedHosts) {
+			violations = append(violations, fmt.Sprintf("%s: %s (from %s)", name, url, host))
+		}
+		return nil
+	}
+
+	for _, name := range sf.FileOrder {
+		l, ok := sf.Get(name)
+		if !ok {
+			continue
+		}
+
+		switch l.From.Type {
+		case types.DockerLayer, types.TarLayer:
+			if err := check(name, l.From.Url, l.From.Type == types.DockerLayer); err != nil {
+				return err
+			}
+		}
+
+		for _, i := range l.Import {
+			urls := append([]string{i.Path}, i.Mirrors...)
+			// signatures are fetched too; without a sig of its own, it's
+			// next to the path
+			if i.GPG != nil && i.GPG.Sig != "" {
+				urls = append(urls, i.GPG.Sig)
+			}
+
+			for _, url := range urls {
+				if err := check(name, url, false); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		return types.KindErrorf(types.PolicyError, "%s pulls from hosts the stacker config doesn't allow:\n%s", path, strings.Join(violations, "\n"))
+	}
+
+	return nil
+}
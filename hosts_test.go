@@ -0,0 +1,95 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/anuvu/stacker/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteHost(t *testing.T) {
+	assert := assert.New(t)
+
+	for url, host := range map[string]string{
+		"docker://centos:latest":                  "docker.io",
+		"docker://library/centos:latest":          "docker.io",
+		"docker://registry.example.com/centos:8":  "registry.example.com",
+		"docker://localhost:5000/centos:8":        "localhost:5000",
+		"https://example.com/files/thing.tar.gz":  "example.com",
+		"http://example.com:8080/files/thing.tar": "example.com:8080",
+		"ftp://ftp.example.com/pub/firmware.bin":  "ftp.example.com",
+		"rsync://mirror.example.com/module/dir":   "mirror.example.com",
+		"stacker://build/usr/bin/thing":           "",
+		"stacker-oci://image/thing":               "",
+		"/home/me/thing.tar":                      "",
+	} {
+		result, err := remoteHost(url, true)
+		assert.NoError(err)
+		assert.Equal(host, result, url)
+	}
+
+	// imports aren't pulled with docker://
+	result, err := remoteHost("docker://registry.example.com/centos:8", false)
+	assert.NoError(err)
+	assert.Equal("", result)
+}
+
+func TestHostAllowed(t *testing.T) {
+	assert := assert.New(t)
+
+	allowed := []string{"*.example.com", "localhost"}
+	denied := []string{"evil.example.com"}
+
+	assert.True(hostAllowed("registry.example.com", allowed, denied))
+	assert.True(hostAllowed("localhost:5000", allowed, denied))
+	assert.False(hostAllowed("evil.example.com:443", allowed, denied))
+	assert.False(hostAllowed("docker.io", allowed, denied))
+	assert.True(hostAllowed("docker.io", nil, denied))
+	assert.False(hostAllowed("evil.example.com", nil, denied))
+
+	// the same hosts, written differently
+	assert.False(hostAllowed("EVIL.Example.com", nil, denied))
+	assert.False(hostAllowed("evil.example.com.", nil, denied))
+	assert.False(hostAllowed("evil.example.com.:443", nil, denied))
+	assert.False(hostAllowed("user@evil.example.com", nil, denied))
+	assert.True(hostAllowed("Registry.Example.com.:5000", allowed, denied))
+
+	assert.True(hostAllowed("[::1]:5000", []string{"::1"}, nil))
+	assert.False(hostAllowed("[::1]:5000", []string{"::2"}, nil))
+	assert.False(hostAllowed("[::1]", nil, []string{"::1"}))
+}
+
+func TestCheckAllowedHostsSignatures(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker-hosts-test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "stacker.yaml")
+	content := `app:
+    from:
+        type: oci
+        url: /srv/oci:base
+    import:
+        - path: https://files.example.com/app.tar.gz
+          gpg:
+              keyring: keys.gpg
+              sig: https://evil.example.com/app.tar.gz.asc
+`
+	assert.NoError(ioutil.WriteFile(file, []byte(content), 0644))
+
+	sf, err := types.NewStackerfile(file, nil)
+	assert.NoError(err)
+
+	config := types.StackerConfig{AllowedHosts: []string{"files.example.com"}}
+	err = checkAllowedHosts(config, file, sf)
+	assert.Error(err)
+	assert.Contains(err.Error(), "app: https://evil.example.com/app.tar.gz.asc (from evil.example.com)")
+
+	config.AllowedHosts = append(config.AllowedHosts, "evil.example.com")
+	assert.NoError(checkAllowedHosts(config, file, sf))
+}
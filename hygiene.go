@@ -0,0 +1,363 @@
+package stacker
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/anuvu/stacker/log"
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// the hygiene checks, as they are called in the stacker config
+const (
+	escapingSymlinks  = "escaping_symlinks"
+	setuidFiles       = "setuid_files"
+	worldWritableDirs = "world_writable_dirs"
+	leakedSecrets     = "secrets"
+)
+
+// maxSymlinkHops is how many symlinks are followed when resolving a path
+// in an image before giving up, like the kernel's limit.
+const maxSymlinkHops = 40
+
+// hygieneProblem is something a layer adds that one of the hygiene checks
+// doesn't like.
+type hygieneProblem struct {
+	check string
+	path  string
+	why   string
+}
+
+func (p hygieneProblem) String() string {
+	return fmt.Sprintf("%s: /%s %s", p.check, p.path, p.why)
+}
+
+// hygienePolicies returns the policy of each of the hygiene checks.
+func hygienePolicies(checks types.HygieneChecks) (map[string]string, error) {
+	policies := map[string]string{
+		escapingSymlinks:  checks.EscapingSymlinks,
+		setuidFiles:       checks.SetuidFiles,
+		worldWritableDirs: checks.WorldWritableDirs,
+		leakedSecrets:     checks.Secrets,
+	}
+
+	for check, policy := range policies {
+		switch policy {
+		case "":
+			policies[check] = "ignore"
+		case "ignore", "warn", "error":
+		default:
+			return nil, errors.Errorf("unknown %s policy %s, it should be ignore, warn or error", check, policy)
+		}
+	}
+
+	return policies, nil
+}
+
+// checkLayerHygiene runs the hygiene checks on the layers that building name
+// added to its tar output, i.e. the ones its base image doesn't have. The
+// problems found by checks whose policy is warn are logged, and any found by
+// checks whose policy is error fail the build.
+func checkLayerHygiene(config types.StackerConfig, oci casext.Engine, name string, layerTypes []types.LayerType, sfm types.StackerFiles) error {
+	policies, err := hygienePolicies(config.HygieneChecks)
+	if err != nil {
+		return err
+	}
+
+	enabled := false
+	for _, policy := range policies {
+		if policy != "ignore" {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return nil
+	}
+
+	hasTar := false
+	for _, layerType := range layerTypes {
+		if layerType == "tar" {
+			hasTar = true
+		}
+	}
+	if !hasTar {
+		log.Infof("WARNING: %s has no tar output, skipping its hygiene checks", name)
+		return nil
+	}
+
+	// only the secrets check needs to read the files' content
+	var scanner *secretScanner
+	if policies[leakedSecrets] != "ignore" {
+		scanner, err = newSecretScanner(config.HygieneChecks.SecretPatterns)
+		if err != nil {
+			return err
+		}
+	}
+
+	manifest, err := stackeroci.LookupManifest(oci, name)
+	if err != nil {
+		return err
+	}
+
+	baseLayers := map[digest.Digest]bool{}
+	_, err = withBaseImage(config, oci, name, sfm, func(layout casext.Engine, base ispec.Manifest) error {
+		for _, desc := range base.Layers {
+			baseLayers[desc.Digest] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	problems := []hygieneProblem{}
+	absLinks := map[string]string{}
+	for _, desc := range manifest.Layers {
+		if baseLayers[desc.Digest] {
+			continue
+		}
+
+		layer, err := stackeroci.OpenTarLayer(oci, desc)
+		if err != nil {
+			return err
+		}
+
+		found, links, err := layerProblems(layer, scanner)
+		layer.Close()
+		if err != nil {
+			return errors.Wrapf(err, "couldn't check layer %s", desc.Digest)
+		}
+
+		problems = append(problems, found...)
+		for link, target := range links {
+			absLinks[link] = target
+		}
+	}
+
+	// whether an absolute symlink points at something in the image
+	// depends on all of the image's layers, not just the new ones
+	if len(absLinks) > 0 && policies[escapingSymlinks] != "ignore" {
+		index := imageIndex{}
+		for _, desc := range manifest.Layers {
+			layer, err := stackeroci.OpenTarLayer(oci, desc)
+			if err != nil {
+				return err
+			}
+
+			err = index.addLayer(layer)
+			layer.Close()
+			if err != nil {
+				return errors.Wrapf(err, "couldn't index layer %s", desc.Digest)
+			}
+		}
+
+		for link, target := range absLinks {
+			if !index.exists(target) {
+				problems = append(problems, hygieneProblem{escapingSymlinks, link, fmt.Sprintf("points at %s, which isn't in the image", target)})
+			}
+		}
+	}
+
+	failed := []string{}
+	for _, p := range problems {
+		switch policies[p.check] {
+		case "warn":
+			log.Infof("WARNING: %s: %s", name, p)
+		case "error":
+			failed = append(failed, p.String())
+		}
+	}
+
+	if len(failed) > 0 {
+		return types.KindErrorf(types.PolicyError, "%s failed its hygiene checks:\n%s", name, strings.Join(failed, "\n"))
+	}
+
+	return nil
+}
+
+// layerProblems returns the problems with the files in the tar layer, as
+// well as its absolute symlinks (by path, without the leading /), which can
+// only be checked against the whole image. If scanner isn't nil, the regular
+// files are also scanned for secrets.
+func layerProblems(layer io.Reader, scanner *secretScanner) ([]hygieneProblem, map[string]string, error) {
+	problems := []hygieneProblem{}
+	absLinks := map[string]string{}
+
+	tr := tar.NewReader(layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return problems, absLinks, nil
+		}
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			if path.IsAbs(hdr.Linkname) {
+				absLinks[name] = hdr.Linkname
+			} else if climbsOutOfRoot(path.Dir(name), hdr.Linkname) {
+				problems = append(problems, hygieneProblem{escapingSymlinks, name, fmt.Sprintf("points at %s, which is above /", hdr.Linkname)})
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if hdr.Mode&06000 != 0 {
+				problems = append(problems, hygieneProblem{setuidFiles, name, fmt.Sprintf("is setuid or setgid (%04o)", hdr.Mode&07777)})
+			}
+
+			if scanner != nil {
+				what, err := scanner.scan(name, hdr.Size, tr)
+				if err != nil {
+					return nil, nil, errors.Wrapf(err, "couldn't scan %s", name)
+				}
+				if what != "" {
+					problems = append(problems, hygieneProblem{leakedSecrets, name, "looks like " + what})
+				}
+			}
+		case tar.TypeDir:
+			if hdr.Mode&02 != 0 && hdr.Mode&01000 == 0 {
+				problems = append(problems, hygieneProblem{worldWritableDirs, name, fmt.Sprintf("is world writable without the sticky bit (%04o)", hdr.Mode&07777)})
+			}
+		}
+	}
+}
+
+// climbsOutOfRoot returns true if the relative symlink target in dir (a path
+// in the image, without the leading /) goes above the image's /.
+func climbsOutOfRoot(dir string, target string) bool {
+	depth := 0
+	for _, part := range strings.Split(dir, "/") {
+		if part != "" && part != "." {
+			depth++
+		}
+	}
+
+	for _, part := range strings.Split(target, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			depth--
+			if depth < 0 {
+				return true
+			}
+		default:
+			depth++
+		}
+	}
+
+	return false
+}
+
+// imageIndex is the tar headers of the files in an image, by path (without
+// the leading /).
+type imageIndex map[string]*tar.Header
+
+// addLayer applies the tar layer to the index: its whiteouts delete the
+// files from the layers below it, and then its files are added.
+func (idx imageIndex) addLayer(layer io.Reader) error {
+	hdrs := []*tar.Header{}
+	tr := tar.NewReader(layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		dir, base := path.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+
+		switch {
+		case base == opaqueWhiteout:
+			idx.deleteUnder(dir)
+		case strings.HasPrefix(base, whiteoutPrefix):
+			deleted := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			delete(idx, deleted)
+			idx.deleteUnder(deleted)
+		default:
+			hdr.Name = name
+			hdrs = append(hdrs, hdr)
+		}
+	}
+
+	for _, hdr := range hdrs {
+		idx[hdr.Name] = hdr
+
+		// layers don't always have the directories their files are
+		// in
+		for dir := path.Dir(hdr.Name); dir != "." && idx[dir] == nil; dir = path.Dir(dir) {
+			idx[dir] = &tar.Header{Name: dir, Typeflag: tar.TypeDir}
+		}
+	}
+
+	return nil
+}
+
+// deleteUnder deletes the files under dir from the index.
+func (idx imageIndex) deleteUnder(dir string) {
+	prefix := dir + "/"
+	for name := range idx {
+		if dir == "" || strings.HasPrefix(name, prefix) {
+			delete(idx, name)
+		}
+	}
+}
+
+// exists returns true if target, an absolute path in the image, exists once
+// the symlinks along it are followed.
+func (idx imageIndex) exists(target string) bool {
+	hops := 0
+	resolved := ""
+	parts := strings.Split(target, "/")
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = strings.TrimSuffix(path.Dir(resolved), ".")
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		hdr, ok := idx[next]
+		if !ok {
+			return false
+		}
+
+		if hdr.Typeflag != tar.TypeSymlink {
+			resolved = next
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return false
+		}
+
+		if path.IsAbs(hdr.Linkname) {
+			resolved = ""
+		}
+		parts = append(strings.Split(hdr.Linkname, "/"), parts...)
+	}
+
+	return true
+}
@@ -0,0 +1,200 @@
+package stacker
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/squashfs"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// StatImageFile returns the info of file in the image tag in the OCI output,
+// without extracting the image.
+func StatImageFile(sc types.StackerConfig, tag string, file string) (*ImageFile, error) {
+	return lookupInImage(sc.OCIDir, tag, cleanImagePath(file), "")
+}
+
+// CatImageFile writes the contents of the regular file file in the image tag
+// in the OCI output to w, without extracting the image.
+func CatImageFile(sc types.StackerConfig, tag string, file string, w io.Writer) error {
+	dir, err := ioutil.TempDir("", "stacker-cat-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(dir)
+
+	target := cleanImagePath(file)
+	dest := path.Join(dir, path.Base(target))
+	if _, err := lookupInImage(sc.OCIDir, tag, target, dest); err != nil {
+		return err
+	}
+
+	f, err := os.Open(dest)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return errors.WithStack(err)
+}
+
+// ListImageFiles returns the files in the image tag in the OCI output that are
+// dir or in it, sorted by path, without extracting the image: the layers'
+// tar headers, or for squashfs layers, their listings, are read from the
+// bottom up and their whiteouts applied.
+func ListImageFiles(sc types.StackerConfig, tag string, dir string) ([]ImageFile, error) {
+	unlock, err := LockOCILayout(sc.OCIDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	oci, err := stackeroci.OpenLayout(sc.OCIDir)
+	if err != nil {
+		return nil, err
+	}
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]ImageFile{}
+	for _, desc := range manifest.Layers {
+		if desc.MediaType == stackeroci.MediaTypeLayerSquashfs || desc.MediaType == stackeroci.ImpoliteMediaTypeLayerSquashfs {
+			blob := path.Join(sc.OCIDir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+			err = listSquashfsLayer(files, blob, desc.Digest)
+		} else {
+			layer, err2 := stackeroci.OpenTarLayer(oci, desc)
+			if err2 != nil {
+				return nil, err2
+			}
+
+			err = listTarLayer(files, layer, desc.Digest)
+			layer.Close()
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't list layer %s", desc.Digest)
+		}
+	}
+
+	dir = cleanImagePath(dir)
+	result := []ImageFile{}
+	for p, f := range files {
+		if dir == "" || p == dir || strings.HasPrefix(p, dir+"/") {
+			result = append(result, f)
+		}
+	}
+
+	if len(result) == 0 {
+		return nil, errors.Errorf("%s not found in %s", dir, tag)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Path < result[j].Path })
+	return result, nil
+}
+
+// deleteImageFile deletes p and everything in it from files, for a whiteout
+// in layer, which only deletes the files of the layers below.
+func deleteImageFile(files map[string]ImageFile, p string, layer digest.Digest) {
+	if f, ok := files[p]; ok && f.Layer != layer {
+		delete(files, p)
+	}
+	deleteImageFileChildren(files, p, layer)
+}
+
+func deleteImageFileChildren(files map[string]ImageFile, dir string, layer digest.Digest) {
+	for p, f := range files {
+		if f.Layer != layer && (dir == "" || strings.HasPrefix(p, dir+"/")) {
+			delete(files, p)
+		}
+	}
+}
+
+// addImageFile adds f to files, which has the files of the layers below.
+func addImageFile(files map[string]ImageFile, f ImageFile) {
+	// a file replacing a directory deletes what was in it
+	if old, ok := files[f.Path]; ok && old.Mode.IsDir() && !f.Mode.IsDir() {
+		deleteImageFileChildren(files, f.Path, f.Layer)
+	}
+
+	files[f.Path] = f
+}
+
+// listTarLayer applies the tar layer to files.
+func listTarLayer(files map[string]ImageFile, layer io.Reader, layerDigest digest.Digest) error {
+	tr := tar.NewReader(layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := cleanImagePath(hdr.Name)
+		dir, base := path.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+
+		if base == opaqueWhiteout {
+			deleteImageFileChildren(files, dir, layerDigest)
+			continue
+		}
+
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			deleteImageFile(files, path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)), layerDigest)
+			continue
+		}
+
+		addImageFile(files, ImageFile{
+			Path:     name,
+			Mode:     hdr.FileInfo().Mode(),
+			Uid:      hdr.Uid,
+			Gid:      hdr.Gid,
+			Size:     hdr.Size,
+			Linkname: hdr.Linkname,
+			Xattrs:   tarXattrs(hdr),
+			Layer:    layerDigest,
+		})
+	}
+}
+
+// listSquashfsLayer applies the squashfs layer to files. Only the listing of
+// the layer is read, so xattr whiteouts and opaque directories aren't
+// noticed.
+func listSquashfsLayer(files map[string]ImageFile, blob string, layerDigest digest.Digest) error {
+	entries, err := squashfs.List(blob)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.Whiteout {
+			deleteImageFile(files, e.Path, layerDigest)
+			continue
+		}
+
+		addImageFile(files, ImageFile{
+			Path:     e.Path,
+			Mode:     e.Mode,
+			Uid:      e.Uid,
+			Gid:      e.Gid,
+			Size:     e.Size,
+			Linkname: e.Linkname,
+			Layer:    layerDigest,
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package stacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListTarLayer(t *testing.T) {
+	assert := assert.New(t)
+
+	layer := func(hdrs ...tar.Header) *bytes.Buffer {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for _, hdr := range hdrs {
+			hdr := hdr
+			if hdr.Typeflag == 0 {
+				hdr.Typeflag = tar.TypeReg
+			}
+			assert.NoError(tw.WriteHeader(&hdr))
+		}
+		assert.NoError(tw.Close())
+		return buf
+	}
+
+	files := map[string]ImageFile{}
+	base := digest.FromString("base")
+	assert.NoError(listTarLayer(files, layer(
+		tar.Header{Name: "./", Mode: 0755, Typeflag: tar.TypeDir},
+		tar.Header{Name: "etc/", Mode: 0755, Typeflag: tar.TypeDir},
+		tar.Header{Name: "etc/passwd", Mode: 0644},
+		tar.Header{Name: "etc/shadow", Mode: 0600},
+		tar.Header{Name: "opt/", Mode: 0755, Typeflag: tar.TypeDir},
+		tar.Header{Name: "opt/app", Mode: 0755},
+		tar.Header{Name: "lib/", Mode: 0755, Typeflag: tar.TypeDir},
+		tar.Header{Name: "lib/libc.so", Mode: 0755},
+	), base))
+
+	top := digest.FromString("top")
+	assert.NoError(listTarLayer(files, layer(
+		tar.Header{Name: "etc/passwd", Mode: 0644, Uid: 1000},
+		tar.Header{Name: "etc/.wh.shadow"},
+		tar.Header{Name: "opt/new", Mode: 0755},
+		tar.Header{Name: "opt/.wh..wh..opq"},
+		tar.Header{Name: "lib", Linkname: "usr/lib", Typeflag: tar.TypeSymlink},
+	), top))
+
+	paths := map[string]digest.Digest{}
+	for p, f := range files {
+		paths[p] = f.Layer
+	}
+	assert.Equal(map[string]digest.Digest{
+		"":           base,
+		"etc":        base,
+		"etc/passwd": top,
+		"opt":        base,
+		"opt/new":    top,
+		"lib":        top,
+	}, paths)
+	assert.Equal(1000, files["etc/passwd"].Uid)
+	assert.Equal("usr/lib", files["lib"].Linkname)
+}
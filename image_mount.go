@@ -0,0 +1,216 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/mount"
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// imageMountDir is where the layer mounts (and the tmpfs upper, if any)
+// under the image mounted at target are kept, named after target so that
+// UnmountImage can find them.
+func imageMountDir(config types.StackerConfig, target string) string {
+	return path.Join(config.StackerDir, "mounts", digest.FromString(target).Encoded()[:16])
+}
+
+// MountImage mounts the squashfs image tag in the OCI output at target: each
+// of its layers is mounted read only, and they're combined with overlay. If
+// writable is set, the overlay has a tmpfs upper dir, so that things can be
+// written to it; they're lost when it's unmounted.
+func MountImage(config types.StackerConfig, tag string, target string, writable bool) error {
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	mounted, err := mount.IsMountpoint(target)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		return errors.Errorf("%s is already a mountpoint", target)
+	}
+
+	unlock, err := LockOCILayout(config.OCIDir, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	oci, err := stackeroci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return err
+	}
+
+	if len(manifest.Layers) == 0 {
+		return errors.Errorf("%s has no layers", tag)
+	}
+
+	for _, desc := range manifest.Layers {
+		if desc.MediaType != stackeroci.MediaTypeLayerSquashfs && desc.MediaType != stackeroci.ImpoliteMediaTypeLayerSquashfs {
+			return errors.Errorf("%s's layer %s is %s, not squashfs; convert it with stacker convert-layers --to squashfs", tag, desc.Digest, desc.MediaType)
+		}
+	}
+
+	dir := imageMountDir(config, target)
+	if _, err := os.Stat(dir); err == nil {
+		return errors.Errorf("something was already mounted at %s; stacker umount it first", target)
+	}
+
+	// whatever was mounted so far is unmounted if something fails
+	success := false
+	defer func() {
+		if !success {
+			unmountImageDir(dir)
+		}
+	}()
+
+	// overlayfs wants the top most lowerdir first
+	lowerdirs := ""
+	for i, desc := range manifest.Layers {
+		layer := path.Join(dir, "layers", strconv.Itoa(i))
+		blob := path.Join(config.OCIDir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+		if err := mountSquashfs(blob, layer); err != nil {
+			return errors.Wrapf(err, "couldn't mount layer %s", desc.Digest)
+		}
+
+		if lowerdirs != "" {
+			lowerdirs = ":" + lowerdirs
+		}
+		lowerdirs = layer + lowerdirs
+	}
+
+	opts := "lowerdir=" + lowerdirs
+	flags := uintptr(unix.MS_RDONLY)
+	if writable {
+		tmpfs := path.Join(dir, "tmpfs")
+		if err := os.MkdirAll(tmpfs, 0755); err != nil {
+			return errors.WithStack(err)
+		}
+
+		log.SubsystemDebugf(log.Storage, "mount -t tmpfs tmpfs %s", tmpfs)
+		if err := unix.Mount("tmpfs", tmpfs, "tmpfs", 0, "mode=0755"); err != nil {
+			return errors.Wrapf(err, "couldn't mount tmpfs")
+		}
+
+		for _, d := range []string{"upper", "work"} {
+			if err := os.Mkdir(path.Join(tmpfs, d), 0755); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		opts += fmt.Sprintf(",upperdir=%s,workdir=%s", path.Join(tmpfs, "upper"), path.Join(tmpfs, "work"))
+		flags = 0
+	} else if len(manifest.Layers) == 1 {
+		// overlay doesn't work with one lowerdir and no upperdir
+		empty := path.Join(dir, "empty")
+		if err := os.MkdirAll(empty, 0755); err != nil {
+			return errors.WithStack(err)
+		}
+		opts += ":" + empty
+	}
+
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.SubsystemDebugf(log.Storage, "mount -t overlay -o %s overlay %s", opts, target)
+	if err := unix.Mount("overlay", target, "overlay", flags, opts); err != nil {
+		return errors.Wrapf(err, "couldn't mount %s at %s", tag, target)
+	}
+
+	success = true
+	return nil
+}
+
+// mountSquashfs mounts the squashfs image at blob read only at dest.
+func mountSquashfs(blob string, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	dev, err := lib.AttachToLoop(blob, true)
+	if err != nil {
+		return err
+	}
+	// the loop device is freed once the squashfs on it is unmounted
+	defer dev.Detach()
+
+	log.SubsystemDebugf(log.Storage, "mount -t squashfs -o ro %s %s", dev.Path(), dest)
+	return errors.WithStack(unix.Mount(dev.Path(), dest, "squashfs", unix.MS_RDONLY, ""))
+}
+
+// UnmountImage unmounts an image MountImage mounted at target, and the layer
+// mounts under it.
+func UnmountImage(config types.StackerConfig, target string) error {
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	dir := imageMountDir(config, target)
+	if _, err := os.Stat(dir); err != nil {
+		return errors.Errorf("no image was mounted at %s by stacker", target)
+	}
+
+	mounted, err := mount.IsMountpoint(target)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		log.SubsystemDebugf(log.Storage, "umount %s", target)
+		if err := unix.Unmount(target, 0); err != nil {
+			return errors.Wrapf(err, "couldn't unmount %s", target)
+		}
+	}
+
+	return unmountImageDir(dir)
+}
+
+// unmountImageDir unmounts the layers and tmpfs in an image's mount dir, and
+// removes it.
+func unmountImageDir(dir string) error {
+	mounts := []string{path.Join(dir, "tmpfs")}
+	layers, err := ioutil.ReadDir(path.Join(dir, "layers"))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	for _, layer := range layers {
+		mounts = append(mounts, path.Join(dir, "layers", layer.Name()))
+	}
+
+	for _, m := range mounts {
+		mounted, err := mount.IsMountpoint(m)
+		if err != nil {
+			return err
+		}
+		if !mounted {
+			continue
+		}
+
+		log.SubsystemDebugf(log.Storage, "umount %s", m)
+		if err := unix.Unmount(m, 0); err != nil {
+			return errors.Wrapf(err, "couldn't unmount %s", m)
+		}
+	}
+
+	return errors.WithStack(os.RemoveAll(dir))
+}
@@ -1,6 +1,7 @@
 package stacker
 
 import (
+	"fmt"
 	"github.com/opencontainers/go-digest"
 	"io/ioutil"
 	"os"
@@ -8,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/limits"
 	"github.com/anuvu/stacker/log"
 	"github.com/anuvu/stacker/types"
 	"github.com/pkg/errors"
@@ -16,7 +18,7 @@ import (
 )
 
 // filesDiffer returns true if the files are different, false if they are the same.
-func filesDiffer(p1 string, info1 os.FileInfo, p2 string, info2 os.FileInfo) (bool, error) {
+func filesDiffer(p1 string, info1 os.FileInfo, p2 string, info2 os.FileInfo, files *fileHashCache) (bool, error) {
 	if info1.Name() != info2.Name() {
 		return false, errors.Errorf("comparing files without the same name?")
 	}
@@ -46,6 +48,22 @@ func filesDiffer(p1 string, info1 os.FileInfo, p2 string, info2 os.FileInfo) (bo
 		return true, nil
 	}
 
+	// if we're not verifying, compare the (probably cached) hashes instead
+	// of reading both files in their entirety.
+	if !files.verify {
+		h1, err := files.HashFile(p1, false)
+		if err != nil {
+			return false, err
+		}
+
+		h2, err := files.HashFile(p2, false)
+		if err != nil {
+			return false, err
+		}
+
+		return h1 != h2, nil
+	}
+
 	f1, err := os.Open(p1)
 	if err != nil {
 		return false, err
@@ -84,7 +102,7 @@ func verifyImportFileHash(imp string, hash string) error {
 	return nil
 }
 
-func importFile(imp string, cacheDir string, hash string) (string, error) {
+func importFile(imp string, cacheDir string, hash string, files *fileHashCache) (string, error) {
 	e1, err := os.Lstat(imp)
 	if err != nil {
 		return "", errors.Wrapf(err, "couldn't stat import %s", imp)
@@ -101,7 +119,7 @@ func importFile(imp string, cacheDir string, hash string) (string, error) {
 		if err != nil {
 			needsCopy = true
 		} else {
-			differ, err := filesDiffer(imp, e1, dest, e2)
+			differ, err := filesDiffer(imp, e1, dest, e2, files)
 			if err != nil {
 				return "", err
 			}
@@ -125,12 +143,12 @@ func importFile(imp string, cacheDir string, hash string) (string, error) {
 		return "", errors.Wrapf(err, "failed making cache dir")
 	}
 
-	existing, err := walkImport(dest)
+	existing, err := walkImport(dest, files)
 	if err != nil {
 		return "", errors.Wrapf(err, "failed walking existing import dir")
 	}
 
-	toImport, err := walkImport(imp)
+	toImport, err := walkImport(imp, files)
 	if err != nil {
 		return "", errors.Wrapf(err, "failed walking dir to import")
 	}
@@ -213,7 +231,7 @@ func validateHash(hash string) error {
 	return nil
 }
 
-func acquireUrl(c types.StackerConfig, storage types.Storage, i string, cache string, progress bool, hash string) (string, error) {
+func acquireUrl(c types.StackerConfig, storage types.Storage, i string, cache string, progress bool, hash string, files *fileHashCache) (string, error) {
 	url, err := types.NewDockerishUrl(i)
 	if err != nil {
 		return "", err
@@ -226,7 +244,7 @@ func acquireUrl(c types.StackerConfig, storage types.Storage, i string, cache st
 
 	// It's just a path, let's copy it to .stacker.
 	if url.Scheme == "" {
-		return importFile(i, cache, hash)
+		return importFile(i, cache, hash, files)
 	} else if url.Scheme == "http" || url.Scheme == "https" {
 		// otherwise, we need to download it
 		// first verify the hashes
@@ -242,7 +260,54 @@ func acquireUrl(c types.StackerConfig, storage types.Storage, i string, cache st
 			return "", errors.Errorf("The requested hash of %s import is different than the actual hash: %s != %s",
 				i, hash, remoteHash)
 		}
+		release, err := limits.Acquire(c, limits.Network)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+
 		return Download(cache, i, progress, remoteHash, remoteSize)
+	} else if url.Scheme == "ftp" {
+		// ftp servers can say how big a file is, but not its hash, so
+		// a previous download is checked against the expected one
+		remoteSize, remoteMtime, err := getFtpFileInfo(i)
+		if err != nil {
+			log.Infof("cannot obtain file info of %s", i)
+		}
+		log.Debugf("Remote file: length: %s mtime: %v", remoteSize, remoteMtime)
+
+		release, err := limits.Acquire(c, limits.Network)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+
+		p, err := ftpDownload(cache, i, progress, strings.ToLower(hash), remoteSize, remoteMtime)
+		if err != nil {
+			return "", err
+		}
+
+		return p, verifyImportFileHash(p, hash)
+	} else if url.Scheme == "rsync" {
+		release, err := limits.Acquire(c, limits.Network)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+
+		p, err := rsyncDownload(cache, i)
+		if err != nil {
+			return "", err
+		}
+
+		if st, err := os.Stat(p); err == nil && !st.IsDir() {
+			err = verifyImportFileHash(p, hash)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		return p, nil
 	} else if url.Scheme == "stacker" {
 		// we always Grab() things from stacker://, because we need to
 		// mount the container's rootfs to get them and don't
@@ -264,12 +329,83 @@ func acquireUrl(c types.StackerConfig, storage types.Storage, i string, cache st
 			return "", err
 		}
 
+		return p, nil
+	} else if url.Scheme == "stacker-output" {
+		p, err := findLayerOutput(c, url.Host, strings.TrimPrefix(url.Path, "/"))
+		if err != nil {
+			return "", err
+		}
+
+		return importFile(p, cache, hash, files)
+	} else if url.Scheme == "stacker-oci" {
+		p, err := importFromOCI(c, url.Host, url.Path, cache)
+		if err != nil {
+			return "", err
+		}
+
+		err = verifyImportFileHash(p, hash)
+		if err != nil {
+			return "", err
+		}
+
 		return p, nil
 	}
 
 	return "", errors.Errorf("unsupported url scheme %s", i)
 }
 
+// acquireImport acquires i like acquireUrl does, trying each of its mirrors
+// in order if it can't be acquired from its path.
+func acquireImport(c types.StackerConfig, storage types.Storage, i types.Import, cache string, progress bool, files *fileHashCache) (string, error) {
+	if len(i.Mirrors) == 0 {
+		return acquireUrl(c, storage, i.Path, cache, progress, i.Hash, files)
+	}
+
+	failures := []string{}
+	for _, url := range append([]string{i.Path}, i.Mirrors...) {
+		p, err := acquireMirror(c, storage, i, url, cache, progress, files)
+		if err == nil {
+			return p, nil
+		}
+
+		log.Infof("WARNING: couldn't import %s from %s: %v", path.Base(i.Path), url, err)
+		failures = append(failures, fmt.Sprintf("%s: %v", url, err))
+	}
+
+	return "", errors.Errorf("couldn't import %s from any of its urls:\n%s", i.Path, strings.Join(failures, "\n"))
+}
+
+// acquireMirror acquires i from url, its path or one of its mirrors, and
+// makes sure it's named after its path, whatever the mirror calls it.
+func acquireMirror(c types.StackerConfig, storage types.Storage, i types.Import, url string, cache string, progress bool, files *fileHashCache) (string, error) {
+	p, err := acquireUrl(c, storage, url, cache, progress, i.Hash, files)
+	if err != nil {
+		return "", err
+	}
+
+	// the mirrors should all serve the same file, but the hash of a
+	// download is otherwise only checked against what the server says
+	// it is
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		if err := verifyImportFileHash(p, i.Hash); err != nil {
+			os.RemoveAll(p)
+			return "", err
+		}
+	}
+
+	name := path.Join(cache, path.Base(i.Path))
+	if p != name {
+		if err := os.RemoveAll(name); err != nil {
+			return "", errors.WithStack(err)
+		}
+		if err := os.Rename(p, name); err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+
+	return name, nil
+}
+
 func CleanImportsDir(c types.StackerConfig, name string, imports types.Imports, cache *BuildCache) error {
 	dir := path.Join(c.StackerDir, "imports", name)
 
@@ -280,12 +416,18 @@ func CleanImportsDir(c types.StackerConfig, name string, imports types.Imports,
 		return os.RemoveAll(dir)
 	}
 
+	l, ok := cache.sfm.LookupLayerDefinition(name)
+	if !ok {
+		return errors.Errorf("%s missing from stackerfile?", name)
+	}
+	normalizer := cache.normalizer(l.ReferenceDirectory())
+
 	// If the base name of two things was the same across builds
 	// but the URL they were imported from was different, let's
 	// make sure we invalidate the cached version.
 	for _, i := range imports {
 		for cached := range cacheEntry.Imports {
-			if path.Base(cached) == path.Base(i.Path) && cached != i.Path {
+			if path.Base(cached) == path.Base(i.Path) && cached != normalizer.Replace(i.Path) {
 				log.Infof("%s url changed to %s, pruning cache", cached, i.Path)
 				err := os.RemoveAll(path.Join(dir, path.Base(i.Path)))
 				if err != nil {
@@ -298,7 +440,7 @@ func CleanImportsDir(c types.StackerConfig, name string, imports types.Imports,
 	return nil
 }
 
-func Import(c types.StackerConfig, storage types.Storage, name string, imports types.Imports, progress bool) error {
+func Import(c types.StackerConfig, storage types.Storage, name string, imports types.Imports, cache *BuildCache, progress bool) error {
 	dir := path.Join(c.StackerDir, "imports", name)
 
 	if err := os.MkdirAll(dir, 0755); err != nil {
@@ -311,11 +453,15 @@ func Import(c types.StackerConfig, storage types.Storage, name string, imports t
 	}
 
 	for _, i := range imports {
-		name, err := acquireUrl(c, storage, i.Path, dir, progress, i.Hash)
+		name, err := acquireImport(c, storage, i, dir, progress, cache.files)
 		if err != nil {
 			return err
 		}
 
+		if err := verifyImport(c, path.Base(dir), i, name, progress); err != nil {
+			return err
+		}
+
 		for i, ext := range existing {
 			if ext.Name() == path.Base(name) {
 				existing = append(existing[:i], existing[i+1:]...)
@@ -0,0 +1,142 @@
+package stacker
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/anuvu/stacker/limits"
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+)
+
+// armorStart is how ascii armored gpg data starts.
+var armorStart = []byte("-----BEGIN PGP ")
+
+// isArmored returns true if the gpg data r is about to read is ascii armored.
+func isArmored(r *bufio.Reader) bool {
+	start, _ := r.Peek(len(armorStart))
+	return bytes.Equal(start, armorStart)
+}
+
+func readKeyring(keyring string) (openpgp.EntityList, error) {
+	f, err := os.Open(keyring)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't open keyring")
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var keys openpgp.EntityList
+	if isArmored(r) {
+		keys, err = openpgp.ReadArmoredKeyRing(r)
+	} else {
+		keys, err = openpgp.ReadKeyRing(r)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read keyring %s", keyring)
+	}
+
+	return keys, nil
+}
+
+// verifyImportSignature checks that sig, a detached signature (armored or
+// not), is a valid signature of file by one of the keys in keyring.
+func verifyImportSignature(file string, keyring string, sig string) error {
+	keys, err := readKeyring(keyring)
+	if err != nil {
+		return err
+	}
+
+	content, err := os.Open(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer content.Close()
+
+	sigFile, err := os.Open(sig)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't open signature")
+	}
+	defer sigFile.Close()
+
+	sigReader := bufio.NewReader(sigFile)
+	check := openpgp.CheckDetachedSignature
+	if isArmored(sigReader) {
+		check = openpgp.CheckArmoredDetachedSignature
+	}
+
+	signer, err := check(keys, content, sigReader)
+	if err != nil {
+		return errors.Wrapf(err, "bad gpg signature %s of %s", sig, file)
+	}
+
+	identities := []string{}
+	for identity := range signer.Identities {
+		identities = append(identities, identity)
+	}
+	sort.Strings(identities)
+	log.Infof("%s is signed by %s", path.Base(file), strings.Join(identities, ", "))
+
+	return nil
+}
+
+// acquireSignature returns a local path to the signature of an import,
+// downloading it into dir if it is on a web server.
+func acquireSignature(c types.StackerConfig, sig string, dir string, progress bool) (string, error) {
+	url, err := types.NewDockerishUrl(sig)
+	if err != nil {
+		return "", err
+	}
+
+	switch url.Scheme {
+	case "":
+		return sig, nil
+	case "http", "https":
+		// always fetch it again, in case it was re-signed
+		if err := os.RemoveAll(path.Join(dir, path.Base(url.Path))); err != nil {
+			return "", errors.WithStack(err)
+		}
+
+		release, err := limits.Acquire(c, limits.Network)
+		if err != nil {
+			return "", err
+		}
+		defer release()
+
+		return Download(dir, sig, progress, "", "")
+	default:
+		return "", errors.Errorf("can't get gpg signatures from %s, only files and http(s) urls", sig)
+	}
+}
+
+// verifyImport checks the gpg signature of the import i of layer name, whose
+// contents are in file, if it has one. If the signature isn't valid, the
+// file is deleted, so that the build can't use it.
+func verifyImport(c types.StackerConfig, name string, i types.Import, file string, progress bool) error {
+	if i.GPG == nil {
+		return nil
+	}
+
+	dir := path.Join(c.StackerDir, "import-signatures", name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	sig, err := acquireSignature(c, i.GPG.Sig, dir, progress)
+	if err != nil {
+		return err
+	}
+
+	if err := verifyImportSignature(file, i.GPG.Keyring, sig); err != nil {
+		os.RemoveAll(file)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package stacker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func TestVerifyImportSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_gpg_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	signer, err := openpgp.NewEntity("vendor", "", "vendor@example.com", nil)
+	assert.NoError(err)
+
+	// an armored keyring with the signer's public key
+	keyring := bytes.Buffer{}
+	w, err := armor.Encode(&keyring, openpgp.PublicKeyType, nil)
+	assert.NoError(err)
+	assert.NoError(signer.Serialize(w))
+	assert.NoError(w.Close())
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "keyring.asc"), keyring.Bytes(), 0644))
+
+	content := "hello world\n"
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "thing.tar"), []byte(content), 0644))
+
+	sig := bytes.Buffer{}
+	assert.NoError(openpgp.ArmoredDetachSign(&sig, signer, strings.NewReader(content), nil))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "thing.tar.asc"), sig.Bytes(), 0644))
+
+	binarySig := bytes.Buffer{}
+	assert.NoError(openpgp.DetachSign(&binarySig, signer, strings.NewReader(content), nil))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "thing.tar.sig"), binarySig.Bytes(), 0644))
+
+	assert.NoError(verifyImportSignature(path.Join(dir, "thing.tar"), path.Join(dir, "keyring.asc"), path.Join(dir, "thing.tar.asc")))
+	assert.NoError(verifyImportSignature(path.Join(dir, "thing.tar"), path.Join(dir, "keyring.asc"), path.Join(dir, "thing.tar.sig")))
+
+	// a tampered file
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "thing.tar"), []byte("hello world!\n"), 0644))
+	assert.Error(verifyImportSignature(path.Join(dir, "thing.tar"), path.Join(dir, "keyring.asc"), path.Join(dir, "thing.tar.asc")))
+
+	// signed by someone who isn't in the keyring
+	other, err := openpgp.NewEntity("someone else", "", "else@example.com", nil)
+	assert.NoError(err)
+	sig.Reset()
+	assert.NoError(openpgp.ArmoredDetachSign(&sig, other, strings.NewReader(content), nil))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "thing.tar"), []byte(content), 0644))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "thing.tar.asc"), sig.Bytes(), 0644))
+	assert.Error(verifyImportSignature(path.Join(dir, "thing.tar"), path.Join(dir, "keyring.asc"), path.Join(dir, "thing.tar.asc")))
+}
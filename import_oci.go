@@ -0,0 +1,224 @@
+package stacker
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/squashfs"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+
+	// paxXattrPrefix is how tar headers' PAX records store xattrs.
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+// errNotRegularFile means a file that was asked for in an image isn't a
+// regular file, which can't be read straight out of its layers.
+var errNotRegularFile = errors.New("not a regular file")
+
+// ImageFile describes a file in an image, as found in its layers.
+type ImageFile struct {
+	// Path is relative to the image's root.
+	Path     string
+	Mode     os.FileMode
+	Uid      int
+	Gid      int
+	Size     int64
+	Linkname string
+	Xattrs   map[string]string
+	// Layer is the digest of the (topmost) layer that has the file.
+	Layer digest.Digest
+}
+
+// importFromOCI copies file out of the image tag in the OCI output dir into
+// cacheDir.
+func importFromOCI(c types.StackerConfig, tag string, file string, cacheDir string) (string, error) {
+	target := cleanImagePath(file)
+	dest := path.Join(cacheDir, path.Base(target))
+
+	if _, err := lookupInImage(c.OCIDir, tag, target, dest); err != nil {
+		return "", errors.Wrapf(err, "couldn't import %s from %s", file, tag)
+	}
+
+	return dest, nil
+}
+
+// cleanImagePath returns p relative to the root of an image.
+func cleanImagePath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// lookupInImage finds target (relative to /) in the image tag in the OCI
+// layout ociDir, copying it to dest if dest isn't empty, which only works for
+// regular files. Rather than unpacking the whole image, it reads the image's
+// layers from the top down until one of them has (or deletes) the file:
+// squashfs layers are seekable, so only the parts of them with the file are
+// read, and tar layers are scanned.
+func lookupInImage(ociDir string, tag string, target string, dest string) (*ImageFile, error) {
+	unlock, err := LockOCILayout(ociDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	oci, err := stackeroci.OpenLayout(ociDir)
+	if err != nil {
+		return nil, err
+	}
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(manifest.Layers) - 1; i >= 0; i-- {
+		desc := manifest.Layers[i]
+
+		var file *ImageFile
+		var hidden bool
+		if desc.MediaType == stackeroci.MediaTypeLayerSquashfs || desc.MediaType == stackeroci.ImpoliteMediaTypeLayerSquashfs {
+			blob := path.Join(ociDir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+			var info *squashfs.FileInfo
+			info, hidden, err = squashfs.Lookup(blob, target, dest)
+			if errors.Cause(err) == squashfs.ErrNotRegularFile {
+				err = errors.Wrapf(errNotRegularFile, "%s", target)
+			}
+			if info != nil {
+				file = &ImageFile{
+					Path:     target,
+					Mode:     info.Mode,
+					Uid:      info.Uid,
+					Gid:      info.Gid,
+					Size:     info.Size,
+					Linkname: info.Linkname,
+					Xattrs:   info.Xattrs,
+				}
+			}
+		} else {
+			layer, err2 := stackeroci.OpenTarLayer(oci, desc)
+			if err2 != nil {
+				return nil, err2
+			}
+
+			var hdr *tar.Header
+			hdr, hidden, err = findInLayer(layer, target, dest)
+			layer.Close()
+			if hdr != nil {
+				file = &ImageFile{
+					Path:     target,
+					Mode:     hdr.FileInfo().Mode(),
+					Uid:      hdr.Uid,
+					Gid:      hdr.Gid,
+					Size:     hdr.Size,
+					Linkname: hdr.Linkname,
+					Xattrs:   tarXattrs(hdr),
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if file != nil {
+			file.Layer = desc.Digest
+			return file, nil
+		}
+
+		if hidden {
+			break
+		}
+	}
+
+	return nil, errors.Errorf("%s not found in %s", target, tag)
+}
+
+// tarXattrs returns the xattrs in a tar header.
+func tarXattrs(hdr *tar.Header) map[string]string {
+	xattrs := map[string]string{}
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, paxXattrPrefix) {
+			xattrs[strings.TrimPrefix(k, paxXattrPrefix)] = v
+		}
+	}
+	if len(xattrs) == 0 {
+		return nil
+	}
+	return xattrs
+}
+
+// findInLayer looks for target in the tar layer, returning its header and
+// writing it to dest (if dest isn't empty) if it is there. If it isn't,
+// hidden is true if the layer deletes it (or a directory it is in), i.e. the
+// lower layers' versions shouldn't be used.
+func findInLayer(layer io.Reader, target string, dest string) (*tar.Header, bool, error) {
+	hidden := false
+	tr := tar.NewReader(layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, hidden, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		dir, base := path.Split(name)
+		dir = strings.TrimSuffix(dir, "/")
+
+		// a whiteout of target or one of its parents, or an opaque
+		// parent
+		if base == opaqueWhiteout && (dir == "" || strings.HasPrefix(target, dir+"/")) {
+			hidden = true
+			continue
+		}
+
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			deleted := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			if deleted == target || strings.HasPrefix(target, deleted+"/") {
+				hidden = true
+			}
+			continue
+		}
+
+		if name != target {
+			continue
+		}
+
+		if dest == "" {
+			return hdr, false, nil
+		}
+
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			return nil, false, errors.Wrapf(errNotRegularFile, "%s", target)
+		}
+
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+		if err != nil {
+			return nil, false, errors.WithStack(err)
+		}
+		defer f.Close()
+
+		// in case it was already there with different permissions
+		if err := f.Chmod(hdr.FileInfo().Mode().Perm()); err != nil {
+			return nil, false, errors.WithStack(err)
+		}
+
+		if _, err := io.Copy(f, tr); err != nil {
+			return nil, false, errors.Wrapf(err, "couldn't write %s", dest)
+		}
+
+		return hdr, false, nil
+	}
+}
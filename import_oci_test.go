@@ -0,0 +1,102 @@
+package stacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindInLayer(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_import_oci_test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	layer := func(files map[string]string) *bytes.Buffer {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		for name, content := range files {
+			err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(content)), Typeflag: tar.TypeReg})
+			assert.NoError(err)
+			_, err = tw.Write([]byte(content))
+			assert.NoError(err)
+		}
+		assert.NoError(tw.Close())
+		return buf
+	}
+
+	dest := path.Join(dir, "gcc")
+
+	hdr, hidden, err := findInLayer(layer(map[string]string{"./usr/bin/gcc": "gcc", "usr/bin/cc": "cc"}), "usr/bin/gcc", dest)
+	assert.NoError(err)
+	assert.NotNil(hdr)
+	assert.False(hidden)
+	content, err := ioutil.ReadFile(dest)
+	assert.NoError(err)
+	assert.Equal("gcc", string(content))
+	fi, err := os.Stat(dest)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0755), fi.Mode().Perm())
+
+	hdr, hidden, err = findInLayer(layer(map[string]string{"usr/bin/cc": "cc"}), "usr/bin/gcc", dest)
+	assert.NoError(err)
+	assert.Nil(hdr)
+	assert.False(hidden)
+
+	hdr, hidden, err = findInLayer(layer(map[string]string{"usr/bin/.wh.gcc": ""}), "usr/bin/gcc", dest)
+	assert.NoError(err)
+	assert.Nil(hdr)
+	assert.True(hidden)
+
+	hdr, hidden, err = findInLayer(layer(map[string]string{"usr/.wh.bin": ""}), "usr/bin/gcc", dest)
+	assert.NoError(err)
+	assert.Nil(hdr)
+	assert.True(hidden)
+
+	hdr, hidden, err = findInLayer(layer(map[string]string{"usr/.wh..wh..opq": ""}), "usr/bin/gcc", dest)
+	assert.NoError(err)
+	assert.Nil(hdr)
+	assert.True(hidden)
+
+	// whiteouts of things that only share a prefix don't count
+	hdr, hidden, err = findInLayer(layer(map[string]string{"usr/bin/.wh.gc": "", "usr/.wh.bi": ""}), "usr/bin/gcc", dest)
+	assert.NoError(err)
+	assert.Nil(hdr)
+	assert.False(hidden)
+}
+
+func TestFindInLayerStat(t *testing.T) {
+	assert := assert.New(t)
+
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	assert.NoError(tw.WriteHeader(&tar.Header{Name: "usr/", Mode: 0755, Typeflag: tar.TypeDir}))
+	assert.NoError(tw.WriteHeader(&tar.Header{
+		Name:       "usr/bin/ping",
+		Mode:       0755,
+		Uid:        1000,
+		Typeflag:   tar.TypeReg,
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{"SCHILY.xattr.security.capability": "cap_net_raw", "comment": "not an xattr"},
+	}))
+	assert.NoError(tw.Close())
+
+	// without a dest, directories are fine too
+	hdr, hidden, err := findInLayer(bytes.NewReader(buf.Bytes()), "usr", "")
+	assert.NoError(err)
+	assert.False(hidden)
+	assert.True(hdr.FileInfo().IsDir())
+
+	hdr, _, err = findInLayer(bytes.NewReader(buf.Bytes()), "usr/bin/ping", "")
+	assert.NoError(err)
+	assert.Equal(1000, hdr.Uid)
+	assert.Equal(map[string]string{"security.capability": "cap_net_raw"}, tarXattrs(hdr))
+}
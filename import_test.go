@@ -0,0 +1,69 @@
+package stacker
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/anuvu/stacker/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcquireImportMirrors(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_import_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	content := "the real thing\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/stale/thing.tar":
+			fmt.Fprint(w, "something else\n")
+		case "/good/thing-1.0.tar":
+			fmt.Fprint(w, content)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	config := types.StackerConfig{StackerDir: dir}
+	cache := path.Join(dir, "imports", "test")
+	assert.NoError(os.MkdirAll(cache, 0755))
+
+	i := types.Import{
+		Path: server.URL + "/down/thing.tar",
+		Hash: fmt.Sprintf("%x", sha256.Sum256([]byte(content))),
+		Mirrors: []string{
+			server.URL + "/stale/thing.tar",
+			server.URL + "/good/thing-1.0.tar",
+		},
+	}
+
+	p, err := acquireImport(config, nil, i, cache, false, openFileHashCache(config))
+	assert.NoError(err)
+	assert.Equal(path.Join(cache, "thing.tar"), p)
+
+	imported, err := ioutil.ReadFile(p)
+	assert.NoError(err)
+	assert.Equal(content, string(imported))
+
+	// the stale mirror's download was thrown away, and the good one renamed
+	ents, err := ioutil.ReadDir(cache)
+	assert.NoError(err)
+	assert.Len(ents, 1)
+
+	// without the copy from last time (which is used when the path is down)
+	// and with only the stale mirror, there's nowhere to get it from
+	assert.NoError(os.Remove(p))
+	i.Mirrors = i.Mirrors[:1]
+	_, err = acquireImport(config, nil, i, cache, false, openFileHashCache(config))
+	assert.Error(err)
+}
@@ -0,0 +1,95 @@
+package stacker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/pkg/errors"
+)
+
+// failedDependency returns a layer that name depends on which failed (or was
+// skipped) earlier in a --keep-going build, if there is one.
+func (b *Builder) failedDependency(sf *types.Stackerfile, name string) string {
+	l, ok := sf.Get(name)
+	if !ok {
+		return ""
+	}
+
+	// a bad dependency will fail the layer's build anyway
+	deps, _ := l.Dependencies()
+	for _, dep := range deps {
+		if b.failed[dep] {
+			return dep
+		}
+	}
+
+	return ""
+}
+
+// layerFailed records that name failed to build with err, so that the layers
+// that depend on it are skipped.
+func (b *Builder) layerFailed(file string, sf *types.Stackerfile, name string, err error) {
+	log.Infof("building %s failed, continuing with the layers that don't depend on it: %v", name, err)
+
+	b.failed[name] = true
+	b.failures = append(b.failures, err)
+	b.steps = nil
+	b.report.FailedLayers = append(b.report.FailedLayers, LayerFailure{
+		Stackerfile: file,
+		Name:        name,
+		Line:        sf.LayerLine(name),
+		Error:       err.Error(),
+	})
+}
+
+// layerSkipped records that name wasn't built because dep, which it depends
+// on, failed.
+func (b *Builder) layerSkipped(file string, sf *types.Stackerfile, name string, dep string) {
+	log.Infof("skipping %s, since %s failed", name, dep)
+
+	b.failed[name] = true
+	b.report.FailedLayers = append(b.report.FailedLayers, LayerFailure{
+		Stackerfile: file,
+		Name:        name,
+		Line:        sf.LayerLine(name),
+		SkippedFor:  dep,
+	})
+}
+
+// keepGoingError summarizes which layers were built and which weren't in a
+// --keep-going build, and returns an error if any failed. Its kind is the
+// kind of the failures if they were all of the same kind, so that stacker
+// exits as it would have if it had stopped at the first one.
+func (b *Builder) keepGoingError() error {
+	if len(b.report.FailedLayers) == 0 {
+		return nil
+	}
+
+	log.Infof("%d of %d layers weren't built:", len(b.report.FailedLayers), len(b.report.Layers)+len(b.report.FailedLayers))
+	names := []string{}
+	for _, f := range b.report.FailedLayers {
+		if f.SkippedFor != "" {
+			log.Infof("    %s: skipped, since %s failed", f.Name, f.SkippedFor)
+		} else {
+			log.Infof("    %s: %s", f.Name, f.Error)
+			names = append(names, f.Name)
+		}
+	}
+
+	kind := types.KindOf(b.failures[0])
+	for _, err := range b.failures[1:] {
+		if types.KindOf(err) != kind {
+			kind = types.OtherError
+			break
+		}
+	}
+
+	skipped := len(b.report.FailedLayers) - len(names)
+	msg := fmt.Sprintf("building %s failed", strings.Join(names, ", "))
+	if skipped != 0 {
+		msg += fmt.Sprintf(" (%d layers depending on them were skipped)", skipped)
+	}
+	return types.WithKind(kind, errors.New(msg))
+}
@@ -0,0 +1,31 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/anuvu/stacker/types"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeepGoingError(t *testing.T) {
+	assert := assert.New(t)
+
+	b := NewBuilder(&BuildArgs{KeepGoing: true})
+	assert.NoError(b.keepGoingError())
+
+	sf := &types.Stackerfile{}
+	b.layerFailed("stacker.yaml", sf, "one", types.KindErrorf(types.NetworkError, "registry down"))
+	b.layerSkipped("stacker.yaml", sf, "two", "one")
+	assert.True(b.failed["two"])
+
+	err := b.keepGoingError()
+	assert.Error(err)
+	assert.Equal(types.NetworkError, types.KindOf(err))
+	assert.Len(b.report.FailedLayers, 2)
+	assert.Equal("one", b.report.FailedLayers[1].SkippedFor)
+
+	// failures of different kinds are just failures
+	b.layerFailed("stacker.yaml", sf, "three", errors.Errorf("run commands failed"))
+	assert.Equal(types.OtherError, types.KindOf(b.keepGoingError()))
+}
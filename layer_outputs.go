@@ -0,0 +1,107 @@
+package stacker
+
+import (
+	"os"
+	"path"
+	"sort"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/pkg/errors"
+)
+
+// layerOutputPath is where the output called output of layer name is copied
+// to, for later layers to import.
+func layerOutputPath(config types.StackerConfig, name string, output string) string {
+	return path.Join(config.StackerDir, "outputs", name, output)
+}
+
+// generateLayerOutputs copies the outputs of layer name out of its
+// filesystem. If onlyIfMissing is set, only the ones that aren't there yet
+// are (for layers that were cached).
+func generateLayerOutputs(config types.StackerConfig, s types.Storage, name string, l *types.Layer, onlyIfMissing bool) error {
+	outputs, err := l.ParseOutputs()
+	if err != nil || len(outputs) == 0 {
+		return err
+	}
+
+	dir := path.Join(config.StackerDir, "outputs", name)
+	if !onlyIfMissing {
+		// outputs that were removed from the layer shouldn't be
+		// importable anymore
+		if err := os.RemoveAll(dir); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	missing := []string{}
+	for output := range outputs {
+		if _, err := os.Lstat(layerOutputPath(config, name, output)); err != nil {
+			missing = append(missing, output)
+		}
+	}
+	sort.Strings(missing)
+
+	if len(missing) == 0 {
+		log.Debugf("%s's outputs are already there", name)
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	writable, cleanup, err := s.TemporaryWritableSnapshot(name)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	rootfs := path.Join(config.RootFSDir, writable, "rootfs")
+	for _, output := range missing {
+		// the layer's filesystem is whatever its run made it, so
+		// symlinks in the path are followed inside it, not on the host
+		source, err := securejoin.SecureJoin(rootfs, outputs[output])
+		if err != nil {
+			return errors.Wrapf(err, "bad path %s for %s's output %s", outputs[output], name, output)
+		}
+		if _, err := os.Lstat(source); err != nil {
+			return errors.Wrapf(err, "%s's output %s (%s) isn't in its filesystem", name, output, outputs[output])
+		}
+
+		// copied next to where it goes, and renamed into place once
+		// it's complete
+		dest := layerOutputPath(config, name, output)
+		tmp := path.Join(dir, "."+output+".tmp")
+		if err := os.RemoveAll(tmp); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := lib.CopyThing(source, tmp); err != nil {
+			os.RemoveAll(tmp)
+			return errors.Wrapf(err, "couldn't copy %s's output %s", name, output)
+		}
+		if err := os.Rename(tmp, dest); err != nil {
+			return errors.WithStack(err)
+		}
+
+		log.Infof("copied %s's output %s from %s", name, output, outputs[output])
+	}
+
+	return nil
+}
+
+// findLayerOutput returns the path of the output called output of layer
+// name, which must have been built already.
+func findLayerOutput(config types.StackerConfig, name string, output string) (string, error) {
+	p := layerOutputPath(config, name, output)
+	if _, err := os.Lstat(p); err != nil {
+		if os.IsNotExist(err) {
+			return "", errors.Errorf("layer %s has no output %s; is it in its outputs?", name, output)
+		}
+		return "", errors.WithStack(err)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// files smaller than this are usually stored inline in the filesystem
+	// metadata, so there's nothing to share.
+	minDedupeSize = 4096
+
+	// btrfs refuses to dedupe more than this in one FIDEDUPERANGE call.
+	maxDedupeChunk = 16 * 1024 * 1024
+
+	// the kernel's FILE_DEDUPE_RANGE_DIFFERS
+	dedupeRangeDiffers = 1
+)
+
+// DedupeStats describes the work done by DedupeFiles.
+type DedupeStats struct {
+	// Files is how many files now share their contents with another.
+	Files int
+	// Bytes is how much data was passed to the filesystem for sharing;
+	// some of it may have been shared already (e.g. by a snapshot).
+	Bytes int64
+}
+
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// DedupeFiles finds regular files under root with identical contents and asks
+// the filesystem to share their extents with FIDEDUPERANGE. The filesystem
+// compares the data itself before sharing anything, so a file changing while
+// this runs is not dangerous, it just won't be deduplicated.
+func DedupeFiles(root string) (DedupeStats, error) {
+	stats := DedupeStats{}
+
+	bySize := map[int64][]string{}
+	seen := map[inode]bool{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() || info.Size() < minDedupeSize {
+			return nil
+		}
+
+		// hard links already share everything
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if ok {
+			i := inode{dev: uint64(st.Dev), ino: st.Ino}
+			if seen[i] {
+				return nil
+			}
+			seen[i] = true
+		}
+
+		bySize[info.Size()] = append(bySize[info.Size()], p)
+		return nil
+	})
+	if err != nil {
+		return stats, errors.Wrapf(err, "couldn't walk %s", root)
+	}
+
+	for size, paths := range bySize {
+		if len(paths) < 2 {
+			continue
+		}
+
+		byHash := map[string][]string{}
+		for _, p := range paths {
+			h, err := HashFile(p, false)
+			if err != nil {
+				return stats, err
+			}
+			byHash[h] = append(byHash[h], p)
+		}
+
+		for _, same := range byHash {
+			if len(same) < 2 {
+				continue
+			}
+
+			for _, dest := range same[1:] {
+				deduped, err := dedupeFile(same[0], dest, size)
+				if err != nil {
+					return stats, err
+				}
+
+				if deduped > 0 {
+					stats.Files++
+					stats.Bytes += deduped
+				}
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+func dedupeFile(source string, dest string, size int64) (int64, error) {
+	s, err := os.Open(source)
+	if err != nil {
+		return 0, errors.Wrapf(err, "couldn't open %s", source)
+	}
+	defer s.Close()
+
+	d, err := os.OpenFile(dest, os.O_RDWR, 0)
+	if err != nil {
+		// root can dedupe into files it only has open for reading
+		d, err = os.Open(dest)
+		if err != nil {
+			return 0, errors.Wrapf(err, "couldn't open %s", dest)
+		}
+	}
+	defer d.Close()
+
+	deduped := int64(0)
+	for offset := int64(0); offset < size; offset += maxDedupeChunk {
+		length := size - offset
+		if length > maxDedupeChunk {
+			length = maxDedupeChunk
+		}
+
+		r := unix.FileDedupeRange{
+			Src_offset: uint64(offset),
+			Src_length: uint64(length),
+			Info: []unix.FileDedupeRangeInfo{{
+				Dest_fd:     int64(d.Fd()),
+				Dest_offset: uint64(offset),
+			}},
+		}
+
+		err := unix.IoctlFileDedupeRange(int(s.Fd()), &r)
+		if err == unix.EOPNOTSUPP || err == unix.ENOTTY {
+			return 0, errors.Errorf("filesystem of %s doesn't support deduplication", source)
+		}
+		if err != nil {
+			return 0, errors.Wrapf(err, "couldn't dedupe %s and %s", source, dest)
+		}
+
+		status := r.Info[0].Status
+		if status == dedupeRangeDiffers {
+			// it changed since we hashed it
+			return deduped, nil
+		}
+		if status < 0 {
+			return 0, errors.Wrapf(syscall.Errno(-status), "couldn't dedupe %s and %s", source, dest)
+		}
+
+		deduped += int64(r.Info[0].Bytes_deduped)
+	}
+
+	return deduped, nil
+}
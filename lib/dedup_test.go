@@ -0,0 +1,50 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupeFiles(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker-dedupe-test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("meshuggah rocks"), 1024)
+	assert.NoError(os.MkdirAll(path.Join(dir, "a"), 0755))
+	assert.NoError(os.MkdirAll(path.Join(dir, "b"), 0755))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "a", "foo"), content, 0644))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "b", "different"), bytes.ToUpper(content), 0644))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "small"), []byte("zomg"), 0644))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "small2"), []byte("zomg"), 0644))
+	assert.NoError(os.Link(path.Join(dir, "a", "foo"), path.Join(dir, "a", "bar")))
+
+	// hard links, small files and files of the same size but different
+	// content are never handed to the filesystem
+	stats, err := DedupeFiles(dir)
+	assert.NoError(err)
+	assert.Equal(DedupeStats{}, stats)
+
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "b", "foo"), content, 0644))
+	stats, err = DedupeFiles(dir)
+	if err != nil {
+		// e.g. the tmpdir is on ext4 or tmpfs
+		assert.True(strings.Contains(err.Error(), "doesn't support deduplication"), err.Error())
+		return
+	}
+
+	assert.Equal(1, stats.Files)
+	assert.Equal(int64(len(content)), stats.Bytes)
+
+	result, err := ioutil.ReadFile(path.Join(dir, "b", "foo"))
+	assert.NoError(err)
+	assert.Equal(content, result)
+}
@@ -0,0 +1,45 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// DiskUsage returns how many bytes of disk the files under root use, like
+// du, counting hard linked files once. It is zero if root doesn't exist.
+func DiskUsage(root string) (int64, error) {
+	total := int64(0)
+	seen := map[inode]bool{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			total += info.Size()
+			return nil
+		}
+
+		i := inode{dev: uint64(st.Dev), ino: st.Ino}
+		if seen[i] {
+			return nil
+		}
+		seen[i] = true
+
+		// st_blocks is always in 512 byte units
+		total += st.Blocks * 512
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "couldn't compute the disk usage of %s", root)
+	}
+
+	return total, nil
+}
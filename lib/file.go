@@ -7,6 +7,7 @@ import (
 	"regexp"
 
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
 func FileCopy(dest string, source string) error {
@@ -49,6 +50,14 @@ func FileCopy(dest string, source string) error {
 		return errors.Wrapf(err, "Coudn't chmod file %s", source)
 	}
 
+	// On filesystems that support it (btrfs, xfs), a reflink shares the
+	// source's extents instead of copying any data.
+	if err := unix.IoctlFileClone(int(d.Fd()), int(s.Fd())); err == nil {
+		return nil
+	}
+
+	// Otherwise, io.Copy uses copy_file_range() between two files, which
+	// at least avoids copying the data through userspace.
 	_, err = io.Copy(d, s)
 	return err
 }
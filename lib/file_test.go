@@ -0,0 +1,41 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileCopy(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker-file-copy-test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// whether or not the tmpdir supports reflinks, the result should be
+	// the same
+	source := path.Join(dir, "source")
+	assert.NoError(ioutil.WriteFile(source, []byte("meshuggah rocks"), 0750))
+
+	dest := path.Join(dir, "dest")
+	assert.NoError(FileCopy(dest, source))
+
+	content, err := ioutil.ReadFile(dest)
+	assert.NoError(err)
+	assert.Equal("meshuggah rocks", string(content))
+
+	fi, err := os.Stat(dest)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0750), fi.Mode())
+
+	// copying over an existing file replaces it
+	assert.NoError(ioutil.WriteFile(source, []byte("zomg"), 0644))
+	assert.NoError(FileCopy(dest, source))
+	content, err = ioutil.ReadFile(dest)
+	assert.NoError(err)
+	assert.Equal("zomg", string(content))
+}
@@ -0,0 +1,110 @@
+package lib
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// HardenOpts are what HardenRootfs does to the files in a rootfs.
+type HardenOpts struct {
+	// StripSetuid removes the setuid and setgid bits of the regular
+	// files, except the ones in KeepSetuid.
+	StripSetuid bool
+	KeepSetuid  []string
+	// RootOwned makes everything owned by root:root.
+	RootOwned bool
+	// Skip are the paths (e.g. mountpoints) that are left alone, along
+	// with everything in them.
+	Skip []string
+}
+
+// HardenStats describes the work done by HardenRootfs.
+type HardenStats struct {
+	// Stripped is how many files lost their setuid or setgid bits.
+	Stripped int
+	// Chowned is how many files are owned by root:root now.
+	Chowned int
+}
+
+// HardenRootfs does opts to dirs (and everything in them) in the rootfs at
+// rootfs. The paths in dirs and opts are in the rootfs, e.g. /usr/bin/sudo.
+func HardenRootfs(rootfs string, dirs []string, opts HardenOpts) (HardenStats, error) {
+	stats := HardenStats{}
+	keep := map[string]bool{}
+	for _, p := range opts.KeepSetuid {
+		keep[path.Clean(p)] = true
+	}
+
+	skip := map[string]bool{}
+	for _, p := range opts.Skip {
+		skip[path.Clean(p)] = true
+	}
+
+	for _, dir := range dirs {
+		root := path.Join(rootfs, dir)
+		err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return errors.WithStack(err)
+			}
+
+			rel, err := filepath.Rel(rootfs, p)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			rel = path.Join("/", rel)
+
+			if skip[rel] {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			mode := fi.Mode()
+			stat := fi.Sys().(*syscall.Stat_t)
+			chowned := false
+			if opts.RootOwned && (stat.Uid != 0 || stat.Gid != 0) {
+				if err := os.Lchown(p, 0, 0); err != nil {
+					return errors.Wrapf(err, "couldn't chown %s", rel)
+				}
+				stats.Chowned++
+				chowned = true
+			}
+
+			if !mode.IsRegular() {
+				return nil
+			}
+
+			setuid := mode & (os.ModeSetuid | os.ModeSetgid)
+			if setuid == 0 {
+				return nil
+			}
+
+			stripped := false
+			if opts.StripSetuid && !keep[rel] {
+				mode &^= setuid
+				stats.Stripped++
+				stripped = true
+			}
+
+			// files left as they were aren't touched
+			if !stripped && !chowned {
+				return nil
+			}
+
+			// chowning clears the bits too, so the ones that are
+			// kept need setting again
+			perms := mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+			return errors.Wrapf(os.Chmod(p, perms), "couldn't chmod %s", rel)
+		})
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
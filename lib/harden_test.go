@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHardenRootfs(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker-harden-test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.MkdirAll(path.Join(dir, "usr", "bin"), 0755))
+	assert.NoError(os.MkdirAll(path.Join(dir, "proc"), 0755))
+	for _, f := range []string{"usr/bin/sudo", "usr/bin/passwd", "usr/bin/ls", "proc/setuid"} {
+		assert.NoError(ioutil.WriteFile(path.Join(dir, f), []byte("#!/bin/sh\n"), 0755))
+	}
+
+	for _, f := range []string{"usr/bin/sudo", "usr/bin/passwd", "proc/setuid"} {
+		assert.NoError(os.Chmod(path.Join(dir, f), 0755|os.ModeSetuid))
+	}
+
+	opts := HardenOpts{
+		StripSetuid: true,
+		KeepSetuid:  []string{"/usr/bin/sudo"},
+		Skip:        []string{"/proc"},
+	}
+	stats, err := HardenRootfs(dir, []string{"/"}, opts)
+	assert.NoError(err)
+	assert.Equal(HardenStats{Stripped: 1}, stats)
+
+	mode := func(f string) os.FileMode {
+		fi, err := os.Stat(path.Join(dir, f))
+		assert.NoError(err)
+		return fi.Mode()
+	}
+
+	assert.Equal(0755|os.ModeSetuid, mode("usr/bin/sudo"))
+	assert.Equal(os.FileMode(0755), mode("usr/bin/passwd"))
+	assert.Equal(os.FileMode(0755), mode("usr/bin/ls"))
+	assert.Equal(0755|os.ModeSetuid, mode("proc/setuid"))
+}
+
+func TestHardenRootfsRootOwned(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker-harden-test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.MkdirAll(path.Join(dir, "usr", "bin"), 0755))
+	for _, f := range []string{"usr/bin/sudo", "usr/bin/passwd", "usr/bin/ls"} {
+		assert.NoError(ioutil.WriteFile(path.Join(dir, f), []byte("#!/bin/sh\n"), 0755))
+		assert.NoError(os.Chown(path.Join(dir, f), 1000, 1000))
+	}
+
+	// chown clears these, so they're set afterwards
+	for _, f := range []string{"usr/bin/sudo", "usr/bin/passwd"} {
+		assert.NoError(os.Chmod(path.Join(dir, f), 0755|os.ModeSetuid|os.ModeSetgid))
+	}
+
+	opts := HardenOpts{
+		StripSetuid: true,
+		KeepSetuid:  []string{"/usr/bin/sudo"},
+		RootOwned:   true,
+	}
+	stats, err := HardenRootfs(dir, []string{"/usr"}, opts)
+	assert.NoError(err)
+	// the directories are root's already
+	assert.Equal(HardenStats{Stripped: 1, Chowned: 3}, stats)
+
+	stat := func(f string) (os.FileMode, uint32, uint32) {
+		fi, err := os.Stat(path.Join(dir, f))
+		assert.NoError(err)
+		st := fi.Sys().(*syscall.Stat_t)
+		return fi.Mode(), st.Uid, st.Gid
+	}
+
+	mode, uid, gid := stat("usr/bin/sudo")
+	assert.Equal(0755|os.ModeSetuid|os.ModeSetgid, mode)
+	assert.Equal([]uint32{0, 0}, []uint32{uid, gid})
+
+	mode, uid, gid = stat("usr/bin/passwd")
+	assert.Equal(os.FileMode(0755), mode)
+	assert.Equal([]uint32{0, 0}, []uint32{uid, gid})
+
+	mode, uid, gid = stat("usr/bin/ls")
+	assert.Equal(os.FileMode(0755), mode)
+	assert.Equal([]uint32{0, 0}, []uint32{uid, gid})
+
+	// everything is root's now, so nothing is touched again
+	stats, err = HardenRootfs(dir, []string{"/usr"}, opts)
+	assert.NoError(err)
+	assert.Equal(HardenStats{}, stats)
+}
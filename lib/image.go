@@ -2,15 +2,21 @@ package lib
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"os"
 	"strings"
+	"time"
 
+	"github.com/anuvu/stacker/log"
 	"github.com/containers/image/v5/copy"
 	"github.com/containers/image/v5/docker"
 	"github.com/containers/image/v5/docker/daemon"
+	"github.com/containers/image/v5/manifest"
 	"github.com/containers/image/v5/oci/layout"
 	"github.com/containers/image/v5/signature"
 	"github.com/containers/image/v5/types"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
 	"github.com/pkg/errors"
@@ -59,6 +65,28 @@ type ImageCopyOpts struct {
 	DestSkipTLS       bool
 	Progress          io.Writer
 	Context           context.Context
+
+	// TmpDir is where the sources and destinations that need to spool
+	// whole blobs to disk (e.g. docker-archive) do so, instead of
+	// containers/image's default of /var/tmp.
+	TmpDir string
+
+	// MaxParallelDownloads is how many layers are copied at once. If
+	// zero, it is containers/image's default (6).
+	MaxParallelDownloads uint
+}
+
+// authDescription describes how an image is accessed for debug logs, without
+// the password.
+func authDescription(username string, skipTLS bool) string {
+	desc := ""
+	if username != "" {
+		desc = fmt.Sprintf(" (as %s, password redacted)", username)
+	}
+	if skipTLS {
+		desc += " (skipping TLS verification)"
+	}
+	return desc
 }
 
 func ImageCopy(opts ImageCopyOpts) error {
@@ -86,11 +114,12 @@ func ImageCopy(opts ImageCopyOpts) error {
 	}
 
 	args := &copy.Options{
-		ReportWriter:     opts.Progress,
-		RemoveSignatures: true,
+		ReportWriter:         opts.Progress,
+		RemoveSignatures:     true,
+		MaxParallelDownloads: opts.MaxParallelDownloads,
 	}
 
-	args.SourceCtx = &types.SystemContext{}
+	args.SourceCtx = &types.SystemContext{BigFilesTemporaryDir: opts.TmpDir}
 
 	if opts.SrcSkipTLS {
 		args.SourceCtx.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
@@ -103,7 +132,7 @@ func ImageCopy(opts ImageCopyOpts) error {
 		}
 	}
 
-	args.DestinationCtx = &types.SystemContext{}
+	args.DestinationCtx = &types.SystemContext{BigFilesTemporaryDir: opts.TmpDir}
 
 	if opts.DestSkipTLS {
 		args.DestinationCtx.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
@@ -123,6 +152,7 @@ func ImageCopy(opts ImageCopyOpts) error {
 		args.ForceManifestMIMEType = opts.ForceManifestType
 	}
 
+	log.SubsystemDebugf(log.OCI, "copying %s%s to %s%s", opts.Src, authDescription(opts.SrcUsername, opts.SrcSkipTLS), opts.Dest, authDescription(opts.DestUsername, opts.DestSkipTLS))
 	_, err = copy.Image(opts.Context, policy, destRef, srcRef, args)
 	if err != nil {
 		return err
@@ -181,3 +211,138 @@ func ImageCopy(opts ImageCopyOpts) error {
 
 	return nil
 }
+
+func systemContext(username string, password string, skipTLS bool) *types.SystemContext {
+	sys := &types.SystemContext{}
+	if skipTLS {
+		sys.DockerInsecureSkipTLSVerify = types.OptionalBoolTrue
+	}
+
+	if username != "" {
+		sys.DockerAuthConfig = &types.DockerAuthConfig{
+			Username: username,
+			Password: password,
+		}
+	}
+
+	return sys
+}
+
+// ManifestDigest returns the digest of the manifest that ref (e.g.
+// docker://example.com/foo:latest) points to.
+func ManifestDigest(ref string, username string, password string, skipTLS bool) (digest.Digest, error) {
+	imageRef, err := localRefParser(ref)
+	if err != nil {
+		return "", err
+	}
+
+	src, err := imageRef.NewImageSource(context.Background(), systemContext(username, password, skipTLS))
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't open %s", ref)
+	}
+	defer src.Close()
+
+	content, _, err := src.GetManifest(context.Background(), nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't get manifest of %s", ref)
+	}
+
+	return manifest.Digest(content)
+}
+
+// notFoundMessages are how containers/image says there's no such image: the
+// registry's MANIFEST_UNKNOWN and NAME_UNKNOWN errors, a 404 without either of
+// them, and an oci layout without the tag.
+var notFoundMessages = []string{"manifest unknown", "name unknown", "StatusCode: 404", "no descriptor found for reference"}
+
+// IsImageNotFound returns whether err, from e.g. ManifestDigest, means that
+// the image isn't there, rather than that it couldn't be looked up (the
+// registry is unreachable, refused the credentials, and so on).
+func IsImageNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// an oci layout that doesn't exist yet
+	if os.IsNotExist(errors.Cause(err)) {
+		return true
+	}
+
+	for _, msg := range notFoundMessages {
+		if strings.Contains(err.Error(), msg) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ImageInfo returns the manifest digest and creation time of the image ref
+// points to.
+func ImageInfo(ref string, username string, password string, skipTLS bool) (digest.Digest, time.Time, error) {
+	imageRef, err := localRefParser(ref)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	img, err := imageRef.NewImage(context.Background(), systemContext(username, password, skipTLS))
+	if err != nil {
+		return "", time.Time{}, errors.Wrapf(err, "couldn't open %s", ref)
+	}
+	defer img.Close()
+
+	content, _, err := img.Manifest(context.Background())
+	if err != nil {
+		return "", time.Time{}, errors.Wrapf(err, "couldn't get manifest of %s", ref)
+	}
+
+	manifestDigest, err := manifest.Digest(content)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	info, err := img.Inspect(context.Background())
+	if err != nil {
+		return "", time.Time{}, errors.Wrapf(err, "couldn't inspect %s", ref)
+	}
+
+	created := time.Time{}
+	if info.Created != nil {
+		created = *info.Created
+	}
+
+	return manifestDigest, created, nil
+}
+
+// RepositoryTags lists the tags in a docker repository, e.g.
+// docker://example.com/foo.
+func RepositoryTags(repo string, username string, password string, skipTLS bool) ([]string, error) {
+	imageRef, err := localRefParser(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	if imageRef.Transport().Name() != docker.Transport.Name() {
+		return nil, errors.Errorf("can't list tags of %s, it isn't a docker repository", repo)
+	}
+
+	tags, err := docker.GetRepositoryTags(context.Background(), systemContext(username, password, skipTLS), imageRef)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't list tags of %s", repo)
+	}
+
+	return tags, nil
+}
+
+// DeleteImage deletes the image ref points to. Note that registries delete
+// manifests by digest, so this deletes every tag that points at the same
+// manifest.
+func DeleteImage(ref string, username string, password string, skipTLS bool) error {
+	imageRef, err := localRefParser(ref)
+	if err != nil {
+		return err
+	}
+
+	err = imageRef.DeleteImage(context.Background(), systemContext(username, password, skipTLS))
+	return errors.Wrapf(err, "couldn't delete %s", ref)
+}
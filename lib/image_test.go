@@ -125,3 +125,31 @@ func TestOldManifestReallyRemoved(t *testing.T) {
 	assert.NoError(err)
 	assert.Len(index.Manifests, 1)
 }
+
+func TestIsImageNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_image_not_found_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	layout := path.Join(dir, "oci")
+	_, err = ManifestDigest(fmt.Sprintf("oci:%s:foo", layout), "", "", false)
+	assert.Error(err)
+	assert.True(IsImageNotFound(err))
+
+	oci, err := umoci.CreateLayout(layout)
+	assert.NoError(err)
+	assert.NoError(umoci.NewImage(oci, "bar"))
+	oci.Close()
+
+	_, err = ManifestDigest(fmt.Sprintf("oci:%s:foo", layout), "", "", false)
+	assert.Error(err)
+	assert.True(IsImageNotFound(err))
+
+	_, err = ManifestDigest(fmt.Sprintf("oci:%s:bar", layout), "", "", false)
+	assert.NoError(err)
+
+	assert.False(IsImageNotFound(nil))
+	assert.False(IsImageNotFound(fmt.Errorf("unable to retrieve auth token: invalid username/password")))
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"os"
+	"sync"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// heldLock is a flock(2) this process holds on a file or directory, and how
+// many shared and exclusive holders it has here; flocks taken through
+// different open files conflict even within one process, so they're shared.
+type heldLock struct {
+	f         *os.File
+	shared    int
+	exclusive int
+}
+
+var (
+	heldLocksMu sync.Mutex
+	heldLocks   = map[string]*heldLock{}
+)
+
+func flockWaiting(f *os.File, how int) error {
+	err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB)
+	if err == nil {
+		return nil
+	}
+	if err != unix.EWOULDBLOCK {
+		return errors.Wrapf(err, "couldn't lock %s", f.Name())
+	}
+
+	log.Infof("waiting for another stacker to finish with %s", f.Name())
+	return errors.Wrapf(unix.Flock(int(f.Fd()), how), "couldn't lock %s", f.Name())
+}
+
+// Lock takes a shared or exclusive lock on p, a file or directory that must
+// exist, waiting for other processes' conflicting locks to be released, and
+// returns a function that releases it. Locks may be taken more than once in
+// a process; it holds the strongest one any caller has until they've all
+// been released.
+func Lock(p string, exclusive bool) (func(), error) {
+	heldLocksMu.Lock()
+	defer heldLocksMu.Unlock()
+
+	l, ok := heldLocks[p]
+	if !ok {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		l = &heldLock{f: f}
+	}
+
+	if exclusive && l.exclusive == 0 {
+		if err := flockWaiting(l.f, unix.LOCK_EX); err != nil {
+			if !ok {
+				l.f.Close()
+			}
+			return nil, err
+		}
+		l.exclusive++
+	} else if exclusive {
+		l.exclusive++
+	} else {
+		if l.shared == 0 && l.exclusive == 0 {
+			if err := flockWaiting(l.f, unix.LOCK_SH); err != nil {
+				if !ok {
+					l.f.Close()
+				}
+				return nil, err
+			}
+		}
+		l.shared++
+	}
+	heldLocks[p] = l
+
+	released := false
+	return func() {
+		heldLocksMu.Lock()
+		defer heldLocksMu.Unlock()
+
+		if released {
+			return
+		}
+		released = true
+
+		if exclusive {
+			l.exclusive--
+		} else {
+			l.shared--
+		}
+
+		switch {
+		case l.exclusive == 0 && l.shared == 0:
+			unix.Flock(int(l.f.Fd()), unix.LOCK_UN)
+			l.f.Close()
+			delete(heldLocks, p)
+		case l.exclusive == 0 && exclusive:
+			// back to what the remaining holders need
+			unix.Flock(int(l.f.Fd()), unix.LOCK_SH)
+		}
+	}, nil
+}
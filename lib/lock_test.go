@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestLock(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_lock_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// flocks through another open file act like another process's
+	other, err := os.Open(dir)
+	assert.NoError(err)
+	defer other.Close()
+	canLock := func(how int) bool {
+		if unix.Flock(int(other.Fd()), how|unix.LOCK_NB) != nil {
+			return false
+		}
+		assert.NoError(unix.Flock(int(other.Fd()), unix.LOCK_UN))
+		return true
+	}
+
+	unlockShared, err := Lock(dir, false)
+	assert.NoError(err)
+	assert.True(canLock(unix.LOCK_SH))
+	assert.False(canLock(unix.LOCK_EX))
+
+	// taking it exclusively in the same process doesn't deadlock
+	unlockExclusive, err := Lock(dir, true)
+	assert.NoError(err)
+	assert.False(canLock(unix.LOCK_SH))
+
+	unlockExclusive()
+	assert.True(canLock(unix.LOCK_SH))
+	assert.False(canLock(unix.LOCK_EX))
+
+	// releasing twice doesn't release anyone else's hold
+	unlockExclusive()
+	assert.False(canLock(unix.LOCK_EX))
+
+	unlockShared()
+	assert.True(canLock(unix.LOCK_EX))
+
+	_, err = Lock(dir+"/missing", false)
+	assert.Error(err)
+}
@@ -0,0 +1,31 @@
+package lib
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/freddierice/go-losetup"
+	"github.com/pkg/errors"
+)
+
+// AttachToLoop attaches the path to a loop device, retrying for a while if it
+// gets -EBUSY.
+func AttachToLoop(path string, readOnly bool) (dev losetup.Device, err error) {
+	// We can race between when we ask the kernel which loop device
+	// is free and when we actually attach to it. This window is
+	// pretty small, but still happens e.g. when we run the stacker
+	// test suite. So let's sleep for a random number of ms and
+	// retry the whole process again.
+	for i := 0; i < 10; i++ {
+		dev, err = losetup.Attach(path, 0, readOnly)
+		if err == nil {
+			return dev, nil
+		}
+
+		// time.Durations are nanoseconds
+		ms := rand.Int63n(100 * 1000 * 1000)
+		time.Sleep(time.Duration(ms))
+	}
+
+	return dev, errors.Wrapf(err, "couldn't attach %s to a loop device, too many retries", path)
+}
@@ -0,0 +1,232 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// User is a user AddUsers adds to a rootfs.
+type User struct {
+	Name   string
+	UID    int
+	Group  string
+	GID    int
+	Home   string
+	Shell  string
+	Groups []string
+}
+
+// String is the user as ParseUser parses it: its fields separated by colons,
+// with the groups separated by commas.
+func (u User) String() string {
+	return fmt.Sprintf("%s:%d:%s:%d:%s:%s:%s", u.Name, u.UID, u.Group, u.GID, u.Home, u.Shell, strings.Join(u.Groups, ","))
+}
+
+// ParseUser parses what User's String() returns.
+func ParseUser(s string) (User, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 7 {
+		return User{}, errors.Errorf("bad user %q", s)
+	}
+
+	uid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return User{}, errors.Errorf("bad uid in user %q", s)
+	}
+
+	gid, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return User{}, errors.Errorf("bad gid in user %q", s)
+	}
+
+	u := User{Name: fields[0], UID: uid, Group: fields[2], GID: gid, Home: fields[4], Shell: fields[5]}
+	if fields[6] != "" {
+		u.Groups = strings.Split(fields[6], ",")
+	}
+
+	return u, nil
+}
+
+// etcFile is one of the colon separated databases in /etc, e.g. /etc/passwd.
+type etcFile struct {
+	p       string
+	mode    os.FileMode
+	entries [][]string
+	// missing is whether the rootfs doesn't have the file; only passwd and
+	// group are created if it doesn't
+	missing bool
+	changed bool
+}
+
+func readEtcFile(rootfs string, name string) (*etcFile, error) {
+	f := &etcFile{p: path.Join(rootfs, "etc", name), mode: 0644}
+	fi, err := os.Stat(f.p)
+	if os.IsNotExist(err) {
+		f.missing = true
+		return f, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	f.mode = fi.Mode()
+
+	content, err := ioutil.ReadFile(f.p)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		f.entries = append(f.entries, strings.Split(line, ":"))
+	}
+
+	return f, nil
+}
+
+func (f *etcFile) add(entry ...string) {
+	f.entries = append(f.entries, entry)
+	f.changed = true
+}
+
+// find returns the entry whose field i is value, or nil.
+func (f *etcFile) find(i int, value string) []string {
+	for _, entry := range f.entries {
+		if len(entry) > i && entry[i] == value {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (f *etcFile) write() error {
+	lines := []string{}
+	for _, entry := range f.entries {
+		lines = append(lines, strings.Join(entry, ":"))
+	}
+
+	if err := os.MkdirAll(path.Dir(f.p), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	content := strings.Join(lines, "\n") + "\n"
+	return errors.Wrapf(ioutil.WriteFile(f.p, []byte(content), f.mode), "couldn't write %s", f.p)
+}
+
+// AddUsers adds users (and their primary groups) to the /etc/passwd,
+// /etc/group, and if the rootfs has them, /etc/shadow and /etc/gshadow of the
+// rootfs at rootfs, and creates their home directories. The files are edited
+// directly rather than with useradd or adduser, which not every image has
+// (or has the same one of). Users and groups that are already there with the
+// same id are left as they are, but a name or an id that is already used for
+// something else is an error.
+func AddUsers(rootfs string, users []User) error {
+	files := map[string]*etcFile{}
+	for _, name := range []string{"passwd", "group", "shadow", "gshadow"} {
+		f, err := readEtcFile(rootfs, name)
+		if err != nil {
+			return err
+		}
+		files[name] = f
+	}
+	passwd, group, shadow, gshadow := files["passwd"], files["group"], files["shadow"], files["gshadow"]
+
+	for _, u := range users {
+		gid := strconv.Itoa(u.GID)
+		existing := group.find(0, u.Group)
+		if existing == nil {
+			if other := group.find(2, gid); other != nil {
+				return errors.Errorf("can't add group %s: gid %s is %s's", u.Group, gid, other[0])
+			}
+
+			group.add(u.Group, "x", gid, "")
+			if !gshadow.missing {
+				gshadow.add(u.Group, "!", "", "")
+			}
+		} else if len(existing) < 3 || existing[2] != gid {
+			return errors.Errorf("can't add group %s with gid %s, it already exists with another one", u.Group, gid)
+		}
+
+		uid := strconv.Itoa(u.UID)
+		existing = passwd.find(0, u.Name)
+		if existing == nil {
+			if other := passwd.find(2, uid); other != nil {
+				return errors.Errorf("can't add user %s: uid %s is %s's", u.Name, uid, other[0])
+			}
+
+			passwd.add(u.Name, "x", uid, gid, "", u.Home, u.Shell)
+			// no password, and no password aging: a date there
+			// would make the image depend on when it was built
+			if !shadow.missing {
+				shadow.add(u.Name, "!", "", "0", "99999", "7", "", "", "")
+			}
+		} else if len(existing) < 4 || existing[2] != uid || existing[3] != gid {
+			return errors.Errorf("can't add user %s with uid %s, it already exists with another one", u.Name, uid)
+		}
+
+		for _, g := range u.Groups {
+			if err := addGroupMember(group, g, u.Name); err != nil {
+				return err
+			}
+
+			if !gshadow.missing && gshadow.find(0, g) != nil {
+				if err := addGroupMember(gshadow, g, u.Name); err != nil {
+					return err
+				}
+			}
+		}
+
+		home := path.Join(rootfs, u.Home)
+		if _, err := os.Lstat(home); os.IsNotExist(err) {
+			if err := os.MkdirAll(home, 0755); err != nil {
+				return errors.Wrapf(err, "couldn't create %s's home", u.Name)
+			}
+
+			if err := os.Chown(home, u.UID, u.GID); err != nil {
+				return errors.Wrapf(err, "couldn't chown %s's home", u.Name)
+			}
+		}
+	}
+
+	for _, f := range files {
+		if !f.changed {
+			continue
+		}
+
+		if err := f.write(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addGroupMember adds user to the members (the last field) of group in f.
+func addGroupMember(f *etcFile, group string, user string) error {
+	entry := f.find(0, group)
+	if entry == nil {
+		return errors.Errorf("can't add %s to group %s, there's no such group", user, group)
+	}
+
+	last := len(entry) - 1
+	members := []string{}
+	if entry[last] != "" {
+		members = strings.Split(entry[last], ",")
+	}
+
+	for _, m := range members {
+		if m == user {
+			return nil
+		}
+	}
+
+	entry[last] = strings.Join(append(members, user), ",")
+	f.changed = true
+	return nil
+}
@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddUsers(t *testing.T) {
+	// the homes are chowned to the users
+	if os.Geteuid() != 0 {
+		t.Skip("needs root")
+	}
+
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker-users-test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.MkdirAll(path.Join(dir, "etc"), 0755))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "etc", "passwd"), []byte("root:x:0:0:root:/root:/bin/sh\n"), 0644))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "etc", "group"), []byte("root:x:0:\nwheel:x:10:root\n"), 0644))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "etc", "shadow"), []byte("root:*::0:99999:7:::\n"), 0640))
+
+	app := User{Name: "app", UID: 1000, Group: "app", GID: 1000, Home: "/home/app", Shell: "/bin/sh", Groups: []string{"wheel"}}
+	parsed, err := ParseUser(app.String())
+	assert.NoError(err)
+	assert.Equal(app, parsed)
+
+	assert.NoError(AddUsers(dir, []User{app}))
+	// adding it again changes nothing
+	assert.NoError(AddUsers(dir, []User{app}))
+
+	content := func(f string) string {
+		b, err := ioutil.ReadFile(path.Join(dir, "etc", f))
+		assert.NoError(err)
+		return string(b)
+	}
+
+	assert.Equal("root:x:0:0:root:/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/sh\n", content("passwd"))
+	assert.Equal("root:x:0:\nwheel:x:10:root,app\napp:x:1000:\n", content("group"))
+	assert.Equal("root:*::0:99999:7:::\napp:!::0:99999:7:::\n", content("shadow"))
+
+	fi, err := os.Stat(path.Join(dir, "etc", "shadow"))
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0640), fi.Mode())
+
+	_, err = os.Stat(path.Join(dir, "etc", "gshadow"))
+	assert.True(os.IsNotExist(err))
+
+	fi, err = os.Stat(path.Join(dir, "home", "app"))
+	assert.NoError(err)
+	assert.True(fi.IsDir())
+
+	// the uid is app's
+	other := User{Name: "other", UID: 1000, Group: "other", GID: 1001, Home: "/home/other", Shell: "/bin/sh"}
+	assert.Error(AddUsers(dir, []User{other}))
+
+	// app is someone else
+	app.UID = 1002
+	assert.Error(AddUsers(dir, []User{app}))
+}
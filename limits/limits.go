@@ -0,0 +1,134 @@
+// Package limits bounds how many of stacker's heavy operations (mksquashfs
+// runs, layer extractions, and network transfers) run at once across all the
+// stacker processes on a machine, so that several builds running at the same
+// time don't thrash it.
+//
+// Each kind of operation has max_<kind>_jobs slots, which are lock files in
+// the limits dir; an operation holds a flock on one of them while it runs.
+// The dir is private to the user stacker runs as, since anyone who can write
+// to it can plant things for stacker to open.
+package limits
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/lxc/lxd/shared"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+type Kind string
+
+const (
+	Squashfs Kind = "squashfs"
+	Extract  Kind = "extract"
+	Network  Kind = "network"
+)
+
+// how often to retry when all the slots are taken
+var pollInterval = 100 * time.Millisecond
+
+func maxJobs(config types.StackerConfig, kind Kind) int {
+	switch kind {
+	case Squashfs:
+		return config.MaxSquashfsJobs
+	case Extract:
+		return config.MaxExtractJobs
+	case Network:
+		return config.MaxNetworkJobs
+	default:
+		return 0
+	}
+}
+
+// Dir returns the directory the slots are in.
+func Dir(config types.StackerConfig) string {
+	if config.LimitsDir != "" {
+		return config.LimitsDir
+	}
+
+	if os.Geteuid() == 0 && !shared.RunningInUserNS() {
+		return "/run/stacker/limits"
+	}
+
+	return path.Join(config.StackerDir, "limits")
+}
+
+// setupDir creates dir if it doesn't exist, and checks that it's a directory
+// only its owner, the user stacker runs as, can write to.
+func setupDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.Wrapf(err, "couldn't create %s", dir)
+	}
+
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if !fi.IsDir() {
+		return errors.Errorf("limits dir %s isn't a directory", dir)
+	}
+
+	stat := fi.Sys().(*syscall.Stat_t)
+	if int(stat.Uid) != os.Geteuid() {
+		return errors.Errorf("limits dir %s is owned by uid %d, not %d", dir, stat.Uid, os.Geteuid())
+	}
+
+	if fi.Mode()&0022 != 0 {
+		return errors.Errorf("limits dir %s can be written to by others (mode %o)", dir, fi.Mode().Perm())
+	}
+
+	return nil
+}
+
+// Acquire blocks until there is a free slot for another operation of kind,
+// and returns a function that frees it again. If there is no limit for kind,
+// it returns immediately.
+func Acquire(config types.StackerConfig, kind Kind) (func(), error) {
+	n := maxJobs(config, kind)
+	if n <= 0 {
+		return func() {}, nil
+	}
+
+	dir := Dir(config)
+	if err := setupDir(dir); err != nil {
+		return nil, err
+	}
+
+	waiting := false
+	for {
+		for i := 0; i < n; i++ {
+			slot := path.Join(dir, fmt.Sprintf("%s.%d", kind, i))
+			f, err := os.OpenFile(slot, os.O_RDWR|os.O_CREATE|unix.O_NOFOLLOW, 0600)
+			if err != nil {
+				return nil, errors.Wrapf(err, "couldn't open %s", slot)
+			}
+
+			err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+			if err == nil {
+				return func() {
+					unix.Flock(int(f.Fd()), unix.LOCK_UN)
+					f.Close()
+				}, nil
+			}
+
+			f.Close()
+			if err != unix.EWOULDBLOCK {
+				return nil, errors.Wrapf(err, "couldn't lock %s", slot)
+			}
+		}
+
+		if !waiting {
+			log.Infof("waiting for one of the %d %s slots to be free", n, kind)
+			waiting = true
+		}
+		time.Sleep(pollInterval)
+	}
+}
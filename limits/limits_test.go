@@ -0,0 +1,83 @@
+package limits
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/anuvu/stacker/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcquire(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_limits_test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pollInterval = 10 * time.Millisecond
+	config := types.StackerConfig{LimitsDir: dir, MaxSquashfsJobs: 2}
+
+	release1, err := Acquire(config, Squashfs)
+	assert.NoError(err)
+	release2, err := Acquire(config, Squashfs)
+	assert.NoError(err)
+
+	// other kinds aren't limited by this one
+	releaseNetwork, err := Acquire(config, Network)
+	assert.NoError(err)
+	releaseNetwork()
+
+	acquired := make(chan func())
+	go func() {
+		release3, err := Acquire(config, Squashfs)
+		assert.NoError(err)
+		acquired <- release3
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("acquired a third slot of two")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	release1()
+	select {
+	case release3 := <-acquired:
+		release3()
+	case <-time.After(time.Second):
+		t.Fatalf("didn't acquire a freed slot")
+	}
+
+	release2()
+}
+
+func TestAcquireUnsafeDir(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_limits_test")
+	if err != nil {
+		t.Fatalf("couldn't create temp dir %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := types.StackerConfig{LimitsDir: dir, MaxSquashfsJobs: 1}
+
+	// someone else could plant slots in it
+	assert.NoError(os.Chmod(dir, 0777))
+	_, err = Acquire(config, Squashfs)
+	assert.Error(err)
+
+	// slots that are symlinks aren't followed
+	assert.NoError(os.Chmod(dir, 0700))
+	target := path.Join(dir, "target")
+	assert.NoError(ioutil.WriteFile(target, []byte{}, 0600))
+	assert.NoError(os.Symlink(target, path.Join(dir, "squashfs.0")))
+	_, err = Acquire(config, Squashfs)
+	assert.Error(err)
+}
@@ -0,0 +1,49 @@
+package stacker
+
+import (
+	"os"
+	"path"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/types"
+	"github.com/pkg/errors"
+)
+
+// rootsDirLock is the file that stackers using the roots dir lock. It is next
+// to the roots dir rather than in it, since the roots dir may be a btrfs
+// mount, or be deleted and recreated, while it's locked.
+func rootsDirLock(c types.StackerConfig) string {
+	return path.Join(path.Dir(c.RootFSDir), "."+path.Base(c.RootFSDir)+".lock")
+}
+
+// lockRootsDir takes an exclusive lock on the roots dir, which is held until
+// stacker exits, so that two stackers don't build in (or otherwise change)
+// it at once. Reading images in the OCI output only needs LockOCILayout().
+func lockRootsDir(c types.StackerConfig) error {
+	p := rootsDirLock(c)
+	if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	f, err := os.OpenFile(p, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create %s", p)
+	}
+	f.Close()
+
+	_, err = lib.Lock(p, true)
+	return err
+}
+
+// LockOCILayout locks the OCI layout at dir: shared to read images from it,
+// which builds may add to (see oci.OpenLayout()) but nothing may delete blobs
+// from in the meantime, or exclusive to delete blobs (gc, prune, etc.). It
+// returns a function that releases the lock; if dir doesn't exist, there is
+// nothing to lock.
+func LockOCILayout(dir string, exclusive bool) (func(), error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return func() {}, nil
+	}
+
+	return lib.Lock(dir, exclusive)
+}
@@ -3,10 +3,28 @@ package log
 import (
 	"fmt"
 	"io"
+	"sort"
+	"strings"
 
 	"github.com/apex/log"
+	"github.com/pkg/errors"
 )
 
+// The subsystems whose debug logs can be turned on by themselves, with e.g.
+// --debug=storage,oci.
+const (
+	// Storage logs the mounts and storage backend commands stacker runs.
+	Storage = "storage"
+	// OCI logs the images stacker copies and files it downloads.
+	OCI = "oci"
+	// Container logs the lxc configs of the containers stacker runs.
+	Container = "container"
+)
+
+var subsystems = []string{Storage, OCI, Container}
+
+var debugSubsystems = map[string]bool{}
+
 var thisIsAStackerLog struct{}
 
 func addStackerLogSentinel(e *log.Entry) *log.Entry {
@@ -45,6 +63,69 @@ func Infof(msg string, v ...interface{}) {
 	addStackerLogSentinel(log.NewEntry(log.Log.(*log.Logger))).Infof(msg, v...)
 }
 
+// SubsystemDebugf logs a debug message about subsystem, which is shown either
+// when all debug logs are, or when that subsystem's are.
+func SubsystemDebugf(subsystem string, msg string, v ...interface{}) {
+	msg = subsystem + ": " + msg
+	if debugSubsystems[subsystem] {
+		Infof(msg, v...)
+		return
+	}
+
+	Debugf(msg, v...)
+}
+
+// DebugFlag is the value of the --debug flag: either just --debug, which turns
+// on all debug logs, or --debug=subsystem,..., which only turns on those
+// subsystems' debug logs.
+type DebugFlag struct {
+	// All is true for a plain --debug.
+	All bool
+}
+
+// IsBoolFlag lets --debug be given without a value.
+func (df *DebugFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (df *DebugFlag) Set(value string) error {
+	switch value {
+	case "true":
+		df.All = true
+		return nil
+	case "false":
+		df.All = false
+		return nil
+	}
+
+	for _, subsystem := range strings.Split(value, ",") {
+		known := false
+		for _, s := range subsystems {
+			known = known || s == subsystem
+		}
+		if !known {
+			return errors.Errorf("unknown debug subsystem %s, it should be one of: %s", subsystem, strings.Join(subsystems, ", "))
+		}
+
+		debugSubsystems[subsystem] = true
+	}
+
+	return nil
+}
+
+func (df *DebugFlag) String() string {
+	if df.All {
+		return "true"
+	}
+
+	enabled := []string{}
+	for subsystem := range debugSubsystems {
+		enabled = append(enabled, subsystem)
+	}
+	sort.Strings(enabled)
+	return strings.Join(enabled, ",")
+}
+
 type TextHandler struct {
 	out io.StringWriter
 }
@@ -0,0 +1,198 @@
+package stacker
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/squashfs"
+	"github.com/anuvu/stacker/types"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/lxc/lxd/shared/osarch"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// The files of an LXD (or Incus) split image, as ExportLXDImage writes them.
+const (
+	LXDMetadataFile = "metadata.tar.gz"
+	LXDRootfsFile   = "rootfs.squashfs"
+)
+
+// lxdMetadata is an LXD image's metadata.yaml.
+type lxdMetadata struct {
+	Architecture string            `yaml:"architecture"`
+	CreationDate int64             `yaml:"creation_date"`
+	Properties   map[string]string `yaml:"properties"`
+}
+
+// readOSRelease returns the fields of the os-release file in rootfs, or
+// nothing if it doesn't have one.
+func readOSRelease(rootfs string) (map[string]string, error) {
+	fields := map[string]string{}
+
+	// it's usually a symlink, which is resolved in rootfs, not on the host
+	open := func(p string) (*os.File, error) {
+		full, err := securejoin.SecureJoin(rootfs, p)
+		if err != nil {
+			return nil, err
+		}
+		return os.Open(full)
+	}
+
+	f, err := open("etc/os-release")
+	if os.IsNotExist(err) {
+		f, err = open("usr/lib/os-release")
+	}
+	if os.IsNotExist(err) {
+		return fields, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		fields[parts[0]] = strings.Trim(parts[1], `"'`)
+	}
+
+	return fields, errors.WithStack(scanner.Err())
+}
+
+// lxdImageMetadata returns the metadata of an LXD image of the layer tag,
+// whose filesystem is rootfs.
+func lxdImageMetadata(tag string, rootfs string) (lxdMetadata, error) {
+	arch, err := osarch.ArchitectureGetLocal()
+	if err != nil {
+		return lxdMetadata{}, errors.WithStack(err)
+	}
+
+	osRelease, err := readOSRelease(rootfs)
+	if err != nil {
+		return lxdMetadata{}, err
+	}
+
+	properties := map[string]string{"name": tag, "description": tag}
+	if osRelease["ID"] != "" {
+		properties["os"] = osRelease["ID"]
+	}
+	if osRelease["VERSION_ID"] != "" {
+		properties["release"] = osRelease["VERSION_ID"]
+	}
+	if osRelease["PRETTY_NAME"] != "" {
+		properties["description"] = osRelease["PRETTY_NAME"] + " (" + tag + ")"
+	}
+
+	return lxdMetadata{
+		Architecture: arch,
+		CreationDate: time.Now().Unix(),
+		Properties:   properties,
+	}, nil
+}
+
+// writeLXDMetadata writes the metadata tarball of an LXD image to file.
+func writeLXDMetadata(file string, metadata lxdMetadata) error {
+	content, err := yaml.Marshal(metadata)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "metadata.yaml",
+		Mode:     0644,
+		Size:     int64(len(content)),
+		ModTime:  time.Unix(metadata.CreationDate, 0),
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err := tw.Write(content); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	if err := gzw.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return errors.WithStack(f.Close())
+}
+
+// ExportLXDImage writes the filesystem of the built layer tag to dir as an
+// LXD (or Incus) split image: a metadata tarball, and the filesystem as a
+// squashfs.
+func ExportLXDImage(config types.StackerConfig, s types.Storage, tag string, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	name, cleanup, err := s.TemporaryWritableSnapshot(tag)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	rootfs := path.Join(config.RootFSDir, name, "rootfs")
+	metadata, err := lxdImageMetadata(tag, rootfs)
+	if err != nil {
+		return err
+	}
+
+	if err := writeLXDMetadata(path.Join(dir, LXDMetadataFile), metadata); err != nil {
+		return errors.Wrapf(err, "couldn't write lxd metadata of %s", tag)
+	}
+
+	image, err := squashfs.MakeSquashfsFile(dir, rootfs, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(image, path.Join(dir, LXDRootfsFile)); err != nil {
+		os.Remove(image)
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+// ImportLXDImage imports the LXD image ExportLXDImage wrote to dir into the
+// local daemon with client (lxc, or incus), as alias.
+func ImportLXDImage(client string, dir string, alias string) error {
+	log.Infof("importing %s into %s as %s", dir, client, alias)
+	cmd := exec.Command(client, "image", "import", path.Join(dir, LXDMetadataFile), path.Join(dir, LXDRootfsFile), "--alias", alias)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "%s image import failed: %s", client, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package stacker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestLXDImageMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_lxd_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	rootfs := path.Join(dir, "rootfs")
+	assert.NoError(os.MkdirAll(path.Join(rootfs, "etc"), 0755))
+	osRelease := `# a comment
+NAME="CentOS Linux"
+ID="centos"
+VERSION_ID='7'
+PRETTY_NAME="CentOS Linux 7 (Core)"
+`
+	assert.NoError(ioutil.WriteFile(path.Join(rootfs, "etc/os-release"), []byte(osRelease), 0644))
+
+	metadata, err := lxdImageMetadata("app", rootfs)
+	assert.NoError(err)
+	assert.NotEmpty(metadata.Architecture)
+	assert.Equal(map[string]string{
+		"name":        "app",
+		"description": "CentOS Linux 7 (Core) (app)",
+		"os":          "centos",
+		"release":     "7",
+	}, metadata.Properties)
+
+	file := path.Join(dir, LXDMetadataFile)
+	assert.NoError(writeLXDMetadata(file, metadata))
+
+	f, err := os.Open(file)
+	assert.NoError(err)
+	defer f.Close()
+	gzr, err := gzip.NewReader(f)
+	assert.NoError(err)
+	tr := tar.NewReader(gzr)
+	hdr, err := tr.Next()
+	assert.NoError(err)
+	assert.Equal("metadata.yaml", hdr.Name)
+
+	content, err := ioutil.ReadAll(tr)
+	assert.NoError(err)
+	written := lxdMetadata{}
+	assert.NoError(yaml.Unmarshal(content, &written))
+	assert.Equal(metadata, written)
+
+	// no os-release is fine too
+	metadata, err = lxdImageMetadata("scratch", dir)
+	assert.NoError(err)
+	assert.Equal(map[string]string{"name": "scratch", "description": "scratch"}, metadata.Properties)
+}
+
+func TestReadOSReleaseStaysInRootfs(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_lxd_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	// an absolute symlink, as some distros have, is the rootfs's file,
+	// not the host's
+	assert.NoError(os.MkdirAll(path.Join(dir, "etc"), 0755))
+	assert.NoError(os.MkdirAll(path.Join(dir, "usr/lib"), 0755))
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "usr/lib/os-release"), []byte("ID=stacker-test\n"), 0644))
+	assert.NoError(os.Symlink("/usr/lib/os-release", path.Join(dir, "etc/os-release")))
+
+	fields, err := readOSRelease(dir)
+	assert.NoError(err)
+	assert.Equal(map[string]string{"ID": "stacker-test"}, fields)
+}
@@ -0,0 +1,234 @@
+package stacker
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/anuvu/stacker/log"
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/storage"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// mergeWithParent replaces the last layer of the layerType image name is
+// built on and the layer name's build added to it with one layer that has
+// both of their changes, so that name doesn't add a layer to its base.
+func mergeWithParent(config types.StackerConfig, oci casext.Engine, name string, layerType types.LayerType, sfm types.StackerFiles) error {
+	if layerType != "tar" {
+		return errors.Errorf("%s: merge_with_parent only works with tar layers, not %s", name, layerType)
+	}
+
+	layerName := layerType.LayerName(name)
+	manifest, err := stackeroci.LookupManifest(oci, layerName)
+	if err != nil {
+		return err
+	}
+
+	base, ok, err := baseLayers(config, oci, name, layerType, sfm)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.Errorf("%s: its base has no %s layers to merge into", name, layerType)
+	}
+
+	if len(base) == 0 {
+		log.Infof("%s: its base has no layers, so there's nothing to merge it into", name)
+		return nil
+	}
+
+	n := len(manifest.Layers)
+	if n != len(base)+1 || !sameLayers(base, manifest.Layers[:n-1]) {
+		return errors.Errorf("%s: can only merge one layer into its base's, not %d", name, n-len(base))
+	}
+
+	parent := manifest.Layers[n-2]
+	delta := manifest.Layers[n-1]
+
+	imageConfig, err := stackeroci.LookupConfig(oci, manifest.Config)
+	if err != nil {
+		return err
+	}
+
+	compressor, err := storage.TarCompressor(config)
+	if err != nil {
+		return err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(mergeTarLayers(oci, parent, delta, writer))
+	}()
+	defer reader.Close()
+
+	digester := digest.SHA256.Digester()
+	compressed, err := compressor.Compress(io.TeeReader(reader, digester.Hash()))
+	if err != nil {
+		return errors.Wrapf(err, "couldn't compress merged layer")
+	}
+	defer compressed.Close()
+
+	d, size, err := oci.PutBlob(context.Background(), compressed)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't merge %s into %s", delta.Digest, parent.Digest)
+	}
+
+	mediaType := ispec.MediaTypeImageLayer
+	if compressor.MediaTypeSuffix() != "" {
+		mediaType = mediaType + "+" + compressor.MediaTypeSuffix()
+	}
+
+	merged := ispec.Descriptor{MediaType: mediaType, Digest: d, Size: size}
+	log.Infof("merged %s's layer into its base's: %s", name, merged.Digest)
+
+	manifest.Layers = append(manifest.Layers[:n-2], merged)
+	diffIDs := imageConfig.RootFS.DiffIDs
+	imageConfig.RootFS.DiffIDs = append(diffIDs[:len(diffIDs)-2], digester.Digest())
+
+	// the build's layer history entry no longer has a layer of its own
+	for i := len(imageConfig.History) - 1; i >= 0; i-- {
+		if !imageConfig.History[i].EmptyLayer {
+			imageConfig.History[i].EmptyLayer = true
+			imageConfig.History[i].Comment = "merged into the layer before it"
+			break
+		}
+	}
+
+	_, err = stackeroci.UpdateImageConfig(oci, layerName, imageConfig, manifest)
+	return err
+}
+
+// mergeTarLayers writes to w a tar layer that is the tar layer parent with
+// the tar layer delta applied on top of it: parent's entries that delta
+// changes, deletes or hides are left out, then all of delta's entries are
+// written, including its whiteouts, since those also hide things in the
+// layers before parent.
+func mergeTarLayers(oci casext.Engine, parent ispec.Descriptor, delta ispec.Descriptor, w io.Writer) error {
+	changes, err := tarLayerChanges(oci, delta)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	err = walkTarLayer(oci, parent, func(hdr *tar.Header, r io.Reader) error {
+		p := path.Clean("/" + hdr.Name)
+		if changes.replaces(p) {
+			return nil
+		}
+
+		if hdr.Typeflag == tar.TypeLink {
+			target := path.Clean("/" + hdr.Linkname)
+			if changes.replaces(target) {
+				return errors.Errorf("can't merge layers: %s is a hard link to %s, which the layer changes", p, target)
+			}
+		}
+
+		return copyTarEntry(tw, hdr, r)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read %s", parent.Digest)
+	}
+
+	err = walkTarLayer(oci, delta, func(hdr *tar.Header, r io.Reader) error {
+		return copyTarEntry(tw, hdr, r)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read %s", delta.Digest)
+	}
+
+	return errors.WithStack(tw.Close())
+}
+
+// layerChanges is what a tar layer does to the paths in the layers before
+// it.
+type layerChanges struct {
+	// the paths the layer has entries for
+	entries map[string]bool
+	// the paths whose contents the layer replaces: directories it deletes
+	// or makes opaque, and things it puts something that isn't a
+	// directory in the place of
+	subtrees map[string]bool
+}
+
+func tarLayerChanges(oci casext.Engine, desc ispec.Descriptor) (layerChanges, error) {
+	changes := layerChanges{entries: map[string]bool{}, subtrees: map[string]bool{}}
+	err := walkTarLayer(oci, desc, func(hdr *tar.Header, r io.Reader) error {
+		p := path.Clean("/" + hdr.Name)
+		changes.entries[p] = true
+
+		dir, base := path.Split(p)
+		switch {
+		case base == opaqueWhiteout:
+			changes.subtrees[path.Clean(dir)] = true
+		case strings.HasPrefix(base, whiteoutPrefix):
+			deleted := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			changes.entries[deleted] = true
+			changes.subtrees[deleted] = true
+		case hdr.Typeflag != tar.TypeDir:
+			changes.subtrees[p] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return layerChanges{}, errors.Wrapf(err, "couldn't read %s", desc.Digest)
+	}
+
+	return changes, nil
+}
+
+// replaces returns true if the layer has an entry for p, or deletes or
+// replaces a directory p is in.
+func (c layerChanges) replaces(p string) bool {
+	if c.entries[p] {
+		return true
+	}
+
+	for dir := path.Dir(p); ; dir = path.Dir(dir) {
+		if c.subtrees[dir] {
+			return true
+		}
+		if dir == "/" {
+			return false
+		}
+	}
+}
+
+func walkTarLayer(oci casext.Engine, desc ispec.Descriptor, f func(hdr *tar.Header, r io.Reader) error) error {
+	layer, err := stackeroci.OpenTarLayer(oci, desc)
+	if err != nil {
+		return err
+	}
+	defer layer.Close()
+
+	tr := tar.NewReader(layer)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := f(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func copyTarEntry(tw *tar.Writer, hdr *tar.Header, r io.Reader) error {
+	if err := tw.WriteHeader(hdr); err != nil {
+		return errors.Wrapf(err, "couldn't write %s", hdr.Name)
+	}
+
+	_, err := io.Copy(tw, r)
+	return errors.Wrapf(err, "couldn't write %s", hdr.Name)
+}
@@ -0,0 +1,107 @@
+package stacker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/stretchr/testify/assert"
+)
+
+func putTestTarLayer(t *testing.T, oci casext.Engine, entries ...*tar.Header) ispec.Descriptor {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, hdr := range entries {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		assert.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write([]byte(hdr.Name))
+			assert.NoError(t, err)
+		}
+	}
+	assert.NoError(t, tw.Close())
+
+	d, size, err := oci.PutBlob(context.Background(), buf)
+	assert.NoError(t, err)
+	return ispec.Descriptor{MediaType: ispec.MediaTypeImageLayer, Digest: d, Size: size}
+}
+
+func TestMergeTarLayers(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_merge_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	oci, err := umoci.CreateLayout(path.Join(dir, "oci"))
+	assert.NoError(err)
+	defer oci.Close()
+
+	file := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+	}
+	directory := func(name string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}
+	}
+
+	parent := putTestTarLayer(t, oci,
+		directory("etc/"), file("etc/kept"), file("etc/changed"),
+		directory("opt/"), file("opt/deleted"), file("opt/.wh.lower"),
+		directory("var/"), directory("var/gone/"), file("var/gone/file"),
+		directory("srv/"), file("srv/hidden"),
+		directory("usr/"), file("usr/replaced/file"),
+	)
+	delta := putTestTarLayer(t, oci,
+		file("etc/changed"), file("etc/new"),
+		file("opt/.wh.deleted"),
+		file("var/.wh.gone"),
+		directory("srv/"), file("srv/.wh..wh..opq"), file("srv/shown"),
+		file("usr/replaced"),
+	)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(mergeTarLayers(oci, parent, delta, buf))
+
+	entries := []string{}
+	contents := map[string]string{}
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(err)
+		entries = append(entries, hdr.Name)
+		content, err := ioutil.ReadAll(tr)
+		assert.NoError(err)
+		contents[hdr.Name] = string(content)
+	}
+
+	assert.Equal([]string{
+		"etc/", "etc/kept",
+		"opt/", "opt/.wh.lower",
+		"var/",
+		"usr/",
+		"etc/changed", "etc/new",
+		"opt/.wh.deleted",
+		"var/.wh.gone",
+		"srv/", "srv/.wh..wh..opq", "srv/shown",
+		"usr/replaced",
+	}, entries)
+	assert.Equal("etc/changed", contents["etc/changed"])
+
+	// hard links to things the layer changes can't be kept
+	parent = putTestTarLayer(t, oci, file("a"), &tar.Header{Name: "b", Typeflag: tar.TypeLink, Linkname: "a"})
+	delta = putTestTarLayer(t, oci, file("a"))
+	assert.Error(mergeTarLayers(oci, parent, delta, ioutil.Discard))
+}
@@ -0,0 +1,32 @@
+package mtree
+
+import (
+	"github.com/opencontainers/umoci"
+	"github.com/pkg/errors"
+	"github.com/vbatts/go-mtree"
+)
+
+// Keywords returns the mtree keywords layers are generated by comparing:
+// umoci's, or the ones in configured (the mtree_keywords config option), if
+// there are any. Only umoci's keywords are recorded when a bundle is
+// unpacked, so configured can only have those, and always compares type,
+// since files replaced by directories (and the like) have to be in the
+// layer.
+func Keywords(configured []string) ([]mtree.Keyword, error) {
+	if len(configured) == 0 {
+		return umoci.MtreeKeywords, nil
+	}
+
+	keywords := []mtree.Keyword{"type"}
+	for _, kw := range configured {
+		if !mtree.InKeywordSlice(mtree.Keyword(kw), umoci.MtreeKeywords) {
+			return nil, errors.Errorf("unsupported mtree keyword %s, it should be one of %v", kw, umoci.MtreeKeywords)
+		}
+
+		if !mtree.InKeywordSlice(mtree.Keyword(kw), keywords) {
+			keywords = append(keywords, mtree.Keyword(kw))
+		}
+	}
+
+	return keywords, nil
+}
@@ -5,12 +5,14 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"path"
 	"strconv"
 	"strings"
 
 	"github.com/anuvu/stacker/lib"
 	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
 	"github.com/cheggaaa/pb/v3"
 	"github.com/pkg/errors"
 )
@@ -65,28 +67,70 @@ func Download(cacheDir string, url string, progress bool, remoteHash string, rem
 
 	log.Infof("downloading %v", url)
 
-	resp, err := http.Get(url)
+	body, length, err := openRemote(url)
 	if err != nil {
 		os.RemoveAll(name)
 		return "", err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		os.RemoveAll(name)
-		return "", errors.Errorf("couldn't download %s: %s", url, resp.Status)
-	}
 
-	source := resp.Body
+	source := io.Reader(body)
 	if progress {
-		bar := pb.New(int(resp.ContentLength)).Set(pb.Bytes, true)
+		bar := pb.New(int(length)).Set(pb.Bytes, true)
 		bar.Start()
 		source = bar.NewProxyReader(source)
 		defer bar.Finish()
 	}
 
 	_, err = io.Copy(out, source)
-	return name, err
+
+	// for ftp, this is where a failed transfer is reported
+	closeErr := body.Close()
+	if err != nil {
+		return name, err
+	}
+	return name, closeErr
+}
+
+// openRemote returns the content of the http(s) or ftp url, and its length
+// (or -1 if it isn't known).
+func openRemote(remoteURL string) (io.ReadCloser, int64, error) {
+	if strings.HasPrefix(remoteURL, "ftp://") {
+		return ftpGet(remoteURL)
+	}
+
+	log.SubsystemDebugf(log.OCI, "GET %s", redactURL(remoteURL))
+	resp, err := http.Get(remoteURL)
+	if err != nil {
+		return nil, 0, types.WithKind(types.NetworkError, err)
+	}
+
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, 0, types.KindErrorf(types.NetworkError, "couldn't download %s: %s", remoteURL, resp.Status)
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// rsyncDownload fetches the file or directory at the rsync url into cacheDir.
+// Since rsync only transfers what changed, the copy there from a previous
+// build is just updated, and it's used as is if the server can't be reached.
+func rsyncDownload(cacheDir string, url string) (string, error) {
+	url = strings.TrimSuffix(url, "/")
+	name := path.Join(cacheDir, path.Base(url))
+
+	log.Infof("rsyncing %v", redactURL(url))
+	cmd := exec.Command("rsync", "--recursive", "--links", "--perms", "--times", "--delete", url, cacheDir+"/")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if _, statErr := os.Stat(name); statErr == nil {
+			log.Infof("couldn't rsync %s, using cached copy: %s", redactURL(url), strings.TrimSpace(string(output)))
+			return name, nil
+		}
+		return "", types.KindErrorf(types.NetworkError, "couldn't rsync %s: %s", redactURL(url), strings.TrimSpace(string(output)))
+	}
+
+	return name, nil
 }
 
 // getHttpFileInfo returns the hash and content size a file stored on a web server
@@ -102,6 +146,7 @@ func getHttpFileInfo(remoteURL string) (string, string, error) {
 	}
 
 	// Make a HEAD call on remote URL
+	log.SubsystemDebugf(log.OCI, "HEAD %s", u.Redacted())
 	resp, err := http.Head(remoteURL)
 	if err != nil {
 		return "", "", err
@@ -115,3 +160,14 @@ func getHttpFileInfo(remoteURL string) (string, string, error) {
 
 	return hash, length, nil
 }
+
+// redactURL hides the password in remoteURL, if it has one, so that it can be
+// logged.
+func redactURL(remoteURL string) string {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return remoteURL
+	}
+
+	return u.Redacted()
+}
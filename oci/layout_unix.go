@@ -0,0 +1,337 @@
+//go:build !windows
+// +build !windows
+
+package oci
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/cas"
+	"github.com/opencontainers/umoci/oci/cas/dir"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// journalPrefix is the prefix of the journals of the blobs added to a layout
+// that its index doesn't refer to yet, kept in the layout's top directory.
+const journalPrefix = ".stacker-journal-"
+
+// durableEngine is umoci's directory CAS, with blobs and the index fsynced
+// before they are used, so a crash (or power loss) never leaves an index that
+// refers to blobs that are missing or half written. Blobs added since the
+// last index update are listed in a journal, which is locked while the engine
+// is open, so that Recover() can clean up after engines that weren't closed.
+type durableEngine struct {
+	cas.Engine
+	dir     string
+	journal *os.File
+}
+
+// OpenLayout opens the OCI layout at ociDir, like umoci.OpenLayout(), but
+// with its blob and index writes made durable.
+func OpenLayout(ociDir string) (casext.Engine, error) {
+	engine, err := dir.Open(ociDir)
+	if err != nil {
+		return casext.Engine{}, errors.Wrap(err, "open CAS")
+	}
+
+	return casext.NewEngine(&durableEngine{Engine: engine, dir: ociDir}), nil
+}
+
+// CreateLayout creates an OCI layout at ociDir, which must not exist, and
+// opens it like OpenLayout().
+func CreateLayout(ociDir string) (casext.Engine, error) {
+	if err := dir.Create(ociDir); err != nil {
+		return casext.Engine{}, err
+	}
+
+	if err := syncDir(path.Dir(ociDir)); err != nil {
+		return casext.Engine{}, err
+	}
+
+	return OpenLayout(ociDir)
+}
+
+func blobPath(ociDir string, d digest.Digest) string {
+	return path.Join(ociDir, "blobs", d.Algorithm().String(), d.Encoded())
+}
+
+func syncFile(p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	return errors.Wrapf(f.Sync(), "couldn't sync %s", p)
+}
+
+func syncDir(p string) error {
+	return syncFile(p)
+}
+
+// syncBlob makes a blob that was just renamed into ociDir durable.
+func syncBlob(ociDir string, d digest.Digest) error {
+	p := blobPath(ociDir, d)
+	if err := syncFile(p); err != nil {
+		return err
+	}
+
+	return syncDir(path.Dir(p))
+}
+
+func (e *durableEngine) addToJournal(d digest.Digest) error {
+	if e.journal == nil {
+		f, err := ioutil.TempFile(e.dir, journalPrefix)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't create journal in %s", e.dir)
+		}
+
+		if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return errors.Wrapf(err, "couldn't lock %s", f.Name())
+		}
+		e.journal = f
+	}
+
+	if _, err := fmt.Fprintln(e.journal, d); err != nil {
+		return errors.Wrapf(err, "couldn't write to %s", e.journal.Name())
+	}
+
+	return errors.Wrapf(e.journal.Sync(), "couldn't sync %s", e.journal.Name())
+}
+
+func (e *durableEngine) PutBlob(ctx context.Context, reader io.Reader) (digest.Digest, int64, error) {
+	d, size, err := e.Engine.PutBlob(ctx, reader)
+	if err != nil {
+		return "", -1, err
+	}
+
+	if err := e.addToJournal(d); err != nil {
+		return "", -1, err
+	}
+
+	if err := syncBlob(e.dir, d); err != nil {
+		return "", -1, err
+	}
+
+	return d, size, nil
+}
+
+// PutIndex replaces the layout's index.json with index, via a fsynced
+// temporary file, after checking that the blobs it refers to exist.
+func (e *durableEngine) PutIndex(ctx context.Context, index ispec.Index) error {
+	for _, desc := range index.Manifests {
+		if _, err := os.Stat(blobPath(e.dir, desc.Digest)); err != nil {
+			return errors.Wrapf(err, "refusing to write an index referring to missing blob %s", desc.Digest)
+		}
+	}
+
+	f, err := ioutil.TempFile(e.dir, ".stacker-index-")
+	if err != nil {
+		return errors.Wrapf(err, "couldn't create temporary index")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(index); err != nil {
+		return errors.Wrapf(err, "couldn't write temporary index")
+	}
+
+	if err := f.Sync(); err != nil {
+		return errors.Wrapf(err, "couldn't sync temporary index")
+	}
+
+	if err := os.Rename(f.Name(), path.Join(e.dir, "index.json")); err != nil {
+		return errors.Wrapf(err, "couldn't replace index")
+	}
+
+	if err := syncDir(e.dir); err != nil {
+		return err
+	}
+
+	// the blobs added so far are referred to now, or were orphaned by a
+	// retag and are left for GC
+	if e.journal != nil {
+		if err := e.journal.Truncate(0); err != nil {
+			return errors.Wrapf(err, "couldn't truncate %s", e.journal.Name())
+		}
+		if _, err := e.journal.Seek(0, io.SeekStart); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
+
+func (e *durableEngine) Close() error {
+	if e.journal != nil {
+		os.Remove(e.journal.Name())
+		e.journal.Close()
+		e.journal = nil
+	}
+
+	return e.Engine.Close()
+}
+
+// journalBlob journals and syncs the blob d, which was added to oci's layout
+// without PutBlob() (see PutBlobFile()).
+func journalBlob(oci casext.Engine, d digest.Digest) error {
+	e, ok := oci.Engine.(*durableEngine)
+	if !ok {
+		return nil
+	}
+
+	if err := e.addToJournal(d); err != nil {
+		return err
+	}
+
+	return syncBlob(e.dir, d)
+}
+
+// readJournal returns the blobs listed in the journal f.
+func readJournal(f *os.File) ([]digest.Digest, error) {
+	blobs := []digest.Digest{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		d, err := digest.Parse(scanner.Text())
+		if err != nil {
+			// the last line may have been half written
+			continue
+		}
+		blobs = append(blobs, d)
+	}
+
+	return blobs, errors.Wrapf(scanner.Err(), "couldn't read %s", f.Name())
+}
+
+// Recover repairs the OCI layout at ociDir after a stacker that was writing
+// to it died: tags whose manifest, config or layers are missing are dropped
+// from the index, and blobs that dead stackers were adding that nothing
+// refers to are deleted, along with their journals and temporary files. It
+// is safe to run while other stackers are using the layout.
+func Recover(ociDir string) error {
+	if _, err := os.Stat(path.Join(ociDir, "index.json")); os.IsNotExist(err) {
+		return nil
+	}
+
+	journals, err := filepath.Glob(path.Join(ociDir, journalPrefix+"*"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	inFlight := map[digest.Digest]bool{}
+	live := map[digest.Digest]bool{}
+	dead := []string{}
+	for _, j := range journals {
+		f, err := os.Open(j)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return errors.WithStack(err)
+		}
+
+		// a locked journal belongs to a stacker that's still running,
+		// so its blobs are kept
+		locked := unix.Flock(int(f.Fd()), unix.LOCK_SH|unix.LOCK_NB) != nil
+		blobs, err := readJournal(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, d := range blobs {
+			if locked {
+				live[d] = true
+			} else {
+				inFlight[d] = true
+			}
+		}
+		if !locked {
+			dead = append(dead, j)
+		}
+	}
+
+	oci, err := OpenLayout(ociDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	ctx := context.Background()
+	index, err := oci.GetIndex(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read the index of %s", ociDir)
+	}
+
+	referenced := map[digest.Digest]bool{}
+	manifests := []ispec.Descriptor{}
+	for _, desc := range index.Manifests {
+		used := []digest.Digest{}
+		err := oci.Walk(ctx, desc, func(dp casext.DescriptorPath) error {
+			d := dp.Descriptor().Digest
+			if _, err := os.Stat(blobPath(ociDir, d)); err != nil {
+				return errors.Wrapf(err, "blob %s is missing", d)
+			}
+			used = append(used, d)
+
+			// only manifests and indexes refer to other blobs
+			switch dp.Descriptor().MediaType {
+			case ispec.MediaTypeImageManifest, ispec.MediaTypeImageIndex:
+				return nil
+			default:
+				return casext.ErrSkipDescriptor
+			}
+		})
+		if err != nil {
+			log.Infof("WARNING: dropping %s from %s: %v", desc.Annotations[ispec.AnnotationRefName], ociDir, err)
+			continue
+		}
+
+		for _, d := range used {
+			referenced[d] = true
+		}
+		manifests = append(manifests, desc)
+	}
+
+	if len(manifests) != len(index.Manifests) {
+		index.Manifests = manifests
+		if err := oci.PutIndex(ctx, index); err != nil {
+			return err
+		}
+	}
+
+	for d := range inFlight {
+		if referenced[d] || live[d] {
+			continue
+		}
+
+		log.Debugf("removing %s left behind in %s", d, ociDir)
+		if err := os.Remove(blobPath(ociDir, d)); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+
+	for _, j := range dead {
+		if err := os.Remove(j); err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+
+	// and the temporary dirs umoci left behind
+	return errors.Wrapf(oci.Clean(ctx), "couldn't clean %s", ociDir)
+}
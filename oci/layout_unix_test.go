@@ -0,0 +1,95 @@
+//go:build !windows
+// +build !windows
+
+package oci
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDurablePutIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_layout_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	oci, err := CreateLayout(path.Join(dir, "oci"))
+	assert.NoError(err)
+	defer oci.Close()
+
+	assert.NoError(umoci.NewImage(oci, "good"))
+
+	missing := ispec.Descriptor{
+		MediaType: ispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("not there"),
+		Size:      9,
+	}
+	err = oci.UpdateReference(context.Background(), "bad", missing)
+	assert.Error(err)
+
+	_, err = oci.ResolveReference(context.Background(), "good")
+	assert.NoError(err)
+}
+
+func TestRecover(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_layout_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	ociDir := path.Join(dir, "oci")
+	oci, err := CreateLayout(ociDir)
+	assert.NoError(err)
+	assert.NoError(umoci.NewImage(oci, "good"))
+	assert.NoError(umoci.NewImage(oci, "broken"))
+
+	// a stacker that is killed after adding a blob, before tagging it
+	orphan, _, err := oci.PutBlob(context.Background(), strings.NewReader("half a layer"))
+	assert.NoError(err)
+	e := oci.Engine.(*durableEngine)
+	e.journal.Close()
+
+	// and a tag whose manifest went missing some other way
+	descs, err := oci.ResolveReference(context.Background(), "broken")
+	assert.NoError(err)
+	assert.NoError(os.Remove(blobPath(ociDir, descs[0].Descriptor().Digest)))
+
+	// a stacker that's still running keeps its blobs
+	running, err := OpenLayout(ociDir)
+	assert.NoError(err)
+	defer running.Close()
+	kept, _, err := running.PutBlob(context.Background(), strings.NewReader("still being built"))
+	assert.NoError(err)
+
+	assert.NoError(Recover(ociDir))
+
+	layout, err := OpenLayout(ociDir)
+	assert.NoError(err)
+	defer layout.Close()
+
+	tags, err := layout.ListReferences(context.Background())
+	assert.NoError(err)
+	assert.Equal([]string{"good"}, tags)
+
+	_, err = os.Stat(blobPath(ociDir, orphan))
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(blobPath(ociDir, kept))
+	assert.NoError(err)
+
+	journals, err := filepath.Glob(path.Join(ociDir, journalPrefix+"*"))
+	assert.NoError(err)
+	assert.Len(journals, 1)
+}
@@ -3,7 +3,13 @@ package oci
 import (
 	"context"
 	"io"
+	"os"
+	"path"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
@@ -16,6 +22,9 @@ const (
 	// layer type so we can match against it. We should be able to revert
 	// this "soon".
 	ImpoliteMediaTypeLayerSquashfs = "application/vnd.oci.image.layer.squashfs"
+
+	// newer image-specs define this, but ours is too old
+	MediaTypeLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
 )
 
 func LookupManifest(oci casext.Engine, tag string) (ispec.Manifest, error) {
@@ -55,6 +64,32 @@ func LookupConfig(oci casext.Engine, desc ispec.Descriptor) (ispec.Image, error)
 
 }
 
+// LookupCreated returns when the image (or artifact) whose manifest is
+// manifest was created: its config's created time, or for artifacts, whose
+// configs aren't image configs, their org.opencontainers.image.created
+// annotation. It's the zero time if neither says.
+func LookupCreated(oci casext.Engine, manifest ispec.Manifest) (time.Time, error) {
+	if manifest.Config.MediaType != ispec.MediaTypeImageConfig {
+		created, ok := manifest.Annotations[ispec.AnnotationCreated]
+		if !ok {
+			return time.Time{}, nil
+		}
+
+		t, err := time.Parse(time.RFC3339, created)
+		return t, errors.Wrapf(err, "bad %s annotation", ispec.AnnotationCreated)
+	}
+
+	config, err := LookupConfig(oci, manifest.Config)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if config.Created == nil {
+		return time.Time{}, nil
+	}
+	return *config.Created, nil
+}
+
 // AddBlobNoCompression adds a blob to an OCI tag without compressing it (i.e.
 // not through umoci.mutator).
 func AddBlobNoCompression(oci casext.Engine, name string, content io.Reader) (ispec.Descriptor, error) {
@@ -72,6 +107,37 @@ func AddBlobNoCompression(oci casext.Engine, name string, content io.Reader) (is
 	return AddBlobByDescriptor(oci, name, desc)
 }
 
+// PutBlobFile adds the file at p to the layout at ociDir, which oci is open
+// on. oci.PutBlob() would copy it, so instead p is hashed and then renamed
+// into place; it is copied only if it is on a different filesystem. Either
+// way, p is gone afterwards.
+func PutBlobFile(oci casext.Engine, ociDir string, p string) (digest.Digest, int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", -1, errors.WithStack(err)
+	}
+	defer os.Remove(p)
+	defer f.Close()
+
+	digester := digest.SHA256.Digester()
+	size, err := io.Copy(digester.Hash(), f)
+	if err != nil {
+		return "", -1, errors.Wrapf(err, "couldn't hash %s", p)
+	}
+
+	blobDigest := digester.Digest()
+	err = os.Rename(p, path.Join(ociDir, "blobs", blobDigest.Algorithm().String(), blobDigest.Encoded()))
+	if err == nil {
+		return blobDigest, size, journalBlob(oci, blobDigest)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", -1, errors.WithStack(err)
+	}
+
+	return oci.PutBlob(context.Background(), f)
+}
+
 // AddBlobByDescriptor adds a layer to an OCI tag based on layer's Descriptor
 func AddBlobByDescriptor(oci casext.Engine, name string, desc ispec.Descriptor) (ispec.Descriptor, error) {
 	manifest, err := LookupManifest(oci, name)
@@ -92,6 +158,22 @@ func AddBlobByDescriptor(oci casext.Engine, name string, desc ispec.Descriptor)
 
 // UpdateImageConfig updates an oci tag with new config and new manifest
 func UpdateImageConfig(oci casext.Engine, name string, newConfig ispec.Image, newManifest ispec.Manifest) (ispec.Descriptor, error) {
+	desc, err := PutImageConfig(oci, newConfig, newManifest)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	err = oci.UpdateReference(context.Background(), name, desc)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	return desc, nil
+}
+
+// PutImageConfig adds new config and new manifest to oci without tagging
+// them, returning the manifest's descriptor.
+func PutImageConfig(oci casext.Engine, newConfig ispec.Image, newManifest ispec.Manifest) (ispec.Descriptor, error) {
 	configDigest, configSize, err := oci.PutBlobJSON(context.Background(), newConfig)
 	if err != nil {
 		return ispec.Descriptor{}, err
@@ -108,16 +190,58 @@ func UpdateImageConfig(oci casext.Engine, name string, newConfig ispec.Image, ne
 		return ispec.Descriptor{}, err
 	}
 
-	desc := ispec.Descriptor{
+	return ispec.Descriptor{
 		MediaType: ispec.MediaTypeImageManifest,
 		Digest:    manifestDigest,
 		Size:      manifestSize,
-	}
+	}, nil
+}
 
-	err = oci.UpdateReference(context.Background(), name, desc)
+// NewZstdReader returns a decompressor of the zstd stream r that uses a
+// single decoder. zstd defaults to one per CPU for each stream, and since
+// layers are already unpacked in parallel, that multiplied the memory
+// unpacking an image takes by the number of CPUs.
+func NewZstdReader(r io.Reader) (*zstd.Decoder, error) {
+	return zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+}
+
+// OpenTarLayer returns the uncompressed tar stream of the layer desc.
+func OpenTarLayer(oci casext.Engine, desc ispec.Descriptor) (io.ReadCloser, error) {
+	blob, err := oci.GetBlob(context.Background(), desc.Digest)
 	if err != nil {
-		return ispec.Descriptor{}, err
+		return nil, err
 	}
 
-	return desc, nil
+	switch desc.MediaType {
+	case ispec.MediaTypeImageLayer:
+		return blob, nil
+	case ispec.MediaTypeImageLayerGzip:
+		r, err := pgzip.NewReader(blob)
+		if err != nil {
+			blob.Close()
+			return nil, errors.Wrapf(err, "couldn't read gzip layer")
+		}
+		return readCloser{r, blob}, nil
+	case MediaTypeLayerZstd:
+		r, err := NewZstdReader(blob)
+		if err != nil {
+			blob.Close()
+			return nil, errors.Wrapf(err, "couldn't read zstd layer")
+		}
+		return readCloser{r.IOReadCloser(), blob}, nil
+	default:
+		blob.Close()
+		return nil, errors.Errorf("unknown layer media type %s", desc.MediaType)
+	}
+}
+
+// readCloser closes both a decompressor and the blob it is reading from
+type readCloser struct {
+	io.ReadCloser
+	blob io.Closer
+}
+
+func (r readCloser) Close() error {
+	r.ReadCloser.Close()
+	return r.blob.Close()
 }
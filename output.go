@@ -0,0 +1,250 @@
+package stacker
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/storage"
+	"github.com/anuvu/stacker/types"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// CpioMediaType is the media type of cpio outputs' blobs when they're
+// artifacts, with +gzip or +zstd if they're compressed.
+const CpioMediaType = "application/x-cpio"
+
+// outputFile returns where the output o of layer name is written.
+func outputFile(config types.StackerConfig, name string, o *types.Output) string {
+	if o.Path != "" {
+		return o.Path
+	}
+
+	return path.Join(path.Dir(config.OCIDir), outputFileName(name, o))
+}
+
+// outputFileName is the file name of the output o of layer name.
+func outputFileName(name string, o *types.Output) string {
+	ext := o.Type
+	switch o.Type {
+	case types.OutputDisk:
+		ext = "img"
+		if o.Format == "qcow2" {
+			ext = "qcow2"
+		}
+	case types.OutputCpio:
+		switch o.Compression {
+		case "gzip":
+			ext = "cpio.gz"
+		case "zstd":
+			ext = "cpio.zst"
+		}
+	case types.OutputCasync:
+		ext = "caidx"
+	}
+
+	return name + "." + ext
+}
+
+// generateOutput writes the output of layer l (if it has one) from the
+// layer's filesystem. If onlyIfMissing is true, e.g. because the layer was
+// cached, an output that was already written is left alone.
+func generateOutput(config types.StackerConfig, s types.Storage, name string, l *types.Layer, onlyIfMissing bool) error {
+	o, err := l.ParseOutput()
+	if err != nil || o == nil {
+		return err
+	}
+
+	// artifact outputs are made by generateArtifact instead
+	if o.Artifact {
+		return nil
+	}
+
+	dest := outputFile(config, name, o)
+	if onlyIfMissing {
+		if _, err := os.Stat(dest); err == nil {
+			log.Debugf("%s output %s is already there", name, dest)
+			return nil
+		}
+	}
+
+	writable, cleanup, err := s.TemporaryWritableSnapshot(name)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	rootfs := path.Join(config.RootFSDir, writable, "rootfs")
+
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// written next to dest, and renamed into place once it's complete
+	tmp := path.Join(path.Dir(dest), "."+path.Base(dest)+".tmp")
+	defer os.Remove(tmp)
+
+	if err := writeOutput(config, name, o, rootfs, tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		return errors.WithStack(err)
+	}
+
+	log.Infof("wrote %s output of %s to %s", o.Type, name, dest)
+	return nil
+}
+
+// checkOutputMapping checks that the output o can have its files' owners
+// mapped as layer_uid_map and layer_gid_map say, if they're set: disks and
+// casync indexes are made from the filesystem's owners as they are, so they
+// can't.
+func checkOutputMapping(config types.StackerConfig, o *types.Output) error {
+	if len(config.LayerUIDMap) == 0 && len(config.LayerGIDMap) == 0 {
+		return nil
+	}
+
+	if o.Type == types.OutputDisk || o.Type == types.OutputCasync {
+		return types.KindErrorf(types.UserError, "%s outputs can't map their files' owners, so they can't be built with layer_uid_map or layer_gid_map", o.Type)
+	}
+
+	return nil
+}
+
+// checkOutputsMapping does checkOutputMapping for the outputs of the layers
+// in sf, so that builds fail before any layers are built.
+func checkOutputsMapping(config types.StackerConfig, sf *types.Stackerfile) error {
+	for _, name := range sf.FileOrder {
+		l, _ := sf.Get(name)
+		o, err := l.ParseOutput()
+		if err != nil {
+			return errors.Wrapf(err, "%s", name)
+		}
+
+		if o == nil {
+			continue
+		}
+
+		if err := checkOutputMapping(config, o); err != nil {
+			return errors.Wrapf(err, "%s", name)
+		}
+	}
+
+	return nil
+}
+
+// writeOutput writes the output o of layer name to dest, from the layer's
+// filesystem at rootfs.
+func writeOutput(config types.StackerConfig, name string, o *types.Output, rootfs string, dest string) error {
+	if err := checkOutputMapping(config, o); err != nil {
+		return errors.Wrapf(err, "couldn't generate %s output of %s", o.Type, name)
+	}
+
+	var err error
+	switch o.Type {
+	case types.OutputDisk:
+		err = generateDiskImage(name, rootfs, o, dest)
+	case types.OutputCpio:
+		err = generateCpio(config, rootfs, o, dest)
+	case types.OutputCasync:
+		err = generateCasync(config, name, rootfs, o, dest)
+	default:
+		err = errors.Errorf("unknown output type %s", o.Type)
+	}
+
+	return errors.Wrapf(err, "couldn't generate %s output of %s", o.Type, name)
+}
+
+// generateCpio writes rootfs to dest as a cpio archive, compressed as o
+// says.
+func generateCpio(config types.StackerConfig, rootfs string, o *types.Output, dest string) error {
+	compressor, err := storage.OutputCompressor(o.Compression)
+	if err != nil {
+		return err
+	}
+
+	mapOptions, err := storage.RepackMapOptions(config)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeCpio(rootfs, writer, mapOptions))
+	}()
+
+	compressed, err := compressor.Compress(reader)
+	if err != nil {
+		reader.Close()
+		return err
+	}
+	defer compressed.Close()
+
+	if _, err := io.Copy(f, compressed); err != nil {
+		return err
+	}
+
+	return errors.WithStack(f.Close())
+}
+
+// outputArtifact replaces the images built for layer name in the OCI output
+// with l's output, packaged as an artifact.
+func outputArtifact(config types.StackerConfig, s types.Storage, oci casext.Engine, name string, l *types.Layer, layerTypes []types.LayerType) (map[types.LayerType]ispec.Descriptor, error) {
+	o, err := l.ParseOutput()
+	if err != nil {
+		return nil, err
+	}
+
+	compressor, err := storage.OutputCompressor(o.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	writable, cleanup, err := s.TemporaryWritableSnapshot(name)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "stacker-output-")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := outputFileName(name, o)
+	rootfs := path.Join(config.RootFSDir, writable, "rootfs")
+	if err := writeOutput(config, name, o, rootfs, path.Join(dir, fileName)); err != nil {
+		return nil, err
+	}
+
+	mediaType := CpioMediaType
+	if suffix := compressor.MediaTypeSuffix(); suffix != "" {
+		mediaType += "+" + suffix
+	}
+	if o.Type == types.OutputCasync {
+		mediaType = CaidxMediaType
+	}
+
+	spec := artifactSpec{
+		Path:            fileName,
+		FileMediaType:   mediaType,
+		ConfigMediaType: DefaultArtifactType,
+		Config: func(ispec.Descriptor) (interface{}, error) {
+			return struct{}{}, nil
+		},
+	}
+
+	return putArtifact(config, oci, name, layerTypes, spec, path.Join(dir, fileName))
+}
@@ -0,0 +1,53 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/anuvu/stacker/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputFile(t *testing.T) {
+	assert := assert.New(t)
+
+	config := types.StackerConfig{OCIDir: "/build/oci"}
+
+	o := &types.Output{Type: types.OutputDisk, Format: "raw"}
+	assert.Equal("/build/os.img", outputFile(config, "os", o))
+
+	o = &types.Output{Type: types.OutputDisk, Format: "qcow2"}
+	assert.Equal("/build/os.qcow2", outputFile(config, "os", o))
+
+	o = &types.Output{Type: types.OutputDisk, Format: "raw", Path: "/images/disk.raw"}
+	assert.Equal("/images/disk.raw", outputFile(config, "os", o))
+
+	o = &types.Output{Type: types.OutputCasync}
+	assert.Equal("/build/os.caidx", outputFile(config, "os", o))
+	assert.Equal("/build/os.castr", casyncStore(config, "os", o))
+
+	o = &types.Output{Type: types.OutputCasync, Store: "/srv/chunks"}
+	assert.Equal("/srv/chunks", casyncStore(config, "os", o))
+}
+
+func TestOutputFileName(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("initrd.cpio", outputFileName("initrd", &types.Output{Type: types.OutputCpio, Compression: "none"}))
+	assert.Equal("initrd.cpio.gz", outputFileName("initrd", &types.Output{Type: types.OutputCpio, Compression: "gzip"}))
+	assert.Equal("initrd.cpio.zst", outputFileName("initrd", &types.Output{Type: types.OutputCpio, Compression: "zstd"}))
+	assert.Equal("os.caidx", outputFileName("os", &types.Output{Type: types.OutputCasync}))
+}
+
+func TestCheckOutputMapping(t *testing.T) {
+	assert := assert.New(t)
+
+	config := types.StackerConfig{}
+	for _, typ := range []string{types.OutputDisk, types.OutputCpio, types.OutputCasync} {
+		assert.NoError(checkOutputMapping(config, &types.Output{Type: typ}))
+	}
+
+	config.LayerUIDMap = []string{"0:100000:65536"}
+	assert.Error(checkOutputMapping(config, &types.Output{Type: types.OutputDisk}))
+	assert.Error(checkOutputMapping(config, &types.Output{Type: types.OutputCasync}))
+	assert.NoError(checkOutputMapping(config, &types.Output{Type: types.OutputCpio}))
+}
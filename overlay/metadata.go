@@ -82,7 +82,9 @@ func (ovl overlayMetadata) write(config types.StackerConfig, tag string) error {
 	return nil
 }
 
-func (ovl overlayMetadata) lxcRootfsString(config types.StackerConfig, tag string) (string, error) {
+// lowerdirs returns the overlay lowerdirs of tag, from the bottom most to the
+// top most.
+func (ovl overlayMetadata) lowerdirs(config types.StackerConfig, tag string) ([]string, error) {
 	// find *any* manifest to mount: we don't care if this is tar or
 	// squashfs, we just need to mount something. the code that generates
 	// the output needs to care about this, not this code.
@@ -106,7 +108,7 @@ func (ovl overlayMetadata) lxcRootfsString(config types.StackerConfig, tag strin
 	for _, layer := range manifest.Layers {
 		contents := overlayPath(config, layer.Digest, "overlay")
 		if _, err := os.Stat(contents); err != nil {
-			return "", errors.Wrapf(err, "%s does not exist", contents)
+			return nil, errors.Wrapf(err, "%s does not exist", contents)
 		}
 		lowerdirs = append(lowerdirs, contents)
 	}
@@ -114,7 +116,7 @@ func (ovl overlayMetadata) lxcRootfsString(config types.StackerConfig, tag strin
 	for _, layer := range ovl.BuiltLayers {
 		contents := path.Join(config.RootFSDir, layer, "overlay")
 		if _, err := os.Stat(contents); err != nil {
-			return "", errors.Wrapf(err, "%s does not exist", contents)
+			return nil, errors.Wrapf(err, "%s does not exist", contents)
 		}
 		lowerdirs = append(lowerdirs, contents)
 	}
@@ -122,7 +124,7 @@ func (ovl overlayMetadata) lxcRootfsString(config types.StackerConfig, tag strin
 	for _, od := range descriptors {
 		contents := overlayPath(config, od.Digest, "overlay")
 		if _, err := os.Stat(contents); err != nil {
-			return "", errors.Wrapf(err, "%s does not exist", contents)
+			return nil, errors.Wrapf(err, "%s does not exist", contents)
 		}
 		lowerdirs = append(lowerdirs, contents)
 	}
@@ -135,12 +137,21 @@ func (ovl overlayMetadata) lxcRootfsString(config types.StackerConfig, tag strin
 		workaround := path.Join(config.RootFSDir, tag, fmt.Sprintf("workaround%d", i))
 		err := os.MkdirAll(workaround, 0755)
 		if err != nil {
-			return "", errors.Wrapf(err, "couldn't make workaround dir")
+			return nil, errors.Wrapf(err, "couldn't make workaround dir")
 		}
 
 		lowerdirs = append(lowerdirs, workaround)
 	}
 
+	return lowerdirs, nil
+}
+
+func (ovl overlayMetadata) lxcRootfsString(config types.StackerConfig, tag string) (string, error) {
+	lowerdirs, err := ovl.lowerdirs(config, tag)
+	if err != nil {
+		return "", err
+	}
+
 	// The OCI spec says that the first layer should be the bottom most
 	// layer (i.e. the last layer in the manifest.Layers) list, and in
 	// overlayfs it's the top most layer. So above, we've created this list
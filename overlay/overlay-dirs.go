@@ -7,7 +7,6 @@ import (
 	"github.com/anuvu/stacker/lib"
 	"github.com/anuvu/stacker/types"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
-	"github.com/opencontainers/umoci"
 	"github.com/pkg/errors"
 )
 
@@ -38,20 +37,8 @@ func generateOverlayDirsLayers(name string, layerTypes []types.LayerType, overla
 
 // generateOverlayDirLayer generates an oci layer from one overlay_dir
 func generateOverlayDirLayer(name string, layerType types.LayerType, overlayDir types.OverlayDir, config types.StackerConfig) (ispec.Descriptor, error) {
-	oci, err := umoci.OpenLayout(config.OCIDir)
-	if err != nil {
-		return ispec.Descriptor{}, err
-	}
-	defer oci.Close()
-
 	contents := path.Join(config.RootFSDir, name, "overlay_dirs", path.Base(overlayDir.Source))
-	blob, err := generateBlob(layerType, contents, config.OCIDir)
-	if err != nil {
-		return ispec.Descriptor{}, err
-	}
-	defer blob.Close()
-
-	desc, err := ociPutBlob(blob, config, layerType)
+	desc, err := ociPutBlob(config, layerType, contents)
 	if err != nil {
 		return ispec.Descriptor{}, err
 	}
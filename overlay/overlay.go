@@ -13,7 +13,10 @@ import (
 	"path"
 	"syscall"
 
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
 	"github.com/anuvu/stacker/types"
+	"github.com/lxc/lxd/shared"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
@@ -25,6 +28,17 @@ var _ types.Storage = &overlay{}
 // successfully (some kernels (ubuntu) support unprivileged overlay mounts, and
 // some do not).
 func canMountOverlay() error {
+	return tryMountOverlay("")
+}
+
+// SupportsUserxattr detects whether overlayfs can be mounted with the
+// userxattr option (kernel >= 5.11), so that it uses the user.overlay. xattrs
+// that an unprivileged build writes for opaque directories and whiteouts.
+func SupportsUserxattr() bool {
+	return tryMountOverlay(",userxattr") == nil
+}
+
+func tryMountOverlay(extraOpts string) error {
 	dir, err := ioutil.TempDir("", "stacker-overlay-mount-")
 	if err != nil {
 		return errors.Wrapf(err, "couldn't create overlay tmpdir")
@@ -50,7 +64,8 @@ func canMountOverlay() error {
 		return errors.Wrapf(err, "couldn't create overlay mountpoint dir")
 	}
 
-	opts := fmt.Sprintf("lowerdir=%s:%s", lower1, lower2)
+	opts := fmt.Sprintf("lowerdir=%s:%s%s", lower1, lower2, extraOpts)
+	log.SubsystemDebugf(log.Storage, "mount -t overlay -o %s overlay %s", opts, mountpoint)
 	err = unix.Mount("overlay", mountpoint, "overlay", 0, opts)
 	defer unix.Unmount(mountpoint, 0)
 	if err != nil {
@@ -194,7 +209,7 @@ func (o *overlay) Finalize(thing string) error {
 
 func (o *overlay) TemporaryWritableSnapshot(source string) (string, func(), error) {
 	// should use create maybe?
-	dir, err := ioutil.TempDir(o.config.RootFSDir, fmt.Sprintf("temp-snapshot-%s-", source))
+	dir, err := ioutil.TempDir(o.config.RootFSDir, fmt.Sprintf("%s%s-", types.TemporarySnapshotPrefix, source))
 	if err != nil {
 		return "", nil, errors.Wrapf(err, "failed to create snapshot")
 	}
@@ -210,9 +225,45 @@ func (o *overlay) TemporaryWritableSnapshot(source string) (string, func(), erro
 		return "", nil, err
 	}
 
+	err = o.mountRootfs(path.Base(dir))
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
 	return path.Base(dir), cleanup, nil
 }
 
+// mountRootfs mounts the filesystem of tag read only at its rootfs dir, so
+// that stacker can read it from the host, e.g. to package it as an output.
+// Containers don't use this mount, lxc mounts the filesystem itself.
+func (o *overlay) mountRootfs(tag string) error {
+	ovl, err := readOverlayMetadata(o.config, tag)
+	if err != nil {
+		return err
+	}
+
+	lowerdirs, err := ovl.lowerdirs(o.config, tag)
+	if err != nil {
+		return err
+	}
+
+	// overlayfs wants the top most lowerdir first, and tag's own
+	// contents are on top of everything
+	opts := "lowerdir=" + path.Join(o.config.RootFSDir, tag, "overlay")
+	for i := len(lowerdirs) - 1; i >= 0; i-- {
+		opts += ":" + lowerdirs[i]
+	}
+	if shared.RunningInUserNS() && SupportsUserxattr() {
+		opts += ",userxattr"
+	}
+
+	rootfs := path.Join(o.config.RootFSDir, tag, "rootfs")
+	log.SubsystemDebugf(log.Storage, "mount -t overlay -o %s overlay %s", opts, rootfs)
+	err = unix.Mount("overlay", rootfs, "overlay", unix.MS_RDONLY, opts)
+	return errors.Wrapf(err, "couldn't mount %s", tag)
+}
+
 func (o *overlay) Clean() error {
 	err := o.Detach()
 	if err != nil {
@@ -226,6 +277,35 @@ func (o *overlay) GC() error {
 	return errors.Errorf("todo")
 }
 
+func (o *overlay) ExportCache(dir string) error {
+	return errors.Errorf("cache export is only supported with btrfs storage")
+}
+
+func (o *overlay) ImportCache(dir string) error {
+	return errors.Errorf("cache import is only supported with btrfs storage")
+}
+
+func (o *overlay) Dedup() (int, int64, error) {
+	dirs := []string{o.config.RootFSDir}
+	if o.config.OverlayLayerPool != "" {
+		dirs = append(dirs, o.config.OverlayLayerPool)
+	}
+
+	files := 0
+	bytes := int64(0)
+	for _, dir := range dirs {
+		stats, err := lib.DedupeFiles(dir)
+		if err != nil {
+			return files, bytes, err
+		}
+
+		files += stats.Files
+		bytes += stats.Bytes
+	}
+
+	return files, bytes, nil
+}
+
 func (o *overlay) GetLXCRootfsConfig(name string) (string, error) {
 	ovl, err := readOverlayMetadata(o.config, name)
 	if err != nil {
@@ -12,12 +12,12 @@ import (
 	"time"
 
 	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/limits"
 	"github.com/anuvu/stacker/log"
 	stackeroci "github.com/anuvu/stacker/oci"
 	"github.com/anuvu/stacker/squashfs"
 	"github.com/anuvu/stacker/storage"
 	"github.com/anuvu/stacker/types"
-	"github.com/klauspost/pgzip"
 	"github.com/opencontainers/go-digest"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/opencontainers/umoci"
@@ -39,9 +39,80 @@ func overlayPath(config types.StackerConfig, d digest.Digest, subdirs ...string)
 	return path.Join(dirs...)
 }
 
+// layerPoolPath is where the base image layer d is extracted. By default this
+// is just overlayPath(), but overlay_layer_pool can point several roots dirs
+// at the same place, so that each base layer is only extracted once.
+func layerPoolPath(config types.StackerConfig, d digest.Digest) string {
+	if config.OverlayLayerPool == "" {
+		return overlayPath(config, d)
+	}
+
+	return path.Join(config.OverlayLayerPool, safeOverlayName(d))
+}
+
+// extractLayer makes the base image layer d available at overlayPath(),
+// extracting it into the layer pool if it isn't already there.
+func extractLayer(config types.StackerConfig, cacheDir string, desc ispec.Descriptor) error {
+	d := desc.Digest
+	target := overlayPath(config, d)
+
+	// don't extract things that have already been extracted
+	if _, err := os.Stat(path.Join(target, "overlay")); err == nil {
+		return nil
+	}
+
+	pooled := layerPoolPath(config, d)
+	if _, err := os.Stat(path.Join(pooled, "overlay")); err != nil {
+		if err := os.MkdirAll(path.Dir(pooled), 0755); err != nil {
+			return errors.Wrapf(err, "couldn't create layer pool")
+		}
+
+		// extract somewhere temporary and then move it into place, so
+		// that an interrupted extraction isn't mistaken for a
+		// complete one later.
+		tmp, err := ioutil.TempDir(path.Dir(pooled), fmt.Sprintf("%s.tmp-", safeOverlayName(d)))
+		if err != nil {
+			return errors.Wrapf(err, "couldn't create extraction dir")
+		}
+		defer os.RemoveAll(tmp)
+
+		release, err := limits.Acquire(config, limits.Extract)
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		err = unpackOne(cacheDir, path.Join(tmp, "overlay"), desc)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(tmp, pooled)
+		// someone else sharing the pool may have won the race to
+		// extract this, which is fine.
+		if err != nil && !os.IsExist(err) {
+			return errors.Wrapf(err, "couldn't move %s into place", d)
+		}
+	} else {
+		log.Debugf("using %s from the layer pool", d)
+	}
+
+	if pooled == target {
+		return nil
+	}
+
+	// if the layer was removed from the pool, there may be a dangling
+	// symlink left over.
+	if err := os.RemoveAll(target); err != nil {
+		return errors.Wrapf(err, "couldn't remove stale %s", target)
+	}
+
+	return errors.Wrapf(os.Symlink(pooled, target), "couldn't link %s from the layer pool", d)
+}
+
 func (o *overlay) Unpack(tag, name string) error {
 	cacheDir := path.Join(o.config.StackerDir, "layer-bases", "oci")
-	oci, err := umoci.OpenLayout(cacheDir)
+	oci, err := stackeroci.OpenLayout(cacheDir)
 	if err != nil {
 		return err
 	}
@@ -52,11 +123,16 @@ func (o *overlay) Unpack(tag, name string) error {
 		return err
 	}
 
-	pool := NewThreadPool(runtime.NumCPU())
+	// each layer is extracted into its own directory, so they can all be
+	// done at once; the lowerdirs are only composed when mounting.
+	jobs := o.config.UnpackJobs
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+	pool := NewThreadPool(jobs)
 
 	for _, layer := range manifest.Layers {
-		digest := layer.Digest
-		contents := overlayPath(o.config, digest, "overlay")
+		desc := layer
 		switch layer.MediaType {
 		case stackeroci.ImpoliteMediaTypeLayerSquashfs:
 			fallthrough
@@ -64,22 +140,18 @@ func (o *overlay) Unpack(tag, name string) error {
 			// don't really need to do this in parallel, but what
 			// the hell.
 			pool.Add(func(ctx context.Context) error {
-				return unpackOne(cacheDir, contents, digest, true)
+				return extractLayer(o.config, cacheDir, desc)
 			})
 		case ispec.MediaTypeImageLayer:
 			fallthrough
+		case stackeroci.MediaTypeLayerZstd:
+			fallthrough
 		case ispec.MediaTypeImageLayerGzip:
-			// don't extract things that have already been
-			// extracted
-			if _, err := os.Stat(contents); err == nil {
-				continue
-			}
-
 			// TODO: when the umoci API grows support for uid
 			// shifting, we can use the fancier features of context
 			// cancelling in the thread pool...
 			pool.Add(func(ctx context.Context) error {
-				return unpackOne(cacheDir, contents, digest, false)
+				return extractLayer(o.config, cacheDir, desc)
 			})
 		default:
 			return errors.Errorf("unknown media type %s", layer.MediaType)
@@ -106,26 +178,28 @@ func (o *overlay) Unpack(tag, name string) error {
 	return ovl.write(o.config, name)
 }
 
-func ConvertAndOutput(config types.StackerConfig, tag, name string, layerType types.LayerType) error {
-	cacheDir := path.Join(config.StackerDir, "layer-bases", "oci")
-	cacheOCI, err := umoci.OpenLayout(cacheDir)
+// ConvertAndOutput converts the image tag in the OCI layout sourceDir to
+// layerType, storing it in the output as name. All of tag's layers must
+// already be extracted.
+func ConvertAndOutput(config types.StackerConfig, sourceDir, tag, name string, layerType types.LayerType) error {
+	sourceOCI, err := stackeroci.OpenLayout(sourceDir)
 	if err != nil {
 		return err
 	}
-	defer cacheOCI.Close()
+	defer sourceOCI.Close()
 
-	oci, err := umoci.OpenLayout(config.OCIDir)
+	oci, err := stackeroci.OpenLayout(config.OCIDir)
 	if err != nil {
 		return err
 	}
 	defer oci.Close()
 
-	manifest, err := stackeroci.LookupManifest(cacheOCI, tag)
+	manifest, err := stackeroci.LookupManifest(sourceOCI, tag)
 	if err != nil {
 		return err
 	}
 
-	imageConfig, err := stackeroci.LookupConfig(cacheOCI, manifest.Config)
+	imageConfig, err := stackeroci.LookupConfig(sourceOCI, manifest.Config)
 	if err != nil {
 		return err
 	}
@@ -139,14 +213,8 @@ func ConvertAndOutput(config types.StackerConfig, tag, name string, layerType ty
 	for _, theLayer := range manifest.Layers {
 		bundlePath := overlayPath(config, theLayer.Digest)
 		overlayDir := path.Join(bundlePath, "overlay")
-		// generate blob
-		blob, err := generateBlob(layerType, overlayDir, config.OCIDir)
-		if err != nil {
-			return err
-		}
-		defer blob.Close()
-		// add it to the oci repository
-		desc, err := ociPutBlob(blob, config, layerType)
+		// generate blob and add it to the oci repository
+		desc, err := ociPutBlob(config, layerType, overlayDir)
 		if err != nil {
 			return err
 		}
@@ -154,8 +222,8 @@ func ConvertAndOutput(config types.StackerConfig, tag, name string, layerType ty
 		// slight hack, but this is much faster than a cp, and the
 		// layers are the same, just in different formats
 		err = os.Symlink(overlayPath(config, theLayer.Digest), overlayPath(config, desc.Digest))
-		if err != nil {
-			return errors.Wrapf(err, "failed to create squashfs symlink")
+		if err != nil && !os.IsExist(err) {
+			return errors.Wrapf(err, "failed to create %s symlink", layerType)
 		}
 		newManifest.Layers = append(newManifest.Layers, desc)
 		newConfig.RootFS.DiffIDs = append(newConfig.RootFS.DiffIDs, desc.Digest)
@@ -169,8 +237,17 @@ func ConvertAndOutput(config types.StackerConfig, tag, name string, layerType ty
 	return nil
 }
 
+func (o *overlay) ConvertOutput(name string, layerType types.LayerType) error {
+	sourceType, err := storage.FindOutputLayerType(o.config.OCIDir, name, layerType)
+	if err != nil {
+		return err
+	}
+
+	return ConvertAndOutput(o.config, o.config.OCIDir, sourceType.LayerName(name), name, layerType)
+}
+
 func lookupManifestInDir(dir, name string) (ispec.Manifest, error) {
-	oci, err := umoci.OpenLayout(dir)
+	oci, err := stackeroci.OpenLayout(dir)
 	if err != nil {
 		return ispec.Manifest{}, err
 	}
@@ -229,7 +306,7 @@ func (o *overlay) initializeBasesInOutput(name string, layerTypes []types.LayerT
 						return err
 					}
 				} else {
-					err = ConvertAndOutput(o.config, cacheTag, name, layerType)
+					err = ConvertAndOutput(o.config, cacheDir, cacheTag, name, layerType)
 					if err != nil {
 						return err
 					}
@@ -241,7 +318,7 @@ func (o *overlay) initializeBasesInOutput(name string, layerTypes []types.LayerT
 	}
 
 	if !initialized {
-		oci, err := umoci.OpenLayout(o.config.OCIDir)
+		oci, err := stackeroci.OpenLayout(o.config.OCIDir)
 		if err != nil {
 			return err
 		}
@@ -264,45 +341,64 @@ func (o *overlay) Repack(name string, layerTypes []types.LayerType, sfm types.St
 		return err
 	}
 
-	return repackOverlay(o.config, name, layerTypes)
+	return repackOverlay(o.config, name, layerTypes, sfm)
 }
 
-// generateBlob generates either a tar blob or a squashfs blob based on layerType
-func generateBlob(layerType types.LayerType, contents string, ociDir string) (io.ReadCloser, error) {
-	var blob io.ReadCloser
-	var err error
-	if layerType == "tar" {
-		packOptions := layer.RepackOptions{TranslateOverlayWhiteouts: true}
-		blob = layer.GenerateInsertLayer(contents, "/", false, &packOptions)
-	} else {
-		blob, err = squashfs.MakeSquashfs(ociDir, contents, nil)
-		if err != nil {
-			return nil, err
-		}
+// generateBlob generates a tar blob of contents
+func generateBlob(config types.StackerConfig, contents string) (io.ReadCloser, error) {
+	mapOptions, err := storage.RepackMapOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	packOptions := layer.RepackOptions{MapOptions: mapOptions, TranslateOverlayWhiteouts: true}
+	return layer.GenerateInsertLayer(contents, "/", false, &packOptions), nil
+}
+
+// generateSquashfs generates a squashfs image of contents in the oci
+// directory, so that stackeroci.PutBlobFile() can rename it into place.
+func generateSquashfs(config types.StackerConfig, contents string) (string, error) {
+	release, err := limits.Acquire(config, limits.Squashfs)
+	if err != nil {
+		return "", err
 	}
-	return blob, nil
+	defer release()
+
+	return squashfs.MakeSquashfsFile(config.OCIDir, contents, nil)
 }
 
-// ociPutBlob takes a tar/squashfs blob and adds it into the oci repository
-func ociPutBlob(blob io.ReadCloser, config types.StackerConfig, layerType types.LayerType) (ispec.Descriptor, error) {
-	oci, err := umoci.OpenLayout(config.OCIDir)
+// ociPutBlob generates a tar/squashfs blob of contents and adds it into the
+// oci repository
+func ociPutBlob(config types.StackerConfig, layerType types.LayerType, contents string) (ispec.Descriptor, error) {
+	oci, err := stackeroci.OpenLayout(config.OCIDir)
 	if err != nil {
 		return ispec.Descriptor{}, err
 	}
 	defer oci.Close()
 
-	layerDigest, layerSize, err := oci.PutBlob(context.Background(), blob)
+	if layerType != "tar" {
+		image, err := generateSquashfs(config, contents)
+		if err != nil {
+			return ispec.Descriptor{}, err
+		}
+
+		return squashfs.PutLayer(oci, config.OCIDir, image, config.SquashfsVerity)
+	}
+
+	blob, err := generateBlob(config, contents)
 	if err != nil {
 		return ispec.Descriptor{}, err
 	}
+	defer blob.Close()
 
-	layerMediaType := stackeroci.MediaTypeLayerSquashfs
-	if layerType == "tar" {
-		layerMediaType = ispec.MediaTypeImageLayerGzip
+	layerDigest, layerSize, err := oci.PutBlob(context.Background(), blob)
+	if err != nil {
+		return ispec.Descriptor{}, err
 	}
 
+	// generateBlob()'s tars aren't compressed
 	desc := ispec.Descriptor{
-		MediaType: layerMediaType,
+		MediaType: ispec.MediaTypeImageLayer,
 		Digest:    layerDigest,
 		Size:      layerSize,
 	}
@@ -310,7 +406,62 @@ func ociPutBlob(blob io.ReadCloser, config types.StackerConfig, layerType types.
 	return desc, nil
 }
 
-func generateLayer(config types.StackerConfig, mutators []*mutate.Mutator, name string, layerTypes []types.LayerType) (bool, error) {
+// addSquashfsLayer adds contents as a squashfs layer of mutator's image.
+// mutator.Add() would copy the image into the layout, so instead this commits
+// the mutator, adds the layer to the result itself, and returns a mutator for
+// the new image.
+func addSquashfsLayer(config types.StackerConfig, mutator *mutate.Mutator, contents string, history *ispec.History) (ispec.Descriptor, *mutate.Mutator, error) {
+	oci, err := stackeroci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return ispec.Descriptor{}, nil, err
+	}
+	defer oci.Close()
+
+	image, err := generateSquashfs(config, contents)
+	if err != nil {
+		return ispec.Descriptor{}, nil, err
+	}
+
+	desc, err := squashfs.PutLayer(oci, config.OCIDir, image, config.SquashfsVerity)
+	if err != nil {
+		return ispec.Descriptor{}, nil, err
+	}
+
+	descPath, err := mutator.Commit(context.Background())
+	if err != nil {
+		return ispec.Descriptor{}, nil, err
+	}
+
+	manifest, err := mutator.Manifest(context.Background())
+	if err != nil {
+		return ispec.Descriptor{}, nil, err
+	}
+
+	imageConfig, err := stackeroci.LookupConfig(oci, manifest.Config)
+	if err != nil {
+		return ispec.Descriptor{}, nil, err
+	}
+
+	// squashfs layers aren't compressed, so the diff id is the digest
+	manifest.Layers = append(manifest.Layers, desc)
+	imageConfig.RootFS.DiffIDs = append(imageConfig.RootFS.DiffIDs, desc.Digest)
+	imageConfig.History = append(imageConfig.History, *history)
+
+	manifestDesc, err := stackeroci.PutImageConfig(oci, imageConfig, manifest)
+	if err != nil {
+		return ispec.Descriptor{}, nil, err
+	}
+
+	descPath.Walk[len(descPath.Walk)-1] = manifestDesc
+	newMutator, err := mutate.New(oci, descPath)
+	if err != nil {
+		return ispec.Descriptor{}, nil, err
+	}
+
+	return desc, newMutator, nil
+}
+
+func generateLayer(config types.StackerConfig, mutators []*mutate.Mutator, name string, layerTypes []types.LayerType, sfm types.StackerFiles) (bool, error) {
 	dir := path.Join(config.RootFSDir, name, "overlay")
 	ents, err := ioutil.ReadDir(dir)
 	if err != nil {
@@ -321,31 +472,42 @@ func generateLayer(config types.StackerConfig, mutators []*mutate.Mutator, name
 		return false, nil
 	}
 
+	author, err := storage.LayerAuthor(config, name, sfm)
+	if err != nil {
+		return false, err
+	}
+
 	now := time.Now()
 	history := &ispec.History{
+		Author:     author,
 		Created:    &now,
 		CreatedBy:  fmt.Sprintf("stacker build of %s", name),
 		EmptyLayer: false,
 	}
 
+	compressor, err := storage.TarCompressor(config)
+	if err != nil {
+		return false, err
+	}
+
 	descs := []ispec.Descriptor{}
 	for i, layerType := range layerTypes {
 		mutator := mutators[i]
 		var desc ispec.Descriptor
 
-		blob, err := generateBlob(layerType, dir, config.OCIDir)
-		if err != nil {
-			return false, err
-		}
-		defer blob.Close()
-
 		if layerType == "tar" {
-			desc, err = mutator.Add(context.Background(), ispec.MediaTypeImageLayer, blob, history, mutate.GzipCompressor)
+			blob, err := generateBlob(config, dir)
+			if err != nil {
+				return false, err
+			}
+			defer blob.Close()
+
+			desc, err = mutator.Add(context.Background(), ispec.MediaTypeImageLayer, blob, history, compressor)
 			if err != nil {
 				return false, err
 			}
 		} else {
-			desc, err = mutator.Add(context.Background(), stackeroci.MediaTypeLayerSquashfs, blob, history, mutate.NoopCompressor)
+			desc, mutators[i], err = addSquashfsLayer(config, mutator, dir, history)
 			if err != nil {
 				return false, err
 			}
@@ -439,8 +601,8 @@ func generateLayer(config types.StackerConfig, mutators []*mutate.Mutator, name
 	return true, nil
 }
 
-func repackOverlay(config types.StackerConfig, name string, layerTypes []types.LayerType) error {
-	oci, err := umoci.OpenLayout(config.OCIDir)
+func repackOverlay(config types.StackerConfig, name string, layerTypes []types.LayerType, sfm types.StackerFiles) error {
+	oci, err := stackeroci.OpenLayout(config.OCIDir)
 	if err != nil {
 		return err
 	}
@@ -480,7 +642,7 @@ func repackOverlay(config types.StackerConfig, name string, layerTypes []types.L
 	// generate blobs for each build layer
 	for _, buildLayer := range ovl.BuiltLayers {
 
-		didMutate, err := generateLayer(config, mutators, buildLayer, layerTypes)
+		didMutate, err := generateLayer(config, mutators, buildLayer, layerTypes, sfm)
 		if err != nil {
 			return err
 		}
@@ -509,7 +671,7 @@ func repackOverlay(config types.StackerConfig, name string, layerTypes []types.L
 		return err
 	}
 
-	didMutate, err := generateLayer(config, mutators, name, layerTypes)
+	didMutate, err := generateLayer(config, mutators, name, layerTypes, sfm)
 	if err != nil {
 		return err
 	}
@@ -543,29 +705,25 @@ func repackOverlay(config types.StackerConfig, name string, layerTypes []types.L
 	return ovl.write(config, name)
 }
 
-func unpackOne(ociDir string, bundlePath string, digest digest.Digest, isSquashfs bool) error {
-	if isSquashfs {
+func unpackOne(ociDir string, bundlePath string, desc ispec.Descriptor) error {
+	switch desc.MediaType {
+	case stackeroci.MediaTypeLayerSquashfs, stackeroci.ImpoliteMediaTypeLayerSquashfs:
 		return squashfs.ExtractSingleSquash(
-			path.Join(ociDir, "blobs", "sha256", digest.Encoded()),
+			path.Join(ociDir, "blobs", "sha256", desc.Digest.Encoded()),
 			path.Join(bundlePath, "rootfs"), "overlay")
 	}
 
-	oci, err := umoci.OpenLayout(ociDir)
+	oci, err := stackeroci.OpenLayout(ociDir)
 	if err != nil {
 		return err
 	}
 	defer oci.Close()
 
-	compressed, err := oci.GetBlob(context.Background(), digest)
-	if err != nil {
-		return err
-	}
-	defer compressed.Close()
-
-	uncompressed, err := pgzip.NewReader(compressed)
+	uncompressed, err := stackeroci.OpenTarLayer(oci, desc)
 	if err != nil {
 		return err
 	}
+	defer uncompressed.Close()
 
 	return layer.UnpackLayer(bundlePath, uncompressed, nil)
 }
@@ -15,11 +15,12 @@ type ThreadPool struct {
 	n      int
 	tasks  chan func(context.Context) error
 	err    error
+	errMu  sync.Mutex
 }
 
 func NewThreadPool(n int) *ThreadPool {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &ThreadPool{ctx, cancel, n, make(chan func(context.Context) error, 1000), nil}
+	return &ThreadPool{ctx: ctx, cancel: cancel, n: n, tasks: make(chan func(context.Context) error, 1000)}
 }
 
 func (tp *ThreadPool) Add(f func(context.Context) error) {
@@ -47,7 +48,13 @@ func (tp *ThreadPool) Run() error {
 
 					err := f(tp.ctx)
 					if err != nil && err != ThreadPoolCancelled {
-						tp.err = err
+						// several workers may fail at once;
+						// report the first one.
+						tp.errMu.Lock()
+						if tp.err == nil {
+							tp.err = err
+						}
+						tp.errMu.Unlock()
 						tp.cancel()
 						return
 					}
@@ -0,0 +1,81 @@
+package overlay
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/lxc/lxd/shared"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// GetLXCWritableMount mounts an overlay of its own at dir, whose lowerdirs are
+// dir in each of the rootfs's lowerdirs, and whose upperdir is dir in the
+// rootfs's upperdir: the rootfs's overlay is read only, and a bind mount of
+// part of it would be too.
+func (o *overlay) GetLXCWritableMount(name string, dir string) (string, error) {
+	ovl, err := readOverlayMetadata(o.config, name)
+	if err != nil {
+		return "", err
+	}
+
+	lowerdirs, err := ovl.lowerdirs(o.config, name)
+	if err != nil {
+		return "", err
+	}
+
+	// dir is looked up in each of the layers rather than in the merged
+	// filesystem, so a symlink in it could mean something different in
+	// each one (or a path on the host, if they were followed there)
+	dir = path.Clean("/" + dir)
+	for _, layer := range append(lowerdirs, path.Join(o.config.RootFSDir, name, "overlay")) {
+		resolved, err := securejoin.SecureJoin(layer, dir)
+		if err != nil {
+			return "", errors.Wrapf(err, "bad writable path %s", dir)
+		}
+
+		if resolved != path.Join(layer, dir) {
+			return "", errors.Errorf("writable path %s goes through a symlink in %s's filesystem", dir, name)
+		}
+	}
+
+	upper := path.Join(o.config.RootFSDir, name, "overlay", dir)
+	if err := os.MkdirAll(upper, 0755); err != nil {
+		return "", errors.Wrapf(err, "couldn't create writable path %s", dir)
+	}
+
+	// the workdir has to be on the same filesystem as the upperdir, but
+	// not in it
+	work := path.Join(o.config.RootFSDir, name, "writable-work", digest.FromString(dir).Encoded()[:16])
+	if err := os.MkdirAll(work, 0755); err != nil {
+		return "", errors.Wrapf(err, "couldn't create workdir for %s", dir)
+	}
+
+	// top most first, like the rootfs's
+	lowers := []string{}
+	for i := len(lowerdirs) - 1; i >= 0; i-- {
+		lower := path.Join(lowerdirs[i], dir)
+		if _, err := os.Stat(lower); err == nil {
+			lowers = append(lowers, lower)
+		}
+	}
+
+	// overlayfs needs a lowerdir even when none of the layers have dir
+	if len(lowers) == 0 {
+		empty := path.Join(o.config.RootFSDir, name, "writable-empty")
+		if err := os.MkdirAll(empty, 0755); err != nil {
+			return "", errors.Wrapf(err, "couldn't make empty lowerdir")
+		}
+		lowers = append(lowers, empty)
+	}
+
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowers, ":"), upper, work)
+	if shared.RunningInUserNS() && SupportsUserxattr() {
+		opts += ",userxattr"
+	}
+
+	return fmt.Sprintf("overlay %s overlay %s 0 0", strings.TrimPrefix(dir, "/"), opts), nil
+}
@@ -0,0 +1,206 @@
+package stacker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/types"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// policyQuery is the rule of the policy bundle that is evaluated: the
+// messages it has for an input are the ways the input violates the policy.
+const policyQuery = "data.stacker.deny"
+
+// opaResult is the part of the output of opa eval --format json we care
+// about.
+type opaResult struct {
+	Result []struct {
+		Expressions []struct {
+			Value interface{} `json:"value"`
+		} `json:"expressions"`
+	} `json:"result"`
+}
+
+// evalPolicy evaluates the policy bundle against input with opa, returning
+// the policy's violations.
+func evalPolicy(bundle string, input interface{}) ([]string, error) {
+	content, err := json.Marshal(input)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't marshal policy input")
+	}
+
+	stdout := bytes.Buffer{}
+	stderr := bytes.Buffer{}
+	cmd := exec.Command("opa", "eval", "--format", "json", "--bundle", bundle, "--stdin-input", policyQuery)
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrapf(err, "couldn't evaluate policy %s: %s%s", bundle, stdout.String(), stderr.String())
+	}
+
+	return policyViolations(stdout.Bytes())
+}
+
+// policyViolations returns the messages policyQuery has in opa's output. The
+// query is usually a set of strings, but its members may be anything.
+func policyViolations(output []byte) ([]string, error) {
+	result := opaResult{}
+	if err := json.Unmarshal(output, &result); err != nil {
+		return nil, errors.Wrapf(err, "bad opa output %s", string(output))
+	}
+
+	violations := []string{}
+	for _, r := range result.Result {
+		for _, e := range r.Expressions {
+			values, ok := e.Value.([]interface{})
+			if !ok {
+				values = []interface{}{e.Value}
+			}
+
+			for _, v := range values {
+				switch v := v.(type) {
+				case string:
+					violations = append(violations, v)
+				case bool:
+					// deny is a rule rather than a set
+					if v {
+						violations = append(violations, "denied")
+					}
+				default:
+					content, err := json.Marshal(v)
+					if err != nil {
+						return nil, errors.WithStack(err)
+					}
+					violations = append(violations, string(content))
+				}
+			}
+		}
+	}
+
+	sort.Strings(violations)
+	return violations, nil
+}
+
+func policyError(what string, violations []string) error {
+	return types.KindErrorf(types.PolicyError, "%s violates the policy:\n%s", what, strings.Join(violations, "\n"))
+}
+
+// checkStackerfilePolicy evaluates the policy against the stacker file at
+// path, whose input is:
+//
+//	{"kind": "stackerfile", "path": path, "stackerfile": its content}
+//
+// where the content is what is in the file after substitutions.
+func checkStackerfilePolicy(config types.StackerConfig, path string, sf *types.Stackerfile) error {
+	if config.PolicyBundle == "" {
+		return nil
+	}
+
+	content := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(sf.AfterSubstitutions), &content); err != nil {
+		return errors.Wrapf(err, "couldn't parse %s", path)
+	}
+
+	input := map[string]interface{}{
+		"kind":        "stackerfile",
+		"path":        path,
+		"stackerfile": jsonValue(content),
+	}
+
+	violations, err := evalPolicy(config.PolicyBundle, input)
+	if err != nil {
+		return err
+	}
+
+	if len(violations) > 0 {
+		return policyError(path, violations)
+	}
+
+	return nil
+}
+
+// checkImagePolicy evaluates the policy against each of the images output
+// for the layer name, whose input is:
+//
+//	{"kind": "image", "name": the tag, "layer_type": "tar" or "squashfs",
+//	 "manifest": the OCI manifest, "config": the OCI image config, or null
+//	 for artifacts}
+func checkImagePolicy(config types.StackerConfig, oci casext.Engine, name string, layerTypes []types.LayerType) error {
+	if config.PolicyBundle == "" {
+		return nil
+	}
+
+	for _, layerType := range layerTypes {
+		tag := layerType.LayerName(name)
+		manifest, err := stackeroci.LookupManifest(oci, tag)
+		if err != nil {
+			return err
+		}
+
+		// artifacts' configs aren't image configs; their manifest's
+		// config media type says what they are
+		var image interface{}
+		if manifest.Config.MediaType == ispec.MediaTypeImageConfig {
+			image, err = stackeroci.LookupConfig(oci, manifest.Config)
+			if err != nil {
+				return err
+			}
+		}
+
+		input := map[string]interface{}{
+			"kind":       "image",
+			"name":       tag,
+			"layer_type": string(layerType),
+			"manifest":   manifest,
+			"config":     image,
+		}
+
+		violations, err := evalPolicy(config.PolicyBundle, input)
+		if err != nil {
+			return err
+		}
+
+		if len(violations) > 0 {
+			return policyError(tag, violations)
+		}
+	}
+
+	return nil
+}
+
+// jsonValue converts v, as unmarshalled by yaml, into something that can be
+// marshalled to json, i.e. with string map keys.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, value := range v {
+			m[fmt.Sprintf("%v", key)] = jsonValue(value)
+		}
+		return m
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for key, value := range v {
+			m[key] = jsonValue(value)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, value := range v {
+			l[i] = jsonValue(value)
+		}
+		return l
+	default:
+		return v
+	}
+}
@@ -0,0 +1,41 @@
+package stacker
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestPolicyViolations(t *testing.T) {
+	assert := assert.New(t)
+
+	violations, err := policyViolations([]byte(`{"result": [{"expressions": [{"value": ["b is bad", "a is bad", {"layer": "c"}], "text": "data.stacker.deny"}]}]}`))
+	assert.NoError(err)
+	assert.Equal([]string{"a is bad", "b is bad", `{"layer":"c"}`}, violations)
+
+	violations, err = policyViolations([]byte(`{"result": [{"expressions": [{"value": []}]}]}`))
+	assert.NoError(err)
+	assert.Empty(violations)
+
+	// deny isn't defined for the input
+	violations, err = policyViolations([]byte(`{}`))
+	assert.NoError(err)
+	assert.Empty(violations)
+
+	_, err = policyViolations([]byte(`not json`))
+	assert.Error(err)
+}
+
+func TestJSONValue(t *testing.T) {
+	assert := assert.New(t)
+
+	content := map[string]interface{}{}
+	err := yaml.Unmarshal([]byte("thing:\n  binds:\n  - /tmp\n  build_only: true\n"), &content)
+	assert.NoError(err)
+
+	out, err := json.Marshal(jsonValue(content))
+	assert.NoError(err)
+	assert.Equal(`{"thing":{"binds":["/tmp"],"build_only":true}}`, string(out))
+}
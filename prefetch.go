@@ -0,0 +1,159 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/limits"
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/pkg/errors"
+)
+
+// prefetchList returns the bases worth pulling before the build starts, in
+// the order the layers that need them will be built: docker images, and tar
+// files from http(s) urls. Local things are quick enough to get when they're
+// needed, and stacker:// urls don't exist until their layer is built.
+func prefetchList(dag *StackerFilesDAG, sfm types.StackerFiles) []*types.ImageSource {
+	bases := []*types.ImageSource{}
+	seen := map[string]bool{}
+	for _, p := range dag.Sort() {
+		sf := dag.GetStackerFile(p)
+		order, err := sf.DependencyOrder(sfm)
+		if err != nil {
+			// the build will report this properly
+			order = sf.FileOrder
+		}
+
+		for _, name := range order {
+			l, ok := sf.Get(name)
+			if !ok || l.From == nil {
+				continue
+			}
+
+			switch l.From.Type {
+			case types.DockerLayer:
+			case types.TarLayer:
+				url, err := types.NewDockerishUrl(l.From.Url)
+				if err != nil || (url.Scheme != "http" && url.Scheme != "https") {
+					continue
+				}
+			default:
+				continue
+			}
+
+			// tar bases are saved by their base name, so there's no
+			// point in getting two with the same one
+			key := l.From.Url
+			if l.From.Type == types.TarLayer {
+				key = path.Base(l.From.Url)
+			}
+
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			bases = append(bases, l.From)
+		}
+	}
+
+	return bases
+}
+
+// prefetchBases pulls bases jobs at a time, so that GetBase() finds them
+// already downloaded when their layers are built. Failures are only logged,
+// since GetBase() will report them when it tries again.
+func prefetchBases(config types.StackerConfig, bases []*types.ImageSource, jobs int) {
+	if len(bases) == 0 {
+		return
+	}
+
+	log.Infof("prefetching %d base images, %d at a time", len(bases), jobs)
+
+	if err := os.MkdirAll(path.Join(config.StackerDir, "layer-bases"), 0755); err != nil {
+		log.Infof("couldn't prefetch base images: %v", err)
+		return
+	}
+
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, jobs)
+	for _, base := range bases {
+		base := base
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var err error
+			switch base.Type {
+			case types.DockerLayer:
+				err = prefetchContainersImage(config, base)
+			case types.TarLayer:
+				cacheDir := path.Join(config.StackerDir, "layer-bases")
+				_, err = acquireUrl(config, nil, base.Url, cacheDir, false, "", nil)
+			}
+			if err != nil {
+				log.Infof("couldn't prefetch %s: %v", base.Url, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// prefetchContainersImage copies is into a staging layout whose blobs dir is
+// the layer-bases layout's. importContainersImage() can't be run in parallel,
+// since each copy would overwrite the others' index.json, but it can reuse the
+// blobs this leaves behind instead of downloading them again.
+func prefetchContainersImage(config types.StackerConfig, is *types.ImageSource) error {
+	toImport, err := is.ContainersImageURL()
+	if err != nil {
+		return err
+	}
+
+	tag, err := is.ParseTag()
+	if err != nil {
+		return err
+	}
+
+	cacheDir, err := layerBasesLayout(config)
+	if err != nil {
+		return err
+	}
+
+	layerBases := path.Dir(cacheDir)
+	blobs := path.Join(cacheDir, "blobs")
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	staging, err := ioutil.TempDir(layerBases, "prefetch-")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(staging)
+
+	if err := os.Symlink(blobs, path.Join(staging, "blobs")); err != nil {
+		return errors.WithStack(err)
+	}
+
+	release, err := limits.Acquire(config, limits.Network)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	log.Debugf("prefetching %s", toImport)
+	return lib.ImageCopy(lib.ImageCopyOpts{
+		Src:                  toImport,
+		Dest:                 fmt.Sprintf("oci:%s:%s", staging, tag),
+		SrcSkipTLS:           is.Insecure,
+		TmpDir:               config.TmpDir,
+		MaxParallelDownloads: config.MaxParallelDownloads,
+	})
+}
@@ -0,0 +1,578 @@
+package stacker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// RemoteImage is a tag of a layer in a publish destination.
+type RemoteImage struct {
+	Tag     string
+	Digest  digest.Digest
+	Created time.Time
+}
+
+// RetentionPolicy decides which tags of each layer prune-remote keeps.
+type RetentionPolicy struct {
+	// KeepLast is how many of the most recently created tags to keep
+	KeepLast int
+	// KeepSemver keeps all tags that look like semantic versions
+	KeepSemver bool
+}
+
+var semverTag = regexp.MustCompile(`^v?(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(-[0-9A-Za-z.-]+)?$`)
+
+// Expired returns the images the policy doesn't keep. Since registries delete
+// manifests (and so all the tags pointing at them) by digest, images that
+// share a digest with a kept image are kept too.
+func (p RetentionPolicy) Expired(images []RemoteImage) []RemoteImage {
+	sorted := make([]RemoteImage, len(images))
+	copy(sorted, images)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Created.Equal(sorted[j].Created) {
+			return sorted[i].Tag > sorted[j].Tag
+		}
+		return sorted[i].Created.After(sorted[j].Created)
+	})
+
+	kept := map[digest.Digest]bool{}
+	candidates := []RemoteImage{}
+	for i, image := range sorted {
+		if i < p.KeepLast || (p.KeepSemver && semverTag.MatchString(image.Tag)) {
+			kept[image.Digest] = true
+			continue
+		}
+		candidates = append(candidates, image)
+	}
+
+	expired := []RemoteImage{}
+	for _, image := range candidates {
+		if kept[image.Digest] {
+			log.Debugf("keeping %s, a kept tag has the same digest", image.Tag)
+			continue
+		}
+		expired = append(expired, image)
+	}
+
+	return expired
+}
+
+// PruneRemoteArgs are the options for pruning a publish destination
+type PruneRemoteArgs struct {
+	Config     types.StackerConfig
+	Substitute []string
+	Url        string
+	Username   string
+	Password   string
+	Policy     RetentionPolicy
+	// UntaggedOlderThan removes unreferenced blobs older than this from
+	// OCI layout destinations; zero leaves them alone.
+	UntaggedOlderThan time.Duration
+	DryRun            bool
+}
+
+// pruneDestination is a place stacker publishes to that can be pruned.
+type pruneDestination interface {
+	images(name string) ([]RemoteImage, error)
+	delete(name string, expired []RemoteImage) error
+	pruneUntagged(olderThan time.Duration) error
+	Close()
+}
+
+type registryDestination struct {
+	opts *PruneRemoteArgs
+}
+
+func (r registryDestination) repo(name string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimRight(r.opts.Url, "/"), name)
+}
+
+func (r registryDestination) images(name string) ([]RemoteImage, error) {
+	tags, err := lib.RepositoryTags(r.repo(name), r.opts.Username, r.opts.Password, false)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []RemoteImage{}
+	for _, tag := range tags {
+		ref := fmt.Sprintf("%s:%s", r.repo(name), tag)
+		manifestDigest, created, err := lib.ImageInfo(ref, r.opts.Username, r.opts.Password, false)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, RemoteImage{Tag: tag, Digest: manifestDigest, Created: created})
+	}
+
+	return images, nil
+}
+
+func (r registryDestination) delete(name string, expired []RemoteImage) error {
+	// deleting one tag deletes all the tags with the same digest
+	deleted := map[digest.Digest]bool{}
+	for _, image := range expired {
+		if deleted[image.Digest] {
+			continue
+		}
+
+		ref := fmt.Sprintf("%s:%s", r.repo(name), image.Tag)
+		if err := lib.DeleteImage(ref, r.opts.Username, r.opts.Password, false); err != nil {
+			return err
+		}
+		deleted[image.Digest] = true
+	}
+
+	return nil
+}
+
+func (r registryDestination) pruneUntagged(olderThan time.Duration) error {
+	return errors.Errorf("registries don't list untagged manifests, use the registry's own garbage collection")
+}
+
+func (r registryDestination) Close() {}
+
+type layoutDestination struct {
+	dir string
+	oci casext.Engine
+	// layers are the names of all the layers in the stacker files, to
+	// tell which one a tag is
+	layers []string
+}
+
+// layoutRefLayer returns which of layers the layout destination tag ref
+// (name_tag, see Publish()) is of, or "" if it's none of them's. Since both
+// layer names and tags may have _ in them, the longest name wins: foo_bar_1.0
+// is foo_bar's if there's such a layer, and foo's otherwise.
+func layoutRefLayer(ref string, layers []string) string {
+	owner := ""
+	for _, name := range layers {
+		if len(name) > len(owner) && len(ref) > len(name)+1 && strings.HasPrefix(ref, name+"_") {
+			owner = name
+		}
+	}
+
+	return owner
+}
+
+func (l layoutDestination) images(name string) ([]RemoteImage, error) {
+	refs, err := l.oci.ListReferences(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	images := []RemoteImage{}
+	for _, ref := range refs {
+		if layoutRefLayer(ref, l.layers) != name {
+			continue
+		}
+
+		descPaths, err := l.oci.ResolveReference(context.Background(), ref)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(descPaths) != 1 {
+			return nil, errors.Errorf("bad descriptor %s", ref)
+		}
+
+		manifest, err := oci.LookupManifest(l.oci, ref)
+		if err != nil {
+			return nil, err
+		}
+
+		created, err := oci.LookupCreated(l.oci, manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		images = append(images, RemoteImage{
+			Tag:     strings.TrimPrefix(ref, name+"_"),
+			Digest:  descPaths[0].Descriptor().Digest,
+			Created: created,
+		})
+	}
+
+	return images, nil
+}
+
+func (l layoutDestination) delete(name string, expired []RemoteImage) error {
+	for _, image := range expired {
+		if err := l.oci.DeleteReference(context.Background(), fmt.Sprintf("%s_%s", name, image.Tag)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l layoutDestination) pruneUntagged(olderThan time.Duration) error {
+	cutoff := time.Now().Add(-olderThan)
+	return l.oci.GC(context.Background(), func(ctx context.Context, d digest.Digest) (bool, error) {
+		fi, err := os.Stat(path.Join(l.dir, "blobs", d.Algorithm().String(), d.Encoded()))
+		if err != nil {
+			return false, err
+		}
+
+		return fi.ModTime().Before(cutoff), nil
+	})
+}
+
+func (l layoutDestination) Close() {
+	l.oci.Close()
+}
+
+func openPruneDestination(opts *PruneRemoteArgs, layers []string) (pruneDestination, error) {
+	is, err := types.NewImageSource(opts.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	switch is.Type {
+	case types.DockerLayer:
+		return registryDestination{opts}, nil
+	case types.OCILayer:
+		layout, err := oci.OpenLayout(is.Url)
+		if err != nil {
+			return nil, err
+		}
+		return layoutDestination{dir: is.Url, oci: layout, layers: layers}, nil
+	default:
+		return nil, errors.Errorf("can't prune destination type: %s", is.Type)
+	}
+}
+
+// PruneRemote deletes the tags of the layers in the stackerfiles at paths
+// that opts.Policy doesn't keep from opts.Url.
+func PruneRemote(opts *PruneRemoteArgs, paths []string) error {
+	if opts.Policy.KeepLast < 1 {
+		return errors.Errorf("the retention policy needs to keep at least one tag per layer")
+	}
+
+	sfm, err := types.NewStackerFiles(paths, append(opts.Substitute, opts.Config.Substitutions()...))
+	if err != nil {
+		return err
+	}
+
+	layers := []string{}
+	for _, sf := range sfm {
+		layers = append(layers, sf.FileOrder...)
+	}
+
+	dest, err := openPruneDestination(opts, layers)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	seen := map[string]bool{}
+	for _, p := range paths {
+		absPath, err := filepath.Abs(p)
+		if err != nil {
+			return err
+		}
+
+		sf, ok := sfm[absPath]
+		if !ok {
+			return errors.Errorf("could not find entry for %s(%s) in stackerfiles", absPath, p)
+		}
+
+		for _, name := range sf.FileOrder {
+			l, ok := sf.Get(name)
+			if !ok {
+				return errors.Errorf("layer cannot be found in stackerfile: %s", name)
+			}
+
+			// build only layers are never published
+			if l.BuildOnly || seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			images, err := dest.images(name)
+			if err != nil {
+				return err
+			}
+
+			expired := opts.Policy.Expired(images)
+			for _, image := range expired {
+				if opts.DryRun {
+					log.Infof("would delete %s %s (%s)", name, image.Tag, image.Digest)
+				} else {
+					log.Infof("deleting %s %s (%s)", name, image.Tag, image.Digest)
+				}
+			}
+
+			if opts.DryRun {
+				continue
+			}
+
+			if err := dest.delete(name, expired); err != nil {
+				return err
+			}
+		}
+	}
+
+	if opts.UntaggedOlderThan == 0 {
+		return nil
+	}
+
+	if opts.DryRun {
+		log.Infof("would remove untagged blobs older than %s", opts.UntaggedOlderThan)
+		return nil
+	}
+
+	return dest.pruneUntagged(opts.UntaggedOlderThan)
+}
+
+// PruneLocalArgs are the options for pruning the local OCI output and roots
+// dir.
+type PruneLocalArgs struct {
+	// OlderThan is how long ago images must have been created to be
+	// pruned
+	OlderThan time.Duration
+	// Match is a glob pattern the tags to prune must match; empty matches
+	// everything
+	Match  string
+	DryRun bool
+}
+
+// localImage is a tag in the OCI output dir, and the roots dir snapshot of
+// the layer it was built from.
+type localImage struct {
+	Tag     string
+	Layer   string
+	Created time.Time
+}
+
+// localImageLayer returns the layer the tag in the OCI output was built from,
+// see LayerType.LayerName().
+func localImageLayer(tag string) string {
+	return strings.TrimSuffix(tag, "-squashfs")
+}
+
+// expiredLocalImages returns the images opts prunes, and the layers whose
+// roots dir snapshots are no longer needed because all of their images are
+// pruned.
+func expiredLocalImages(opts *PruneLocalArgs, images []localImage, now time.Time) ([]localImage, []string, error) {
+	cutoff := now.Add(-opts.OlderThan)
+	expired := []localImage{}
+	kept := map[string]bool{}
+	for _, image := range images {
+		matches := true
+		if opts.Match != "" {
+			var err error
+			matches, err = path.Match(opts.Match, image.Tag)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "bad pattern %s", opts.Match)
+			}
+		}
+
+		// images without a creation time are never old enough
+		if matches && !image.Created.IsZero() && image.Created.Before(cutoff) {
+			expired = append(expired, image)
+		} else {
+			kept[image.Layer] = true
+		}
+	}
+
+	layers := []string{}
+	seen := map[string]bool{}
+	for _, image := range expired {
+		if kept[image.Layer] || seen[image.Layer] {
+			continue
+		}
+		seen[image.Layer] = true
+		layers = append(layers, image.Layer)
+	}
+
+	return expired, layers, nil
+}
+
+// PruneLocal deletes the tags in the OCI output that opts selects, along with
+// the roots dir snapshots of the layers they were built from, and garbage
+// collects what they used. It returns how many bytes that freed.
+func PruneLocal(config types.StackerConfig, s types.Storage, opts *PruneLocalArgs) (int64, error) {
+	if _, err := os.Stat(config.OCIDir); os.IsNotExist(err) {
+		log.Infof("no OCI output in %s, nothing to prune", config.OCIDir)
+		return 0, nil
+	}
+
+	unlock, err := LockOCILayout(config.OCIDir, true)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	layout, err := oci.OpenLayout(config.OCIDir)
+	if err != nil {
+		return 0, err
+	}
+	defer layout.Close()
+
+	refs, err := layout.ListReferences(context.Background())
+	if err != nil {
+		return 0, err
+	}
+
+	images := []localImage{}
+	for _, ref := range refs {
+		manifest, err := oci.LookupManifest(layout, ref)
+		if err != nil {
+			return 0, err
+		}
+
+		created, err := oci.LookupCreated(layout, manifest)
+		if err != nil {
+			return 0, err
+		}
+
+		images = append(images, localImage{Tag: ref, Layer: localImageLayer(ref), Created: created})
+	}
+
+	expired, layers, err := expiredLocalImages(opts, images, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	if opts.DryRun {
+		for _, image := range expired {
+			log.Infof("would delete %s (created %s)", image.Tag, image.Created.Format(time.RFC3339))
+		}
+		for _, layer := range layers {
+			if s.Exists(layer) {
+				log.Infof("would delete roots dir snapshot %s", layer)
+			}
+		}
+		return 0, nil
+	}
+
+	before, err := localDiskUsage(config)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, image := range expired {
+		log.Infof("deleting %s (created %s)", image.Tag, image.Created.Format(time.RFC3339))
+		if err := layout.DeleteReference(context.Background(), image.Tag); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, layer := range layers {
+		if !s.Exists(layer) {
+			continue
+		}
+
+		log.Infof("deleting roots dir snapshot %s", layer)
+		if err := s.Delete(layer); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := layout.GC(context.Background()); err != nil {
+		return 0, err
+	}
+
+	if err := s.GC(); err != nil {
+		return 0, err
+	}
+
+	after, err := localDiskUsage(config)
+	if err != nil {
+		return 0, err
+	}
+
+	// something else may have been writing there meanwhile
+	if after > before {
+		return 0, nil
+	}
+
+	return before - after, nil
+}
+
+// GCLayout garbage collects the blobs that no tag in the OCI layout at dir
+// refers to any more (e.g. the old manifests and layers of rebuilt images),
+// and returns how many bytes that freed.
+func GCLayout(dir string) (int64, error) {
+	unlock, err := LockOCILayout(dir, true)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	layout, err := oci.OpenLayout(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer layout.Close()
+
+	blobs := path.Join(dir, "blobs")
+	before, err := lib.DiskUsage(blobs)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := layout.GC(context.Background()); err != nil {
+		return 0, errors.Wrapf(err, "couldn't gc %s", dir)
+	}
+
+	after, err := lib.DiskUsage(blobs)
+	if err != nil {
+		return 0, err
+	}
+
+	if after > before {
+		return 0, nil
+	}
+
+	return before - after, nil
+}
+
+// gcLayerBases garbage collects the layout stacker copies docker and oci bases
+// into, where the blobs of a base whose tag moved (e.g. a nightly) are left
+// behind by each import of the new one, and returns how many bytes that
+// freed. A layout whose blobs are a shared base_image_cache is left alone,
+// since the other stacker dirs' bases are in there too.
+func gcLayerBases(config types.StackerConfig) (int64, error) {
+	dir := path.Join(config.StackerDir, "layer-bases", "oci")
+	fi, err := os.Lstat(path.Join(dir, "blobs"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		log.Debugf("not collecting %s, its blobs are the shared base image cache's", dir)
+		return 0, nil
+	}
+
+	return GCLayout(dir)
+}
+
+func localDiskUsage(config types.StackerConfig) (int64, error) {
+	total := int64(0)
+	for _, dir := range []string{config.OCIDir, config.RootFSDir} {
+		usage, err := lib.DiskUsage(dir)
+		if err != nil {
+			return 0, err
+		}
+		total += usage
+	}
+
+	return total, nil
+}
@@ -0,0 +1,248 @@
+package stacker
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	image := func(tag string, content string, age int) RemoteImage {
+		return RemoteImage{
+			Tag:     tag,
+			Digest:  digest.FromString(content),
+			Created: now.Add(-time.Duration(age) * time.Hour),
+		}
+	}
+
+	images := []RemoteImage{
+		image("1.0.0", "a", 10),
+		image("1.0.0-squashfs", "b", 10),
+		image("nightly-1", "c", 9),
+		image("nightly-2", "d", 8),
+		image("nightly-3", "e", 7),
+		image("latest", "e", 7),
+		image("nightly-4", "f", 6),
+	}
+
+	tags := func(images []RemoteImage) []string {
+		ret := []string{}
+		for _, i := range images {
+			ret = append(ret, i.Tag)
+		}
+		return ret
+	}
+
+	policy := RetentionPolicy{KeepLast: 2}
+	// latest has the same digest as nightly-3, so deleting one would delete both
+	assert.Equal([]string{"nightly-2", "nightly-1", "1.0.0-squashfs", "1.0.0"}, tags(policy.Expired(images)))
+
+	policy.KeepSemver = true
+	assert.Equal([]string{"nightly-2", "nightly-1"}, tags(policy.Expired(images)))
+
+	policy.KeepLast = 10
+	assert.Equal([]string{}, tags(policy.Expired(images)))
+}
+
+func TestExpiredLocalImages(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	image := func(tag string, age int) localImage {
+		created := time.Time{}
+		if age >= 0 {
+			created = now.Add(-time.Duration(age) * time.Hour)
+		}
+		return localImage{Tag: tag, Layer: localImageLayer(tag), Created: created}
+	}
+
+	images := []localImage{
+		image("nightly-1", 1000),
+		image("nightly-1-squashfs", 1000),
+		image("nightly-2", 1000),
+		image("nightly-2-squashfs", 10),
+		image("nightly-3", 10),
+		image("release", 1000),
+		image("unknown", -1),
+	}
+
+	tags := func(images []localImage) []string {
+		result := []string{}
+		for _, image := range images {
+			result = append(result, image.Tag)
+		}
+		return result
+	}
+
+	expired, layers, err := expiredLocalImages(&PruneLocalArgs{OlderThan: 720 * time.Hour, Match: "nightly-*"}, images, now)
+	assert.NoError(err)
+	assert.Equal([]string{"nightly-1", "nightly-1-squashfs", "nightly-2"}, tags(expired))
+	// nightly-2 still has its squashfs image
+	assert.Equal([]string{"nightly-1"}, layers)
+
+	expired, layers, err = expiredLocalImages(&PruneLocalArgs{OlderThan: 720 * time.Hour}, images, now)
+	assert.NoError(err)
+	assert.Equal([]string{"nightly-1", "nightly-1-squashfs", "nightly-2", "release"}, tags(expired))
+	assert.Equal([]string{"nightly-1", "release"}, layers)
+
+	_, _, err = expiredLocalImages(&PruneLocalArgs{Match: "["}, images, now)
+	assert.Error(err)
+}
+
+func TestGCLayout(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_gc_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	layout := path.Join(dir, "oci")
+	oci, err := umoci.CreateLayout(layout)
+	assert.NoError(err)
+	assert.NoError(umoci.NewImage(oci, "kept"))
+
+	// a blob nothing refers to, like a rebuilt layer's old one
+	orphan, _, err := oci.PutBlob(context.Background(), strings.NewReader(strings.Repeat("orphaned", 4096)))
+	assert.NoError(err)
+	oci.Close()
+
+	reclaimed, err := GCLayout(layout)
+	assert.NoError(err)
+	assert.True(reclaimed > 0)
+
+	_, err = os.Stat(path.Join(layout, "blobs", orphan.Algorithm().String(), orphan.Encoded()))
+	assert.True(os.IsNotExist(err))
+
+	oci, err = umoci.OpenLayout(layout)
+	assert.NoError(err)
+	defer oci.Close()
+	_, err = oci.ResolveReference(context.Background(), "kept")
+	assert.NoError(err)
+
+	// nothing left to collect
+	reclaimed, err = GCLayout(layout)
+	assert.NoError(err)
+	assert.Equal(int64(0), reclaimed)
+}
+
+func TestGCLayerBasesSkipsSharedCache(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_gc_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	config := types.StackerConfig{StackerDir: path.Join(dir, "stacker"), BaseImageCache: path.Join(dir, "cache")}
+	reclaimed, err := gcLayerBases(config)
+	assert.NoError(err)
+	assert.Equal(int64(0), reclaimed)
+
+	oci, err := umoci.CreateLayout(path.Join(config.StackerDir, "layer-bases", "oci"))
+	assert.NoError(err)
+	oci.Close()
+
+	layout, err := layerBasesLayout(config)
+	assert.NoError(err)
+	oci, err = umoci.OpenLayout(layout)
+	assert.NoError(err)
+	// another stacker dir's base, as far as this one knows
+	orphan, _, err := oci.PutBlob(context.Background(), strings.NewReader(strings.Repeat("shared", 4096)))
+	assert.NoError(err)
+	oci.Close()
+
+	reclaimed, err = gcLayerBases(config)
+	assert.NoError(err)
+	assert.Equal(int64(0), reclaimed)
+
+	_, err = os.Stat(path.Join(config.BaseImageCache, "blobs", orphan.Algorithm().String(), orphan.Encoded()))
+	assert.NoError(err)
+}
+
+func TestLayoutDestinationImages(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_prune_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	layout := path.Join(dir, "oci")
+	oci, err := umoci.CreateLayout(layout)
+	assert.NoError(err)
+	defer oci.Close()
+	for _, ref := range []string{"foo_1.0", "foo_1.0-squashfs", "foo_bar_1.0", "other_1.0"} {
+		assert.NoError(umoci.NewImage(oci, ref))
+	}
+
+	dest := layoutDestination{dir: layout, oci: oci, layers: []string{"foo", "foo_bar"}}
+	images, err := dest.images("foo")
+	assert.NoError(err)
+	tags := []string{}
+	for _, image := range images {
+		tags = append(tags, image.Tag)
+	}
+	sort.Strings(tags)
+	assert.Equal([]string{"1.0", "1.0-squashfs"}, tags)
+
+	images, err = dest.images("foo_bar")
+	assert.NoError(err)
+	assert.Len(images, 1)
+	assert.Equal("1.0", images[0].Tag)
+}
+
+func TestArtifactKeepsCreated(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_prune_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	oci, err := umoci.CreateLayout(path.Join(dir, "oci"))
+	assert.NoError(err)
+	defer oci.Close()
+	assert.NoError(umoci.NewImage(oci, "sbom"))
+
+	manifest, err := stackeroci.LookupManifest(oci, "sbom")
+	assert.NoError(err)
+	created, err := stackeroci.LookupCreated(oci, manifest)
+	assert.NoError(err)
+	assert.False(created.IsZero())
+
+	file := path.Join(dir, "sbom.json")
+	assert.NoError(ioutil.WriteFile(file, []byte("{}"), 0644))
+	tar, err := types.NewLayerType("tar")
+	assert.NoError(err)
+	spec := artifactSpec{
+		Path:            "/sbom.json",
+		FileMediaType:   "application/spdx+json",
+		ConfigMediaType: DefaultArtifactType,
+		Config:          func(ispec.Descriptor) (interface{}, error) { return map[string]string{}, nil },
+	}
+	_, err = putArtifact(types.StackerConfig{}, oci, "sbom", []types.LayerType{tar}, spec, file)
+	assert.NoError(err)
+
+	// the artifact's config isn't an image config
+	manifest, err = stackeroci.LookupManifest(oci, "sbom")
+	assert.NoError(err)
+	assert.Equal(DefaultArtifactType, manifest.Config.MediaType)
+	_, err = stackeroci.LookupConfig(oci, manifest.Config)
+	assert.Error(err)
+
+	artifactCreated, err := stackeroci.LookupCreated(oci, manifest)
+	assert.NoError(err)
+	assert.True(created.Truncate(time.Second).Equal(artifactCreated), "%s != %s", created, artifactCreated)
+}
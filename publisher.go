@@ -1,38 +1,45 @@
 package stacker
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/limits"
 	"github.com/anuvu/stacker/log"
+	stackeroci "github.com/anuvu/stacker/oci"
 	"github.com/anuvu/stacker/types"
-	"github.com/opencontainers/umoci"
 	"github.com/opencontainers/umoci/oci/casext"
 	"github.com/pkg/errors"
 )
 
 type PublishArgs struct {
-	Config     types.StackerConfig
-	ShowOnly   bool
-	Substitute []string
-	Tags       []string
-	Url        string
-	Username   string
-	Password   string
-	Force      bool
-	Progress   bool
-	LayerTypes []types.LayerType
+	Config      types.StackerConfig
+	ShowOnly    bool
+	Substitute  []string
+	Tags        []string
+	Url         string
+	Username    string
+	Password    string
+	Force       bool
+	Progress    bool
+	LayerTypes  []types.LayerType
+	AlwaysPush  bool
+	NoOverwrite bool
 }
 
 // Publisher is responsible for publishing the layers based on stackerfiles
 type Publisher struct {
 	stackerfiles types.StackerFiles // Keep track of all the Stackerfiles to publish
 	opts         *PublishArgs       // Publish options
+	report       Report             // Summary of what was published
+	webhook      *webhook           // Where publish events are sent, if anywhere
 }
 
 // NewPublisher initializes a new Publisher struct
@@ -40,9 +47,15 @@ func NewPublisher(opts *PublishArgs) *Publisher {
 	return &Publisher{
 		stackerfiles: make(map[string]*types.Stackerfile, 1),
 		opts:         opts,
+		webhook:      newWebhook(opts.Config, "publish"),
 	}
 }
 
+// Report returns a summary of the images published so far
+func (p *Publisher) Report() *Report {
+	return &p.report
+}
+
 // Publish layers in a single stackerfile
 func (p *Publisher) Publish(file string) error {
 	opts := p.opts
@@ -59,7 +72,7 @@ func (p *Publisher) Publish(file string) error {
 	}
 
 	var oci casext.Engine
-	oci, err = umoci.OpenLayout(opts.Config.OCIDir)
+	oci, err = stackeroci.OpenLayout(opts.Config.OCIDir)
 	if err != nil {
 		return err
 	}
@@ -112,20 +125,25 @@ func (p *Publisher) Publish(file string) error {
 			return errors.Errorf("layer needs to be rebuilt before publishing: %s", name)
 		}
 
+		layerTypes, err := l.ParseLayerType()
+		if err != nil {
+			return err
+		}
+		if layerTypes == nil {
+			layerTypes = opts.LayerTypes
+		}
+
+		policyChecked := map[types.LayerType]bool{}
+
 		// Iterate through all tags
 		for _, tag := range tags {
-			for _, layerType := range opts.LayerTypes {
+			for _, layerType := range layerTypes {
 				layerTypeTag := layerType.LayerName(tag)
 				layerName := layerType.LayerName(name)
 				// Determine full destination URL
-				var destUrl string
-				switch is.Type {
-				case types.DockerLayer:
-					destUrl = fmt.Sprintf("%s/%s:%s", strings.TrimRight(opts.Url, "/"), name, layerTypeTag)
-				case types.OCILayer:
-					destUrl = fmt.Sprintf("%s:%s_%s", opts.Url, name, layerTypeTag)
-				default:
-					return errors.Errorf("can't save layers to destination type: %s", is.Type)
+				destUrl, err := publishDestination(is, opts.Url, name, layerTypeTag)
+				if err != nil {
+					return err
 				}
 
 				if opts.ShowOnly {
@@ -134,13 +152,78 @@ func (p *Publisher) Publish(file string) error {
 					continue
 				}
 
+				// if this layer wasn't built as this layer type,
+				// convert whatever was built
+				descPaths, err := oci.ResolveReference(context.Background(), layerName)
+				if err != nil {
+					return err
+				}
+
+				if len(descPaths) == 0 {
+					if l.IsArtifact() {
+						return errors.Errorf("%s is an artifact, and wasn't built as %s", name, layerType)
+					}
+
+					log.Infof("%s wasn't built as %s, converting it", name, layerType)
+					if err := s.ConvertOutput(name, layerType); err != nil {
+						return err
+					}
+
+					descPaths, err = oci.ResolveReference(context.Background(), layerName)
+					if err != nil {
+						return err
+					}
+				}
+
+				// the image may have been built (or converted just
+				// now) without the policy, or before it changed
+				if !policyChecked[layerType] {
+					if err := checkImagePolicy(opts.Config, oci, name, []types.LayerType{layerType}); err != nil {
+						return err
+					}
+					policyChecked[layerType] = true
+				}
+
+				// skip tags the destination already has, and refuse
+				// to clobber ones it has different versions of
+				localDigest := descPaths[0].Descriptor().Digest
+				if !opts.AlwaysPush || opts.NoOverwrite {
+					remoteDigest, err := lib.ManifestDigest(destUrl, opts.Username, opts.Password, false)
+					if err != nil && opts.NoOverwrite && !opts.Force && !lib.IsImageNotFound(err) {
+						// it may well be there, for all we know
+						return errors.Wrapf(err, "couldn't check whether %s exists, not publishing it with --no-overwrite", destUrl)
+					} else if err != nil {
+						log.Debugf("couldn't get digest of %s, publishing it: %v", destUrl, err)
+					} else if remoteDigest != localDigest && opts.NoOverwrite && !opts.Force {
+						return errors.Errorf("%s already exists with digest %s, not overwriting it with %s (use --force to)", destUrl, remoteDigest, localDigest)
+					} else if remoteDigest == localDigest && !opts.AlwaysPush {
+						log.Infof("%s is up to date, skipping %s %s", destUrl, file, layerName)
+						p.report.Published = append(p.report.Published, PublishReport{
+							Stackerfile:    file,
+							Name:           name,
+							Tag:            layerTypeTag,
+							LayerType:      layerType,
+							Destination:    destUrl,
+							ManifestDigest: localDigest.String(),
+							Skipped:        true,
+						})
+						continue
+					}
+				}
+
 				var progressWriter io.Writer
 				if p.opts.Progress {
 					progressWriter = os.Stderr
 				}
 
+				release, err := limits.Acquire(opts.Config, limits.Network)
+				if err != nil {
+					return err
+				}
+
 				// Store the layers to new destination
 				log.Infof("publishing %s %s to %s\n", file, layerName, destUrl)
+				start := time.Now()
 				err = lib.ImageCopy(lib.ImageCopyOpts{
 					Src:          fmt.Sprintf("oci:%s:%s", opts.Config.OCIDir, layerName),
 					Dest:         destUrl,
@@ -149,9 +232,22 @@ func (p *Publisher) Publish(file string) error {
 					Progress:     progressWriter,
 					SrcSkipTLS:   true,
 				})
+				release()
 				if err != nil {
-					return err
+					return types.WithKind(types.NetworkError, err)
 				}
+
+				pr := PublishReport{
+					Stackerfile:     file,
+					Name:            name,
+					Tag:             layerTypeTag,
+					LayerType:       layerType,
+					Destination:     destUrl,
+					ManifestDigest:  localDigest.String(),
+					DurationSeconds: time.Since(start).Seconds(),
+				}
+				p.report.Published = append(p.report.Published, pr)
+				p.webhook.send(WebhookEvent{Event: EventPublished, Stackerfiles: []string{file}, Published: &pr})
 			}
 		}
 	}
@@ -159,19 +255,54 @@ func (p *Publisher) Publish(file string) error {
 	return nil
 }
 
+// publishDestination returns the url that layer name is published to as tag
+// in the destination url (of type is).
+func publishDestination(is *types.ImageSource, url string, name string, tag string) (string, error) {
+	switch is.Type {
+	case types.DockerLayer:
+		return fmt.Sprintf("%s/%s:%s", strings.TrimRight(url, "/"), name, tag), nil
+	case types.OCILayer:
+		return fmt.Sprintf("%s:%s_%s", url, name, tag), nil
+	default:
+		return "", errors.Errorf("can't save layers to destination type: %s", is.Type)
+	}
+}
+
 // PublishMultiple published layers defined in a list of stackerfiles
 func (p *Publisher) PublishMultiple(paths []string) error {
+	start := time.Now()
+	p.webhook.send(WebhookEvent{Event: EventStarted, Stackerfiles: paths})
+	err := p.publishMultiple(paths)
+	p.webhook.finish(&p.report, start, err)
+	return err
+}
+
+func (p *Publisher) publishMultiple(paths []string) error {
 
 	// Verify the OCI layout exists
 	if _, err := os.Stat(p.opts.Config.OCIDir); err != nil {
 		return err
 	}
 
+	if err := stackeroci.Recover(p.opts.Config.OCIDir); err != nil {
+		return err
+	}
+
+	unlock, err := LockOCILayout(p.opts.Config.OCIDir, false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	// Read stackerfiles and update substitutions
 	sfm, err := p.readStackerFiles(paths)
 	if err != nil {
 		return err
 	}
+
+	if err := resolveStackerFilesBases(sfm, lockReadOnly); err != nil {
+		return err
+	}
 	p.stackerfiles = sfm
 
 	// Publish all Stackerfiles
@@ -182,6 +313,15 @@ func (p *Publisher) PublishMultiple(paths []string) error {
 		}
 	}
 
+	// Summarize what was actually pushed
+	for _, published := range p.report.Published {
+		status := "pushed"
+		if published.Skipped {
+			status = "skipped"
+		}
+		log.Infof("%s: %s", status, published.Destination)
+	}
+
 	return nil
 }
 
@@ -0,0 +1,130 @@
+package stacker
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// Report is a machine readable summary of a build or publish, written out by
+// --output-json so that CI systems don't have to scrape stacker's logs.
+type Report struct {
+	Layers          []LayerReport   `json:"layers,omitempty"`
+	Published       []PublishReport `json:"published,omitempty"`
+	DurationSeconds float64         `json:"duration_seconds"`
+	Error           string          `json:"error,omitempty"`
+
+	// ReclaimedBytes is how much gc_after_build freed in the base images.
+	ReclaimedBytes int64 `json:"reclaimed_bytes,omitempty"`
+
+	// FailedLayer is the layer that was being built when a build failed.
+	FailedLayer *LayerFailure `json:"failed_layer,omitempty"`
+
+	// FailedLayers are the layers that failed, or were skipped because
+	// one they depend on did, in a --keep-going build.
+	FailedLayers []LayerFailure `json:"failed_layers,omitempty"`
+}
+
+// LayerFailure says where the layer a build failed on is defined, and (in
+// FailedLayers) why it failed.
+type LayerFailure struct {
+	Stackerfile string `json:"stackerfile"`
+	Name        string `json:"name"`
+	Line        int    `json:"line,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// SkippedFor is the failed layer this one depends on, if it wasn't
+	// built because of it
+	SkippedFor string `json:"skipped_for,omitempty"`
+}
+
+// LayerReport describes the outcome of building a single layer.
+type LayerReport struct {
+	Stackerfile     string           `json:"stackerfile"`
+	Name            string           `json:"name"`
+	CacheHit        bool             `json:"cache_hit"`
+	BuildOnly       bool             `json:"build_only,omitempty"`
+	Outputs         []ManifestReport `json:"outputs,omitempty"`
+	Steps           []StepReport     `json:"steps,omitempty"`
+	DurationSeconds float64          `json:"duration_seconds"`
+}
+
+// StepReport is how long one of a layer's run or run_steps took; the run
+// directive is the step "run".
+type StepReport struct {
+	Name            string  `json:"name"`
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// ManifestReport describes an image stacker left in the output OCI layout.
+type ManifestReport struct {
+	Tag            string          `json:"tag"`
+	LayerType      types.LayerType `json:"layer_type"`
+	ManifestDigest string          `json:"manifest_digest"`
+	LayerDigests   []string        `json:"layer_digests"`
+}
+
+// PublishReport describes a single image copied to a remote destination.
+type PublishReport struct {
+	Stackerfile     string          `json:"stackerfile"`
+	Name            string          `json:"name"`
+	Tag             string          `json:"tag"`
+	LayerType       types.LayerType `json:"layer_type"`
+	Destination     string          `json:"destination"`
+	ManifestDigest  string          `json:"manifest_digest"`
+	DurationSeconds float64         `json:"duration_seconds"`
+	// Skipped is true if the destination already had this manifest
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+func newManifestReport(oci casext.Engine, layerType types.LayerType, name string) (ManifestReport, error) {
+	tag := layerType.LayerName(name)
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return ManifestReport{}, err
+	}
+
+	descPaths, err := oci.ResolveReference(context.Background(), tag)
+	if err != nil {
+		return ManifestReport{}, err
+	}
+
+	mr := ManifestReport{
+		Tag:            tag,
+		LayerType:      layerType,
+		ManifestDigest: descPaths[0].Descriptor().Digest.String(),
+		LayerDigests:   []string{},
+	}
+
+	for _, l := range manifest.Layers {
+		mr.LayerDigests = append(mr.LayerDigests, l.Digest.String())
+	}
+
+	return mr, nil
+}
+
+// Finish records the total duration of the operation and its error, if any.
+func (r *Report) Finish(start time.Time, err error) {
+	r.DurationSeconds = time.Since(start).Seconds()
+	if err != nil {
+		r.Error = err.Error()
+	} else {
+		r.FailedLayer = nil
+	}
+}
+
+// Write serializes the report as json to path.
+func (r *Report) Write(path string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "couldn't marshal report")
+	}
+
+	err = ioutil.WriteFile(path, append(content, '\n'), 0644)
+	return errors.Wrapf(err, "couldn't write report to %s", path)
+}
@@ -0,0 +1,110 @@
+package stacker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/pkg/errors"
+)
+
+// runStepPrefix is the prefix of the storage tags of name's run step
+// snapshots.
+func runStepPrefix(name string) string {
+	return fmt.Sprintf("%s-run-step-", name)
+}
+
+func runStepTag(name string, key string) string {
+	return runStepPrefix(name) + key[:16]
+}
+
+// canCacheRunSteps returns whether name's run steps' results can be cached.
+// overlay's snapshots share the upperdir of the thing they're a snapshot of,
+// so they would change as the build went on.
+func canCacheRunSteps(s types.Storage, l *types.Layer, binds types.Binds) bool {
+	if s.Name() != "btrfs" {
+		log.Infof("run steps are only cached with btrfs storage")
+		return false
+	}
+
+	// like the layer itself, it's impossible to say whether the steps
+	// would do the same thing with different bind contents
+	if binds.AlwaysRebuild() {
+		log.Infof("not using cached run steps due to use of binds in stacker file")
+		return false
+	}
+
+	// the point of a cache_ttl is running the steps again
+	if l.CacheTTL != "" {
+		log.Infof("not using cached run steps since the layer has a cache_ttl")
+		return false
+	}
+
+	return true
+}
+
+// restoreRunSteps sets name's rootfs up from the snapshot of the last of
+// its run steps whose key hasn't changed, returning how many of the steps
+// that skips, or zero if there is no such snapshot.
+func restoreRunSteps(s types.Storage, name string, steps []types.RunStep, keys []string) (int, error) {
+	for i := len(keys) - 1; i >= 0; i-- {
+		tag := runStepTag(name, keys[i])
+		if !s.Exists(tag) {
+			continue
+		}
+
+		err := s.Delete(name)
+		if err != nil && !os.IsNotExist(errors.Unwrap(err)) {
+			return 0, err
+		}
+
+		if err := s.Restore(tag, name); err != nil {
+			return 0, err
+		}
+
+		log.Infof("using cached result of run steps up to %s", steps[i].Name)
+		return i + 1, nil
+	}
+
+	return 0, nil
+}
+
+// snapshotRunStep saves the result of the run step with key.
+func snapshotRunStep(s types.Storage, name string, key string) error {
+	tag := runStepTag(name, key)
+	if s.Exists(tag) {
+		return nil
+	}
+
+	return s.Snapshot(name, tag)
+}
+
+// pruneRunSteps deletes the snapshots of name's run steps that aren't one of
+// keys, i.e. the results of steps that have since changed.
+func pruneRunSteps(config types.StackerConfig, s types.Storage, name string, keys []string) error {
+	current := map[string]bool{}
+	for _, key := range keys {
+		current[runStepTag(name, key)] = true
+	}
+
+	ents, err := ioutil.ReadDir(config.RootFSDir)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't list %s", config.RootFSDir)
+	}
+
+	for _, ent := range ents {
+		if !strings.HasPrefix(ent.Name(), runStepPrefix(name)) || current[ent.Name()] {
+			continue
+		}
+
+		log.Debugf("deleting stale run step snapshot %s", ent.Name())
+		if err := s.Delete(ent.Name()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
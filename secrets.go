@@ -0,0 +1,82 @@
+package stacker
+
+import (
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// maxSecretScanSize is the size of the biggest file whose content is scanned
+// for secrets; bigger ones are things like binaries and archives, which
+// aren't where keys get left behind.
+const maxSecretScanSize = 8 * 1024 * 1024
+
+// secretPattern is something in a file's content that looks like a secret.
+type secretPattern struct {
+	what string
+	re   *regexp.Regexp
+}
+
+// commonSecrets are the secrets the secrets check always looks for.
+var commonSecrets = []secretPattern{
+	{"an AWS access key id", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"an AWS secret access key", regexp.MustCompile(`(?i)aws_secret_access_key["']?\s*[:=]\s*["']?[A-Za-z0-9/+]{40}`)},
+	{"a private key", regexp.MustCompile(`-----BEGIN ((RSA|DSA|EC|OPENSSH|ENCRYPTED|PGP) )?PRIVATE KEY( BLOCK)?-----`)},
+}
+
+// secretFiles are the names of files that hold credentials whatever their
+// content.
+var secretFiles = map[string]string{
+	".netrc":           "a netrc file",
+	"_netrc":           "a netrc file",
+	".git-credentials": "a git credentials file",
+}
+
+// secretScanner finds the secrets in a layer's files.
+type secretScanner struct {
+	patterns []secretPattern
+}
+
+// newSecretScanner returns a scanner for the common secrets, as well as the
+// regexes in patterns.
+func newSecretScanner(patterns []string) (*secretScanner, error) {
+	scanner := &secretScanner{patterns: append([]secretPattern{}, commonSecrets...)}
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad secret pattern %s", pattern)
+		}
+
+		scanner.patterns = append(scanner.patterns, secretPattern{"a match for " + pattern, re})
+	}
+
+	return scanner, nil
+}
+
+// scan returns what kind of secret the file name (of size bytes) with content
+// has, or nothing if it doesn't look like it has any.
+func (ss *secretScanner) scan(name string, size int64, content io.Reader) (string, error) {
+	if what, ok := secretFiles[path.Base(name)]; ok {
+		return what, nil
+	}
+
+	if size > maxSecretScanSize {
+		return "", nil
+	}
+
+	buf, err := ioutil.ReadAll(content)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	for _, pattern := range ss.patterns {
+		if pattern.re.Match(buf) {
+			return pattern.what, nil
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,118 @@
+package squashfs
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/pkg/errors"
+)
+
+// outputTailLines is how many of the last lines a squashfs tool printed are
+// included in its error.
+const outputTailLines = 10
+
+var (
+	// ErrToolNotFound means the squashfs tool isn't installed.
+	ErrToolNotFound = errors.New("not found in $PATH")
+
+	// ErrUnsupportedCompressor means the squashfs tool wasn't built with
+	// support for the image's compressor.
+	ErrUnsupportedCompressor = errors.New("unsupported compressor")
+
+	// ErrNoSpace means the squashfs tool ran out of disk space.
+	ErrNoSpace = errors.New("no space left on device")
+
+	// ErrNotRegularFile means ExtractFile was asked for something that
+	// isn't a regular file.
+	ErrNotRegularFile = errors.New("not a regular file")
+)
+
+// failures maps output from mksquashfs, unsquashfs and squashtool to the
+// error it indicates.
+var failures = []struct {
+	message string
+	err     error
+}{
+	{"No space left on device", ErrNoSpace},
+	{"Unrecognised compressor", ErrUnsupportedCompressor},
+	{"compression, this is unsupported", ErrUnsupportedCompressor},
+	{"compressor not supported", ErrUnsupportedCompressor},
+}
+
+// runTool runs one of the squashfs tools, and if it fails, returns an error
+// with the end of its output. If the failure was recognized, errors.Cause()
+// of the error is one of the Err* values above.
+func runTool(name string, args ...string) error {
+	_, err := toolOutput(name, args...)
+	return err
+}
+
+// toolOutput is runTool, but also returns what the tool printed.
+func toolOutput(name string, args ...string) (string, error) {
+	if which(name) == "" {
+		return "", errors.Wrapf(ErrToolNotFound, "%s", name)
+	}
+
+	log.SubsystemDebugf(log.Storage, "%s %s", name, strings.Join(args, " "))
+	output := bytes.Buffer{}
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = nil
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return "", toolError(name, output.String(), err)
+	}
+
+	return output.String(), nil
+}
+
+func toolError(name string, output string, err error) error {
+	// mksquashfs uses \r to redraw its progress bar
+	lines := strings.FieldsFunc(output, func(r rune) bool {
+		return r == '\n' || r == '\r'
+	})
+
+	tail := []string{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			tail = append(tail, line)
+		}
+	}
+	if len(tail) > outputTailLines {
+		tail = tail[len(tail)-outputTailLines:]
+	}
+
+	for _, f := range failures {
+		if strings.Contains(output, f.message) {
+			err = f.err
+			break
+		}
+	}
+
+	return toolFailure{name, tail, err}
+}
+
+// toolFailure puts the tool's output after the error, since it may be
+// several lines long.
+type toolFailure struct {
+	name   string
+	output []string
+	err    error
+}
+
+func (t toolFailure) Error() string {
+	msg := fmt.Sprintf("%s failed: %v", t.name, t.err)
+	if len(t.output) == 0 {
+		return msg
+	}
+
+	return msg + "\n" + strings.Join(t.output, "\n")
+}
+
+func (t toolFailure) Cause() error {
+	return t.err
+}
@@ -0,0 +1,82 @@
+package squashfs
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToolError(t *testing.T) {
+	assert := assert.New(t)
+
+	exitErr := errors.New("exit status 1")
+
+	output := "Parallel mksquashfs: Using 8 processors\r[===   ] 10/100  10%\r[=====] 100/100 100%\n" +
+		"Write failed because No space left on device\n\nFATAL ERROR: Failed to write to output filesystem\n"
+	err := toolError("mksquashfs", output, exitErr)
+	assert.Equal(ErrNoSpace, errors.Cause(err))
+	assert.Equal(`mksquashfs failed: no space left on device
+Parallel mksquashfs: Using 8 processors
+[===   ] 10/100  10%
+[=====] 100/100 100%
+Write failed because No space left on device
+FATAL ERROR: Failed to write to output filesystem`, err.Error())
+
+	err = toolError("unsquashfs", "Filesystem uses zstd compression, this is unsupported by this version\n", exitErr)
+	assert.Equal(ErrUnsupportedCompressor, errors.Cause(err))
+
+	err = toolError("unsquashfs", "", exitErr)
+	assert.Equal(exitErr, errors.Cause(err))
+	assert.Equal("unsquashfs failed: exit status 1", err.Error())
+
+	// only the end of long output is kept
+	lines := []string{}
+	for i := 0; i < 100; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	err = toolError("mksquashfs", strings.Join(lines, "\n"), exitErr)
+	assert.Equal(outputTailLines+1, len(strings.Split(err.Error(), "\n")))
+	assert.True(strings.HasSuffix(err.Error(), "line 99"))
+
+	assert.Equal(ErrToolNotFound, errors.Cause(runTool("stacker-no-such-squashfs-tool")))
+}
+
+func TestParseCompressors(t *testing.T) {
+	assert := assert.New(t)
+
+	mksquashfsHelp := `SYNTAX:mksquashfs source1 source2 ...  dest [options] [-e list of exclude dirs/files]
+
+Filesystem build options:
+-comp <comp>		select <comp> compression
+			Compressors available:
+				gzip (default)
+				xz
+
+Compressors available and compressor specific options:
+	gzip (default)
+	  -Xcompression-level <compression-level>
+		<compression-level> should be 1 .. 9 (default 9)
+	lzo
+	  -Xalgorithm <algorithm>
+	xz
+	zstd
+	  -Xcompression-level <compression-level>
+`
+	assert.Equal([]string{"gzip", "lzo", "xz", "zstd"}, parseCompressors(mksquashfsHelp))
+
+	unsquashfsHelp := `UNSQUASHFS version 4.4 (2019/08/29)
+SYNTAX: unsquashfs [options] filesystem [directories or files to extract]
+	-v[ersion]		print version, licence and copyright information
+
+Decompressors available:
+	gzip
+	lz4
+	xz
+`
+	assert.Equal([]string{"gzip", "lz4", "xz"}, parseCompressors(unsquashfsHelp))
+
+	assert.Equal([]string{}, parseCompressors("mksquashfs: invalid option"))
+}
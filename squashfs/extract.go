@@ -0,0 +1,254 @@
+package squashfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// trustedOpaqueXattr is how privileged overlay mounts mark opaque directories.
+const trustedOpaqueXattr = "trusted.overlay.opaque"
+
+// listingEntry matches a line of unsquashfs -lln: the mode, the owner, the
+// size (or for devices, major and minor) and the path.
+var listingEntry = regexp.MustCompile(`^([-dlcbps][-rwxsStT]{9})\s+(\d+)/(\d+)\s+(\d+,\s*\d+|\d+)\s+\S+\s+\S+\s+squashfs-root(/.*)?$`)
+
+// FileInfo describes a file in a squashfs image.
+type FileInfo struct {
+	// Path is relative to the image's root.
+	Path     string
+	Mode     os.FileMode
+	Uid      int
+	Gid      int
+	Size     int64
+	Linkname string
+	// Whiteout is true for 0/0 character devices, which delete the file
+	// from the layers below.
+	Whiteout bool
+	// Xattrs are only filled in by Lookup(), for files that aren't
+	// directories.
+	Xattrs map[string]string
+}
+
+// parseMode parses an ls style mode, e.g. drwxr-xr-x.
+func parseMode(s string) os.FileMode {
+	mode := map[byte]os.FileMode{
+		'd': os.ModeDir,
+		'l': os.ModeSymlink,
+		'c': os.ModeDevice | os.ModeCharDevice,
+		'b': os.ModeDevice,
+		'p': os.ModeNamedPipe,
+		's': os.ModeSocket,
+	}[s[0]]
+
+	for i, c := range s[1:] {
+		if c != '-' && c != 'S' && c != 'T' {
+			mode |= 1 << uint(8-i)
+		}
+	}
+
+	if s[3] == 's' || s[3] == 'S' {
+		mode |= os.ModeSetuid
+	}
+	if s[6] == 's' || s[6] == 'S' {
+		mode |= os.ModeSetgid
+	}
+	if s[9] == 't' || s[9] == 'T' {
+		mode |= os.ModeSticky
+	}
+
+	return mode
+}
+
+// parseListing returns the entries in unsquashfs -lln output.
+func parseListing(listing string) []FileInfo {
+	entries := []FileInfo{}
+	for _, line := range strings.Split(listing, "\n") {
+		m := listingEntry.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		fi := FileInfo{Mode: parseMode(m[1])}
+		fi.Uid, _ = strconv.Atoi(m[2])
+		fi.Gid, _ = strconv.Atoi(m[3])
+		if strings.Contains(m[4], ",") {
+			fi.Whiteout = m[1][0] == 'c' && strings.Replace(m[4], " ", "", -1) == "0,0"
+		} else {
+			fi.Size, _ = strconv.ParseInt(m[4], 10, 64)
+		}
+
+		// symlinks are listed as "link -> target"
+		parts := strings.SplitN(strings.TrimPrefix(m[5], "/"), " -> ", 2)
+		fi.Path = parts[0]
+		if len(parts) == 2 {
+			fi.Linkname = parts[1]
+		}
+
+		entries = append(entries, fi)
+	}
+
+	return entries
+}
+
+// List returns the files in squashFile, or if paths are given, only those
+// (along with the directories they are in). Only the image's metadata is
+// read, not the contents of its files.
+func List(squashFile string, paths ...string) ([]FileInfo, error) {
+	listing, err := toolOutput("unsquashfs", append([]string{"-lln", squashFile}, paths...)...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't list %s", squashFile)
+	}
+
+	return parseListing(listing), nil
+}
+
+func hasOpaqueXattr(dir string) bool {
+	for _, xattr := range []string{userOpaqueXattr, trustedOpaqueXattr} {
+		buf := make([]byte, 1)
+		n, err := unix.Lgetxattr(dir, xattr, buf)
+		if err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+
+	return false
+}
+
+func readXattrs(p string) (map[string]string, error) {
+	size, err := unix.Llistxattr(p, nil)
+	if err != nil || size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(p, buf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't list xattrs of %s", p)
+	}
+
+	xattrs := map[string]string{}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		valueSize, err := unix.Lgetxattr(p, name, nil)
+		if err != nil {
+			continue
+		}
+
+		value := make([]byte, valueSize)
+		valueSize, err = unix.Lgetxattr(p, name, value)
+		if err != nil {
+			continue
+		}
+		xattrs[name] = string(value[:valueSize])
+	}
+
+	return xattrs, nil
+}
+
+// Lookup returns the info of target (a path relative to the image's root) in
+// the squashfs image squashFile, only reading the parts of the image it
+// needs; if dest isn't empty, target is extracted there, which only works
+// for regular files. If the image doesn't have target, the info is nil, and
+// hidden is true if the image deletes it or a directory it is in (with either
+// kind of whiteout, or an opaque directory), i.e. lower layers' versions of
+// it shouldn't be used.
+func Lookup(squashFile string, target string, dest string) (*FileInfo, bool, error) {
+	entries, err := List(squashFile, target)
+	if err != nil {
+		return nil, false, err
+	}
+
+	listed := map[string]FileInfo{}
+	for _, e := range entries {
+		listed[e.Path] = e
+	}
+
+	parts := strings.Split(target, "/")
+	for i := range parts {
+		entry, ok := listed[strings.Join(parts[:i+1], "/")]
+		if !ok {
+			break
+		}
+
+		if entry.Whiteout {
+			return nil, true, nil
+		}
+
+		// a file replaced one of target's directories
+		if i < len(parts)-1 && !entry.Mode.IsDir() {
+			return nil, true, nil
+		}
+	}
+
+	info, found := listed[target]
+	if found && info.Mode.IsDir() {
+		if dest != "" {
+			return nil, false, errors.Wrapf(ErrNotRegularFile, "%s", target)
+		}
+
+		// extracting a directory extracts everything in it
+		return &info, false, nil
+	}
+
+	// extract target (and the directories it is in, to find opaque ones)
+	// next to dest, so it can be renamed into place
+	tmpParent := ""
+	if dest != "" {
+		tmpParent = path.Dir(dest)
+	}
+	tmp, err := ioutil.TempDir(tmpParent, ".stacker-extract-")
+	if err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	err = runTool("unsquashfs", "-n", "-f", "-d", tmp, squashFile, target)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "couldn't extract %s from %s", target, squashFile)
+	}
+
+	extracted := path.Join(tmp, target)
+	st, err := os.Lstat(extracted)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, false, errors.WithStack(err)
+		}
+
+		for dir := path.Dir(extracted); strings.HasPrefix(dir, tmp+"/"); dir = path.Dir(dir) {
+			if hasOpaqueXattr(dir) {
+				return nil, true, nil
+			}
+		}
+
+		return nil, false, nil
+	}
+
+	if isXattrWhiteout(extracted, st) {
+		return nil, true, nil
+	}
+
+	info.Xattrs, err = readXattrs(extracted)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if dest == "" {
+		return &info, false, nil
+	}
+
+	if !st.Mode().IsRegular() {
+		return nil, false, errors.Wrapf(ErrNotRegularFile, "%s", target)
+	}
+
+	if err := os.Rename(extracted, dest); err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+
+	return &info, false, nil
+}
@@ -0,0 +1,37 @@
+package squashfs
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseListing(t *testing.T) {
+	assert := assert.New(t)
+
+	listing := `Parallel unsquashfs: Using 8 processors
+3 inodes (1 blocks) to write
+
+drwxr-xr-x 0/0                      45 2021-06-01 12:00 squashfs-root
+drwxr-xr-x 0/0                      36 2021-06-01 12:00 squashfs-root/etc
+-rw-r--r-- 1000/100               1024 2021-06-01 12:00 squashfs-root/etc/os-release
+crw-r--r-- 0/0                   0,  0 2021-06-01 12:00 squashfs-root/etc/passwd
+crw-rw-rw- 0/0                   1,  3 2021-06-01 12:00 squashfs-root/etc/null
+lrwxrwxrwx 0/0                      10 2021-06-01 12:00 squashfs-root/etc/localtime -> ../usr/foo
+-rwsr-xr-x 0/0                      10 2021-06-01 12:00 squashfs-root/etc/suid
+drwxrwxrwt 0/0                       3 2021-06-01 12:00 squashfs-root/tmp
+`
+
+	entries := parseListing(listing)
+	assert.Equal([]FileInfo{
+		{Path: "", Mode: os.ModeDir | 0755, Size: 45},
+		{Path: "etc", Mode: os.ModeDir | 0755, Size: 36},
+		{Path: "etc/os-release", Mode: 0644, Uid: 1000, Gid: 100, Size: 1024},
+		{Path: "etc/passwd", Mode: os.ModeDevice | os.ModeCharDevice | 0644, Whiteout: true},
+		{Path: "etc/null", Mode: os.ModeDevice | os.ModeCharDevice | 0666},
+		{Path: "etc/localtime", Mode: os.ModeSymlink | 0777, Size: 10, Linkname: "../usr/foo"},
+		{Path: "etc/suid", Mode: os.ModeSetuid | 0755, Size: 10},
+		{Path: "tmp", Mode: os.ModeDir | os.ModeSticky | 0777, Size: 3},
+	}, entries)
+}
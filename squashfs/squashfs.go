@@ -4,11 +4,9 @@ package squashfs
 
 import (
 	"bytes"
-	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"strings"
 
@@ -101,6 +99,18 @@ func (eps *ExcludePaths) String() (string, error) {
 }
 
 func MakeSquashfs(tempdir string, rootfs string, eps *ExcludePaths) (io.ReadCloser, error) {
+	image, err := MakeSquashfsFile(tempdir, rootfs, eps)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(image)
+
+	return os.Open(image)
+}
+
+// MakeSquashfsFile is MakeSquashfs, but returns the path of the image in
+// tempdir rather than its contents; the caller is responsible for removing it.
+func MakeSquashfsFile(tempdir string, rootfs string, eps *ExcludePaths) (string, error) {
 	var excludesFile string
 	var err error
 	var toExclude string
@@ -108,14 +118,14 @@ func MakeSquashfs(tempdir string, rootfs string, eps *ExcludePaths) (io.ReadClos
 	if eps != nil {
 		toExclude, err = eps.String()
 		if err != nil {
-			return nil, errors.Wrapf(err, "couldn't create exclude path list")
+			return "", errors.Wrapf(err, "couldn't create exclude path list")
 		}
 	}
 
 	if len(toExclude) != 0 {
 		excludes, err := ioutil.TempFile(tempdir, "stacker-squashfs-exclude-")
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 		defer os.Remove(excludes.Name())
 
@@ -123,32 +133,29 @@ func MakeSquashfs(tempdir string, rootfs string, eps *ExcludePaths) (io.ReadClos
 		_, err = excludes.WriteString(toExclude)
 		excludes.Close()
 		if err != nil {
-			return nil, err
+			return "", err
 		}
 	}
 
 	tmpSquashfs, err := ioutil.TempFile(tempdir, "stacker-squashfs-img-")
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	tmpSquashfs.Close()
 	os.Remove(tmpSquashfs.Name())
-	defer os.Remove(tmpSquashfs.Name())
 	args := []string{rootfs, tmpSquashfs.Name()}
 	if len(toExclude) != 0 {
 		args = append(args, "-ef", excludesFile)
 	}
-	cmd := exec.Command("mksquashfs", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err = cmd.Run(); err != nil {
-		return nil, errors.Wrap(err, "couldn't build squashfs")
+	if err = runTool("mksquashfs", args...); err != nil {
+		os.Remove(tmpSquashfs.Name())
+		return "", errors.Wrap(err, "couldn't build squashfs")
 	}
 
-	return os.Open(tmpSquashfs.Name())
+	return tmpSquashfs.Name(), nil
 }
 
-func GenerateSquashfsLayer(name, author, bundlepath, ocidir string, oci casext.Engine) error {
+func GenerateSquashfsLayer(name, author, bundlepath, ocidir string, oci casext.Engine, verity bool, keywords []mtree.Keyword) error {
 	meta, err := umoci.ReadBundleMeta(bundlepath)
 	if err != nil {
 		return err
@@ -169,12 +176,12 @@ func GenerateSquashfsLayer(name, author, bundlepath, ocidir string, oci casext.E
 
 	fsEval := fseval.Rootless
 	rootfsPath := path.Join(bundlepath, "rootfs")
-	newDH, err := mtree.Walk(rootfsPath, nil, umoci.MtreeKeywords, fsEval)
+	newDH, err := mtree.Walk(rootfsPath, nil, keywords, fsEval)
 	if err != nil {
 		return errors.Wrapf(err, "couldn't mtree walk %s", rootfsPath)
 	}
 
-	diffs, err := mtree.CompareSame(spec, newDH, umoci.MtreeKeywords)
+	diffs, err := mtree.CompareSame(spec, newDH, keywords)
 	if err != nil {
 		return err
 	}
@@ -194,11 +201,19 @@ func GenerateSquashfsLayer(name, author, bundlepath, ocidir string, oci casext.E
 	// library for generating squashfs images, we have to write these to
 	// the actual filesystem, and then remember what they are so we can
 	// delete them later.
+	//
+	// Without privilege, we can't create device nodes, so we use xattr
+	// whiteouts instead, which also means marking their parent
+	// directories; we remember those too.
 	missing := []string{}
+	markedDirs := map[string]bool{}
 	defer func() {
 		for _, f := range missing {
 			os.Remove(f)
 		}
+		for d := range markedDirs {
+			unix.Lremovexattr(d, userOpaqueXattr)
+		}
 	}()
 
 	// we only need to generate a layer if anything was added, modified, or
@@ -218,15 +233,15 @@ func GenerateSquashfsLayer(name, author, bundlepath, ocidir string, oci casext.E
 			paths.AddInclude(p, diff.Old().IsDir())
 			if err := unix.Mknod(p, unix.S_IFCHR, int(unix.Mkdev(0, 0))); err != nil {
 				if !os.IsNotExist(err) && err != unix.ENOTDIR {
-					// No privilege to create device nodes. Create a .wh.$filename instead.
-					dirname := path.Dir(diff.Path())
-					fname := fmt.Sprintf(".wh.%s", path.Base(diff.Path()))
-					whPath := path.Join(rootfsPath, dirname, fname)
-					fd, err := os.Create(whPath)
+					// No privilege to create device nodes. Create
+					// an xattr whiteout instead.
+					marked, err := writeXattrWhiteout(p)
 					if err != nil {
-						return errors.Wrapf(err, "couldn't mknod whiteout for %s", diff.Path())
+						return errors.Wrapf(err, "couldn't create whiteout for %s", diff.Path())
+					}
+					if marked {
+						markedDirs[path.Dir(p)] = true
 					}
-					fd.Close()
 				}
 			}
 		case mtree.Same:
@@ -238,13 +253,17 @@ func GenerateSquashfsLayer(name, author, bundlepath, ocidir string, oci casext.E
 		return nil
 	}
 
-	tmpSquashfs, err := MakeSquashfs(ocidir, rootfsPath, paths)
+	tmpSquashfs, err := MakeSquashfsFile(ocidir, rootfsPath, paths)
+	if err != nil {
+		return err
+	}
+
+	layer, err := PutLayer(oci, ocidir, tmpSquashfs, verity)
 	if err != nil {
 		return err
 	}
-	defer tmpSquashfs.Close()
 
-	desc, err := stackeroci.AddBlobNoCompression(oci, name, tmpSquashfs)
+	desc, err := stackeroci.AddBlobByDescriptor(oci, name, layer)
 	if err != nil {
 		return err
 	}
@@ -286,11 +305,17 @@ func ExtractSingleSquash(squashFile string, extractDir string, storageType strin
 		uCmd = []string{"unsquashfs", "-f", "-d", extractDir, squashFile}
 	}
 
-	cmd := exec.Command(uCmd[0], uCmd[1:]...)
-	cmd.Stdin = nil
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	if err := runTool(uCmd[0], uCmd[1:]...); err != nil {
+		return errors.Wrapf(err, "couldn't extract %s", squashFile)
+	}
+
+	// squashtool only knows about device whiteouts; overlay interprets
+	// xattr whiteouts itself when the layer is mounted.
+	if storageType == "btrfs" {
+		return applyXattrWhiteouts(extractDir)
+	}
+
+	return nil
 }
 
 func which(name string) string {
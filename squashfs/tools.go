@@ -0,0 +1,86 @@
+package squashfs
+
+import (
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ToolVersion returns the version line mksquashfs or unsquashfs prints, e.g.
+// "mksquashfs version 4.4 (2019/08/29)".
+func ToolVersion(tool string) (string, error) {
+	if which(tool) == "" {
+		return "", errors.Wrapf(ErrToolNotFound, "%s", tool)
+	}
+
+	output, err := exec.Command(tool, "-version").CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't get %s version: %s", tool, string(output))
+	}
+
+	return strings.SplitN(strings.TrimSpace(string(output)), "\n", 2)[0], nil
+}
+
+// ToolCompressors returns the compressors mksquashfs or unsquashfs was built
+// with.
+func ToolCompressors(tool string) ([]string, error) {
+	if which(tool) == "" {
+		return nil, errors.Wrapf(ErrToolNotFound, "%s", tool)
+	}
+
+	// the help output is the only place these are listed, and some
+	// versions exit non-zero after printing it.
+	output, _ := exec.Command(tool, "-help").CombinedOutput()
+	compressors := parseCompressors(string(output))
+	if len(compressors) == 0 {
+		return nil, errors.Errorf("couldn't find compressors in %s -help output", tool)
+	}
+
+	return compressors, nil
+}
+
+// parseCompressors parses the list of compressors from mksquashfs' or
+// unsquashfs' help, which look like:
+//
+//	Compressors available and compressor specific options:
+//		gzip (default)
+//		  -Xcompression-level <compression-level>
+//		...
+//		xz
+//
+// and
+//
+//	Decompressors available:
+//		gzip
+//		xz
+func parseCompressors(help string) []string {
+	compressors := []string{}
+	inList := false
+	for _, line := range strings.Split(help, "\n") {
+		if strings.Contains(line, "ompressors available") {
+			inList = true
+			continue
+		}
+
+		if !inList {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "\t") {
+			if strings.TrimSpace(line) != "" {
+				inList = false
+			}
+			continue
+		}
+
+		// compressor options are indented further
+		if len(line) < 2 || line[1] == ' ' || line[1] == '\t' {
+			continue
+		}
+
+		compressors = append(compressors, strings.Fields(line)[0])
+	}
+
+	return compressors
+}
@@ -0,0 +1,103 @@
+package squashfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	stackeroci "github.com/anuvu/stacker/oci"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci/oci/casext"
+	"github.com/pkg/errors"
+)
+
+// VerityRootHashAnnotation is the annotation on a squashfs layer's
+// descriptor with the root hash of the dm-verity hash tree appended to it.
+const VerityRootHashAnnotation = "com.cisco.stacker.squashfs_verity_root_hash"
+
+// verityBlockSize is veritysetup's default data and hash block size.
+// mksquashfs pads images to a multiple of it, so the hash tree starts right
+// after the image.
+const verityBlockSize = 4096
+
+var verityRootHash = regexp.MustCompile(`(?m)^Root hash:\s+([0-9a-f]+)\s*$`)
+
+// parseVerityRootHash finds the root hash in veritysetup format's output.
+func parseVerityRootHash(output string) (string, error) {
+	m := verityRootHash.FindStringSubmatch(output)
+	if m == nil {
+		return "", errors.Errorf("no root hash in veritysetup output:\n%s", output)
+	}
+
+	return m[1], nil
+}
+
+// AppendVerity appends a dm-verity hash tree for the squashfs image file to
+// it, and returns the tree's root hash.
+func AppendVerity(file string) (string, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	size := fi.Size()
+	if size%verityBlockSize != 0 {
+		return "", errors.Errorf("%s isn't padded to %d bytes, can't append verity data", file, verityBlockSize)
+	}
+
+	output, err := toolOutput("veritysetup", "format",
+		fmt.Sprintf("--data-blocks=%d", size/verityBlockSize),
+		fmt.Sprintf("--hash-offset=%d", size),
+		file, file)
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't append verity data to %s", file)
+	}
+
+	return parseVerityRootHash(output)
+}
+
+// VerityHashOffset returns where the hash tree in a squashfs blob with
+// verity data starts, i.e. the size of the image before it, from the
+// image's superblock.
+func VerityHashOffset(blob io.ReaderAt) (int64, error) {
+	// the superblock's magic is its first four bytes, and its bytes_used
+	// is the eight bytes at 40
+	superblock := make([]byte, 48)
+	if _, err := blob.ReadAt(superblock, 0); err != nil {
+		return 0, errors.Wrapf(err, "couldn't read squashfs superblock")
+	}
+
+	if string(superblock[:4]) != "hsqs" {
+		return 0, errors.Errorf("bad squashfs magic %q", superblock[:4])
+	}
+
+	used := int64(binary.LittleEndian.Uint64(superblock[40:]))
+	return (used + verityBlockSize - 1) / verityBlockSize * verityBlockSize, nil
+}
+
+// PutLayer adds the squashfs image file to oci as a layer, appending verity
+// data to it first if verity is set, and returns the layer's descriptor.
+func PutLayer(oci casext.Engine, ocidir string, file string, verity bool) (ispec.Descriptor, error) {
+	desc := ispec.Descriptor{MediaType: stackeroci.MediaTypeLayerSquashfs}
+
+	if verity {
+		rootHash, err := AppendVerity(file)
+		if err != nil {
+			os.Remove(file)
+			return ispec.Descriptor{}, err
+		}
+
+		desc.Annotations = map[string]string{VerityRootHashAnnotation: rootHash}
+	}
+
+	d, size, err := stackeroci.PutBlobFile(oci, ocidir, file)
+	if err != nil {
+		return ispec.Descriptor{}, err
+	}
+
+	desc.Digest = d
+	desc.Size = size
+	return desc, nil
+}
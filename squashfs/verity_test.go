@@ -0,0 +1,50 @@
+package squashfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVerityRootHash(t *testing.T) {
+	assert := assert.New(t)
+
+	output := `VERITY header information for layer
+UUID:            	0f6d3a3c-3b1e-4c1a-9f0e-2f4b8f1c2d3e
+Hash type:       	1
+Data blocks:     	256
+Data block size: 	4096
+Hash block size: 	4096
+Hash algorithm:  	sha256
+Salt:            	5e4c5b1d3a2f
+Root hash:      	d9c2fd3fbe3b8f1c6a0e7d2b4a5c6e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d
+`
+	rootHash, err := parseVerityRootHash(output)
+	assert.NoError(err)
+	assert.Equal("d9c2fd3fbe3b8f1c6a0e7d2b4a5c6e8f9a0b1c2d3e4f5a6b7c8d9e0f1a2b3c4d", rootHash)
+
+	_, err = parseVerityRootHash("Device layer is not a valid VERITY device.\n")
+	assert.Error(err)
+}
+
+func TestVerityHashOffset(t *testing.T) {
+	assert := assert.New(t)
+
+	superblock := make([]byte, 96)
+	copy(superblock, "hsqs")
+	binary.LittleEndian.PutUint64(superblock[40:], 5000)
+
+	offset, err := VerityHashOffset(bytes.NewReader(superblock))
+	assert.NoError(err)
+	assert.Equal(int64(8192), offset)
+
+	binary.LittleEndian.PutUint64(superblock[40:], 8192)
+	offset, err = VerityHashOffset(bytes.NewReader(superblock))
+	assert.NoError(err)
+	assert.Equal(int64(8192), offset)
+
+	_, err = VerityHashOffset(bytes.NewReader(make([]byte, 96)))
+	assert.Error(err)
+}
@@ -0,0 +1,100 @@
+package squashfs
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Besides 0/0 character devices, overlayfs (since v6.7) accepts an empty
+// regular file with the overlay.whiteout xattr as a whiteout, as long as its
+// parent directory's overlay.opaque xattr is "x". When overlay is mounted with
+// userxattr (which unprivileged mounts need anyway), these are in the user.
+// namespace, so they can be written without privilege.
+const (
+	userWhiteoutXattr = "user.overlay.whiteout"
+	userOpaqueXattr   = "user.overlay.opaque"
+
+	// the user.overlay.opaque value for a directory that contains xattr
+	// whiteouts, but is not itself opaque ("y")
+	opaqueHasXattrWhiteouts = "x"
+)
+
+// writeXattrWhiteout creates an xattr whiteout at p, returning true if it had
+// to mark p's parent directory.
+func writeXattrWhiteout(p string) (bool, error) {
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return false, err
+	}
+	f.Close()
+
+	if err := unix.Lsetxattr(p, userWhiteoutXattr, []byte{}, 0); err != nil {
+		return false, errors.Wrapf(err, "couldn't set %s", userWhiteoutXattr)
+	}
+
+	// an opaque directory hides everything below it anyway, so don't
+	// clobber that.
+	dir := filepath.Dir(p)
+	if isOpaque(dir) {
+		return false, nil
+	}
+
+	err = unix.Lsetxattr(dir, userOpaqueXattr, []byte(opaqueHasXattrWhiteouts), 0)
+	if err != nil {
+		return false, errors.Wrapf(err, "couldn't set %s on %s", userOpaqueXattr, dir)
+	}
+
+	return true, nil
+}
+
+func isOpaque(dir string) bool {
+	buf := make([]byte, 1)
+	n, err := unix.Lgetxattr(dir, userOpaqueXattr, buf)
+	return err == nil && n == 1 && buf[0] == 'y'
+}
+
+func isXattrWhiteout(p string, info os.FileInfo) bool {
+	if !info.Mode().IsRegular() || info.Size() != 0 {
+		return false
+	}
+
+	_, err := unix.Lgetxattr(p, userWhiteoutXattr, nil)
+	return err == nil
+}
+
+// applyXattrWhiteouts deletes the xattr whiteouts extracted into rootfs, along
+// with the xattrs marking their parent directories, since there is no overlay
+// to interpret them.
+func applyXattrWhiteouts(rootfs string) error {
+	whiteouts := []string{}
+	err := filepath.Walk(rootfs, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if isXattrWhiteout(p, info) {
+			whiteouts = append(whiteouts, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "couldn't find whiteouts in %s", rootfs)
+	}
+
+	for _, p := range whiteouts {
+		if err := os.Remove(p); err != nil {
+			return errors.Wrapf(err, "couldn't apply whiteout %s", p)
+		}
+
+		buf := make([]byte, 1)
+		n, err := unix.Lgetxattr(filepath.Dir(p), userOpaqueXattr, buf)
+		if err == nil && n == 1 && buf[0] == opaqueHasXattrWhiteouts[0] {
+			unix.Lremovexattr(filepath.Dir(p), userOpaqueXattr)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+package squashfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestXattrWhiteouts(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker-whiteout-test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(os.Mkdir(path.Join(dir, "etc"), 0755))
+	marked, err := writeXattrWhiteout(path.Join(dir, "etc", "foo"))
+	if err == unix.ENOTSUP {
+		t.Skip("tmpdir doesn't support user xattrs")
+	}
+	assert.NoError(err)
+	assert.True(marked)
+
+	// an empty file without the xattr is just an empty file
+	assert.NoError(ioutil.WriteFile(path.Join(dir, "etc", "empty"), nil, 0644))
+
+	assert.NoError(applyXattrWhiteouts(dir))
+
+	_, err = os.Stat(path.Join(dir, "etc", "foo"))
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(path.Join(dir, "etc", "empty"))
+	assert.NoError(err)
+
+	_, err = unix.Lgetxattr(path.Join(dir, "etc"), userOpaqueXattr, nil)
+	assert.Equal(unix.ENODATA, err)
+}
@@ -3,10 +3,15 @@ package stacker
 import (
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/anuvu/stacker/btrfs"
 	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/mount"
 	"github.com/anuvu/stacker/overlay"
 	"github.com/anuvu/stacker/storage"
 	"github.com/anuvu/stacker/types"
@@ -133,7 +138,18 @@ func maybeSwitchStorage(c types.StackerConfig) error {
 	return errors.Wrapf(err, "couldn't delete old cache")
 }
 
+// NewStorage sets up and opens the storage backend of the roots dir. Errors
+// it returns are storage errors, unless something more specific went wrong.
 func NewStorage(c types.StackerConfig) (types.Storage, error) {
+	s, err := newStorage(c)
+	return s, types.WithKind(types.StorageError, err)
+}
+
+func newStorage(c types.StackerConfig) (types.Storage, error) {
+	if err := lockRootsDir(c); err != nil {
+		return nil, err
+	}
+
 	if err := os.MkdirAll(c.RootFSDir, 0755); err != nil {
 		return nil, err
 	}
@@ -159,7 +175,42 @@ func NewStorage(c types.StackerConfig) (types.Storage, error) {
 		return nil, errors.Wrapf(err, "couldn't write storage type")
 	}
 
-	return openStorage(c, c.StorageType)
+	s, err := openStorage(c, c.StorageType)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := deleteTemporarySnapshots(c, s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// deleteTemporarySnapshots deletes the temporary snapshots that stackers
+// which were killed before they could clean them up left in the roots dir.
+// Since the roots dir is locked, no other stacker can still be using them.
+func deleteTemporarySnapshots(c types.StackerConfig, s types.Storage) error {
+	ents, err := ioutil.ReadDir(c.RootFSDir)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't read rootfs dir")
+	}
+
+	for _, ent := range ents {
+		if !strings.HasPrefix(ent.Name(), types.TemporarySnapshotPrefix) {
+			continue
+		}
+
+		log.Debugf("deleting leftover temporary snapshot %s", ent.Name())
+		// overlay mounts the snapshot's rootfs, which stays mounted if
+		// stacker wasn't in a user namespace
+		syscall.Unmount(path.Join(c.RootFSDir, ent.Name(), "rootfs"), 0)
+		if err := s.Delete(ent.Name()); err != nil {
+			return errors.Wrapf(err, "couldn't delete leftover temporary snapshot %s", ent.Name())
+		}
+	}
+
+	return nil
 }
 
 func UnprivSetup(c types.StackerConfig, uid, gid int) error {
@@ -177,3 +228,126 @@ func UnprivSetup(c types.StackerConfig, uid, gid int) error {
 		return errors.Errorf("unknown storage type %s", c.StorageType)
 	}
 }
+
+// MoveRootsDir moves the roots dir to dest, which mustn't exist yet. Nothing
+// may be building in the roots dir while it is moved; afterwards, the stacker
+// config (or --roots-dir) needs to point at dest.
+func MoveRootsDir(c types.StackerConfig, dest string) error {
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return err
+	}
+
+	if dest == c.RootFSDir || strings.HasPrefix(dest, c.RootFSDir+"/") {
+		return errors.Errorf("can't move %s into itself", c.RootFSDir)
+	}
+
+	if _, err := os.Stat(dest); err == nil {
+		return errors.Errorf("%s already exists", dest)
+	}
+
+	if _, err := os.Stat(c.RootFSDir); os.IsNotExist(err) {
+		return errors.Errorf("no roots dir in %s", c.RootFSDir)
+	}
+
+	if err := lockRootsDir(c); err != nil {
+		return err
+	}
+
+	ents, err := ioutil.ReadDir(c.RootFSDir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, ent := range ents {
+		if BuildRunning(c, ent.Name()) {
+			return errors.Errorf("%s is being built, can't move the roots dir", ent.Name())
+		}
+	}
+
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// the btrfs loopback's contents live in the stacker dir, and it is
+	// mounted wherever the roots dir is, so there is nothing to move
+	if btrfs.HasLoopback(c) {
+		mounted, err := mount.IsMountpoint(c.RootFSDir)
+		if err != nil {
+			return err
+		}
+
+		if mounted {
+			if err := syscall.Unmount(c.RootFSDir, 0); err != nil {
+				return errors.Wrapf(err, "couldn't unmount the btrfs loopback from %s", c.RootFSDir)
+			}
+		}
+
+		return errors.WithStack(os.Remove(c.RootFSDir))
+	}
+
+	err = os.Rename(c.RootFSDir, dest)
+	if err == nil {
+		return relinkRootsDir(c.RootFSDir, dest)
+	}
+
+	if !errors.Is(err, syscall.EXDEV) {
+		return errors.Wrapf(err, "couldn't move %s to %s", c.RootFSDir, dest)
+	}
+
+	// btrfs subvolumes can't be copied with their snapshots' sharing
+	// intact, so only overlay roots dirs go across filesystems
+	if c.StorageType != "overlay" {
+		return errors.Errorf("%s and %s are on different filesystems, which is only supported for overlay roots dirs", c.RootFSDir, dest)
+	}
+
+	log.Infof("%s is on a different filesystem, copying", dest)
+	output, err := exec.Command("cp", "-a", "--reflink=auto", c.RootFSDir, dest).CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dest)
+		return errors.Wrapf(err, "couldn't copy %s to %s: %s", c.RootFSDir, dest, string(output))
+	}
+
+	if err := relinkRootsDir(c.RootFSDir, dest); err != nil {
+		return err
+	}
+
+	return errors.Wrapf(os.RemoveAll(c.RootFSDir), "couldn't remove %s", c.RootFSDir)
+}
+
+// relinkRootsDir points the overlay backend's absolute symlinks between the
+// layers in the roots dir (see overlayPath()), which are at most two levels
+// deep, at the roots dir's new location.
+func relinkRootsDir(old string, dest string) error {
+	links, err := filepath.Glob(path.Join(dest, "*"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	inner, err := filepath.Glob(path.Join(dest, "*", "*"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, link := range append(links, inner...) {
+		target, err := os.Readlink(link)
+		if err != nil {
+			// not a symlink
+			continue
+		}
+
+		if !strings.HasPrefix(target, old+"/") {
+			continue
+		}
+
+		if err := os.Remove(link); err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := os.Symlink(dest+strings.TrimPrefix(target, old), link); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"io"
+	"runtime"
+
+	"github.com/anuvu/stacker/types"
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/opencontainers/umoci/mutate"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/opencontainers/umoci/pkg/idtools"
+	"github.com/pkg/errors"
+)
+
+// TarCompressor returns the compressor for tar layers described by the
+// layer_compression and layer_compression_level config options.
+func TarCompressor(config types.StackerConfig) (mutate.Compressor, error) {
+	level := config.LayerCompressionLevel
+
+	switch config.LayerCompression {
+	case "", "gzip":
+		if level == 0 {
+			level = pgzip.DefaultCompression
+		}
+		if level < pgzip.DefaultCompression || level > pgzip.BestCompression {
+			return nil, errors.Errorf("bad layer_compression_level %d for gzip", level)
+		}
+		return gzipCompressor{level}, nil
+	case "zstd":
+		if level < 0 || level > 22 {
+			return nil, errors.Errorf("bad layer_compression_level %d for zstd", level)
+		}
+		return zstdCompressor{level}, nil
+	case "none":
+		return mutate.NoopCompressor, nil
+	default:
+		return nil, errors.Errorf("unknown layer_compression %s", config.LayerCompression)
+	}
+}
+
+// OutputCompressor returns the compressor for outputs' compression, none,
+// gzip or zstd, at the compressor's default level.
+func OutputCompressor(compression string) (mutate.Compressor, error) {
+	switch compression {
+	case "", "none":
+		return mutate.NoopCompressor, nil
+	case "gzip":
+		return gzipCompressor{pgzip.DefaultCompression}, nil
+	case "zstd":
+		return zstdCompressor{0}, nil
+	default:
+		return nil, errors.Errorf("unknown compression %s", compression)
+	}
+}
+
+// RepackMapOptions returns the uid and gid mappings to apply to the files in
+// tar layers, from the layer_uid_map and layer_gid_map config options. These
+// are in umoci's containerID:hostID:size format.
+func RepackMapOptions(config types.StackerConfig) (layer.MapOptions, error) {
+	opts := layer.MapOptions{}
+
+	for _, m := range config.LayerUIDMap {
+		idMap, err := idtools.ParseMapping(m)
+		if err != nil {
+			return opts, errors.Wrapf(err, "bad layer_uid_map %s", m)
+		}
+		opts.UIDMappings = append(opts.UIDMappings, idMap)
+	}
+
+	for _, m := range config.LayerGIDMap {
+		idMap, err := idtools.ParseMapping(m)
+		if err != nil {
+			return opts, errors.Wrapf(err, "bad layer_gid_map %s", m)
+		}
+		opts.GIDMappings = append(opts.GIDMappings, idMap)
+	}
+
+	return opts, nil
+}
+
+// compress streams r through the compressor w creates.
+func compress(r io.Reader, newWriter func(io.Writer) (io.WriteCloser, error)) (io.ReadCloser, error) {
+	reader, writer := io.Pipe()
+
+	compressor, err := newWriter(writer)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		_, err := io.Copy(compressor, r)
+		if err != nil {
+			compressor.Close()
+			writer.CloseWithError(errors.Wrapf(err, "couldn't compress layer"))
+			return
+		}
+
+		writer.CloseWithError(compressor.Close())
+	}()
+
+	return reader, nil
+}
+
+// umoci's compressors always use the default level, so we have our own.
+type gzipCompressor struct {
+	level int
+}
+
+func (gz gzipCompressor) Compress(r io.Reader) (io.ReadCloser, error) {
+	return compress(r, func(w io.Writer) (io.WriteCloser, error) {
+		gzw, err := pgzip.NewWriterLevel(w, gz.level)
+		if err != nil {
+			return nil, err
+		}
+
+		// the same as umoci's
+		err = gzw.SetConcurrency(256<<10, 2*runtime.NumCPU())
+		if err != nil {
+			return nil, err
+		}
+
+		return gzw, nil
+	})
+}
+
+func (gz gzipCompressor) MediaTypeSuffix() string {
+	return "gzip"
+}
+
+type zstdCompressor struct {
+	// level is in zstd's 1-22 scale, or 0 for the default
+	level int
+}
+
+func (zs zstdCompressor) Compress(r io.Reader) (io.ReadCloser, error) {
+	return compress(r, func(w io.Writer) (io.WriteCloser, error) {
+		opts := []zstd.EOption{}
+		if zs.level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(zs.level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	})
+}
+
+func (zs zstdCompressor) MediaTypeSuffix() string {
+	return "zstd"
+}
@@ -2,6 +2,9 @@
 package storage
 
 import (
+	"context"
+
+	stackeroci "github.com/anuvu/stacker/oci"
 	"github.com/anuvu/stacker/types"
 	"github.com/pkg/errors"
 )
@@ -49,3 +52,42 @@ func FindFirstBaseInOutput(name string, sfm types.StackerFiles) (string, *types.
 	// otherwise, we didn't find anything
 	return "", nil, nil
 }
+
+// FindOutputLayerType finds a layer type other than layerType that name was
+// output as, so that it can be converted to layerType.
+func FindOutputLayerType(ociDir string, name string, layerType types.LayerType) (types.LayerType, error) {
+	oci, err := stackeroci.OpenLayout(ociDir)
+	if err != nil {
+		return types.LayerType(""), err
+	}
+	defer oci.Close()
+
+	for _, lt := range []types.LayerType{"tar", "squashfs"} {
+		if lt == layerType {
+			continue
+		}
+
+		descPaths, err := oci.ResolveReference(context.Background(), lt.LayerName(name))
+		if err != nil {
+			return types.LayerType(""), err
+		}
+
+		if len(descPaths) > 0 {
+			return lt, nil
+		}
+	}
+
+	return types.LayerType(""), errors.Errorf("%s isn't in the output in any layer type, can't convert it to %s", name, layerType)
+}
+
+// LayerAuthor returns the author of the layer name, for the history of the
+// layers generated for it.
+func LayerAuthor(config types.StackerConfig, name string, sfm types.StackerFiles) (string, error) {
+	l, ok := sfm.LookupLayerDefinition(name)
+	if !ok {
+		l = &types.Layer{}
+	}
+
+	author, _, err := l.ParseAuthor(config)
+	return author, err
+}
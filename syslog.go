@@ -0,0 +1,81 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/pkg/errors"
+)
+
+// syslogSink receives what the processes in a build container send to
+// syslog, and logs it with the rest of the build's output; otherwise there
+// is nothing in the container to receive it, and it is lost. Its socket is
+// mounted at /dev/log in the container, which is on lxc's autodev tmpfs, so
+// the mountpoint doesn't end up in the layer.
+type syslogSink struct {
+	dir    string
+	socket string
+	conn   *net.UnixConn
+	done   chan struct{}
+}
+
+func newSyslogSink() (*syslogSink, error) {
+	// unix socket paths are limited to 108 bytes, so this can't be in
+	// StackerDir
+	dir, err := ioutil.TempDir("", "stacker-syslog-")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	s := &syslogSink{dir: dir, socket: path.Join(dir, "log"), done: make(chan struct{})}
+	s.conn, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: s.socket, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, errors.Wrapf(err, "couldn't listen on %s", s.socket)
+	}
+
+	// the processes logging may not be root
+	for p, mode := range map[string]os.FileMode{dir: 0755, s.socket: 0666} {
+		if err := os.Chmod(p, mode); err != nil {
+			s.Close()
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	go s.serve()
+	return s, nil
+}
+
+func (s *syslogSink) serve() {
+	defer close(s.done)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			return
+		}
+
+		log.Infof("syslog: %s", syslogMessage(buf[:n]))
+	}
+}
+
+func (s *syslogSink) Close() {
+	s.conn.Close()
+	<-s.done
+	os.RemoveAll(s.dir)
+}
+
+var syslogPriority = regexp.MustCompile(`^<[0-9]{1,3}>`)
+
+// syslogMessage returns the message of a syslog datagram, without its
+// priority or trailing newlines.
+func syslogMessage(datagram []byte) string {
+	msg := syslogPriority.ReplaceAllString(string(datagram), "")
+	return strings.TrimRight(msg, "\n\x00")
+}
@@ -0,0 +1,31 @@
+package stacker
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslogMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("Oct 14 07:08:09 myapp[12]: started", syslogMessage([]byte("<13>Oct 14 07:08:09 myapp[12]: started\n")))
+	assert.Equal("no priority", syslogMessage([]byte("no priority")))
+}
+
+func TestSyslogSink(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := newSyslogSink()
+	assert.NoError(err)
+
+	conn, err := net.Dial("unixgram", s.socket)
+	assert.NoError(err)
+	_, err = conn.Write([]byte("<13>hello"))
+	assert.NoError(err)
+	conn.Close()
+
+	s.Close()
+	assert.NoDirExists(s.dir)
+}
@@ -0,0 +1,153 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+    rm -rf oci_publish || true
+}
+
+@test "artifact outputs" {
+    cat > stacker.yaml <<EOF
+app:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        mkdir -p /etc/app
+        echo config > /etc/app/app.conf
+sbom:
+    from:
+        type: built
+        tag: app
+    run: |
+        echo '{"spdxVersion": "SPDX-2.2"}' > /sbom.json
+    artifact:
+        path: /sbom.json
+        media_type: application/spdx+json
+        artifact_type: application/vnd.example.sbom.v1+json
+config-pack:
+    from:
+        type: built
+        tag: app
+    artifact:
+        path: /etc/app
+EOF
+    stacker build
+
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "sbom") | .digest' | cut -f2 -d:)
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r .config.mediaType)" = "application/vnd.example.sbom.v1+json" ]
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r '.layers | length')" = "1" ]
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r .layers[0].mediaType)" = "application/spdx+json" ]
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r '.layers[0].annotations."org.opencontainers.image.title"')" = "sbom.json" ]
+    blob=$(cat oci/blobs/sha256/$manifest | jq -r .layers[0].digest | cut -f2 -d:)
+    [ "$(cat oci/blobs/sha256/$blob | jq -r .spdxVersion)" = "SPDX-2.2" ]
+
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "config-pack") | .digest' | cut -f2 -d:)
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r .config.mediaType)" = "application/vnd.unknown.config.v1+json" ]
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r .layers[0].mediaType)" = "application/vnd.oci.image.layer.v1.tar" ]
+    blob=$(cat oci/blobs/sha256/$manifest | jq -r .layers[0].digest | cut -f2 -d:)
+    tar -tf oci/blobs/sha256/$blob | grep app.conf
+
+    # it's cached like any other layer
+    stacker build
+    echo "$output" | grep "found cached layer sbom"
+
+    stacker publish --url oci:oci_publish --tag test
+    manifest=$(cat oci_publish/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "sbom_test") | .digest' | cut -f2 -d:)
+    [ "$(cat oci_publish/blobs/sha256/$manifest | jq -r .config.mediaType)" = "application/vnd.example.sbom.v1+json" ]
+}
+
+@test "layers can't be built on artifacts" {
+    cat > stacker.yaml <<EOF
+sbom:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    artifact:
+        path: /etc/os-release
+child:
+    from:
+        type: built
+        tag: sbom
+EOF
+    bad_stacker build
+    echo "$output" | grep "child: can't be built on sbom, which is an artifact"
+}
+
+@test "artifacts' symlinks are followed inside the layer" {
+    echo host-secret > secret
+    cat > stacker.yaml <<EOF
+sbom:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        echo '{"spdxVersion": "SPDX-2.2"}' > /real.json
+        ln -s /real.json /sbom.json
+        ln -s $(pwd)/secret /leak.json
+    artifact:
+        path: /sbom.json
+leak:
+    from:
+        type: built
+        tag: sbom
+    artifact:
+        path: /leak.json
+EOF
+    bad_stacker build
+    echo "$output" | grep "couldn't find artifact /leak.json"
+
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "sbom") | .digest' | cut -f2 -d:)
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r '.layers[0].annotations."org.opencontainers.image.title"')" = "sbom.json" ]
+    blob=$(cat oci/blobs/sha256/$manifest | jq -r .layers[0].digest | cut -f2 -d:)
+    [ "$(cat oci/blobs/sha256/$blob | jq -r .spdxVersion)" = "SPDX-2.2" ]
+}
+
+@test "wasm outputs" {
+    cat > stacker.yaml <<EOF
+hello:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    author: wasm@example.com
+    run: |
+        printf '\\0asm\\1\\0\\0\\0' > /hello.wasm
+    wasm:
+        module: /hello.wasm
+notwasm:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    wasm:
+        module: /bin/ls
+        wasi: preview2
+EOF
+    bad_stacker build
+    echo "$output" | grep "bad artifact /bin/ls: not a wasm module"
+
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "hello") | .digest' | cut -f2 -d:)
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r .config.mediaType)" = "application/vnd.wasm.config.v0+json" ]
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r .layers[0].mediaType)" = "application/wasm" ]
+    layer=$(cat oci/blobs/sha256/$manifest | jq -r .layers[0].digest)
+    config=$(cat oci/blobs/sha256/$manifest | jq -r .config.digest | cut -f2 -d:)
+    [ "$(cat oci/blobs/sha256/$config | jq -r .architecture)" = "wasm" ]
+    [ "$(cat oci/blobs/sha256/$config | jq -r .os)" = "wasip1" ]
+    [ "$(cat oci/blobs/sha256/$config | jq -r .author)" = "wasm@example.com" ]
+    [ "$(cat oci/blobs/sha256/$config | jq -r .layerDigests[0])" = "$layer" ]
+    [ "$(head -c4 oci/blobs/sha256/${layer#sha256:} | od -An -c | tr -d ' ')" = "\\0asm" ]
+
+    cat > stacker.yaml <<EOF
+bad:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    wasm:
+        module: /hello.wasm
+        wasi: preview3
+EOF
+    bad_stacker build
+    echo "$output" | grep "unknown wasi version preview3"
+}
@@ -0,0 +1,54 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "umask, timezone and locale are set for run" {
+    cat > stacker.yaml <<EOF
+thing:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    umask: "0027"
+    timezone: UTC
+    locale: C.UTF-8
+    run: |
+        touch /created
+        echo "\$TZ \$LANG \$LC_ALL" > /env
+EOF
+    stacker build
+    umoci unpack --image oci:thing dest
+    [ "$(stat --format=%a dest/rootfs/created)" = "640" ]
+    [ "$(cat dest/rootfs/env)" = "UTC C.UTF-8 C.UTF-8" ]
+    rm -rf dest
+}
+
+@test "bad umasks are rejected" {
+    cat > stacker.yaml <<EOF
+thing:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    umask: "0999"
+    run: true
+EOF
+    bad_stacker build
+    echo "$output" | grep "bad umask 0999"
+}
+
+@test "syslog messages end up in the build log" {
+    cat > stacker.yaml <<EOF
+thing:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: logger -t provision hello from syslog
+EOF
+    stacker build
+    echo "$output" | grep "syslog: .*provision.*hello from syslog"
+}
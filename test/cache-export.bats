@@ -0,0 +1,51 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "btrfs cache export and import" {
+    require_storage btrfs
+    require_privilege priv
+
+    touch foo
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    import:
+        - foo
+    run: cp /stacker/foo /foo
+EOF
+    stacker build
+    stacker cache export export
+    [ -f export/roots.btrfs ]
+    [ -f export/build.cache ]
+
+    # import it into a fresh set of dirs, which should be fully cached
+    stacker --stacker-dir=other/.stacker --roots-dir=other/roots --oci-dir=other/oci cache import export
+    stacker --stacker-dir=other/.stacker --roots-dir=other/roots --oci-dir=other/oci build
+    echo "$output" | grep "found cached layer test"
+
+    # and it doesn't clobber an existing cache
+    bad_stacker --stacker-dir=other/.stacker --roots-dir=other/roots --oci-dir=other/oci cache import export
+    echo "$output" | grep "refusing to overwrite"
+}
+
+@test "cache export isn't supported on overlay" {
+    require_storage overlay
+
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+EOF
+    stacker build
+    bad_stacker cache export export
+}
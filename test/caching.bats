@@ -27,6 +27,41 @@ EOF
     [ "$(cat dest/rootfs/content.txt)" == "b" ]
 }
 
+@test "from: tar extractions are cached by hash" {
+    echo -n "a" > content.txt
+    tar -cf - content.txt | xz > tar.tar.xz
+    tar -cf - content.txt | zstd > tar.tar.zst
+    cat > stacker.yaml <<EOF
+one:
+    from:
+        type: tar
+        url: tar.tar.xz
+        hash: $(sha256sum tar.tar.xz | cut -f1 -d" ")
+two:
+    from:
+        type: tar
+        url: tar.tar.xz
+    run: |
+        echo two > /two
+three:
+    from:
+        type: tar
+        url: tar.tar.zst
+EOF
+    stacker build
+    echo "$output" | grep "using cached extraction of tar.tar.xz"
+    umoci unpack --image oci:two dest
+    [ "$(cat dest/rootfs/content.txt)" == "a" ]
+    [ "$(cat dest/rootfs/two)" == "two" ]
+    rm -rf dest
+    umoci unpack --image oci:three dest
+    [ "$(cat dest/rootfs/content.txt)" == "a" ]
+
+    sed -i "s/hash: .*/hash: $(sha256sum tar.tar.zst | cut -f1 -d" ")/" stacker.yaml
+    bad_stacker build
+    echo "$output" | grep "The requested hash of tar.tar.xz base is different than the actual hash"
+}
+
 @test "from: oci layer rebuilds on change" {
     cat > stacker.yaml <<EOF
 test:
@@ -163,6 +198,38 @@ EOF
     [[ ! "${output}" =~ ^(.*found cached layer bind-test)$ ]]
 }
 
+@test "bind_cache content rebuilds only when content changes" {
+    cat > stacker.yaml <<"EOF"
+bind-test:
+    from:
+        type: oci
+        url: ${{CENTOS_OCI}}
+    binds:
+        - source: ${{bind_path}}
+          dest: /root/tree
+          bind_cache: content
+    run: |
+        cp /root/tree/zomg /root/zomg
+EOF
+    mkdir -p tree
+    echo foo > tree/zomg
+    bind_path=$(realpath tree)
+
+    stacker build --substitute bind_path=${bind_path} --substitute CENTOS_OCI=$CENTOS_OCI
+    stacker build --substitute bind_path=${bind_path} --substitute CENTOS_OCI=$CENTOS_OCI
+    [[ "${output}" =~ ^(.*found cached layer bind-test.*)$ ]]
+
+    # mtime changes alone don't matter for content caching
+    touch tree/zomg
+    stacker build --substitute bind_path=${bind_path} --substitute CENTOS_OCI=$CENTOS_OCI
+    [[ "${output}" =~ ^(.*found cached layer bind-test.*)$ ]]
+
+    echo bar > tree/zomg
+    stacker build --substitute bind_path=${bind_path} --substitute CENTOS_OCI=$CENTOS_OCI
+    [[ "${output}" =~ ^(.*cache miss because bind content changed.*)$ ]]
+    [[ "${output}" =~ ^(.*filesystem bind-test built successfully)$ ]]
+}
+
 @test "mode change is re-imported" {
     cat > stacker.yaml <<EOF
 mode-test:
@@ -223,3 +290,244 @@ EOF
     echo '{"version": 1, "cache": "lolnope"}' > .stacker/build.cache
     stacker build
 }
+
+@test "stacker cache migrate" {
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+EOF
+    stacker cache migrate
+    echo "$output" | grep "nothing to migrate"
+    stacker build
+    sed -i -e 's/"version":12/"version":11/' .stacker/build.cache
+    stacker cache migrate
+    echo "$output" | grep "migrated cache to version 12"
+    stacker build
+    echo "$output" | grep "found cached layer test"
+}
+
+@test "stacker cache key" {
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    import:
+        - setup.sh
+    run: sh /stacker/setup.sh
+EOF
+    echo "echo one" > setup.sh
+    stacker build
+    stacker cache key test
+    echo "$output" | grep "^key: "
+    echo "$output" | grep "^layer: "
+    echo "$output" | grep "^base oci: "
+    echo "$output" | grep "^import .*setup.sh: "
+    [ -z "$(echo "$output" | grep "was")" ]
+    before=$(echo "$output" | grep "^key: " | cut -f2 -d" ")
+
+    stacker cache key --json test
+    [ "$(echo "$output" | jq -r .key)" = "$before" ]
+
+    # the definition is read from the stacker file, so changing it shows up
+    # right away
+    sed -i 's|run: sh /stacker/setup.sh|run: sh -x /stacker/setup.sh|' stacker.yaml
+    stacker cache key test
+    echo "$output" | grep "^key: .* (was $before)"
+    echo "$output" | grep "^layer: .* (was "
+    [ -z "$(echo "$output" | grep "^import .*was")" ]
+
+    stacker build
+    stacker cache key test
+    [ "$(echo "$output" | grep "^key: " | cut -f2 -d" ")" != "$before" ]
+    [ -z "$(echo "$output" | grep "was")" ]
+
+    bad_stacker cache key nope
+    echo "$output" | grep "no layer nope"
+}
+
+@test "run_steps reuse the results of unchanged steps" {
+    require_storage btrfs
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run_steps:
+        - name: first
+          run: date +%s%N > /first
+        - name: second
+          run: echo one > /second
+EOF
+    stacker build
+    umoci unpack --image oci:test dest
+    first="$(cat dest/rootfs/first)"
+    rm -rf dest
+
+    sed -i 's/echo one/echo two/' stacker.yaml
+    stacker build
+    echo "$output" | grep "using cached result of run steps up to first"
+    umoci unpack --image oci:test dest
+    [ "$(cat dest/rootfs/first)" == "$first" ]
+    [ "$(cat dest/rootfs/second)" == "two" ]
+}
+
+@test "cache directories persist and aren't in the layer" {
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    cache:
+        - /var/cache/thing
+    run: |
+        ls /var/cache/thing > /before
+        touch /var/cache/thing/\$(date +%s%N)
+EOF
+    stacker build
+    [ "$(ls .stacker/run-caches/test/var_cache_thing | wc -l)" == "1" ]
+
+    # change the layer so that it's rebuilt
+    echo "        true" >> stacker.yaml
+    stacker build
+    [ "$(ls .stacker/run-caches/test/var_cache_thing | wc -l)" == "2" ]
+
+    umoci unpack --image oci:test dest
+    [ "$(cat dest/rootfs/before | wc -l)" == "1" ]
+    [ "$(ls dest/rootfs/var/cache/thing | wc -l)" == "0" ]
+}
+
+@test "build_caches set up the cache and its environment" {
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    build_caches:
+        - go
+    run: |
+        [ "\$GOCACHE" = /var/cache/stacker/go-build ]
+        touch "\$GOCACHE/cached"
+EOF
+    stacker build
+    [ -f .stacker/run-caches/test/var_cache_stacker_go-build/cached ]
+    umoci unpack --image oci:test dest
+    [ ! -f dest/rootfs/var/cache/stacker/go-build/cached ]
+}
+
+@test "cancelled builds roll back the layer they were building" {
+    require_privilege priv
+    mkdir ctl
+    cat > stacker.yaml <<EOF
+parent:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: echo parent > /parent
+child:
+    from:
+        type: built
+        tag: parent
+    binds:
+        - $(realpath ctl) -> /ctl
+    run: |
+        echo half > /half
+        touch /ctl/started
+        while [ ! -f /ctl/go ]; do sleep 1; done
+EOF
+    "${ROOT_DIR}/stacker" --storage-type=$STORAGE_TYPE --debug build > build.log 2>&1 &
+    pid=$!
+    for i in $(seq 60); do
+        [ -f ctl/started ] && break
+        sleep 1
+    done
+    [ -f ctl/started ]
+
+    kill -TERM $pid
+    status=0
+    wait $pid || status=$?
+    cat build.log
+    [ "$status" -eq 130 ]
+    grep "build cancelled, rolling back child" build.log
+    [ ! -d roots/child ]
+
+    touch ctl/go
+    stacker build
+    echo "$output" | grep "found cached layer parent"
+    [ "$(stacker cat child:/half | tail -n1)" = "half" ]
+}
+
+@test "mtree_keywords leaves out changes to the other keywords" {
+    require_storage btrfs
+    cat > stacker.yaml <<EOF
+base:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        echo hello > /hello
+test:
+    from:
+        type: built
+        tag: base
+    run: |
+        chmod 0600 /hello
+EOF
+    echo "mtree_keywords: [type, size, sha256digest]" > config.yaml
+    stacker --config=config.yaml build
+    # the chmod isn't a change, so test has no layer of its own
+    base_layers=$(cat oci/blobs/sha256/$(jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "base") | .digest' oci/index.json | cut -f2 -d:) | jq '.layers | length')
+    test_layers=$(cat oci/blobs/sha256/$(jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "test") | .digest' oci/index.json | cut -f2 -d:) | jq '.layers | length')
+    [ "$base_layers" = "$test_layers" ]
+
+    echo "mtree_keywords: [type, atime]" > config.yaml
+    bad_stacker --config=config.yaml build --no-cache
+    echo "$output" | grep "unsupported mtree keyword atime"
+}
+
+@test "--invalidate rebuilds only the layers it names and what's built on them" {
+    cat > stacker.yaml <<EOF
+base:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    # the same every time, and with no manifests whose digests could
+    # change, so only its epoch says that child needs rebuilding
+    run: echo base > /base
+    build_only: true
+child:
+    from:
+        type: built
+        tag: base
+    run: date +%s%N > /child
+other:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: date +%s%N > /other
+EOF
+    stacker build
+    digests() {
+        for tag in child other; do
+            cat oci/index.json | jq -r ".manifests[] | select(.annotations.\"org.opencontainers.image.ref.name\" == \"$tag\") | .digest"
+        done
+    }
+    digests > before
+
+    bad_stacker build --invalidate nonexistent
+    echo "$output" | grep "can't invalidate nonexistent, there's no such layer"
+
+    stacker build --invalidate base
+    echo "$output" | grep "cache miss because base was invalidated"
+    echo "$output" | grep "cache miss because base layer was changed"
+    digests > after
+    [ "$(sed -n 1p before)" != "$(sed -n 1p after)" ]
+    [ "$(sed -n 2p before)" = "$(sed -n 2p after)" ]
+
+    # and afterwards, they're cached again
+    stacker build
+    digests > again
+    cmp after again
+}
@@ -20,3 +20,32 @@ EOF
     stacker build
     echo "[ -f /test ]" | stacker chroot
 }
+
+@test "exec attaches to a build in progress" {
+    cat > stacker.yaml <<EOF
+thing:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    build_env:
+        FOO: bar
+    run: |
+        touch /started
+        while [ ! -f /done ]; do sleep 1; done
+EOF
+    stacker build &
+
+    for i in $(seq 60); do
+        run_stacker exec thing -- test -f /started
+        [ "$status" -eq 0 ] && break
+        sleep 1
+    done
+    [ "$status" -eq 0 ]
+
+    stacker exec thing -- sh -c 'echo $FOO > /done'
+    wait
+
+    umoci unpack --image oci:thing dest
+    [ "$(cat dest/rootfs/done)" = "bar" ]
+    rm -rf dest
+}
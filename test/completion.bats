@@ -0,0 +1,40 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "completion scripts are generated" {
+    stacker completion bash
+    echo "$output" | grep -q "complete -o bashdefault"
+    stacker completion zsh
+    echo "$output" | grep -q "compdef _stacker_complete stacker"
+    stacker completion fish
+    echo "$output" | grep -q "complete -c stacker"
+    bad_stacker completion tcsh
+}
+
+@test "completion knows about layer names" {
+    cat > stacker.yaml <<EOF
+first:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+second:
+    from:
+        type: built
+        tag: first
+EOF
+    stacker chroot --generate-bash-completion
+    [ "${lines[0]}" = "first" ]
+    [ "${lines[1]}" = "second" ]
+}
+
+@test "mistyped commands get a suggestion" {
+    bad_stacker biuld
+    echo "$output" | grep -q "did you mean: build"
+}
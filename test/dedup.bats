@@ -0,0 +1,33 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "dedup shares identical files" {
+    require_storage btrfs
+    require_privilege priv
+
+    cat > stacker.yaml <<EOF
+one:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: dd if=/dev/urandom of=/random bs=1M count=4
+two:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: dd if=/dev/zero of=/zero bs=1M count=4
+EOF
+    stacker build
+    stacker dedup
+    echo "$output" | grep "deduplicated"
+    stacker build
+    echo "$output" | grep "found cached layer one"
+    echo "$output" | grep "found cached layer two"
+}
@@ -90,3 +90,71 @@ atomix-installer-iso:
 EOF
     stacker build
 }
+
+@test "--keep-going builds the layers that don't depend on failed ones" {
+    cat > stacker.yaml <<EOF
+broken:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: "false"
+child:
+    from:
+        type: built
+        tag: broken
+    run: touch /child
+unrelated:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: touch /unrelated
+EOF
+    bad_stacker build
+    [ "$status" -eq 1 ]
+    [ -z "$(umoci ls --layout oci | grep unrelated)" ]
+
+    bad_stacker build --keep-going --output-json out.json
+    [ "$status" -eq 1 ]
+    echo "$output" | grep "skipping child, since broken failed"
+    echo "$output" | grep "2 of 3 layers weren't built"
+    umoci ls --layout oci | grep unrelated
+    [ -z "$(umoci ls --layout oci | grep child)" ]
+    [ "$(jq -r '.failed_layers[0].name' out.json)" = "broken" ]
+    [ "$(jq -r '.failed_layers[1].skipped_for' out.json)" = "broken" ]
+}
+
+@test "stacker graph shows what the next build rebuilds" {
+    cat > stacker.yaml <<EOF
+base:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: touch /base
+child:
+    from:
+        type: built
+        tag: base
+    run: touch /child
+other:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    import:
+        - stacker://base/base
+    run: cp /stacker/base /other
+EOF
+    stacker graph
+    echo "$output" | grep '"base" -> "child";'
+    echo "$output" | grep '"base" -> "other" \[style=dashed, label=import\];'
+    echo "$output" | grep '"child" \[fillcolor="#d9d9d9", tooltip="new"\];'
+
+    stacker build
+    stacker graph
+    echo "$output" | grep '"child" \[fillcolor="#b7e1a1", tooltip="cached"\];'
+
+    sed -i 's|touch /base|touch /base2|' stacker.yaml
+    stacker graph --format mermaid
+    echo "$output" | grep '^graph TD'
+    echo "$output" | grep 'class n0 changed'
+    echo "$output" | grep 'class n1,n2 affected'
+}
@@ -31,3 +31,27 @@ EOF
     umoci unpack --image oci:layer1 dest
     [ ! -f dest/rootfs/favicon.ico ]
 }
+
+@test "docker bases are prefetched in parallel" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: ls /etc/centos-release
+ubuntu:
+    from:
+        type: docker
+        url: docker://ubuntu:latest
+    run: ls /etc/lsb-release
+EOF
+    stacker build --jobs 2
+    echo "$output" | grep "prefetching 2 base images, 2 at a time"
+    # the staging layouts are cleaned up
+    [ -z "$(ls -d .stacker/layer-bases/prefetch-* 2>/dev/null)" ]
+    umoci ls --layout .stacker/layer-bases/oci | grep centos
+    umoci ls --layout .stacker/layer-bases/oci | grep ubuntu
+
+    stacker build --jobs 1 --no-cache
+    ! echo "$output" | grep "prefetching"
+}
@@ -0,0 +1,27 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "doctor passes in the test environment" {
+    stacker doctor
+    echo "$output" | grep "\[ OK \] mksquashfs (.*compressors: .*)"
+    echo "$output" | grep "\[ OK \] unsquashfs"
+    [ -z "$(echo "$output" | grep FAIL)" ]
+}
+
+@test "doctor reports missing squashfs tools" {
+    # sudo wouldn't be found either
+    require_privilege priv
+
+    mkdir bin
+    PATH="$(pwd)/bin" bad_stacker doctor
+    echo "$output" | grep "\[FAIL\] mksquashfs: mksquashfs: not found in \$PATH"
+    echo "$output" | grep "install squashfs-tools"
+    echo "$output" | grep "checks failed"
+}
@@ -27,6 +27,7 @@ layer2:
     full_command: baz
 EOF
     stacker build
+    echo "$output" | grep -F 'WARNING: layer1: entrypoint is set, but cmd ["foo"] is inherited from the base image'
 
     manifest=$(cat oci/index.json | jq -r .manifests[0].digest | cut -f2 -d:)
     config=$(cat oci/blobs/sha256/$manifest | jq -r .config.digest | cut -f2 -d:)
@@ -41,3 +42,47 @@ EOF
     [ "$(cat oci/blobs/sha256/$config | jq -r '.config.Cmd')" = "null" ]
     [ "$(cat oci/blobs/sha256/$config | jq -r '.config.Entrypoint | join("")')" = "baz" ]
 }
+
+@test "command_merge" {
+    cat > stacker.yaml <<EOF
+base:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    entrypoint: /bin/sh -c
+    cmd: foo
+replaced:
+    from:
+        type: built
+        tag: base
+    entrypoint: bar
+    command_merge: replace
+appended:
+    from:
+        type: built
+        tag: base
+    cmd: --verbose
+    command_merge: append
+EOF
+    stacker build
+    ! echo "$output" | grep "WARNING: replaced"
+
+    for tag in base:"/bin/sh -c:foo" replaced:"bar:" appended:"/bin/sh -c:foo --verbose"; do
+        name="${tag%%:*}"
+        expected="${tag#*:}"
+        manifest=$(cat oci/index.json | jq -r ".manifests[] | select(.annotations.\"org.opencontainers.image.ref.name\" == \"$name\") | .digest" | cut -f2 -d:)
+        config=$(cat oci/blobs/sha256/$manifest | jq -r .config.digest | cut -f2 -d:)
+        [ "$(cat oci/blobs/sha256/$config | jq -r '.config.Entrypoint // [] | join(" ")')" = "${expected%%:*}" ]
+        [ "$(cat oci/blobs/sha256/$config | jq -r '.config.Cmd // [] | join(" ")')" = "${expected#*:}" ]
+    done
+
+    cat > stacker.yaml <<EOF
+bad:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    command_merge: prepend
+EOF
+    bad_stacker build
+    echo "$output" | grep "unknown command_merge prepend"
+}
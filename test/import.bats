@@ -73,6 +73,69 @@ EOF
     stacker build
 }
 
+@test "layers' outputs can be imported by name" {
+    cat > stacker.yaml <<EOF
+builder:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    build_only: true
+    run: |
+        mkdir -p /src/build/docs
+        echo app > /src/build/app
+        touch /src/build/docs/README
+    outputs:
+        app: /src/build/app
+        docs: /src/build/docs
+runtime:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    import:
+        - stacker-output://builder/app
+        - stacker-output://builder/docs
+    run: |
+        [ -f /stacker/docs/README ]
+        cp /stacker/app /app
+EOF
+    stacker build
+    [ "$(cat .stacker/outputs/builder/app)" = "app" ]
+    umoci unpack --image oci:runtime dest
+    [ "$(cat dest/rootfs/app)" = "app" ]
+
+    # changing an output rebuilds the layers that import it
+    sed -i 's/echo app /echo app2 /' stacker.yaml
+    stacker build
+    echo "$output" | grep "cache miss because import content changed: stacker-output://builder/app"
+    rm -rf dest
+    umoci unpack --image oci:runtime dest
+    [ "$(cat dest/rootfs/app)" = "app2" ]
+
+    # outputs have to be declared
+    sed -i 's|stacker-output://builder/docs|stacker-output://builder/nope|' stacker.yaml
+    bad_stacker build
+    echo "$output" | grep "layer builder has no output nope"
+}
+
+@test "outputs' symlinks are followed inside the layer" {
+    cat > stacker.yaml <<EOF
+builder:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    build_only: true
+    run: |
+        mkdir -p /stacker-link-target
+        echo inside > /stacker-link-target/file
+        ln -s /stacker-link-target /link
+    outputs:
+        file: /link/file
+EOF
+    stacker build
+    [ "$(cat .stacker/outputs/builder/file)" = "inside" ]
+    [ ! -e /stacker-link-target ]
+}
+
 @test "different import types" {
     touch test_file
     test_file_sha=$(sha test_file) || { stderr "failed sha $test_file"; return 1; }
@@ -122,6 +185,35 @@ EOF
     echo $output | grep "is different than the actual hash"
 }
 
+@test "import mirrors are tried in order" {
+    mkdir -p stale good
+    echo stale > stale/thing
+    echo good > good/thing-1.0
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    import:
+        - path: missing/thing
+          hash: $(sha256sum good/thing-1.0 | cut -f1 -d" ")
+          mirrors:
+            - stale/thing
+            - good/thing-1.0
+    run: |
+        [ "\$(cat /stacker/thing)" = "good" ]
+        [ ! -e /stacker/thing-1.0 ]
+EOF
+
+    stacker build
+    echo "$output" | grep "WARNING: couldn't import thing from .*missing/thing"
+    echo "$output" | grep "WARNING: couldn't import thing from .*stale/thing"
+
+    rm good/thing-1.0
+    bad_stacker build
+    echo "$output" | grep "couldn't import .*missing/thing from any of its urls"
+}
+
 @test "invalid hash should fail" {
     cat > stacker.yaml <<EOF
 centos:
@@ -203,3 +295,170 @@ EOF
 
     stacker build
 }
+
+@test "importing stacker-oci:// from a previous build's image" {
+    cat > toolchain.yaml <<EOF
+toolchain:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        echo "echo hello from the toolchain" > /usr/bin/mytool
+        chmod 755 /usr/bin/mytool
+        rm /etc/os-release
+EOF
+    stacker build -f toolchain.yaml
+
+    cat > stacker.yaml <<EOF
+app:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    import:
+        - stacker-oci://toolchain/usr/bin/mytool
+    run: |
+        [ "\$(/stacker/mytool)" = "hello from the toolchain" ]
+EOF
+    stacker build
+
+    # files deleted in the image can't be imported
+    cat > stacker.yaml <<EOF
+app:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    import:
+        - stacker-oci://toolchain/etc/os-release
+EOF
+    bad_stacker build
+    echo "$output" | grep "not found in toolchain"
+    rm toolchain.yaml
+}
+
+@test "grab reads files straight out of images" {
+    cat > stacker.yaml <<EOF
+parent:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        echo parent > /parent
+        echo deleted > /deleted
+child:
+    from:
+        type: built
+        tag: parent
+    run: |
+        echo child > /child
+        rm /deleted
+EOF
+    stacker build --layer-type tar --layer-type squashfs
+
+    for tag in child child-squashfs; do
+        stacker --debug=storage grab $tag:/child
+        [ "$(cat child)" = "child" ]
+        stacker grab $tag:/parent
+        [ "$(cat parent)" = "parent" ]
+        bad_stacker grab $tag:/deleted
+        echo "$output" | grep "not found in $tag"
+        rm child parent
+    done
+
+    # the squashfs image isn't extracted, just read
+    stacker --debug=storage grab child-squashfs:/child
+    echo "$output" | grep "unsquashfs -lln"
+}
+
+@test "cat and stat read files straight out of images" {
+    cat > stacker.yaml <<EOF
+parent:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        echo parent > /parent
+        echo deleted > /deleted
+        chown 1000:100 /parent
+        chmod 0640 /parent
+child:
+    from:
+        type: built
+        tag: parent
+    run: |
+        echo child > /child
+        ln -s /parent /link
+        rm /deleted
+EOF
+    stacker build --layer-type tar --layer-type squashfs
+
+    for tag in child child-squashfs; do
+        stacker cat $tag:/child
+        [ "$output" = "child" ]
+        stacker cat $tag:/parent
+        [ "$output" = "parent" ]
+        bad_stacker cat $tag:/deleted
+        echo "$output" | grep "not found in $tag"
+        bad_stacker stat $tag:/deleted
+
+        stacker stat $tag:/parent
+        echo "$output" | grep "^mode: -rw-r----- (0640)$"
+        echo "$output" | grep "^owner: 1000:100$"
+        echo "$output" | grep "^size: 7$"
+
+        stacker stat $tag:/link
+        echo "$output" | grep "^link: /parent$"
+
+        stacker stat $tag:/etc
+        echo "$output" | grep "^mode: drwxr-xr-x"
+    done
+
+    # /child is in the topmost layer
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "child") | .digest' | cut -f2 -d:)
+    top=$(cat oci/blobs/sha256/$manifest | jq -r '.layers[-1].digest')
+    stacker stat child:/child
+    echo "$output" | grep "^layer: $top$"
+}
+
+@test "ls-tree lists files and the layers they came from" {
+    cat > stacker.yaml <<EOF
+parent:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        mkdir /stuff
+        echo parent > /stuff/parent
+        echo deleted > /stuff/deleted
+child:
+    from:
+        type: built
+        tag: parent
+    run: |
+        echo child > /stuff/child
+        ln -s parent /stuff/link
+        rm /stuff/deleted
+EOF
+    stacker build --layer-type tar --layer-type squashfs
+
+    for tag in child child-squashfs; do
+        manifest=$(cat oci/index.json | jq -r ".manifests[] | select(.annotations.\"org.opencontainers.image.ref.name\" == \"$tag\") | .digest" | cut -f2 -d:)
+        top=$(cat oci/blobs/sha256/$manifest | jq -r '.layers[-1].digest' | cut -f2 -d: | cut -c1-12)
+        parent=$(cat oci/blobs/sha256/$manifest | jq -r '.layers[-2].digest' | cut -f2 -d: | cut -c1-12)
+
+        stacker ls-tree $tag /stuff
+        echo "$output"
+        echo "$output" | grep "^-rw-r--r-- 0/0 *6 $top /stuff/child$"
+        echo "$output" | grep "^-rw-r--r-- 0/0 *7 $parent /stuff/parent$"
+        echo "$output" | grep " $top /stuff/link -> parent$"
+
+        stacker ls-tree $tag
+        echo "$output" | grep " /etc/os-release$"
+
+        bad_stacker ls-tree $tag /nope
+    done
+
+    # unprivileged squashfs layers have xattr whiteouts, which aren't listed
+    stacker ls-tree child /stuff
+    [ "$(echo "$output" | wc -l)" = "4" ]
+    ! echo "$output" | grep deleted
+}
@@ -0,0 +1,54 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "inherit_config runs steps with the base image's config" {
+    cat > stacker.yaml <<EOF
+base:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    environment:
+        FOO: base
+    working_dir: /work
+    runtime_user: nobody
+    run: mkdir -p /out && chmod 777 /out
+child:
+    from:
+        type: built
+        tag: base
+    inherit_config: true
+    run: echo "\$FOO \$(pwd) \$(id -un)" > /out/inherited
+override:
+    from:
+        type: built
+        tag: base
+    inherit_config: true
+    build_env:
+        FOO: override
+    working_dir: /elsewhere
+    runtime_user: root
+    run: echo "\$FOO \$(pwd) \$(id -un)" > /out/overridden
+plain:
+    from:
+        type: built
+        tag: base
+    run: echo "\$FOO \$(pwd) \$(id -un)" > /out/plain
+EOF
+    stacker build
+    umoci unpack --image oci:child dest
+    [ "$(cat dest/rootfs/out/inherited)" = "base /work nobody" ]
+    rm -rf dest
+    umoci unpack --image oci:override dest
+    [ "$(cat dest/rootfs/out/overridden)" = "override /elsewhere root" ]
+    rm -rf dest
+    umoci unpack --image oci:plain dest
+    [ "$(cat dest/rootfs/out/plain)" = " / root" ]
+    rm -rf dest
+}
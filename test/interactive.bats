@@ -0,0 +1,43 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "interactive steps get stdin and a terminal" {
+    cat > stacker.yaml <<EOF
+thing:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run_steps:
+        - name: batch
+          run: "[ ! -t 0 ]"
+        - name: ask
+          run: |
+              [ -t 0 ]
+              read answer
+              echo "\$answer" > /answer
+          interactive: true
+EOF
+    echo yes | stacker build
+    umoci unpack --image oci:thing dest
+    [ "$(cat dest/rootfs/answer)" = "yes" ]
+    rm -rf dest
+}
+
+@test "--interactive makes all steps interactive" {
+    cat > stacker.yaml <<EOF
+thing:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: "[ -t 0 ]"
+EOF
+    bad_stacker build
+    stacker build --interactive < /dev/null
+}
@@ -47,3 +47,12 @@ layer2:
 EOF
     bad_stacker build -f stacker2.yaml
 }
+
+@test "malformed yaml is a user error" {
+    cat > stacker.yaml <<EOF2
+foo:
+    from: [
+EOF2
+    bad_stacker build
+    [ "$status" -eq 65 ]
+}
@@ -6,7 +6,7 @@ function setup() {
 
 function teardown() {
     cleanup
-    rm logfile || true
+    rm logfile cpu.out mem.out trace.out || true
 }
 
 @test "log --debug works" {
@@ -24,6 +24,32 @@ function teardown() {
     [ -z "$(echo "$output" | grep "stacker version")" ]
 }
 
+@test "--debug=subsystem only shows that subsystem's debug logs" {
+    require_privilege priv
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: ls
+EOF
+
+    run "${ROOT_DIR}/stacker" --storage-type=$STORAGE_TYPE --debug=container build
+    echo "$output"
+    [ "$status" -eq 0 ]
+    echo "$output" | grep "container: lxc config for test"
+    echo "$output" | grep "lxc.execute.cmd"
+    [ -z "$(echo "$output" | grep "stacker version")" ]
+    [ -z "$(echo "$output" | grep "oci: copying")" ]
+}
+
+@test "unknown --debug subsystems fail" {
+    run "${ROOT_DIR}/stacker" --debug=nope build --help
+    echo "$output"
+    [ "$status" -ne 0 ]
+    echo "$output" | grep "unknown debug subsystem nope"
+}
+
 @test "--log-file works" {
     stacker --log-file=logfile build --help
     grep "stacker version" logfile
@@ -52,3 +78,18 @@ EOF
     stacker build
     [ -z "$(echo "$output" | grep "Copying blob")" ]
 }
+
+@test "profiling flags work" {
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: ls
+EOF
+
+    stacker --cpuprofile=cpu.out --memprofile=mem.out --trace=trace.out build
+    [ -s cpu.out ]
+    [ -s mem.out ]
+    [ -s trace.out ]
+}
@@ -235,3 +235,83 @@ EOF
     [ -f lastlayer/2 ]
     [ -f lastlayer/3 ]
 }
+
+@test "per-layer layer_type works" {
+    require_storage overlay
+
+    cat > stacker.yaml <<EOF
+parent:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    layer_type:
+        - tar
+        - squashfs
+    run: |
+        echo meshuggah > /rocks
+child:
+    from:
+        type: built
+        tag: parent
+    layer_type: squashfs
+    run: |
+        echo primus > /sucks
+EOF
+    stacker build
+    [ "$(jq -r '.manifests[].annotations["org.opencontainers.image.ref.name"]' oci/index.json | sort | tr '\n' ' ')" == "child-squashfs parent parent-squashfs " ]
+
+    stacker build
+    echo $output | grep "found cached layer parent-squashfs"
+    echo $output | grep "found cached layer child-squashfs"
+}
+
+@test "per-layer layer_type converts its base" {
+    require_storage overlay
+
+    cat > stacker.yaml <<EOF
+parent:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        echo meshuggah > /rocks
+child:
+    from:
+        type: built
+        tag: parent
+    layer_type: squashfs
+    run: |
+        echo primus > /sucks
+EOF
+    stacker build
+    echo $output | grep "converting its base parent"
+
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "child-squashfs") | .digest' | cut -f2 -d:)
+    layer=$(cat oci/blobs/sha256/$manifest | jq -r .layers[-2].digest | cut -f2 -d:)
+    mkdir layer
+    mount -t squashfs oci/blobs/sha256/$layer layer
+    [ "$(cat layer/rocks)" == "meshuggah" ]
+}
+
+@test "squashfs layers from a tar base are flattened (btrfs)" {
+    require_storage btrfs
+
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        echo meshuggah > /rocks
+EOF
+    stacker build --layer-type squashfs
+    echo $output | grep "will be flattened into test"
+
+    manifest=$(cat oci/index.json | jq -r .manifests[0].digest | cut -f2 -d:)
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r '.layers | length')" == "1" ]
+    layer=$(cat oci/blobs/sha256/$manifest | jq -r .layers[0].digest | cut -f2 -d:)
+    mkdir layer
+    mount -t squashfs oci/blobs/sha256/$layer layer
+    [ "$(cat layer/rocks)" == "meshuggah" ]
+    [ -f layer/bin/sh ]
+}
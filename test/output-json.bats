@@ -0,0 +1,66 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "--output-json records build results" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: touch /foo
+EOF
+    stacker build --output-json out.json
+    [ "$(jq -r '.layers[0].name' out.json)" = "centos" ]
+    [ "$(jq -r '.layers[0].cache_hit' out.json)" = "false" ]
+    [ "$(jq -r '.layers[0].outputs[0].manifest_digest' out.json)" = "$(jq -r .manifests[0].digest oci/index.json)" ]
+
+    stacker build --output-json out.json
+    [ "$(jq -r '.layers[0].cache_hit' out.json)" = "true" ]
+}
+
+@test "--output-json records the failed layer" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: touch /foo
+broken:
+    from:
+        type: built
+        tag: centos
+    run: false
+EOF
+    bad_stacker build --output-json out.json
+    [ "$(jq -r '.failed_layer.name' out.json)" = "broken" ]
+    [ "$(jq -r '.failed_layer.line' out.json)" = "6" ]
+}
+
+@test "--ci-annotations github emits workflow commands" {
+    cat > stacker.yaml <<EOF
+centos:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: touch /foo
+broken:
+    from:
+        type: built
+        tag: centos
+    run: false
+EOF
+    bad_stacker build --ci-annotations github
+    echo "$output" | grep "^::error file=stacker.yaml,line=6,title=stacker build of broken failed::"
+    echo "$output" | grep "^::notice title=stacker cache::0 of 1 layers came from the cache"
+    echo "$output" | grep "^::notice title=built centos::centos sha256:"
+
+    bad_stacker build --ci-annotations gitlab
+    echo "$output" | grep "unknown --ci-annotations gitlab"
+}
@@ -0,0 +1,194 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+    rm -rf hook.sh hook.env os.img os.qcow2 initrd.cpio.gz initrd rootfs.tar.zst rootfs.tgz app-lxd || true
+}
+
+@test "disk outputs" {
+    cat > hook.sh <<EOF
+#!/bin/sh
+env | grep ^STACKER_ > $(pwd)/hook.env
+EOF
+    chmod +x hook.sh
+    cat > stacker.yaml <<EOF
+os:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        echo hello > /hello
+    output:
+        type: disk
+        size: 512MiB
+        hooks:
+            - hook.sh
+EOF
+    stacker build
+    [ -f os.img ]
+    [ "$(stat -c %s os.img)" = "$((512*1024*1024))" ]
+    sfdisk -d os.img | grep "start=        2048"
+    sfdisk -d os.img | grep bootable
+    debugfs -R "cat /hello" "os.img?offset=1048576" | grep hello
+
+    grep "STACKER_LAYER_NAME=os" hook.env
+    grep "STACKER_PARTITION_OFFSET=1048576" hook.env
+    grep "STACKER_DISK=" hook.env
+
+    # a cached layer doesn't rewrite its output, but does write a missing one
+    stacker build
+    echo "$output" | grep "found cached layer os"
+    [ -z "$(echo "$output" | grep "wrote disk output")" ]
+    rm os.img
+    stacker build
+    [ -f os.img ]
+}
+
+@test "qcow2 disk outputs" {
+    cat > stacker.yaml <<EOF
+os:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    build_only: true
+    output:
+        type: disk
+        format: qcow2
+EOF
+    stacker build
+    [ "$(qemu-img info --output=json os.qcow2 | jq -r .format)" = "qcow2" ]
+}
+
+@test "bad disk outputs" {
+    cat > stacker.yaml <<EOF
+os:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    output:
+        type: disk
+        filesystem: btrfs
+EOF
+    bad_stacker build
+    echo "$output" | grep "unsupported disk filesystem btrfs"
+}
+
+@test "cpio outputs" {
+    cat > stacker.yaml <<EOF
+initrd:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        printf '#!/bin/sh\\nexec /bin/sh\\n' > /init
+        chmod +x /init
+    output:
+        type: cpio
+        compression: gzip
+initrd-artifact:
+    from:
+        type: built
+        tag: initrd
+    output:
+        type: cpio
+        compression: zstd
+        artifact: true
+EOF
+    stacker build
+    mkdir initrd
+    (cd initrd && zcat ../initrd.cpio.gz | cpio -idm)
+    [ -x initrd/init ]
+    [ -f initrd/etc/os-release ]
+
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "initrd-artifact") | .digest' | cut -f2 -d:)
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r .layers[0].mediaType)" = "application/x-cpio+zstd" ]
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r '.layers[0].annotations."org.opencontainers.image.title"')" = "initrd-artifact.cpio.zst" ]
+    blob=$(cat oci/blobs/sha256/$manifest | jq -r .layers[0].digest | cut -f2 -d:)
+    zstd -dc oci/blobs/sha256/$blob | cpio -it | grep "^init$"
+}
+
+@test "casync outputs" {
+    command -v desync || skip "desync isn't installed"
+    cat > stacker.yaml <<EOF
+os:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        echo os > /os.conf
+    output:
+        type: casync
+        chunk_size: 32KiB
+os-artifact:
+    from:
+        type: built
+        tag: os
+    output:
+        type: casync
+        store: chunks
+        artifact: true
+EOF
+    stacker build
+    [ -f os.caidx ]
+    [ -n "$(find os.castr -name '*.cacnk')" ]
+    desync untar --index --store os.castr os.caidx os
+    [ "$(cat os/os.conf)" = "os" ]
+
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "os-artifact") | .digest' | cut -f2 -d:)
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r .layers[0].mediaType)" = "application/x-caidx" ]
+    blob=$(cat oci/blobs/sha256/$manifest | jq -r .layers[0].digest | cut -f2 -d:)
+    desync untar --index --store chunks oci/blobs/sha256/$blob os-artifact
+    [ "$(cat os-artifact/os.conf)" = "os" ]
+}
+
+@test "export-rootfs" {
+    cat > stacker.yaml <<EOF
+app:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        echo app > /app.conf
+        rm /etc/os-release
+EOF
+    stacker build
+    stacker export-rootfs app -o rootfs.tar.zst
+    zstd -dc rootfs.tar.zst | tar -t | grep "^app.conf$"
+    [ -z "$(zstd -dc rootfs.tar.zst | tar -t | grep "os-release$")" ]
+    [ -z "$(zstd -dc rootfs.tar.zst | tar -t | grep ".wh.")" ]
+
+    stacker export-rootfs app -o rootfs.tgz
+    [ "$(tar -xzOf rootfs.tgz app.conf)" = "app" ]
+
+    stacker export-rootfs --compression none app -o -
+    echo "$output" | grep -a "app.conf"
+
+    bad_stacker export-rootfs app
+    echo "$output" | grep "no --output to export app to"
+}
+
+@test "export-lxd" {
+    cat > stacker.yaml <<EOF
+app:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        echo app > /app.conf
+EOF
+    stacker build
+    stacker export-lxd app
+    tar -xzOf app-lxd/metadata.tar.gz metadata.yaml | grep "os: centos"
+    tar -xzOf app-lxd/metadata.tar.gz metadata.yaml | grep "name: app"
+    unsquashfs -l app-lxd/rootfs.squashfs | grep "squashfs-root/app.conf"
+
+    if which lxc >/dev/null 2>&1 && lxc info >/dev/null 2>&1; then
+        stacker export-lxd app --import stacker-test-app
+        lxc image info stacker-test-app
+        lxc image delete stacker-test-app
+    fi
+}
@@ -0,0 +1,119 @@
+load helpers
+
+function setup() {
+    stacker_setup
+    command -v opa || skip "opa isn't installed"
+    mkdir -p policy
+    cat > policy/stacker.rego <<"EOF"
+package stacker
+
+deny[msg] {
+    input.kind == "stackerfile"
+    layer := input.stackerfile[name]
+    count(layer.binds) > 0
+    msg := sprintf("%s has host binds", [name])
+}
+
+deny[msg] {
+    input.kind == "image"
+    input.config.config.Labels.forbidden
+    msg := sprintf("%s has the forbidden label", [input.name])
+}
+
+deny[msg] {
+    input.kind == "image"
+    input.manifest.config.mediaType == "application/vnd.example.forbidden.v1+json"
+    msg := sprintf("%s is a forbidden artifact", [input.name])
+}
+EOF
+    cat > config.yaml <<EOF
+policy_bundle: $(pwd)/policy
+EOF
+}
+
+function teardown() {
+    cleanup
+    rm -rf policy config.yaml || true
+}
+
+@test "stacker files that violate the policy aren't built" {
+    cat > stacker.yaml <<EOF
+thing:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    binds:
+        - /tmp -> /host-tmp
+EOF
+    bad_stacker --config=config.yaml build
+    echo "$output" | grep "violates the policy"
+    echo "$output" | grep "thing has host binds"
+    [ ! -d oci ]
+}
+
+@test "images that violate the policy fail the build" {
+    cat > stacker.yaml <<EOF
+allowed:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+thing:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    labels:
+        forbidden: "true"
+EOF
+    bad_stacker --config=config.yaml build
+    echo "$output" | grep "thing has the forbidden label"
+
+    # and cache hits are checked too
+    stacker build
+    bad_stacker --config=config.yaml build
+    echo "$output" | grep "thing has the forbidden label"
+}
+
+@test "images that violate the policy aren't published" {
+    cat > stacker.yaml <<EOF
+thing:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    labels:
+        forbidden: "true"
+EOF
+    # built before there was a policy
+    stacker build
+    bad_stacker --config=config.yaml publish --url oci:oci_publish --tag test1
+    echo "$output" | grep "thing has the forbidden label"
+    [ -z "$(umoci ls --layout oci_publish 2>/dev/null | grep thing_test1)" ]
+
+    stacker publish --url oci:oci_publish --tag test1
+    [ "$(umoci ls --layout oci_publish | grep thing_test1)" = "thing_test1" ]
+}
+
+@test "artifacts are checked against the policy" {
+    cat > stacker.yaml <<EOF
+sbom:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    labels:
+        forbidden: "true"
+    run: echo '{"spdxVersion": "SPDX-2.2"}' > /sbom.json
+    artifact:
+        path: /sbom.json
+        artifact_type: application/vnd.example.sbom.v1+json
+EOF
+    # it's the artifact that's output, not the image with the label
+    stacker --config=config.yaml build
+    # and cached builds and publishes of it work too
+    stacker --config=config.yaml build
+    echo "$output" | grep "found cached layer sbom"
+    stacker --config=config.yaml publish --url oci:oci_publish --tag test1
+    [ "$(umoci ls --layout oci_publish | grep sbom_test1)" = "sbom_test1" ]
+
+    sed -i 's|application/vnd.example.sbom.v1+json|application/vnd.example.forbidden.v1+json|' stacker.yaml
+    bad_stacker --config=config.yaml build
+    echo "$output" | grep "sbom is a forbidden artifact"
+}
@@ -0,0 +1,104 @@
+load helpers
+
+function setup() {
+    stacker_setup
+}
+
+function teardown() {
+    cleanup
+}
+
+@test "prune deletes old matching images and their snapshots" {
+    cat > stacker.yaml <<EOF
+nightly-1:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: dd if=/dev/urandom of=/junk bs=1M count=10
+release:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: touch /release
+EOF
+    stacker build
+
+    stacker prune --match 'nightly-*' --older-than 720h
+    umoci ls --layout oci | grep nightly-1
+
+    stacker prune --match 'nightly-*' --dry-run
+    echo "$output" | grep "would delete nightly-1"
+    umoci ls --layout oci | grep nightly-1
+
+    stacker prune --match 'nightly-*'
+    echo "$output" | grep "deleting nightly-1"
+    echo "$output" | grep "reclaimed [1-9]"
+    ! umoci ls --layout oci | grep nightly-1
+    umoci ls --layout oci | grep release
+}
+
+@test "prune handles artifacts" {
+    cat > stacker.yaml <<EOF
+sbom:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: echo '{"spdxVersion": "SPDX-2.2"}' > /sbom.json
+    artifact:
+        path: /sbom.json
+release:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: touch /release
+EOF
+    stacker build
+
+    # the artifact keeps the image's creation time
+    stacker prune --match 'sbom' --older-than 720h
+    umoci ls --layout oci | grep sbom
+
+    stacker prune --match 'sbom'
+    echo "$output" | grep "deleting sbom"
+    ! umoci ls --layout oci | grep sbom
+    umoci ls --layout oci | grep release
+}
+
+@test "prune needs something to select images with" {
+    bad_stacker prune
+    echo "$output" | grep "refusing to prune everything"
+}
+
+@test "gc_after_build drops the old blobs of bases whose tags moved" {
+    cat > base.yaml <<EOF
+base:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: dd if=/dev/urandom of=/junk bs=1M count=10
+EOF
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $(pwd)/base-oci:base
+    run: ls /junk
+EOF
+    cat > config.yaml <<EOF
+gc_after_build: true
+EOF
+    stacker --oci-dir base-oci --stacker-dir base-stacker --roots-dir base-roots build -f base.yaml
+    stacker --config=config.yaml build
+    echo "$output" | grep "gc of the base images in .* reclaimed"
+    local blobs=$(ls .stacker/layer-bases/oci/blobs/sha256 | wc -l)
+
+    # the base's tag moves, and its old image is left behind without gc
+    stacker --oci-dir base-oci --stacker-dir base-stacker --roots-dir base-roots build -f base.yaml --no-cache
+    stacker build
+    [ "$(ls .stacker/layer-bases/oci/blobs/sha256 | wc -l)" -gt "$blobs" ]
+
+    stacker --oci-dir base-oci --stacker-dir base-stacker --roots-dir base-roots build -f base.yaml --no-cache
+    stacker --config=config.yaml build
+    echo "$output" | grep "gc of the base images in .* reclaimed [1-9]"
+    [ "$(ls .stacker/layer-bases/oci/blobs/sha256 | wc -l)" -eq "$blobs" ]
+}
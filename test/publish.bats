@@ -152,3 +152,70 @@ function teardown() {
     mount -t squashfs oci/blobs/sha256/$layer1 layer1
     [ -f layer1/root/ls_out ]
 }
+
+@test "publish skips unchanged tags" {
+    stacker build -f ocibuilds/sub4/stacker.yaml
+    stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag test1
+    echo "$output" | grep "pushed: oci:oci_publish:layer4_test1"
+
+    stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag test1 --output-json report.json
+    echo "$output" | grep "skipped: oci:oci_publish:layer4_test1"
+    [ "$(jq -r .published[0].skipped report.json)" == "true" ]
+
+    stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag test1 --always-push
+    echo "$output" | grep "pushed: oci:oci_publish:layer4_test1"
+    rm report.json
+}
+
+@test "publish --no-overwrite refuses to clobber tags" {
+    stacker build -f ocibuilds/sub4/stacker.yaml
+    stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag test1
+
+    # the same image is fine
+    stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag test1 --no-overwrite
+
+    # a different one isn't
+    sed -i 's|ls > /root/ls_out|ls -a > /root/ls_out|' ocibuilds/sub4/stacker.yaml
+    stacker build -f ocibuilds/sub4/stacker.yaml
+    bad_stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag test1 --no-overwrite
+    echo "$output" | grep "not overwriting"
+
+    stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag test1 --no-overwrite --force
+    echo "$output" | grep "pushed: oci:oci_publish:layer4_test1"
+}
+
+@test "prune-remote keeps the newest and semver tags" {
+    stacker build -f ocibuilds/sub4/stacker.yaml
+    for tag in 1.0.0 nightly-1 nightly-2; do
+        stacker build -f ocibuilds/sub4/stacker.yaml --no-cache
+        stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag $tag
+        sleep 1
+    done
+
+    stacker prune-remote -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --keep-last 1 --keep-semver --dry-run
+    echo "$output" | grep "would delete layer4 nightly-1"
+    umoci ls --layout oci_publish | grep layer4_nightly-1
+
+    stacker prune-remote -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --keep-last 1 --keep-semver
+    umoci ls --layout oci_publish
+    [ "$(umoci ls --layout oci_publish | sort | tr '\n' ' ')" == "layer4_1.0.0 layer4_nightly-2 " ]
+
+    bad_stacker prune-remote -f ocibuilds/sub4/stacker.yaml --url docker://docker-reg.fake.com/ --untagged-older-than 1
+}
+
+@test "bom verify checks published images against the stacker file" {
+    stacker build -f ocibuilds/sub4/stacker.yaml
+    stacker publish -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag test1
+    stacker bom verify -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag test1
+    echo "$output" | grep "\[ OK \] oci:oci_publish:layer4_test1"
+
+    # the published image isn't what this stacker file builds any more
+    sed -i 's|ls > /root/ls_out|ls -a > /root/ls_out|' ocibuilds/sub4/stacker.yaml
+    bad_stacker bom verify -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag test1
+    echo "$output" | grep "no build in the cache matches"
+
+    # and after rebuilding, it's a different image
+    stacker build -f ocibuilds/sub4/stacker.yaml
+    bad_stacker bom verify -f ocibuilds/sub4/stacker.yaml --url oci:oci_publish --tag test1
+    echo "$output" | grep "published digest doesn't match"
+}
@@ -9,7 +9,10 @@ function teardown() {
     rm -rf combined || true
     umount layer0 || true
     umount layer1 || true
-    rm -rf layer0 layer1 || true
+    umount layer || true
+    rm -rf layer0 layer1 layer || true
+    umount mnt || true
+    umount_under .stacker/mounts || true
     cleanup
 }
 
@@ -292,3 +295,203 @@ EOF
     cat layer1/message
     [ "$(cat layer1/message)" == "foo bar" ]
 }
+
+@test "convert-layers round trips squashfs layers" {
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        echo meshuggah > /rocks
+EOF
+    stacker build --layer-type squashfs
+    stacker convert-layers --to tar+zstd test-squashfs
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "test-squashfs-tar-zstd") | .digest' | cut -f2 -d:)
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r .layers[-1].mediaType)" == "application/vnd.oci.image.layer.v1.tar+zstd" ]
+
+    stacker convert-layers --to squashfs --tag roundtrip test-squashfs-tar-zstd
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "roundtrip") | .digest' | cut -f2 -d:)
+    layer=$(cat oci/blobs/sha256/$manifest | jq -r .layers[-1].digest | cut -f2 -d:)
+    mkdir layer
+    mount -t squashfs oci/blobs/sha256/$layer layer
+    [ "$(cat layer/rocks)" == "meshuggah" ]
+}
+
+@test "squashfs_verity layers can be verified" {
+    command -v veritysetup || skip "veritysetup isn't installed"
+    local tmpd=$(pwd)
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        echo meshuggah > /rocks
+EOF
+    cat > "$tmpd/config.yaml" <<EOF
+squashfs_verity: true
+EOF
+    stacker "--config=$tmpd/config.yaml" build --layer-type squashfs
+
+    manifest=$(cat oci/index.json | jq -r .manifests[0].digest | cut -f2 -d:)
+    [ "$(cat oci/blobs/sha256/$manifest | jq -r '.layers[] | .annotations["com.cisco.stacker.squashfs_verity_root_hash"]' | grep -c null)" -eq 0 ]
+    chain=$(cat oci/blobs/sha256/$manifest | jq -r '.annotations["com.cisco.stacker.squashfs_verity_chain"]')
+
+    stacker verity-info test-squashfs
+    echo "$output" > verity.env
+    . ./verity.env
+    [ "$STACKER_VERITY_CHAIN" = "$chain" ]
+    [ "$STACKER_VERITY_LAYERS" -gt 0 ]
+    for i in $(seq 0 $((STACKER_VERITY_LAYERS - 1))); do
+        eval digest=\$STACKER_VERITY_LAYER_${i}_DIGEST
+        eval root_hash=\$STACKER_VERITY_LAYER_${i}_ROOT_HASH
+        eval offset=\$STACKER_VERITY_LAYER_${i}_HASH_OFFSET
+        blob=oci/blobs/sha256/$(echo $digest | cut -f2 -d:)
+        veritysetup verify "$blob" "$blob" "$root_hash" "--hash-offset=$offset"
+    done
+
+    stacker verity-info --json test-squashfs
+    [ "$(echo "$output" | jq -r .chain)" = "$chain" ]
+
+    # the layers are still mountable squashfs images
+    layer=$(cat oci/blobs/sha256/$manifest | jq -r .layers[-1].digest | cut -f2 -d:)
+    mkdir layer
+    mount -t squashfs oci/blobs/sha256/$layer layer
+    [ "$(cat layer/rocks)" == "meshuggah" ]
+
+    # images without verity data don't have any
+    stacker build --layer-type squashfs --no-cache
+    bad_stacker verity-info test-squashfs
+}
+
+@test "stacker mount mounts squashfs images on the host" {
+    require_privilege priv
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        echo meshuggah > /rocks
+        rm /etc/os-release
+EOF
+    stacker build --layer-type squashfs
+
+    # tar images have to be converted first
+    bad_stacker mount test mnt
+    echo "$output" | grep "not squashfs"
+
+    stacker mount test-squashfs mnt
+    [ "$(cat mnt/rocks)" == "meshuggah" ]
+    [ ! -e mnt/etc/os-release ]
+    [ "$(chroot mnt /bin/cat /rocks)" == "meshuggah" ]
+    ! touch mnt/foo
+    bad_stacker mount test-squashfs mnt
+    stacker umount mnt
+    ! mountpoint -q mnt
+    [ -z "$(ls .stacker/mounts)" ]
+
+    stacker mount --writable test-squashfs mnt
+    chroot mnt /bin/sh -c "echo zeal > /rocks"
+    [ "$(cat mnt/rocks)" == "zeal" ]
+    stacker umount mnt
+
+    # the image itself is unchanged
+    stacker mount test-squashfs mnt
+    [ "$(cat mnt/rocks)" == "meshuggah" ]
+    stacker umount mnt
+}
+
+@test "delta makes xdelta3 deltas between squashfs layers" {
+    command -v xdelta3 || skip "xdelta3 isn't installed"
+    cat > stacker.yaml <<EOF
+v1:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        seq 1 500000 > /data
+v2:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        seq 1 500000 > /data
+        echo v2 > /version
+EOF
+    stacker build --layer-type squashfs
+    stacker delta v1-squashfs v2-squashfs
+
+    manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations["org.opencontainers.image.ref.name"] == "v2-squashfs-from-v1-squashfs") | .digest' | cut -f2 -d:)
+    [ "$(jq -r .config.mediaType oci/blobs/sha256/$manifest)" == "application/vnd.stacker.delta.config.v1+json" ]
+    # only the top layer changed
+    [ "$(jq -r '.layers | length' oci/blobs/sha256/$manifest)" == "1" ]
+    [ "$(jq -r .layers[0].mediaType oci/blobs/sha256/$manifest)" == "application/vnd.stacker.layer.delta.v1.vcdiff" ]
+
+    source=$(jq -r '.layers[0].annotations["com.cisco.stacker.delta_source"]' oci/blobs/sha256/$manifest | cut -f2 -d:)
+    target=$(jq -r '.layers[0].annotations["com.cisco.stacker.delta_target"]' oci/blobs/sha256/$manifest | cut -f2 -d:)
+    delta=$(jq -r .layers[0].digest oci/blobs/sha256/$manifest | cut -f2 -d:)
+    [ "$(stat -c %s oci/blobs/sha256/$delta)" -lt "$(stat -c %s oci/blobs/sha256/$target)" ]
+
+    xdelta3 -d -s oci/blobs/sha256/$source oci/blobs/sha256/$delta applied
+    [ "$(sha256sum applied | cut -f1 -d' ')" == "$target" ]
+}
+
+@test "tools_image tools are used instead of the host's" {
+    mkdir -p tools
+    cat > tools/stacker.yaml <<EOF
+tools:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        # the image's own (dynamically linked) false: the host's mksquashfs
+        # would succeed
+        mkdir -p /usr/local/bin
+        cp /usr/bin/false /usr/local/bin/mksquashfs
+EOF
+    stacker --oci-dir tools/oci --stacker-dir tools/.stacker --roots-dir tools/roots build -f tools/stacker.yaml
+    tools_digest=$(cat tools/oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "tools") | .digest')
+
+    # tools_image has to be pinned, and say which tools it's used for
+    echo "tools_image: oci:$(pwd)/tools/oci:tools" > config.yaml
+    echo "tools: [mksquashfs]" >> config.yaml
+    bad_stacker --config=config.yaml build --layer-type squashfs
+    echo "$output" | grep "should be pinned"
+    echo "tools_image: oci:$(pwd)/tools/oci:tools@$tools_digest" > config.yaml
+    bad_stacker --config=config.yaml build --layer-type squashfs
+    echo "$output" | grep "needs the tools to use from it"
+
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        echo meshuggah > /rocks
+EOF
+    cat > config.yaml <<EOF
+tools_image: oci:$(pwd)/tools/oci:tools@$tools_digest
+tools_dir: $(pwd)/tools-cache
+tools:
+    - mksquashfs
+EOF
+    bad_stacker --config=config.yaml build --layer-type squashfs
+    echo "$output" | grep "loading tools from"
+    echo "$output" | grep "mksquashfs failed"
+    # run with the image's loader and libraries
+    grep -- "--library-path '$(pwd)/tools-cache/" tools-cache/*/bin/mksquashfs
+    grep "image/rootfs/usr/local/bin/mksquashfs" tools-cache/*/bin/mksquashfs
+
+    # --no-cache doesn't throw the tools away
+    bad_stacker --config=config.yaml build --no-cache --layer-type squashfs
+    echo "$output" | grep "mksquashfs failed"
+    [ -z "$(echo "$output" | grep "loading tools from")" ]
+
+    echo "tools_image: oci:$(pwd)/tools/oci:tools@$tools_digest" > config.yaml
+    echo "tools_dir: $(pwd)/tools-cache" >> config.yaml
+    echo "tools: [unsquashfs]" >> config.yaml
+    bad_stacker --config=config.yaml build --layer-type squashfs
+    echo "$output" | grep "the tools image doesn't have unsquashfs"
+}
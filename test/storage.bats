@@ -53,3 +53,93 @@ EOF
     [ -f roots/test/overlay_metadata.json ]
     [ "$(cat .stacker/storage.type)" = "overlay" ]
 }
+
+@test "a stacker that died mid-build doesn't break the output" {
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: touch /test
+EOF
+    stacker build
+
+    # the manifest of test went missing, and a dead stacker left a blob it
+    # was adding and its journal behind
+    local manifest=$(cat oci/index.json | jq -r '.manifests[] | select(.annotations."org.opencontainers.image.ref.name" == "test") | .digest' | cut -f2 -d:)
+    rm oci/blobs/sha256/$manifest
+    echo "half a layer" > oci/blobs/sha256/dead
+    local dead=$(sha256sum oci/blobs/sha256/dead | cut -f1 -d" ")
+    mv oci/blobs/sha256/dead oci/blobs/sha256/$dead
+    echo "sha256:$dead" > oci/.stacker-journal-1234
+
+    stacker build
+    echo "$output" | grep "WARNING: dropping test from .*oci"
+    [ ! -f oci/blobs/sha256/$dead ]
+    [ ! -f oci/.stacker-journal-1234 ]
+    umoci ls --layout oci | grep test
+    umoci unpack --image oci:test dest
+    [ -f dest/rootfs/test ]
+}
+
+@test "the output can be read while something is building" {
+    cat > first.yaml <<EOF
+first:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: echo hello > /hello
+EOF
+    cat > second.yaml <<EOF
+second:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: |
+        touch /started
+        while [ ! -f /done ]; do sleep 1; done
+EOF
+    stacker build -f first.yaml
+    stacker build -f second.yaml &
+
+    for i in $(seq 60); do
+        run_stacker exec second -- test -f /started
+        [ "$status" -eq 0 ] && break
+        sleep 1
+    done
+    [ "$status" -eq 0 ]
+
+    # reading doesn't wait for the build, but building in the same roots dir
+    # does
+    stacker inspect first
+    [ "$(stacker cat first:/hello | tail -n1)" = "hello" ]
+    stacker build -f first.yaml > waiting.log 2>&1 &
+    sleep 5
+
+    stacker exec second -- touch /done
+    wait
+    grep "waiting for another stacker to finish with .*roots.lock" waiting.log
+}
+
+@test "temporary snapshots a killed stacker left behind are deleted" {
+    require_privilege priv
+    cat > stacker.yaml <<EOF
+test:
+    from:
+        type: oci
+        url: $CENTOS_OCI
+    run: touch /hello
+EOF
+    stacker build
+
+    # the way a stacker that got killed while grabbing something would have
+    # left one
+    if [ "$STORAGE_TYPE" = "btrfs" ]; then
+        btrfs subvolume snapshot roots/test roots/temp-snapshot-test-123456
+    else
+        mkdir -p roots/temp-snapshot-test-123456/overlay roots/temp-snapshot-test-123456/rootfs
+    fi
+
+    stacker build
+    [ -z "$(ls -d roots/temp-snapshot-* 2>/dev/null)" ]
+}
@@ -0,0 +1,354 @@
+package stacker
+
+import (
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/anuvu/stacker/lib"
+	"github.com/anuvu/stacker/log"
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/layer"
+	"github.com/pkg/errors"
+)
+
+// toolsImagePath is where tools are looked for in a tools image, in order.
+var toolsImagePath = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// toolsLibraryPath is where the libraries the tools are linked against are
+// looked for in a tools image, along with the multiarch directories (e.g.
+// /usr/lib/x86_64-linux-gnu).
+var toolsLibraryPath = []string{"/usr/local/lib64", "/usr/local/lib", "/lib64", "/usr/lib64", "/lib", "/usr/lib"}
+
+// toolsDir returns where the config's tools image is extracted. It's named
+// after the image and the tools, so a different image (or tag, or set of
+// tools) is extracted again.
+func toolsDir(config types.StackerConfig) (string, error) {
+	base := config.ToolsDir
+	if base == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return "", errors.Wrapf(err, "couldn't find where to keep tools, set tools_dir")
+		}
+		base = path.Join(cache, "stacker", "tools")
+	}
+
+	key := strings.Join(append([]string{config.ToolsImage}, config.Tools...), "\n")
+	return path.Join(base, digest.FromString(key).Encoded()[:16]), nil
+}
+
+// toolsImageRef splits the config's tools image into the reference it is
+// copied from and the digest it is pinned to. Since the tools run on the host
+// and the image is only fetched once, it has to be pinned by digest (e.g.
+// docker://example.com/tools@sha256:...), rather than with a tag that might
+// move.
+func toolsImageRef(image string) (string, digest.Digest, error) {
+	i := strings.LastIndex(image, "@")
+	if i < 0 {
+		return "", "", errors.Errorf("tools_image %s should be pinned with @sha256:<digest>", image)
+	}
+
+	d, err := digest.Parse(image[i+1:])
+	if err != nil {
+		return "", "", errors.Wrapf(err, "bad digest in tools_image %s", image)
+	}
+
+	// docker references have digests of their own, which the copy
+	// checks; the others are checked before they're copied
+	if strings.HasPrefix(image, "docker://") {
+		return image, d, nil
+	}
+	return image[:i], d, nil
+}
+
+// SetupTools makes the tools in the config's tools image be found before the
+// host's by everything stacker runs, by putting a directory with wrappers
+// for them first in $PATH. The image is only fetched the first time.
+func SetupTools(config types.StackerConfig) error {
+	if config.ToolsImage == "" {
+		return nil
+	}
+
+	if len(config.Tools) == 0 {
+		return errors.Errorf("tools_image %s needs the tools to use from it in tools", config.ToolsImage)
+	}
+
+	if _, _, err := toolsImageRef(config.ToolsImage); err != nil {
+		return err
+	}
+
+	dir, err := toolsDir(config)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		if !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+
+		if err := fetchTools(config, dir); err != nil {
+			return errors.Wrapf(err, "couldn't get tools from %s", config.ToolsImage)
+		}
+	}
+
+	bin := path.Join(dir, "bin")
+	log.Debugf("using tools from %s in %s", config.ToolsImage, bin)
+	return errors.WithStack(os.Setenv("PATH", bin+":"+os.Getenv("PATH")))
+}
+
+// fetchTools extracts the tools image and writes wrappers for the tools in
+// it into dir's bin.
+func fetchTools(config types.StackerConfig, dir string) error {
+	tmp := dir + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	src, pinned, err := toolsImageRef(config.ToolsImage)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(src, "docker://") {
+		d, err := lib.ManifestDigest(src, "", "", false)
+		if err != nil {
+			return err
+		}
+
+		if d != pinned {
+			return errors.Errorf("%s is %s, not the pinned %s", src, d, pinned)
+		}
+	}
+
+	log.Infof("loading tools from %s", config.ToolsImage)
+	ociDir := path.Join(tmp, "oci")
+	err = lib.ImageCopy(lib.ImageCopyOpts{
+		Src:    src,
+		Dest:   fmt.Sprintf("oci:%s:tools", ociDir),
+		TmpDir: config.TmpDir,
+	})
+	if err != nil {
+		return err
+	}
+
+	oci, err := stackeroci.OpenLayout(ociDir)
+	if err != nil {
+		return err
+	}
+	defer oci.Close()
+
+	bundle := path.Join(tmp, "image")
+	// doctor and the like don't run in the user namespace
+	opts := layer.UnpackOptions{MapOptions: layer.MapOptions{Rootless: os.Geteuid() != 0}}
+	if err := umoci.Unpack(oci, "tools", bundle, opts); err != nil {
+		return errors.Wrapf(err, "couldn't unpack %s", config.ToolsImage)
+	}
+
+	// the unpacked image is all that's kept
+	if err := os.RemoveAll(ociDir); err != nil {
+		return errors.WithStack(err)
+	}
+
+	rootfs := path.Join(bundle, "rootfs")
+	tools, err := imageTools(rootfs, config.Tools)
+	if err != nil {
+		return err
+	}
+
+	bin := path.Join(tmp, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+
+	for name, p := range tools {
+		// the wrappers point at where the image will be once tmp is
+		// renamed
+		wrapper, err := toolWrapper(rootfs, path.Join(dir, "image", "rootfs"), p)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't use %s", name)
+		}
+
+		if err := ioutil.WriteFile(path.Join(bin, name), []byte(wrapper), 0755); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	log.Infof("using %d tools from %s", len(tools), config.ToolsImage)
+	if err := os.MkdirAll(path.Dir(dir), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, dir))
+}
+
+// imageTools returns the paths (in the image) of the tools named in wanted
+// in the image whose filesystem is at rootfs, with the symlinks to them
+// resolved. The first executable found with each name in the image's usual
+// bin directories (in toolsImagePath's order) wins.
+func imageTools(rootfs string, wanted []string) (map[string]string, error) {
+	tools := map[string]string{}
+	for _, dir := range toolsImagePath {
+		// e.g. /bin -> /usr/bin
+		dir = resolveInRootfs(rootfs, dir)
+		entries, err := ioutil.ReadDir(path.Join(rootfs, dir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.WithStack(err)
+		}
+
+		for _, entry := range entries {
+			if _, ok := tools[entry.Name()]; ok {
+				continue
+			}
+
+			p := resolveInRootfs(rootfs, path.Join(dir, entry.Name()))
+			fi, err := os.Stat(path.Join(rootfs, p))
+			if err != nil || fi.IsDir() || fi.Mode()&0111 == 0 {
+				continue
+			}
+
+			tools[entry.Name()] = p
+		}
+	}
+
+	selected := map[string]string{}
+	missing := []string{}
+	for _, name := range wanted {
+		p, ok := tools[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		selected[name] = p
+	}
+
+	if len(missing) > 0 {
+		return nil, errors.Errorf("the tools image doesn't have %s", strings.Join(missing, ", "))
+	}
+
+	return selected, nil
+}
+
+// resolveInRootfs returns what p in rootfs is once the symlinks (e.g.
+// /sbin -> usr/sbin or /usr/sbin/mkfs.ext4 -> mke2fs) are followed inside
+// rootfs rather than on the host.
+func resolveInRootfs(rootfs string, p string) string {
+	for i := 0; i < 40; i++ {
+		target, err := os.Readlink(path.Join(rootfs, p))
+		if err != nil {
+			break
+		}
+
+		if !path.IsAbs(target) {
+			target = path.Join(path.Dir(p), target)
+		}
+		p = path.Clean("/" + target)
+	}
+
+	return p
+}
+
+// toolWrapper returns a script that runs the tool at p in the image whose
+// filesystem is at rootfs (and will be at final when it's run) with the
+// image's dynamic loader and libraries, so that nothing but the kernel (and
+// /bin/sh, to start it) comes from the host.
+func toolWrapper(rootfs string, final string, p string) (string, error) {
+	interp, err := elfInterpreter(path.Join(rootfs, p))
+	if err != nil {
+		return "", err
+	}
+
+	// statically linked
+	if interp == "" {
+		return fmt.Sprintf("#!/bin/sh\nexec %s \"$@\"\n", shellQuote(path.Join(final, p))), nil
+	}
+
+	interp = resolveInRootfs(rootfs, interp)
+	if _, err := os.Stat(path.Join(rootfs, interp)); err != nil {
+		return "", errors.Errorf("the tools image doesn't have %s's dynamic loader %s", p, interp)
+	}
+
+	libs := []string{}
+	for _, dir := range imageLibraryPath(rootfs) {
+		libs = append(libs, path.Join(final, dir))
+	}
+
+	return fmt.Sprintf("#!/bin/sh\nexec %s --library-path %s %s \"$@\"\n",
+		shellQuote(path.Join(final, interp)), shellQuote(strings.Join(libs, ":")), shellQuote(path.Join(final, p))), nil
+}
+
+// elfInterpreter returns the dynamic loader (PT_INTERP) of the ELF binary at
+// p, or "" if it's statically linked.
+func elfInterpreter(p string) (string, error) {
+	f, err := elf.Open(p)
+	if err != nil {
+		// a script's interpreter would be the host's
+		if content, rerr := ioutil.ReadFile(p); rerr == nil && strings.HasPrefix(string(content), "#!") {
+			return "", errors.Errorf("%s is a script, only binaries can be run from the tools image", path.Base(p))
+		}
+		return "", errors.Wrapf(err, "%s isn't an ELF binary", path.Base(p))
+	}
+	defer f.Close()
+
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_INTERP {
+			continue
+		}
+
+		interp, err := ioutil.ReadAll(prog.Open())
+		if err != nil {
+			return "", errors.Wrapf(err, "couldn't read %s's interpreter", path.Base(p))
+		}
+		return strings.TrimRight(string(interp), "\x00"), nil
+	}
+
+	return "", nil
+}
+
+// imageLibraryPath returns the directories of toolsLibraryPath, and the
+// multiarch ones, that the image whose filesystem is at rootfs has.
+func imageLibraryPath(rootfs string) []string {
+	candidates := append([]string{}, toolsLibraryPath...)
+	for _, pattern := range []string{"lib/*-linux-*", "usr/lib/*-linux-*"} {
+		matches, _ := filepath.Glob(path.Join(rootfs, pattern))
+		for _, m := range matches {
+			if rel, err := filepath.Rel(rootfs, m); err == nil {
+				candidates = append(candidates, path.Join("/", rel))
+			}
+		}
+	}
+
+	dirs := []string{}
+	seen := map[string]bool{}
+	for _, dir := range candidates {
+		// e.g. /lib -> usr/lib
+		dir = resolveInRootfs(rootfs, dir)
+		fi, err := os.Stat(path.Join(rootfs, dir))
+		if err != nil || !fi.IsDir() || seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		dirs = append(dirs, dir)
+	}
+
+	return dirs
+}
+
+// shellQuote quotes s for a shell script.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,144 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/anuvu/stacker/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImageTools(t *testing.T) {
+	assert := assert.New(t)
+
+	rootfs, err := ioutil.TempDir("", "stacker-tools-")
+	assert.NoError(err)
+	defer os.RemoveAll(rootfs)
+
+	assert.NoError(os.MkdirAll(path.Join(rootfs, "usr/bin"), 0755))
+	assert.NoError(os.MkdirAll(path.Join(rootfs, "usr/sbin"), 0755))
+	assert.NoError(ioutil.WriteFile(path.Join(rootfs, "usr/bin/mksquashfs"), []byte("#!/bin/true\n"), 0755))
+	assert.NoError(ioutil.WriteFile(path.Join(rootfs, "usr/bin/README"), []byte("not a tool\n"), 0644))
+	assert.NoError(ioutil.WriteFile(path.Join(rootfs, "usr/sbin/mke2fs"), []byte("#!/bin/true\n"), 0755))
+	// absolute links are followed inside the image, not on the host
+	assert.NoError(os.Symlink("/usr/sbin/mke2fs", path.Join(rootfs, "usr/sbin/mkfs.ext4")))
+	assert.NoError(os.Symlink("/usr/bin", path.Join(rootfs, "bin")))
+
+	tools, err := imageTools(rootfs, []string{"mksquashfs", "mke2fs", "mkfs.ext4"})
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"mksquashfs": "/usr/bin/mksquashfs",
+		"mke2fs":     "/usr/sbin/mke2fs",
+		"mkfs.ext4":  "/usr/sbin/mke2fs",
+	}, tools)
+
+	tools, err = imageTools(rootfs, []string{"mksquashfs"})
+	assert.NoError(err)
+	assert.Equal(map[string]string{"mksquashfs": "/usr/bin/mksquashfs"}, tools)
+
+	_, err = imageTools(rootfs, []string{"mksquashfs", "README"})
+	assert.Error(err)
+
+	_, err = imageTools(rootfs, []string{"mksquashfs", "unsquashfs"})
+	assert.Error(err)
+}
+
+func TestToolsImageRef(t *testing.T) {
+	assert := assert.New(t)
+
+	d := "sha256:" + strings.Repeat("a", 64)
+	ref, pinned, err := toolsImageRef("docker://example.com/tools@" + d)
+	assert.NoError(err)
+	assert.Equal("docker://example.com/tools@"+d, ref)
+	assert.Equal(d, pinned.String())
+
+	ref, pinned, err = toolsImageRef("oci:/tools:1.0@" + d)
+	assert.NoError(err)
+	assert.Equal("oci:/tools:1.0", ref)
+	assert.Equal(d, pinned.String())
+
+	_, _, err = toolsImageRef("docker://example.com/tools:1.0")
+	assert.Error(err)
+
+	_, _, err = toolsImageRef("docker://example.com/tools@latest")
+	assert.Error(err)
+
+	err = SetupTools(types.StackerConfig{ToolsImage: "docker://example.com/tools@" + d})
+	assert.Error(err)
+}
+
+func TestToolsDir(t *testing.T) {
+	assert := assert.New(t)
+
+	config := types.StackerConfig{StackerDir: "/build/.stacker", ToolsDir: "/cache/tools", ToolsImage: "oci:/tools:1.0"}
+	dir, err := toolsDir(config)
+	assert.NoError(err)
+	assert.Equal("/cache/tools", path.Dir(dir))
+
+	config.Tools = []string{"mksquashfs"}
+	other, err := toolsDir(config)
+	assert.NoError(err)
+	assert.NotEqual(dir, other)
+
+	config.Tools = nil
+	config.ToolsImage = "oci:/tools:1.1"
+	other, err = toolsDir(config)
+	assert.NoError(err)
+	assert.NotEqual(dir, other)
+
+	// build --no-cache removes the stacker dir, but not the tools
+	config.ToolsDir = ""
+	os.Setenv("XDG_CACHE_HOME", "/cache")
+	defer os.Unsetenv("XDG_CACHE_HOME")
+	dir, err = toolsDir(config)
+	assert.NoError(err)
+	assert.Equal("/cache/stacker/tools", path.Dir(dir))
+}
+
+func TestToolWrapper(t *testing.T) {
+	assert := assert.New(t)
+
+	rootfs, err := ioutil.TempDir("", "stacker-tools-")
+	assert.NoError(err)
+	defer os.RemoveAll(rootfs)
+
+	host, err := os.Executable()
+	assert.NoError(err)
+	interp, err := elfInterpreter(host)
+	assert.NoError(err)
+
+	assert.NoError(os.MkdirAll(path.Join(rootfs, "usr/bin"), 0755))
+	assert.NoError(os.MkdirAll(path.Join(rootfs, "usr/lib"), 0755))
+	assert.NoError(os.Symlink("usr/lib", path.Join(rootfs, "lib")))
+	content, err := ioutil.ReadFile(host)
+	assert.NoError(err)
+	assert.NoError(ioutil.WriteFile(path.Join(rootfs, "usr/bin/tool"), content, 0755))
+	assert.NoError(ioutil.WriteFile(path.Join(rootfs, "usr/bin/script"), []byte("#!/bin/sh\n"), 0755))
+
+	_, err = toolWrapper(rootfs, "/tools/image/rootfs", "/usr/bin/script")
+	assert.Error(err)
+
+	wrapper, err := toolWrapper(rootfs, "/tools/image/rootfs", "/usr/bin/tool")
+	if interp == "" {
+		assert.NoError(err)
+		assert.Equal("#!/bin/sh\nexec '/tools/image/rootfs/usr/bin/tool' \"$@\"\n", wrapper)
+		return
+	}
+
+	// the image's loader, not the host's
+	assert.Error(err)
+	assert.NoError(os.MkdirAll(path.Join(rootfs, path.Dir(interp)), 0755))
+	assert.NoError(ioutil.WriteFile(path.Join(rootfs, interp), []byte{}, 0755))
+
+	wrapper, err = toolWrapper(rootfs, "/tools/image/rootfs", "/usr/bin/tool")
+	assert.NoError(err)
+	assert.Contains(wrapper, "--library-path '/tools/image/rootfs/")
+	// /lib is a link to /usr/lib, which is only in it once
+	assert.Contains(wrapper, "/tools/image/rootfs/usr/lib'")
+	assert.NotContains(wrapper, "/tools/image/rootfs/lib:")
+	assert.Contains(wrapper, "'/tools/image/rootfs/usr/bin/tool' \"$@\"")
+	assert.Contains(wrapper, "exec '/tools/image/rootfs"+resolveInRootfs(rootfs, interp)+"'")
+}
@@ -3,6 +3,9 @@ package types
 import (
 	"fmt"
 	"path"
+	"runtime"
+	"sort"
+	"strings"
 )
 
 // StackerConfig is a struct that contains global (or widely used) stacker
@@ -13,6 +16,195 @@ type StackerConfig struct {
 	RootFSDir   string `yaml:"rootfs_dir"`
 	Debug       bool   `yaml:"-"`
 	StorageType string `yaml:"-"`
+
+	// BtrfsLoopbackMaxSize is the size (e.g. "500GiB") that stacker may
+	// grow the btrfs loopback file to when it fills up. If empty, the
+	// loopback is never grown.
+	BtrfsLoopbackMaxSize string `yaml:"btrfs_loopback_max_size"`
+
+	// OverlayLayerPool is a directory where the overlay backend extracts
+	// base image layers. It may be shared between several roots dirs, so
+	// that a base used by several projects is only extracted once. If
+	// empty, layers are extracted into the roots dir.
+	OverlayLayerPool string `yaml:"overlay_layer_pool"`
+
+	// BaseImageCache is a directory, which may be shared between several
+	// stacker dirs, where the blobs of docker and oci base images are
+	// kept, so that each is only downloaded and stored once. It must be
+	// on the same filesystem as the stacker dirs using it. If it is set
+	// and OverlayLayerPool isn't, the overlay backend extracts layers
+	// into it too.
+	BaseImageCache string `yaml:"base_image_cache"`
+
+	// UnpackJobs is the number of base image layers the overlay backend
+	// extracts at once. If zero, it is the number of CPUs.
+	UnpackJobs int `yaml:"unpack_jobs"`
+
+	// LayerCompression is how generated tar layers are compressed: gzip
+	// (the default), zstd or none.
+	LayerCompression string `yaml:"layer_compression"`
+
+	// LayerCompressionLevel is the level LayerCompression compresses at
+	// (1-9 for gzip, 1-22 for zstd). If zero, it is the compressor's
+	// default.
+	LayerCompressionLevel int `yaml:"layer_compression_level"`
+
+	// LayerUIDMap and LayerGIDMap are umoci style containerID:hostID:size
+	// mappings applied to the owners of files in generated tar layers.
+	LayerUIDMap []string `yaml:"layer_uid_map"`
+	LayerGIDMap []string `yaml:"layer_gid_map"`
+
+	// NoGitAnnotations stops stacker from annotating images with the
+	// commit, branch, etc. of the git repo the stacker file is in.
+	NoGitAnnotations bool `yaml:"no_git_annotations"`
+
+	// MaxSquashfsJobs, MaxExtractJobs and MaxNetworkJobs limit how many
+	// mksquashfs runs, layer extractions and network transfers all the
+	// stacker processes on this machine do at once. Zero means no limit.
+	MaxSquashfsJobs int `yaml:"max_squashfs_jobs"`
+	MaxExtractJobs  int `yaml:"max_extract_jobs"`
+	MaxNetworkJobs  int `yaml:"max_network_jobs"`
+
+	// MaxParallelDownloads is how many layers of an image one pull
+	// downloads at once. If zero, it is containers/image's default (6).
+	MaxParallelDownloads uint `yaml:"max_parallel_downloads"`
+
+	// LimitsDir is where the locks enforcing these limits are kept;
+	// processes that should share limits need to use the same one. If
+	// empty, it is /run/stacker/limits for root, and limits in the
+	// StackerDir for everyone else.
+	LimitsDir string `yaml:"limits_dir"`
+
+	// RunAgent runs layers' run and run_steps through a stacker agent in
+	// the build container, which reports each step's exit status and
+	// duration, instead of starting the container once per step.
+	RunAgent bool `yaml:"run_agent"`
+
+	// GCAfterBuild garbage collects the base images stacker keeps in the
+	// StackerDir after each successful build, dropping the blobs that
+	// the old images of bases whose tags moved left behind.
+	GCAfterBuild bool `yaml:"gc_after_build"`
+
+	// SquashfsVerity appends a dm-verity hash tree to each squashfs layer
+	// built, and annotates the layers with their root hashes and images
+	// with the chain of them (see stacker verity-info).
+	SquashfsVerity bool `yaml:"squashfs_verity"`
+
+	// MtreeKeywords are the mtree keywords the btrfs backend compares to
+	// find what a layer changed, e.g. without nlink and tar_time for
+	// filesystems whose link counts and times change for no reason. If
+	// empty, they're umoci's.
+	MtreeKeywords []string `yaml:"mtree_keywords"`
+
+	// HygieneChecks are the checks run on what each built layer adds.
+	HygieneChecks HygieneChecks `yaml:"hygiene_checks"`
+
+	// PolicyBundle is an OPA (rego) policy bundle, a directory or
+	// tarball, that opa evaluates against each stacker file before it is
+	// built and each image that is output. Any messages its
+	// data.stacker.deny has fail the build.
+	PolicyBundle string `yaml:"policy_bundle"`
+
+	// AllowedHosts and DeniedHosts are glob patterns (e.g.
+	// *.example.com) of the registries and web servers that stacker
+	// files may pull base images and imports from. If AllowedHosts is
+	// empty, any host that isn't denied is allowed.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	DeniedHosts  []string `yaml:"denied_hosts"`
+
+	// HardenedBuilds runs build containers without setuid execution,
+	// with only the capabilities builds need, a read only /sys and the
+	// sensitive parts of /proc masked, for building semi-trusted stacker
+	// files.
+	HardenedBuilds bool `yaml:"hardened_builds"`
+
+	// TmpDir is where stacker (and the tools it runs) keep temporary
+	// files. If empty, it is $TMPDIR.
+	TmpDir string `yaml:"tmp_dir"`
+
+	// WebhookURL is where stacker POSTs json events as builds and
+	// publishes progress. If WebhookSecret is set, each request is
+	// signed with it (see doc/tricks.md).
+	WebhookURL    string `yaml:"webhook_url"`
+	WebhookSecret string `yaml:"webhook_secret"`
+
+	// Author is the author of the images built, for layers that don't
+	// set their own. If empty, it is the user running stacker, as
+	// user@host.
+	Author string `yaml:"author"`
+
+	// ToolsImage is an image pinned by digest (e.g.
+	// docker://example.com/stacker-tools@sha256:... or
+	// oci:/path/to/layout:tools@sha256:...) whose tools, e.g. mksquashfs,
+	// are run instead of the host's; Tools is which ones.
+	ToolsImage string   `yaml:"tools_image"`
+	Tools      []string `yaml:"tools"`
+
+	// ToolsDir is where tools images are extracted. It's kept out of the
+	// StackerDir so that build --no-cache doesn't pull them again; if
+	// empty, it is stacker/tools in the user's cache directory
+	// ($XDG_CACHE_HOME, or ~/.cache).
+	ToolsDir string `yaml:"tools_dir"`
+
+	// Profiles are named sets of directories (e.g. "fast-nvme" and
+	// "big-hdd") that --profile selects, overriding the ones above.
+	Profiles map[string]StorageProfile `yaml:"profiles"`
+}
+
+// StorageProfile is where a --profile keeps things; empty directories are
+// left as they are in the rest of the config.
+type StorageProfile struct {
+	StackerDir string `yaml:"stacker_dir"`
+	OCIDir     string `yaml:"oci_dir"`
+	RootFSDir  string `yaml:"rootfs_dir"`
+	TmpDir     string `yaml:"tmp_dir"`
+}
+
+// ApplyProfile overrides the config's directories with the ones of the
+// profile name, recording that in origins if it isn't nil.
+func (sc *StackerConfig) ApplyProfile(name string, origins ConfigOrigins) error {
+	profile, ok := sc.Profiles[name]
+	if !ok {
+		names := []string{}
+		for n := range sc.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return KindErrorf(UserError, "unknown profile %s, the config has: %s", name, strings.Join(names, ", "))
+	}
+
+	for _, dir := range []struct {
+		key    string
+		value  string
+		config *string
+	}{
+		{"stacker_dir", profile.StackerDir, &sc.StackerDir},
+		{"oci_dir", profile.OCIDir, &sc.OCIDir},
+		{"rootfs_dir", profile.RootFSDir, &sc.RootFSDir},
+		{"tmp_dir", profile.TmpDir, &sc.TmpDir},
+	} {
+		if dir.value != "" {
+			*dir.config = dir.value
+			if origins != nil {
+				origins[dir.key] = fmt.Sprintf("profile %s", name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// HygieneChecks says what to do (ignore, the default, warn or error) when a
+// built layer adds symlinks that point outside of the image, setuid or setgid
+// files, world writable directories without the sticky bit, or files that
+// look like they have secrets in them. SecretPatterns are regexes of secrets
+// to look for on top of the common ones (AWS keys, private keys, and so on).
+type HygieneChecks struct {
+	EscapingSymlinks  string   `yaml:"escaping_symlinks"`
+	SetuidFiles       string   `yaml:"setuid_files"`
+	WorldWritableDirs string   `yaml:"world_writable_dirs"`
+	Secrets           string   `yaml:"secrets"`
+	SecretPatterns    []string `yaml:"secret_patterns"`
 }
 
 // Substitutions - return an array of substitutions for StackerFiles
@@ -21,9 +213,18 @@ func (sc *StackerConfig) Substitutions() []string {
 		fmt.Sprintf("STACKER_ROOTFS_DIR=%s", sc.RootFSDir),
 		fmt.Sprintf("STACKER_STACKER_DIR=%s", sc.StackerDir),
 		fmt.Sprintf("STACKER_OCI_DIR=%s", sc.OCIDir),
+		fmt.Sprintf("STACKER_ARCH=%s", runtime.GOARCH),
+		fmt.Sprintf("STACKER_OS=%s", runtime.GOOS),
 	}
 }
 
 func (sc *StackerConfig) CacheFile() string {
 	return path.Join(sc.StackerDir, "build.cache")
 }
+
+// RunCacheDir is where the persistent contents of the cache directory dir of
+// layer name are kept.
+func (sc *StackerConfig) RunCacheDir(name string, dir string) string {
+	escaped := strings.ReplaceAll(strings.Trim(dir, "/"), "/", "_")
+	return path.Join(sc.StackerDir, "run-caches", name, escaped)
+}
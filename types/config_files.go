@@ -0,0 +1,189 @@
+package types
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// SystemConfigFile and ProjectConfigFile are the config files read before
+// and after the user's, see LoadFiles().
+const (
+	SystemConfigFile  = "/etc/stacker/conf.yaml"
+	ProjectConfigFile = ".stacker.yaml"
+)
+
+// ConfigOrigins says where each setting of a StackerConfig (by its yaml
+// name) came from: a config file, a flag or a profile. Settings that aren't
+// in it have their default value.
+type ConfigOrigins map[string]string
+
+// LoadFiles reads the config files in order, each overriding the settings
+// of the ones before it; files that don't exist are skipped. It returns
+// which file each of the settings came from.
+func (sc *StackerConfig) LoadFiles(files []string) (ConfigOrigins, error) {
+	origins := ConfigOrigins{}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, errors.Wrapf(err, "couldn't read config %s", file)
+		}
+
+		before := *sc
+		if err := yaml.Unmarshal(content, sc); err != nil {
+			return nil, WithKind(UserError, errors.Wrapf(err, "couldn't parse config %s", file))
+		}
+
+		settings := map[string]interface{}{}
+		if err := yaml.Unmarshal(content, &settings); err != nil {
+			return nil, WithKind(UserError, errors.Wrapf(err, "couldn't parse config %s", file))
+		}
+
+		if file == ProjectConfigFile {
+			for _, key := range sc.projectOnly(before, settings) {
+				log.Infof("WARNING: ignoring %s in %s, which can only make security settings stricter", key, file)
+				delete(settings, key)
+			}
+		}
+
+		for key := range settings {
+			origins[key] = file
+		}
+	}
+
+	return origins, nil
+}
+
+// projectSettings are the settings the project's config may set as it likes:
+// ones that only change what is built, or how fast, rather than what runs on
+// the host, where things are kept or where they're sent.
+var projectSettings = map[string]bool{
+	"layer_compression":       true,
+	"layer_compression_level": true,
+	"layer_uid_map":           true,
+	"layer_gid_map":           true,
+	"no_git_annotations":      true,
+	"unpack_jobs":             true,
+	"max_squashfs_jobs":       true,
+	"max_extract_jobs":        true,
+	"max_network_jobs":        true,
+	"max_parallel_downloads":  true,
+	"run_agent":               true,
+	"gc_after_build":          true,
+	"squashfs_verity":         true,
+	"mtree_keywords":          true,
+	"author":                  true,
+}
+
+// projectOnly undoes what the project's config (which comes with whatever
+// was checked out, rather than from whoever runs stacker) did to before, the
+// config so far, except for the projectSettings and making the security
+// settings stricter: it may turn hardened_builds on and deny more hosts, and
+// set allowed_hosts and policy_bundle if nothing before it did, but not
+// loosen them. settings are the ones the project's config has. It returns the
+// settings that were undone.
+func (sc *StackerConfig) projectOnly(before StackerConfig, settings map[string]interface{}) []string {
+	undone := sc.tightenOnly(before)
+
+	v := reflect.ValueOf(sc).Elem()
+	old := reflect.ValueOf(before)
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if _, ok := settings[key]; !ok || projectSettings[key] {
+			continue
+		}
+
+		switch key {
+		case "hardened_builds", "denied_hosts", "allowed_hosts", "policy_bundle":
+			continue
+		}
+
+		v.Field(i).Set(old.Field(i))
+		undone = append(undone, key)
+	}
+
+	return undone
+}
+
+// tightenOnly undoes whatever the project's config did to the security
+// settings of before except making them stricter, returning the ones it
+// undid.
+func (sc *StackerConfig) tightenOnly(before StackerConfig) []string {
+	undone := []string{}
+	if before.HardenedBuilds && !sc.HardenedBuilds {
+		sc.HardenedBuilds = true
+		undone = append(undone, "hardened_builds")
+	}
+
+	for _, host := range before.DeniedHosts {
+		found := false
+		for _, h := range sc.DeniedHosts {
+			found = found || h == host
+		}
+		if !found {
+			sc.DeniedHosts = append(sc.DeniedHosts, host)
+		}
+	}
+
+	if len(before.AllowedHosts) > 0 && !reflect.DeepEqual(before.AllowedHosts, sc.AllowedHosts) {
+		sc.AllowedHosts = before.AllowedHosts
+		undone = append(undone, "allowed_hosts")
+	}
+
+	if before.PolicyBundle != "" && before.PolicyBundle != sc.PolicyBundle {
+		sc.PolicyBundle = before.PolicyBundle
+		undone = append(undone, "policy_bundle")
+	}
+
+	return undone
+}
+
+// secretSettings are the settings Show doesn't print the values of, since
+// its output ends up in bug reports and CI logs.
+var secretSettings = map[string]bool{"webhook_secret": true}
+
+// Show renders the config as yaml, with a comment saying where each setting
+// came from if origins isn't nil. Secrets are redacted.
+func (sc StackerConfig) Show(origins ConfigOrigins) (string, error) {
+	out := strings.Builder{}
+	v := reflect.ValueOf(sc)
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+
+		value := v.Field(i).Interface()
+		if secretSettings[key] && !v.Field(i).IsZero() {
+			value = "<redacted>"
+		}
+
+		content, err := yaml.Marshal(map[string]interface{}{key: value})
+		if err != nil {
+			return "", errors.Wrapf(err, "couldn't render %s", key)
+		}
+
+		lines := strings.SplitN(strings.TrimSuffix(string(content), "\n"), "\n", 2)
+		if origins != nil {
+			origin, ok := origins[key]
+			if !ok {
+				origin = "default"
+			}
+			lines[0] = fmt.Sprintf("%s  # %s", lines[0], origin)
+		}
+
+		out.WriteString(strings.Join(lines, "\n"))
+		out.WriteString("\n")
+	}
+
+	return out.String(), nil
+}
@@ -0,0 +1,131 @@
+package types
+
+import (
+	"net"
+	"os/exec"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorKind is what kind of problem made stacker fail, which decides its exit
+// code, so that e.g. CI can retry builds that failed because a registry was
+// down, but not ones whose stacker file is wrong.
+type ErrorKind int
+
+const (
+	// OtherError is anything that isn't one of the kinds below.
+	OtherError ErrorKind = iota
+	// UserError is a problem with a stacker file, config or flags.
+	UserError
+	// ToolMissing means a program stacker runs isn't installed.
+	ToolMissing
+	// StorageError is a problem with the roots dir or its storage
+	// backend.
+	StorageError
+	// NetworkError is a problem talking to a registry or web server.
+	NetworkError
+	// PolicyError means that a build violates one of the policies in the
+	// stacker config.
+	PolicyError
+	// CancelledError means that the build was cancelled, e.g. with ^C.
+	CancelledError
+)
+
+var errorKindNames = map[ErrorKind]string{
+	OtherError:     "error",
+	UserError:      "user error",
+	ToolMissing:    "tool missing",
+	StorageError:   "storage error",
+	NetworkError:   "network error",
+	PolicyError:    "policy error",
+	CancelledError: "cancelled",
+}
+
+func (k ErrorKind) String() string {
+	return errorKindNames[k]
+}
+
+// ExitCode is stacker's exit code when it fails because of an error of this
+// kind. They are the closest sysexits.h codes, which are unlikely to clash
+// with the exit statuses of the commands in run sections.
+func (k ErrorKind) ExitCode() int {
+	switch k {
+	case UserError:
+		return 65 // EX_DATAERR
+	case ToolMissing:
+		return 69 // EX_UNAVAILABLE
+	case StorageError:
+		return 74 // EX_IOERR
+	case NetworkError:
+		return 75 // EX_TEMPFAIL
+	case PolicyError:
+		return 77 // EX_NOPERM
+	case CancelledError:
+		return 130 // what shells exit with after SIGINT
+	default:
+		return 1
+	}
+}
+
+type kindError struct {
+	kind ErrorKind
+	err  error
+}
+
+func (e kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e kindError) Cause() error {
+	return e.err
+}
+
+func (e kindError) Unwrap() error {
+	return e.err
+}
+
+// WithKind marks err as being of kind. A nil err stays nil.
+func WithKind(kind ErrorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return kindError{kind, err}
+}
+
+// KindErrorf is errors.Errorf for an error of kind.
+func KindErrorf(kind ErrorKind, format string, args ...interface{}) error {
+	return WithKind(kind, errors.Errorf(format, args...))
+}
+
+// KindOf returns the kind of err. Errors are often marked again as they are
+// returned up the stack, so the mark closest to the actual problem wins (a
+// network error while setting up storage is a network error); programs that
+// aren't installed and failed network connections are recognized without
+// being marked.
+func KindOf(err error) ErrorKind {
+	kind := OtherError
+	for err != nil {
+		switch e := err.(type) {
+		case kindError:
+			kind = e.kind
+		case net.Error:
+			kind = NetworkError
+		}
+
+		if err == exec.ErrNotFound {
+			kind = ToolMissing
+		}
+
+		switch e := err.(type) {
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		case interface{ Cause() error }:
+			err = e.Cause()
+		default:
+			err = nil
+		}
+	}
+
+	return kind
+}
@@ -0,0 +1,52 @@
+package types
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Harden is what's done to a layer's rootfs once it's built, for appliance
+// style images that shouldn't have anything privileged in them that isn't
+// meant to be.
+type Harden struct {
+	// StripSetuid removes the setuid and setgid bits of all the files,
+	// except the ones in KeepSetuid.
+	StripSetuid bool     `yaml:"strip_setuid"`
+	KeepSetuid  []string `yaml:"keep_setuid"`
+	// RootOwned makes everything owned by root:root.
+	RootOwned bool `yaml:"root_owned"`
+}
+
+// ParseHarden checks the layer's harden, and returns it with the paths in it
+// cleaned, or nil if it doesn't have one.
+func (l *Layer) ParseHarden() (*Harden, error) {
+	if l.Harden == nil {
+		return nil, nil
+	}
+
+	if !l.Harden.StripSetuid && !l.Harden.RootOwned {
+		return nil, errors.Errorf("harden has nothing to do, it should set strip_setuid or root_owned")
+	}
+
+	if len(l.Harden.KeepSetuid) > 0 && !l.Harden.StripSetuid {
+		return nil, errors.Errorf("keep_setuid only makes sense with strip_setuid")
+	}
+
+	h := &Harden{StripSetuid: l.Harden.StripSetuid, RootOwned: l.Harden.RootOwned}
+	for _, p := range l.Harden.KeepSetuid {
+		if !filepath.IsAbs(p) {
+			return nil, errors.Errorf("keep_setuid path %s must be an absolute path", p)
+		}
+
+		// it's passed to the container on its command line
+		if strings.ContainsAny(p, " \t\n") {
+			return nil, errors.Errorf("keep_setuid path %q can't have whitespace in it", p)
+		}
+
+		h.KeepSetuid = append(h.KeepSetuid, filepath.Clean(p))
+	}
+
+	return h, nil
+}
@@ -47,6 +47,12 @@ type ImageSource struct {
 	Url      string `yaml:"url"`
 	Tag      string `yaml:"tag"`
 	Insecure bool   `yaml:"insecure"`
+	// Hash is the sha256 of tar bases' tarball.
+	Hash string `yaml:"hash"`
+	// Constraint, for docker bases, is the semver range of the tag to
+	// use: the newest tag of Url's repository in it is picked, and
+	// recorded in the stacker file's lock file.
+	Constraint string `yaml:"constraint"`
 }
 
 func NewImageSource(containersImageString string) (*ImageSource, error) {
@@ -96,14 +102,16 @@ func (is *ImageSource) ParseTag() (string, error) {
 			return "", err
 		}
 
+		// e.g. docker://example.com/base@sha256:... for locked
+		// constraints
 		if url.Path != "" {
-			return path.Base(strings.Split(url.Path, ":")[0]), nil
+			return path.Base(strings.Split(strings.Split(url.Path, "@")[0], ":")[0]), nil
 		}
 
 		// skopeo allows docker://centos:latest or
 		// docker://docker.io/centos:latest; if we don't have a
 		// url path, let's use the host as the image tag
-		return strings.Split(url.Host, ":")[0], nil
+		return strings.Split(strings.Split(url.Host, "@")[0], ":")[0], nil
 	case OCILayer:
 		pieces := strings.SplitN(is.Url, ":", 2)
 		if len(pieces) != 2 {
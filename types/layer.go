@@ -3,15 +3,28 @@ package types
 import (
 	"fmt"
 	"os"
+	"os/user"
+	"path"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/anmitsu/go-shlex"
 	"github.com/pkg/errors"
 )
 
+// How a layer's cmd and entrypoint are merged with its base image's, see
+// ParseCommandMerge().
+const (
+	CommandMergeInherit = "inherit"
+	CommandMergeReplace = "replace"
+	CommandMergeAppend  = "append"
+)
+
 const (
 	DockerLayer = "docker"
 	TarLayer    = "tar"
@@ -30,9 +43,98 @@ func IsContainersImageLayer(from string) bool {
 	return false
 }
 
+// Import is something copied into /stacker before the layer's run. If it
+// can't be fetched from Path, each of Mirrors is tried in order; they should
+// all serve the same file, which is named after Path in /stacker either way.
 type Import struct {
-	Path string `yaml:"path"`
-	Hash string `yaml:"hash"`
+	Path    string     `yaml:"path"`
+	Hash    string     `yaml:"hash"`
+	GPG     *ImportGPG `yaml:"gpg"`
+	Mirrors []string   `yaml:"mirrors"`
+}
+
+// ImportGPG is how to check an import's detached gpg signature: the keyring
+// (armored or not) with the keys that may sign it, and the signature. If Sig
+// is empty, it is the import's path with .asc appended.
+type ImportGPG struct {
+	Keyring string `yaml:"keyring"`
+	Sig     string `yaml:"sig"`
+}
+
+// Artifact says that a layer's output is the file or directory at Path in
+// its filesystem, packaged as an OCI artifact, instead of the filesystem as a
+// runnable image. MediaType is the media type of the artifact's blob (a tar
+// of Path if it is a directory), and ArtifactType the media type of its
+// config, which says what kind of artifact it is.
+type Artifact struct {
+	Path         string `yaml:"path"`
+	MediaType    string `yaml:"media_type"`
+	ArtifactType string `yaml:"artifact_type"`
+}
+
+// Wasm says that a layer's output is the wasm module at Module in its
+// filesystem, packaged as a wasm OCI artifact for the wasi version WASI
+// ("preview1", the default, or "preview2").
+type Wasm struct {
+	Module string `yaml:"module"`
+	WASI   string `yaml:"wasi"`
+}
+
+// OS returns the "os" of the wasm module's OCI config, for its wasi
+// version.
+func (w Wasm) OS() (string, error) {
+	switch w.WASI {
+	case "", "preview1":
+		return "wasip1", nil
+	case "preview2":
+		return "wasip2", nil
+	default:
+		return "", errors.Errorf("unknown wasi version %s, it should be preview1 or preview2", w.WASI)
+	}
+}
+
+func getImportGPGFromInterface(v interface{}) (*ImportGPG, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.Errorf("import gpg should be a map with keyring and sig, not %#v", v)
+	}
+
+	gpg := &ImportGPG{}
+	if m["keyring"] == nil {
+		return nil, errors.Errorf("import gpg needs a keyring")
+	}
+	gpg.Keyring = fmt.Sprintf("%v", m["keyring"])
+	if m["sig"] != nil {
+		gpg.Sig = fmt.Sprintf("%v", m["sig"])
+	}
+
+	return gpg, nil
+}
+
+func getImportMirrorsFromInterface(v interface{}) ([]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.Errorf("import mirrors should be a list of urls, not %#v", v)
+	}
+
+	mirrors := []string{}
+	for _, mirror := range list {
+		url, ok := mirror.(string)
+		if !ok {
+			return nil, errors.Errorf("import mirror should be a url, not %#v", mirror)
+		}
+		mirrors = append(mirrors, url)
+	}
+
+	return mirrors, nil
 }
 
 type OverlayDir struct {
@@ -43,11 +145,150 @@ type OverlayDir struct {
 type OverlayDirs []OverlayDir
 type Imports []Import
 
+const (
+	// BindCacheNone means the bind's contents are not considered when
+	// deciding whether to use the cache.
+	BindCacheNone = "none"
+	// BindCacheMtime means the bind is considered changed when the
+	// size, mtime or metadata of any file under it changes.
+	BindCacheMtime = "mtime"
+	// BindCacheContent means the bind is considered changed when the
+	// contents of any file under it changes.
+	BindCacheContent = "content"
+)
+
+type Bind struct {
+	Source string `yaml:"source"`
+	Dest   string `yaml:"dest"`
+	// BindCache is one of the BindCache* constants, or empty if the user
+	// didn't specify it, in which case the layer is always rebuilt.
+	BindCache string `yaml:"bind_cache"`
+}
+
+type Binds []Bind
+
+func getBindFromInterface(v interface{}) (Bind, error) {
+	m, ok := v.(map[interface{}]interface{})
+	if ok {
+		b := Bind{}
+		for k, val := range m {
+			if val == nil {
+				continue
+			}
+
+			switch k {
+			case "source":
+				b.Source = fmt.Sprintf("%v", val)
+			case "dest":
+				b.Dest = fmt.Sprintf("%v", val)
+			case "bind_cache":
+				b.BindCache = fmt.Sprintf("%v", val)
+			default:
+				return Bind{}, errors.Errorf("unknown bind directive %v", k)
+			}
+		}
+		return b, nil
+	}
+
+	s, ok := v.(string)
+	if ok {
+		parts := strings.Split(s, "->")
+		if len(parts) != 1 && len(parts) != 2 {
+			return Bind{}, errors.Errorf("invalid bind mount %s", s)
+		}
+
+		b := Bind{Source: strings.TrimSpace(parts[0])}
+		if len(parts) == 2 {
+			b.Dest = strings.TrimSpace(parts[1])
+		}
+		return b, nil
+	}
+
+	return Bind{}, errors.Errorf("Didn't find a matching type for: %#v", v)
+}
+
+// Custom UnmarshalYAML from string/map/slice of strings/slice of maps into Binds
+func (bs *Binds) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var data interface{}
+	if err := unmarshal(&data); err != nil {
+		return err
+	}
+
+	binds, ok := data.([]interface{})
+	if !ok {
+		if data == nil {
+			return nil
+		}
+		binds = []interface{}{data}
+	}
+
+	for _, v := range binds {
+		b, err := getBindFromInterface(v)
+		if err != nil {
+			return err
+		}
+		*bs = append(*bs, b)
+	}
+
+	return nil
+}
+
+// RunStep is one of a layer's run_steps: a named part of its run whose result
+// is cached separately, so that changing a step only reruns it and the steps
+// after it.
+type RunStep struct {
+	Name string      `yaml:"name"`
+	Run  interface{} `yaml:"run"`
+	// not part of the json the step's cache key is computed from unless
+	// it is set, so that existing keys stay valid
+	Interactive bool `yaml:"interactive" json:",omitempty"`
+	// how often the step is retried doesn't change its result
+	Retries *Retries `yaml:"retries" json:"-" hash:"ignore"`
+}
+
+// Retries says that a run (or run step) which fails is attempted again,
+// after waiting Delay (e.g. "10s"), up to Attempts times in all. Whatever a
+// failed attempt changed is thrown away before the next one.
+type Retries struct {
+	Attempts int    `yaml:"attempts"`
+	Delay    string `yaml:"delay"`
+}
+
+// Parse returns how many times to attempt a run, and how long to wait
+// between attempts. A nil Retries means a single attempt.
+func (r *Retries) Parse() (int, time.Duration, error) {
+	if r == nil {
+		return 1, 0, nil
+	}
+
+	if r.Attempts < 1 {
+		return 0, 0, errors.Errorf("retries must have at least one attempt, not %d", r.Attempts)
+	}
+
+	delay := time.Duration(0)
+	if r.Delay != "" {
+		var err error
+		delay, err = time.ParseDuration(r.Delay)
+		if err != nil {
+			return 0, 0, errors.Wrapf(err, "bad retry delay %s", r.Delay)
+		}
+		if delay < 0 {
+			return 0, 0, errors.Errorf("negative retry delay %s", r.Delay)
+		}
+	}
+
+	return r.Attempts, delay, nil
+}
+
 type Layer struct {
 	From               *ImageSource      `yaml:"from"`
 	Import             Imports           `yaml:"import"`
 	OverlayDirs        OverlayDirs       `yaml:"overlay_dirs"`
 	Run                interface{}       `yaml:"run"`
+	RunSteps           []RunStep         `yaml:"run_steps"`
+	Interactive        bool              `yaml:"interactive"`
+	Retries            *Retries          `yaml:"retries" hash:"ignore"`
+	CacheTTL           string            `yaml:"cache_ttl" hash:"ignore"`
 	Cmd                interface{}       `yaml:"cmd"`
 	Entrypoint         interface{}       `yaml:"entrypoint"`
 	FullCommand        interface{}       `yaml:"full_command"`
@@ -59,8 +300,28 @@ type Layer struct {
 	GenerateLabels     interface{}       `yaml:"generate_labels"`
 	WorkingDir         string            `yaml:"working_dir"`
 	BuildOnly          bool              `yaml:"build_only"`
-	Binds              interface{}       `yaml:"binds"`
+	Binds              Binds             `yaml:"binds"`
+	CacheDirs          []string          `yaml:"cache"`
+	WritablePaths      []string          `yaml:"writable_paths"`
+	BuildCaches        []string          `yaml:"build_caches"`
+	Packages           *Packages         `yaml:"packages"`
+	Harden             *Harden           `yaml:"harden"`
 	RuntimeUser        string            `yaml:"runtime_user"`
+	Users              []User            `yaml:"users"`
+	InheritConfig      bool              `yaml:"inherit_config"`
+	MergeWithParent    bool              `yaml:"merge_with_parent"`
+	Umask              interface{}       `yaml:"umask"`
+	Timezone           string            `yaml:"timezone"`
+	Locale             string            `yaml:"locale"`
+	LayerType          interface{}       `yaml:"layer_type"`
+	Extends            string            `yaml:"extends"`
+	CommandMerge       string            `yaml:"command_merge"`
+	Artifact           *Artifact         `yaml:"artifact"`
+	Wasm               *Wasm             `yaml:"wasm"`
+	Output             *Output           `yaml:"output"`
+	Outputs            map[string]string `yaml:"outputs"`
+	Author             string            `yaml:"author"`
+	Maintainer         string            `yaml:"maintainer"`
 	referenceDirectory string            // Location of the directory where the layer is defined
 }
 
@@ -74,7 +335,15 @@ func getImportFromInterface(v interface{}) (Import, error) {
 		} else {
 			hash = fmt.Sprintf("%v", m["hash"])
 		}
-		return Import{Hash: hash, Path: fmt.Sprintf("%v", m["path"])}, nil
+		gpg, err := getImportGPGFromInterface(m["gpg"])
+		if err != nil {
+			return Import{}, err
+		}
+		mirrors, err := getImportMirrorsFromInterface(m["mirrors"])
+		if err != nil {
+			return Import{}, err
+		}
+		return Import{Hash: hash, Path: fmt.Sprintf("%v", m["path"]), GPG: gpg, Mirrors: mirrors}, nil
 	}
 
 	m2, ok := v.(map[string]interface{})
@@ -183,11 +452,140 @@ func buildEnv(passThrough []string, newEnv map[string]string,
 }
 
 func (l *Layer) BuildEnvironment(name string) (map[string]string, error) {
-	env, err := buildEnv(l.BuildEnvPt, l.BuildEnv, os.Environ)
+	cacheEnv, err := l.parseBuildCaches()
+	if err != nil {
+		return nil, err
+	}
+
+	// build_env can still point things somewhere else
+	newEnv := mergeStringMaps(mergeStringMaps(cacheEnv, l.localeEnv()), l.BuildEnv)
+	env, err := buildEnv(l.BuildEnvPt, newEnv, os.Environ)
 	env["STACKER_LAYER_NAME"] = name
 	return env, err
 }
 
+// localeEnv returns the environment that sets the layer's timezone and
+// locale.
+func (l *Layer) localeEnv() map[string]string {
+	env := map[string]string{}
+	if l.Timezone != "" {
+		env["TZ"] = l.Timezone
+	}
+	if l.Locale != "" {
+		env["LANG"] = l.Locale
+		env["LC_ALL"] = l.Locale
+	}
+	return env
+}
+
+// ParseCacheTTL returns how long the layer's cache entry is used for before
+// it's rebuilt anyway, or 0 if it's used for as long as its inputs don't
+// change.
+func (l *Layer) ParseCacheTTL() (time.Duration, error) {
+	if l.CacheTTL == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(l.CacheTTL)
+	if err != nil {
+		return 0, errors.Wrapf(err, "bad cache_ttl %s", l.CacheTTL)
+	}
+
+	if ttl <= 0 {
+		return 0, errors.Errorf("cache_ttl %s isn't positive", l.CacheTTL)
+	}
+
+	return ttl, nil
+}
+
+// ParseUmask checks that the layer's umask is a mode, and returns it in the
+// canonical four digit octal form, or "" if the layer doesn't set one. yaml
+// makes an unquoted 022 the number 18, so numbers are taken as the mode
+// itself, and strings as its octal digits.
+func (l *Layer) ParseUmask() (string, error) {
+	var umask uint64
+	var err error
+	switch v := l.Umask.(type) {
+	case nil:
+		return "", nil
+	case int:
+		umask = uint64(v)
+		if v < 0 {
+			err = errors.Errorf("negative umask")
+		}
+	case string:
+		umask, err = strconv.ParseUint(v, 8, 32)
+	default:
+		err = errors.Errorf("unknown umask type %T", v)
+	}
+
+	if err != nil || umask > 0777 {
+		return "", errors.Errorf("bad umask %v, it should be an octal mode like 0022", l.Umask)
+	}
+
+	return fmt.Sprintf("%04o", umask), nil
+}
+
+// BuildCachesDir is where build_caches' cache directories are mounted.
+const BuildCachesDir = "/var/cache/stacker"
+
+// buildCaches are the tools build_caches knows about, with the environment
+// variables that set where each one keeps its cache, and the directory in
+// BuildCachesDir they're set to.
+var buildCaches = map[string]map[string]string{
+	"go":     {"GOCACHE": "go-build", "GOMODCACHE": "go-mod"},
+	"ccache": {"CCACHE_DIR": "ccache"},
+	"pip":    {"PIP_CACHE_DIR": "pip"},
+	"npm":    {"npm_config_cache": "npm"},
+}
+
+// parseBuildCaches returns the environment that points the tools in the
+// layer's build_caches at their cache directories.
+func (l *Layer) parseBuildCaches() (map[string]string, error) {
+	env := map[string]string{}
+	for _, tool := range l.BuildCaches {
+		vars, ok := buildCaches[tool]
+		if !ok {
+			return nil, errors.Errorf("unknown build cache %s", tool)
+		}
+
+		for k, v := range vars {
+			env[k] = path.Join(BuildCachesDir, v)
+		}
+	}
+
+	return env, nil
+}
+
+// ParseAuthor returns the author of the layer: its author (or maintainer,
+// which is the same thing), or the stacker config's author, or the user
+// running stacker as user@host, along with whether it was set explicitly
+// (i.e. it isn't the latter).
+func (l *Layer) ParseAuthor(sc StackerConfig) (string, bool, error) {
+	for _, a := range []string{l.Author, l.Maintainer, sc.Author} {
+		if a != "" {
+			return a, true, nil
+		}
+	}
+
+	username := os.Getenv("SUDO_USER")
+	if username == "" {
+		u, err := user.Current()
+		if err != nil {
+			return "", false, errors.WithStack(err)
+		}
+
+		username = u.Username
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return "", false, errors.WithStack(err)
+	}
+
+	return fmt.Sprintf("%s@%s", username, host), false, nil
+}
+
 func (l *Layer) ParseCmd() ([]string, error) {
 	return l.getStringOrStringSlice(l.Cmd, func(s string) ([]string, error) {
 		return shlex.Split(s, true)
@@ -200,12 +598,78 @@ func (l *Layer) ParseEntrypoint() ([]string, error) {
 	})
 }
 
+// ParseCommandMerge returns how the layer's cmd and entrypoint are merged
+// with the ones of its base image: with CommandMergeInherit (the default),
+// the ones the layer sets replace the base image's, and the others are
+// inherited; with CommandMergeReplace, the layer's are used as they are, so
+// the ones it doesn't set are cleared; and with CommandMergeAppend, the
+// layer's are appended to the base image's.
+func (l *Layer) ParseCommandMerge() (string, error) {
+	switch l.CommandMerge {
+	case "":
+		return CommandMergeInherit, nil
+	case CommandMergeInherit, CommandMergeReplace, CommandMergeAppend:
+		return l.CommandMerge, nil
+	default:
+		return "", errors.Errorf("unknown command_merge %s, it should be one of: %s, %s, %s", l.CommandMerge, CommandMergeInherit, CommandMergeReplace, CommandMergeAppend)
+	}
+}
+
 func (l *Layer) ParseFullCommand() ([]string, error) {
 	return l.getStringOrStringSlice(l.FullCommand, func(s string) ([]string, error) {
 		return shlex.Split(s, true)
 	})
 }
 
+// Dependencies returns the names of the layers this layer is built on or
+// imports from (with stacker:// or stacker-output://, or stacker-oci://, in
+// which case they may be images that were already in the OCI output), each
+// once, in the order they appear in its definition.
+func (l *Layer) Dependencies() ([]string, error) {
+	deps := []string{}
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !seen[name] {
+			deps = append(deps, name)
+			seen[name] = true
+		}
+	}
+
+	if l.From != nil {
+		switch l.From.Type {
+		case BuiltLayer:
+			add(l.From.Tag)
+		case TarLayer:
+			url, err := NewDockerishUrl(l.From.Url)
+			if err != nil {
+				return nil, err
+			}
+			if url.Scheme == "stacker" {
+				add(url.Host)
+			}
+		}
+	}
+
+	imports, err := l.ParseImport()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, imp := range imports {
+		url, err := NewDockerishUrl(imp.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		switch url.Scheme {
+		case "stacker", "stacker-output", "stacker-oci":
+			add(url.Host)
+		}
+	}
+
+	return deps, nil
+}
+
 func (l *Layer) ParseImport() (Imports, error) {
 	var absImports Imports
 	var absImport Import
@@ -215,6 +679,29 @@ func (l *Layer) ParseImport() (Imports, error) {
 			return nil, err
 		}
 		absImport = Import{Hash: rawImport.Hash, Path: absImportPath}
+		for _, mirror := range rawImport.Mirrors {
+			absMirror, err := l.getAbsPath(mirror)
+			if err != nil {
+				return nil, err
+			}
+			absImport.Mirrors = append(absImport.Mirrors, absMirror)
+		}
+		if rawImport.GPG != nil {
+			absImport.GPG = &ImportGPG{}
+			absImport.GPG.Keyring, err = l.getAbsPath(rawImport.GPG.Keyring)
+			if err != nil {
+				return nil, err
+			}
+
+			sig := rawImport.GPG.Sig
+			if sig == "" {
+				sig = rawImport.Path + ".asc"
+			}
+			absImport.GPG.Sig, err = l.getAbsPath(sig)
+			if err != nil {
+				return nil, err
+			}
+		}
 		absImports = append(absImports, absImport)
 	}
 	return absImports, nil
@@ -234,38 +721,132 @@ func (l *Layer) ParseOverlayDirs() (OverlayDirs, error) {
 	return absOverlayDirs, nil
 }
 
-func (l *Layer) ParseBinds() (map[string]string, error) {
-	rawBinds, err := l.getStringOrStringSlice(l.Binds, func(s string) ([]string, error) {
-		return []string{s}, nil
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	absBinds := make(map[string]string, len(rawBinds))
-	for _, bind := range rawBinds {
-		parts := strings.Split(bind, "->")
-		if len(parts) != 1 && len(parts) != 2 {
-			return nil, errors.Errorf("invalid bind mount %s", bind)
+// ParseBinds returns the binds for this layer, with absolute source paths and
+// the destination filled in.
+func (l *Layer) ParseBinds() (Binds, error) {
+	absBinds := Binds{}
+	for _, bind := range l.Binds {
+		if bind.Source == "" {
+			return nil, errors.Errorf("bind mount with no source")
 		}
 
-		source := strings.TrimSpace(parts[0])
-		target := source
+		switch bind.BindCache {
+		case "", BindCacheNone, BindCacheMtime, BindCacheContent:
+		default:
+			return nil, errors.Errorf("invalid bind_cache %s for %s", bind.BindCache, bind.Source)
+		}
 
-		absSource, err := l.getAbsPath(source)
+		absSource, err := l.getAbsPath(bind.Source)
 		if err != nil {
 			return nil, err
 		}
 
-		if len(parts) == 2 {
-			target = strings.TrimSpace(parts[1])
+		target := bind.Dest
+		if target == "" {
+			target = bind.Source
 		}
 
-		absBinds[absSource] = target
+		absBinds = append(absBinds, Bind{Source: absSource, Dest: target, BindCache: bind.BindCache})
 	}
 
 	return absBinds, nil
+}
+
+// ParseOutputs returns the layer's outputs: the names later layers import
+// them by (with stacker-output://<layer>/<name>), and the cleaned paths in its
+// filesystem they're copied from.
+func (l *Layer) ParseOutputs() (map[string]string, error) {
+	outputs := map[string]string{}
+	for name, p := range l.Outputs {
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return nil, errors.Errorf("bad output name %q", name)
+		}
+
+		if !filepath.IsAbs(p) {
+			return nil, errors.Errorf("output %s's path %s must be absolute", name, p)
+		}
+
+		p = filepath.Clean(p)
+		if p == "/" {
+			return nil, errors.Errorf("output %s can't be the whole filesystem", name)
+		}
 
+		outputs[name] = p
+	}
+
+	return outputs, nil
+}
+
+// ParseCacheDirs returns the cleaned paths in the layer's cache directive,
+// and the cache directories of its build_caches: the directories that get a
+// persistent cache mounted over them while it is built.
+func (l *Layer) ParseCacheDirs() ([]string, error) {
+	dirs := []string{}
+	for _, dir := range l.CacheDirs {
+		if !filepath.IsAbs(dir) {
+			return nil, errors.Errorf("cache directory %s must be an absolute path", dir)
+		}
+
+		dir = filepath.Clean(dir)
+		if dir == "/" {
+			return nil, errors.Errorf("can't use / as a cache directory")
+		}
+
+		dirs = append(dirs, dir)
+	}
+
+	cacheEnv, err := l.parseBuildCaches()
+	if err != nil {
+		return nil, err
+	}
+
+	buildCacheDirs := []string{}
+	for _, dir := range cacheEnv {
+		buildCacheDirs = append(buildCacheDirs, dir)
+	}
+	sort.Strings(buildCacheDirs)
+
+	return append(dirs, buildCacheDirs...), nil
+}
+
+// ParseWritablePaths returns the cleaned paths in the layer's writable_paths:
+// if there are any, its rootfs is read only while it is built, except for
+// these directories.
+func (l *Layer) ParseWritablePaths() ([]string, error) {
+	dirs := []string{}
+	seen := map[string]bool{}
+	for _, dir := range l.WritablePaths {
+		if !filepath.IsAbs(dir) {
+			return nil, errors.Errorf("writable path %s must be an absolute path", dir)
+		}
+
+		dir = filepath.Clean(dir)
+		if dir == "/" {
+			return nil, errors.Errorf("can't use / as a writable path, leave out writable_paths instead")
+		}
+
+		// e.g. both the layer and the one it extends have it
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+
+		dirs = append(dirs, dir)
+	}
+
+	return dirs, nil
+}
+
+// AlwaysRebuild returns true if any of the binds doesn't specify how it should
+// be cached.
+func (bs Binds) AlwaysRebuild() bool {
+	for _, b := range bs {
+		if b.BindCache == "" {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (l *Layer) ParseRun() ([]string, error) {
@@ -274,12 +855,255 @@ func (l *Layer) ParseRun() ([]string, error) {
 	})
 }
 
+// ParseRunSteps returns the layer's run_steps, with each step's run parsed
+// into a []string.
+func (l *Layer) ParseRunSteps() ([]RunStep, error) {
+	if len(l.RunSteps) == 0 {
+		return nil, nil
+	}
+
+	if l.Run != nil {
+		return nil, errors.Errorf("run and run_steps can't both be specified")
+	}
+
+	steps := []RunStep{}
+	seen := map[string]bool{}
+
+	// the packages are installed by a step of their own, so that it's
+	// cached like the others, which is retried like the layer's run
+	packages, err := l.ParsePackages()
+	if err != nil {
+		return nil, err
+	}
+	if packages != "" {
+		steps = append(steps, RunStep{Name: "packages", Run: []string{packages}, Retries: l.Retries})
+		seen["packages"] = true
+	}
+
+	for _, step := range l.RunSteps {
+		if step.Name == "" {
+			return nil, errors.Errorf("run step with no name")
+		}
+
+		if seen[step.Name] {
+			return nil, errors.Errorf("duplicate run step %s", step.Name)
+		}
+		seen[step.Name] = true
+
+		run, err := l.getStringOrStringSlice(step.Run, func(s string) ([]string, error) {
+			return []string{s}, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(run) == 0 {
+			return nil, errors.Errorf("run step %s has nothing to run", step.Name)
+		}
+
+		if _, _, err := step.Retries.Parse(); err != nil {
+			return nil, errors.Wrapf(err, "run step %s", step.Name)
+		}
+
+		steps = append(steps, RunStep{Name: step.Name, Run: run, Interactive: step.Interactive, Retries: step.Retries})
+	}
+
+	return steps, nil
+}
+
 func (l *Layer) ParseGenerateLabels() ([]string, error) {
 	return l.getStringOrStringSlice(l.GenerateLabels, func(s string) ([]string, error) {
 		return []string{s}, nil
 	})
 }
 
+// ParseLayerType returns the output layer types this layer's layer_type asks
+// for, or nil if it doesn't specify any, in which case the ones given on the
+// command line should be used.
+func (l *Layer) ParseLayerType() ([]LayerType, error) {
+	if l.LayerType == nil {
+		return nil, nil
+	}
+
+	lts, err := l.getStringOrStringSlice(l.LayerType, func(s string) ([]string, error) {
+		return []string{s}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lts) == 0 {
+		return nil, errors.Errorf("layer_type must have at least one layer type")
+	}
+
+	return NewLayerTypes(lts)
+}
+
+// mergeStringMaps returns a new map with the contents of parent overridden by
+// child.
+func mergeStringMaps(parent map[string]string, child map[string]string) map[string]string {
+	if parent == nil && child == nil {
+		return nil
+	}
+
+	merged := map[string]string{}
+	for k, v := range parent {
+		merged[k] = v
+	}
+	for k, v := range child {
+		merged[k] = v
+	}
+	return merged
+}
+
+// mergeStringOrStringSlice concatenates two directives which can be either a
+// string or a list of strings.
+func (l *Layer) mergeStringOrStringSlice(parent interface{}, child interface{}) (interface{}, error) {
+	if parent == nil {
+		return child, nil
+	}
+
+	if child == nil {
+		return parent, nil
+	}
+
+	identity := func(s string) ([]string, error) {
+		return []string{s}, nil
+	}
+
+	parentStrs, err := l.getStringOrStringSlice(parent, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	childStrs, err := l.getStringOrStringSlice(child, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(parentStrs, childStrs...), nil
+}
+
+// extend merges parent's definition into this layer, as specified by this
+// layer's extends: directive. Lists (imports, run, binds, etc.) are
+// concatenated with the parent's entries first, maps (environment, labels,
+// etc.) are merged with this layer's values taking precedence, and scalars
+// (from, cmd, working_dir, etc.) are inherited only if this layer doesn't
+// specify them. build_only is never inherited.
+func (l *Layer) extend(parent *Layer) error {
+	var err error
+
+	if l.From == nil {
+		l.From = parent.From
+	}
+
+	l.Import = append(append(Imports{}, parent.Import...), l.Import...)
+	l.OverlayDirs = append(append(OverlayDirs{}, parent.OverlayDirs...), l.OverlayDirs...)
+	l.BuildEnvPt = append(append([]string{}, parent.BuildEnvPt...), l.BuildEnvPt...)
+	l.Volumes = append(append([]string{}, parent.Volumes...), l.Volumes...)
+
+	l.BuildEnv = mergeStringMaps(parent.BuildEnv, l.BuildEnv)
+	l.Environment = mergeStringMaps(parent.Environment, l.Environment)
+	l.Labels = mergeStringMaps(parent.Labels, l.Labels)
+	l.Outputs = mergeStringMaps(parent.Outputs, l.Outputs)
+
+	l.Run, err = l.mergeStringOrStringSlice(parent.Run, l.Run)
+	if err != nil {
+		return err
+	}
+
+	l.RunSteps = append(append([]RunStep{}, parent.RunSteps...), l.RunSteps...)
+
+	l.GenerateLabels, err = l.mergeStringOrStringSlice(parent.GenerateLabels, l.GenerateLabels)
+	if err != nil {
+		return err
+	}
+
+	l.Binds = append(append(Binds{}, parent.Binds...), l.Binds...)
+	l.CacheDirs = append(append([]string{}, parent.CacheDirs...), l.CacheDirs...)
+	l.WritablePaths = append(append([]string{}, parent.WritablePaths...), l.WritablePaths...)
+	l.Users = append(append([]User{}, parent.Users...), l.Users...)
+	l.BuildCaches = append(append([]string{}, parent.BuildCaches...), l.BuildCaches...)
+
+	if l.Cmd == nil {
+		l.Cmd = parent.Cmd
+	}
+
+	if l.Entrypoint == nil {
+		l.Entrypoint = parent.Entrypoint
+	}
+
+	if l.FullCommand == nil {
+		l.FullCommand = parent.FullCommand
+	}
+
+	if l.WorkingDir == "" {
+		l.WorkingDir = parent.WorkingDir
+	}
+
+	if l.RuntimeUser == "" {
+		l.RuntimeUser = parent.RuntimeUser
+	}
+
+	if l.LayerType == nil {
+		l.LayerType = parent.LayerType
+	}
+
+	if l.Retries == nil {
+		l.Retries = parent.Retries
+	}
+
+	if l.CacheTTL == "" {
+		l.CacheTTL = parent.CacheTTL
+	}
+
+	if l.Packages == nil {
+		l.Packages = parent.Packages
+	}
+
+	if l.Harden == nil {
+		l.Harden = parent.Harden
+	}
+
+	if l.Umask == nil {
+		l.Umask = parent.Umask
+	}
+
+	if l.Timezone == "" {
+		l.Timezone = parent.Timezone
+	}
+
+	if l.Locale == "" {
+		l.Locale = parent.Locale
+	}
+
+	if l.CommandMerge == "" {
+		l.CommandMerge = parent.CommandMerge
+	}
+
+	if l.Author == "" && l.Maintainer == "" {
+		l.Author = parent.Author
+		l.Maintainer = parent.Maintainer
+	}
+
+	l.InheritConfig = l.InheritConfig || parent.InheritConfig
+	l.Interactive = l.Interactive || parent.Interactive
+
+	return nil
+}
+
+// IsArtifact is true if the layer's output is an artifact, rather than a
+// runnable image.
+func (l *Layer) IsArtifact() bool {
+	return l.Artifact != nil || l.Wasm != nil || (l.Output != nil && l.Output.Artifact)
+}
+
+// ReferenceDirectory is the directory relative to which the paths in this
+// layer's definition are resolved.
+func (l *Layer) ReferenceDirectory() string {
+	return l.referenceDirectory
+}
+
 func (l *Layer) getAbsPath(path string) (string, error) {
 	parsedPath, err := NewDockerishUrl(path)
 	if err != nil {
@@ -0,0 +1,158 @@
+package types
+
+import (
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+const (
+	// OutputDisk is the type of outputs that are bootable disk images.
+	OutputDisk = "disk"
+
+	// OutputCpio is the type of outputs that are cpio archives, e.g. to
+	// boot as an initramfs.
+	OutputCpio = "cpio"
+
+	// OutputCasync is the type of outputs that are casync indexes of the
+	// filesystem, whose chunks are in a chunk store.
+	OutputCasync = "casync"
+)
+
+// Output is a file a layer's filesystem is packed into, besides (or for
+// build only layers, instead of) its OCI image.
+type Output struct {
+	Type string `yaml:"type"`
+	// Path is where the output is written, by default <layer>.<ext> in
+	// the directory the OCI layout is in.
+	Path string `yaml:"path"`
+
+	// Artifact, for cpio archives and casync indexes, publishes the
+	// archive (or index) as the layer's OCI artifact, instead of writing
+	// it to Path.
+	Artifact bool `yaml:"artifact"`
+
+	// Format, Size, Filesystem and Hooks are for disk images: the
+	// format (raw or qcow2) and size of the disk, the filesystem of its
+	// partition, and the programs that install a bootloader on it.
+	Format     string   `yaml:"format"`
+	Size       string   `yaml:"size"`
+	Filesystem string   `yaml:"filesystem"`
+	Hooks      []string `yaml:"hooks"`
+
+	// Compression is what cpio archives are compressed with: none (the
+	// default), gzip or zstd.
+	Compression string `yaml:"compression"`
+
+	// Store and ChunkSize are for casync indexes: the chunk store the
+	// chunks are added to, by default <layer>.castr next to the OCI
+	// layout, and the average size of the chunks.
+	Store     string `yaml:"store"`
+	ChunkSize string `yaml:"chunk_size"`
+}
+
+// UnmarshalYAML lets an output be just its type, e.g. output: disk.
+func (o *Output) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var outputType string
+	if err := unmarshal(&outputType); err == nil {
+		*o = Output{Type: outputType}
+		return nil
+	}
+
+	type output Output
+	return unmarshal((*output)(o))
+}
+
+// ParseOutput returns the layer's output with its paths made absolute and its
+// defaults filled in, or nil if it doesn't have one.
+func (l *Layer) ParseOutput() (*Output, error) {
+	if l.Output == nil {
+		return nil, nil
+	}
+
+	o := *l.Output
+	switch o.Type {
+	case OutputDisk:
+		if o.Format == "" {
+			o.Format = "raw"
+		}
+		if o.Format != "raw" && o.Format != "qcow2" {
+			return nil, errors.Errorf("unknown disk format %s, it should be raw or qcow2", o.Format)
+		}
+
+		if o.Filesystem == "" {
+			o.Filesystem = "ext4"
+		}
+		switch o.Filesystem {
+		case "ext2", "ext3", "ext4":
+		default:
+			return nil, errors.Errorf("unsupported disk filesystem %s, it should be ext2, ext3 or ext4", o.Filesystem)
+		}
+
+		if o.Size != "" {
+			if _, err := humanize.ParseBytes(o.Size); err != nil {
+				return nil, errors.Wrapf(err, "bad disk size %s", o.Size)
+			}
+		}
+
+		o.Hooks = []string{}
+		for _, hook := range l.Output.Hooks {
+			absHook, err := l.getAbsPath(hook)
+			if err != nil {
+				return nil, err
+			}
+			o.Hooks = append(o.Hooks, absHook)
+		}
+	case OutputCpio:
+		if o.Compression == "" {
+			o.Compression = "none"
+		}
+		switch o.Compression {
+		case "none", "gzip", "zstd":
+		default:
+			return nil, errors.Errorf("unknown cpio compression %s, it should be none, gzip or zstd", o.Compression)
+		}
+	case OutputCasync:
+		if o.ChunkSize != "" {
+			size, err := humanize.ParseBytes(o.ChunkSize)
+			if err != nil {
+				return nil, errors.Wrapf(err, "bad chunk size %s", o.ChunkSize)
+			}
+			// the chunker's sizes are in KiB, and the smallest
+			// chunks are a quarter of the average
+			if size < 4*1024 || size%1024 != 0 {
+				return nil, errors.Errorf("chunk size %s should be a multiple of 1KiB, and at least 4KiB", o.ChunkSize)
+			}
+		}
+
+		// stores can also be urls, e.g. s3+https://, which are left
+		// as they are
+		if o.Store != "" {
+			absStore, err := l.getAbsPath(o.Store)
+			if err != nil {
+				return nil, err
+			}
+			o.Store = absStore
+		}
+	default:
+		return nil, errors.Errorf("unknown output type %s", o.Type)
+	}
+
+	if o.Artifact {
+		if o.Type == OutputDisk {
+			return nil, errors.Errorf("%s outputs can't be artifacts", o.Type)
+		}
+		if o.Path != "" {
+			return nil, errors.Errorf("artifact outputs aren't written to a path")
+		}
+	}
+
+	if o.Path != "" {
+		absPath, err := l.getAbsPath(o.Path)
+		if err != nil {
+			return nil, err
+		}
+		o.Path = absPath
+	}
+
+	return &o, nil
+}
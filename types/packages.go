@@ -0,0 +1,110 @@
+package types
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Packages are the distro packages a layer installs with a package manager,
+// e.g. manager: apt and install: [curl, ca-certificates].
+type Packages struct {
+	Manager string   `yaml:"manager"`
+	Install []string `yaml:"install"`
+}
+
+// packageManager is how to install packages with a package manager without
+// leaving its caches in the layer.
+type packageManager struct {
+	// run before installing anything, e.g. to fetch the package lists
+	setup []string
+	// the install command, which the packages are appended to
+	install string
+	// run after installing, to clean up what the install left behind
+	cleanup []packageCleanup
+}
+
+// packageCleanup is a command that empties a package manager's cache dir.
+// It isn't run if dir is (or is in, or has in it) one of the layer's cache
+// directories, since the point of those is keeping what's in them.
+type packageCleanup struct {
+	command string
+	dir     string
+}
+
+var packageManagers = map[string]packageManager{
+	"apt": {
+		setup:   []string{"apt-get update"},
+		install: "DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends",
+		cleanup: []packageCleanup{
+			{"apt-get clean", "/var/cache/apt"},
+			{"rm -rf /var/lib/apt/lists/*", "/var/lib/apt/lists"},
+		},
+	},
+	"apk": {
+		// --no-cache fetches the index for the install, and doesn't
+		// keep it or the packages
+		install: "apk add --no-cache",
+	},
+	"dnf": {
+		install: "dnf install -y --setopt=install_weak_deps=False",
+		cleanup: []packageCleanup{
+			{"dnf clean all", "/var/cache/dnf"},
+		},
+	},
+}
+
+// package names and version pins (e.g. curl=7.88.1-10, curl-7.61.1), but
+// nothing the shell would do anything with
+var packageName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+:~=@/-]*$`)
+
+// ParsePackages returns the script that installs the layer's packages, or ""
+// if it has none. The layer's cache directories are kept across builds, so
+// they aren't cleaned up.
+func (l *Layer) ParsePackages() (string, error) {
+	if l.Packages == nil {
+		return "", nil
+	}
+
+	cacheDirs, err := l.ParseCacheDirs()
+	if err != nil {
+		return "", err
+	}
+
+	pm, ok := packageManagers[l.Packages.Manager]
+	if !ok {
+		return "", errors.Errorf("unknown package manager %q, it should be one of apt, apk or dnf", l.Packages.Manager)
+	}
+
+	if len(l.Packages.Install) == 0 {
+		return "", errors.Errorf("packages has nothing to install")
+	}
+
+	for _, p := range l.Packages.Install {
+		if !packageName.MatchString(p) {
+			return "", errors.Errorf("bad package name %q", p)
+		}
+	}
+
+	lines := append([]string{}, pm.setup...)
+	lines = append(lines, pm.install+" "+strings.Join(l.Packages.Install, " "))
+	for _, cleanup := range pm.cleanup {
+		if !inCacheDir(cleanup.dir, cacheDirs) {
+			lines = append(lines, cleanup.command)
+		}
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// inCacheDir returns true if dir is one of cacheDirs, is in one of them, or
+// one of them is in it.
+func inCacheDir(dir string, cacheDirs []string) bool {
+	for _, cacheDir := range cacheDirs {
+		if cacheDir == dir || strings.HasPrefix(cacheDir, dir+"/") || strings.HasPrefix(dir, cacheDir+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,288 @@
+package types
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Version is a semantic version, e.g. the tag 2.3.5 or v2.3.5.
+type Version struct {
+	Major      uint64
+	Minor      uint64
+	Patch      uint64
+	Prerelease string
+}
+
+// ParseVersion parses a MAJOR.MINOR.PATCH version, with an optional v in
+// front and -prerelease and +build suffixes (the latter is ignored).
+func ParseVersion(s string) (Version, error) {
+	v, parts, err := parsePartialVersion(s)
+	if err != nil {
+		return Version{}, err
+	}
+
+	if parts != 3 {
+		return Version{}, errors.Errorf("version %s isn't MAJOR.MINOR.PATCH", s)
+	}
+
+	return v, nil
+}
+
+// parsePartialVersion parses a version with up to three parts, any of which
+// can be x or * (as can the ones after it), and returns how many parts it
+// had, up to the first wildcard.
+func parsePartialVersion(s string) (Version, int, error) {
+	v := Version{}
+	rest := strings.TrimPrefix(s, "v")
+	rest = strings.SplitN(rest, "+", 2)[0]
+	if pieces := strings.SplitN(rest, "-", 2); len(pieces) == 2 {
+		if pieces[1] == "" {
+			return Version{}, 0, errors.Errorf("bad version %s: empty prerelease", s)
+		}
+		rest = pieces[0]
+		v.Prerelease = pieces[1]
+	}
+
+	numbers := strings.Split(rest, ".")
+	if len(numbers) > 3 || rest == "" {
+		return Version{}, 0, errors.Errorf("bad version %s", s)
+	}
+
+	fields := []*uint64{&v.Major, &v.Minor, &v.Patch}
+	parts := 0
+	for i, n := range numbers {
+		if n == "x" || n == "X" || n == "*" {
+			break
+		}
+
+		if parts != i {
+			return Version{}, 0, errors.Errorf("bad version %s: numbers after a wildcard", s)
+		}
+
+		num, err := strconv.ParseUint(n, 10, 64)
+		if err != nil {
+			return Version{}, 0, errors.Errorf("bad version %s", s)
+		}
+		*fields[i] = num
+		parts++
+	}
+
+	if v.Prerelease != "" && parts != 3 {
+		return Version{}, 0, errors.Errorf("bad version %s: only full versions can be prereleases", s)
+	}
+
+	return v, parts, nil
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		s += "-" + v.Prerelease
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 if v is older than, the same as or newer than
+// o. Prereleases are older than their release.
+func (v Version) Compare(o Version) int {
+	for _, c := range [][2]uint64{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		if c[0] < c[1] {
+			return -1
+		}
+		if c[0] > c[1] {
+			return 1
+		}
+	}
+
+	switch {
+	case v.Prerelease == o.Prerelease:
+		return 0
+	case v.Prerelease == "":
+		return 1
+	case o.Prerelease == "":
+		return -1
+	case v.Prerelease < o.Prerelease:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// next returns the first version after the ones v (with parts parts) covers,
+// e.g. 2.4.0 for 2.3.
+func (v Version) next(parts int) Version {
+	switch parts {
+	case 1:
+		return Version{Major: v.Major + 1}
+	case 2:
+		return Version{Major: v.Major, Minor: v.Minor + 1}
+	default:
+		return Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1}
+	}
+}
+
+type comparator struct {
+	op string
+	v  Version
+}
+
+func (c comparator) matches(v Version) bool {
+	cmp := v.Compare(c.v)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case ">":
+		return cmp > 0
+	case "<=":
+		return cmp <= 0
+	case "<":
+		return cmp < 0
+	default:
+		return cmp == 0
+	}
+}
+
+// VersionConstraint is a semver range, e.g. ^2.3, ~1.4.2, >=1.2 <1.5 or
+// 1.x || 2.x.
+type VersionConstraint struct {
+	source string
+	// alternatives are ORed, and the comparators in each of them ANDed
+	alternatives [][]comparator
+}
+
+// ParseVersionConstraint parses a constraint: alternatives separated by ||,
+// each of which is comparators separated by spaces or commas. A comparator is
+// a (possibly partial) version with one of the operators =, >, >=, <, <=, ^
+// (compatible with it: the same major version, or minor version for 0.x) or
+// ~ (the same minor version), or with none, which is the versions it covers,
+// e.g. 2.3 is 2.3.x.
+func ParseVersionConstraint(s string) (*VersionConstraint, error) {
+	c := &VersionConstraint{source: s}
+	for _, alternative := range strings.Split(s, "||") {
+		fields := strings.FieldsFunc(alternative, func(r rune) bool {
+			return r == ' ' || r == ','
+		})
+		if len(fields) == 0 {
+			return nil, errors.Errorf("bad version constraint %q", s)
+		}
+
+		comparators := []comparator{}
+		for _, field := range fields {
+			expanded, err := parseComparator(field)
+			if err != nil {
+				return nil, errors.Wrapf(err, "bad version constraint %q", s)
+			}
+			comparators = append(comparators, expanded...)
+		}
+		c.alternatives = append(c.alternatives, comparators)
+	}
+
+	return c, nil
+}
+
+// parseComparator returns the simple comparators one comparator of a
+// constraint means.
+func parseComparator(s string) ([]comparator, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(s, prefix) {
+			op = prefix
+			break
+		}
+	}
+
+	v, parts, err := parsePartialVersion(strings.TrimPrefix(s, op))
+	if err != nil {
+		return nil, err
+	}
+
+	if parts == 0 {
+		if op == "" || op == "=" || op == ">=" {
+			// anything
+			return []comparator{{">=", Version{}}}, nil
+		}
+		return nil, errors.Errorf("%s needs a version", s)
+	}
+
+	switch op {
+	case ">=", "<":
+		return []comparator{{op, v}}, nil
+	case ">":
+		if parts == 3 {
+			return []comparator{{op, v}}, nil
+		}
+		return []comparator{{">=", v.next(parts)}}, nil
+	case "<=":
+		if parts == 3 {
+			return []comparator{{op, v}}, nil
+		}
+		return []comparator{{"<", v.next(parts)}}, nil
+	case "^":
+		upper := v.next(3)
+		if v.Major > 0 || parts == 1 {
+			upper = v.next(1)
+		} else if v.Minor > 0 || parts == 2 {
+			upper = v.next(2)
+		}
+		return []comparator{{">=", v}, {"<", upper}}, nil
+	case "~":
+		upper := v.next(2)
+		if parts == 1 {
+			upper = v.next(1)
+		}
+		return []comparator{{">=", v}, {"<", upper}}, nil
+	default:
+		if parts == 3 {
+			return []comparator{{"=", v}}, nil
+		}
+		return []comparator{{">=", v}, {"<", v.next(parts)}}, nil
+	}
+}
+
+// Matches returns true if v is in the constraint's range. Prereleases never
+// are, unless the constraint asks for that exact version.
+func (c *VersionConstraint) Matches(v Version) bool {
+	for _, comparators := range c.alternatives {
+		matches := true
+		for _, comparator := range comparators {
+			if !comparator.matches(v) {
+				matches = false
+				break
+			}
+		}
+
+		if matches && (v.Prerelease == "" || (len(comparators) == 1 && comparators[0].op == "=")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *VersionConstraint) String() string {
+	return c.source
+}
+
+// Latest returns the newest of tags that is a version in the constraint's
+// range, and false if none of them is. Tags that aren't versions are
+// ignored.
+func (c *VersionConstraint) Latest(tags []string) (string, bool) {
+	latest := ""
+	var latestVersion Version
+	for _, tag := range tags {
+		v, err := ParseVersion(tag)
+		if err != nil || !c.Matches(v) {
+			continue
+		}
+
+		if latest == "" || v.Compare(latestVersion) > 0 {
+			latest = tag
+			latestVersion = v
+		}
+	}
+
+	return latest, latest != ""
+}
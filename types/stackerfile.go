@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/anuvu/stacker/log"
@@ -51,7 +52,27 @@ func (sf *Stackerfile) Len() int {
 	return len(sf.internal)
 }
 
-func substitute(content string, substitutions []string) (string, error) {
+// LayerLine returns the line of the stacker file that the layer name is
+// defined on, or 0 if it can't be found.
+func (sf *Stackerfile) LayerLine(name string) int {
+	keys := []string{name + ":", fmt.Sprintf("%q:", name), fmt.Sprintf("'%s':", name)}
+	for i, line := range strings.Split(sf.AfterSubstitutions, "\n") {
+		for _, key := range keys {
+			if strings.HasPrefix(line, key) {
+				return i + 1
+			}
+		}
+	}
+
+	return 0
+}
+
+// gitCommitUse matches the substitutions of STACKER_GIT_COMMIT:
+// $STACKER_GIT_COMMIT and ${{STACKER_GIT_COMMIT}} (with a default or in a
+// pipeline), but not the name on its own, e.g. in a comment.
+var gitCommitUse = regexp.MustCompile(`\$STACKER_GIT_COMMIT|\$\{\{\s*STACKER_GIT_COMMIT\s*[:|\}]`)
+
+func substitute(content string, substitutions []string, dir string) (string, error) {
 	for _, subst := range substitutions {
 		membs := strings.SplitN(subst, "=", 2)
 		if len(membs) != 2 {
@@ -65,7 +86,7 @@ func substitute(content string, substitutions []string) (string, error) {
 
 		content = strings.Replace(content, from, to, -1)
 
-		re, err := regexp.Compile(fmt.Sprintf(`\$\{\{%s(:[^\}]*)?\}\}`, membs[0]))
+		re, err := regexp.Compile(fmt.Sprintf(`\$\{\{%s(:[^\}\|]*)?\}\}`, membs[0]))
 		if err != nil {
 			return "", err
 		}
@@ -86,13 +107,23 @@ func substitute(content string, substitutions []string) (string, error) {
 		// get content without ${{}}
 		variable := content[idx[0]+3 : idx[1]-2]
 
-		membs := strings.SplitN(variable, ":", 2)
-		if len(membs) != 2 {
-			return "", errors.Errorf("no value for substitution %s", variable)
+		var value string
+		if len(splitPipeline(variable)) > 1 {
+			var err error
+			value, err = evalPipeline(variable, substitutions, dir)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			membs := strings.SplitN(variable, ":", 2)
+			if len(membs) != 2 {
+				return "", errors.Errorf("no value for substitution %s", variable)
+			}
+			value = membs[1]
 		}
 
 		buf := bytes.NewBufferString(content[:idx[0]])
-		_, err := buf.WriteString(membs[1])
+		_, err := buf.WriteString(value)
 		if err != nil {
 			return "", err
 		}
@@ -110,8 +141,14 @@ func substitute(content string, substitutions []string) (string, error) {
 // NewStackerfile creates a new stackerfile from the given path. substitutions
 // is a list of KEY=VALUE pairs of things to substitute. Note that this is
 // explicitly not a map, because the substitutions are performed one at a time
-// in the order that they are given.
+// in the order that they are given. Errors it returns are user errors, unless
+// e.g. the stacker file couldn't be downloaded.
 func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, error) {
+	sf, err := newStackerfile(stackerfile, substitutions)
+	return sf, WithKind(UserError, err)
+}
+
+func newStackerfile(stackerfile string, substitutions []string) (*Stackerfile, error) {
 	var err error
 
 	sf := Stackerfile{}
@@ -153,7 +190,7 @@ func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, e
 		defer resp.Body.Close()
 
 		if resp.StatusCode != 200 {
-			return nil, errors.Errorf("stackerfile: couldn't download %s: %s", stackerfile, resp.Status)
+			return nil, KindErrorf(NetworkError, "stackerfile: couldn't download %s: %s", stackerfile, resp.Status)
 		}
 
 		raw, err = ioutil.ReadAll(resp.Body)
@@ -165,7 +202,17 @@ func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, e
 		// Continue to use the working directory
 	}
 
-	content, err := substitute(string(raw), substitutions)
+	// only shell out to git if someone actually wants the commit and
+	// didn't supply it themselves
+	if gitCommitUse.Match(raw) && !hasSubstitution(substitutions, "STACKER_GIT_COMMIT") {
+		commit, err := gitCommit(sf.ReferenceDirectory)
+		if err != nil {
+			return nil, err
+		}
+		substitutions = append(append([]string{}, substitutions...), fmt.Sprintf("STACKER_GIT_COMMIT=%s", commit))
+	}
+
+	content, err := substituteLayers(string(raw), substitutions, sf.ReferenceDirectory)
 	if err != nil {
 		return nil, err
 	}
@@ -222,6 +269,19 @@ func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, e
 				return nil, errors.Errorf("stackerfile: unknown directive %s", directive.Key.(string))
 			}
 
+			// the duplicates are gone once this is unmarshalled into a
+			// map, so they have to be found here
+			if directive.Key.(string) == "environment" {
+				env, _ := directive.Value.(yaml.MapSlice)
+				seen := map[interface{}]bool{}
+				for _, kv := range env {
+					if seen[kv.Key] {
+						return nil, errors.Errorf("%s: environment: %v is set more than once", e.Key, kv.Key)
+					}
+					seen[kv.Key] = true
+				}
+			}
+
 			if directive.Key.(string) == "from" {
 				for _, sourceDirective := range directive.Value.(yaml.MapSlice) {
 					found = false
@@ -252,8 +312,21 @@ func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, e
 		return nil, err
 	}
 
+	// Resolve extends: before validating anything, since layers may inherit
+	// e.g. their from: directive.
+	resolved := map[string]bool{}
+	for _, name := range sf.FileOrder {
+		if err := sf.resolveExtends(name, resolved, []string{}); err != nil {
+			return nil, err
+		}
+	}
+
 	for name, layer := range sf.internal {
 		// Validate field values
+		if layer.From == nil {
+			return nil, errors.Errorf("%s: missing from directive", name)
+		}
+
 		switch layer.From.Type {
 		case BuiltLayer:
 			if len(layer.From.Tag) == 0 {
@@ -261,6 +334,115 @@ func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, e
 			}
 		}
 
+		if _, err := layer.ParseLayerType(); err != nil {
+			return nil, errors.Wrapf(err, "%s: bad layer_type", name)
+		}
+
+		if _, err := layer.ParseCommandMerge(); err != nil {
+			return nil, errors.Wrapf(err, "%s: bad command_merge", name)
+		}
+
+		if layer.Artifact != nil && layer.Artifact.Path == "" {
+			return nil, errors.Errorf("%s: artifact has no path", name)
+		}
+
+		if layer.Wasm != nil {
+			if layer.Wasm.Module == "" {
+				return nil, errors.Errorf("%s: wasm has no module", name)
+			}
+
+			if _, err := layer.Wasm.OS(); err != nil {
+				return nil, errors.Wrapf(err, "%s: bad wasm", name)
+			}
+
+			if layer.Artifact != nil {
+				return nil, errors.Errorf("%s: only one of artifact and wasm can be set", name)
+			}
+		}
+
+		if layer.From.Hash != "" && layer.From.Type != TarLayer {
+			return nil, errors.Errorf("%s: from hash is only for tar bases", name)
+		}
+
+		if layer.From.Constraint != "" {
+			if layer.From.Type != DockerLayer {
+				return nil, errors.Errorf("%s: from constraint is only for docker bases", name)
+			}
+
+			if _, err := ParseVersionConstraint(layer.From.Constraint); err != nil {
+				return nil, errors.Wrapf(err, "%s", name)
+			}
+
+			repo := layer.From.Url[strings.LastIndex(layer.From.Url, "/")+1:]
+			if strings.ContainsAny(repo, ":@") {
+				return nil, errors.Errorf("%s: from url %s has a tag, but the constraint picks it", name, layer.From.Url)
+			}
+		}
+
+		if err := validateEnvironment(layer.Environment); err != nil {
+			return nil, errors.Wrapf(err, "%s: bad environment", name)
+		}
+
+		if _, err := layer.ParsePackages(); err != nil {
+			return nil, errors.Wrapf(err, "%s: bad packages", name)
+		}
+
+		users, err := layer.ParseUsers()
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: bad users", name)
+		}
+
+		if user := usersRuntimeUser(users); user != "" {
+			if layer.RuntimeUser != "" && layer.RuntimeUser != user {
+				return nil, errors.Errorf("%s: runtime_user is %s, but one of its users is the runtime_user", name, layer.RuntimeUser)
+			}
+			layer.RuntimeUser = user
+		}
+
+		if _, err := layer.ParseHarden(); err != nil {
+			return nil, errors.Wrapf(err, "%s: bad harden", name)
+		}
+
+		if _, err := layer.ParseWritablePaths(); err != nil {
+			return nil, errors.Wrapf(err, "%s", name)
+		}
+
+		if _, err := layer.ParseCacheTTL(); err != nil {
+			return nil, errors.Wrapf(err, "%s", name)
+		}
+
+		if _, err := layer.ParseOutput(); err != nil {
+			return nil, errors.Wrapf(err, "%s: bad output", name)
+		}
+
+		if layer.Output != nil && layer.Output.Artifact && (layer.Artifact != nil || layer.Wasm != nil) {
+			return nil, errors.Errorf("%s: an artifact output can't be set with artifact or wasm", name)
+		}
+
+		if layer.IsArtifact() && layer.BuildOnly {
+			return nil, errors.Errorf("%s: build only layers can't be artifacts", name)
+		}
+
+		if layer.From.Type == BuiltLayer {
+			if base, ok := sf.internal[layer.From.Tag]; ok && base.IsArtifact() {
+				return nil, errors.Errorf("%s: can't be built on %s, which is an artifact", name, layer.From.Tag)
+			}
+		}
+
+		if layer.MergeWithParent {
+			if layer.From.Type != BuiltLayer && !IsContainersImageLayer(layer.From.Type) {
+				return nil, errors.Errorf("%s: merge_with_parent needs a base image to merge into, not a %s base", name, layer.From.Type)
+			}
+
+			if layer.BuildOnly || layer.IsArtifact() {
+				return nil, errors.Errorf("%s: merge_with_parent is only for layers that are images", name)
+			}
+		}
+
+		if layer.Author != "" && layer.Maintainer != "" && layer.Author != layer.Maintainer {
+			return nil, errors.Errorf("%s: author and maintainer are the same thing, only one of them should be set", name)
+		}
+
 		// Set the directory with the location where the layer was defined
 		layer.referenceDirectory = sf.ReferenceDirectory
 	}
@@ -268,6 +450,68 @@ func NewStackerfile(stackerfile string, substitutions []string) (*Stackerfile, e
 	return &sf, err
 }
 
+// validateEnvironment makes sure the variables in env can be put in an image
+// config, whose Env is a list of KEY=value strings.
+func validateEnvironment(env map[string]string) error {
+	for _, k := range SortedEnvKeys(env) {
+		if k == "" || strings.ContainsAny(k, "=\n") {
+			return errors.Errorf("bad variable name %q", k)
+		}
+
+		if strings.Contains(env[k], "\n") {
+			return errors.Errorf("%s has a newline in it", k)
+		}
+	}
+
+	return nil
+}
+
+// SortedEnvKeys returns the names of the variables in env in order, so that
+// the image configs they're written to don't depend on map iteration order.
+func SortedEnvKeys(env map[string]string) []string {
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// resolveExtends merges the definition of the layer that name extends (if
+// any) into name, resolving the parent's own extends: first.
+func (sf *Stackerfile) resolveExtends(name string, resolved map[string]bool, stack []string) error {
+	if resolved[name] {
+		return nil
+	}
+
+	for _, seen := range stack {
+		if seen == name {
+			return errors.Errorf("stackerfile: extends cycle %s", strings.Join(append(stack, name), " -> "))
+		}
+	}
+
+	layer := sf.internal[name]
+	if layer.Extends != "" {
+		parent, ok := sf.internal[layer.Extends]
+		if !ok {
+			return errors.Errorf("%s: extends unknown layer %s", name, layer.Extends)
+		}
+
+		err := sf.resolveExtends(layer.Extends, resolved, append(stack, name))
+		if err != nil {
+			return err
+		}
+
+		err = layer.extend(parent)
+		if err != nil {
+			return errors.Wrapf(err, "%s: couldn't extend %s", name, layer.Extends)
+		}
+	}
+
+	resolved[name] = true
+	return nil
+}
+
 func (s *Stackerfile) addPrerequisites(processed map[string]bool, sfm StackerFiles) error {
 	for _, prereq := range s.buildConfig.Prerequisites {
 		absPrereq := prereq
@@ -300,6 +544,11 @@ func (s *Stackerfile) addPrerequisites(processed map[string]bool, sfm StackerFil
 // DependencyOrder provides the list of layer names from a stackerfile in the
 // order in which they should be built so all dependencies are satisfied.
 func (s *Stackerfile) DependencyOrder(sfm StackerFiles) ([]string, error) {
+	order, err := s.dependencyOrder(sfm)
+	return order, WithKind(UserError, err)
+}
+
+func (s *Stackerfile) dependencyOrder(sfm StackerFiles) ([]string, error) {
 	ret := []string{}
 	processed := map[string]bool{}
 
@@ -324,7 +573,13 @@ func (s *Stackerfile) DependencyOrder(sfm StackerFiles) ([]string, error) {
 				return nil, err
 			}
 
-			if url.Scheme != "stacker" {
+			// stacker-oci:// imports from images in the OCI
+			// output, which may be layers in this file
+			if url.Scheme == "stacker-oci" {
+				if _, inFile := s.internal[url.Host]; !inFile {
+					continue
+				}
+			} else if url.Scheme != "stacker" && url.Scheme != "stacker-output" {
 				continue
 			}
 
@@ -4,6 +4,11 @@ import (
 	"github.com/opencontainers/umoci/oci/casext"
 )
 
+// TemporarySnapshotPrefix is what the names of the snapshots
+// TemporaryWritableSnapshot() makes start with; they're named after their
+// source, with a random suffix so that each one is different.
+const TemporarySnapshotPrefix = "temp-snapshot-"
+
 type Storage interface {
 	// Name of this storage driver (e.g. "btrfs")
 	Name() string
@@ -73,6 +78,12 @@ type Storage interface {
 	// lxc.rootfs.path in the LXC container's config.
 	GetLXCRootfsConfig(name string) (string, error)
 
+	// GetLXCWritableMount returns the lxc.mount.entry that makes dir
+	// writable in the container of name when its rootfs is mounted read
+	// only, with what is written to it still part of name's filesystem.
+	// dir is created if name doesn't have it.
+	GetLXCWritableMount(name string, dir string) (string, error)
+
 	// TarExtractLocation returns the location that a tar-based rootfs
 	// should be extracted to
 	TarExtractLocation(name string) string
@@ -80,4 +91,22 @@ type Storage interface {
 	// Add overlay_dirs into overlay metadata so that later we can mount them
 	// in the lxc container, works only for storage-type 'overlay'
 	SetOverlayDirs(name string, overlayDirs OverlayDirs, layerTypes []LayerType) error
+
+	// ExportCache writes the storage's finalized tags into dir, in a
+	// format that ImportCache() can restore on another machine. Works only
+	// for storage-type 'btrfs'
+	ExportCache(dir string) error
+
+	// ImportCache restores the tags written by ExportCache() into this
+	// storage, skipping any tags that already exist.
+	ImportCache(dir string) error
+
+	// ConvertOutput adds a layerType version of the image name to the
+	// output, converted from a layer type it was already output as.
+	ConvertOutput(name string, layerType LayerType) error
+
+	// Dedup shares the extents of identical files across all the tags in
+	// this storage, if the underlying filesystem supports it, returning
+	// the number of files and bytes deduplicated.
+	Dedup() (int, int64, error)
 }
@@ -0,0 +1,395 @@
+package types
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// SubstitutionEnvPrefix is the prefix of environment variables that are
+// automatically picked up as substitutions, e.g. STACKER_SUBST_FOO=bar is the
+// same as --substitute FOO=bar.
+const SubstitutionEnvPrefix = "STACKER_SUBST_"
+
+// sortSubstitutions sorts a list of KEY=VALUE substitutions so the result is
+// deterministic. Since $FOO style substitutions are simple string replacement,
+// longer keys go first, so that e.g. $FOOBAR isn't clobbered by FOO=baz.
+func sortSubstitutions(substitutions []string) {
+	key := func(i int) string {
+		return strings.SplitN(substitutions[i], "=", 2)[0]
+	}
+
+	sort.Slice(substitutions, func(i, j int) bool {
+		if len(key(i)) != len(key(j)) {
+			return len(key(i)) > len(key(j))
+		}
+		return key(i) < key(j)
+	})
+}
+
+// SubstitutionsFromEnv returns the KEY=VALUE substitutions defined by the
+// STACKER_SUBST_ variables in environ (in os.Environ() format).
+func SubstitutionsFromEnv(environ []string) []string {
+	substitutions := []string{}
+	for _, env := range environ {
+		if !strings.HasPrefix(env, SubstitutionEnvPrefix) {
+			continue
+		}
+
+		subst := strings.TrimPrefix(env, SubstitutionEnvPrefix)
+		if strings.HasPrefix(subst, "=") {
+			continue
+		}
+
+		substitutions = append(substitutions, subst)
+	}
+
+	sortSubstitutions(substitutions)
+	return substitutions
+}
+
+// SubstitutionsFromFile reads a yaml map of substitutions from path and
+// returns them in KEY=VALUE format.
+func SubstitutionsFromFile(path string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read substitution file")
+	}
+
+	vars := map[string]interface{}{}
+	if err := yaml.Unmarshal(content, &vars); err != nil {
+		return nil, errors.Wrapf(err, "couldn't parse substitution file %s", path)
+	}
+
+	substitutions := []string{}
+	for k, v := range vars {
+		switch v.(type) {
+		case map[interface{}]interface{}, []interface{}:
+			return nil, errors.Errorf("substitution %s in %s must be a scalar", k, path)
+		case nil:
+			v = ""
+		}
+
+		substitutions = append(substitutions, fmt.Sprintf("%s=%v", k, v))
+	}
+
+	sortSubstitutions(substitutions)
+	return substitutions, nil
+}
+
+// CombineSubstitutions merges the various sources of substitutions. Since
+// substitutions are applied in order and the first one for a particular
+// variable wins, the result is ordered by precedence: the command line
+// substitutions, then the environment, then the substitution files (earlier
+// files taking precedence over later ones).
+func CombineSubstitutions(cli []string, environ []string, files []string) ([]string, error) {
+	substitutions := append([]string{}, cli...)
+	substitutions = append(substitutions, SubstitutionsFromEnv(environ)...)
+
+	for _, f := range files {
+		fromFile, err := SubstitutionsFromFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		substitutions = append(substitutions, fromFile...)
+	}
+
+	return substitutions, nil
+}
+
+// substitutionFunc is a function that can be used in a substitution pipeline,
+// e.g. ${{FOO | trimsuffix .tar.gz | upper}}. It is passed the current value
+// of the pipeline and its arguments, and returns the new value.
+type substitutionFunc struct {
+	nargs int
+	f     func(dir string, value string, args []string) (string, error)
+}
+
+var substitutionFuncs = map[string]substitutionFunc{
+	"upper": {0, func(dir string, value string, args []string) (string, error) {
+		return strings.ToUpper(value), nil
+	}},
+	"lower": {0, func(dir string, value string, args []string) (string, error) {
+		return strings.ToLower(value), nil
+	}},
+	"replace": {2, func(dir string, value string, args []string) (string, error) {
+		return strings.Replace(value, args[0], args[1], -1), nil
+	}},
+	"trimprefix": {1, func(dir string, value string, args []string) (string, error) {
+		return strings.TrimPrefix(value, args[0]), nil
+	}},
+	"trimsuffix": {1, func(dir string, value string, args []string) (string, error) {
+		return strings.TrimSuffix(value, args[0]), nil
+	}},
+	"sha256": {0, func(dir string, value string, args []string) (string, error) {
+		p := value
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			return "", errors.Wrapf(err, "couldn't hash %s", value)
+		}
+
+		return fmt.Sprintf("%x", sha256.Sum256(content)), nil
+	}},
+}
+
+// splitPipeline splits a substitution expression on the | characters that
+// are not inside double quotes.
+func splitPipeline(expr string) []string {
+	stages := []string{}
+	quoted := false
+	escaped := false
+	start := 0
+	for i, c := range expr {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == '|' && !quoted:
+			stages = append(stages, expr[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(stages, expr[start:])
+}
+
+// splitArgs splits a pipeline stage into words. Words may be double quoted
+// (with go string escapes) to include whitespace or | characters.
+func splitArgs(stage string) ([]string, error) {
+	args := []string{}
+	rest := strings.TrimSpace(stage)
+	for rest != "" {
+		end := strings.IndexAny(rest, " \t")
+		if end < 0 {
+			end = len(rest)
+		}
+
+		arg := rest[:end]
+		if rest[0] == '"' {
+			end = 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) {
+				return nil, errors.Errorf("unterminated quote in %s", stage)
+			}
+
+			end++
+			var err error
+			arg, err = strconv.Unquote(rest[:end])
+			if err != nil {
+				return nil, errors.Wrapf(err, "bad quoted string %s", rest[:end])
+			}
+		}
+
+		args = append(args, arg)
+		rest = strings.TrimLeft(rest[end:], " \t")
+	}
+
+	return args, nil
+}
+
+// evalPipeline evaluates a substitution expression containing functions. The
+// first stage is either a variable name (with an optional :default, as in
+// regular substitutions) or a double quoted literal; the remaining stages are
+// functions applied in order to its value. substitutions are the KEY=VALUE
+// pairs, where the first definition of a variable wins. Relative
+// paths are resolved relative to dir.
+func evalPipeline(expr string, substitutions []string, dir string) (string, error) {
+	stages := splitPipeline(expr)
+	head := strings.TrimSpace(stages[0])
+
+	value := ""
+	set := false
+	if strings.HasPrefix(head, `"`) {
+		literal, err := strconv.Unquote(head)
+		if err != nil {
+			return "", errors.Wrapf(err, "bad quoted string %s", head)
+		}
+		value = literal
+		set = true
+	} else {
+		membs := strings.SplitN(head, ":", 2)
+		for _, subst := range substitutions {
+			kv := strings.SplitN(subst, "=", 2)
+			if len(kv) == 2 && kv[0] == membs[0] {
+				value = kv[1]
+				set = true
+				break
+			}
+		}
+
+		if !set && len(membs) == 2 {
+			value = membs[1]
+			set = true
+		}
+	}
+
+	for _, stage := range stages[1:] {
+		args, err := splitArgs(stage)
+		if err != nil {
+			return "", err
+		}
+
+		if len(args) == 0 {
+			return "", errors.Errorf("empty function in substitution %s", expr)
+		}
+
+		name := args[0]
+		args = args[1:]
+
+		// default is special: it is the only function that can be
+		// applied to something which doesn't have a value.
+		if name == "default" {
+			if len(args) != 1 {
+				return "", errors.Errorf("default takes 1 argument, got %d in %s", len(args), expr)
+			}
+			if !set || value == "" {
+				value = args[0]
+				set = true
+			}
+			continue
+		}
+
+		if !set {
+			return "", errors.Errorf("no value for substitution %s", head)
+		}
+
+		f, ok := substitutionFuncs[name]
+		if !ok {
+			return "", errors.Errorf("unknown substitution function %s in %s", name, expr)
+		}
+
+		if len(args) != f.nargs {
+			return "", errors.Errorf("%s takes %d arguments, got %d in %s", name, f.nargs, len(args), expr)
+		}
+
+		value, err = f.f(dir, value, args)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if !set {
+		return "", errors.Errorf("no value for substitution %s", head)
+	}
+
+	return value, nil
+}
+
+// hasSubstitution returns true if there is a substitution for key.
+func hasSubstitution(substitutions []string, key string) bool {
+	for _, subst := range substitutions {
+		if strings.HasPrefix(subst, key+"=") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// gitCommit returns the commit hash of HEAD of the git repo that dir is in.
+func gitCommit(dir string) (string, error) {
+	output, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "couldn't get git commit for %s: %s", dir, output)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// layerName returns the name of the layer defined by line, if line is a top
+// level key in the stacker file.
+func layerName(line string) (string, bool) {
+	if line == "" || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") ||
+		strings.HasPrefix(line, "#") || strings.HasPrefix(line, "---") {
+		return "", false
+	}
+
+	idx := strings.Index(line, ":")
+	if idx < 0 {
+		return "", false
+	}
+
+	return strings.Trim(strings.TrimSpace(line[:idx]), `"'`), true
+}
+
+// substituteLayers performs substitutions on the stacker file content layer by
+// layer, so that LAYER_NAME can be set to the name of the layer that is being
+// substituted. LAYER_NAME has the lowest precedence, so it can be overridden
+// like any other substitution.
+func substituteLayers(content string, substitutions []string, dir string) (string, error) {
+	result := bytes.NewBuffer(nil)
+	chunk := bytes.NewBuffer(nil)
+	chunkSubsts := substitutions
+
+	flush := func() error {
+		substituted, err := substitute(chunk.String(), chunkSubsts, dir)
+		if err != nil {
+			return err
+		}
+
+		result.WriteString(substituted)
+		chunk.Reset()
+		return nil
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if _, ok := layerName(line); ok {
+			if err := flush(); err != nil {
+				return "", err
+			}
+
+			// the layer name itself may be the result of a
+			// substitution
+			keyLine, err := substitute(line, substitutions, dir)
+			if err != nil {
+				return "", err
+			}
+
+			name, _ := layerName(keyLine)
+			chunkSubsts = append(append([]string{}, substitutions...), fmt.Sprintf("LAYER_NAME=%s", name))
+			result.WriteString(keyLine)
+			result.WriteString("\n")
+			continue
+		}
+
+		chunk.WriteString(line)
+		chunk.WriteString("\n")
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", errors.Wrapf(err, "couldn't read stacker file")
+	}
+
+	if err := flush(); err != nil {
+		return "", err
+	}
+
+	return result.String(), nil
+}
@@ -1,10 +1,19 @@
 package types
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"os/exec"
+	"path"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 func parse(t *testing.T, content string) *Stackerfile {
@@ -80,9 +89,92 @@ third:
 	}
 }
 
+func TestDependencies(t *testing.T) {
+	content := `base:
+    from:
+        type: docker
+        url: docker://centos:latest
+tarball:
+    from:
+        type: tar
+        url: stacker://base/output.tar
+    import:
+        - stacker://base/etc/os-release
+        - stacker://other/foo
+        - stacker-oci://released/bar
+        - stacker://base/etc/hosts
+        - stacker-output://builder/app
+child:
+    from:
+        type: built
+        tag: base
+    import:
+        - stacker://tarball/foo
+`
+	sf := parse(t, content)
+
+	for name, expected := range map[string][]string{
+		"base":    {},
+		"tarball": {"base", "other", "released", "builder"},
+		"child":   {"base", "tarball"},
+	} {
+		l, _ := sf.Get(name)
+		deps, err := l.Dependencies()
+		if err != nil {
+			t.Fatalf("couldn't get %s's dependencies: %s", name, err)
+		}
+
+		if !reflect.DeepEqual(expected, deps) {
+			t.Fatalf("bad dependencies for %s: %v", name, deps)
+		}
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	content := `builder:
+    from:
+        type: docker
+        url: docker://centos:latest
+    outputs:
+        app: /src/build//app
+        docs: /src/docs/
+slash:
+    from:
+        type: docker
+        url: docker://centos:latest
+    outputs:
+        a/b: /src/app
+relative:
+    from:
+        type: docker
+        url: docker://centos:latest
+    outputs:
+        app: src/app
+`
+	sf := parse(t, content)
+
+	l, _ := sf.Get("builder")
+	outputs, err := l.ParseOutputs()
+	if err != nil {
+		t.Fatalf("couldn't parse outputs: %s", err)
+	}
+
+	expected := map[string]string{"app": "/src/build/app", "docs": "/src/docs"}
+	if !reflect.DeepEqual(expected, outputs) {
+		t.Fatalf("bad outputs: %v", outputs)
+	}
+
+	for _, name := range []string{"slash", "relative"} {
+		l, _ := sf.Get(name)
+		if _, err := l.ParseOutputs(); err == nil {
+			t.Fatalf("%s's outputs should be bad", name)
+		}
+	}
+}
+
 func TestSubstitute(t *testing.T) {
 	s := "$ONE $TWO ${{TWO}} ${{TWO:}} ${{TWO:3}} ${{TWO2:22}} ${{THREE:3}}"
-	result, err := substitute(s, []string{"ONE=1", "TWO=2"})
+	result, err := substitute(s, []string{"ONE=1", "TWO=2"}, "")
 	if err != nil {
 		t.Fatalf("failed substitutition: %s", err)
 	}
@@ -94,7 +186,7 @@ func TestSubstitute(t *testing.T) {
 
 	// ${PRODUCT} is ok
 	s = "$PRODUCT ${PRODUCT//x} ${{PRODUCT}}"
-	result, err = substitute(s, []string{"PRODUCT=foo"})
+	result, err = substitute(s, []string{"PRODUCT=foo"}, "")
 	if err != nil {
 		t.Fatalf("failed substitution: %s", err)
 	}
@@ -165,3 +257,1417 @@ func TestContainerProxyPassThroughByDefault(t *testing.T) {
 			expected, result)
 	}
 }
+
+func TestCombineSubstitutions(t *testing.T) {
+	tf, err := ioutil.TempFile("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempfile: %s", err)
+	}
+	defer tf.Close()
+	defer os.Remove(tf.Name())
+
+	_, err = tf.WriteString("FOO: file\nQUUX: file\nBAZ: 3\n")
+	if err != nil {
+		t.Fatalf("couldn't write content: %s", err)
+	}
+
+	environ := []string{"STACKER_SUBST_FOO=env", "STACKER_SUBST_BAR=env", "HOME=/home/user"}
+	result, err := CombineSubstitutions([]string{"FOO=cli"}, environ, []string{tf.Name()})
+	if err != nil {
+		t.Fatalf("failed combining substitutions: %s", err)
+	}
+
+	expected := []string{"FOO=cli", "BAR=env", "FOO=env", "QUUX=file", "BAZ=3", "FOO=file"}
+	if !reflect.DeepEqual(expected, result) {
+		t.Fatalf("Incorrect substitutions expected != found: %v != %v", expected, result)
+	}
+
+	content, err := substitute("$FOO $QUUX $BAR $BAZ", result, "")
+	if err != nil {
+		t.Fatalf("failed substitution: %s", err)
+	}
+
+	if content != "cli file env 3" {
+		t.Fatalf("bad substitution result: %s", content)
+	}
+}
+
+func TestSubstituteFunctions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(path.Join(dir, "foo"), []byte("foo\n"), 0644)
+	if err != nil {
+		t.Fatalf("couldn't write content: %s", err)
+	}
+
+	s := `${{VERSION | trimprefix v}} ${{NAME | upper}} ${{NAME:x | replace o 0}} ${{MISSING | default "a | b"}} ` +
+		`${{MISSING:def | upper}} ${{"foo" | sha256}} ${{EMPTY | default none | lower}}`
+	result, err := substitute(s, []string{"VERSION=v1.2", "NAME=foo", "EMPTY="}, dir)
+	if err != nil {
+		t.Fatalf("failed substitution: %s", err)
+	}
+
+	expected := "1.2 FOO f00 a | b DEF b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c none"
+	if result != expected {
+		t.Fatalf("bad substitution result, expected %s got %s", expected, result)
+	}
+
+	for _, bad := range []string{"${{MISSING | upper}}", "${{NAME | nope}}", "${{NAME | trimsuffix}}", `${{NAME | default "x}}`} {
+		_, err = substitute(bad, []string{"NAME=foo"}, dir)
+		if err == nil {
+			t.Fatalf("substitution %s should have failed", bad)
+		}
+	}
+}
+
+func TestExtends(t *testing.T) {
+	content := `base:
+    from:
+        type: docker
+        url: docker://centos:latest
+    import:
+        - common.sh
+    environment:
+        FOO: base
+        BAR: base
+    run: sh /stacker/common.sh
+    build_only: true
+    inherit_config: true
+child:
+    extends: base
+    import:
+        - child.sh
+    environment:
+        FOO: child
+    run:
+        - sh /stacker/child.sh
+grandchild:
+    extends: child
+    from:
+        type: built
+        tag: base
+`
+	sf := parse(t, content)
+
+	l, ok := sf.Get("grandchild")
+	if !ok {
+		t.Fatalf("missing grandchild layer")
+	}
+
+	if l.From.Type != BuiltLayer || l.From.Tag != "base" {
+		t.Fatalf("bad from: %v", l.From)
+	}
+
+	if l.BuildOnly {
+		t.Fatalf("build_only should not be inherited")
+	}
+
+	if !l.InheritConfig {
+		t.Fatalf("inherit_config not inherited")
+	}
+
+	imports := []string{}
+	for _, imp := range l.Import {
+		imports = append(imports, imp.Path)
+	}
+	if !reflect.DeepEqual([]string{"common.sh", "child.sh"}, imports) {
+		t.Fatalf("bad imports: %v", imports)
+	}
+
+	if !reflect.DeepEqual(map[string]string{"FOO": "child", "BAR": "base"}, l.Environment) {
+		t.Fatalf("bad environment: %v", l.Environment)
+	}
+
+	run, err := l.ParseRun()
+	if err != nil {
+		t.Fatalf("couldn't parse run: %s", err)
+	}
+	if !reflect.DeepEqual([]string{"sh /stacker/common.sh", "sh /stacker/child.sh"}, run) {
+		t.Fatalf("bad run: %v", run)
+	}
+
+	l, _ = sf.Get("child")
+	if l.From.Type != DockerLayer {
+		t.Fatalf("from not inherited: %v", l.From)
+	}
+}
+
+func TestBuiltinSubstitutions(t *testing.T) {
+	content := `first:
+    from:
+        type: docker
+        url: docker://${{LAYER_NAME}}:latest
+    run: echo ${{LAYER_NAME | upper}} $STACKER_ARCH
+$SECOND:
+    from:
+        type: built
+        tag: first
+    run: echo ${{LAYER_NAME}}
+`
+	result, err := substituteLayers(content, append([]string{"SECOND=second"}, (&StackerConfig{}).Substitutions()...), "")
+	if err != nil {
+		t.Fatalf("failed substitution: %s", err)
+	}
+
+	expected := fmt.Sprintf(`first:
+    from:
+        type: docker
+        url: docker://first:latest
+    run: echo FIRST %s
+second:
+    from:
+        type: built
+        tag: first
+    run: echo second
+`, runtime.GOARCH)
+	if result != expected {
+		t.Fatalf("bad substitution result, expected %s got %s", expected, result)
+	}
+}
+
+func TestLayerType(t *testing.T) {
+	content := `default:
+    from:
+        type: docker
+        url: docker://centos:latest
+squashfs:
+    from:
+        type: docker
+        url: docker://centos:latest
+    layer_type: squashfs
+both:
+    extends: squashfs
+    layer_type:
+        - tar
+        - squashfs
+inherited:
+    extends: squashfs
+`
+	sf := parse(t, content)
+
+	expected := map[string][]LayerType{
+		"default":   nil,
+		"squashfs":  {"squashfs"},
+		"both":      {"tar", "squashfs"},
+		"inherited": {"squashfs"},
+	}
+
+	for name, lts := range expected {
+		l, ok := sf.Get(name)
+		if !ok {
+			t.Fatalf("missing layer %s", name)
+		}
+
+		parsed, err := l.ParseLayerType()
+		if err != nil {
+			t.Fatalf("couldn't parse layer_type of %s: %s", name, err)
+		}
+
+		if !reflect.DeepEqual(lts, parsed) {
+			t.Fatalf("bad layer types for %s: %v", name, parsed)
+		}
+	}
+
+	tf, err := ioutil.TempFile("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempfile: %s", err)
+	}
+	defer tf.Close()
+	defer os.Remove(tf.Name())
+
+	_, err = tf.WriteString(`bad:
+    from:
+        type: docker
+        url: docker://centos:latest
+    layer_type: zip
+`)
+	if err != nil {
+		t.Fatalf("couldn't write content: %s", err)
+	}
+
+	_, err = NewStackerfile(tf.Name(), nil)
+	if err == nil {
+		t.Fatalf("bad layer_type should have failed")
+	}
+}
+
+func TestLayerLine(t *testing.T) {
+	content := `# a comment
+first:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: |
+        echo "second: not a layer"
+"second":
+    from:
+        type: built
+        tag: first
+`
+	sf := parse(t, content)
+
+	expected := map[string]int{"first": 2, "second": 8, "missing": 0}
+	for name, line := range expected {
+		if sf.LayerLine(name) != line {
+			t.Fatalf("bad line for %s: %d", name, sf.LayerLine(name))
+		}
+	}
+}
+
+func TestRunSteps(t *testing.T) {
+	content := `steps:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run_steps:
+        - name: packages
+          run: dnf install -y gcc
+        - name: build
+          run:
+              - make
+              - make install
+          interactive: true
+both:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: ls
+    run_steps:
+        - name: build
+          run: make
+duplicate:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run_steps:
+        - name: build
+          run: make
+        - name: build
+          run: make install
+`
+	sf := parse(t, content)
+
+	l, _ := sf.Get("steps")
+	steps, err := l.ParseRunSteps()
+	if err != nil {
+		t.Fatalf("couldn't parse run_steps: %s", err)
+	}
+
+	expected := []RunStep{
+		{Name: "packages", Run: []string{"dnf install -y gcc"}},
+		{Name: "build", Run: []string{"make", "make install"}, Interactive: true},
+	}
+	if !reflect.DeepEqual(expected, steps) {
+		t.Fatalf("bad run_steps: %v", steps)
+	}
+
+	l, _ = sf.Get("both")
+	if _, err := l.ParseRunSteps(); err == nil {
+		t.Fatalf("run and run_steps together should fail")
+	}
+
+	l, _ = sf.Get("duplicate")
+	if _, err := l.ParseRunSteps(); err == nil {
+		t.Fatalf("duplicate run step names should fail")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	content := `retried:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run: dnf install -y gcc
+    retries:
+        attempts: 3
+        delay: 10s
+steps:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run_steps:
+        - name: packages
+          run: dnf install -y gcc
+          retries:
+              attempts: 2
+badstep:
+    from:
+        type: docker
+        url: docker://centos:latest
+    run_steps:
+        - name: packages
+          run: dnf install -y gcc
+          retries:
+              attempts: 2
+              delay: soon
+`
+	sf := parse(t, content)
+
+	l, _ := sf.Get("retried")
+	attempts, delay, err := l.Retries.Parse()
+	if err != nil {
+		t.Fatalf("couldn't parse retries: %s", err)
+	}
+	if attempts != 3 || delay != 10*time.Second {
+		t.Fatalf("bad retries: %d attempts, %s delay", attempts, delay)
+	}
+
+	l, _ = sf.Get("steps")
+	steps, err := l.ParseRunSteps()
+	if err != nil {
+		t.Fatalf("couldn't parse run_steps: %s", err)
+	}
+	attempts, delay, err = steps[0].Retries.Parse()
+	if err != nil || attempts != 2 || delay != 0 {
+		t.Fatalf("bad step retries: %d attempts, %s delay, %v", attempts, delay, err)
+	}
+
+	// no retries is one attempt
+	attempts, _, err = (*Retries)(nil).Parse()
+	if err != nil || attempts != 1 {
+		t.Fatalf("bad default retries: %d attempts, %v", attempts, err)
+	}
+
+	if _, _, err := (&Retries{Attempts: 0}).Parse(); err == nil {
+		t.Fatalf("retries with no attempts should fail")
+	}
+
+	l, _ = sf.Get("badstep")
+	if _, err := l.ParseRunSteps(); err == nil {
+		t.Fatalf("bad retry delay should fail")
+	}
+}
+
+func TestCacheDirs(t *testing.T) {
+	content := `good:
+    from:
+        type: docker
+        url: docker://centos:latest
+    cache:
+        - /var/cache/dnf/
+        - /root/.cache
+relative:
+    from:
+        type: docker
+        url: docker://centos:latest
+    cache:
+        - var/cache/dnf
+`
+	sf := parse(t, content)
+
+	l, _ := sf.Get("good")
+	dirs, err := l.ParseCacheDirs()
+	if err != nil {
+		t.Fatalf("couldn't parse cache: %s", err)
+	}
+	if !reflect.DeepEqual([]string{"/var/cache/dnf", "/root/.cache"}, dirs) {
+		t.Fatalf("bad cache dirs: %v", dirs)
+	}
+
+	l, _ = sf.Get("relative")
+	if _, err := l.ParseCacheDirs(); err == nil {
+		t.Fatalf("relative cache dirs should fail")
+	}
+}
+
+func TestImportGPG(t *testing.T) {
+	content := `signed:
+    from:
+        type: docker
+        url: docker://centos:latest
+    import:
+        - path: https://example.com/thing.tar.gz
+          gpg:
+              keyring: /etc/keys/vendor.asc
+        - path: https://example.com/other.tar.gz
+          gpg:
+              keyring: /etc/keys/vendor.asc
+              sig: https://example.com/sigs/other.tar.gz.sig
+        - https://example.com/unsigned.tar.gz
+`
+	sf := parse(t, content)
+
+	l, _ := sf.Get("signed")
+	imports, err := l.ParseImport()
+	if err != nil {
+		t.Fatalf("couldn't parse imports: %s", err)
+	}
+
+	if len(imports) != 3 {
+		t.Fatalf("bad imports: %v", imports)
+	}
+
+	expected := ImportGPG{Keyring: "/etc/keys/vendor.asc", Sig: "https://example.com/thing.tar.gz.asc"}
+	if imports[0].GPG == nil || *imports[0].GPG != expected {
+		t.Fatalf("bad default gpg sig: %v", imports[0].GPG)
+	}
+
+	expected.Sig = "https://example.com/sigs/other.tar.gz.sig"
+	if imports[1].GPG == nil || *imports[1].GPG != expected {
+		t.Fatalf("bad gpg sig: %v", imports[1].GPG)
+	}
+
+	if imports[2].GPG != nil {
+		t.Fatalf("unsigned import has gpg: %v", imports[2].GPG)
+	}
+}
+
+func TestImportMirrors(t *testing.T) {
+	content := `mirrored:
+    from:
+        type: docker
+        url: docker://centos:latest
+    import:
+        - path: https://example.com/thing.tar.gz
+          mirrors:
+              - https://mirror.example.org/thing.tar.gz
+              - vendor/thing.tar.gz
+        - https://example.com/other.tar.gz
+`
+	sf := parse(t, content)
+
+	l, _ := sf.Get("mirrored")
+	imports, err := l.ParseImport()
+	if err != nil {
+		t.Fatalf("couldn't parse imports: %s", err)
+	}
+
+	expected := []string{"https://mirror.example.org/thing.tar.gz", path.Join(sf.ReferenceDirectory, "vendor/thing.tar.gz")}
+	if !reflect.DeepEqual(expected, imports[0].Mirrors) {
+		t.Fatalf("bad mirrors: %v", imports[0].Mirrors)
+	}
+
+	if imports[1].Mirrors != nil {
+		t.Fatalf("import without mirrors has some: %v", imports[1].Mirrors)
+	}
+
+	if _, err := getImportFromInterface(map[interface{}]interface{}{"path": "a", "mirrors": "b"}); err == nil {
+		t.Fatalf("mirrors that aren't a list should have failed")
+	}
+}
+
+func TestBuildCaches(t *testing.T) {
+	content := `good:
+    from:
+        type: docker
+        url: docker://centos:latest
+    build_caches:
+        - go
+        - ccache
+    build_env:
+        CCACHE_DIR: /elsewhere
+bad:
+    from:
+        type: docker
+        url: docker://centos:latest
+    build_caches:
+        - cargo
+`
+	sf := parse(t, content)
+
+	l, _ := sf.Get("good")
+	dirs, err := l.ParseCacheDirs()
+	if err != nil {
+		t.Fatalf("couldn't parse cache: %s", err)
+	}
+	expected := []string{"/var/cache/stacker/ccache", "/var/cache/stacker/go-build", "/var/cache/stacker/go-mod"}
+	if !reflect.DeepEqual(expected, dirs) {
+		t.Fatalf("bad cache dirs: %v", dirs)
+	}
+
+	env, err := l.BuildEnvironment("good")
+	if err != nil {
+		t.Fatalf("couldn't get build environment: %s", err)
+	}
+	if env["GOCACHE"] != "/var/cache/stacker/go-build" || env["GOMODCACHE"] != "/var/cache/stacker/go-mod" {
+		t.Fatalf("bad go environment: %v", env)
+	}
+	if env["CCACHE_DIR"] != "/elsewhere" {
+		t.Fatalf("build_env should override build_caches: %v", env)
+	}
+
+	l, _ = sf.Get("bad")
+	if _, err := l.ParseCacheDirs(); err == nil {
+		t.Fatalf("unknown build caches should fail")
+	}
+}
+
+func TestUmaskAndLocale(t *testing.T) {
+	content := `good:
+    from:
+        type: docker
+        url: docker://centos:latest
+    umask: 022
+    timezone: Europe/Paris
+    locale: C.UTF-8
+    build_env:
+        LC_ALL: POSIX
+bad:
+    from:
+        type: docker
+        url: docker://centos:latest
+    umask: "0999"
+quoted:
+    from:
+        type: docker
+        url: docker://centos:latest
+    umask: "0027"
+`
+	sf := parse(t, content)
+
+	l, _ := sf.Get("good")
+	umask, err := l.ParseUmask()
+	if err != nil {
+		t.Fatalf("couldn't parse umask: %s", err)
+	}
+	if umask != "0022" {
+		t.Fatalf("bad umask: %s", umask)
+	}
+
+	env, err := l.BuildEnvironment("good")
+	if err != nil {
+		t.Fatalf("couldn't get build environment: %s", err)
+	}
+	if env["TZ"] != "Europe/Paris" || env["LANG"] != "C.UTF-8" {
+		t.Fatalf("bad locale environment: %v", env)
+	}
+	if env["LC_ALL"] != "POSIX" {
+		t.Fatalf("build_env should override locale: %v", env)
+	}
+
+	l, _ = sf.Get("quoted")
+	umask, err = l.ParseUmask()
+	if err != nil || umask != "0027" {
+		t.Fatalf("bad quoted umask %s: %v", umask, err)
+	}
+
+	l, _ = sf.Get("bad")
+	if _, err := l.ParseUmask(); err == nil {
+		t.Fatalf("bad umask should fail")
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	sc := StackerConfig{
+		StackerDir: "/stacker",
+		OCIDir:     "/oci",
+		RootFSDir:  "/roots",
+		Profiles: map[string]StorageProfile{
+			"fast-nvme": StorageProfile{RootFSDir: "/nvme/roots", TmpDir: "/nvme/tmp"},
+			"big-hdd":   StorageProfile{OCIDir: "/hdd/oci"},
+		},
+	}
+
+	if err := sc.ApplyProfile("fast-nvme", nil); err != nil {
+		t.Fatalf("couldn't apply profile: %v", err)
+	}
+
+	if sc.StackerDir != "/stacker" || sc.OCIDir != "/oci" {
+		t.Fatalf("dirs the profile doesn't have were changed: %v", sc)
+	}
+
+	if sc.RootFSDir != "/nvme/roots" || sc.TmpDir != "/nvme/tmp" {
+		t.Fatalf("the profile wasn't applied: %v", sc)
+	}
+
+	err := sc.ApplyProfile("ramdisk", nil)
+	if err == nil || !strings.Contains(err.Error(), "big-hdd, fast-nvme") {
+		t.Fatalf("bad error for unknown profile: %v", err)
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	network := errors.Wrapf(&net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}, "couldn't pull")
+
+	for _, tc := range []struct {
+		err  error
+		kind ErrorKind
+	}{
+		{fmt.Errorf("plain"), OtherError},
+		{KindErrorf(UserError, "bad yaml"), UserError},
+		{errors.Wrapf(WithKind(PolicyError, fmt.Errorf("denied")), "building foo"), PolicyError},
+		{WithKind(StorageError, network), NetworkError},
+		{WithKind(UserError, errors.Wrapf(&exec.Error{Name: "git", Err: exec.ErrNotFound}, "no commit")), ToolMissing},
+	} {
+		if kind := KindOf(tc.err); kind != tc.kind {
+			t.Fatalf("bad kind for %v: %s, expected %s", tc.err, kind, tc.kind)
+		}
+	}
+
+	if WithKind(UserError, nil) != nil {
+		t.Fatalf("marking a nil error made it non-nil")
+	}
+
+	if UserError.ExitCode() == NetworkError.ExitCode() || OtherError.ExitCode() != 1 {
+		t.Fatalf("bad exit codes")
+	}
+}
+
+func TestParseAuthor(t *testing.T) {
+	content := `base:
+    from:
+        type: docker
+        url: docker://centos:latest
+    author: Jane Doe <jane@example.com>
+child:
+    extends: base
+maintainer:
+    from:
+        type: built
+        tag: base
+    maintainer: team@example.com
+nobody:
+    from:
+        type: built
+        tag: base
+`
+	sf := parse(t, content)
+	sc := StackerConfig{Author: "builds@example.com"}
+
+	for name, expected := range map[string]string{
+		"base":       "Jane Doe <jane@example.com>",
+		"child":      "Jane Doe <jane@example.com>",
+		"maintainer": "team@example.com",
+		"nobody":     "builds@example.com",
+	} {
+		l, _ := sf.Get(name)
+		author, explicit, err := l.ParseAuthor(sc)
+		if err != nil {
+			t.Fatalf("couldn't parse author of %s: %s", name, err)
+		}
+
+		if author != expected || !explicit {
+			t.Fatalf("bad author for %s: %s", name, author)
+		}
+	}
+
+	l, _ := sf.Get("nobody")
+	author, explicit, err := l.ParseAuthor(StackerConfig{})
+	if err != nil {
+		t.Fatalf("couldn't parse default author: %s", err)
+	}
+
+	if !strings.Contains(author, "@") || explicit {
+		t.Fatalf("bad default author: %s", author)
+	}
+
+	tf, err := ioutil.TempFile("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempfile: %s", err)
+	}
+	defer tf.Close()
+	defer os.Remove(tf.Name())
+
+	_, err = tf.WriteString(`bad:
+    from:
+        type: docker
+        url: docker://centos:latest
+    author: jane@example.com
+    maintainer: team@example.com
+`)
+	if err != nil {
+		t.Fatalf("couldn't write content: %s", err)
+	}
+
+	_, err = NewStackerfile(tf.Name(), nil)
+	if err == nil {
+		t.Fatalf("different author and maintainer should have failed")
+	}
+}
+
+func TestArtifact(t *testing.T) {
+	content := `sbom:
+    from:
+        type: docker
+        url: docker://centos:latest
+    artifact:
+        path: /sbom.json
+        media_type: application/spdx+json
+`
+	sf := parse(t, content)
+
+	l, _ := sf.Get("sbom")
+	expected := Artifact{Path: "/sbom.json", MediaType: "application/spdx+json"}
+	if l.Artifact == nil || *l.Artifact != expected {
+		t.Fatalf("bad artifact: %v", l.Artifact)
+	}
+
+	for _, bad := range []string{`sbom:
+    from:
+        type: docker
+        url: docker://centos:latest
+    artifact:
+        media_type: application/spdx+json
+`, `sbom:
+    from:
+        type: docker
+        url: docker://centos:latest
+    build_only: true
+    artifact:
+        path: /sbom.json
+`, `sbom:
+    from:
+        type: docker
+        url: docker://centos:latest
+    artifact:
+        path: /sbom.json
+child:
+    from:
+        type: built
+        tag: sbom
+`} {
+		tf, err := ioutil.TempFile("", "stacker_test_")
+		if err != nil {
+			t.Fatalf("couldn't create tempfile: %s", err)
+		}
+		defer tf.Close()
+		defer os.Remove(tf.Name())
+
+		if _, err := tf.WriteString(bad); err != nil {
+			t.Fatalf("couldn't write content: %s", err)
+		}
+
+		if _, err := NewStackerfile(tf.Name(), nil); err == nil {
+			t.Fatalf("bad artifact should have failed:\n%s", bad)
+		}
+	}
+}
+
+func TestParseOutput(t *testing.T) {
+	content := `os:
+    from:
+        type: docker
+        url: docker://centos:latest
+    output: disk
+qcow:
+    from:
+        type: docker
+        url: docker://centos:latest
+    output:
+        type: disk
+        format: qcow2
+        size: 2GiB
+        filesystem: ext3
+        hooks:
+            - install-grub.sh
+`
+	sf := parse(t, content)
+
+	l, _ := sf.Get("os")
+	o, err := l.ParseOutput()
+	if err != nil {
+		t.Fatalf("couldn't parse output: %s", err)
+	}
+	if o.Type != OutputDisk || o.Format != "raw" || o.Filesystem != "ext4" || o.Path != "" {
+		t.Fatalf("bad default output: %v", o)
+	}
+
+	l, _ = sf.Get("qcow")
+	o, err = l.ParseOutput()
+	if err != nil {
+		t.Fatalf("couldn't parse output: %s", err)
+	}
+	if o.Format != "qcow2" || o.Size != "2GiB" || o.Filesystem != "ext3" {
+		t.Fatalf("bad output: %v", o)
+	}
+	if len(o.Hooks) != 1 || o.Hooks[0] != path.Join(l.referenceDirectory, "install-grub.sh") {
+		t.Fatalf("bad output hooks: %v", o.Hooks)
+	}
+
+	l = &Layer{Output: &Output{Type: OutputCpio}}
+	o, err = l.ParseOutput()
+	if err != nil {
+		t.Fatalf("couldn't parse output: %s", err)
+	}
+	if o.Compression != "none" {
+		t.Fatalf("bad default cpio compression: %s", o.Compression)
+	}
+
+	l = &Layer{Output: &Output{Type: OutputCasync, Store: "chunks", ChunkSize: "256KiB"}, referenceDirectory: "/stacker"}
+	o, err = l.ParseOutput()
+	if err != nil {
+		t.Fatalf("couldn't parse output: %s", err)
+	}
+	if o.Store != "/stacker/chunks" {
+		t.Fatalf("bad casync store: %s", o.Store)
+	}
+
+	l = &Layer{Output: &Output{Type: OutputCasync, Store: "s3+https://example.com/chunks"}}
+	o, err = l.ParseOutput()
+	if err != nil {
+		t.Fatalf("couldn't parse output: %s", err)
+	}
+	if o.Store != "s3+https://example.com/chunks" {
+		t.Fatalf("bad casync store: %s", o.Store)
+	}
+
+	for _, bad := range []Output{
+		{Type: "floppy"},
+		{Type: OutputDisk, Format: "vmdk"},
+		{Type: OutputDisk, Filesystem: "btrfs"},
+		{Type: OutputDisk, Size: "big"},
+		{Type: OutputDisk, Artifact: true},
+		{Type: OutputCpio, Compression: "xz"},
+		{Type: OutputCpio, Artifact: true, Path: "initrd.cpio"},
+		{Type: OutputCasync, ChunkSize: "2KiB"},
+		{Type: OutputCasync, ChunkSize: "5000"},
+		{Type: OutputCasync, ChunkSize: "huge"},
+	} {
+		l := Layer{Output: &bad}
+		if _, err := l.ParseOutput(); err == nil {
+			t.Fatalf("bad output should have failed: %v", bad)
+		}
+	}
+}
+
+func TestBadEnvironment(t *testing.T) {
+	for _, bad := range []string{`test:
+    from:
+        type: docker
+        url: docker://centos:latest
+    environment:
+        FOO: bar
+        FOO: baz
+`, `test:
+    from:
+        type: docker
+        url: docker://centos:latest
+    environment:
+        FOO: |
+            two
+            lines
+`, `test:
+    from:
+        type: docker
+        url: docker://centos:latest
+    environment:
+        "FOO=BAR": baz
+`} {
+		tf, err := ioutil.TempFile("", "stacker_test_")
+		if err != nil {
+			t.Fatalf("couldn't create tempfile: %s", err)
+		}
+		defer tf.Close()
+		defer os.Remove(tf.Name())
+
+		if _, err := tf.WriteString(bad); err != nil {
+			t.Fatalf("couldn't write content: %s", err)
+		}
+
+		if _, err := NewStackerfile(tf.Name(), nil); err == nil {
+			t.Fatalf("bad environment should have failed:\n%s", bad)
+		}
+	}
+
+	keys := SortedEnvKeys(map[string]string{"PATH": "/bin", "A": "1", "LANG": "C"})
+	if !reflect.DeepEqual([]string{"A", "LANG", "PATH"}, keys) {
+		t.Fatalf("bad key order: %v", keys)
+	}
+}
+
+func TestVersionConstraint(t *testing.T) {
+	for _, tc := range []struct {
+		constraint string
+		matches    []string
+		doesnt     []string
+	}{
+		{"^2.3", []string{"2.3.0", "2.9.1", "v2.3.4"}, []string{"2.2.9", "3.0.0", "2.4.0-rc1"}},
+		{"^0.3.1", []string{"0.3.1", "0.3.9"}, []string{"0.4.0", "0.3.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"~1.4.2", []string{"1.4.2", "1.4.7"}, []string{"1.5.0", "1.4.1"}},
+		{"~1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{">=1.2 <1.5", []string{"1.2.0", "1.4.9"}, []string{"1.5.0", "1.1.9"}},
+		{">1.2, <=1.5", []string{"1.3.0", "1.5.9"}, []string{"1.2.9", "1.6.0"}},
+		{"1.x || 3.1", []string{"1.0.0", "1.7.3", "3.1.4"}, []string{"2.0.0", "3.2.0"}},
+		{"*", []string{"0.0.1", "10.0.0"}, []string{"1.0.0-beta"}},
+		{"=1.0.0-beta", []string{"1.0.0-beta"}, []string{"1.0.0"}},
+	} {
+		c, err := ParseVersionConstraint(tc.constraint)
+		if err != nil {
+			t.Fatalf("couldn't parse %s: %s", tc.constraint, err)
+		}
+
+		for _, s := range tc.matches {
+			v, err := ParseVersion(s)
+			if err != nil {
+				t.Fatalf("couldn't parse %s: %s", s, err)
+			}
+			if !c.Matches(v) {
+				t.Fatalf("%s should match %s", tc.constraint, s)
+			}
+		}
+
+		for _, s := range tc.doesnt {
+			v, err := ParseVersion(s)
+			if err != nil {
+				t.Fatalf("couldn't parse %s: %s", s, err)
+			}
+			if c.Matches(v) {
+				t.Fatalf("%s shouldn't match %s", tc.constraint, s)
+			}
+		}
+	}
+
+	for _, bad := range []string{"", "^", "1.2.3.4", "^x.1", "latest", ">=1 ||", "1.2-rc1"} {
+		if _, err := ParseVersionConstraint(bad); err == nil {
+			t.Fatalf("bad constraint %q should have failed", bad)
+		}
+	}
+
+	c, _ := ParseVersionConstraint("^2.3")
+	latest, ok := c.Latest([]string{"latest", "2.2.0", "v2.3.5", "2.10.0-rc1", "2.4.1", "3.0.0", "2.4"})
+	if !ok || latest != "2.4.1" {
+		t.Fatalf("bad latest tag %s", latest)
+	}
+
+	if _, ok := c.Latest([]string{"latest", "1.0.0"}); ok {
+		t.Fatalf("no tag should have matched")
+	}
+}
+
+func TestFromConstraint(t *testing.T) {
+	content := `base:
+    from:
+        type: docker
+        url: docker://example.com/myorg/base
+        constraint: ^2.3
+`
+	sf := parse(t, content)
+	l, _ := sf.Get("base")
+	if l.From.Constraint != "^2.3" {
+		t.Fatalf("bad constraint %s", l.From.Constraint)
+	}
+
+	for _, bad := range []string{
+		"type: docker\n        url: docker://example.com/myorg/base:2.3.1\n        constraint: ^2.3",
+		"type: docker\n        url: docker://example.com/myorg/base\n        constraint: sometime",
+		"type: tar\n        url: base.tar\n        constraint: ^2.3",
+	} {
+		tf, err := ioutil.TempFile("", "stacker_test_")
+		if err != nil {
+			t.Fatalf("couldn't create tempfile: %s", err)
+		}
+		defer tf.Close()
+		defer os.Remove(tf.Name())
+
+		if _, err := tf.WriteString("base:\n    from:\n        " + bad + "\n"); err != nil {
+			t.Fatalf("couldn't write content: %s", err)
+		}
+
+		if _, err := NewStackerfile(tf.Name(), nil); err == nil {
+			t.Fatalf("bad from should have failed: %s", bad)
+		}
+	}
+}
+
+func TestMergeWithParent(t *testing.T) {
+	content := `base:
+    from:
+        type: docker
+        url: docker://example.com/myorg/base
+merged:
+    from:
+        type: built
+        tag: base
+    merge_with_parent: true
+`
+	sf := parse(t, content)
+	l, _ := sf.Get("merged")
+	if !l.MergeWithParent {
+		t.Fatalf("merge_with_parent not set")
+	}
+
+	for _, bad := range []string{
+		"from:\n        type: tar\n        url: base.tar\n    merge_with_parent: true",
+		"from:\n        type: docker\n        url: docker://example.com/myorg/base\n    build_only: true\n    merge_with_parent: true",
+	} {
+		tf, err := ioutil.TempFile("", "stacker_test_")
+		if err != nil {
+			t.Fatalf("couldn't create tempfile: %s", err)
+		}
+		defer tf.Close()
+		defer os.Remove(tf.Name())
+
+		if _, err := tf.WriteString("merged:\n    " + bad + "\n"); err != nil {
+			t.Fatalf("couldn't write content: %s", err)
+		}
+
+		if _, err := NewStackerfile(tf.Name(), nil); err == nil {
+			t.Fatalf("bad merge_with_parent should have failed: %s", bad)
+		}
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	content := `base:
+    from:
+        type: docker
+        url: docker://example.com/myorg/base
+    cache_ttl: 24h
+`
+	sf := parse(t, content)
+	l, _ := sf.Get("base")
+	ttl, err := l.ParseCacheTTL()
+	if err != nil || ttl != 24*time.Hour {
+		t.Fatalf("bad cache_ttl %v: %v", ttl, err)
+	}
+
+	for _, bad := range []string{"1d", "-1h", "0s"} {
+		tf, err := ioutil.TempFile("", "stacker_test_")
+		if err != nil {
+			t.Fatalf("couldn't create tempfile: %s", err)
+		}
+		defer tf.Close()
+		defer os.Remove(tf.Name())
+
+		if _, err := tf.WriteString(strings.Replace(content, "24h", bad, 1)); err != nil {
+			t.Fatalf("couldn't write content: %s", err)
+		}
+
+		if _, err := NewStackerfile(tf.Name(), nil); err == nil {
+			t.Fatalf("bad cache_ttl should have failed: %s", bad)
+		}
+	}
+}
+
+func TestUsers(t *testing.T) {
+	content := `base:
+    from:
+        type: docker
+        url: docker://example.com/myorg/base
+    users:
+        - name: app
+          uid: 1000
+          runtime_user: true
+        - name: worker
+          uid: 1001
+          group: app
+          gid: 1000
+          home: /var/lib/worker/
+          shell: /sbin/nologin
+`
+	sf := parse(t, content)
+	l, _ := sf.Get("base")
+	users, err := l.ParseUsers()
+	if err != nil {
+		t.Fatalf("couldn't parse users: %s", err)
+	}
+
+	if len(users) != 2 {
+		t.Fatalf("bad users %v", users)
+	}
+
+	app := users[0]
+	if app.Group != "app" || *app.GID != 1000 || app.Home != "/home/app" || app.Shell != "/bin/sh" {
+		t.Fatalf("bad defaults for app: %v", app)
+	}
+
+	if users[1].Home != "/var/lib/worker" {
+		t.Fatalf("bad home for worker: %s", users[1].Home)
+	}
+
+	if l.RuntimeUser != "1000:1000" {
+		t.Fatalf("bad runtime_user %s", l.RuntimeUser)
+	}
+
+	bad := []string{
+		strings.Replace(content, "name: app", "name: App", 1),
+		strings.Replace(content, "uid: 1000", "uid: 0", 1),
+		strings.Replace(content, "          uid: 1001\n", "", 1),
+		strings.Replace(content, "/sbin/nologin", "nologin", 1),
+		strings.Replace(content, "shell: /sbin/nologin", "shell: /sbin/nologin\n          runtime_user: true", 1),
+		strings.Replace(content, "    users:", "    runtime_user: root\n    users:", 1),
+	}
+	for _, c := range bad {
+		tf, err := ioutil.TempFile("", "stacker_test_")
+		if err != nil {
+			t.Fatalf("couldn't create tempfile: %s", err)
+		}
+		defer tf.Close()
+		defer os.Remove(tf.Name())
+
+		if _, err := tf.WriteString(c); err != nil {
+			t.Fatalf("couldn't write content: %s", err)
+		}
+
+		if _, err := NewStackerfile(tf.Name(), nil); err == nil {
+			t.Fatalf("bad users should have failed: %s", c)
+		}
+	}
+}
+
+func TestHarden(t *testing.T) {
+	content := `base:
+    from:
+        type: docker
+        url: docker://example.com/myorg/base
+    harden:
+        strip_setuid: true
+        keep_setuid:
+            - /usr/bin/sudo/
+        root_owned: true
+`
+	sf := parse(t, content)
+	l, _ := sf.Get("base")
+	h, err := l.ParseHarden()
+	if err != nil {
+		t.Fatalf("couldn't parse harden: %s", err)
+	}
+
+	if !h.StripSetuid || !h.RootOwned || !reflect.DeepEqual(h.KeepSetuid, []string{"/usr/bin/sudo"}) {
+		t.Fatalf("bad harden %v", h)
+	}
+
+	bad := []string{
+		strings.Replace(content, "/usr/bin/sudo/", "usr/bin/sudo", 1),
+		strings.Replace(content, "strip_setuid: true", "strip_setuid: false", 1),
+		strings.Replace(strings.Replace(content, "true", "false", -1), "keep_setuid:\n            - /usr/bin/sudo/\n", "", 1),
+	}
+	for _, c := range bad {
+		tf, err := ioutil.TempFile("", "stacker_test_")
+		if err != nil {
+			t.Fatalf("couldn't create tempfile: %s", err)
+		}
+		defer tf.Close()
+		defer os.Remove(tf.Name())
+
+		if _, err := tf.WriteString(c); err != nil {
+			t.Fatalf("couldn't write content: %s", err)
+		}
+
+		if _, err := NewStackerfile(tf.Name(), nil); err == nil {
+			t.Fatalf("bad harden should have failed: %s", c)
+		}
+	}
+}
+
+func TestWritablePaths(t *testing.T) {
+	content := `base:
+    from:
+        type: docker
+        url: docker://example.com/myorg/base
+    writable_paths:
+        - /opt/app/
+        - /var/lib/app
+child:
+    extends: base
+    from:
+        type: built
+        tag: base
+    writable_paths:
+        - /opt/app
+        - /etc/app
+`
+	sf := parse(t, content)
+	l, _ := sf.Get("child")
+	dirs, err := l.ParseWritablePaths()
+	if err != nil {
+		t.Fatalf("couldn't parse writable paths: %s", err)
+	}
+
+	if !reflect.DeepEqual(dirs, []string{"/opt/app", "/var/lib/app", "/etc/app"}) {
+		t.Fatalf("bad writable paths %v", dirs)
+	}
+
+	for _, bad := range []string{"opt/app", "/"} {
+		tf, err := ioutil.TempFile("", "stacker_test_")
+		if err != nil {
+			t.Fatalf("couldn't create tempfile: %s", err)
+		}
+		defer tf.Close()
+		defer os.Remove(tf.Name())
+
+		if _, err := tf.WriteString(strings.Replace(content, "/etc/app", bad, 1)); err != nil {
+			t.Fatalf("couldn't write content: %s", err)
+		}
+
+		if _, err := NewStackerfile(tf.Name(), nil); err == nil {
+			t.Fatalf("bad writable path should have failed: %s", bad)
+		}
+	}
+}
+
+func TestPackages(t *testing.T) {
+	content := `base:
+    from:
+        type: docker
+        url: docker://ubuntu:latest
+    cache:
+        - /var/lib/apt/lists
+    packages:
+        manager: apt
+        install:
+            - curl
+            - ca-certificates=20230311
+`
+	sf := parse(t, content)
+	l, _ := sf.Get("base")
+	script, err := l.ParsePackages()
+	if err != nil {
+		t.Fatalf("couldn't parse packages: %v", err)
+	}
+
+	// the cached package lists are kept
+	expected := `apt-get update
+DEBIAN_FRONTEND=noninteractive apt-get install -y --no-install-recommends curl ca-certificates=20230311
+apt-get clean`
+	if script != expected {
+		t.Fatalf("bad packages script:\n%s", script)
+	}
+
+	l.Packages.Manager = "apk"
+	script, err = l.ParsePackages()
+	if err != nil || script != "apk add --no-cache curl ca-certificates=20230311" {
+		t.Fatalf("bad apk script %q: %v", script, err)
+	}
+
+	// with run_steps, it's the first step
+	l.RunSteps = []RunStep{{Name: "build", Run: "make"}}
+	steps, err := l.ParseRunSteps()
+	if err != nil {
+		t.Fatalf("couldn't parse run steps: %v", err)
+	}
+	if len(steps) != 2 || steps[0].Name != "packages" || steps[1].Name != "build" {
+		t.Fatalf("bad run steps %v", steps)
+	}
+
+	// retried like the layer's run would be
+	l.Retries = &Retries{Attempts: 3}
+	steps, err = l.ParseRunSteps()
+	if err != nil || steps[0].Retries != l.Retries || steps[1].Retries != nil {
+		t.Fatalf("bad run step retries %v: %v", steps, err)
+	}
+
+	// a cache dir that has the package manager's cache in it keeps it too
+	l.Packages.Manager = "apt"
+	l.CacheDirs = []string{"/var/cache"}
+	script, err = l.ParsePackages()
+	if err != nil || strings.Contains(script, "apt-get clean") || !strings.Contains(script, "rm -rf /var/lib/apt/lists/*") {
+		t.Fatalf("bad apt script with /var/cache cached %q: %v", script, err)
+	}
+
+	for _, bad := range []string{
+		"manager: zypper\n        install: [curl]",
+		"manager: apt",
+		"manager: apt\n        install: [\"curl; rm -rf /\"]",
+	} {
+		tf, err := ioutil.TempFile("", "stacker_test_")
+		if err != nil {
+			t.Fatalf("couldn't create tempfile: %s", err)
+		}
+		defer tf.Close()
+		defer os.Remove(tf.Name())
+
+		if _, err := tf.WriteString("base:\n    from:\n        type: docker\n        url: docker://ubuntu:latest\n    packages:\n        " + bad + "\n"); err != nil {
+			t.Fatalf("couldn't write content: %s", err)
+		}
+
+		if _, err := NewStackerfile(tf.Name(), nil); err == nil {
+			t.Fatalf("bad packages should have failed: %s", bad)
+		}
+	}
+}
+
+func TestProjectConfigOnlyTightens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stacker_test_")
+	if err != nil {
+		t.Fatalf("couldn't create tempdir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("couldn't get cwd: %s", err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("couldn't chdir: %s", err)
+	}
+
+	system := path.Join(dir, "system.yaml")
+	content := "hardened_builds: true\nallowed_hosts: ['*.example.com']\ndenied_hosts: [evil.example.com]\npolicy_bundle: /etc/stacker/policy\n"
+	if err := ioutil.WriteFile(system, []byte(content), 0644); err != nil {
+		t.Fatalf("couldn't write config: %s", err)
+	}
+
+	content = "hardened_builds: false\nallowed_hosts: ['*']\ndenied_hosts: [other.example.com]\npolicy_bundle: ./policy\nlayer_compression: zstd\n" +
+		"tools_image: docker://evil.example.com/tools\nwebhook_url: https://evil.example.com\nhygiene_checks: {secrets: ignore}\nrootfs_dir: /\n"
+	if err := ioutil.WriteFile(ProjectConfigFile, []byte(content), 0644); err != nil {
+		t.Fatalf("couldn't write config: %s", err)
+	}
+
+	sc := StackerConfig{}
+	origins, err := sc.LoadFiles([]string{system, ProjectConfigFile})
+	if err != nil {
+		t.Fatalf("couldn't load configs: %s", err)
+	}
+
+	if !sc.HardenedBuilds || !reflect.DeepEqual(sc.AllowedHosts, []string{"*.example.com"}) || sc.PolicyBundle != "/etc/stacker/policy" {
+		t.Fatalf("the project config loosened the system's: %+v", sc)
+	}
+
+	if !reflect.DeepEqual(sc.DeniedHosts, []string{"other.example.com", "evil.example.com"}) {
+		t.Fatalf("bad denied hosts %v", sc.DeniedHosts)
+	}
+
+	if sc.ToolsImage != "" || sc.WebhookURL != "" || sc.HygieneChecks.Secrets != "" || sc.RootFSDir != "" {
+		t.Fatalf("the project config set more than it may: %+v", sc)
+	}
+
+	if sc.LayerCompression != "zstd" {
+		t.Fatalf("bad layer compression %q", sc.LayerCompression)
+	}
+
+	if origins["policy_bundle"] != system || origins["layer_compression"] != ProjectConfigFile {
+		t.Fatalf("bad origins %v", origins)
+	}
+
+	if _, ok := origins["tools_image"]; ok {
+		t.Fatalf("bad origins %v", origins)
+	}
+
+	// with nothing before it, it may set them
+	sc = StackerConfig{}
+	if _, err := sc.LoadFiles([]string{ProjectConfigFile}); err != nil {
+		t.Fatalf("couldn't load configs: %s", err)
+	}
+
+	if sc.PolicyBundle != "./policy" || !reflect.DeepEqual(sc.AllowedHosts, []string{"*"}) {
+		t.Fatalf("bad project config %+v", sc)
+	}
+}
+
+func TestConfigShowRedactsSecrets(t *testing.T) {
+	sc := StackerConfig{WebhookURL: "https://ci.example.com/hook", WebhookSecret: "hunter2"}
+	content, err := sc.Show(nil)
+	if err != nil {
+		t.Fatalf("couldn't show config: %s", err)
+	}
+
+	if strings.Contains(content, "hunter2") || !strings.Contains(content, "webhook_secret: <redacted>\n") {
+		t.Fatalf("the webhook secret wasn't redacted:\n%s", content)
+	}
+
+	if !strings.Contains(content, "webhook_url: https://ci.example.com/hook\n") {
+		t.Fatalf("the webhook url was redacted:\n%s", content)
+	}
+}
+
+func TestGitCommitUse(t *testing.T) {
+	for content, uses := range map[string]bool{
+		"run: echo $STACKER_GIT_COMMIT":                       true,
+		"run: echo ${{STACKER_GIT_COMMIT}}":                   true,
+		"run: echo ${{STACKER_GIT_COMMIT:unknown}}":           true,
+		"run: echo ${{ STACKER_GIT_COMMIT | upper }}":         true,
+		"# STACKER_GIT_COMMIT is the commit we're built from": false,
+		"run: echo ${{STACKER_GIT_COMMITTER}}":                false,
+	} {
+		if gitCommitUse.MatchString(content) != uses {
+			t.Fatalf("%q should use STACKER_GIT_COMMIT: %v", content, uses)
+		}
+	}
+}
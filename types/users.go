@@ -0,0 +1,113 @@
+package types
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// User is a user (and its group) that a layer adds to the image's
+// /etc/passwd, /etc/group and /etc/shadow, with a fixed uid so that files
+// owned by it mean the same thing in every image.
+type User struct {
+	Name string `yaml:"name"`
+	UID  *int   `yaml:"uid"`
+	// Group is the user's primary group, created if the image doesn't
+	// have it: the user's name and uid if they aren't set.
+	Group string `yaml:"group"`
+	GID   *int   `yaml:"gid"`
+	Home  string `yaml:"home"`
+	Shell string `yaml:"shell"`
+	// Groups are existing groups the user is also added to.
+	Groups []string `yaml:"groups"`
+	// RuntimeUser makes the user the image's config's user, as uid:gid.
+	RuntimeUser bool `yaml:"runtime_user"`
+}
+
+// the portable user and group names from POSIX, as useradd accepts them
+var userName = regexp.MustCompile(`^[a-z_][a-z0-9_-]*\$?$`)
+
+// ParseUsers checks the layer's users, and returns them with their defaults
+// filled in.
+func (l *Layer) ParseUsers() ([]User, error) {
+	users := []User{}
+	runtimeUser := ""
+	for _, u := range l.Users {
+		if !userName.MatchString(u.Name) || len(u.Name) > 32 {
+			return nil, errors.Errorf("bad user name %q", u.Name)
+		}
+
+		if u.UID == nil {
+			return nil, errors.Errorf("user %s needs a uid", u.Name)
+		}
+
+		if *u.UID <= 0 {
+			return nil, errors.Errorf("user %s's uid %d should be more than 0", u.Name, *u.UID)
+		}
+
+		if u.Group == "" {
+			u.Group = u.Name
+		}
+
+		if !userName.MatchString(u.Group) || len(u.Group) > 32 {
+			return nil, errors.Errorf("bad group name %q for user %s", u.Group, u.Name)
+		}
+
+		if u.GID == nil {
+			u.GID = u.UID
+		}
+
+		if *u.GID <= 0 {
+			return nil, errors.Errorf("user %s's gid %d should be more than 0", u.Name, *u.GID)
+		}
+
+		if u.Home == "" {
+			u.Home = "/home/" + u.Name
+		}
+
+		if u.Shell == "" {
+			u.Shell = "/bin/sh"
+		}
+
+		for _, p := range []string{u.Home, u.Shell} {
+			// they're fields in /etc/passwd, and passed to the
+			// build container on its command line
+			if !filepath.IsAbs(p) || strings.ContainsAny(p, ": \t\n,") {
+				return nil, errors.Errorf("bad path %q for user %s", p, u.Name)
+			}
+		}
+		u.Home = filepath.Clean(u.Home)
+
+		for _, g := range u.Groups {
+			if !userName.MatchString(g) || len(g) > 32 {
+				return nil, errors.Errorf("bad group name %q for user %s", g, u.Name)
+			}
+		}
+
+		if u.RuntimeUser {
+			if runtimeUser != "" {
+				return nil, errors.Errorf("both %s and %s are the runtime_user", runtimeUser, u.Name)
+			}
+			runtimeUser = u.Name
+		}
+
+		users = append(users, u)
+	}
+
+	return users, nil
+}
+
+// usersRuntimeUser returns the uid:gid of the user in users that is the
+// runtime_user, or "" if none of them is.
+func usersRuntimeUser(users []User) string {
+	for _, u := range users {
+		if u.RuntimeUser {
+			return fmt.Sprintf("%d:%d", *u.UID, *u.GID)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,156 @@
+package stacker
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/anuvu/stacker/lib"
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// VerifyArgs are the options for checking published images against the
+// stackerfiles that allegedly built them.
+type VerifyArgs struct {
+	Config     types.StackerConfig
+	Substitute []string
+	Url        string
+	Tag        string
+	Username   string
+	Password   string
+	LayerTypes []types.LayerType
+}
+
+// LayerVerification is the result of verifying one published layer.
+type LayerVerification struct {
+	Stackerfile string
+	Name        string
+	LayerType   types.LayerType
+	Destination string
+
+	// Expected is the digest the build cache has for the stackerfile's
+	// current inputs, empty if there is no such build.
+	Expected digest.Digest
+	// Published is the digest in the destination.
+	Published digest.Digest
+
+	// Problem is why the layer doesn't match; empty if it does.
+	Problem string
+}
+
+// Verify replays the build cache lookup for each layer in the stackerfiles
+// at paths, and checks that the layer's manifest in opts.Url is the one the
+// cache says those inputs (layer definition, base, imports, etc.) built.
+// Since this relies on the local build cache, it only works on a machine
+// that built (or imported the cache of) the images.
+func Verify(opts *VerifyArgs, paths []string) ([]LayerVerification, error) {
+	sfm, err := types.NewStackerFiles(paths, append(opts.Substitute, opts.Config.Substitutions()...))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resolveStackerFilesBases(sfm, lockReadOnly); err != nil {
+		return nil, err
+	}
+
+	is, err := types.NewImageSource(opts.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	oci, err := stackeroci.OpenLayout(opts.Config.OCIDir)
+	if err != nil {
+		return nil, err
+	}
+	defer oci.Close()
+
+	buildCache, err := OpenCache(opts.Config, oci, sfm)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []LayerVerification{}
+	for _, p := range paths {
+		absPath, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+
+		sf, ok := sfm[absPath]
+		if !ok {
+			return nil, errors.Errorf("could not find entry for %s(%s) in stackerfiles", absPath, p)
+		}
+
+		for _, name := range sf.FileOrder {
+			l, ok := sf.Get(name)
+			if !ok {
+				return nil, errors.Errorf("layer cannot be found in stackerfile: %s", name)
+			}
+
+			// build only layers are never published
+			if l.BuildOnly {
+				continue
+			}
+
+			layerTypes, err := l.ParseLayerType()
+			if err != nil {
+				return nil, err
+			}
+			if layerTypes == nil {
+				layerTypes = opts.LayerTypes
+			}
+
+			entry, cacheHit, err := buildCache.Lookup(name)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, layerType := range layerTypes {
+				destUrl, err := publishDestination(is, opts.Url, name, layerType.LayerName(opts.Tag))
+				if err != nil {
+					return nil, err
+				}
+
+				result := LayerVerification{
+					Stackerfile: p,
+					Name:        name,
+					LayerType:   layerType,
+					Destination: destUrl,
+				}
+
+				if cacheHit {
+					result.Expected = entry.Manifests[layerType].Digest
+					if result.Expected == "" {
+						// publish converts layers that weren't
+						// built as this type
+						descPaths, err := oci.ResolveReference(context.Background(), layerType.LayerName(name))
+						if err != nil {
+							return nil, err
+						}
+						if len(descPaths) != 0 {
+							result.Expected = descPaths[0].Descriptor().Digest
+						}
+					}
+				}
+
+				result.Published, err = lib.ManifestDigest(destUrl, opts.Username, opts.Password, false)
+				switch {
+				case err != nil:
+					result.Problem = err.Error()
+				case !cacheHit:
+					result.Problem = "no build in the cache matches the stackerfile's inputs"
+				case result.Expected == "":
+					result.Problem = "the matching build wasn't built as " + string(layerType)
+				case result.Expected != result.Published:
+					result.Problem = "published digest doesn't match the build of these inputs"
+				}
+
+				results = append(results, result)
+			}
+		}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,153 @@
+package stacker
+
+import (
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/anuvu/stacker/log"
+	stackeroci "github.com/anuvu/stacker/oci"
+	"github.com/anuvu/stacker/squashfs"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// VerityLayer is what's needed to open one squashfs layer with dm-verity,
+// e.g. `veritysetup open <blob> <name> <blob> <root hash>
+// --hash-offset=<hash offset>`.
+type VerityLayer struct {
+	Digest     digest.Digest `json:"digest"`
+	RootHash   string        `json:"root_hash"`
+	HashOffset int64         `json:"hash_offset"`
+}
+
+// VerityInfo is the verity data of an image's layers, from the bottom up,
+// and the chain of their root hashes, which covers all of them.
+type VerityInfo struct {
+	Chain  digest.Digest `json:"chain"`
+	Layers []VerityLayer `json:"layers"`
+}
+
+// verityChain returns the chain of the root hashes of layers: the sha256 of
+// each root hash followed by a newline, from the bottom layer up. ok is
+// false if any of them has no root hash.
+func verityChain(layers []ispec.Descriptor) (chain digest.Digest, ok bool) {
+	if len(layers) == 0 {
+		return "", false
+	}
+
+	hashes := ""
+	for _, desc := range layers {
+		rootHash, ok := desc.Annotations[squashfs.VerityRootHashAnnotation]
+		if !ok {
+			return "", false
+		}
+		hashes += rootHash + "\n"
+	}
+
+	return digest.FromString(hashes), true
+}
+
+// setVerityChain sets the verity chain annotation of the image name for its
+// layers, or removes one it inherited from its base if they don't all have
+// verity data.
+func setVerityChain(config types.StackerConfig, name string, layerType types.LayerType, layers []ispec.Descriptor, annotations map[string]string) {
+	chain, ok := verityChain(layers)
+	if ok {
+		annotations[VerityChainAnnotation] = chain.String()
+		return
+	}
+
+	delete(annotations, VerityChainAnnotation)
+	if config.SquashfsVerity && layerType == "squashfs" {
+		log.Infof("WARNING: not all of %s's layers have verity data (e.g. its base image's), so it has no verity chain", name)
+	}
+}
+
+// ImageVerityInfo returns the verity data of the squashfs image tag in the
+// OCI output.
+func ImageVerityInfo(sc types.StackerConfig, tag string) (*VerityInfo, error) {
+	unlock, err := LockOCILayout(sc.OCIDir, false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	oci, err := stackeroci.OpenLayout(sc.OCIDir)
+	if err != nil {
+		return nil, err
+	}
+	defer oci.Close()
+
+	manifest, err := stackeroci.LookupManifest(oci, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, ok := manifest.Annotations[VerityChainAnnotation]
+	if !ok {
+		return nil, errors.Errorf("%s has no verity chain; are all its layers squashfs built with squashfs_verity?", tag)
+	}
+
+	info := &VerityInfo{Chain: digest.Digest(chain)}
+	for _, desc := range manifest.Layers {
+		layer, err := verityLayer(sc.OCIDir, desc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "layer %s", desc.Digest)
+		}
+
+		info.Layers = append(info.Layers, layer)
+	}
+
+	// the annotation may be stale if something other than stacker edited
+	// the image
+	if computed, _ := verityChain(manifest.Layers); computed.String() != chain {
+		return nil, errors.Errorf("%s's verity chain %s doesn't match its layers' (%s)", tag, chain, computed)
+	}
+
+	return info, nil
+}
+
+func verityLayer(ociDir string, desc ispec.Descriptor) (VerityLayer, error) {
+	if desc.MediaType != stackeroci.MediaTypeLayerSquashfs {
+		return VerityLayer{}, errors.Errorf("media type %s isn't squashfs", desc.MediaType)
+	}
+
+	rootHash, ok := desc.Annotations[squashfs.VerityRootHashAnnotation]
+	if !ok {
+		return VerityLayer{}, errors.Errorf("no verity root hash")
+	}
+
+	blob, err := os.Open(path.Join(ociDir, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+	if err != nil {
+		return VerityLayer{}, errors.WithStack(err)
+	}
+	defer blob.Close()
+
+	offset, err := squashfs.VerityHashOffset(blob)
+	if err != nil {
+		return VerityLayer{}, err
+	}
+
+	if offset >= desc.Size {
+		return VerityLayer{}, errors.Errorf("no verity data after the %d byte image", offset)
+	}
+
+	return VerityLayer{Digest: desc.Digest, RootHash: rootHash, HashOffset: offset}, nil
+}
+
+// Env returns the verity info as lines of shell variable assignments, e.g.
+// for initrd scripts to source before mounting the image.
+func (vi VerityInfo) Env() string {
+	env := fmt.Sprintf("STACKER_VERITY_CHAIN=%s\n", vi.Chain)
+	env += fmt.Sprintf("STACKER_VERITY_LAYERS=%d\n", len(vi.Layers))
+	for i, layer := range vi.Layers {
+		env += fmt.Sprintf("STACKER_VERITY_LAYER_%d_DIGEST=%s\n", i, layer.Digest)
+		env += fmt.Sprintf("STACKER_VERITY_LAYER_%d_ROOT_HASH=%s\n", i, layer.RootHash)
+		env += fmt.Sprintf("STACKER_VERITY_LAYER_%d_HASH_OFFSET=%d\n", i, layer.HashOffset)
+	}
+
+	return env
+}
@@ -0,0 +1,64 @@
+package stacker
+
+import (
+	"testing"
+
+	"github.com/anuvu/stacker/squashfs"
+	"github.com/anuvu/stacker/types"
+	"github.com/opencontainers/go-digest"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerityChain(t *testing.T) {
+	assert := assert.New(t)
+
+	layer := func(rootHash string) ispec.Descriptor {
+		desc := ispec.Descriptor{Digest: digest.FromString(rootHash)}
+		if rootHash != "" {
+			desc.Annotations = map[string]string{squashfs.VerityRootHashAnnotation: rootHash}
+		}
+		return desc
+	}
+
+	chain, ok := verityChain([]ispec.Descriptor{layer("aaaa"), layer("bbbb")})
+	assert.True(ok)
+	assert.Equal(digest.FromString("aaaa\nbbbb\n"), chain)
+
+	// the order of the layers matters
+	reversed, _ := verityChain([]ispec.Descriptor{layer("bbbb"), layer("aaaa")})
+	assert.NotEqual(chain, reversed)
+
+	_, ok = verityChain([]ispec.Descriptor{layer(""), layer("bbbb")})
+	assert.False(ok)
+	_, ok = verityChain(nil)
+	assert.False(ok)
+
+	// a chain inherited from a base with verity data is dropped if the new
+	// layers don't have any
+	annotations := map[string]string{VerityChainAnnotation: chain.String()}
+	setVerityChain(types.StackerConfig{}, "test", "squashfs", []ispec.Descriptor{layer("aaaa"), layer("")}, annotations)
+	_, ok = annotations[VerityChainAnnotation]
+	assert.False(ok)
+
+	setVerityChain(types.StackerConfig{}, "test", "squashfs", []ispec.Descriptor{layer("aaaa"), layer("bbbb")}, annotations)
+	assert.Equal(chain.String(), annotations[VerityChainAnnotation])
+}
+
+func TestVerityInfoEnv(t *testing.T) {
+	assert := assert.New(t)
+
+	info := VerityInfo{
+		Chain: "sha256:1234",
+		Layers: []VerityLayer{
+			{Digest: "sha256:abcd", RootHash: "aaaa", HashOffset: 4096},
+		},
+	}
+
+	assert.Equal(`STACKER_VERITY_CHAIN=sha256:1234
+STACKER_VERITY_LAYERS=1
+STACKER_VERITY_LAYER_0_DIGEST=sha256:abcd
+STACKER_VERITY_LAYER_0_ROOT_HASH=aaaa
+STACKER_VERITY_LAYER_0_HASH_OFFSET=4096
+`, info.Env())
+}
@@ -0,0 +1,78 @@
+package stacker
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"time"
+
+	"github.com/anuvu/stacker/types"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// The media types of the wasm OCI artifact format, which containerd's wasm
+// shims (and other wasm runtimes) pull modules as.
+const (
+	WasmConfigMediaType = "application/vnd.wasm.config.v0+json"
+	WasmLayerMediaType  = "application/wasm"
+)
+
+// wasmMagic starts every wasm module.
+var wasmMagic = []byte("\x00asm")
+
+// wasmConfig is the config of a wasm OCI artifact.
+type wasmConfig struct {
+	Created      *time.Time `json:"created,omitempty"`
+	Author       string     `json:"author,omitempty"`
+	Architecture string     `json:"architecture"`
+	OS           string     `json:"os"`
+	LayerDigests []string   `json:"layerDigests"`
+}
+
+// checkWasmModule checks that file is a wasm module, rather than e.g. a
+// native binary built by mistake.
+func checkWasmModule(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(wasmMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || !bytes.Equal(magic, wasmMagic) {
+		return errors.Errorf("not a wasm module")
+	}
+
+	return nil
+}
+
+// wasmArtifact returns how to package l's wasm module.
+func wasmArtifact(config types.StackerConfig, l *types.Layer) (artifactSpec, error) {
+	wasmOS, err := l.Wasm.OS()
+	if err != nil {
+		return artifactSpec{}, err
+	}
+
+	author, _, err := l.ParseAuthor(config)
+	if err != nil {
+		return artifactSpec{}, err
+	}
+
+	return artifactSpec{
+		Path:            l.Wasm.Module,
+		FileMediaType:   WasmLayerMediaType,
+		Validate:        checkWasmModule,
+		ConfigMediaType: WasmConfigMediaType,
+		Config: func(blob ispec.Descriptor) (interface{}, error) {
+			now := time.Now()
+			return wasmConfig{
+				Created:      &now,
+				Author:       author,
+				Architecture: "wasm",
+				OS:           wasmOS,
+				LayerDigests: []string{blob.Digest.String()},
+			}, nil
+		},
+	}, nil
+}
@@ -0,0 +1,30 @@
+package stacker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckWasmModule(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "stacker_wasm_test")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	module := path.Join(dir, "app.wasm")
+	assert.NoError(ioutil.WriteFile(module, []byte("\x00asm\x01\x00\x00\x00"), 0644))
+	assert.NoError(checkWasmModule(module))
+
+	binary := path.Join(dir, "app")
+	assert.NoError(ioutil.WriteFile(binary, []byte("\x7fELF\x02\x01\x01"), 0755))
+	assert.Error(checkWasmModule(binary))
+
+	empty := path.Join(dir, "empty.wasm")
+	assert.NoError(ioutil.WriteFile(empty, nil, 0644))
+	assert.Error(checkWasmModule(empty))
+}
@@ -0,0 +1,183 @@
+package stacker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/anuvu/stacker/log"
+	"github.com/anuvu/stacker/types"
+	"github.com/pkg/errors"
+)
+
+// WebhookSignatureHeader is the header of webhook requests with the hex
+// HMAC-SHA256 of their body, keyed with the config's webhook_secret.
+const WebhookSignatureHeader = "X-Stacker-Signature-256"
+
+// The webhook events: a build or publish started, a layer was built (or
+// found in the cache), an image was published, and the build or publish
+// finished or failed.
+const (
+	EventStarted    = "started"
+	EventLayerBuilt = "layer_built"
+	EventPublished  = "published"
+	EventFinished   = "finished"
+	EventFailed     = "failed"
+)
+
+// WebhookEvent is the json body POSTed to the config's webhook_url.
+type WebhookEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+
+	// Operation is "build" or "publish".
+	Operation    string   `json:"operation"`
+	Stackerfiles []string `json:"stackerfiles,omitempty"`
+
+	Layer     *LayerReport   `json:"layer,omitempty"`
+	Published *PublishReport `json:"published,omitempty"`
+
+	// Report is the summary of the whole build or publish, sent with
+	// the finished and failed events.
+	Report *Report `json:"report,omitempty"`
+}
+
+// webhookQueueSize is how many events can wait to be sent before new ones
+// are dropped, and webhookFlushTimeout how long finish waits for them to be
+// sent.
+const webhookQueueSize = 256
+
+var webhookFlushTimeout = 30 * time.Second
+
+type webhook struct {
+	url       string
+	secret    string
+	operation string
+	client    *http.Client
+
+	// events are sent in order by a goroutine, so that a slow webhook
+	// doesn't slow down the build; pending counts the ones not sent yet
+	events  chan WebhookEvent
+	start   sync.Once
+	pending sync.WaitGroup
+}
+
+// newWebhook returns the webhook the build or publish operation sends its
+// events to, or nil if the config doesn't have one.
+func newWebhook(config types.StackerConfig, operation string) *webhook {
+	if config.WebhookURL == "" {
+		return nil
+	}
+
+	return &webhook{
+		url:       config.WebhookURL,
+		secret:    config.WebhookSecret,
+		operation: operation,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		events:    make(chan WebhookEvent, webhookQueueSize),
+	}
+}
+
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// send queues event to be POSTed to the webhook. Notifications are best
+// effort: if the webhook can't be reached (or can't keep up), the build
+// carries on.
+func (w *webhook) send(event WebhookEvent) {
+	if w == nil {
+		return
+	}
+
+	w.start.Do(func() { go w.run() })
+
+	event.Operation = w.operation
+	event.Time = time.Now().UTC()
+
+	w.pending.Add(1)
+	select {
+	case w.events <- event:
+	default:
+		w.pending.Done()
+		log.Infof("WARNING: too many events waiting for the webhook, dropping %s event", event.Event)
+	}
+}
+
+// run POSTs the queued events to the webhook.
+func (w *webhook) run() {
+	for event := range w.events {
+		if err := w.post(event); err != nil {
+			log.Infof("WARNING: couldn't send %s event to webhook: %v", event.Event, err)
+		}
+		w.pending.Done()
+	}
+}
+
+func (w *webhook) post(event WebhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrapf(err, "couldn't marshal event")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if w.secret != "" {
+		req.Header.Set(WebhookSignatureHeader, webhookSignature(w.secret, body))
+	}
+
+	log.Debugf("sending %s event to webhook %s", event.Event, redactURL(w.url))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("%s", resp.Status)
+	}
+
+	return nil
+}
+
+// finish sends the finished or failed event for the whole operation.
+func (w *webhook) finish(report *Report, start time.Time, err error) {
+	if w == nil {
+		return
+	}
+
+	// copy the report so the caller's stays as it was for Finish()
+	r := *report
+	r.Finish(start, err)
+
+	event := EventFinished
+	if err != nil {
+		event = EventFailed
+	}
+
+	w.send(WebhookEvent{Event: event, Report: &r})
+
+	// wait for the queued events to be sent, but not forever
+	sent := make(chan struct{})
+	go func() {
+		w.pending.Wait()
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(webhookFlushTimeout):
+		log.Infof("WARNING: gave up waiting for the webhook to receive the %s's events", w.operation)
+	}
+}
@@ -0,0 +1,85 @@
+package stacker
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anuvu/stacker/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhook(t *testing.T) {
+	assert := assert.New(t)
+
+	events := []WebhookEvent{}
+	signatures := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(err)
+
+		event := WebhookEvent{}
+		assert.NoError(json.Unmarshal(body, &event))
+		events = append(events, event)
+
+		signatures = append(signatures, r.Header.Get(WebhookSignatureHeader))
+		assert.Equal(webhookSignature("sekrit", body), r.Header.Get(WebhookSignatureHeader))
+	}))
+	defer server.Close()
+
+	assert.Nil(newWebhook(types.StackerConfig{}, "build"))
+
+	w := newWebhook(types.StackerConfig{WebhookURL: server.URL, WebhookSecret: "sekrit"}, "build")
+	w.send(WebhookEvent{Event: EventStarted, Stackerfiles: []string{"stacker.yaml"}})
+	w.send(WebhookEvent{Event: EventLayerBuilt, Layer: &LayerReport{Name: "foo"}})
+
+	report := &Report{FailedLayer: &LayerFailure{Name: "bar"}}
+	w.finish(report, time.Now(), errors.New("exit status 1"))
+
+	assert.Len(events, 3)
+	assert.Equal(EventStarted, events[0].Event)
+	assert.Equal("build", events[0].Operation)
+	assert.Equal([]string{"stacker.yaml"}, events[0].Stackerfiles)
+	assert.Equal("foo", events[1].Layer.Name)
+	assert.Equal(EventFailed, events[2].Event)
+	assert.Equal("exit status 1", events[2].Report.Error)
+	assert.Equal("bar", events[2].Report.FailedLayer.Name)
+
+	// the operation's own report isn't finished by the webhook
+	assert.Equal("", report.Error)
+
+	for _, s := range signatures {
+		assert.Regexp("^sha256=[0-9a-f]{64}$", s)
+	}
+
+	// unreachable webhooks don't stop anything
+	server.Close()
+	w.send(WebhookEvent{Event: EventFinished})
+}
+
+func TestSlowWebhook(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(old time.Duration) { webhookFlushTimeout = old }(webhookFlushTimeout)
+	webhookFlushTimeout = 100 * time.Millisecond
+
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+	defer close(unblock)
+
+	// neither the events nor finishing wait for the webhook for long
+	start := time.Now()
+	w := newWebhook(types.StackerConfig{WebhookURL: server.URL}, "build")
+	for i := 0; i < webhookQueueSize*2; i++ {
+		w.send(WebhookEvent{Event: EventLayerBuilt, Layer: &LayerReport{Name: "foo"}})
+	}
+	w.finish(&Report{}, time.Now(), nil)
+	assert.True(time.Since(start) < 5*time.Second)
+}